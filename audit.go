@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+// runAudit checks a finished output against its -journal: that the
+// journal is intact, that every entry's bytes are where it says with the
+// hash it says, and that every complete ranged response matches the part
+// of the output it was written to.
+func runAudit(args []string) {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	stdout := fs.String("stdout", "", "file the standard output of the run was saved to")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: gocat audit [-stdout <output>] <journal>")
+		os.Exit(1)
+	}
+
+	problems := 0
+	problem := func(format string, args ...any) {
+		fmt.Fprintf(os.Stderr, "FAILED: "+format+"\n", args...)
+		problems++
+	}
+
+	records, err := readJournal(fs.Arg(0))
+	if err != nil {
+		problem("%v", err)
+	}
+
+	a := &auditor{stdout: *stdout, files: map[string]*os.File{}}
+	defer a.close()
+
+	// Where each URL's bytes landed, for placing its responses.
+	placed := map[string][]journalRecord{}
+	for _, rec := range records {
+		if rec.Type != "entry" {
+			continue
+		}
+		if len(rec.Pipeline) > 0 {
+			fmt.Fprintf(os.Stderr, "skipping %s: transformed by %v\n", rec.URL, rec.Pipeline)
+			continue
+		}
+		ok, err := a.check(rec.Output, rec.Offset, rec.Bytes, rec.SHA256)
+		if err != nil {
+			problem("%s: %v", rec.URL, err)
+			continue
+		}
+		if !ok {
+			problem("%s: the %v bytes at %v of %s do not match the journal", rec.URL, rec.Bytes, rec.Offset, rec.Output)
+		}
+		// Checked against its responses even if wrong, to find the bad part.
+		placed[rec.URL] = append(placed[rec.URL], rec)
+	}
+
+	checked := 0
+	for _, rec := range records {
+		if !rec.complete() || rec.Bytes == 0 {
+			continue
+		}
+		entries := placed[rec.URL]
+		if len(entries) == 0 {
+			continue
+		}
+		first := int64(0)
+		if rec.Status == 206 {
+			if first, _, _, err = downloader.ParseContentRange(rec.ContentRange); err != nil {
+				problem("%s: %v", rec.URL, err)
+				continue
+			}
+		}
+
+		// The same URL may be listed more than once; any copy will do.
+		matched, covered := false, false
+		for _, e := range entries {
+			if first < e.First || first+rec.Bytes > e.First+e.Bytes {
+				continue
+			}
+			covered = true
+			ok, err := a.check(e.Output, e.Offset+first-e.First, rec.Bytes, rec.SHA256)
+			if err != nil {
+				problem("%s: %v", rec.URL, err)
+			}
+			if ok {
+				matched = true
+				break
+			}
+		}
+		if !covered {
+			// Bytes of an earlier, interrupted run.
+			continue
+		}
+		checked++
+		if !matched {
+			problem("%s: response for %v (%s) does not match the output", rec.URL, rec.Range, rec.Time)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "%v records, %v entries and %v responses checked\n",
+		len(records), len(placed), checked)
+	if problems > 0 {
+		fmt.Fprintf(os.Stderr, "AUDIT FAILED: %v problem(s)\n", problems)
+		os.Exit(1)
+	}
+	fmt.Fprintln(os.Stderr, "COMPLETED!")
+}
+
+type auditor struct {
+	stdout string
+	files  map[string]*os.File
+}
+
+// check reports whether n bytes at offset of output hash to want.
+func (a *auditor) check(output string, offset, n int64, want string) (bool, error) {
+	path := output
+	if output == "-" {
+		if a.stdout == "" {
+			return false, fmt.Errorf("went to stdout; name where it was saved with -stdout")
+		}
+		path = a.stdout
+	}
+	f, ok := a.files[path]
+	if !ok {
+		var err error
+		if f, err = os.Open(path); err != nil {
+			return false, err
+		}
+		a.files[path] = f
+	}
+	h := sha256.New()
+	copied, err := io.Copy(h, io.NewSectionReader(f, offset, n))
+	if err != nil {
+		return false, err
+	}
+	if copied != n {
+		return false, fmt.Errorf("%s ends before byte %v", path, offset+n)
+	}
+	return hex.EncodeToString(h.Sum(nil)) == want, nil
+}
+
+func (a *auditor) close() {
+	for _, f := range a.files {
+		f.Close()
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+const (
+	azureVersion      = "2021-08-06"
+	azureStorageScope = "https://storage.azure.com/.default"
+)
+
+// azureStore serves az://account/container/blob from Blob Storage. Access
+// comes from AZURE_STORAGE_CONNECTION_STRING, a SAS token in
+// AZURE_STORAGE_SAS_TOKEN, an account key in AZURE_STORAGE_KEY, a service
+// principal or workload identity in AZURE_TENANT_ID, AZURE_CLIENT_ID and
+// AZURE_CLIENT_SECRET or AZURE_FEDERATED_TOKEN_FILE, or managed identity;
+// without any, requests go anonymous for public containers.
+type azureStore struct {
+	once sync.Once
+	auth *azureAuth
+	err  error
+}
+
+// azureAuth is the first usable entry of the credential chain.
+type azureAuth struct {
+	// account, if set, is the only account key and sas apply to.
+	account  string
+	endpoint *url.URL
+	key      []byte
+	sas      url.Values
+	token    *cachedToken
+}
+
+func newAzureStore() *azureStore {
+	return &azureStore{}
+}
+
+func (s *azureStore) prepare(req *http.Request) error {
+	s.once.Do(func() { s.auth, s.err = azureCredentials() })
+	if s.err != nil {
+		return s.err
+	}
+	auth := s.auth
+	account := req.URL.Host
+	own := auth.account == "" || strings.EqualFold(auth.account, account)
+
+	u := &url.URL{
+		Scheme:   "https",
+		Host:     account + ".blob.core.windows.net",
+		Path:     req.URL.Path,
+		RawQuery: req.URL.RawQuery,
+	}
+	if own && auth.endpoint != nil {
+		u.Scheme, u.Host = auth.endpoint.Scheme, auth.endpoint.Host
+		u.Path = strings.TrimSuffix(auth.endpoint.Path, "/") + u.Path
+	}
+	if own && auth.sas != nil {
+		q := u.Query()
+		for k, v := range auth.sas {
+			q[k] = v
+		}
+		u.RawQuery = q.Encode()
+	}
+	req.URL, req.Host = u, ""
+	req.Header.Set("x-ms-version", azureVersion)
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+
+	switch {
+	case own && auth.sas != nil:
+	case own && auth.key != nil:
+		signSharedKey(req, account, auth.key)
+	case auth.token != nil:
+		token, err := auth.token.get(req.Context())
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return nil
+}
+
+func azureCredentials() (*azureAuth, error) {
+	if cs := os.Getenv("AZURE_STORAGE_CONNECTION_STRING"); cs != "" {
+		return parseConnectionString(cs)
+	}
+
+	account := os.Getenv("AZURE_STORAGE_ACCOUNT")
+	if sas := os.Getenv("AZURE_STORAGE_SAS_TOKEN"); sas != "" {
+		q, err := url.ParseQuery(strings.TrimPrefix(sas, "?"))
+		if err != nil {
+			return nil, &downloader.PermanentError{Err: fmt.Errorf("AZURE_STORAGE_SAS_TOKEN: %w", err)}
+		}
+		return &azureAuth{account: account, sas: q}, nil
+	}
+	if key := os.Getenv("AZURE_STORAGE_KEY"); key != "" {
+		b, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, &downloader.PermanentError{Err: fmt.Errorf("AZURE_STORAGE_KEY: %w", err)}
+		}
+		return &azureAuth{account: account, key: b}, nil
+	}
+
+	tenant, client := os.Getenv("AZURE_TENANT_ID"), os.Getenv("AZURE_CLIENT_ID")
+	if tenant != "" && client != "" {
+		authority := os.Getenv("AZURE_AUTHORITY_HOST")
+		if authority == "" {
+			authority = "https://login.microsoftonline.com"
+		}
+		endpoint := strings.TrimSuffix(authority, "/") + "/" + url.PathEscape(tenant) + "/oauth2/v2.0/token"
+		form := url.Values{
+			"grant_type": {"client_credentials"},
+			"client_id":  {client},
+			"scope":      {azureStorageScope},
+		}
+		if secret := os.Getenv("AZURE_CLIENT_SECRET"); secret != "" {
+			form.Set("client_secret", secret)
+			return &azureAuth{token: &cachedToken{fetch: func(ctx context.Context) (string, time.Time, error) {
+				return postToken(ctx, endpoint, form)
+			}}}, nil
+		}
+		if file := os.Getenv("AZURE_FEDERATED_TOKEN_FILE"); file != "" {
+			return &azureAuth{token: &cachedToken{fetch: func(ctx context.Context) (string, time.Time, error) {
+				// The projected token is rotated on disk; read it every time.
+				assertion, err := os.ReadFile(file)
+				if err != nil {
+					return "", time.Time{}, err
+				}
+				f := url.Values{}
+				for k, v := range form {
+					f[k] = v
+				}
+				f.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+				f.Set("client_assertion", strings.TrimSpace(string(assertion)))
+				return postToken(ctx, endpoint, f)
+			}}}, nil
+		}
+	}
+
+	identity := &cachedToken{fetch: managedIdentityToken}
+	// Off Azure the identity endpoint does not answer; go anonymous then.
+	if _, err := identity.get(context.Background()); err != nil {
+		return &azureAuth{}, nil
+	}
+	return &azureAuth{token: identity}, nil
+}
+
+// managedIdentityToken asks App Service's identity endpoint, or else the
+// VM instance metadata service, for a token.
+func managedIdentityToken(ctx context.Context) (string, time.Time, error) {
+	resource := strings.TrimSuffix(azureStorageScope, ".default")
+	var req *http.Request
+	var err error
+	if endpoint := os.Getenv("IDENTITY_ENDPOINT"); endpoint != "" {
+		q := url.Values{"api-version": {"2019-08-01"}, "resource": {resource}}
+		if id := os.Getenv("AZURE_CLIENT_ID"); id != "" {
+			q.Set("client_id", id)
+		}
+		req, err = http.NewRequestWithContext(ctx, "GET", endpoint+"?"+q.Encode(), nil)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		req.Header.Set("X-IDENTITY-HEADER", os.Getenv("IDENTITY_HEADER"))
+	} else {
+		q := url.Values{"api-version": {"2018-02-01"}, "resource": {resource}}
+		if id := os.Getenv("AZURE_CLIENT_ID"); id != "" {
+			q.Set("client_id", id)
+		}
+		req, err = http.NewRequestWithContext(ctx, "GET",
+			"http://169.254.169.254/metadata/identity/oauth2/token?"+q.Encode(), nil)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		req.Header.Set("Metadata", "true")
+	}
+	var tr tokenResponse
+	if err := fetchJSON(metadataClient, req, &tr); err != nil {
+		return "", time.Time{}, err
+	}
+	return tr.AccessToken, tr.expiry(), nil
+}
+
+// parseConnectionString reads the "Name=value;..." strings the portal and
+// Azurite hand out.
+func parseConnectionString(cs string) (*azureAuth, error) {
+	fields := map[string]string{}
+	for _, part := range strings.Split(cs, ";") {
+		if k, v, ok := strings.Cut(part, "="); ok {
+			fields[strings.ToLower(strings.TrimSpace(k))] = strings.TrimSpace(v)
+		}
+	}
+	auth := &azureAuth{account: fields["accountname"]}
+	if ep := fields["blobendpoint"]; ep != "" {
+		u, err := url.Parse(ep)
+		if err != nil || u.Host == "" {
+			return nil, &downloader.PermanentError{
+				Err: fmt.Errorf("AZURE_STORAGE_CONNECTION_STRING: invalid BlobEndpoint %q", ep),
+			}
+		}
+		auth.endpoint = u
+	} else if suffix := fields["endpointsuffix"]; suffix != "" && auth.account != "" {
+		scheme := fields["defaultendpointsprotocol"]
+		if scheme == "" {
+			scheme = "https"
+		}
+		auth.endpoint = &url.URL{Scheme: scheme, Host: auth.account + ".blob." + suffix}
+	}
+	if sas := fields["sharedaccesssignature"]; sas != "" {
+		q, err := url.ParseQuery(strings.TrimPrefix(sas, "?"))
+		if err != nil {
+			return nil, &downloader.PermanentError{Err: fmt.Errorf("AZURE_STORAGE_CONNECTION_STRING: %w", err)}
+		}
+		auth.sas = q
+	} else if key := fields["accountkey"]; key != "" {
+		b, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, &downloader.PermanentError{Err: fmt.Errorf("AZURE_STORAGE_CONNECTION_STRING: AccountKey: %w", err)}
+		}
+		auth.key = b
+	}
+	return auth, nil
+}
+
+// signSharedKey adds a Shared Key Authorization header.
+func signSharedKey(req *http.Request, account string, key []byte) {
+	h := req.Header
+	length := ""
+	if req.ContentLength > 0 {
+		length = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	var names []string
+	for name := range h {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-ms-") {
+			names = append(names, lower)
+		}
+	}
+	sort.Strings(names)
+	var canonHeaders []string
+	for _, name := range names {
+		canonHeaders = append(canonHeaders, name+":"+strings.TrimSpace(h.Get(name)))
+	}
+
+	resource := "/" + account + req.URL.EscapedPath()
+	q := req.URL.Query()
+	var params []string
+	for k := range q {
+		params = append(params, k)
+	}
+	sort.Strings(params)
+	for _, k := range params {
+		values := q[k]
+		sort.Strings(values)
+		resource += "\n" + strings.ToLower(k) + ":" + strings.Join(values, ",")
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		h.Get("Content-Encoding"),
+		h.Get("Content-Language"),
+		length,
+		h.Get("Content-MD5"),
+		h.Get("Content-Type"),
+		"", // Date; x-ms-date stands in.
+		h.Get("If-Modified-Since"),
+		h.Get("If-Match"),
+		h.Get("If-None-Match"),
+		h.Get("If-Unmodified-Since"),
+		h.Get("Range"),
+		strings.Join(canonHeaders, "\n"),
+		resource,
+	}, "\n")
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(stringToSign))
+	h.Set("Authorization", "SharedKey "+account+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
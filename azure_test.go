@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestSignSharedKey signs the requests of the examples in the Azure
+// Storage documentation of Shared Key authorization, whose strings to sign
+// it spells out.
+func TestSignSharedKey(t *testing.T) {
+	// The well-known key of the storage emulator.
+	key, _ := base64.StdEncoding.DecodeString("Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw==")
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		length int64
+		header map[string]string
+		toSign string
+	}{
+		{
+			name:   "container metadata",
+			method: "GET",
+			url:    "https://myaccount.blob.core.windows.net/mycontainer?restype=container&comp=metadata&timeout=20",
+			header: map[string]string{"x-ms-date": "Sun, 11 Oct 2009 21:49:13 GMT", "x-ms-version": "2009-09-19"},
+			toSign: "GET\n\n\n\n\n\n\n\n\n\n\n\n" +
+				"x-ms-date:Sun, 11 Oct 2009 21:49:13 GMT\nx-ms-version:2009-09-19\n" +
+				"/myaccount/mycontainer\ncomp:metadata\nrestype:container\ntimeout:20",
+		},
+		{
+			name:   "list with several includes",
+			method: "GET",
+			url:    "https://myaccount.blob.core.windows.net/mycontainer?restype=container&comp=list&include=snapshots&include=metadata&include=uncommittedblobs",
+			header: map[string]string{"x-ms-date": "Fri, 26 Jun 2015 23:39:12 GMT", "x-ms-version": "2015-02-21"},
+			toSign: "GET\n\n\n\n\n\n\n\n\n\n\n\n" +
+				"x-ms-date:Fri, 26 Jun 2015 23:39:12 GMT\nx-ms-version:2015-02-21\n" +
+				"/myaccount/mycontainer\ncomp:list\ninclude:metadata,snapshots,uncommittedblobs\nrestype:container",
+		},
+		{
+			name:   "put blob",
+			method: "PUT",
+			url:    "https://myaccount.blob.core.windows.net/mycontainer/hello%20world.txt",
+			length: 11,
+			header: map[string]string{
+				"Content-Type":   "text/plain; charset=UTF-8",
+				"x-ms-blob-type": "BlockBlob",
+				"x-ms-date":      "Fri, 26 Jun 2015 23:39:12 GMT",
+				"x-ms-version":   "2015-02-21",
+			},
+			toSign: "PUT\n\n\n11\n\ntext/plain; charset=UTF-8\n\n\n\n\n\n\n" +
+				"x-ms-blob-type:BlockBlob\nx-ms-date:Fri, 26 Jun 2015 23:39:12 GMT\nx-ms-version:2015-02-21\n" +
+				"/myaccount/mycontainer/hello%20world.txt",
+		},
+		{
+			// Since version 2015-02-21 a zero length is left empty.
+			name:   "ranged get",
+			method: "GET",
+			url:    "https://myaccount.blob.core.windows.net/mycontainer/blob",
+			header: map[string]string{
+				"Range":        "bytes=0-9",
+				"x-ms-date":    "Fri, 26 Jun 2015 23:39:12 GMT",
+				"x-ms-version": "2015-02-21",
+			},
+			toSign: "GET\n\n\n\n\n\n\n\n\n\n\nbytes=0-9\n" +
+				"x-ms-date:Fri, 26 Jun 2015 23:39:12 GMT\nx-ms-version:2015-02-21\n" +
+				"/myaccount/mycontainer/blob",
+		},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := &http.Request{Method: tt.method, URL: u, Header: http.Header{}, ContentLength: tt.length}
+		for k, v := range tt.header {
+			req.Header.Set(k, v)
+		}
+		signSharedKey(req, "myaccount", key)
+
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(tt.toSign))
+		want := "SharedKey myaccount:" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+		if got := req.Header.Get("Authorization"); got != want {
+			t.Errorf("%v: got %v, want %v, the signature of\n%v", tt.name, got, want, strings.ReplaceAll(tt.toSign, "\n", `\n`))
+		}
+	}
+}
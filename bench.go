@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// benchTolerance is how much slower than the fastest trial a setting with
+// fewer connections may be and still be recommended over it.
+const benchTolerance = 0.05
+
+// benchMaxRetryRate is the share of failed requests above which a trial is
+// not recommended however fast it was: the origin is pushing back.
+const benchMaxRetryRate = 0.1
+
+type benchTrial struct {
+	chunkMB, parallel int
+	bytes             int64
+	elapsed           time.Duration
+	requests          int64
+	retries           int64
+	err               error
+}
+
+func (t *benchTrial) throughput() float64 {
+	if t.elapsed <= 0 {
+		return 0
+	}
+	return float64(t.bytes) / t.elapsed.Seconds()
+}
+
+func (t *benchTrial) retryRate() float64 {
+	return float64(t.retries) / float64(max(t.requests+t.retries, 1))
+}
+
+// runBench is gocat bench: it downloads the first -sample bytes of url
+// with every combination of -chunks and -parallel, and recommends the
+// fastest that the origin does not push back on, preferring fewer
+// connections when they are about as fast.
+func runBench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	registerFlags(fs)
+	sample := byteSize(64 << 20)
+	fs.Var(&sample, "sample", "bytes of the object each trial downloads")
+	chunks := fs.String("chunks", "1,4,16,64", "chunk sizes to try, in MB")
+	parallel := fs.String("parallel", "1,4,8,16", "numbers of chunks in flight to try")
+	write := fs.Bool("write-config", false, "set -b and -p in the config file to the recommendation")
+	parseFlags(fs, args)
+
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: gocat bench [options] [-sample <size>] [-chunks <MB,...>] [-parallel <n,...>] [-write-config] <url>")
+		os.Exit(1)
+	}
+	sizes, err := parseCounts("chunks", *chunks)
+	if err != nil {
+		log.Fatal(err)
+	}
+	workers, err := parseCounts("parallel", *parallel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if sample <= 0 {
+		log.Fatalf("invalid -sample %v: want more than 0", int64(sample))
+	}
+	if err := setup(); err != nil {
+		log.Fatal(err)
+	}
+
+	ctx := interruptContext()
+	url := fs.Arg(0)
+	info, err := dl.Stat(ctx, url)
+	if err != nil {
+		fatal(ctx, err)
+	}
+	if !info.Ranges || info.Size <= 0 {
+		log.Fatalf("%s: benchmarking needs a server that serves ranges of an object of known size", url)
+	}
+	end := min(int64(sample), info.Size)
+
+	var retried atomic.Int64
+	dl.OnRetry = func(string, error, time.Duration) { retried.Add(1) }
+	dl.OnChunk = nil
+	dl.AdaptiveChunks = false
+	dl.Hedge = false
+
+	var trials []*benchTrial
+	for _, b := range sizes {
+		for _, p := range workers {
+			t := &benchTrial{chunkMB: b, parallel: p}
+			dl.ChunkSize = int64(b) << 20
+			dl.Workers = p
+			dl.HugeWorkers = p
+			t.requests = (end + dl.ChunkSize - 1) / dl.ChunkSize
+			retried.Store(0)
+			infof("trying -b %v -p %v", b, p)
+			start := time.Now()
+			t.bytes, t.err = dl.DownloadRange(ctx, url, info.Size, 0, end, io.Discard)
+			t.elapsed = time.Since(start)
+			t.retries = retried.Load()
+			if ctx.Err() != nil {
+				fatal(ctx, ctx.Err())
+			}
+			trials = append(trials, t)
+		}
+	}
+
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "-b\t-p\tMB/s\trequests\tretries")
+	for _, t := range trials {
+		if t.err != nil {
+			fmt.Fprintf(tw, "%v\t%v\tFAIL\t%v\t%v\t%v\n", t.chunkMB, t.parallel, t.requests, t.retries, t.err)
+			continue
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%.1f\t%v\t%v\n",
+			t.chunkMB, t.parallel, t.throughput()/(1<<20), t.requests, t.retries)
+	}
+	tw.Flush()
+	os.Stdout.Write(buf.Bytes())
+
+	best := recommend(trials)
+	if best == nil {
+		fmt.Fprintln(os.Stderr, "FAILED: no trial finished without the origin pushing back")
+		os.Exit(1)
+	}
+	fmt.Printf("recommended: -b %v -p %v (%.1f MB/s)\n", best.chunkMB, best.parallel, best.throughput()/(1<<20))
+
+	if *write {
+		path, _ := configPath()
+		if path == "" {
+			log.Fatal("no config file to write: pass -config")
+		}
+		err := setConfig(path, []configOption{
+			{name: "b", values: []string{strconv.Itoa(best.chunkMB)}},
+			{name: "p", values: []string{strconv.Itoa(best.parallel)}},
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		infof("wrote -b %v -p %v to %s", best.chunkMB, best.parallel, path)
+	}
+}
+
+// recommend picks the trial with the fewest connections, then the largest
+// chunks, of those within benchTolerance of the fastest acceptable one.
+func recommend(trials []*benchTrial) *benchTrial {
+	var ok []*benchTrial
+	fastest := 0.0
+	for _, t := range trials {
+		if t.err == nil && t.retryRate() <= benchMaxRetryRate {
+			ok = append(ok, t)
+			fastest = max(fastest, t.throughput())
+		}
+	}
+	var best *benchTrial
+	for _, t := range ok {
+		if t.throughput() < fastest*(1-benchTolerance) {
+			continue
+		}
+		if best == nil || t.parallel < best.parallel ||
+			t.parallel == best.parallel && t.chunkMB > best.chunkMB {
+			best = t
+		}
+	}
+	return best
+}
+
+// parseCounts parses the comma-separated positive numbers of the named flag.
+func parseCounts(name, s string) ([]int, error) {
+	var counts []int
+	for _, f := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid -%s %q: want numbers above 0, separated by commas", name, s)
+		}
+		counts = append(counts, n)
+	}
+	return counts, nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// A bundle is a tar archive holding each list entry's bytes as data/NNNNNN,
+// in list order, followed by bundle.json describing them. It lets a
+// download be carried to an air-gapped host and replayed there.
+const bundleManifestName = "bundle.json"
+
+type bundleEntry struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type bundleManifest struct {
+	Version int           `json:"version"`
+	Created time.Time     `json:"created"`
+	Source  string        `json:"source"`
+	Entries []bundleEntry `json:"entries"`
+}
+
+func runBundle(args []string) {
+	fs := flag.NewFlagSet("bundle", flag.ExitOnError)
+	registerFlags(fs)
+	out := fs.String("o", "", "bundle file to create")
+	parseFlags(fs, args)
+
+	if *out == "" || fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: gocat bundle [options] -o <bundle> <url>")
+		os.Exit(1)
+	}
+
+	if err := setup(); err != nil {
+		log.Fatal(err)
+	}
+
+	ctx := interruptContext()
+	files, err := loadList(ctx, fs.Arg(0))
+	if err != nil {
+		fatal(ctx, err)
+	}
+
+	if err := writeBundle(ctx, *out, fs.Arg(0), files); err != nil {
+		printRetryReport()
+		fatal(ctx, err)
+	}
+
+	printRetryReport()
+	fmt.Fprintln(os.Stderr, "COMPLETED!")
+}
+
+// writeBundle builds the archive under a temporary name and renames it into
+// place only once every entry has been written and hashed.
+func writeBundle(ctx context.Context, path, source string, files []string) (err error) {
+	tmp := path + ".part"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	tw := tar.NewWriter(f)
+	manifest := bundleManifest{Version: 1, Created: time.Now().UTC(), Source: source}
+	for i, file := range files {
+		info, err := checkHeaders(ctx, file)
+		if err != nil {
+			return err
+		}
+		size := info.Size
+		if size < 0 {
+			return fmt.Errorf("%s: a bundle needs the size of every entry", file)
+		}
+
+		name := fmt.Sprintf("data/%06d", i)
+		err = tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0644,
+			Size:     size,
+			ModTime:  manifest.Created,
+		})
+		if err != nil {
+			return err
+		}
+
+		h := sha256.New()
+		_, written, err := downloadAndWrite(ctx, file, io.MultiWriter(tw, h))
+		if err != nil {
+			return err
+		}
+		if written != size {
+			return fmt.Errorf("%s: expected %v bytes, got %v", file, size, written)
+		}
+
+		manifest.Entries = append(manifest.Entries, bundleEntry{
+			Name:   name,
+			URL:    file,
+			Size:   size,
+			SHA256: hex.EncodeToString(h.Sum(nil)),
+		})
+	}
+
+	body, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     bundleManifestName,
+		Mode:     0644,
+		Size:     int64(len(body)),
+		ModTime:  manifest.Created,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := tw.Write(body); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func runUnbundle(args []string) {
+	fs := flag.NewFlagSet("unbundle", flag.ExitOnError)
+	verifyOnly := fs.Bool("verify", false, "check the bundle's hashes without writing any output")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: gocat unbundle [-verify] <bundle>")
+		os.Exit(1)
+	}
+
+	var out io.Writer = os.Stdout
+	if *verifyOnly {
+		out = io.Discard
+	}
+	if err := replayBundle(fs.Arg(0), out); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintln(os.Stderr, "COMPLETED!")
+}
+
+func readBundleManifest(path string) (*bundleManifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%v: no %v found", path, bundleManifestName)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name != bundleManifestName {
+			continue
+		}
+
+		var m bundleManifest
+		if err := json.NewDecoder(tr).Decode(&m); err != nil {
+			return nil, fmt.Errorf("%v: %w", bundleManifestName, err)
+		}
+		if m.Version != 1 {
+			return nil, fmt.Errorf("unsupported bundle version %v", m.Version)
+		}
+		return &m, nil
+	}
+}
+
+// replayBundle writes the bundled entries to w in their original order,
+// failing on the first entry whose size or hash disagrees with the
+// manifest.
+func replayBundle(path string, w io.Writer) error {
+	manifest, err := readBundleManifest(path)
+	if err != nil {
+		return err
+	}
+	byName := map[string]bundleEntry{}
+	for _, e := range manifest.Entries {
+		byName[e.Name] = e
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	replayed := 0
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		entry, ok := byName[hdr.Name]
+		if !ok {
+			continue
+		}
+		if entry.Name != manifest.Entries[replayed].Name {
+			return fmt.Errorf("%v: entry %v is out of order", path, hdr.Name)
+		}
+
+		infof("replaying %v/%v %s", replayed+1, len(manifest.Entries), entry.URL)
+
+		h := sha256.New()
+		n, err := io.Copy(io.MultiWriter(w, h), tr)
+		if err != nil {
+			return err
+		}
+		if n != entry.Size {
+			return fmt.Errorf("%s: expected %v bytes, got %v", entry.URL, entry.Size, n)
+		}
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != entry.SHA256 {
+			return fmt.Errorf("%s: sha256 mismatch: expected %v, got %v", entry.URL, entry.SHA256, sum)
+		}
+		replayed++
+	}
+
+	if replayed != len(manifest.Entries) {
+		return fmt.Errorf("%v: %v of %v entries present", path, replayed, len(manifest.Entries))
+	}
+	return nil
+}
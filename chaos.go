@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The chaos flags are left out of -h; they exist to test retry and
+// verification settings, not for real transfers.
+var (
+	ChaosDropRate    float64
+	ChaosCorruptRate float64
+	ChaosLatency     time.Duration
+)
+
+var errChaosDrop = errors.New("chaos: connection dropped")
+
+func chaosEnabled() bool {
+	return ChaosDropRate > 0 || ChaosCorruptRate > 0 || ChaosLatency > 0
+}
+
+// chaosTransport delays requests by up to ChaosLatency, fails or cuts off
+// a ChaosDropRate share of them and flips one byte in a ChaosCorruptRate
+// share of response bodies.
+type chaosTransport struct {
+	base http.RoundTripper
+}
+
+func (t *chaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if ChaosLatency > 0 {
+		select {
+		case <-time.After(rand.N(ChaosLatency)):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+
+	drop := rand.Float64() < ChaosDropRate
+	// Half the drops happen before any response, half mid-body.
+	if drop && rand.IntN(2) == 0 {
+		return nil, errChaosDrop
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.ContentLength == 0 {
+		return resp, err
+	}
+
+	body := &chaosBody{ReadCloser: resp.Body, cut: -1, flip: -1}
+	length := resp.ContentLength
+	if length < 0 {
+		length = 1 << 20
+	}
+	if drop {
+		body.cut = rand.Int64N(length)
+	}
+	if rand.Float64() < ChaosCorruptRate {
+		body.flip = rand.Int64N(length)
+	}
+	resp.Body = body
+	return resp, nil
+}
+
+type chaosBody struct {
+	io.ReadCloser
+	read int64
+	cut  int64
+	flip int64
+}
+
+func (b *chaosBody) Read(p []byte) (int, error) {
+	if b.cut >= 0 && b.read >= b.cut {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if b.cut >= 0 && b.read+int64(len(p)) > b.cut {
+		p = p[:b.cut-b.read]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if b.flip >= b.read && b.flip < b.read+int64(n) {
+		p[b.flip-b.read] ^= 0xff
+	}
+	b.read += int64(n)
+	return n, err
+}
+
+func registerChaosFlags(fs *flag.FlagSet) {
+	fs.Float64Var(&ChaosDropRate, "chaos-drop-rate", 0,
+		"share of requests to fail or cut off mid-body")
+	fs.Float64Var(&ChaosCorruptRate, "chaos-corrupt-rate", 0,
+		"share of responses to corrupt one byte of")
+	fs.DurationVar(&ChaosLatency, "chaos-latency", 0, "delay requests by up to this long")
+
+	fs.Usage = func() {
+		visible := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+		visible.SetOutput(fs.Output())
+		fs.VisitAll(func(f *flag.Flag) {
+			if !strings.HasPrefix(f.Name, "chaos-") {
+				visible.Var(f.Value, f.Name, f.Usage)
+			}
+		})
+		fmt.Fprintf(fs.Output(), "Usage of %s:\n", fs.Name())
+		visible.PrintDefaults()
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	neturl "net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+var SHA256Sums string
+
+var WarnSizeMismatch bool
+
+var sha256Sums map[string]string
+
+var checksumHashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"crc32":  func() hash.Hash { return newParallelCRC(crc32.IEEE) },
+	"crc32c": func() hash.Hash { return newParallelCRC(crc32.Castagnoli) },
+}
+
+// loadSHA256Sums reads a manifest in sha256sum output format from a URL
+// or a local file.
+func loadSHA256Sums(ctx context.Context, src string) (map[string]string, error) {
+	var data []byte
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		var err error
+		if data, err = dl.FetchList(ctx, src); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if data, err = os.ReadFile(src); err != nil {
+			return nil, err
+		}
+	}
+
+	sums := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		sum, name, ok := strings.Cut(text, " ")
+		raw, err := hex.DecodeString(sum)
+		if !ok || err != nil || len(raw) != sha256.Size {
+			return nil, fmt.Errorf("%v:%v: not a sha256sum line", src, line)
+		}
+		// sha256sum marks binary mode with '*' before the name.
+		name = strings.TrimPrefix(strings.TrimLeft(name, " "), "*")
+		sums[name] = strings.ToLower(sum)
+	}
+	return sums, scanner.Err()
+}
+
+// manifestSum finds url in the -sha256sums manifest, by full URL or by the
+// last segment of its path.
+func manifestSum(url string) (string, bool) {
+	if sum, ok := sha256Sums[url]; ok {
+		return sum, true
+	}
+	u, err := neturl.Parse(url)
+	if err != nil {
+		return "", false
+	}
+	sum, ok := sha256Sums[path.Base(u.Path)]
+	return sum, ok
+}
+
+// checkListedSize fails when size, if known, is not the size= the list
+// gave for url, or only warns with -warn-size-mismatch.
+func checkListedSize(url string, size int64) error {
+	meta, ok := dl.Meta(url)
+	if !ok || meta.Size < 0 || size < 0 || size == meta.Size {
+		return nil
+	}
+	err := fmt.Errorf("%s: %v bytes, but the list says %v", url, size, meta.Size)
+	if WarnSizeMismatch {
+		warnf("%v", err)
+		return nil
+	}
+	return &downloader.PermanentError{Err: err}
+}
+
+// limitListedSize returns w failing the write that would take url, from
+// byte start, past the size= its list gives, so that an entry the server
+// does not give the size of is cut off there rather than found too long
+// at its end. It is w itself when there is no size to hold url to.
+func limitListedSize(url string, start int64, w io.Writer) io.Writer {
+	meta, ok := dl.Meta(url)
+	if !ok || meta.Size < 0 || WarnSizeMismatch {
+		return w
+	}
+	return &sizeLimit{url: url, w: w, n: start, size: meta.Size}
+}
+
+type sizeLimit struct {
+	url     string
+	w       io.Writer
+	n, size int64
+}
+
+func (l *sizeLimit) Write(p []byte) (int, error) {
+	if l.n+int64(len(p)) > l.size {
+		return 0, &downloader.PermanentError{Err: fmt.Errorf("%s: more than the %v bytes the list says", l.url, l.size)}
+	}
+	n, err := l.w.Write(p)
+	l.n += int64(n)
+	return n, err
+}
+
+// verifier hashes an entry while it streams and compares the result with
+// every digest known for it.
+type verifier struct {
+	url      string
+	expected map[string]string
+	hashes   map[string]hash.Hash
+	// all feeds every hash at once.
+	all io.Writer
+}
+
+// newVerifier returns nil when nothing is known to check url against.
+func newVerifier(url string, info downloader.Info) *verifier {
+	expected := map[string]string{}
+	for algo, sum := range info.Digests {
+		expected[algo] = sum
+	}
+	if sum, ok := manifestSum(url); ok {
+		expected["sha256"] = sum
+	}
+	if meta, ok := dl.Meta(url); ok && meta.SHA256 != "" {
+		expected["sha256"] = meta.SHA256
+	}
+	if len(expected) == 0 {
+		return nil
+	}
+
+	v := &verifier{url: url, expected: expected, hashes: map[string]hash.Hash{}}
+	for algo := range expected {
+		if newHash, ok := checksumHashes[algo]; ok {
+			v.hashes[algo] = newHash()
+		}
+	}
+	if len(v.hashes) == 0 {
+		return nil
+	}
+	ws := make([]io.Writer, 0, len(v.hashes))
+	for _, h := range v.hashes {
+		ws = append(ws, h)
+	}
+	v.all = fanOut(ws...)
+	return v
+}
+
+func (v *verifier) Write(p []byte) (int, error) {
+	return v.all.Write(p)
+}
+
+func (v *verifier) verify() error {
+	algos := make([]string, 0, len(v.hashes))
+	for algo := range v.hashes {
+		algos = append(algos, algo)
+	}
+	sort.Strings(algos)
+	for _, algo := range algos {
+		got := hex.EncodeToString(v.hashes[algo].Sum(nil))
+		if got != v.expected[algo] {
+			return fmt.Errorf("%s: %v mismatch: expected %v, got %v",
+				v.url, algo, v.expected[algo], got)
+		}
+	}
+	return nil
+}
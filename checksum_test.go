@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListedSize(t *testing.T) {
+	content := []byte("0123456789")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/missing" {
+			http.NotFound(w, req)
+			return
+		}
+		if req.URL.Path == "/known" {
+			http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(content))
+			return
+		}
+		// Chunked, without a length or ranges.
+		if req.Method == "GET" {
+			w.Write(content[:5])
+			w.(http.Flusher).Flush()
+			w.Write(content[5:])
+		}
+	}))
+	t.Cleanup(srv.Close)
+	base, _ := url.Parse(srv.URL + "/")
+
+	tests := []struct {
+		line string
+		warn bool
+		// want is the failure, if any.
+		want string
+	}{
+		{"/known size=10", false, ""},
+		{"/known size=9", false, "10 bytes, but the list says 9"},
+		{"/known size=9", true, ""},
+		{"/chunked size=10", false, ""},
+		{"/chunked size=7", false, "more than the 7 bytes the list says"},
+		{"/chunked size=12", false, "10 bytes, but the list says 12"},
+		{"/chunked size=7", true, ""},
+		{"/missing size=10", false, "404"},
+	}
+	for _, tt := range tests {
+		r, out, _ := testRun(t, func() {
+			SkipFailed = true
+			MaxRetry = 1
+			WarnSizeMismatch = tt.warn
+		})
+		var entry string
+		err := dl.ScanList(context.Background(), strings.NewReader(tt.line), "list", base, func(e string) error {
+			entry = e
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		runEntries(t, r, entry)
+
+		failures := strings.Join(r.failures, "\n")
+		switch {
+		case tt.want == "" && (failures != "" || !bytes.Equal(out.Bytes(), content)):
+			t.Errorf("%q (warn %v): wrote %q, failures %q; want the entry", tt.line, tt.warn, out.Bytes(), failures)
+		case tt.want != "" && !strings.Contains(failures, tt.want):
+			t.Errorf("%q: failures %q, want %q", tt.line, failures, tt.want)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+// divergence is a byte range where a local concatenated output differs
+// from what its source serves. Offsets are given both within the source
+// file and within the output.
+type divergence struct {
+	URL        string
+	FileOffset int64
+	OutOffset  int64
+	Length     int64
+}
+
+func (d divergence) String() string {
+	return fmt.Sprintf(
+		"%s: file bytes [%v, %v), output bytes [%v, %v)",
+		d.URL,
+		d.FileOffset,
+		d.FileOffset+d.Length,
+		d.OutOffset,
+		d.OutOffset+d.Length,
+	)
+}
+
+// compareOutput lays files out back to back as a plain run would, reads
+// every block of f and compares it with a ranged read of the source. For
+// each block that differs it records the exact differing byte range and,
+// when fix is set, writes the remote bytes over the local ones. f is
+// finally truncated to the expected total length when fixing.
+//
+// Without piece hashes to compare against, every block has to be fetched;
+// only the writes are limited to the damaged regions.
+func compareOutput(ctx context.Context, f *os.File, files []string, fix bool) ([]divergence, error) {
+	batchSize := int64(BatchSizeInMB) << 20
+
+	var found []divergence
+	add := func(d divergence) {
+		if n := len(found); n > 0 {
+			last := &found[n-1]
+			if last.URL == d.URL && last.FileOffset+last.Length == d.FileOffset {
+				last.Length += d.Length
+				return
+			}
+		}
+		found = append(found, d)
+	}
+
+	local := make([]byte, batchSize)
+	base := int64(0)
+	for _, file := range files {
+		info, err := checkHeaders(ctx, file)
+		if err != nil {
+			return nil, err
+		}
+		if !info.Ranges {
+			return nil, fmt.Errorf("%s: comparing needs a server that serves ranges", file)
+		}
+		contentLen := info.Size
+
+		infof("comparing [%v, %v) against %s", base, base+contentLen, file)
+
+		for offset := int64(0); offset < contentLen; offset += batchSize {
+			offsetTo := offset + batchSize
+			if offsetTo > contentLen {
+				offsetTo = contentLen
+			}
+
+			remote, err := dl.FetchRange(ctx, file, downloader.ClosedRange(offset, offsetTo-1))
+			if err != nil {
+				return nil, err
+			}
+			if int64(len(remote)) != offsetTo-offset {
+				return nil, fmt.Errorf(
+					"%s: expected %v bytes at %v, got %v",
+					file, offsetTo-offset, offset, len(remote),
+				)
+			}
+
+			n, err := f.ReadAt(local[:len(remote)], base+offset)
+			if err != nil && !errors.Is(err, io.EOF) {
+				return nil, err
+			}
+
+			from, to, differs := diffRange(local[:n], remote)
+			if !differs {
+				continue
+			}
+
+			add(divergence{
+				URL:        file,
+				FileOffset: offset + from,
+				OutOffset:  base + offset + from,
+				Length:     to - from,
+			})
+			if fix {
+				if _, err := f.WriteAt(remote[from:to], base+offset+from); err != nil {
+					return nil, err
+				}
+			}
+		}
+		base += contentLen
+	}
+
+	if fix {
+		if err := f.Truncate(base); err != nil {
+			return nil, err
+		}
+		if err := f.Sync(); err != nil {
+			return nil, err
+		}
+	} else if st, err := f.Stat(); err == nil && st.Size() > base {
+		fmt.Fprintf(
+			os.Stderr,
+			"output has %v trailing bytes beyond the expected %v\n",
+			st.Size()-base,
+			base,
+		)
+	}
+	return found, nil
+}
+
+// diffRange returns the smallest [from, to) covering every byte where local
+// differs from remote. A local block shorter than remote differs over its
+// missing tail.
+func diffRange(local, remote []byte) (from, to int64, differs bool) {
+	if bytes.Equal(local, remote) {
+		return 0, 0, false
+	}
+
+	first := 0
+	for first < len(local) && local[first] == remote[first] {
+		first++
+	}
+	last := len(remote)
+	if len(local) == len(remote) {
+		for last > first && local[last-1] == remote[last-1] {
+			last--
+		}
+	}
+	return int64(first), int64(last), true
+}
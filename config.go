@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	ConfigFile string
+	Profile    string
+)
+
+// sharedFlags are the names registerFlags defines. Only these are taken
+// from the environment and the config file for a subcommand, whose own
+// flags may mean something else under the same name.
+var sharedFlags = map[string]bool{}
+
+// envNames are the environment variables of flags whose upper-cased name
+// would be taken by another flag.
+var envNames = map[string]string{"O": "GOCAT_REMOTE_NAME"}
+
+// flagEnv returns the environment variable setting the named flag: -m is
+// GOCAT_M and -connect-timeout GOCAT_CONNECT_TIMEOUT.
+func flagEnv(name string) string {
+	if env, ok := envNames[name]; ok {
+		return env
+	}
+	return "GOCAT_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// parseFlags parses args into flags, which registerFlags set up, and then
+// gives each flag args left out its GOCAT_* environment variable or, after
+// that, its value in the config file: in the -profile section, else at the
+// top level.
+func parseFlags(flags *flag.FlagSet, args []string) {
+	flags.Parse(args)
+	if err := applyConfig(flags); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func applyConfig(flags *flag.FlagSet) error {
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var errs []error
+	flags.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] || f.Name == "config" || !configurable(flags, f.Name) {
+			return
+		}
+		env := flagEnv(f.Name)
+		v, ok := os.LookupEnv(env)
+		if !ok {
+			return
+		}
+		if err := flags.Set(f.Name, configBool(f, v)); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s=%q: %w", env, v, err))
+		}
+		set[f.Name] = true
+	})
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	path, explicit := configPath()
+	if path == "" {
+		return nil
+	}
+	options, profiles, err := readConfig(path)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	if Profile != "" && !slices.Contains(profiles, Profile) {
+		return fmt.Errorf("%s: no profile %q", path, Profile)
+	}
+
+	known := func(o configOption) bool {
+		return flags.Lookup(o.name) != nil && o.name != "config" && o.name != "profile" && configurable(flags, o.name)
+	}
+	for _, o := range options {
+		// The file is shared by every subcommand; only the default one
+		// knows every option, of every profile.
+		if !known(o) && flags == flag.CommandLine {
+			return fmt.Errorf("%s:%d: unknown option %q", path, o.line, o.name)
+		}
+	}
+
+	// The profile's options go first, and win over the top level's.
+	sections := []string{""}
+	if Profile != "" {
+		sections = []string{Profile, ""}
+	}
+	for _, section := range sections {
+		applied := map[string]bool{}
+		for _, o := range options {
+			if o.profile != section || !known(o) || set[o.name] {
+				continue
+			}
+			f := flags.Lookup(o.name)
+			for _, v := range o.values {
+				if err := flags.Set(o.name, configBool(f, v)); err != nil {
+					return fmt.Errorf("%s:%d: invalid %s: %w", path, o.line, o.name, err)
+				}
+			}
+			applied[o.name] = true
+		}
+		maps.Copy(set, applied)
+	}
+	return nil
+}
+
+// configPath returns the config file: -config, else $GOCAT_CONFIG, else
+// config.yaml in the user's config directory, which need not exist; path is
+// empty when there is none.
+func configPath() (path string, explicit bool) {
+	if ConfigFile != "" {
+		return ConfigFile, true
+	}
+	if env, ok := os.LookupEnv("GOCAT_CONFIG"); ok {
+		return env, true
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		return filepath.Join(dir, "gocat", "config.yaml"), false
+	}
+	return "", false
+}
+
+// configurable reports whether the named flag of flags is taken from the
+// environment and the config file.
+func configurable(flags *flag.FlagSet, name string) bool {
+	return flags == flag.CommandLine || sharedFlags[name]
+}
+
+// configBool turns the YAML spellings of a boolean into Go's, for a
+// boolean flag.
+func configBool(f *flag.Flag, v string) string {
+	if b, ok := f.Value.(interface{ IsBoolFlag() bool }); !ok || !b.IsBoolFlag() {
+		return v
+	}
+	switch strings.ToLower(v) {
+	case "yes", "on", "y":
+		return "true"
+	case "no", "off", "n":
+		return "false"
+	}
+	return v
+}
+
+// configOption is one key of the config file and its values, several for
+// a repeatable flag. profile is the section of profiles it is in, or
+// empty at the top level.
+type configOption struct {
+	name    string
+	values  []string
+	line    int
+	profile string
+}
+
+// readConfig reads the YAML config file at path, and the names of its
+// profiles. Only what flags need of YAML is understood: a mapping of flag
+// names, without the dash, to a scalar or to a list of them, either as
+// [a, b] or as "- a" lines below the key, and under profiles, named
+// mappings of the same.
+//
+//	m: 10
+//	connect-timeout: 5s
+//	H:
+//	  - "X-Token: abc"
+//	  - "Accept: */*"
+//	profiles:
+//	  slow-mirror:
+//	    m: 500
+//	    limit-rate: 1M
+func readConfig(path string) (options []configOption, profiles []string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	// list is the index of the key whose "- a" lines follow, or -1, and
+	// listIndent its indentation.
+	list, listIndent := -1, 0
+	// inProfiles is set below the profiles key, and profile is the
+	// section being read. Their keys are indented by profileIndent and
+	// optionIndent, as their first ones are.
+	inProfiles, profile := false, ""
+	profileIndent, optionIndent := 0, 0
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		raw := strings.TrimRight(stripComment(scanner.Text()), " \t\r")
+		line := strings.TrimLeft(raw, " \t")
+		if line == "" || line == "---" {
+			continue
+		}
+		indent := len(raw) - len(line)
+		fail := func(format string, args ...any) error {
+			return fmt.Errorf("%s:%d: %s", path, n, fmt.Sprintf(format, args...))
+		}
+
+		if item, ok := strings.CutPrefix(line, "- "); ok || line == "-" {
+			if list < 0 || indent <= listIndent {
+				return nil, nil, fail("list item outside an indented list")
+			}
+			v, err := configScalar(item)
+			if err != nil {
+				return nil, nil, fail("%v", err)
+			}
+			options[list].values = append(options[list].values, v)
+			continue
+		}
+		list = -1
+
+		name, value, ok := strings.Cut(line, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t\"'") {
+			return nil, nil, fail("want flag: value")
+		}
+		value = strings.TrimSpace(value)
+		switch {
+		case indent == 0:
+			inProfiles, profile = name == "profiles", ""
+			if inProfiles {
+				if value != "" {
+					return nil, nil, fail("want the profiles indented below profiles:")
+				}
+				continue
+			}
+		case inProfiles && (profile == "" || indent == profileIndent):
+			if profile == "" && profileIndent == 0 {
+				profileIndent = indent
+			}
+			if indent != profileIndent || value != "" {
+				return nil, nil, fail("want a profile name: with its options indented below it")
+			}
+			if slices.Contains(profiles, name) {
+				return nil, nil, fail("profile %q given twice", name)
+			}
+			profile, optionIndent = name, 0
+			profiles = append(profiles, name)
+			continue
+		case profile != "" && indent > profileIndent:
+			if optionIndent == 0 {
+				optionIndent = indent
+			}
+			if indent != optionIndent {
+				return nil, nil, fail("unexpected indentation; want the profile's flag: value lines aligned")
+			}
+		default:
+			return nil, nil, fail("unexpected indentation; only flag: value lines and profiles are supported")
+		}
+
+		name = strings.TrimLeft(name, "-")
+		o := configOption{name: name, line: n, profile: profile}
+		switch {
+		case value == "":
+			list, listIndent = len(options), indent
+			options = append(options, o)
+			continue
+		case strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]"):
+			for _, item := range splitFlow(value[1 : len(value)-1]) {
+				v, err := configScalar(item)
+				if err != nil {
+					return nil, nil, fail("%v", err)
+				}
+				o.values = append(o.values, v)
+			}
+		default:
+			v, err := configScalar(value)
+			if err != nil {
+				return nil, nil, fail("%v", err)
+			}
+			o.values = []string{v}
+		}
+		options = append(options, o)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	for _, o := range options {
+		if len(o.values) == 0 {
+			return nil, nil, fmt.Errorf("%s:%d: %s has no value", path, o.line, o.name)
+		}
+	}
+	return options, profiles, nil
+}
+
+// stripComment drops a # comment that is not inside quotes.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// splitFlow splits the items of a [a, b] list at commas outside quotes.
+func splitFlow(s string) []string {
+	var items []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			items = append(items, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(s[start:]); last != "" || len(items) > 0 {
+		items = append(items, last)
+	}
+	return items
+}
+
+// configScalar returns the value of a plain, "double" or 'single' quoted
+// YAML scalar.
+func configScalar(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"':
+		return strconv.Unquote(s)
+	case len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'':
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case strings.HasPrefix(s, "\"") || strings.HasPrefix(s, "'"):
+		return "", fmt.Errorf("unterminated quote in %s", s)
+	case s == "~" || s == "null":
+		return "", nil
+	}
+	return s, nil
+}
+
+// setConfig sets options, of one value each, in the config file at path,
+// creating the file if need be. Other lines, comments included, are kept
+// as they are.
+func setConfig(path string, options []configOption) error {
+	values := map[string]string{}
+	for _, o := range options {
+		values[o.name] = o.values[0]
+	}
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	var lines []string
+	if len(b) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	}
+
+	var out []string
+	done := map[string]bool{}
+	// skipping drops the "- a" lines of a replaced list.
+	skipping := false
+	for _, line := range lines {
+		trimmed := strings.TrimLeft(line, " \t")
+		if skipping && trimmed != line && strings.HasPrefix(trimmed, "-") {
+			continue
+		}
+		skipping = false
+		if name, _, ok := strings.Cut(line, ":"); ok && trimmed == line {
+			name = strings.TrimLeft(strings.TrimSpace(name), "-")
+			if v, set := values[name]; set {
+				if !done[name] {
+					out = append(out, name+": "+v)
+					done[name] = true
+				}
+				skipping = true
+				continue
+			}
+		}
+		out = append(out, line)
+	}
+	for _, o := range options {
+		if !done[o.name] {
+			out = append(out, o.name+": "+o.values[0])
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(out, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
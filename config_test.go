@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const testConfig = `m: 10
+retry-initial: 2s
+H:
+  - "X-Team: infra"
+profiles:
+  slow-mirror:
+    m: 500
+    limit-rate: 1M
+    H: ["X-Mirror: slow", "X-Token: abc"]
+  quick:
+    m: 1
+`
+
+// testConfigFlags parses args with the shared flags at their defaults and
+// the config file holding content.
+func testConfigFlags(t *testing.T, content string, args ...string) error {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Only the default flags know every option of the file.
+	fs, saved := flag.NewFlagSet("test", flag.ContinueOnError), flag.CommandLine
+	flag.CommandLine = fs
+	registerFlags(fs)
+	Headers, LimitRate = nil, 0
+	t.Cleanup(func() {
+		flag.CommandLine = saved
+		Headers, LimitRate, ConfigFile, Profile = nil, 0, "", ""
+	})
+	if err := fs.Parse(append([]string{"-config", path}, args...)); err != nil {
+		t.Fatal(err)
+	}
+	return applyConfig(fs)
+}
+
+func TestConfigProfiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     string
+		args    []string
+		m       int
+		limit   byteSize
+		headers []string
+	}{
+		{"top level", "", nil, 10, 0, []string{"X-Team: infra"}},
+		{"profile", "", []string{"-profile", "slow-mirror"}, 500, 1 << 20, []string{"X-Mirror: slow", "X-Token: abc"}},
+		{"profile from the environment", "quick", nil, 1, 0, []string{"X-Team: infra"}},
+		{"flag over profile", "", []string{"-profile", "slow-mirror", "-m", "3"}, 3, 1 << 20, []string{"X-Mirror: slow", "X-Token: abc"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("GOCAT_PROFILE", tt.env)
+			}
+			if err := testConfigFlags(t, testConfig, tt.args...); err != nil {
+				t.Fatal(err)
+			}
+			if MaxRetry != tt.m || LimitRate != tt.limit || !slices.Equal(Headers, tt.headers) {
+				t.Errorf("m %v, limit-rate %v, H %q; want %v, %v, %q", MaxRetry, LimitRate, Headers, tt.m, tt.limit, tt.headers)
+			}
+			if RetryInitial.String() != "2s" {
+				t.Errorf("retry-initial %v, want the top level's 2s", RetryInitial)
+			}
+		})
+	}
+
+	t.Run("environment over profile", func(t *testing.T) {
+		t.Setenv("GOCAT_M", "7")
+		if err := testConfigFlags(t, testConfig, "-profile", "slow-mirror"); err != nil || MaxRetry != 7 {
+			t.Errorf("m %v, %v; want GOCAT_M's 7", MaxRetry, err)
+		}
+	})
+}
+
+func TestConfigProfileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		args    []string
+		want    string
+	}{
+		{"unknown profile", testConfig, []string{"-profile", "fast"}, `no profile "fast"`},
+		{"unknown option", "profiles:\n  p:\n    bogus: 1\n", []string{"-profile", "p"}, `:3: unknown option "bogus"`},
+		{"unselected unknown option", "profiles:\n  p:\n    bogus: 1\n", nil, `:3: unknown option "bogus"`},
+		{"profile with a value", "profiles:\n  p: 1\n", nil, ":2: want a profile name"},
+		{"misaligned option", "profiles:\n  p:\n    m: 1\n      b: 2\n", nil, ":4: unexpected indentation"},
+		{"profile twice", "profiles:\n  p:\n    m: 1\n  p:\n    m: 2\n", nil, `:4: profile "p" given twice`},
+		{"indented top level", "m: 1\n  b: 2\n", nil, ":2: unexpected indentation"},
+		{"profiles value", "profiles: p\n", nil, ":1: want the profiles indented"},
+	}
+	for _, tt := range tests {
+		err := testConfigFlags(t, tt.content, tt.args...)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%v: got %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+var (
+	Confirm      bool
+	ConfirmAbove byteSize
+)
+
+const confirmListed = 10
+
+// confirmDownload prints what the run is about to transfer and asks the user
+// on the controlling terminal, since stdin and stdout may be part of a
+// pipeline. With only -confirm-above set, small jobs proceed silently.
+func confirmDownload(files []string, sizes []int64) error {
+	total := int64(0)
+	for _, size := range sizes {
+		// Entries of unknown size (-1) are left out of the total.
+		total += max(size, 0)
+	}
+
+	if !Confirm && total <= int64(ConfirmAbove) {
+		return nil
+	}
+
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("cannot ask for confirmation without a terminal: %w", err)
+	}
+	defer tty.Close()
+
+	printSummary(tty, files, sizes, total)
+	fmt.Fprint(tty, "Proceed? [y/N] ")
+
+	answer, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return errors.New("aborted by user")
+}
+
+func printSummary(w io.Writer, files []string, sizes []int64, total int64) {
+	for i, file := range files {
+		if i == confirmListed {
+			fmt.Fprintf(w, "  ... and %v more\n", len(files)-confirmListed)
+			break
+		}
+		size := "unknown"
+		if sizes[i] >= 0 {
+			size = formatSize(sizes[i])
+		}
+		fmt.Fprintf(w, "  %10v  %s\n", size, file)
+	}
+	fmt.Fprintf(w, "%v entries, %v (%v bytes) in total\n", len(files), formatSize(total), total)
+}
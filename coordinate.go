@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+// defaultLease is how long a worker holds an entry it claimed without
+// renewing it.
+const defaultLease = 10 * time.Minute
+
+// workPoll is the longest a worker waits to ask again while the rest of
+// the entries are claimed by others, one of which may yet come back.
+var workPoll = 5 * time.Second
+
+var errLeaseLost = errors.New("the lease on the entry was lost")
+
+// serveManifest is a list whose entries gocat work processes on several
+// hosts claim from gocat serve one at a time. A claim is a lease: an
+// entry whose worker neither renews it nor reports its end within Lease
+// is claimed by the next worker to ask, so the entries of a worker that
+// died are not lost.
+type serveManifest struct {
+	ID      string           `json:"id"`
+	List    string           `json:"list"`
+	Lease   string           `json:"lease"`
+	Entries []*manifestEntry `json:"entries"`
+
+	lease time.Duration
+}
+
+// manifestEntry is an entry of a manifest. Its state is pending, claimed,
+// done or failed.
+type manifestEntry struct {
+	URL string `json:"url"`
+	// Name is the file the entry is written to, which no other entry of
+	// the manifest has, so workers sharing a directory do not overwrite
+	// each other.
+	Name string `json:"name,omitempty"`
+	// Meta is what the list said about the entry, for the worker.
+	Meta   *resumeMeta `json:"meta,omitempty"`
+	State  string      `json:"state"`
+	Worker string      `json:"worker,omitempty"`
+	Until  *time.Time  `json:"until,omitempty"`
+	Claims int         `json:"claims,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// manifestClaim answers a claim: the entry claimed, or Done when every
+// entry has ended, or Wait until Until when the rest are claimed by other
+// workers.
+type manifestClaim struct {
+	Index int         `json:"index"`
+	URL   string      `json:"url,omitempty"`
+	Name  string      `json:"name,omitempty"`
+	Meta  *resumeMeta `json:"meta,omitempty"`
+	Until time.Time   `json:"until"`
+	Done  bool        `json:"done,omitempty"`
+	Wait  bool        `json:"wait,omitempty"`
+}
+
+func (m *serveManifest) parse() error {
+	lease, err := time.ParseDuration(m.Lease)
+	if err != nil || lease <= 0 {
+		return fmt.Errorf("invalid lease %q: want a duration such as 10m", m.Lease)
+	}
+	m.lease = lease
+	return nil
+}
+
+func (s *server) manifest(id string) *serveManifest {
+	for _, m := range s.state.Manifests {
+		if m.ID == id {
+			return m
+		}
+	}
+	return nil
+}
+
+// loadManifests parses the manifests of a state file.
+func (s *server) loadManifests() error {
+	s.state.NextManifest = max(s.state.NextManifest, 1)
+	for _, m := range s.state.Manifests {
+		if err := m.parse(); err != nil {
+			return fmt.Errorf("manifest %s: %w", m.ID, err)
+		}
+	}
+	return nil
+}
+
+func (s *server) addManifest(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		List        string `json:"list"`
+		Lease       string `json:"lease"`
+		OnCollision string `json:"on_collision"`
+	}
+	if err := json.NewDecoder(io.LimitReader(req.Body, 1<<20)).Decode(&body); err != nil {
+		serveError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return
+	}
+	if body.List == "" {
+		serveError(w, http.StatusBadRequest, errors.New("invalid request: no list"))
+		return
+	}
+	if body.Lease == "" {
+		body.Lease = defaultLease.String()
+	}
+	// Workers end their entries in no particular order, so there is no
+	// later entry to let overwrite an earlier one.
+	switch body.OnCollision {
+	case "", "error", "suffix":
+	default:
+		serveError(w, http.StatusBadRequest, fmt.Errorf("invalid on_collision %q: want error or suffix", body.OnCollision))
+		return
+	}
+	m := &serveManifest{List: body.List, Lease: body.Lease}
+	if err := m.parse(); err != nil {
+		serveError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.allowed(body.List); err != nil {
+		serveError(w, http.StatusBadRequest, err)
+		return
+	}
+	// The workers share the whole list; -shard-count is for a list each
+	// run takes a part of by itself.
+	files, err := fetchList(req.Context(), body.List)
+	if err != nil {
+		serveError(w, http.StatusBadGateway, err)
+		return
+	}
+	taken := map[string]string{}
+	for _, file := range files {
+		if err := s.allowed(file); err != nil {
+			serveError(w, http.StatusBadRequest, err)
+			return
+		}
+		name, err := outputName(file, downloader.Info{})
+		if err != nil {
+			serveError(w, http.StatusBadRequest, err)
+			return
+		}
+		if prev, ok := taken[name]; ok {
+			if body.OnCollision != "suffix" {
+				serveError(w, http.StatusBadRequest, fmt.Errorf("%s and %s would both be written to %v", prev, file, name))
+				return
+			}
+			orig := name
+			for n := 1; ok; n++ {
+				name = suffixedName(orig, n)
+				_, ok = taken[name]
+			}
+			warnf("%s and %s would both be written to %v, writing %v instead", prev, file, orig, name)
+		}
+		taken[name] = file
+		m.Entries = append(m.Entries, &manifestEntry{URL: file, Name: name, Meta: snapshotMeta(file), State: "pending"})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m.ID = "m" + strconv.Itoa(s.state.NextManifest)
+	s.state.NextManifest++
+	s.state.Manifests = append(s.state.Manifests, m)
+	if err := s.save(); err != nil {
+		s.state.NextManifest--
+		s.state.Manifests = s.state.Manifests[:len(s.state.Manifests)-1]
+		serveError(w, http.StatusInternalServerError, err)
+		return
+	}
+	infof("%s: %v entries of %s for workers to claim", m.ID, len(m.Entries), m.List)
+	serveJSON(w, http.StatusCreated, m)
+}
+
+func (s *server) listManifests(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	serveJSON(w, http.StatusOK, map[string]any{"manifests": s.state.Manifests})
+}
+
+func (s *server) getManifest(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.manifest(req.PathValue("id"))
+	if m == nil {
+		serveError(w, http.StatusNotFound, fmt.Errorf("no manifest %s", req.PathValue("id")))
+		return
+	}
+	serveJSON(w, http.StatusOK, m)
+}
+
+func (s *server) deleteManifest(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.manifest(req.PathValue("id"))
+	if m == nil {
+		serveError(w, http.StatusNotFound, fmt.Errorf("no manifest %s", req.PathValue("id")))
+		return
+	}
+	s.state.Manifests = slices.DeleteFunc(s.state.Manifests, func(o *serveManifest) bool { return o == m })
+	s.saveOrWarn()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// claim leases the first pending entry, or one whose lease has run out,
+// to the worker asking.
+func (s *server) claim(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Worker string `json:"worker"`
+	}
+	if err := json.NewDecoder(io.LimitReader(req.Body, 1<<20)).Decode(&body); err != nil || body.Worker == "" {
+		serveError(w, http.StatusBadRequest, errors.New("invalid request: want {\"worker\": <name>}"))
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.manifest(req.PathValue("id"))
+	if m == nil {
+		serveError(w, http.StatusNotFound, fmt.Errorf("no manifest %s", req.PathValue("id")))
+		return
+	}
+
+	now := time.Now().UTC()
+	c := manifestClaim{Index: -1, Done: true}
+	for i, e := range m.Entries {
+		switch {
+		case e.State == "pending", e.State == "claimed" && !e.Until.After(now):
+			if e.State == "claimed" {
+				infof("%s: the lease of %s on entry %v ran out", m.ID, e.Worker, i)
+			}
+			until := now.Add(m.lease)
+			e.State, e.Worker, e.Until = "claimed", body.Worker, &until
+			e.Claims++
+			s.saveOrWarn()
+			serveJSON(w, http.StatusOK, manifestClaim{Index: i, URL: e.URL, Name: e.Name, Meta: e.Meta, Until: until})
+			return
+		case e.State == "claimed":
+			if !c.Wait || e.Until.Before(c.Until) {
+				c.Until = *e.Until
+			}
+			c.Done, c.Wait = false, true
+		}
+	}
+	serveJSON(w, http.StatusOK, c)
+}
+
+// report takes a worker's renewal of its lease on an entry, or the end of
+// the entry, done or failed.
+func (s *server) report(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Worker string `json:"worker"`
+		State  string `json:"state"`
+		Error  string `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(req.Body, 1<<20)).Decode(&body); err != nil {
+		serveError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return
+	}
+	switch body.State {
+	case "renew", "done", "failed":
+	default:
+		serveError(w, http.StatusBadRequest, fmt.Errorf("invalid state %q: want renew, done or failed", body.State))
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.manifest(req.PathValue("id"))
+	if m == nil {
+		serveError(w, http.StatusNotFound, fmt.Errorf("no manifest %s", req.PathValue("id")))
+		return
+	}
+	i, err := strconv.Atoi(req.PathValue("index"))
+	if err != nil || i < 0 || i >= len(m.Entries) {
+		serveError(w, http.StatusNotFound, fmt.Errorf("no entry %s in manifest %s", req.PathValue("index"), m.ID))
+		return
+	}
+	e := m.Entries[i]
+	// A lease that ran out may have gone to another worker since.
+	if e.State != "claimed" || e.Worker != body.Worker {
+		serveError(w, http.StatusConflict, fmt.Errorf("entry %v is not claimed by %s", i, body.Worker))
+		return
+	}
+	switch body.State {
+	case "renew":
+		until := time.Now().UTC().Add(m.lease)
+		e.Until = &until
+	case "done":
+		e.State, e.Until, e.Error = "done", nil, ""
+	case "failed":
+		e.State, e.Until, e.Error = "failed", nil, body.Error
+		warnf("%s: %s failed on %s: %v", m.ID, e.URL, body.Worker, body.Error)
+	}
+	s.saveOrWarn()
+	serveJSON(w, http.StatusOK, e)
+}
+
+// coordinator is a gocat serve that gocat work claims entries from.
+type coordinator struct {
+	base     string
+	token    string
+	manifest string
+	worker   string
+	client   *http.Client
+}
+
+// call posts body to path of the manifest and decodes the answer into v.
+func (c *coordinator) call(ctx context.Context, path string, body, v any) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	url := c.base + "/manifests/" + c.manifest + path
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusConflict {
+		return errLeaseLost
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&e)
+		return fmt.Errorf("%s: %v %s", url, resp.Status, e.Error)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+func (c *coordinator) claim(ctx context.Context) (manifestClaim, error) {
+	var claim manifestClaim
+	err := c.call(ctx, "/claim", map[string]string{"worker": c.worker}, &claim)
+	return claim, err
+}
+
+func (c *coordinator) report(ctx context.Context, index int, state, msg string) error {
+	var e manifestEntry
+	return c.call(ctx, "/entries/"+strconv.Itoa(index),
+		map[string]string{"worker": c.worker, "state": state, "error": msg}, &e)
+}
+
+// runWork is gocat work: one of several processes, on any number of
+// hosts, that share the entries of a manifest queued on a gocat serve,
+// each claiming an entry at a time and writing it to its own -dir.
+func runWork(args []string) {
+	fs := flag.NewFlagSet("work", flag.ExitOnError)
+	registerFlags(fs)
+	coord := fs.String("coordinator", "", "URL of the gocat serve holding the manifest, e.g. http://host:8080")
+	token := fs.String("token", "", "the -token of the gocat serve")
+	worker := fs.String("worker", "", "name of this worker in the leases (default host:pid)")
+	dir := fs.String("dir", ".", "directory the entries this worker claims are written to")
+	parseFlags(fs, args)
+
+	if *coord == "" || fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: gocat work [options] -coordinator <url> [-token <token>] [-worker <name>] [-dir <dir>] <manifest id>")
+		os.Exit(1)
+	}
+	if *worker == "" {
+		host, _ := os.Hostname()
+		*worker = host + ":" + strconv.Itoa(os.Getpid())
+	}
+	if err := setup(); err != nil {
+		log.Fatal(err)
+	}
+	c := &coordinator{
+		base:     strings.TrimSuffix(*coord, "/"),
+		token:    *token,
+		manifest: fs.Arg(0),
+		worker:   *worker,
+		client:   &http.Client{Timeout: time.Minute},
+	}
+
+	ctx := interruptContext()
+	done, failed, err := work(ctx, c, longPath(*dir))
+	prog.stop()
+	printRetryReport()
+	if err != nil {
+		fatal(ctx, err)
+	}
+	fmt.Fprintf(os.Stderr, "%v entries done, %v failed\n", done, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+	fmt.Fprintln(os.Stderr, "COMPLETED!")
+}
+
+// work claims the entries of c's manifest and downloads them to dir until
+// none is left, and returns how many it did and how many failed.
+func work(ctx context.Context, c *coordinator, dir string) (done, failed int, err error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, 0, err
+	}
+	for {
+		claim, err := c.claim(ctx)
+		switch {
+		case err != nil:
+			return done, failed, err
+		case claim.Done:
+			return done, failed, nil
+		case claim.Wait:
+			select {
+			case <-time.After(min(time.Until(claim.Until), workPoll)):
+			case <-ctx.Done():
+				return done, failed, context.Cause(ctx)
+			}
+			continue
+		}
+
+		err = c.fetch(ctx, claim, dir)
+		switch {
+		case ctx.Err() != nil:
+			// The lease runs out and the entry goes to another worker.
+			return done, failed, context.Cause(ctx)
+		case errors.Is(err, errLeaseLost):
+			warnf("%s: %v", claim.URL, err)
+			continue
+		case err != nil:
+			warnf("%s failed: %v", claim.URL, err)
+			failed++
+			err = c.report(ctx, claim.Index, "failed", err.Error())
+		default:
+			done++
+			err = c.report(ctx, claim.Index, "done", "")
+		}
+		if err != nil && !errors.Is(err, errLeaseLost) {
+			return done, failed, err
+		}
+	}
+}
+
+// fetch downloads the entry claimed to dir, renewing the lease as it goes,
+// and checks it against the size= and sha256= its list gave.
+func (c *coordinator) fetch(ctx context.Context, claim manifestClaim, dir string) error {
+	restoreMeta(claim.URL, claim.Meta)
+	name, err := cleanName(claim.URL, claim.Name)
+	if claim.Name == "" {
+		// A manifest from before names were given out.
+		name, err = outputName(claim.URL, downloader.Info{})
+	}
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		// Renew at a third of the lease, to stay well ahead of it.
+		every := max(time.Until(claim.Until)/3, time.Second)
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := c.report(ctx, claim.Index, "renew", ""); err != nil && ctx.Err() == nil {
+					if errors.Is(err, errLeaseLost) {
+						cancel(errLeaseLost)
+						return
+					}
+					warnf("renewing the lease on %s: %v", claim.URL, err)
+				}
+			}
+		}
+	}()
+	err = getFile(ctx, claim.URL, filepath.Join(dir, name))
+	cancel(nil)
+	<-renewed
+	if errors.Is(context.Cause(ctx), errLeaseLost) {
+		return errLeaseLost
+	}
+	return err
+}
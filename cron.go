@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a crontab(5) time specification: a set of minutes,
+// hours, days of the month, months and days of the week, each a bit set.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// anyDay is set when the day of the month or that of the week is *,
+	// and a day must then match both; otherwise it matches either, as in
+	// cron.
+	anyDay bool
+}
+
+// cronAliases are the @ forms cron takes besides the five fields.
+var cronAliases = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseCron parses "minute hour day month weekday", each field *, a
+// number, a range a-b, or a list of them, any of which may have a /step,
+// or one of the @daily forms. Weekdays run from 0, Sunday, to 7, Sunday
+// again; names are not taken.
+func parseCron(spec string) (*cronSchedule, error) {
+	if alias, ok := cronAliases[spec]; ok {
+		spec = alias
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron %q: want minute hour day month weekday", spec)
+	}
+	var c cronSchedule
+	var err error
+	for i, f := range []struct {
+		bits   *uint64
+		lo, hi int
+	}{
+		{&c.minute, 0, 59},
+		{&c.hour, 0, 23},
+		{&c.dom, 1, 31},
+		{&c.month, 1, 12},
+		{&c.dow, 0, 7},
+	} {
+		if *f.bits, err = parseCronField(fields[i], f.lo, f.hi); err != nil {
+			return nil, fmt.Errorf("invalid cron %q: %w", spec, err)
+		}
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.anyDay = fields[2] == "*" || fields[4] == "*"
+	return &c, nil
+}
+
+// parseCronField parses one field of values from lo to hi.
+func parseCronField(field string, lo, hi int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		span, stepText, stepped := strings.Cut(part, "/")
+		step := 1
+		if stepped {
+			n, err := strconv.Atoi(stepText)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			step = n
+		}
+		first, last := lo, hi
+		if span != "*" {
+			a, b, ranged := strings.Cut(span, "-")
+			var err error
+			if first, err = strconv.Atoi(a); err != nil {
+				return 0, fmt.Errorf("invalid value in %q", part)
+			}
+			switch {
+			case ranged:
+				if last, err = strconv.Atoi(b); err != nil {
+					return 0, fmt.Errorf("invalid value in %q", part)
+				}
+			case !stepped:
+				last = first
+			}
+			if first < lo || last > hi || first > last {
+				return 0, fmt.Errorf("%q is out of %v-%v", part, lo, hi)
+			}
+		}
+		for v := first; v <= last; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// next returns the first minute after t that c matches, in t's location,
+// or the zero time when there is none within five years, as for the 31st
+// of February.
+func (c *cronSchedule) next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(5, 0, 0)
+	for t.Before(end) {
+		y, mo, d := t.Date()
+		h, mi := t.Hour(), t.Minute()
+		switch {
+		case c.month&(1<<mo) == 0:
+			t = time.Date(y, mo+1, 1, 0, 0, 0, 0, loc)
+		case !c.matchesDay(t):
+			t = time.Date(y, mo, d+1, 0, 0, 0, 0, loc)
+		case c.hour&(1<<h) == 0:
+			t = time.Date(y, mo, d, h+1, 0, 0, 0, loc)
+		case c.minute&(1<<mi) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (c *cronSchedule) matchesDay(t time.Time) bool {
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<t.Weekday()) != 0
+	if c.anyDay {
+		return dom && dow
+	}
+	return dom || dow
+}
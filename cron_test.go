@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04", s, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	tests := []struct {
+		spec, after, want string
+	}{
+		{"0 2 * * *", "2026-10-15 01:59", "2026-10-15 02:00"},
+		{"0 2 * * *", "2026-10-15 02:00", "2026-10-16 02:00"},
+		{"@daily", "2026-12-31 23:30", "2027-01-01 00:00"},
+		{"*/15 * * * *", "2026-10-15 10:07", "2026-10-15 10:15"},
+		{"30 9-17/4 * * 1-5", "2026-10-16 18:00", "2026-10-19 09:30"},
+		{"0 0 29 2 *", "2026-03-01 00:00", "2028-02-29 00:00"},
+		// Both days restricted: either matches, as in cron. The 15th of
+		// October 2026 is a Thursday.
+		{"0 0 1 * 4", "2026-10-14 12:00", "2026-10-15 00:00"},
+		{"0 0 * * 7", "2026-10-15 00:00", "2026-10-18 00:00"},
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.spec)
+		if err != nil {
+			t.Errorf("%q: %v", tt.spec, err)
+			continue
+		}
+		if got := c.next(at(tt.after)); !got.Equal(at(tt.want)) {
+			t.Errorf("%q after %v: got %v, want %v", tt.spec, tt.after, got, tt.want)
+		}
+	}
+
+	if c, err := parseCron("0 0 31 2 *"); err != nil || !c.next(at("2026-01-01 00:00")).IsZero() {
+		t.Errorf("the 31st of February came around: %v", err)
+	}
+	for _, bad := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "x * * * *"} {
+		if _, err := parseCron(bad); err == nil {
+			t.Errorf("%q was accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+// dataTransport answers data: URLs (RFC 2397) itself, as a server that
+// serves ranges would, so inline entries of a list are emitted in place
+// like any other. A non-standard name or filename parameter names the
+// entry for -O.
+type dataTransport struct {
+	base http.RoundTripper
+}
+
+func (t *dataTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "data" {
+		return t.base.RoundTrip(req)
+	}
+	data, header, err := parseDataURL(req.URL)
+	if err != nil {
+		return nil, &downloader.PermanentError{Err: err}
+	}
+	sum := sha256.Sum256(data)
+	header.Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	header.Set("Accept-Ranges", "bytes")
+
+	resp := &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Request:    req,
+	}
+	if first, last, ok := dataRange(req.Header.Get("Range"), int64(len(data))); ok {
+		resp.Status, resp.StatusCode = "206 Partial Content", http.StatusPartialContent
+		header.Set("Content-Range", fmt.Sprintf("bytes %v-%v/%v", first, last, len(data)))
+		data = data[first : last+1]
+	}
+	resp.ContentLength = int64(len(data))
+	header.Set("Content-Length", strconv.Itoa(len(data)))
+	if req.Method == "HEAD" {
+		data = nil
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	return resp, nil
+}
+
+// parseDataURL decodes the payload of u and returns it with the headers a
+// server would send for it.
+func parseDataURL(u *neturl.URL) ([]byte, http.Header, error) {
+	raw := u.Opaque
+	if raw == "" {
+		raw = strings.TrimPrefix(u.String(), "data:")
+	}
+	meta, payload, ok := strings.Cut(raw, ",")
+	if !ok {
+		return nil, nil, fmt.Errorf("data URL without a comma: %.40q", "data:"+raw)
+	}
+
+	header := http.Header{}
+	params := strings.Split(meta, ";")
+	encoded := false
+	if params[len(params)-1] == "base64" {
+		encoded = true
+		params = params[:len(params)-1]
+	}
+	mediaType := "text/plain;charset=US-ASCII"
+	if params[0] != "" || len(params) > 1 {
+		if params[0] == "" {
+			params[0] = "text/plain"
+		}
+		if unescaped, err := neturl.PathUnescape(strings.Join(params, ";")); err == nil {
+			mediaType = unescaped
+		}
+	}
+	if mt, mparams, err := mime.ParseMediaType(mediaType); err == nil {
+		name := mparams["filename"]
+		if name == "" {
+			name = mparams["name"]
+		}
+		if name != "" {
+			delete(mparams, "filename")
+			delete(mparams, "name")
+			header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+		}
+		mediaType = mime.FormatMediaType(mt, mparams)
+	}
+	header.Set("Content-Type", mediaType)
+
+	payload, err := neturl.PathUnescape(payload)
+	if err != nil {
+		return nil, nil, fmt.Errorf("data URL: %w", err)
+	}
+	if !encoded {
+		return []byte(payload), header, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		// Padding is often left out.
+		if data, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(payload, "=")); err != nil {
+			return nil, nil, fmt.Errorf("data URL: %w", err)
+		}
+	}
+	return data, header, nil
+}
+
+// dataRange interprets a single-range Range header against size bytes, as
+// the downloader sends them. ok is false for no or an unsatisfiable range,
+// which is answered with the whole payload.
+func dataRange(h string, size int64) (first, last int64, ok bool) {
+	spec, found := strings.CutPrefix(h, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	from, to, _ := strings.Cut(spec, "-")
+	var err error
+	switch {
+	case from == "":
+		n, err := strconv.ParseInt(to, 10, 64)
+		if err != nil || n <= 0 || size == 0 {
+			return 0, 0, false
+		}
+		return max(size-n, 0), size - 1, true
+	default:
+		if first, err = strconv.ParseInt(from, 10, 64); err != nil || first >= size {
+			return 0, 0, false
+		}
+		last = size - 1
+		if to != "" {
+			if last, err = strconv.ParseInt(to, 10, 64); err != nil || last < first {
+				return 0, 0, false
+			}
+			last = min(last, size-1)
+		}
+		return first, last, true
+	}
+}
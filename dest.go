@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/msmania/gocat/retry"
+)
+
+var (
+	Dest         string
+	DestPartSize byteSize = 16 << 20
+)
+
+const (
+	// destUploads is how many parts of an upload are in flight at once.
+	destUploads = 4
+	// minPartSize is the smallest part S3 and GCS take, but for the last.
+	minPartSize = 5 << 20
+	// destAbortTimeout bounds the cleanup of an upload that failed.
+	destAbortTimeout = 30 * time.Second
+)
+
+var errUploadAborted = errors.New("upload aborted")
+
+// dest receives the entries back to back, as stdout would, with -dest.
+var dest destWriter
+
+// destWriter uploads what is written to it. Close publishes the upload and
+// abort drops what was sent so far.
+type destWriter interface {
+	io.WriteCloser
+	abort()
+}
+
+func openDest(ctx context.Context, rawURL string) (destWriter, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid -dest %q: want s3://bucket/key, gs://bucket/object or an http(s) URL", rawURL)
+	}
+	switch u.Scheme {
+	case "s3", "gs":
+		if u.Path == "" || u.Path == "/" {
+			return nil, fmt.Errorf("invalid -dest %q: missing key", rawURL)
+		}
+		if DestPartSize < minPartSize {
+			return nil, fmt.Errorf("invalid -dest-part-size %v: want at least %v", int64(DestPartSize), formatSize(minPartSize))
+		}
+		if u.Scheme == "gs" {
+			gcsScope = gcsWriteScope
+		}
+		return newMultipartUpload(ctx, u)
+	case "http", "https":
+		return newPutUpload(ctx, rawURL), nil
+	}
+	return nil, fmt.Errorf("invalid -dest %q: want s3://bucket/key, gs://bucket/object or an http(s) URL", rawURL)
+}
+
+// multipartUpload sends the stream to S3, or to GCS, whose XML API speaks
+// the same protocol, in parts of DestPartSize. Each part is retried like a
+// chunk; a part in flight holds its memory, so at most destUploads+1 parts
+// are buffered.
+type multipartUpload struct {
+	ctx    context.Context
+	u      *url.URL
+	id     string
+	policy retry.Policy
+
+	buf   []byte
+	next  int
+	parts chan uploadPart
+	wg    sync.WaitGroup
+
+	mu sync.Mutex
+	// etags holds the ETag of each part, by part number from 1.
+	etags []string
+	err   error
+}
+
+type uploadPart struct {
+	n    int
+	data []byte
+}
+
+func newMultipartUpload(ctx context.Context, u *url.URL) (*multipartUpload, error) {
+	m := &multipartUpload{
+		ctx:   ctx,
+		u:     u,
+		buf:   make([]byte, 0, DestPartSize),
+		parts: make(chan uploadPart),
+	}
+	m.policy = retry.Policy{
+		MaxAttempts: MaxRetry,
+		Initial:     RetryInitial,
+		Max:         RetryMax,
+		Multiplier:  RetryMultiplier,
+		OnRetry: func(i int, err error, wait time.Duration) {
+			logger.Warn(
+				fmt.Sprintf("retrying upload %v/%v in %v (%v)", i, MaxRetry, wait.Round(time.Millisecond), err.Error()),
+				"event", "retry",
+				"url", u.String(),
+				"attempt", i,
+				"max_retry", MaxRetry,
+				"backoff_seconds", wait.Seconds(),
+				"error", err.Error(),
+			)
+			prog.retry(u.String(), err, wait)
+		},
+	}
+
+	_, body, err := m.call(ctx, http.MethodPost, "uploads", nil)
+	if err != nil {
+		return nil, fmt.Errorf("starting upload to %s: %w", u, err)
+	}
+	var started struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(body, &started); err != nil || started.UploadID == "" {
+		return nil, fmt.Errorf("starting upload to %s: no UploadId in the answer", u)
+	}
+	m.id = started.UploadID
+	logger.Debug(fmt.Sprintf("started upload %v to %s", m.id, u), "url", u.String())
+
+	for range destUploads {
+		m.wg.Add(1)
+		go m.uploader()
+	}
+	return m, nil
+}
+
+func (m *multipartUpload) failed() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+func (m *multipartUpload) setErr(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err == nil {
+		m.err = err
+	}
+}
+
+func (m *multipartUpload) Write(p []byte) (int, error) {
+	if err := m.failed(); err != nil {
+		return 0, err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		k := min(len(p), cap(m.buf)-len(m.buf))
+		m.buf = append(m.buf, p[:k]...)
+		p = p[k:]
+		if len(m.buf) == cap(m.buf) {
+			m.send()
+		}
+	}
+	return n, nil
+}
+
+// send hands the buffered part to the uploaders.
+func (m *multipartUpload) send() {
+	m.next++
+	m.mu.Lock()
+	m.etags = append(m.etags, "")
+	m.mu.Unlock()
+	m.parts <- uploadPart{m.next, m.buf}
+	m.buf = make([]byte, 0, DestPartSize)
+}
+
+func (m *multipartUpload) uploader() {
+	defer m.wg.Done()
+	for part := range m.parts {
+		if m.failed() != nil {
+			continue
+		}
+		query := fmt.Sprintf("partNumber=%d&uploadId=%s", part.n, url.QueryEscape(m.id))
+		header, _, err := m.call(m.ctx, http.MethodPut, query, part.data)
+		if err != nil {
+			m.setErr(fmt.Errorf("uploading part %d to %s: %w", part.n, m.u, err))
+			continue
+		}
+		logger.Debug(
+			fmt.Sprintf("uploaded part %v (%v bytes) to %s", part.n, len(part.data), m.u),
+			"event", "part_done",
+			"url", m.u.String(),
+			"part", part.n,
+			"bytes", len(part.data),
+		)
+		m.mu.Lock()
+		m.etags[part.n-1] = header.Get("ETag")
+		m.mu.Unlock()
+	}
+}
+
+// Close uploads the last part and publishes the object.
+func (m *multipartUpload) Close() error {
+	// An empty stream still makes one, empty, part.
+	if len(m.buf) > 0 || m.next == 0 {
+		m.send()
+	}
+	close(m.parts)
+	m.wg.Wait()
+	if err := m.failed(); err != nil {
+		m.abort()
+		return err
+	}
+
+	type completedPart struct {
+		PartNumber int
+		ETag       string
+	}
+	complete := struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{}
+	for i, etag := range m.etags {
+		complete.Parts = append(complete.Parts, completedPart{i + 1, etag})
+	}
+	payload, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	_, _, err = m.call(m.ctx, http.MethodPost, "uploadId="+url.QueryEscape(m.id), payload)
+	if err != nil {
+		m.abort()
+		return fmt.Errorf("completing upload to %s: %w", m.u, err)
+	}
+	infof("uploaded %v parts to %s", len(m.etags), m.u)
+	return nil
+}
+
+// abort stops the uploaders and deletes the parts uploaded so far. A part
+// still in flight may land afterwards; S3's lifecycle rules for incomplete
+// uploads cover those.
+func (m *multipartUpload) abort() {
+	m.setErr(errUploadAborted)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(m.ctx), destAbortTimeout)
+	defer cancel()
+	if _, _, err := m.call(ctx, http.MethodDelete, "uploadId="+url.QueryEscape(m.id), nil); err != nil {
+		warnf("aborting upload to %s: %v", m.u, err)
+	}
+}
+
+// call sends one request of the upload protocol, with retries, and returns
+// the headers and body of the answer.
+func (m *multipartUpload) call(ctx context.Context, method, query string, payload []byte) (http.Header, []byte, error) {
+	u := *m.u
+	u.RawQuery = query
+	sum := sha256.Sum256(payload)
+
+	var header http.Header
+	var body []byte
+	err := m.policy.Do(ctx, func() error {
+		req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(payload))
+		if err != nil {
+			return &retry.PermanentError{Err: err}
+		}
+		req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(sum[:]))
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return retry.ResponseError(resp)
+		}
+		if body, err = io.ReadAll(resp.Body); err != nil {
+			return err
+		}
+		// S3 can turn a completion into an error after it answered 200.
+		var result struct {
+			XMLName xml.Name
+			Code    string
+			Message string
+		}
+		if xml.Unmarshal(body, &result) == nil && result.XMLName.Local == "Error" {
+			return fmt.Errorf("%v: %v", result.Code, result.Message)
+		}
+		header = resp.Header
+		return nil
+	})
+	return header, body, err
+}
+
+// putUpload streams the entries to an HTTP endpoint in a single chunked
+// PUT. Unlike the parts of a multipart upload, it cannot be retried.
+type putUpload struct {
+	url  string
+	pw   *io.PipeWriter
+	done chan struct{}
+	err  error
+}
+
+func newPutUpload(ctx context.Context, rawURL string) *putUpload {
+	pr, pw := io.Pipe()
+	p := &putUpload{url: rawURL, pw: pw, done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, rawURL, pr)
+		if err == nil {
+			var resp *http.Response
+			if resp, err = httpClient.Do(req); err == nil {
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode/100 != 2 {
+					err = retry.ResponseError(resp)
+				}
+			}
+		}
+		if err != nil {
+			err = fmt.Errorf("uploading to %s: %w", rawURL, err)
+		}
+		p.err = err
+		// Writers waiting on a request that is over get its error.
+		if err == nil {
+			err = io.ErrClosedPipe
+		}
+		pr.CloseWithError(err)
+	}()
+	return p
+}
+
+func (p *putUpload) Write(b []byte) (int, error) {
+	return p.pw.Write(b)
+}
+
+func (p *putUpload) Close() error {
+	p.pw.Close()
+	<-p.done
+	if p.err == nil {
+		infof("uploaded to %s", p.url)
+	}
+	return p.err
+}
+
+func (p *putUpload) abort() {
+	p.pw.CloseWithError(errUploadAborted)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+var (
+	// OutputDevice is -o when it names a disk rather than a directory.
+	OutputDevice string
+	YesDevice    bool
+)
+
+// device is where every entry goes, end to end, when -o is a disk.
+var device *deviceWriter
+
+// minDeviceBlock is the smallest unit written to a device. It is a
+// multiple of every common sector size, so writes stay aligned on 512e
+// and 4Kn disks alike even where the geometry cannot be read.
+const minDeviceBlock = 4096
+
+// isDevice reports whether path is a disk: a block device, a raw disk on
+// macOS, or a Windows \\.\PhysicalDriveN or \\.\X: path.
+func isDevice(path string) bool {
+	if runtime.GOOS == "windows" {
+		return strings.HasPrefix(path, `\\.\`)
+	}
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode()&fs.ModeDevice == 0 {
+		return false
+	}
+	if fi.Mode()&fs.ModeCharDevice == 0 {
+		return true
+	}
+	return runtime.GOOS == "darwin" && strings.HasPrefix(filepath.Base(path), "rdisk")
+}
+
+// deviceWriter writes a disk image, made of the entries in list order, to
+// a device in whole blocks from its first byte. The image must fit; bytes
+// of the device past its end are kept, including those sharing its last
+// block.
+type deviceWriter struct {
+	f     *os.File
+	path  string
+	block int
+	// image is the expected size of the image.
+	image int64
+
+	pending []byte
+	written int64
+}
+
+// openDevice opens path for writing an image of the given entry sizes,
+// which must all be known and must fit on the device.
+func openDevice(path string, sizes []int64) (*deviceWriter, error) {
+	var image int64
+	for _, size := range sizes {
+		if size < 0 {
+			return nil, errors.New("every entry needs a known size to be written to a device")
+		}
+		image += size
+	}
+
+	// On Linux O_EXCL makes the open fail while the disk or any of its
+	// partitions is mounted.
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_EXCL, 0)
+	if err != nil {
+		return nil, err
+	}
+	capacity, sector, err := deviceGeometry(f, path)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: reading the device size: %w", path, err)
+	}
+	if capacity <= 0 {
+		f.Close()
+		return nil, fmt.Errorf("%s: cannot tell the size of the device", path)
+	}
+	if image > capacity {
+		f.Close()
+		return nil, fmt.Errorf("%s: the image of %v bytes does not fit on the device's %v",
+			path, image, capacity)
+	}
+
+	block := max(sector, minDeviceBlock)
+	if sector > 0 && block%sector != 0 {
+		block = sector
+	}
+	return &deviceWriter{f: f, path: path, block: block, image: image}, nil
+}
+
+func (d *deviceWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(d.pending) > 0 {
+		k := min(d.block-len(d.pending), len(p))
+		d.pending = append(d.pending, p[:k]...)
+		p = p[k:]
+		if len(d.pending) < d.block {
+			d.written += int64(n)
+			return n, nil
+		}
+		if _, err := d.f.Write(d.pending); err != nil {
+			return 0, err
+		}
+		d.pending = d.pending[:0]
+	}
+	if whole := len(p) / d.block * d.block; whole > 0 {
+		if _, err := d.f.Write(p[:whole]); err != nil {
+			return 0, err
+		}
+		p = p[whole:]
+	}
+	d.pending = append(d.pending, p...)
+	d.written += int64(n)
+	return n, nil
+}
+
+// Close writes out the last, partial block over what the device held
+// there, flushes the device and checks that the whole image was written.
+func (d *deviceWriter) Close() error {
+	if len(d.pending) > 0 {
+		offset := d.written - int64(len(d.pending))
+		last := make([]byte, d.block)
+		n, err := d.f.ReadAt(last, offset)
+		if n < len(d.pending) {
+			d.f.Close()
+			return fmt.Errorf("%s: reading the last block: %w", d.path, err)
+		}
+		copy(last, d.pending)
+		if _, err := d.f.WriteAt(last[:n], offset); err != nil {
+			d.f.Close()
+			return err
+		}
+		d.pending = nil
+	}
+	if err := d.f.Sync(); err != nil {
+		d.f.Close()
+		return err
+	}
+	if err := d.f.Close(); err != nil {
+		return err
+	}
+	if d.written != d.image {
+		return fmt.Errorf("%s: expected an image of %v bytes, wrote %v", d.path, d.image, d.written)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	dkiocGetBlockSize  = 0x40046418
+	dkiocGetBlockCount = 0x40086419
+)
+
+// deviceGeometry returns the size and sector size of the disk f, which
+// seeking cannot tell on macOS.
+func deviceGeometry(f *os.File, path string) (size int64, sector int, err error) {
+	var blockSize uint32
+	var blockCount uint64
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(),
+		dkiocGetBlockSize, uintptr(unsafe.Pointer(&blockSize))); errno != 0 {
+		return 0, 0, errno
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(),
+		dkiocGetBlockCount, uintptr(unsafe.Pointer(&blockCount))); errno != 0 {
+		return 0, 0, errno
+	}
+	return int64(blockCount) * int64(blockSize), int(blockSize), nil
+}
@@ -0,0 +1,32 @@
+//go:build !windows && !darwin
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// deviceGeometry returns the size of the device f, and on Linux its
+// physical sector size, or 0 when unknown.
+func deviceGeometry(f *os.File, path string) (size int64, sector int, err error) {
+	size, err = f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		b, err := os.ReadFile(filepath.Join(
+			"/sys/class/block", filepath.Base(resolved), "queue", "physical_block_size"))
+		if err == nil {
+			sector, _ = strconv.Atoi(strings.TrimSpace(string(b)))
+		}
+	}
+	return size, sector, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	ioctlDiskGetDriveGeometry = 0x70000
+	ioctlDiskGetLengthInfo    = 0x7405c
+)
+
+// diskGeometry is DISK_GEOMETRY.
+type diskGeometry struct {
+	Cylinders         int64
+	MediaType         uint32
+	TracksPerCylinder uint32
+	SectorsPerTrack   uint32
+	BytesPerSector    uint32
+}
+
+// deviceGeometry returns the size and sector size of the drive f, which
+// seeking cannot tell on Windows.
+func deviceGeometry(f *os.File, path string) (size int64, sector int, err error) {
+	var n uint32
+	if err := syscall.DeviceIoControl(syscall.Handle(f.Fd()), ioctlDiskGetLengthInfo,
+		nil, 0, (*byte)(unsafe.Pointer(&size)), uint32(unsafe.Sizeof(size)), &n, nil); err != nil {
+		return 0, 0, err
+	}
+	var g diskGeometry
+	if err := syscall.DeviceIoControl(syscall.Handle(f.Fd()), ioctlDiskGetDriveGeometry,
+		nil, 0, (*byte)(unsafe.Pointer(&g)), uint32(unsafe.Sizeof(g)), &n, nil); err == nil {
+		sector = int(g.BytesPerSector)
+	}
+	return size, sector, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// dnsCache resolves each host once per -dns-cache-ttl and dials its
+// addresses for every new connection in the meantime, so a run opening
+// hundreds of chunk connections does not send hundreds of lookups.
+type dnsCache struct {
+	dialer *net.Dialer
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*dnsEntry
+}
+
+// dnsEntry is one lookup, shared by every dial that wants it while it is
+// in flight.
+type dnsEntry struct {
+	done    chan struct{}
+	addrs   []string
+	err     error
+	expires time.Time
+}
+
+func newDNSCache(dialer *net.Dialer, ttl time.Duration) *dnsCache {
+	return &dnsCache{dialer: dialer, ttl: ttl, entries: map[string]*dnsEntry{}}
+}
+
+// dial is an http.Transport DialContext function.
+func (c *dnsCache) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return c.dialer.DialContext(ctx, network, addr)
+	}
+	addrs, err := c.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var first error
+	for _, ip := range addrs {
+		if network == "tcp4" && net.ParseIP(ip).To4() == nil || network == "tcp6" && net.ParseIP(ip).To4() != nil {
+			continue
+		}
+		conn, err := c.dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+		if first == nil {
+			first = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	// The host may have moved; look it up again on the next dial.
+	c.forget(host)
+	if first == nil {
+		first = &net.AddrError{Err: "no suitable address", Addr: host}
+	}
+	return nil, first
+}
+
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	c.mu.Lock()
+	e := c.entries[host]
+	if e != nil {
+		select {
+		case <-e.done:
+			if e.err != nil || time.Now().After(e.expires) {
+				e = nil
+			}
+		default:
+		}
+	}
+	if e == nil {
+		e = &dnsEntry{done: make(chan struct{})}
+		c.entries[host] = e
+		go func() {
+			// Not bound to ctx: other dials may be waiting on it.
+			lctx, cancel := context.WithTimeout(context.Background(), c.dialer.Timeout)
+			defer cancel()
+			e.addrs, e.err = c.resolver().LookupHost(lctx, host)
+			e.expires = time.Now().Add(c.ttl)
+			close(e.done)
+		}()
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-e.done:
+		return e.addrs, e.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *dnsCache) forget(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e := c.entries[host]; e != nil {
+		select {
+		case <-e.done:
+			delete(c.entries, host)
+		default:
+		}
+	}
+}
+
+func (c *dnsCache) resolver() *net.Resolver {
+	if c.dialer.Resolver != nil {
+		return c.dialer.Resolver
+	}
+	return net.DefaultResolver
+}
@@ -0,0 +1,58 @@
+package downloader
+
+import (
+	"sync"
+	"time"
+)
+
+// chunkTarget is how long an adaptive chunk should take: long enough for
+// the request overhead not to matter, short enough that a failed attempt
+// costs little.
+const chunkTarget = 2 * time.Second
+
+// chunkSizer holds the chunk size of AdaptiveChunks, shared by every
+// transfer since they share the link.
+type chunkSizer struct {
+	mu   sync.Mutex
+	size int64
+}
+
+// chunkSize is the size of the next chunk of url to plan.
+func (d *Downloader) chunkSize(url string) int64 {
+	if n := d.sourceMeta(url).ChunkSize; n > 0 {
+		return n
+	}
+	if !d.AdaptiveChunks {
+		return d.ChunkSize
+	}
+	d.sizer.mu.Lock()
+	defer d.sizer.mu.Unlock()
+	if d.sizer.size == 0 {
+		d.sizer.size = d.MinChunkSize
+	}
+	return d.sizer.size
+}
+
+// chunkFinished moves the chunk size toward what takes chunkTarget at the
+// rate n bytes came in, by at most a factor of two at a time.
+func (d *Downloader) chunkFinished(n int64, elapsed time.Duration) {
+	if !d.AdaptiveChunks || n <= 0 || elapsed <= 0 {
+		return
+	}
+	want := int64(float64(n) / elapsed.Seconds() * chunkTarget.Seconds())
+	d.sizer.mu.Lock()
+	defer d.sizer.mu.Unlock()
+	cur := max(d.sizer.size, d.MinChunkSize)
+	d.sizer.size = min(max(want, cur/2, d.MinChunkSize), cur*2, d.MaxChunkSize)
+}
+
+// chunkFailed halves the chunk size after a failed attempt, so a flaky
+// link loses less on each.
+func (d *Downloader) chunkFailed() {
+	if !d.AdaptiveChunks {
+		return
+	}
+	d.sizer.mu.Lock()
+	defer d.sizer.mu.Unlock()
+	d.sizer.size = max(d.sizer.size/2, d.MinChunkSize)
+}
@@ -0,0 +1,34 @@
+package downloader
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/msmania/gocat/retry"
+)
+
+// StatusError is an HTTP response that is not the one asked for. 4xx
+// answers other than 408 and 429 are returned wrapped in a PermanentError.
+type StatusError = retry.StatusError
+
+// PermanentError marks a failure that retrying cannot fix, such as a 404.
+type PermanentError = retry.PermanentError
+
+func statusError(resp *http.Response) error {
+	return retry.ResponseError(resp)
+}
+
+// policy is the retry policy of the Retry fields.
+func (d *Downloader) policy() retry.Policy {
+	return retry.Policy{
+		MaxAttempts: d.MaxRetry,
+		Initial:     d.RetryInitial,
+		Max:         d.RetryMax,
+		Multiplier:  d.RetryMultiplier,
+	}
+}
+
+// backoff returns the wait before attempt i+1 under the policy of d.
+func (d *Downloader) backoff(i int, err error) time.Duration {
+	return d.policy().Backoff(i, err)
+}
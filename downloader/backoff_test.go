@@ -0,0 +1,82 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	content := []byte("after the wait\n")
+	var mu sync.Mutex
+	gets := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		if req.Method == "GET" {
+			gets++
+		}
+		n := gets
+		mu.Unlock()
+		switch {
+		case n == 1:
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+		case n == 2:
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+		default:
+			http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(content))
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	d := testDownloader(srv.Client())
+	d.MaxRetry = 3
+	d.RetryInitial, d.RetryMax, d.RetryMultiplier = 10*time.Millisecond, 40*time.Millisecond, 2
+	var waits []time.Duration
+	d.OnRetry = func(url string, err error, wait time.Duration) {
+		waits = append(waits, wait)
+	}
+	start := time.Now()
+	var out bytes.Buffer
+	if _, err := d.Download(context.Background(), srv.URL+"/a", &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), content) {
+		t.Errorf("got %q", out.Bytes())
+	}
+	// The 429 is waited out for as long as it asked, the 503 after it for
+	// the jittered second step of the backoff.
+	if len(waits) != 2 || waits[0] != time.Second || waits[1] < 10*time.Millisecond || waits[1] > 20*time.Millisecond {
+		t.Errorf("waits %v, want 1s and then within [10ms, 20ms]", waits)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("done in %v, before the Retry-After", elapsed)
+	}
+}
+
+func TestBackoffPermanent(t *testing.T) {
+	gets := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "GET" {
+			gets++
+		}
+		http.Error(w, "gone", http.StatusGone)
+	}))
+	t.Cleanup(srv.Close)
+
+	d := testDownloader(srv.Client())
+	d.MaxRetry = 5
+	_, err := d.Download(context.Background(), srv.URL+"/a", &bytes.Buffer{})
+	var perm *PermanentError
+	if !errors.As(err, &perm) {
+		t.Errorf("got %v, want a PermanentError", err)
+	}
+	if gets > 1 {
+		t.Errorf("a 410 was asked %v times", gets)
+	}
+}
@@ -0,0 +1,42 @@
+package downloader
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Unchanged asks url with a conditional HEAD whether it still is the
+// version of size bytes with etag, or was not modified since since; etag
+// may be empty, since zero and size -1 for unknown. A server that ignores
+// the conditions is judged by the validators it answers with.
+func (d *Downloader) Unchanged(ctx context.Context, url, etag string, since time.Time, size int64) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		return false, err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if !since.IsZero() {
+		req.Header.Set("If-Modified-Since", since.UTC().Format(http.TimeFormat))
+	}
+	resp, err := d.do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		return true, nil
+	case resp.StatusCode/100 != 2:
+		return false, statusError(resp)
+	case size >= 0 && resp.ContentLength >= 0 && resp.ContentLength != size:
+		return false, nil
+	}
+	if got := resp.Header.Get("ETag"); etag != "" && got != "" {
+		return got == etag, nil
+	}
+	modified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return err == nil && !since.IsZero() && !modified.After(since), nil
+}
@@ -0,0 +1,125 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// ErrDrained is returned by DownloadFrom once Drain, or the drain of a
+// WithDrain context, has stopped it between chunks.
+var ErrDrained = errors.New("stopped after the chunks in flight")
+
+// Pause holds every transfer of d, in flight or not, until Resume. Paused
+// transfers do not count as stalled.
+func (d *Downloader) Pause() {
+	d.pauseMu.Lock()
+	defer d.pauseMu.Unlock()
+	if d.resumed == nil {
+		d.resumed = make(chan struct{})
+	}
+}
+
+func (d *Downloader) Resume() {
+	d.pauseMu.Lock()
+	defer d.pauseMu.Unlock()
+	if d.resumed != nil {
+		close(d.resumed)
+		d.resumed = nil
+	}
+}
+
+func (d *Downloader) Paused() bool {
+	d.pauseMu.Lock()
+	defer d.pauseMu.Unlock()
+	return d.resumed != nil
+}
+
+// awaitResume blocks while d is paused.
+func (d *Downloader) awaitResume(ctx context.Context) error {
+	d.pauseMu.Lock()
+	resumed := d.resumed
+	d.pauseMu.Unlock()
+	if resumed == nil {
+		return nil
+	}
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// Drain lets the chunks in flight finish but starts no more: ranged
+// downloads then return ErrDrained. A download in a single request runs to
+// its end.
+func (d *Downloader) Drain() {
+	d.draining.Store(true)
+}
+
+type drainKey struct{}
+
+// WithDrain returns a context under which ranged downloads stop as Drain
+// stops them once drain is called, while the other transfers of the
+// Downloader carry on.
+func WithDrain(parent context.Context) (ctx context.Context, drain func()) {
+	var draining atomic.Bool
+	return context.WithValue(parent, drainKey{}, &draining), func() { draining.Store(true) }
+}
+
+// drained reports whether a ranged download under ctx is to start no
+// more chunks.
+func (d *Downloader) drained(ctx context.Context) bool {
+	if draining, ok := ctx.Value(drainKey{}).(*atomic.Bool); ok && draining.Load() {
+		return true
+	}
+	return d.draining.Load()
+}
+
+// SetRateLimit changes the combined rate of every transfer, including
+// those in flight, to rate bytes per second; 0 lifts the limit.
+func (d *Downloader) SetRateLimit(rate int64) {
+	d.sharedRate().SetRate(rate)
+	d.rebalance()
+}
+
+// CurrentRateLimit is the combined rate in force, 0 when unlimited.
+func (d *Downloader) CurrentRateLimit() int64 {
+	return d.sharedRate().Rate()
+}
+
+// maxSetWorkers is as many chunks per object as SetWorkers allows.
+const maxSetWorkers = 256
+
+// SetWorkers changes how many chunks of each object are fetched at a time,
+// including objects being downloaded in chunks already: they start no new
+// chunk until they are below it. An object begun in a single stream, and
+// one spooled to disk, keeps the number it started with.
+func (d *Downloader) SetWorkers(n int) {
+	d.workersMu.Lock()
+	defer d.workersMu.Unlock()
+	d.workersSet.Store(int64(min(max(n, 1), maxSetWorkers)))
+	if d.workersChanged != nil {
+		close(d.workersChanged)
+		d.workersChanged = nil
+	}
+}
+
+// CurrentWorkers is Workers, or what SetWorkers last changed it to.
+func (d *Downloader) CurrentWorkers() int {
+	if n := d.workersSet.Load(); n > 0 {
+		return int(n)
+	}
+	return d.Workers
+}
+
+// workersChange returns a channel closed by the next SetWorkers.
+func (d *Downloader) workersChange() <-chan struct{} {
+	d.workersMu.Lock()
+	defer d.workersMu.Unlock()
+	if d.workersChanged == nil {
+		d.workersChanged = make(chan struct{})
+	}
+	return d.workersChanged
+}
@@ -0,0 +1,75 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// CredentialsProvider supplies the credentials of a Downloader's requests,
+// for schemes whose tokens expire during a long download, such as
+// short-lived JWTs.
+type CredentialsProvider interface {
+	// Apply sets the current credentials on req.
+	Apply(req *http.Request) error
+	// Refresh fetches new credentials once a request with the current
+	// ones was refused with 401 or 403. Requests refused together lead to
+	// a single Refresh.
+	Refresh(ctx context.Context) error
+}
+
+// credentialsState counts the refreshes of the Credentials of a
+// Downloader, so requests refused with the same credentials refresh them
+// once.
+type credentialsState struct {
+	mu         sync.Mutex
+	generation int
+}
+
+// do sends req, a request without a body, through Client with the
+// Credentials, if any. A 401 or 403 refreshes them and sends req once
+// more; a second refusal is the answer. A failed Refresh is an error to
+// retry.
+func (d *Downloader) do(req *http.Request) (*http.Response, error) {
+	creds := d.Credentials
+	if creds == nil {
+		return d.Client.Do(req)
+	}
+	gen, err := d.applyCredentials(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.Client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden {
+		return resp, err
+	}
+
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	d.credentials.mu.Lock()
+	if d.credentials.generation == gen {
+		// Requests wait in applyCredentials for the new credentials.
+		if err := creds.Refresh(req.Context()); err != nil {
+			d.credentials.mu.Unlock()
+			return nil, fmt.Errorf("refreshing the credentials after %v: %w", resp.Status, err)
+		}
+		d.credentials.generation++
+	}
+	d.credentials.mu.Unlock()
+
+	req = req.Clone(req.Context())
+	if _, err := d.applyCredentials(req); err != nil {
+		return nil, err
+	}
+	return d.Client.Do(req)
+}
+
+// applyCredentials sets the current credentials on req and returns their
+// generation.
+func (d *Downloader) applyCredentials(req *http.Request) (int, error) {
+	d.credentials.mu.Lock()
+	defer d.credentials.mu.Unlock()
+	return d.credentials.generation, d.Credentials.Apply(req)
+}
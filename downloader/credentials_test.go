@@ -0,0 +1,104 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tokenSource hands out tokens numbered from 1, a new one per Refresh.
+type tokenSource struct {
+	mu        sync.Mutex
+	token     int
+	refreshes int
+	err       error
+}
+
+func (s *tokenSource) Apply(req *http.Request) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer t%v", s.token))
+	return nil
+}
+
+func (s *tokenSource) Refresh(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.token++
+	s.refreshes++
+	return nil
+}
+
+func TestCredentialsRefresh(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 10)
+	// The token in force expires after the first few requests.
+	var valid atomic.Value
+	valid.Store("Bearer t1")
+	var served atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != valid.Load() {
+			http.Error(w, "expired", http.StatusUnauthorized)
+			return
+		}
+		if served.Add(1) == 3 {
+			valid.Store("Bearer t2")
+		}
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(srv.Close)
+
+	d := testDownloader(srv.Client())
+	d.Workers = 4
+	d.ChunkSize = 10
+	creds := &tokenSource{token: 1}
+	d.Credentials = creds
+	var out bytes.Buffer
+	if _, err := d.Download(context.Background(), srv.URL+"/a", &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), content) {
+		t.Errorf("got %q", out.Bytes())
+	}
+	// The chunks refused together renewed the token once.
+	if creds.refreshes != 1 {
+		t.Errorf("%v refreshes, want 1", creds.refreshes)
+	}
+}
+
+func TestCredentialsRefused(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "no", http.StatusForbidden)
+	}))
+	t.Cleanup(srv.Close)
+
+	// Refused with fresh credentials too, it is the server's answer.
+	d := testDownloader(srv.Client())
+	d.MaxRetry = 3
+	creds := &tokenSource{}
+	d.Credentials = creds
+	_, err := d.FetchRange(context.Background(), srv.URL+"/a", ClosedRange(0, 9))
+	var perm *PermanentError
+	if !errors.As(err, &perm) || creds.refreshes != 1 {
+		t.Errorf("got %v after %v refreshes, want a PermanentError after 1", err, creds.refreshes)
+	}
+
+	// A Refresh that fails is retried.
+	broken := errors.New("token endpoint down")
+	creds = &tokenSource{err: broken}
+	d.Credentials = creds
+	var retries int
+	d.OnRetry = func(url string, err error, wait time.Duration) { retries++ }
+	if _, err := d.FetchRange(context.Background(), srv.URL+"/a", ClosedRange(0, 9)); !errors.Is(err, broken) || retries != 2 {
+		t.Errorf("got %v after %v retries, want %v after 2", err, retries, broken)
+	}
+}
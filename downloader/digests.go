@@ -0,0 +1,38 @@
+package downloader
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// headerDigests collects the whole-object digests a server advertises,
+// hex encoded by algorithm. Only HEAD responses qualify; on a range
+// response these headers may describe the range instead.
+func headerDigests(h http.Header) map[string]string {
+	digests := map[string]string{}
+	add := func(algo, b64 string) {
+		// Composite S3 checksums ("...-3") cover parts, not the object.
+		if raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(b64)); err == nil {
+			digests[algo] = hex.EncodeToString(raw)
+		}
+	}
+
+	if v := h.Get("Content-MD5"); v != "" {
+		add("md5", v)
+	}
+	for _, v := range h.Values("X-Goog-Hash") {
+		for _, part := range strings.Split(v, ",") {
+			if algo, value, ok := strings.Cut(strings.TrimSpace(part), "="); ok {
+				add(algo, value)
+			}
+		}
+	}
+	for _, algo := range []string{"sha256", "sha1", "crc32", "crc32c"} {
+		if v := h.Get("X-Amz-Checksum-" + algo); v != "" {
+			add(algo, v)
+		}
+	}
+	return digests
+}
@@ -0,0 +1,693 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// streamRange copies any single byte range of url to w, including the
+// open-ended and suffix forms used for tails and unknown lengths, and
+// returns the number of bytes written. The server must answer 206 with a
+// Content-Range matching what was asked for, and a body as long as the
+// Content-Range says; anything else is an error to retry. A range from
+// gocat serve is also checked against the checksum it sends after it.
+func (d *Downloader) streamRange(parent context.Context, url string, r ByteRange, w io.Writer) (int64, error) {
+	parent, stop := d.chunkContext(parent, url)
+	defer stop()
+	ctx, cancel := context.WithCancelCause(parent)
+	defer cancel(nil)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Add("Range", r.String())
+	req.Header.Set(ChecksumHeader, "sha256")
+	info, validated := d.validatorsOf(url)
+	if validated {
+		// If-Range would answer a changed object with all of it; these
+		// refuse it outright.
+		if info.ETag != "" && !strings.HasPrefix(info.ETag, "W/") {
+			req.Header.Set("If-Match", info.ETag)
+		} else if info.LastModified != "" {
+			req.Header.Set("If-Unmodified-Since", info.LastModified)
+		}
+	}
+
+	guard := d.newSpeedGuard(cancel)
+	defer guard.stop()
+
+	resp, err := d.do(req)
+	if err != nil {
+		if cause := context.Cause(ctx); cause != nil {
+			return 0, cause
+		}
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// Servers that ignore the precondition still show their validators.
+	if resp.StatusCode == http.StatusPreconditionFailed ||
+		validated && resp.StatusCode/100 == 2 && changed(info, resp.Header) {
+		return 0, changedError(url)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// A 200 is the whole object, or a page standing in for it, even
+		// for a range from 0; only a 206 says which bytes it holds.
+		return 0, fmt.Errorf("requested %v but server answered %v", r, resp.Status)
+	default:
+		return 0, statusError(resp)
+	}
+	first, last, _, err := r.CheckContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return 0, err
+	}
+	want := last - first + 1
+	if resp.ContentLength >= 0 && resp.ContentLength != want {
+		return 0, fmt.Errorf("Content-Length %v does not match Content-Range %q",
+			resp.ContentLength, resp.Header.Get("Content-Range"))
+	}
+	body := io.LimitReader(resp.Body, want)
+
+	check := newRangeCheck(resp)
+	if check != nil {
+		return d.copyChecked(ctx, w, guard.wrap(d.limitRate(ctx, check.wrap(body))), r, want, check)
+	}
+	n, err := copyBody(ctx, w, guard.wrap(d.limitRate(ctx, body)))
+	if err == nil && n != want {
+		// Retried for the rest, like any cut connection.
+		return n, fmt.Errorf("response to %v ended after %v of %v bytes", r, n, want)
+	}
+	return n, err
+}
+
+// copyChecked copies the want bytes of r in body to w once they match the
+// checksum that follows them. Until then they are held back, so a range
+// damaged or cut short on the way is fetched again whole.
+func (d *Downloader) copyChecked(ctx context.Context, w io.Writer, body io.Reader, r ByteRange, want int64, check *rangeCheck) (int64, error) {
+	held := d.getBuffer()
+	defer d.putBuffer(held)
+	n, err := copyBody(ctx, held, body)
+	if err != nil {
+		return 0, err
+	}
+	if n != want {
+		return 0, fmt.Errorf("response to %v ended after %v of %v bytes", r, n, want)
+	}
+	if err := check.check(r); err != nil {
+		return 0, err
+	}
+	return copyBody(ctx, w, held)
+}
+
+// chunkContext bounds a ranged request of url to ChunkTimeout, or to the
+// timeout= of its list line.
+func (d *Downloader) chunkContext(parent context.Context, url string) (context.Context, context.CancelFunc) {
+	timeout := d.ChunkTimeout
+	if t := d.sourceMeta(url).ChunkTimeout; t > 0 {
+		timeout = t
+	}
+	if timeout <= 0 {
+		return parent, func() {}
+	}
+	return context.WithTimeoutCause(parent, timeout, &ChunkTimeoutError{timeout})
+}
+
+// copyBody copies a response body to w. Errors from w come back as a
+// PermanentError, and a body cut short by cancelling ctx reports the cause.
+func copyBody(ctx context.Context, w io.Writer, body io.Reader) (int64, error) {
+	sink := &sinkWriter{w: w}
+	n, err := io.Copy(sink, body)
+	if sink.err != nil {
+		return n, &PermanentError{Err: &writeError{sink.err}}
+	}
+	if err != nil {
+		if cause := context.Cause(ctx); cause != nil {
+			return n, cause
+		}
+		return n, err
+	}
+	return n, nil
+}
+
+// sinkWriter remembers the error of w so streamRange can tell a failing
+// destination from a failing download.
+type sinkWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (s *sinkWriter) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	s.err = err
+	return n, err
+}
+
+// writeError is an error of the destination rather than the download.
+type writeError struct {
+	err error
+}
+
+func (e *writeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *writeError) Unwrap() error {
+	return e.err
+}
+
+// unwrapSink returns the destination's own error when err is one, so
+// callers of the Download methods see what w returned.
+func unwrapSink(err error) error {
+	var we *writeError
+	if errors.As(err, &we) {
+		return we.err
+	}
+	return err
+}
+
+// fetchRange reads r of url into a buffer from the pool. When it fails,
+// the buffer holds what arrived before, if anything.
+func (d *Downloader) fetchRange(ctx context.Context, url string, r ByteRange) (*bytes.Buffer, error) {
+	buf := d.getBuffer()
+	if _, err := d.streamRange(ctx, url, r, buf); err != nil {
+		if buf.Len() == 0 {
+			d.putBuffer(buf)
+			return nil, err
+		}
+		return buf, err
+	}
+	return buf, nil
+}
+
+func (d *Downloader) getBuffer() *bytes.Buffer {
+	if buf, ok := d.buffers.Get().(*bytes.Buffer); ok {
+		buf.Reset()
+		return buf
+	}
+	return new(bytes.Buffer)
+}
+
+func (d *Downloader) putBuffer(buf *bytes.Buffer) {
+	if buf != nil {
+		d.buffers.Put(buf)
+	}
+}
+
+// fetchChunk fetches r of url, or of its sources when set is not nil,
+// into a pooled buffer, making up to MaxRetry attempts; the caller returns
+// the buffer with putBuffer. A failed attempt keeps what it read, and the
+// next one asks only for the rest of the range.
+func (d *Downloader) fetchChunk(
+	ctx context.Context,
+	url string,
+	set *sourceSet,
+	r ByteRange,
+) (buf *bytes.Buffer, err error) {
+	err = d.retry(ctx, "", url, func() error {
+		return d.fromSources(ctx, url, set, func(url string) error {
+			rest := r
+			if buf != nil {
+				if r.Suffix > 0 {
+					// The end of an object may move; start over.
+					d.putBuffer(buf)
+					buf = nil
+				} else {
+					rest.First += int64(buf.Len())
+					if r.Last >= 0 && rest.First > r.Last {
+						return nil
+					}
+					d.log(slog.LevelDebug, fmt.Sprintf("resuming %v of %s at byte %v", r, url, rest.First), "url", url)
+				}
+			}
+			part, err := d.fetchHedged(ctx, url, rest)
+			switch {
+			case part == nil:
+			case buf == nil:
+				buf = part
+			default:
+				buf.Write(part.Bytes())
+				d.putBuffer(part)
+			}
+			return err
+		})
+	})
+	if err != nil {
+		d.putBuffer(buf)
+		return nil, err
+	}
+	return buf, nil
+}
+
+// FetchRange fetches r of url, making up to MaxRetry attempts. A
+// PermanentError, such as a 404, is returned without retrying.
+func (d *Downloader) FetchRange(ctx context.Context, url string, r ByteRange) ([]byte, error) {
+	buf, err := d.fetchChunk(ctx, url, nil, r)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// streamChunk copies r of url, or of its sources when set is not nil,
+// straight to w. A failed attempt keeps what it wrote, and the next one
+// asks only for the rest of the range.
+func (d *Downloader) streamChunk(
+	ctx context.Context,
+	url string,
+	set *sourceSet,
+	r ByteRange,
+	w io.Writer,
+) (written int64, err error) {
+	err = d.retry(ctx, "", url, func() error {
+		return d.fromSources(ctx, url, set, func(url string) error {
+			start := time.Now()
+			n, err := d.streamRange(ctx, url, ClosedRange(r.First+written, r.Last), w)
+			written += n
+			if err == nil {
+				d.latencies.add(time.Since(start))
+			}
+			return err
+		})
+	})
+	return written, err
+}
+
+// Download writes the whole of url to w and returns the number of bytes
+// written. A transfer shorter than the size the server announced is an
+// error.
+func (d *Downloader) Download(ctx context.Context, url string, w io.Writer) (int64, error) {
+	info, err := d.Stat(ctx, url)
+	if err != nil {
+		return 0, err
+	}
+	if !info.Ranges {
+		written, err := d.DownloadStream(ctx, url, info, 0, w)
+		if err == nil && info.Size >= 0 && written != info.Size {
+			err = fmt.Errorf("%s: expected %v bytes, wrote %v", url, info.Size, written)
+		}
+		return written, err
+	}
+	written, err := d.DownloadFrom(ctx, url, info.Size, 0, w)
+	if err == nil && written != info.Size {
+		err = fmt.Errorf("%s: expected %v bytes, wrote %v", url, info.Size, written)
+	}
+	return written, err
+}
+
+// DownloadFrom writes bytes [start, size) of url to w in chunks and returns
+// the number of bytes written. It leaves size, as learnt from Stat, to the
+// caller so a caller resuming a transfer can check the object first. The
+// chunks of a url with mirrors are spread across them.
+func (d *Downloader) DownloadFrom(
+	ctx context.Context,
+	url string,
+	size, start int64,
+	w io.Writer,
+) (written int64, err error) {
+	return d.DownloadRange(ctx, url, size, start, size, w)
+}
+
+// DownloadRange is DownloadFrom for bytes [start, end) of the size bytes
+// of url.
+//
+// Whatever ends it early, be it an error, the cancellation of ctx, whose
+// cause it then returns, or Drain, the bytes it has written are the first
+// written of the range, in order, and nothing else: chunks fetched ahead
+// of a gap are dropped. A transfer is therefore resumed by calling it
+// again from start+written.
+func (d *Downloader) DownloadRange(
+	ctx context.Context,
+	url string,
+	size, start, end int64,
+	w io.Writer,
+) (written int64, err error) {
+	began := time.Now()
+	d.emit(Event{Kind: TransferStarted, URL: url, From: start, To: end})
+	defer func() {
+		d.emit(Event{
+			Kind: TransferDone, URL: url, From: start, To: end,
+			Bytes: written, Elapsed: time.Since(began), Err: err,
+		})
+	}()
+	ctx, release := d.fairShare(ctx, url, start, end)
+	defer release()
+
+	set := d.sourcesFor(url, size)
+	workers := d.CurrentWorkers()
+	if d.HugeSize > 0 && size >= d.HugeSize {
+		workers = max(workers, d.HugeWorkers)
+	}
+	if set != nil {
+		workers = max(workers, len(set.sources))
+	}
+	if workers > 1 && end-start > d.chunkSize(url) {
+		if d.SpoolDir != "" {
+			return d.downloadSpooled(ctx, url, set, workers, start, end, w)
+		}
+		return d.downloadParallel(ctx, url, set, workers, start, end, w)
+	}
+
+	chunk := int64(1)
+	for offset := start; offset < end; {
+		if d.drained(ctx) {
+			return written, ErrDrained
+		}
+		size := d.chunkSize(url)
+		offsetTo := min(offset+size, end)
+		numChunks := chunk - 1 + (end-offset+size-1)/size
+
+		d.chunkStarted(url, chunk, numChunks, offset, offsetTo)
+		r := ClosedRange(offset, offsetTo-1)
+		began := time.Now()
+		if !d.Hedge {
+			n, err := d.streamChunk(ctx, url, set, r, w)
+			written += n
+			d.chunkDone(url, chunk, numChunks, r, n, began, err)
+			if err != nil {
+				return written, unwrapSink(err)
+			}
+		} else {
+			// The losing request of a race must not have written anything,
+			// so hedged chunks are buffered.
+			buf, err := d.fetchChunk(ctx, url, set, r)
+			if err != nil {
+				d.chunkDone(url, chunk, numChunks, r, 0, began, err)
+				return written, unwrapSink(err)
+			}
+			d.chunkDone(url, chunk, numChunks, r, int64(buf.Len()), began, nil)
+			n, err := w.Write(buf.Bytes())
+			d.putBuffer(buf)
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+		}
+
+		offset = offsetTo
+		chunk++
+	}
+
+	return written, nil
+}
+
+// chunkDone records the end of chunk r of url, after n bytes, as a debug
+// record.
+func (d *Downloader) chunkDone(url string, chunk, numChunks int64, r ByteRange, n int64, began time.Time, err error) {
+	elapsed := time.Since(began)
+	if err == nil {
+		d.chunkFinished(n, elapsed)
+	}
+	d.emit(Event{
+		Kind: ChunkDone, URL: url, From: r.First, To: r.Last + 1, Chunk: chunk, NumChunks: numChunks,
+		Bytes: n, Elapsed: elapsed, Err: err,
+	})
+	if d.Log == nil {
+		return
+	}
+	msg := fmt.Sprintf(
+		"fetched %v/%v [%v, %v) of %s in %v",
+		chunk, numChunks, r.First, r.Last+1, url, elapsed.Round(time.Millisecond),
+	)
+	attrs := []any{
+		"event", "chunk_done",
+		"url", url,
+		"chunk", chunk,
+		"num_chunks", numChunks,
+		"from", r.First,
+		"to", r.Last + 1,
+		"bytes", n,
+		"seconds", elapsed.Seconds(),
+	}
+	if err != nil {
+		msg += ": " + err.Error()
+		attrs = append(attrs, "error", err.Error())
+	}
+	d.log(slog.LevelDebug, msg, attrs...)
+}
+
+// DownloadStream writes url from byte start to w with a single GET, for
+// servers that do not serve ranges (info.Ranges is false), or send the
+// object chunked without a Content-Length. A failed attempt keeps what it
+// wrote. The retry asks for the rest with If-Range when info has a
+// validator, and otherwise reads the object again from the beginning and
+// skips what was already written. A body read whole is checked against
+// the checksum trailers the server announces, if any.
+func (d *Downloader) DownloadStream(
+	ctx context.Context,
+	url string,
+	info Info,
+	start int64,
+	w io.Writer,
+) (written int64, err error) {
+	d.logf("%s does not serve ranges, fetching it in one request", url)
+	began := time.Now()
+	d.emit(Event{Kind: TransferStarted, URL: url, From: start, To: info.Size})
+	defer func() {
+		d.emit(Event{
+			Kind: TransferDone, URL: url, From: start, To: info.Size,
+			Bytes: written, Elapsed: time.Since(began), Err: err,
+		})
+	}()
+	ctx, release := d.fairShare(ctx, url, start, info.Size)
+	defer release()
+	err = d.retry(ctx, "", url, func() error {
+		n, err := d.streamFrom(ctx, url, info, start+written, w)
+		written += n
+		return err
+	})
+	return written, unwrapSink(err)
+}
+
+func (d *Downloader) streamFrom(
+	parent context.Context,
+	url string,
+	info Info,
+	offset int64,
+	w io.Writer,
+) (int64, error) {
+	ctx, cancel := context.WithCancelCause(parent)
+	defer cancel(nil)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return 0, err
+	}
+	// Without a Range the transport would ask for gzip and decode it
+	// transparently, and the bytes would no longer be those info and the
+	// offsets count.
+	req.Header.Set("Accept-Encoding", "identity")
+	validator := info.ETag
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		// If-Range takes only strong validators.
+		validator = info.LastModified
+	}
+	r := OpenRange(offset)
+	if offset > 0 && validator != "" {
+		req.Header.Set("Range", r.String())
+		req.Header.Set("If-Range", validator)
+	}
+
+	guard := d.newSpeedGuard(cancel)
+	defer guard.stop()
+
+	resp, err := d.do(req)
+	if err != nil {
+		if cause := context.Cause(ctx); cause != nil {
+			return 0, cause
+		}
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	body := guard.wrap(d.limitRate(ctx, resp.Body))
+	var trailers *trailerCheck
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && req.Header.Get("Range") != "":
+		if _, _, _, err := r.CheckContentRange(resp.Header.Get("Content-Range")); err != nil {
+			return 0, err
+		}
+	case resp.StatusCode == http.StatusOK:
+		if changed(info, resp.Header) {
+			return 0, changedError(url)
+		}
+		// Only a body read from its first byte can be checked against
+		// the trailers.
+		if trailers = newTrailerCheck(resp); trailers != nil {
+			body = io.TeeReader(body, trailers)
+		}
+		if _, err := io.CopyN(io.Discard, body, offset); err != nil {
+			if cause := context.Cause(ctx); cause != nil {
+				return 0, cause
+			}
+			return 0, err
+		}
+	default:
+		return 0, statusError(resp)
+	}
+	n, err := copyBody(ctx, w, body)
+	if err == nil && trailers != nil {
+		err = d.checkTrailers(url, trailers, resp.Trailer)
+	}
+	return n, err
+}
+
+func changedError(url string) error {
+	return &PermanentError{Err: fmt.Errorf("%s changed during the download", url)}
+}
+
+// remember keeps the validators of the latest Stat of url, so its chunks
+// are checked against the version that was planned for.
+func (d *Downloader) remember(url string, info Info) {
+	d.validatorsMu.Lock()
+	defer d.validatorsMu.Unlock()
+	if info.ETag == "" && info.LastModified == "" {
+		delete(d.validators, url)
+		return
+	}
+	if d.validators == nil {
+		d.validators = map[string]Info{}
+	}
+	d.validators[url] = Info{ETag: info.ETag, LastModified: info.LastModified}
+}
+
+func (d *Downloader) validatorsOf(url string) (Info, bool) {
+	d.validatorsMu.Lock()
+	defer d.validatorsMu.Unlock()
+	info, ok := d.validators[url]
+	return info, ok
+}
+
+// changed reports whether h carries validators that differ from info's.
+func changed(info Info, h http.Header) bool {
+	etag, lastModified := h.Get("ETag"), h.Get("Last-Modified")
+	return info.ETag != "" && etag != "" && etag != info.ETag ||
+		info.LastModified != "" && lastModified != "" && lastModified != info.LastModified
+}
+
+// downloadParallel fetches the chunks of [start, end) of url with up to
+// workers requests in flight, or as many as SetWorkers allows once called,
+// and writes them to w in order. The chunks started and not yet written,
+// each holding its pooled buffer, are at most Window or that many if more,
+// and take at most WindowMemory bytes; the first chunk is let through
+// whatever its size, so the download always goes on.
+func (d *Downloader) downloadParallel(
+	parent context.Context,
+	url string,
+	set *sourceSet,
+	workers int,
+	start, end int64,
+	w io.Writer,
+) (written int64, err error) {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	limit := func() int64 {
+		if n := d.workersSet.Load(); n > 0 {
+			return n
+		}
+		return int64(workers)
+	}
+	window := func() int64 {
+		return max(int64(d.Window), limit())
+	}
+	// ahead counts the chunks started and not yet written, held their
+	// bytes.
+	var inFlight, ahead, held atomic.Int64
+	freed := make(chan struct{}, 1)
+	free := func() {
+		select {
+		case freed <- struct{}{}:
+		default:
+		}
+	}
+	pending := make(chan chan chunkResult, max(workers, maxSetWorkers, d.Window))
+
+	go func() {
+		defer close(pending)
+		next := start
+		for chunk := int64(1); next < end && !d.drained(ctx); chunk++ {
+			var size int64
+			for {
+				if ctx.Err() != nil {
+					return
+				}
+				changed := d.workersChange()
+				size = d.chunkSize(url)
+				fits := d.WindowMemory <= 0 || held.Load() == 0 ||
+					held.Load()+min(size, end-next) <= d.WindowMemory
+				if inFlight.Load() < limit() && ahead.Load() < window() && fits {
+					break
+				}
+				select {
+				case <-freed:
+				case <-changed:
+				case <-ctx.Done():
+					return
+				}
+			}
+			offset := next
+			offsetTo := min(offset+size, end)
+			inFlight.Add(1)
+			ahead.Add(1)
+			held.Add(offsetTo - offset)
+			next = offsetTo
+			numChunks := chunk - 1 + (end-offset+size-1)/size
+			result := make(chan chunkResult, 1)
+			pending <- result
+
+			go func() {
+				d.chunkStarted(url, chunk, numChunks, offset, offsetTo)
+				began := time.Now()
+				r := ClosedRange(offset, offsetTo-1)
+				buf, err := d.fetchChunk(ctx, url, set, r)
+				inFlight.Add(-1)
+				free()
+				n := int64(0)
+				if err == nil {
+					n = int64(buf.Len())
+				}
+				d.chunkDone(url, chunk, numChunks, r, n, began, err)
+				result <- chunkResult{buf, err}
+			}()
+		}
+	}()
+
+	for result := range pending {
+		r := <-result
+		if r.err != nil {
+			return written, r.err
+		}
+		n, err := w.Write(r.buf.Bytes())
+		chunk := int64(r.buf.Len())
+		d.putBuffer(r.buf)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+		ahead.Add(-1)
+		held.Add(-chunk)
+		free()
+	}
+	if written < end-start {
+		// The producer stopped early because of a drain or because
+		// parent was cancelled.
+		if err := context.Cause(parent); err != nil {
+			return written, err
+		}
+		return written, ErrDrained
+	}
+	return written, nil
+}
@@ -0,0 +1,311 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowServer serves content in ranges, 10 bytes a millisecond, flushing
+// as it goes so a cancelled request has delivered part of its range.
+func slowServer(t *testing.T, content []byte) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var first, last int
+		if _, err := fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-%d", &first, &last); err != nil {
+			http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(content))
+			return
+		}
+		last = min(last, len(content)-1)
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, len(content)))
+		w.Header().Set("Content-Length", strconv.Itoa(last-first+1))
+		w.WriteHeader(http.StatusPartialContent)
+		for p := content[first : last+1]; len(p) > 0; {
+			n := min(len(p), 10)
+			if _, err := w.Write(p[:n]); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			p = p[n:]
+			time.Sleep(time.Millisecond)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestDownloadRangeCancel(t *testing.T) {
+	content := make([]byte, 2000)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	srv := slowServer(t, content)
+	const start, end = 100, 1900
+
+	for _, tc := range []struct {
+		name    string
+		workers int
+		spool   bool
+	}{
+		{"sequential", 1, false},
+		{"parallel", 4, false},
+		{"spooled", 4, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := testDownloader(srv.Client())
+			d.Workers = tc.workers
+			d.ChunkSize = 100
+			if tc.spool {
+				d.SpoolDir = t.TempDir()
+			}
+
+			cause := errors.New("stopped")
+			ctx, cancel := context.WithCancelCause(context.Background())
+			time.AfterFunc(30*time.Millisecond, func() { cancel(cause) })
+			var out bytes.Buffer
+			written, err := d.DownloadRange(ctx, srv.URL+"/a", int64(len(content)), start, end, &out)
+			if !errors.Is(err, cause) {
+				t.Errorf("got %v, want the cause of the cancellation", err)
+			}
+			if written >= end-start {
+				t.Fatalf("all %v bytes were written before the cancellation", written)
+			}
+			// What was written is all there is, in order from start.
+			if int64(out.Len()) != written || !bytes.Equal(out.Bytes(), content[start:start+written]) {
+				t.Fatalf("reported %v bytes written, wrote %v", written, out.Len())
+			}
+
+			// It goes on from start+written.
+			n, err := d.DownloadRange(context.Background(), srv.URL+"/a", int64(len(content)), start+written, end, &out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if written+n != end-start || !bytes.Equal(out.Bytes(), content[start:end]) {
+				t.Errorf("resumed after %v bytes and wrote %v more, which do not add up", written, n)
+			}
+		})
+	}
+}
+
+func TestStreamRangeChecks(t *testing.T) {
+	content := []byte("0123456789abcdefghij")
+	for _, tc := range []struct {
+		name    string
+		r       ByteRange
+		serve   func(w http.ResponseWriter)
+		wantErr string
+	}{
+		{"206", ClosedRange(5, 9), func(w http.ResponseWriter) {
+			w.Header().Set("Content-Range", "bytes 5-9/20")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(content[5:10])
+		}, ""},
+		{"other range", ClosedRange(5, 9), func(w http.ResponseWriter) {
+			w.Header().Set("Content-Range", "bytes 0-4/20")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(content[0:5])
+		}, `requested bytes=5-9 but server sent "bytes 0-4/20"`},
+		{"longer range", ClosedRange(5, 9), func(w http.ResponseWriter) {
+			w.Header().Set("Content-Range", "bytes 5-12/20")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(content[5:13])
+		}, "but server sent"},
+		{"Content-Length", ClosedRange(5, 9), func(w http.ResponseWriter) {
+			w.Header().Set("Content-Range", "bytes 5-9/20")
+			w.Header().Set("Content-Length", "4")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(content[5:9])
+		}, "does not match Content-Range"},
+		{"short body", ClosedRange(5, 9), func(w http.ResponseWriter) {
+			w.Header().Set("Content-Range", "bytes 5-9/20")
+			w.WriteHeader(http.StatusPartialContent)
+			// Sent chunked, without a Content-Length to hold it to.
+			w.(http.Flusher).Flush()
+			w.Write(content[5:8])
+		}, "ended after 3 of 5 bytes"},
+		{"200 from 0", ClosedRange(0, 9), func(w http.ResponseWriter) {
+			w.Write(content)
+		}, "requested bytes=0-9 but server answered 200 OK"},
+		{"200 from 5", ClosedRange(5, 9), func(w http.ResponseWriter) {
+			w.Write(content)
+		}, "server answered 200 OK"},
+		{"403", ClosedRange(5, 9), func(w http.ResponseWriter) {
+			http.Error(w, "<html>denied</html>", http.StatusForbidden)
+		}, "403"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				tc.serve(w)
+			}))
+			t.Cleanup(srv.Close)
+			d := testDownloader(srv.Client())
+			var out bytes.Buffer
+			n, err := d.streamRange(context.Background(), srv.URL, tc.r, &out)
+			if tc.wantErr == "" {
+				if err != nil || !bytes.Equal(out.Bytes(), content[5:10]) || n != 5 {
+					t.Errorf("got %q, %v, %v; want %q", out.Bytes(), n, err, content[5:10])
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("got %v, want an error saying %q", err, tc.wantErr)
+			}
+			// A bad response is retried; a 403 goes by its status.
+			if errors.As(err, new(*PermanentError)) && tc.name != "403" {
+				t.Errorf("%v is permanent, want it retried", err)
+			}
+		})
+	}
+}
+
+func TestSpeedLimit(t *testing.T) {
+	content := []byte("0123456789abcdefghij")
+	var mu sync.Mutex
+	gets := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		gets[req.URL.Path]++
+		n := gets[req.URL.Path]
+		mu.Unlock()
+		if req.URL.Path == "/stall" || n == 1 {
+			// A trickle well below the limit, then nothing.
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(content)-1, len(content)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(content[:2])
+			w.(http.Flusher).Flush()
+			<-req.Context().Done()
+			return
+		}
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(srv.Close)
+	d := testDownloader(srv.Client())
+	d.SpeedLimit, d.SpeedTime = 1000, time.Second
+
+	_, err := d.streamRange(context.Background(), srv.URL+"/stall", ClosedRange(0, int64(len(content))-1), io.Discard)
+	var stall *StallError
+	if !errors.As(err, &stall) || stall.Limit != 1000 || stall.Time != time.Second {
+		t.Fatalf("got %v, want a StallError", err)
+	}
+
+	// A stalled chunk is retried like any other failure.
+	d.MaxRetry = 3
+	var out bytes.Buffer
+	if _, err := d.DownloadFrom(context.Background(), srv.URL+"/once", int64(len(content)), 0, &out); err != nil || out.String() != string(content) {
+		t.Errorf("got %q, %v; want %q", out.String(), err, content)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if gets["/once"] != 2 {
+		t.Errorf("%v requests, want the stalled one and its retry", gets["/once"])
+	}
+}
+
+func TestStreamTrailers(t *testing.T) {
+	content := []byte("streamed without a length\n")
+	sum := sha256.Sum256(content)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Trailer", "X-Amz-Checksum-Sha256")
+		w.Write(content[:10])
+		w.(http.Flusher).Flush()
+		w.Write(content[10:])
+		switch req.URL.Path {
+		case "/good":
+			w.Header().Set("X-Amz-Checksum-Sha256", base64.StdEncoding.EncodeToString(sum[:]))
+		case "/bad":
+			w.Header().Set("X-Amz-Checksum-Sha256", base64.StdEncoding.EncodeToString(make([]byte, sha256.Size)))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	d := testDownloader(srv.Client())
+
+	for path, wantErr := range map[string]string{
+		"/good": "",
+		// A trailer announced and then left out checks nothing.
+		"/absent": "",
+		"/bad":    "sha256 mismatch with the trailer",
+	} {
+		var out bytes.Buffer
+		n, err := d.DownloadStream(context.Background(), srv.URL+path, Info{Size: -1}, 0, &out)
+		if wantErr == "" {
+			if err != nil || n != int64(len(content)) || !bytes.Equal(out.Bytes(), content) {
+				t.Errorf("%s: got %q, %v", path, out.Bytes(), err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), wantErr) || !errors.As(err, new(*PermanentError)) {
+			t.Errorf("%s: got %v, want a permanent error saying %q", path, err, wantErr)
+		}
+	}
+}
+
+func TestWindow(t *testing.T) {
+	content := make([]byte, 100)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	for _, tc := range []struct {
+		name    string
+		window  int
+		memory  int64
+		started int
+	}{
+		{"workers", 0, 0, 2},
+		{"window", 5, 0, 5},
+		{"memory", 5, 30, 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			release := make(chan struct{})
+			var mu sync.Mutex
+			started := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				mu.Lock()
+				started++
+				mu.Unlock()
+				// The first chunk is slow, and the others wait their
+				// turn to be written behind it.
+				if req.Header.Get("Range") == "bytes=0-9" {
+					<-release
+				}
+				http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(content))
+			}))
+			t.Cleanup(srv.Close)
+			d := testDownloader(srv.Client())
+			d.Workers, d.ChunkSize = 2, 10
+			d.Window, d.WindowMemory = tc.window, tc.memory
+
+			var out bytes.Buffer
+			done := make(chan error)
+			go func() {
+				_, err := d.DownloadFrom(context.Background(), srv.URL, int64(len(content)), 0, &out)
+				done <- err
+			}()
+			count := func() int {
+				mu.Lock()
+				defer mu.Unlock()
+				return started
+			}
+			for deadline := time.Now().Add(5 * time.Second); count() < tc.started && time.Now().Before(deadline); {
+				time.Sleep(time.Millisecond)
+			}
+			time.Sleep(50 * time.Millisecond)
+			if n := count(); n != tc.started {
+				t.Errorf("%v chunks started while the first was held, want %v", n, tc.started)
+			}
+			close(release)
+			if err := <-done; err != nil || !bytes.Equal(out.Bytes(), content) {
+				t.Errorf("got %v bytes, %v; want them all in order", out.Len(), err)
+			}
+		})
+	}
+}
@@ -0,0 +1,415 @@
+// Package downloader fetches HTTP objects in byte-range chunks, retrying
+// each chunk on its own so a flaky connection costs one chunk rather than
+// the whole transfer. It is the engine behind the gocat command.
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/msmania/gocat/ratelimit"
+)
+
+// Downloader holds the transfer settings. Create one with New and adjust
+// the fields before the first download; they must not change afterwards.
+//
+// Every method takes a context. Cancelling it aborts in-flight requests
+// and backoffs; the methods then return context.Cause(ctx), and writers
+// have received only whole chunks.
+type Downloader struct {
+	Client *http.Client
+	// Credentials, when set, puts credentials on every request and
+	// renews them when they are refused.
+	Credentials CredentialsProvider
+
+	// MaxRetry is the number of attempts per chunk, and per list.
+	MaxRetry int
+	// NetworkWait is how long to pause every transfer when the local
+	// network goes away, probing until it is back, before failing. Such
+	// failures do not use up MaxRetry. Zero treats them like any other.
+	NetworkWait time.Duration
+	// RetryInitial is the first backoff, grown by RetryMultiplier after
+	// each failed attempt up to RetryMax.
+	RetryInitial    time.Duration
+	RetryMax        time.Duration
+	RetryMultiplier float64
+	// ChunkSize is the size of each range request.
+	ChunkSize int64
+	// AdaptiveChunks replaces ChunkSize with a size that starts at
+	// MinChunkSize and follows the throughput and failures seen, within
+	// MaxChunkSize. Chunk counts passed to OnChunk are then estimates.
+	AdaptiveChunks bool
+	MinChunkSize   int64
+	MaxChunkSize   int64
+	// Workers is the number of chunks fetched concurrently per object.
+	Workers int
+	// SmallSize is the largest object Peek fetches whole in one request;
+	// zero makes Peek a Stat. Objects of HugeSize bytes or more, when it
+	// is positive, are fetched HugeWorkers chunks at a time if that is
+	// more than Workers.
+	SmallSize   int64
+	HugeSize    int64
+	HugeWorkers int
+	// Hedge races a duplicate request for chunks slower than the recent
+	// p95 latency.
+	Hedge bool
+	// SpoolDir, when set, holds the chunks of a parallel download that
+	// wait for their turn in a temporary file there instead of memory. It
+	// rules out Hedge.
+	SpoolDir string
+	// Window lets a parallel download run up to Window chunks ahead of the
+	// one being written, so that a slow chunk holds up the output but not
+	// the workers: the chunks done after it wait in memory for their turn,
+	// WindowMemory bytes of chunks at most when it is positive. A Window
+	// no larger than Workers holds each chunk in its worker's slot until it
+	// is written. Neither applies with SpoolDir.
+	Window       int
+	WindowMemory int64
+
+	// SpeedLimit and SpeedTime abort a chunk whose rate stays below
+	// SpeedLimit bytes per second for SpeedTime, like curl's
+	// --speed-limit/--speed-time. A zero SpeedLimit disables the check.
+	SpeedLimit int64
+	SpeedTime  time.Duration
+	// ChunkTimeout bounds each ranged request, from sending it to the
+	// last byte of its body; an attempt over it is retried. Zero means no
+	// limit.
+	ChunkTimeout time.Duration
+
+	// RateLimit caps the combined rate of every transfer of this
+	// Downloader, and ConnRateLimit that of each single request, in bytes
+	// per second. Zero means no limit.
+	RateLimit     int64
+	ConnRateLimit int64
+	// Fair shares RateLimit between the transfers in flight at once.
+	Fair Fairness
+
+	// ListTimeout bounds each attempt to fetch a list; zero means no
+	// limit. MaxListSize caps a list before and after decompression, and
+	// MaxLineLength caps each of its lines.
+	ListTimeout   time.Duration
+	MaxListSize   int64
+	MaxLineLength int
+	// ExpandEnv replaces ${VAR} and ${VAR:-default} in the URLs of list
+	// entries and their mirrors; StrictEnv additionally rejects unset
+	// variables without a default. Any variable may be expanded in a list
+	// read with ScanLocalList, but elsewhere, as in a list fetched from a
+	// server, only those in EnvAllow, so that a list cannot send the
+	// environment to a host of its choosing.
+	ExpandEnv bool
+	StrictEnv bool
+	EnvAllow  []string
+	// Manifest fails a list on a malformed entry, mirror or field (see
+	// EntryMeta) instead of skipping it, and takes any key=value field
+	// for a field rather than a mirror.
+	Manifest bool
+	// Glob expands the {a,b} and [1-9] globs of list entries (see
+	// ExpandGlob), as Manifest does.
+	Glob bool
+	// RecursiveLists expands list lines that name another list, as
+	// "list:" and its URL or a URL whose path ends in ListSuffix, into
+	// that list's entries, at most MaxListDepth lists deep. A list that
+	// includes itself, directly or not, is skipped rather than read again.
+	RecursiveLists bool
+	ListSuffix     string
+	MaxListDepth   int
+
+	// Schemes lists URL schemes besides http and https that list entries
+	// may use, for a Client whose transport serves them.
+	Schemes []string
+
+	// Mirrors are other locations of the tree a list lives in: an entry
+	// under the list's directory is also fetched from the same path under
+	// each of them. A list line may name mirrors of its own entry as well,
+	// as further whitespace-separated URLs. Ranged downloads spread their
+	// chunks across every source, with at least one worker per source, and
+	// move a chunk to another source when one fails.
+	Mirrors []string
+
+	// Logger receives retry and warning messages; nil discards them.
+	Logger *log.Logger
+	// Log, when set, receives them in place of Logger as records with a
+	// level and the details as attributes, debug records of each finished
+	// chunk included.
+	Log *slog.Logger
+	// OnChunk, when set, is called as each chunk of [from, to) starts.
+	OnChunk func(url string, chunk, numChunks, from, to int64)
+	// OnRetry, when set, is called for every failed attempt before the
+	// backoff.
+	OnRetry func(url string, err error, backoff time.Duration)
+	// OnEvent, when set, receives an Event as each transfer and chunk
+	// starts and ends, for every retry, and for every body checked
+	// against the digests its server sent, for a program embedding the
+	// Downloader to show progress its own way. Chunks fetched in parallel
+	// report from their own goroutines, at the same time.
+	OnEvent func(Event)
+
+	credentials credentialsState
+	latencies   latencyTracker
+	network     networkGate
+	buffers     sync.Pool
+	rateOnce    sync.Once
+	rate        *ratelimit.Bucket
+	fair        fairShares
+	sizer       chunkSizer
+	pauseMu     sync.Mutex
+	// resumed is closed by Resume; it is nil while not paused.
+	resumed  chan struct{}
+	draining atomic.Bool
+	// workersSet is the SetWorkers override, 0 without one; workersChanged
+	// is closed when it changes.
+	workersMu      sync.Mutex
+	workersSet     atomic.Int64
+	workersChanged chan struct{}
+
+	alternatesMu sync.Mutex
+	alternates   map[string][]string
+
+	// sources holds the meta of each entry under its URL and those of
+	// its mirrors.
+	metaMu  sync.Mutex
+	meta    map[string]EntryMeta
+	sources map[string]EntryMeta
+
+	// validators holds the ETag and Last-Modified each URL was last
+	// stat'ed with; chunks of it must come from that same version.
+	validatorsMu sync.Mutex
+	validators   map[string]Info
+}
+
+// New returns a Downloader using client with the defaults of the gocat
+// command.
+func New(client *http.Client) *Downloader {
+	return &Downloader{
+		Client:          client,
+		MaxRetry:        100,
+		RetryInitial:    time.Second,
+		RetryMax:        30 * time.Second,
+		RetryMultiplier: 2,
+		NetworkWait:     30 * time.Minute,
+		ChunkSize:       16 << 20,
+		MinChunkSize:    1 << 20,
+		MaxChunkSize:    64 << 20,
+		Workers:         1,
+		MaxListSize:     64 << 20,
+		MaxLineLength:   1 << 20,
+		MaxListDepth:    8,
+	}
+}
+
+func (d *Downloader) logf(format string, args ...any) {
+	d.log(slog.LevelInfo, fmt.Sprintf(format, args...))
+}
+
+func (d *Downloader) warnf(format string, args ...any) {
+	d.log(slog.LevelWarn, fmt.Sprintf(format, args...))
+}
+
+// log sends msg to Log with attrs, or to Logger without them. Logger has
+// no levels, so it is not bothered with debug records.
+func (d *Downloader) log(level slog.Level, msg string, attrs ...any) {
+	switch {
+	case d.Log != nil:
+		d.Log.Log(context.Background(), level, msg, attrs...)
+	case d.Logger != nil && level >= slog.LevelInfo:
+		d.Logger.Printf("[%v] %s", time.Now().Format(time.RFC3339), msg)
+	}
+}
+
+// retry runs attempt until it succeeds, making up to MaxRetry attempts, or
+// the retries= of url's entry. A PermanentError ends it at once, and an attempt that found the network
+// down waits for it to come back without using up the budget. A cancelled
+// transfer is neither logged nor counted as a retry.
+func (d *Downloader) retry(ctx context.Context, what, url string, attempt func() error) error {
+	p := d.policy()
+	if n := d.sourceMeta(url).Retries; n > 0 {
+		p.MaxAttempts = n
+	}
+	p.Hold = func(ctx context.Context, err error) (bool, error) {
+		if !d.networkDown(err) {
+			return false, nil
+		}
+		return true, d.awaitNetwork(ctx, url, err)
+	}
+	p.OnRetry = func(i int, err error, wait time.Duration) {
+		d.retried(what, url, i, p.MaxAttempts, err, wait)
+	}
+	return p.Do(ctx, attempt)
+}
+
+// retried reports failed attempt i of at most maxRetry before its backoff
+// of wait.
+func (d *Downloader) retried(what, url string, i, maxRetry int, err error, wait time.Duration) {
+	d.chunkFailed()
+	d.log(
+		slog.LevelWarn,
+		fmt.Sprintf("retrying %v%v/%v in %v (%v)", what, i, maxRetry, wait.Round(time.Millisecond), err.Error()),
+		"event", "retry",
+		"url", url,
+		"attempt", i,
+		"max_retry", maxRetry,
+		"backoff_seconds", wait.Seconds(),
+		"error", err.Error(),
+	)
+	if d.OnRetry != nil {
+		d.OnRetry(url, err, wait)
+	}
+	d.emit(Event{Kind: Retry, URL: url, Attempt: i, Backoff: wait, Err: err})
+}
+
+// Info is what the metadata phase learns about a URL: its size, the
+// validators identifying this version of the object, and the filename and
+// digests the server offers, if any.
+type Info struct {
+	// Size is -1 when the server does not say.
+	Size int64
+	// Ranges reports whether the server serves byte ranges. Objects
+	// without them can only be fetched whole, with DownloadStream.
+	Ranges       bool
+	ETag         string
+	LastModified string
+	Filename     string
+	// ContentType is the media type without parameters, lowercased.
+	ContentType string
+	// ContentEncoding is the lowercased Content-Encoding, if any.
+	ContentEncoding string
+	// Digests maps an algorithm (md5, sha1, sha256, crc32, crc32c) to the
+	// hex digest of the whole object.
+	Digests map[string]string
+}
+
+func newInfo(size int64, h http.Header) Info {
+	info := Info{
+		Size:            size,
+		ETag:            h.Get("ETag"),
+		LastModified:    h.Get("Last-Modified"),
+		ContentEncoding: strings.ToLower(h.Get("Content-Encoding")),
+	}
+	if mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type")); err == nil {
+		info.ContentType = mediaType
+	}
+	if _, params, err := mime.ParseMediaType(h.Get("Content-Disposition")); err == nil {
+		info.Filename = params["filename"]
+	}
+	return info
+}
+
+// Stat learns the size and validators of url with HEAD, falling back to
+// StatRange for servers that reject HEAD or do not advertise ranges. Like
+// transfers, it waits out a lost network for up to NetworkWait. When url
+// fails, its mirrors are asked in turn.
+func (d *Downloader) Stat(ctx context.Context, url string) (Info, error) {
+	info, err := d.statWait(ctx, url)
+	if err == nil || ctx.Err() != nil {
+		return info, err
+	}
+	for _, m := range d.MirrorsOf(url) {
+		d.warnf("%s: %v, asking mirror %s", url, err.Error(), m)
+		if info, merr := d.statWait(ctx, m); merr == nil {
+			return info, nil
+		}
+	}
+	return info, err
+}
+
+func (d *Downloader) statWait(ctx context.Context, url string) (Info, error) {
+	for {
+		info, err := d.stat(ctx, url)
+		if err == nil {
+			d.remember(url, info)
+		}
+		if err == nil || !d.networkDown(err) {
+			return info, err
+		}
+		if werr := d.awaitNetwork(ctx, url, err); werr != nil {
+			return Info{}, werr
+		}
+	}
+}
+
+func (d *Downloader) stat(ctx context.Context, url string) (Info, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		return Info{}, err
+	}
+	resp, err := d.do(req)
+	if err != nil || resp.StatusCode/100 != 2 {
+		// Some servers reject HEAD outright but serve ranges fine.
+		if err == nil {
+			resp.Body.Close()
+		}
+		return d.StatRange(ctx, url)
+	}
+	resp.Body.Close()
+
+	size := int64(-1)
+	if v := resp.Header.Get("Content-Length"); v != "" {
+		if size, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return Info{}, err
+		}
+	}
+
+	if resp.Header.Get("Accept-Ranges") != "bytes" || size < 0 {
+		// Servers often serve ranges without advertising them; the probe
+		// also settles a missing length.
+		info, err := d.StatRange(ctx, url)
+		if err != nil {
+			return Info{}, err
+		}
+		info.Digests = headerDigests(resp.Header)
+		return info, nil
+	}
+
+	info := newInfo(size, resp.Header)
+	info.Ranges = true
+	info.Digests = headerDigests(resp.Header)
+	return info, nil
+}
+
+// StatRange discovers the size of url without HEAD by requesting its first
+// byte. A 206 answer both proves range support and carries the full length
+// in Content-Range. A 200 answer means the server ignores ranges; Size is
+// then its Content-Length, if any.
+func (d *Downloader) StatRange(ctx context.Context, url string) (Info, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return Info{}, err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+
+	resp, err := d.do(req)
+	if err != nil {
+		return Info{}, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1))
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return newInfo(resp.ContentLength, resp.Header), nil
+	case http.StatusPartialContent:
+	default:
+		return Info{}, fmt.Errorf("range probe failed: %w", statusError(resp))
+	}
+	_, _, complete, err := ParseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return Info{}, err
+	}
+	if complete < 0 {
+		// Chunks cannot be planned without the length.
+		return newInfo(-1, resp.Header), nil
+	}
+	info := newInfo(complete, resp.Header)
+	info.Ranges = true
+	return info, nil
+}
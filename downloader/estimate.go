@@ -0,0 +1,25 @@
+package downloader
+
+// EstimateRequests returns how many GETs a download of bytes [from, to)
+// of url would send after Peek found info: none for what came along with
+// the peek, one for an object fetched without ranges, and a chunk's worth
+// for each of the rest. Retries, hedged requests and the resizing of
+// AdaptiveChunks are not foreseen, so the real count may be higher.
+func (d *Downloader) EstimateRequests(url string, info Info, from, to int64) int64 {
+	peeked := min(d.SmallSize, max(info.Size, 0))
+	switch {
+	case info.Size >= 0 && info.Size <= d.SmallSize:
+		return 0
+	case !info.Ranges || info.Size < 0:
+		return 1
+	}
+	rest := to - max(from, peeked)
+	if rest <= 0 {
+		return 0
+	}
+	chunk := d.chunkSize(url)
+	if chunk <= 0 {
+		return 1
+	}
+	return (rest + chunk - 1) / chunk
+}
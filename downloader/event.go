@@ -0,0 +1,80 @@
+package downloader
+
+import "time"
+
+// EventKind is what an Event reports.
+type EventKind int
+
+const (
+	// TransferStarted and TransferDone bracket a call of DownloadRange,
+	// DownloadFrom or DownloadStream, that is one file or one part of it.
+	TransferStarted EventKind = iota
+	TransferDone
+	// ChunkStarted and ChunkDone bracket each range request of a ranged
+	// transfer, retries included.
+	ChunkStarted
+	ChunkDone
+	// Retry is a failed attempt, before its backoff.
+	Retry
+	// Verified is a body checked against the digests its server sent
+	// along, passed or not.
+	Verified
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case TransferStarted:
+		return "transfer_started"
+	case TransferDone:
+		return "transfer_done"
+	case ChunkStarted:
+		return "chunk_started"
+	case ChunkDone:
+		return "chunk_done"
+	case Retry:
+		return "retry"
+	case Verified:
+		return "verified"
+	}
+	return "unknown"
+}
+
+// Event is what OnEvent receives. Fields that do not apply to its Kind
+// are zero.
+type Event struct {
+	Kind EventKind
+	URL  string
+	// From and To are the bytes [From, To) of a transfer or a chunk; To
+	// is -1 for a transfer of unknown size.
+	From, To int64
+	// Chunk numbers a chunk from 1 among NumChunks, which is an estimate
+	// with AdaptiveChunks.
+	Chunk, NumChunks int64
+	// Bytes is what a finished transfer or chunk wrote.
+	Bytes   int64
+	Elapsed time.Duration
+	// Attempt counts the failed attempts of a Retry from 0, and Backoff
+	// is the wait before the next.
+	Attempt int
+	Backoff time.Duration
+	// Algorithms are the digests a Verified body was checked against.
+	Algorithms []string
+	// Err is what a transfer, a chunk or an attempt failed with, or the
+	// mismatch a body was Verified with.
+	Err error
+}
+
+func (d *Downloader) emit(e Event) {
+	if d.OnEvent != nil {
+		d.OnEvent(e)
+	}
+}
+
+// chunkStarted reports chunk of numChunks, bytes [from, to) of url, as it
+// starts.
+func (d *Downloader) chunkStarted(url string, chunk, numChunks, from, to int64) {
+	if d.OnChunk != nil {
+		d.OnChunk(url, chunk, numChunks, from, to)
+	}
+	d.emit(Event{Kind: ChunkStarted, URL: url, From: from, To: to, Chunk: chunk, NumChunks: numChunks})
+}
@@ -0,0 +1,126 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// eventLog collects the events of a Downloader.
+type eventLog struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (l *eventLog) add(e Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, e)
+}
+
+func (l *eventLog) kinds() []EventKind {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var kinds []EventKind
+	for _, e := range l.events {
+		kinds = append(kinds, e.Kind)
+	}
+	return kinds
+}
+
+func TestEvents(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 3)
+	failed := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Range") == "bytes=10-19" && !failed {
+			failed = true
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(srv.Close)
+
+	d := testDownloader(srv.Client())
+	d.MaxRetry = 2
+	d.ChunkSize = 10
+	var log eventLog
+	d.OnEvent = log.add
+	if _, err := d.Download(context.Background(), srv.URL+"/a", &bytes.Buffer{}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []EventKind{
+		TransferStarted,
+		ChunkStarted, ChunkDone,
+		ChunkStarted, Retry, ChunkDone,
+		ChunkStarted, ChunkDone,
+		TransferDone,
+	}
+	if got := log.kinds(); !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	e := log.events
+	if e[0].From != 0 || e[0].To != 30 || e[8].Bytes != 30 || e[8].Err != nil {
+		t.Errorf("transfer %+v, %+v", e[0], e[8])
+	}
+	if e[3].Chunk != 2 || e[3].NumChunks != 3 || e[3].From != 10 || e[3].To != 20 {
+		t.Errorf("second chunk %+v", e[3])
+	}
+	var se *StatusError
+	if !errors.As(e[4].Err, &se) || se.StatusCode != 503 || e[4].Attempt != 0 || e[4].Backoff <= 0 {
+		t.Errorf("retry %+v", e[4])
+	}
+	if e[5].Bytes != 10 || e[5].Err != nil {
+		t.Errorf("second chunk done %+v", e[5])
+	}
+}
+
+func TestVerifiedEvent(t *testing.T) {
+	content := []byte("checked against its trailer\n")
+	sum := sha256.Sum256(content)
+	for _, tc := range []struct {
+		name    string
+		trailer string
+	}{
+		{"match", base64.StdEncoding.EncodeToString(sum[:])},
+		{"mismatch", base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Trailer", "X-Amz-Checksum-Sha256")
+				w.Write(content)
+				w.Header().Set("X-Amz-Checksum-Sha256", tc.trailer)
+			}))
+			t.Cleanup(srv.Close)
+
+			d := testDownloader(srv.Client())
+			var log eventLog
+			d.OnEvent = log.add
+			_, err := d.DownloadStream(context.Background(), srv.URL+"/a", Info{Size: -1}, 0, &bytes.Buffer{})
+
+			want := []EventKind{TransferStarted, Verified, TransferDone}
+			if got := log.kinds(); !slices.Equal(got, want) {
+				t.Fatalf("got %v, want %v", got, want)
+			}
+			v := log.events[1]
+			if !slices.Equal(v.Algorithms, []string{"sha256"}) || v.URL != srv.URL+"/a" {
+				t.Errorf("verified %+v", v)
+			}
+			if tc.name == "match" && (err != nil || v.Err != nil) {
+				t.Errorf("got %v, %v", err, v.Err)
+			}
+			if tc.name == "mismatch" && (err == nil || v.Err == nil || log.events[2].Err == nil) {
+				t.Errorf("got %v, %v, %v, want the mismatch", err, v.Err, log.events[2].Err)
+			}
+		})
+	}
+}
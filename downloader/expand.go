@@ -0,0 +1,71 @@
+package downloader
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// expandFields expands the variables in the URLs of a list line, its entry
+// and mirrors, in place. Its key=value fields are left as they are, and so
+// is the split into fields, whatever the values hold. Unless the list is
+// local, only the variables in EnvAllow may be expanded.
+func (d *Downloader) expandFields(fields []string, local bool) error {
+	if !d.ExpandEnv && !d.StrictEnv {
+		return nil
+	}
+	allowed := func(name string) bool {
+		return local || slices.Contains(d.EnvAllow, name)
+	}
+	for i, field := range fields {
+		if _, _, ok := metaField(field, d.Manifest); ok && i > 0 {
+			continue
+		}
+		expanded, err := expandVars(field, d.StrictEnv, allowed)
+		if err != nil {
+			return err
+		}
+		fields[i] = expanded
+	}
+	return nil
+}
+
+// expandVars replaces ${VAR} and ${VAR:-default} in s with values from the
+// environment. Bare $VAR is left alone because '$' is legal in URLs. In
+// strict mode a variable that is unset and has no default is an error;
+// otherwise it expands to the empty string. A variable allowed refuses is
+// an error either way.
+func expandVars(s string, strict bool, allowed func(name string) bool) (string, error) {
+	var b strings.Builder
+	for {
+		start := strings.Index(s, "${")
+		if start < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		end := strings.IndexByte(s[start:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated ${ in %q", s)
+		}
+		end += start
+
+		b.WriteString(s[:start])
+		expr := s[start+2 : end]
+		name, def, hasDef := strings.Cut(expr, ":-")
+		if !allowed(name) {
+			return "", fmt.Errorf("${%v} is only expanded in a local list file, or with -expand-env-var %v", name, name)
+		}
+		value, ok := os.LookupEnv(name)
+		switch {
+		case ok && value != "":
+			b.WriteString(value)
+		case hasDef:
+			b.WriteString(def)
+		case ok:
+		case strict:
+			return "", fmt.Errorf("undefined variable %v", name)
+		}
+		s = s[end+1:]
+	}
+}
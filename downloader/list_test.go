@@ -0,0 +1,104 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestListLines(t *testing.T) {
+	list := strings.Join([]string{
+		"\uFEFF# files for the nightly run",
+		"a.bin",
+		"   ",
+		"b.bin   # the second",
+		"/top.bin\r",
+		"http://other.example/c.bin#part",
+		"ftp://other.example/d.bin",
+		"https://other.example/%zz",
+	}, "\n")
+	mux := http.NewServeMux()
+	mux.Handle("/old", http.RedirectHandler("/dir/list.txt", http.StatusFound))
+	mux.HandleFunc("/dir/list.txt", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(list))
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	d := testDownloader(srv.Client())
+	var warnings bytes.Buffer
+	d.Logger = log.New(&warnings, "", 0)
+	got, err := d.DownloadList(context.Background(), srv.URL+"/old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Relative entries are resolved against where the list was found.
+	want := []string{
+		srv.URL + "/dir/a.bin",
+		srv.URL + "/dir/b.bin",
+		srv.URL + "/top.bin",
+		"http://other.example/c.bin#part",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	for _, line := range []string{"/old:7: unsupported scheme", "/old:8: "} {
+		if !strings.Contains(warnings.String(), "skipping "+srv.URL+line) {
+			t.Errorf("warnings %q, want line %q", warnings.String(), line)
+		}
+	}
+	if n := strings.Count(warnings.String(), "\n"); n != 2 {
+		t.Errorf("%v warnings, want 2: %q", n, warnings.String())
+	}
+}
+
+func TestListFields(t *testing.T) {
+	list := strings.Join([]string{
+		`/a.bin http://mirror.example/a.bin out=b.bin size=1048576 sha256=` + strings.Repeat("AB", 32) + ` header="X-Token: a b"`,
+		`/c.bin size=lots`,
+	}, "\n")
+	srv, _ := testListServer(t, list, nil, 0)
+
+	d := testDownloader(srv.Client())
+	var warnings bytes.Buffer
+	d.Logger = log.New(&warnings, "", 0)
+	entries, err := d.DownloadList(context.Background(), srv.URL+"/list")
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("got %q, %v", entries, err)
+	}
+	meta, ok := d.Meta(srv.URL + "/a.bin")
+	if !ok || meta.Output != "b.bin" || meta.Size != 1<<20 || meta.SHA256 != strings.Repeat("ab", 32) {
+		t.Errorf("got %+v, want the fields of the line", meta)
+	}
+	// The mirror is sent the entry's headers too.
+	if got := d.EntryHeader("http://mirror.example/a.bin").Get("X-Token"); got != "a b" {
+		t.Errorf("mirror X-Token %q, want the quoted value", got)
+	}
+	// Without -manifest a bad field is ignored with a warning.
+	if meta, ok := d.Meta(srv.URL + "/c.bin"); ok {
+		t.Errorf("c.bin has %+v, want no fields", meta)
+	}
+	if !strings.Contains(warnings.String(), "ignoring field at "+srv.URL+"/list:2") {
+		t.Errorf("warnings %q, want the size= of line 2", warnings.String())
+	}
+
+	// With -manifest anything malformed fails the list.
+	for line, want := range map[string]string{
+		"/c.bin size=lots":     `list:1: invalid size="lots"`,
+		"/c.bin colour=red":    "list:1: unknown field colour=",
+		`/c.bin header="X: y`:  "list:1: unterminated quote",
+		"/c.bin ftp://h/c.bin": "list:1: mirror: unsupported scheme",
+	} {
+		srv, _ := testListServer(t, line, nil, 0)
+		d := testDownloader(srv.Client())
+		d.Manifest = true
+		if _, err := d.DownloadList(context.Background(), srv.URL+"/list"); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: got %v, want %q", line, err, want)
+		}
+	}
+}
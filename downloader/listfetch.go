@@ -0,0 +1,196 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+)
+
+// listBody is a fully fetched, still encoded, list.
+type listBody struct {
+	data   []byte
+	header http.Header
+	// url is where the list was finally served from after redirects;
+	// relative entries resolve against it.
+	url *neturl.URL
+	// from is the source the body came from, url or one of its mirrors.
+	from string
+}
+
+// fetchList downloads a list with the same retry budget as chunks. Each
+// attempt is bounded by ListTimeout, and an attempt that dies mid-body
+// resumes with a validated Range request when the server allows it, so a
+// flaky list host does not end the run before it starts. A list with
+// mirrors (see AddMirrors) moves on to the next of them when one fails,
+// as chunks do, and the list fetched is then checked against every other.
+func (d *Downloader) fetchList(ctx context.Context, url string) (*listBody, error) {
+	set := d.sourcesFor(url, -1)
+	if set != nil {
+		// Unlike objects, lists need not serve ranges.
+		for _, src := range set.sources {
+			src.checked = true
+		}
+	}
+	list := &listBody{}
+	var buf bytes.Buffer
+	err := d.retry(ctx, "list ", url, func() error {
+		return d.fromSources(ctx, url, set, func(src string) error {
+			return d.fetchListAttempt(ctx, src, list, &buf)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	list.data = buf.Bytes()
+	if set != nil {
+		if err := d.compareListMirrors(ctx, list, set); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+// compareListMirrors fetches the list from each source it did not come
+// from, once, and fails if any serves different entries. Sources that
+// cannot be reached are only reported; one of them failing is why mirrors
+// are given.
+func (d *Downloader) compareListMirrors(ctx context.Context, list *listBody, set *sourceSet) error {
+	want, err := d.listHash(list)
+	if err != nil {
+		return err
+	}
+	for _, src := range set.sources {
+		if src.url == list.from {
+			continue
+		}
+		other := &listBody{}
+		var buf bytes.Buffer
+		err := d.fetchListAttempt(ctx, src.url, other, &buf)
+		if err == nil {
+			other.data = buf.Bytes()
+			var got string
+			if got, err = d.listHash(other); err == nil && got != want {
+				return &PermanentError{Err: fmt.Errorf(
+					"list %s differs from list %s (sha256 %s, not %s)", src.url, list.from, got, want,
+				)}
+			}
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return context.Cause(ctx)
+			}
+			d.warnf("could not check the list against %s: %v", src.url, err.Error())
+		}
+	}
+	return nil
+}
+
+// listHash is the SHA-256 of the decoded list, so mirrors compressing it
+// differently still compare equal.
+func (d *Downloader) listHash(list *listBody) (string, error) {
+	body, err := d.decodeList(list)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (d *Downloader) fetchListAttempt(
+	ctx context.Context,
+	url string,
+	list *listBody,
+	buf *bytes.Buffer,
+) error {
+	if d.ListTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.ListTimeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return &PermanentError{Err: err}
+	}
+	// Asking explicitly turns off the transport's transparent gzip so
+	// decodeList sees, and handles, every encoding itself.
+	req.Header.Set("Accept-Encoding", "gzip, zstd")
+
+	resume := false
+	if buf.Len() > 0 && list.header.Get("Accept-Ranges") == "bytes" {
+		validator := list.header.Get("ETag")
+		if validator == "" && list.from == url {
+			// Another server's copy may share the date but not the bytes.
+			validator = list.header.Get("Last-Modified")
+		}
+		if validator != "" {
+			resume = true
+			req.Header.Set("Range", fmt.Sprintf("bytes=%v-", buf.Len()))
+			req.Header.Set("If-Range", validator)
+		}
+	}
+
+	resp, err := d.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resume && resp.StatusCode == http.StatusPartialContent:
+	case resp.StatusCode == http.StatusOK:
+		buf.Reset()
+		list.header = resp.Header
+		list.url = resp.Request.URL
+		list.from = url
+	default:
+		err := statusError(resp)
+		var perm *PermanentError
+		if errors.As(err, &perm) {
+			return &PermanentError{Err: fmt.Errorf("fetching list %s: %w", url, perm.Err)}
+		}
+		return fmt.Errorf("fetching list %s: %w", url, err)
+	}
+
+	limit := d.MaxListSize
+	if resp.StatusCode == http.StatusOK && resp.ContentLength > limit {
+		return &PermanentError{Err: fmt.Errorf(
+			"list %s is %v bytes, over the %v byte limit", url, resp.ContentLength, limit,
+		)}
+	}
+
+	_, err = io.Copy(buf, io.LimitReader(d.limitRate(ctx, resp.Body), limit-int64(buf.Len())+1))
+	if int64(buf.Len()) > limit {
+		return &PermanentError{Err: fmt.Errorf(
+			"list %s exceeds the %v byte limit", url, limit,
+		)}
+	}
+	return err
+}
+
+// cappedReader fails once more than limit bytes have been read, guarding the
+// decompressed list against compression bombs.
+type cappedReader struct {
+	io.ReadCloser
+	limit int64
+	read  int64
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.read += int64(n)
+	if c.read > c.limit {
+		return n, fmt.Errorf("decompressed list exceeds the %v byte limit", c.limit)
+	}
+	return n, err
+}
@@ -0,0 +1,375 @@
+package downloader
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EntryMeta is what a list line says about its entry besides where it is,
+// as key=value fields after the URL:
+//
+//	https://host/a.bin  out=b.bin  size=1048576  sha256=...  header="X-Token: abc"
+//	https://flaky/c.bin  retries=500  timeout=2m  chunk=1M
+//	https://host/d.bin  output=s3://bucket/d.bin
+//
+// A value holding spaces is quoted. retries=, timeout= and chunk= tune the
+// entry's transfer over the Downloader's settings, and priority= weighs
+// its share of RateLimit under FairPriority.
+type EntryMeta struct {
+	// Output is the local name to save the entry under.
+	Output string
+	// Route, from output=, is where the entry goes whatever the others
+	// do: a relative path to write it to, s3://bucket/key to upload it
+	// to, or "-" for the stream of entries.
+	Route string
+	// Size is the expected size of the entry, or -1.
+	Size int64
+	// SHA256 is the expected digest of the entry, in lowercase hex.
+	SHA256 string
+	// Header is sent with every request for the entry and for its
+	// mirrors.
+	Header http.Header
+	// Retries, when positive, replaces MaxRetry for the entry.
+	Retries int
+	// ChunkTimeout, when positive, replaces ChunkTimeout for the entry.
+	ChunkTimeout time.Duration
+	// ChunkSize, when positive, replaces ChunkSize for the entry, and
+	// AdaptiveChunks too; WholeEntry, from chunk=0, fetches it in one
+	// request.
+	ChunkSize int64
+	// Priority, when positive, weighs the entry's share of RateLimit
+	// under FairPriority; entries without one weigh 1.
+	Priority int
+}
+
+// WholeEntry is a ChunkSize larger than any object.
+const WholeEntry = int64(1) << 62
+
+// metaKeys are the fields a list line may have.
+var metaKeys = map[string]bool{
+	"out": true, "output": true, "size": true, "sha256": true, "header": true,
+	"retries": true, "timeout": true, "chunk": true, "priority": true,
+}
+
+// splitFields splits a list line at whitespace, except inside a value
+// quoted right after its '=', whose quotes are dropped.
+func splitFields(line string) ([]string, error) {
+	var fields []string
+	var field strings.Builder
+	inField, quoted := false, false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quoted && c == '"':
+			quoted = false
+		case quoted:
+			field.WriteByte(c)
+		case c == ' ' || c == '\t':
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		case c == '"' && i > 0 && line[i-1] == '=':
+			quoted = true
+		default:
+			field.WriteByte(c)
+			inField = true
+		}
+	}
+	if quoted {
+		return nil, errors.New("unterminated quote")
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields, nil
+}
+
+// metaField reports whether field is key=value for a known key, or, when
+// strict, for any key at all: a mirror URL has a scheme or a slash before
+// any '='.
+func metaField(field string, strict bool) (key, value string, ok bool) {
+	key, value, ok = strings.Cut(field, "=")
+	if !ok || key == "" {
+		return "", "", false
+	}
+	if metaKeys[key] {
+		return key, value, true
+	}
+	return key, value, strict && !strings.ContainsAny(key, ":/?#")
+}
+
+// setMeta records one field in meta.
+func setMeta(meta *EntryMeta, key, value string) error {
+	switch key {
+	case "out":
+		if value == "" || value == "." || value == ".." || strings.ContainsAny(value, `/\`) {
+			return fmt.Errorf("invalid out=%q: want a file name", value)
+		}
+		if meta.Output != "" {
+			return errors.New("out= given twice")
+		}
+		if meta.Route != "" {
+			return errors.New("out= and output= exclude each other")
+		}
+		meta.Output = value
+	case "output":
+		if err := checkRoute(value); err != nil {
+			return fmt.Errorf("invalid output=%q: %w", value, err)
+		}
+		if meta.Route != "" {
+			return errors.New("output= given twice")
+		}
+		if meta.Output != "" {
+			return errors.New("out= and output= exclude each other")
+		}
+		meta.Route = value
+	case "size":
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || size < 0 {
+			return fmt.Errorf("invalid size=%q: want a number of bytes", value)
+		}
+		if meta.Size >= 0 {
+			return errors.New("size= given twice")
+		}
+		meta.Size = size
+	case "sha256":
+		if raw, err := hex.DecodeString(value); err != nil || len(raw) != 32 {
+			return fmt.Errorf("invalid sha256=%q: want 64 hex digits", value)
+		}
+		if meta.SHA256 != "" {
+			return errors.New("sha256= given twice")
+		}
+		meta.SHA256 = strings.ToLower(value)
+	case "header":
+		name, v, ok := strings.Cut(value, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return fmt.Errorf("invalid header=%q: want \"Name: value\"", value)
+		}
+		if meta.Header == nil {
+			meta.Header = http.Header{}
+		}
+		meta.Header.Add(name, strings.TrimSpace(v))
+	case "retries":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid retries=%q: want a number of attempts", value)
+		}
+		if meta.Retries > 0 {
+			return errors.New("retries= given twice")
+		}
+		meta.Retries = n
+	case "timeout":
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid timeout=%q: want a duration such as 30s", value)
+		}
+		if meta.ChunkTimeout > 0 {
+			return errors.New("timeout= given twice")
+		}
+		meta.ChunkTimeout = timeout
+	case "chunk":
+		size, err := ParseSize(value)
+		if err != nil || size >= WholeEntry {
+			return fmt.Errorf("invalid chunk=%q: want a size such as 4M, or 0 for one request", value)
+		}
+		if meta.ChunkSize > 0 {
+			return errors.New("chunk= given twice")
+		}
+		if size == 0 {
+			size = WholeEntry
+		}
+		meta.ChunkSize = size
+	case "priority":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid priority=%q: want a positive weight", value)
+		}
+		if meta.Priority > 0 {
+			return errors.New("priority= given twice")
+		}
+		meta.Priority = n
+	default:
+		return fmt.Errorf("unknown field %v=", key)
+	}
+	return nil
+}
+
+// checkRoute checks an output= field: "-", s3://bucket/key, or a relative
+// path that stays below the directory it is taken in.
+func checkRoute(route string) error {
+	if route == "-" {
+		return nil
+	}
+	if rest, ok := strings.CutPrefix(route, "s3://"); ok {
+		if bucket, key, _ := strings.Cut(rest, "/"); bucket == "" || key == "" {
+			return errors.New("want s3://bucket/key")
+		}
+		return nil
+	}
+	name := strings.ReplaceAll(route, `\`, "/")
+	switch {
+	case strings.Contains(route, "://"):
+		return errors.New("want a path, s3://bucket/key or -")
+	case name == "" || strings.HasSuffix(name, "/"):
+		return errors.New("want a file path")
+	case path.IsAbs(name) || len(name) > 1 && name[1] == ':':
+		return errors.New("want a relative path")
+	}
+	if clean := path.Clean(name); clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return errors.New("want a path below the current directory")
+	}
+	return nil
+}
+
+// setEntryMeta records meta for url, and its headers and overrides for
+// the mirrors as well.
+func (d *Downloader) setEntryMeta(url string, meta EntryMeta, mirrors []string) {
+	d.metaMu.Lock()
+	defer d.metaMu.Unlock()
+	if d.meta == nil {
+		d.meta = map[string]EntryMeta{}
+		d.sources = map[string]EntryMeta{}
+	}
+	d.meta[url] = meta
+	for _, u := range append([]string{url}, mirrors...) {
+		d.sources[u] = meta
+	}
+}
+
+// SetMeta records meta for url as a list line would, with mirrors, for
+// an entry that comes from elsewhere, such as saved state.
+func (d *Downloader) SetMeta(url string, meta EntryMeta, mirrors ...string) {
+	d.setEntryMeta(url, meta, mirrors)
+	d.AddMirrors(url, mirrors...)
+}
+
+// Meta returns what the list said about url, if it had fields.
+func (d *Downloader) Meta(url string) (EntryMeta, bool) {
+	d.metaMu.Lock()
+	defer d.metaMu.Unlock()
+	meta, ok := d.meta[url]
+	return meta, ok
+}
+
+// EntryHeader returns the headers the list gave for requests to url, an
+// entry or a mirror of one.
+func (d *Downloader) EntryHeader(url string) http.Header {
+	return d.sourceMeta(url).Header
+}
+
+// sourceMeta returns the meta of the entry url is, or is a mirror of.
+func (d *Downloader) sourceMeta(url string) EntryMeta {
+	d.metaMu.Lock()
+	defer d.metaMu.Unlock()
+	return d.sources[url]
+}
+
+// maxGlobEntries caps what one list line may expand to.
+const maxGlobEntries = 100000
+
+// ExpandGlob expands the {a,b} alternatives and [1-10], [001-100] or
+// [a-z] ranges of a URL, as curl does, into every combination in order. A
+// range may step, as in [0-100:10]. Brackets holding a ':' that is not a
+// step are an IPv6 host, and are kept.
+func ExpandGlob(s string) ([]string, error) {
+	out := []string{""}
+	for len(s) > 0 {
+		i := strings.IndexAny(s, "{[")
+		if i < 0 {
+			break
+		}
+		var alts []string
+		var rest string
+		if s[i] == '{' {
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return nil, errors.New("unterminated { in glob")
+			}
+			alts, rest = strings.Split(s[i+1:i+end], ","), s[i+end+1:]
+		} else {
+			end := strings.IndexByte(s[i:], ']')
+			if end < 0 {
+				return nil, errors.New("unterminated [ in glob")
+			}
+			spec := s[i+1 : i+end]
+			if strings.Count(spec, ":") > 1 || strings.Contains(spec, ":") && !strings.Contains(spec, "-") {
+				out = appendEach(out, []string{s[:i+end+1]})
+				s = s[i+end+1:]
+				continue
+			}
+			var err error
+			if alts, err = globRange(spec); err != nil {
+				return nil, err
+			}
+			rest = s[i+end+1:]
+		}
+		if len(out)*len(alts) > maxGlobEntries {
+			return nil, fmt.Errorf("glob expands to more than %v entries", maxGlobEntries)
+		}
+		out = appendEach(appendEach(out, []string{s[:i]}), alts)
+		s = rest
+	}
+	return appendEach(out, []string{s}), nil
+}
+
+// globRange expands a [from-to] glob range of numbers or letters. A
+// number with leading zeros sets the width of them all.
+func globRange(spec string) ([]string, error) {
+	bounds, stepSpec, stepped := strings.Cut(spec, ":")
+	from, to, ok := strings.Cut(bounds, "-")
+	step, err := strconv.Atoi(stepSpec)
+	if !ok || stepped && (err != nil || step < 1) {
+		return nil, fmt.Errorf("invalid glob range [%v]", spec)
+	}
+	if !stepped {
+		step = 1
+	}
+	if len(from) == 1 && len(to) == 1 && isLetter(from[0]) && isLetter(to[0]) && from[0] <= to[0] {
+		var alts []string
+		for c := int(from[0]); c <= int(to[0]); c += step {
+			alts = append(alts, string(rune(c)))
+		}
+		return alts, nil
+	}
+	lo, err1 := strconv.Atoi(from)
+	hi, err2 := strconv.Atoi(to)
+	if err1 != nil || err2 != nil || lo < 0 || lo > hi {
+		return nil, fmt.Errorf("invalid glob range [%v]", spec)
+	}
+	if (hi-lo)/step >= maxGlobEntries {
+		return nil, fmt.Errorf("glob expands to more than %v entries", maxGlobEntries)
+	}
+	width := 0
+	if len(from) > 1 && from[0] == '0' {
+		width = len(from)
+	}
+	alts := make([]string, 0, (hi-lo)/step+1)
+	for n := lo; n <= hi; n += step {
+		alts = append(alts, fmt.Sprintf("%0*d", width, n))
+	}
+	return alts, nil
+}
+
+func isLetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// appendEach returns every prefix followed by every suffix.
+func appendEach(prefixes, suffixes []string) []string {
+	out := make([]string, 0, len(prefixes)*len(suffixes))
+	for _, p := range prefixes {
+		for _, s := range suffixes {
+			out = append(out, p+s)
+		}
+	}
+	return out
+}
@@ -0,0 +1,249 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testListServer serves list at /list and content at every other path,
+// failing the first failures GETs of /flaky* and those of /slow taking a
+// second. It counts the GETs of each path.
+func testListServer(t *testing.T, list string, content []byte, failures int) (*httptest.Server, func(path string) int) {
+	t.Helper()
+	var mu sync.Mutex
+	gets := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/list" {
+			io.WriteString(w, list)
+			return
+		}
+		if req.Method != "GET" {
+			http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(content))
+			return
+		}
+		mu.Lock()
+		gets[req.URL.Path]++
+		n := gets[req.URL.Path]
+		mu.Unlock()
+		switch {
+		case strings.HasPrefix(req.URL.Path, "/flaky") && n <= failures:
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		case req.URL.Path == "/slow":
+			select {
+			case <-time.After(time.Second):
+			case <-req.Context().Done():
+				return
+			}
+		}
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func(path string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return gets[path]
+	}
+}
+
+func testDownloader(client *http.Client) *Downloader {
+	d := New(client)
+	d.MaxRetry = 1
+	d.RetryInitial, d.RetryMax = time.Millisecond, time.Millisecond
+	d.NetworkWait = 0
+	return d
+}
+
+func TestEntryOverrides(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 10)
+	list := strings.Join([]string{
+		"/flaky retries=4",
+		"/flaky-default",
+		"/chunked chunk=10",
+		"/whole chunk=0",
+		"/slow timeout=50ms",
+	}, "\n")
+	srv, gets := testListServer(t, list, content, 3)
+	d := testDownloader(srv.Client())
+	d.ChunkSize = 30
+	d.Manifest = true
+	ctx := context.Background()
+	if _, err := d.DownloadList(ctx, srv.URL+"/list"); err != nil {
+		t.Fatal(err)
+	}
+
+	download := func(path string) error {
+		var out bytes.Buffer
+		_, err := d.Download(ctx, srv.URL+path, &out)
+		if err == nil && !bytes.Equal(out.Bytes(), content) {
+			t.Errorf("%v: got %q", path, out.Bytes())
+		}
+		return err
+	}
+	// Its first chunk takes 4 attempts, and the other 3 one each.
+	if err := download("/flaky"); err != nil || gets("/flaky") != 7 {
+		t.Errorf("/flaky with retries=4: %v after %v GETs, want success after 7", err, gets("/flaky"))
+	}
+	if err := download("/flaky-default"); err == nil || gets("/flaky-default") != 1 {
+		t.Errorf("/flaky-default: %v after %v GETs, want the 1 attempt of MaxRetry to fail", err, gets("/flaky-default"))
+	}
+	if err := download("/chunked"); err != nil || gets("/chunked") != 10 {
+		t.Errorf("/chunked with chunk=10: %v in %v GETs, want 10", err, gets("/chunked"))
+	}
+	if err := download("/whole"); err != nil || gets("/whole") != 1 {
+		t.Errorf("/whole with chunk=0: %v in %v GETs, want 1", err, gets("/whole"))
+	}
+	var timeout *ChunkTimeoutError
+	if err := download("/slow"); !errors.As(err, &timeout) || timeout.Timeout != 50*time.Millisecond {
+		t.Errorf("/slow with timeout=50ms: %v, want its chunk timed out", err)
+	}
+}
+
+func TestEntryOverrideMirrors(t *testing.T) {
+	content := []byte("mirrored")
+	mirror, gets := testListServer(t, "", content, 2)
+	list := "/missing retries=3 " + mirror.URL + "/flaky\n"
+	srv, _ := testListServer(t, list, content, 0)
+	d := testDownloader(srv.Client())
+	d.Manifest = true
+	if _, err := d.DownloadList(context.Background(), srv.URL+"/list"); err != nil {
+		t.Fatal(err)
+	}
+	if meta := d.sourceMeta(mirror.URL + "/flaky"); meta.Retries != 3 {
+		t.Errorf("the mirror has retries=%v, want the entry's 3", meta.Retries)
+	}
+	// Asked for directly, the mirror is retried as its entry is.
+	got, err := d.FetchRange(context.Background(), mirror.URL+"/flaky", ClosedRange(0, 7))
+	if err != nil || !bytes.Equal(got, content) || gets("/flaky") != 3 {
+		t.Errorf("fetching from the mirror: %q, %v after %v GETs; want success after 3", got, err, gets("/flaky"))
+	}
+}
+
+func TestSetMetaOverrides(t *testing.T) {
+	tests := []struct {
+		fields []string
+		want   string
+	}{
+		{[]string{"retries=0"}, `invalid retries="0"`},
+		{[]string{"retries=x"}, `invalid retries="x"`},
+		{[]string{"retries=2", "retries=3"}, "retries= given twice"},
+		{[]string{"timeout=5"}, `invalid timeout="5"`},
+		{[]string{"timeout=-1s"}, `invalid timeout="-1s"`},
+		{[]string{"timeout=1s", "timeout=2s"}, "timeout= given twice"},
+		{[]string{"chunk=1X"}, `invalid chunk="1X"`},
+		{[]string{"chunk=-1"}, `invalid chunk="-1"`},
+		{[]string{"chunk=0", "chunk=10"}, "chunk= given twice"},
+		{[]string{"priority=0"}, `invalid priority="0"`},
+		{[]string{"priority=2", "priority=3"}, "priority= given twice"},
+	}
+	for _, tt := range tests {
+		meta := EntryMeta{Size: -1}
+		var err error
+		for _, f := range tt.fields {
+			key, value, _ := strings.Cut(f, "=")
+			if err = setMeta(&meta, key, value); err != nil {
+				break
+			}
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: got %v, want %q", tt.fields, err, tt.want)
+		}
+	}
+
+	meta := EntryMeta{Size: -1}
+	for _, f := range []string{"retries=7", "timeout=1m30s", "chunk=0", "priority=3"} {
+		key, value, _ := strings.Cut(f, "=")
+		if err := setMeta(&meta, key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if meta.Retries != 7 || meta.ChunkTimeout != 90*time.Second || meta.ChunkSize != WholeEntry || meta.Priority != 3 {
+		t.Errorf("got %+v", meta)
+	}
+	for value, want := range map[string]int64{"4M": 4 << 20, "512K": 512 << 10, "1.5M": 3 << 19, "100": 100} {
+		meta := EntryMeta{Size: -1}
+		if err := setMeta(&meta, "chunk", value); err != nil || meta.ChunkSize != want {
+			t.Errorf("chunk=%v: %v, %v bytes; want %v", value, err, meta.ChunkSize, want)
+		}
+	}
+}
+
+func TestSetMetaRoute(t *testing.T) {
+	for _, route := range []string{"-", "a.bin", "dir/sub/a.bin", "./a.bin", "s3://bucket/dir/a.bin"} {
+		meta := EntryMeta{Size: -1}
+		if err := setMeta(&meta, "output", route); err != nil || meta.Route != route {
+			t.Errorf("output=%v: %v, route %q", route, err, meta.Route)
+		}
+	}
+	for route, want := range map[string]string{
+		"":              "want a file path",
+		"dir/":          "want a file path",
+		".":             "below the current directory",
+		"../a.bin":      "below the current directory",
+		"dir/../../a":   "below the current directory",
+		"/etc/passwd":   "want a relative path",
+		`C:\a.bin`:      "want a relative path",
+		"s3://bucket":   "want s3://bucket/key",
+		"s3:///key":     "want s3://bucket/key",
+		"gs://bucket/k": "want a path, s3://bucket/key or -",
+	} {
+		meta := EntryMeta{Size: -1}
+		if err := setMeta(&meta, "output", route); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("output=%q: got %v, want %q", route, err, want)
+		}
+	}
+
+	meta := EntryMeta{Size: -1}
+	if err := setMeta(&meta, "out", "a.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := setMeta(&meta, "output", "b.bin"); err == nil || !strings.Contains(err.Error(), "exclude each other") {
+		t.Errorf("out= then output=: got %v", err)
+	}
+}
+
+func TestExpandGlob(t *testing.T) {
+	for glob, want := range map[string][]string{
+		"https://h/part-[000-002].bin": {"https://h/part-000.bin", "https://h/part-001.bin", "https://h/part-002.bin"},
+		"https://h/{a,b}/[1-2]":        {"https://h/a/1", "https://h/a/2", "https://h/b/1", "https://h/b/2"},
+		"https://h/[0-10:5]":           {"https://h/0", "https://h/5", "https://h/10"},
+		"https://h/[a-e:2]":            {"https://h/a", "https://h/c", "https://h/e"},
+		"https://[::1]:8080/[8-9]":     {"https://[::1]:8080/8", "https://[::1]:8080/9"},
+		"https://h/plain":              {"https://h/plain"},
+	} {
+		if got, err := ExpandGlob(glob); err != nil || !slices.Equal(got, want) {
+			t.Errorf("ExpandGlob(%q) = %q, %v; want %q", glob, got, err, want)
+		}
+	}
+	for glob, want := range map[string]string{
+		"https://h/{a,b":           "unterminated {",
+		"https://h/[1-2":           "unterminated [",
+		"https://h/[2-1]":          "invalid glob range",
+		"https://h/[1-9:0]":        "invalid glob range",
+		"https://h/[x-9]":          "invalid glob range",
+		"https://h/[0-99999][1-2]": "more than 100000 entries",
+	} {
+		if _, err := ExpandGlob(glob); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("ExpandGlob(%q): got %v, want %q", glob, err, want)
+		}
+	}
+
+	// With Glob, list entries expand too, and a bad glob skips its line.
+	srv, _ := testListServer(t, "/part-[1-2].bin\n/bad-[2-1].bin\n/last.bin\n", nil, 0)
+	d := testDownloader(srv.Client())
+	d.Glob = true
+	entries, err := d.DownloadList(context.Background(), srv.URL+"/list")
+	want := []string{srv.URL + "/part-1.bin", srv.URL + "/part-2.bin", srv.URL + "/last.bin"}
+	if err != nil || !slices.Equal(entries, want) {
+		t.Errorf("got %q, %v; want %q", entries, err, want)
+	}
+}
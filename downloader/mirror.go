@@ -0,0 +1,227 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	neturl "net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AddMirrors records other URLs serving the same bytes as url, so ranged
+// downloads of url spread their chunks across all of them.
+func (d *Downloader) AddMirrors(url string, mirrors ...string) {
+	if len(mirrors) == 0 {
+		return
+	}
+	d.alternatesMu.Lock()
+	defer d.alternatesMu.Unlock()
+	if d.alternates == nil {
+		d.alternates = map[string][]string{}
+	}
+	for _, m := range mirrors {
+		if m != url && !slices.Contains(d.alternates[url], m) {
+			d.alternates[url] = append(d.alternates[url], m)
+		}
+	}
+}
+
+// MirrorsOf returns the mirrors added for url so far.
+func (d *Downloader) MirrorsOf(url string) []string {
+	d.alternatesMu.Lock()
+	defer d.alternatesMu.Unlock()
+	return append([]string(nil), d.alternates[url]...)
+}
+
+// treeMirrors returns where entry lives under each of d.Mirrors, when it
+// is under the directory of the list at base.
+func (d *Downloader) treeMirrors(base *neturl.URL, entry string) []string {
+	if base == nil || len(d.Mirrors) == 0 {
+		return nil
+	}
+	dir := *base
+	dir.Path = dir.Path[:strings.LastIndex(dir.Path, "/")+1]
+	dir.RawPath, dir.RawQuery, dir.Fragment = "", "", ""
+	rel, ok := strings.CutPrefix(entry, dir.String())
+	if !ok {
+		return nil
+	}
+	var mirrors []string
+	for _, m := range d.Mirrors {
+		mirrors = append(mirrors, strings.TrimSuffix(m, "/")+"/"+rel)
+	}
+	return mirrors
+}
+
+// source is one URL of an object and how it has been doing.
+type source struct {
+	url string
+
+	// checked is set once the mirror is known to serve ranges of the
+	// object, and of the same size; checkErr once it is known not to.
+	// Until then every attempt asks again.
+	checkMu  sync.Mutex
+	checked  bool
+	checkErr error
+
+	dead    bool
+	fails   int
+	benched time.Time
+}
+
+// sourceSet is an object's URL and its mirrors. Chunks take live sources
+// in turn; a failing one sits out a backoff, and one that cannot serve the
+// object at all is dropped.
+type sourceSet struct {
+	size int64
+
+	mu      sync.Mutex
+	sources []*source
+	next    int
+}
+
+// sourcesFor returns the sources of url, or nil when it has no mirrors.
+func (d *Downloader) sourcesFor(url string, size int64) *sourceSet {
+	mirrors := d.MirrorsOf(url)
+	if len(mirrors) == 0 {
+		return nil
+	}
+	set := &sourceSet{size: size}
+	for _, u := range append([]string{url}, mirrors...) {
+		set.sources = append(set.sources, &source{url: u})
+	}
+	// url is what the size came from.
+	set.sources[0].checked = true
+	return set
+}
+
+// pick returns the index of the source for the next attempt, skipping the
+// ones in tried: the next live one in turn that is not sitting out, else
+// the live one back soonest. ok is false when none is left.
+func (s *sourceSet) pick(tried []bool) (i int, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	soonest := -1
+	for n := 0; n < len(s.sources); n++ {
+		i := (s.next + n) % len(s.sources)
+		src := s.sources[i]
+		if src.dead || tried[i] {
+			continue
+		}
+		if !src.benched.After(now) {
+			s.next = i + 1
+			return i, true
+		}
+		if soonest < 0 || src.benched.Before(s.sources[soonest].benched) {
+			soonest = i
+		}
+	}
+	return soonest, soonest >= 0
+}
+
+func (s *sourceSet) succeeded(i int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sources[i].fails = 0
+	s.sources[i].benched = time.Time{}
+}
+
+// failed benches source i for a backoff, or drops it for good after a
+// PermanentError, and reports whether any source is left.
+func (s *sourceSet) failed(i int, err error, bench func(int, error) time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	src := s.sources[i]
+	var perm *PermanentError
+	if errors.As(err, &perm) {
+		src.dead = true
+	} else {
+		src.benched = time.Now().Add(bench(src.fails, err))
+		src.fails++
+	}
+	for _, src := range s.sources {
+		if !src.dead {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSource makes sure a mirror serves ranges of an object the size of
+// the one being downloaded before any of its bytes are used. Only a
+// definite answer is kept: a mirror that cannot serve the object fails
+// with a PermanentError from then on, while one that could not be asked,
+// after a timeout, a 503 or a cancelled chunk, is asked again next time.
+func (d *Downloader) checkSource(ctx context.Context, set *sourceSet, src *source) error {
+	src.checkMu.Lock()
+	defer src.checkMu.Unlock()
+	if src.checked || src.checkErr != nil {
+		return src.checkErr
+	}
+	info, err := d.Stat(ctx, src.url)
+	switch {
+	case err != nil:
+		return fmt.Errorf("mirror %s: %w", src.url, err)
+	case !info.Ranges:
+		src.checkErr = errors.New("does not serve ranges")
+	case set.size >= 0 && info.Size != set.size:
+		src.checkErr = fmt.Errorf("has %v bytes, not %v", info.Size, set.size)
+	default:
+		src.checked = true
+		return nil
+	}
+	src.checkErr = &PermanentError{Err: fmt.Errorf("mirror %s %w", src.url, src.checkErr)}
+	return src.checkErr
+}
+
+// fromSources runs one attempt of fetch against url or, when set has
+// mirrors, against its sources in turn until one succeeds. A failure
+// moves straight on to the next source that has not been tried; only
+// when all have failed does the attempt fail, and it is permanent only
+// once no source is left.
+func (d *Downloader) fromSources(ctx context.Context, url string, set *sourceSet, fetch func(url string) error) error {
+	if set == nil {
+		return fetch(url)
+	}
+	tried := make([]bool, len(set.sources))
+	var last error
+	for {
+		i, ok := set.pick(tried)
+		if !ok {
+			break
+		}
+		tried[i] = true
+		src := set.sources[i]
+		if last != nil {
+			d.warnf("trying %s after %v", src.url, last.Error())
+		}
+
+		err := d.checkSource(ctx, set, src)
+		if err == nil {
+			if err = fetch(src.url); err == nil {
+				set.succeeded(i)
+				return nil
+			}
+		}
+		var we *writeError
+		if ctx.Err() != nil || errors.As(err, &we) || d.networkDown(err) {
+			// None of these is the source's fault.
+			return err
+		}
+		last = err
+		if !set.failed(i, err, d.backoff) {
+			return err
+		}
+	}
+
+	var perm *PermanentError
+	if errors.As(last, &perm) {
+		// Other sources may still come back; let the retry budget decide.
+		return perm.Err
+	}
+	return last
+}
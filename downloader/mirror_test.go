@@ -0,0 +1,60 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMirrorCheckRetried(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 10)
+	// The primary is slow enough for the mirror to sit out its backoff
+	// before the download ends.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "GET" {
+			time.Sleep(5 * time.Millisecond)
+		}
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(srv.Close)
+
+	// The mirror is busy for the HEAD and range probe of its first check,
+	// then serves.
+	var mu sync.Mutex
+	requests, ranged := 0, 0
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		requests++
+		n := requests
+		if n > 2 && req.Method == "GET" {
+			ranged++
+		}
+		mu.Unlock()
+		if n <= 2 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(mirror.Close)
+
+	d := testDownloader(srv.Client())
+	d.ChunkSize = 10
+	d.AddMirrors(srv.URL+"/a", mirror.URL+"/a")
+	var out bytes.Buffer
+	if _, err := d.Download(context.Background(), srv.URL+"/a", &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), content) {
+		t.Errorf("got %q", out.Bytes())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if ranged == 0 {
+		t.Errorf("the mirror served no chunk after its check failed once in %v requests", requests)
+	}
+}
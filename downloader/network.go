@@ -0,0 +1,120 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const networkProbeTimeout = 10 * time.Second
+
+// networkDown reports whether err means this machine has no usable
+// network, as when a laptop moves between Wi-Fi networks, rather than that
+// the server failed.
+func (d *Downloader) networkDown(err error) bool {
+	return d.NetworkWait > 0 && isNetworkDown(err)
+}
+
+func isNetworkDown(err error) bool {
+	return errors.Is(err, syscall.ENETUNREACH) ||
+		errors.Is(err, syscall.ENETDOWN) ||
+		errors.Is(err, syscall.EHOSTUNREACH) ||
+		errors.Is(err, syscall.EADDRNOTAVAIL)
+}
+
+// networkGate makes every request that finds the network down wait on a
+// single probe instead of each burning its retries.
+type networkGate struct {
+	mu    sync.Mutex
+	probe *networkProbe
+}
+
+type networkProbe struct {
+	done    chan struct{}
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// awaitNetwork blocks until a request to url gets past the network again,
+// or fails once the network has been gone for NetworkWait.
+func (d *Downloader) awaitNetwork(ctx context.Context, url string, cause error) error {
+	g := &d.network
+	g.mu.Lock()
+	p := g.probe
+	if p == nil {
+		pctx, cancel := context.WithTimeout(context.Background(), d.NetworkWait)
+		p = &networkProbe{done: make(chan struct{}), cancel: cancel}
+		g.probe = p
+		go d.probeNetwork(pctx, url, cause, p)
+	}
+	p.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-p.done:
+		return p.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		p.waiters--
+		if p.waiters == 0 {
+			// Nobody is left to wait; a later failure starts afresh.
+			g.probe = nil
+			p.cancel()
+		}
+		g.mu.Unlock()
+		return context.Cause(ctx)
+	}
+}
+
+func (d *Downloader) probeNetwork(ctx context.Context, url string, cause error, p *networkProbe) {
+	defer p.cancel()
+	start := time.Now()
+	d.warnf("network unreachable, pausing all transfers (%v)", cause.Error())
+
+	var err error
+	for i := 0; err == nil; i++ {
+		select {
+		case <-time.After(d.backoff(i, cause)):
+		case <-ctx.Done():
+			err = fmt.Errorf("network still unreachable after %v: %w",
+				time.Since(start).Round(time.Second), cause)
+			continue
+		}
+		// Any answer, even an error status, proves the network works.
+		perr := d.probe(ctx, url)
+		if ctx.Err() == nil && !isNetworkDown(perr) {
+			d.logf("network is back after %v, resuming", time.Since(start).Round(time.Second))
+			break
+		}
+	}
+
+	d.network.mu.Lock()
+	if d.network.probe == p {
+		d.network.probe = nil
+	}
+	p.err = err
+	close(p.done)
+	d.network.mu.Unlock()
+}
+
+// probe sends a HEAD to url through the client, so proxies and signing
+// apply exactly as for the transfer itself.
+func (d *Downloader) probe(ctx context.Context, url string) error {
+	ctx, cancel := context.WithTimeout(ctx, networkProbeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := d.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
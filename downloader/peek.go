@@ -0,0 +1,118 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Peek is Stat for objects that are likely small: it asks for the first
+// SmallSize bytes with a GET and learns the info from the answer, so a
+// small object costs one request instead of a HEAD and a GET. body is what
+// came with it: the whole object when len(body) == info.Size, else, for an
+// object served in ranges, its first bytes, which the caller may keep as
+// the start of the transfer. A failure is left to Stat.
+func (d *Downloader) Peek(ctx context.Context, url string) (info Info, body []byte, err error) {
+	if d.SmallSize <= 0 {
+		info, err = d.Stat(ctx, url)
+		return info, nil, err
+	}
+	for {
+		info, body, err = d.peek(ctx, url)
+		if err == nil {
+			d.remember(url, info)
+			return info, body, nil
+		}
+		if !d.networkDown(err) {
+			break
+		}
+		if werr := d.awaitNetwork(ctx, url, err); werr != nil {
+			return Info{}, nil, werr
+		}
+	}
+	// Stat knows what to do with large objects and with failures alike.
+	info, err = d.Stat(ctx, url)
+	return info, nil, err
+}
+
+// peek returns the info of url with the first SmallSize bytes of it, or
+// with all of it when it is no larger. The request is bounded like any
+// chunk, by ChunkTimeout and SpeedLimit, so that a slow origin is left to
+// the chunked path, with its retries, rather than holding the transfer.
+func (d *Downloader) peek(parent context.Context, url string) (Info, []byte, error) {
+	parent, stop := d.chunkContext(parent, url)
+	defer stop()
+	ctx, cancel := context.WithCancelCause(parent)
+	defer cancel(nil)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return Info{}, nil, err
+	}
+	r := ClosedRange(0, d.SmallSize-1)
+	req.Header.Set("Range", r.String())
+	req.Header.Set(ChecksumHeader, "sha256")
+
+	guard := d.newSpeedGuard(cancel)
+	defer guard.stop()
+
+	resp, err := d.do(req)
+	if err != nil {
+		if cause := context.Cause(ctx); cause != nil {
+			return Info{}, nil, cause
+		}
+		return Info{}, nil, err
+	}
+	defer resp.Body.Close()
+	check := newRangeCheck(resp)
+	body := guard.wrap(d.limitRate(ctx, check.wrap(resp.Body)))
+
+	var info Info
+	switch resp.StatusCode {
+	case http.StatusOK:
+		info = newInfo(resp.ContentLength, resp.Header)
+	case http.StatusPartialContent:
+		_, _, complete, err := ParseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return Info{}, nil, err
+		}
+		info = newInfo(complete, resp.Header)
+		info.Ranges = complete >= 0
+	default:
+		return Info{}, nil, statusError(resp)
+	}
+	if info.Size < 0 || info.Size > d.SmallSize {
+		if !info.Ranges {
+			// Reading the rest of a whole large object is not worth
+			// the connection.
+			return info, nil, nil
+		}
+		// Read so that the connection is kept, the first bytes are kept
+		// too. Content-MD5 is the part's, the other digests the object's.
+		info.Digests = headerDigests(resp.Header)
+		delete(info.Digests, "md5")
+		head, err := io.ReadAll(io.LimitReader(body, d.SmallSize))
+		if err != nil || int64(len(head)) != d.SmallSize || check.check(r) != nil {
+			return info, nil, nil
+		}
+		return info, head, nil
+	}
+
+	all, err := io.ReadAll(io.LimitReader(body, info.Size+1))
+	if err != nil {
+		if cause := context.Cause(ctx); cause != nil {
+			return Info{}, nil, cause
+		}
+		return Info{}, nil, err
+	}
+	if int64(len(all)) != info.Size {
+		return Info{}, nil, fmt.Errorf("%s: expected %v bytes, got %v", url, info.Size, len(all))
+	}
+	if err := check.check(r); err != nil {
+		return Info{}, nil, err
+	}
+	// The response is the whole object, so its digests are the object's.
+	info.Digests = headerDigests(resp.Header)
+	return info, all, nil
+}
@@ -0,0 +1,62 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestPeekStall checks that a peek the origin stalls on gives way to Stat
+// and the chunked path rather than holding the transfer.
+func TestPeekStall(t *testing.T) {
+	small := bytes.Repeat([]byte("s"), 500)
+	large := bytes.Repeat([]byte("l"), 2000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		content := small
+		if req.URL.Path == "/large" {
+			content = large
+		}
+		if req.Method == "GET" && req.Header.Get("Range") == "bytes=0-999" {
+			// The headers and a few bytes, then nothing.
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%v/%v", min(len(content), 1000)-1, len(content)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(content[:10])
+			w.(http.Flusher).Flush()
+			<-req.Context().Done()
+			return
+		}
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(srv.Close)
+
+	for _, tc := range []struct {
+		name  string
+		setup func(d *Downloader)
+	}{
+		{"chunk timeout", func(d *Downloader) { d.ChunkTimeout = 100 * time.Millisecond }},
+		{"speed limit", func(d *Downloader) { d.SpeedLimit, d.SpeedTime = 1000, time.Second }},
+	} {
+		for path, want := range map[string][]byte{"/small": small, "/large": large} {
+			d := testDownloader(srv.Client())
+			d.SmallSize = 1000
+			tc.setup(d)
+			start := time.Now()
+			info, body, err := d.Peek(context.Background(), srv.URL+path)
+			if err != nil || info.Size != int64(len(want)) || body != nil {
+				t.Errorf("%s: peek of %s: %+v, %v bytes, %v; want its size and no body", tc.name, path, info, len(body), err)
+				continue
+			}
+			if took := time.Since(start); took > 5*time.Second {
+				t.Errorf("%s: peek of %s took %v", tc.name, path, took)
+			}
+			var got bytes.Buffer
+			if _, err := d.Download(context.Background(), srv.URL+path, &got); err != nil || !bytes.Equal(got.Bytes(), want) {
+				t.Errorf("%s: then downloading %s: %v bytes, %v", tc.name, path, got.Len(), err)
+			}
+		}
+	}
+}
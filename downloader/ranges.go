@@ -0,0 +1,106 @@
+package downloader
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseContentRange parses a "bytes first-last/complete" Content-Range
+// header. complete is -1 when the server sends "*" for an unknown length.
+func ParseContentRange(s string) (first, last, complete int64, err error) {
+	spec, ok := strings.CutPrefix(strings.TrimSpace(s), "bytes ")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("unsupported Content-Range %q", s)
+	}
+	rng, size, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("malformed Content-Range %q", s)
+	}
+
+	complete = -1
+	if size != "*" {
+		complete, err = strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("malformed Content-Range %q", s)
+		}
+	}
+
+	firstStr, lastStr, ok := strings.Cut(rng, "-")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("malformed Content-Range %q", s)
+	}
+	first, err = strconv.ParseInt(firstStr, 10, 64)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("malformed Content-Range %q", s)
+	}
+	last, err = strconv.ParseInt(lastStr, 10, 64)
+	if err != nil || last < first {
+		return 0, 0, 0, fmt.Errorf("malformed Content-Range %q", s)
+	}
+	return first, last, complete, nil
+}
+
+// ByteRange is a single HTTP byte-range-spec: [First, Last] when Last is
+// non-negative, First to the end of the object ("bytes=N-") when Last is
+// -1, or the final Suffix bytes ("bytes=-N") when Suffix is positive.
+type ByteRange struct {
+	First  int64
+	Last   int64
+	Suffix int64
+}
+
+func ClosedRange(first, last int64) ByteRange {
+	return ByteRange{First: first, Last: last}
+}
+
+func OpenRange(first int64) ByteRange {
+	return ByteRange{First: first, Last: -1}
+}
+
+func SuffixRange(n int64) ByteRange {
+	return ByteRange{Suffix: n}
+}
+
+func (r ByteRange) String() string {
+	switch {
+	case r.Suffix > 0:
+		return fmt.Sprintf("bytes=-%v", r.Suffix)
+	case r.Last < 0:
+		return fmt.Sprintf("bytes=%v-", r.First)
+	default:
+		return fmt.Sprintf("bytes=%v-%v", r.First, r.Last)
+	}
+}
+
+// CheckContentRange verifies that the Content-Range of a 206 response is
+// the server's faithful interpretation of r, and returns the absolute
+// byte range it covers together with the object's full length (-1 when
+// unknown).
+func (r ByteRange) CheckContentRange(header string) (first, last, complete int64, err error) {
+	first, last, complete, err = ParseContentRange(header)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	mismatch := fmt.Errorf("requested %v but server sent %q", r, header)
+	switch {
+	case r.Suffix > 0:
+		// The suffix may be clipped to the object's length, but it must
+		// end at the last byte.
+		if complete < 0 || last != complete-1 || last-first+1 != min(r.Suffix, complete) {
+			return 0, 0, 0, mismatch
+		}
+	case r.Last < 0:
+		if first != r.First || (complete >= 0 && last != complete-1) {
+			return 0, 0, 0, mismatch
+		}
+	default:
+		// A range past the end of the object is clipped by the server.
+		if first != r.First || last > r.Last ||
+			(last < r.Last && (complete < 0 || last != complete-1)) {
+			return 0, 0, 0, mismatch
+		}
+	}
+	return first, last, complete, nil
+}
@@ -0,0 +1,42 @@
+package downloader
+
+import (
+	"context"
+	"io"
+
+	"github.com/msmania/gocat/ratelimit"
+)
+
+// sharedRate is the bucket of RateLimit, which SetRateLimit may change
+// later.
+func (d *Downloader) sharedRate() *ratelimit.Bucket {
+	d.rateOnce.Do(func() { d.rate = ratelimit.New(d.RateLimit) })
+	return d.rate
+}
+
+// limitRate paces body to ConnRateLimit, to the Fair share of its
+// transfer and, together with every other transfer of d, to RateLimit,
+// and holds it while d is paused.
+func (d *Downloader) limitRate(ctx context.Context, body io.Reader) io.Reader {
+	buckets := []*ratelimit.Bucket{d.sharedRate()}
+	if b := fairBucket(ctx); b != nil {
+		buckets = append(buckets, b)
+	}
+	if d.ConnRateLimit > 0 {
+		buckets = append(buckets, ratelimit.New(d.ConnRateLimit))
+	}
+	return &pausableReader{ctx: ctx, d: d, r: ratelimit.Reader(ctx, body, buckets...)}
+}
+
+type pausableReader struct {
+	ctx context.Context
+	d   *Downloader
+	r   io.Reader
+}
+
+func (pr *pausableReader) Read(p []byte) (int, error) {
+	if err := pr.d.awaitResume(pr.ctx); err != nil {
+		return 0, err
+	}
+	return pr.r.Read(p)
+}
@@ -0,0 +1,48 @@
+package downloader
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var sizeSuffixes = []struct {
+	suffix string
+	shift  uint
+}{
+	{"T", 40},
+	{"G", 30},
+	{"M", 20},
+	{"K", 10},
+}
+
+// ParseSize parses a size such as "512", "64K", "10M" or "1.5G", as the
+// gocat command's byte-size flags and the chunk= field take them.
+// Suffixes are binary multiples, and may be followed by B or iB.
+func ParseSize(s string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	str = strings.TrimSuffix(strings.TrimSuffix(str, "B"), "I")
+
+	shift := uint(0)
+	for _, suf := range sizeSuffixes {
+		if strings.HasSuffix(str, suf.suffix) {
+			shift = suf.shift
+			str = strings.TrimSuffix(str, suf.suffix)
+			break
+		}
+	}
+
+	if shift == 0 {
+		n, err := strconv.ParseInt(str, 10, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid size %q", s)
+		}
+		return n, nil
+	}
+
+	f, err := strconv.ParseFloat(str, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(f * float64(int64(1)<<shift)), nil
+}
@@ -0,0 +1,106 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// spooledChunk is a chunk waiting in the spool for its turn.
+type spooledChunk struct {
+	slot int64
+	n    int64
+	err  error
+}
+
+// downloadSpooled is downloadParallel with the chunks that wait for their
+// turn kept in a temporary file in SpoolDir rather than in memory. Each of
+// the workers slots owns a region of the file as large as a chunk can be,
+// which its chunk streams into as it arrives, so the file never takes more
+// disk than the buffers would have taken memory. Chunks are not hedged.
+func (d *Downloader) downloadSpooled(
+	parent context.Context,
+	url string,
+	set *sourceSet,
+	workers int,
+	start, end int64,
+	w io.Writer,
+) (written int64, err error) {
+	f, err := os.CreateTemp(d.SpoolDir, ".gocat-spool-*")
+	if err != nil {
+		return 0, &PermanentError{Err: fmt.Errorf("spool: %w", err)}
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	region := d.ChunkSize
+	if n := d.sourceMeta(url).ChunkSize; n > 0 {
+		region = n
+	} else if d.AdaptiveChunks {
+		region = d.MaxChunkSize
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	slots := make(chan int64, workers)
+	for i := range workers {
+		slots <- int64(i)
+	}
+	pending := make(chan chan spooledChunk, workers)
+
+	go func() {
+		defer close(pending)
+		next := start
+		for chunk := int64(1); next < end && !d.drained(ctx); chunk++ {
+			var slot int64
+			select {
+			case slot = <-slots:
+			case <-ctx.Done():
+				return
+			}
+
+			size := min(d.chunkSize(url), region)
+			offset := next
+			offsetTo := min(offset+size, end)
+			next = offsetTo
+			numChunks := chunk - 1 + (end-offset+size-1)/size
+			result := make(chan spooledChunk, 1)
+			pending <- result
+
+			go func() {
+				d.chunkStarted(url, chunk, numChunks, offset, offsetTo)
+				began := time.Now()
+				r := ClosedRange(offset, offsetTo-1)
+				n, err := d.streamChunk(ctx, url, set, r, io.NewOffsetWriter(f, slot*region))
+				d.chunkDone(url, chunk, numChunks, r, n, began, err)
+				result <- spooledChunk{slot, n, unwrapSink(err)}
+			}()
+		}
+	}()
+
+	for result := range pending {
+		r := <-result
+		if r.err != nil {
+			return written, r.err
+		}
+		n, err := io.Copy(w, io.NewSectionReader(f, r.slot*region, r.n))
+		written += n
+		if err != nil {
+			return written, err
+		}
+		slots <- r.slot
+	}
+	if written < end-start {
+		// The producer stopped early because of a drain or because
+		// parent was cancelled.
+		if err := context.Cause(parent); err != nil {
+			return written, err
+		}
+		return written, ErrDrained
+	}
+	return written, nil
+}
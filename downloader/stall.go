@@ -0,0 +1,109 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// StallError is the cause of a chunk cancelled for being too slow.
+type StallError struct {
+	Limit int64
+	Time  time.Duration
+}
+
+func (e *StallError) Error() string {
+	return fmt.Sprintf("transfer slower than %v bytes/s for %v", e.Limit, e.Time)
+}
+
+// ChunkTimeoutError is the cause of a ranged request cancelled for taking
+// longer than ChunkTimeout.
+type ChunkTimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e *ChunkTimeoutError) Error() string {
+	return fmt.Sprintf("request took longer than %v", e.Timeout)
+}
+
+// speedGuard cancels a transfer whose rate stays below limit bytes per
+// second for window. The cancelled request surfaces as an error and is
+// retried like any other failure.
+type speedGuard struct {
+	bytes  atomic.Int64
+	limit  int64
+	window time.Duration
+	paused func() bool
+	cancel context.CancelCauseFunc
+	done   chan struct{}
+}
+
+// newSpeedGuard returns nil when stall detection is disabled; a nil guard
+// is safe to use.
+func (d *Downloader) newSpeedGuard(cancel context.CancelCauseFunc) *speedGuard {
+	if d.SpeedLimit <= 0 {
+		return nil
+	}
+
+	g := &speedGuard{
+		limit:  d.SpeedLimit,
+		window: d.SpeedTime,
+		paused: d.Paused,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go g.run()
+	return g
+}
+
+func (g *speedGuard) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	last := int64(0)
+	slowSince := time.Now()
+	for {
+		select {
+		case <-g.done:
+			return
+		case now := <-ticker.C:
+			cur := g.bytes.Load()
+			rate := cur - last
+			last = cur
+			if rate >= g.limit || g.paused() {
+				slowSince = now
+				continue
+			}
+			if now.Sub(slowSince) >= g.window {
+				g.cancel(&StallError{Limit: g.limit, Time: g.window})
+				return
+			}
+		}
+	}
+}
+
+func (g *speedGuard) stop() {
+	if g != nil {
+		close(g.done)
+	}
+}
+
+func (g *speedGuard) wrap(r io.Reader) io.Reader {
+	if g == nil {
+		return r
+	}
+	return &guardedReader{r: r, g: g}
+}
+
+type guardedReader struct {
+	r io.Reader
+	g *speedGuard
+}
+
+func (gr *guardedReader) Read(p []byte) (int, error) {
+	n, err := gr.r.Read(p)
+	gr.g.bytes.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,149 @@
+package downloader
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var trailerHashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"crc32":  func() hash.Hash { return crc32.NewIEEE() },
+	"crc32c": func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+}
+
+// trailerCheck hashes a whole-object response body for the checksums its
+// Trailer header announces, such as x-amz-checksum-sha256, so they can be
+// checked when the trailers arrive at the end of a chunked body.
+type trailerCheck struct {
+	hashes map[string]hash.Hash
+}
+
+// newTrailerCheck returns nil when resp announces no checksum trailer.
+func newTrailerCheck(resp *http.Response) *trailerCheck {
+	t := &trailerCheck{hashes: map[string]hash.Hash{}}
+	add := func(algo string) {
+		if newHash, ok := trailerHashes[algo]; ok {
+			t.hashes[algo] = newHash()
+		}
+	}
+	for key := range resp.Trailer {
+		switch key = strings.ToLower(key); {
+		case key == "content-md5":
+			add("md5")
+		case key == "x-goog-hash":
+			add("md5")
+			add("crc32c")
+		case strings.HasPrefix(key, "x-amz-checksum-"):
+			add(strings.TrimPrefix(key, "x-amz-checksum-"))
+		}
+	}
+	if len(t.hashes) == 0 {
+		return nil
+	}
+	return t
+}
+
+func (t *trailerCheck) Write(p []byte) (int, error) {
+	for _, h := range t.hashes {
+		h.Write(p)
+	}
+	return len(p), nil
+}
+
+// check compares what was hashed with the checksums in trailer, which
+// the server may have left out after all.
+func (d *Downloader) checkTrailers(url string, t *trailerCheck, trailer http.Header) error {
+	digests := headerDigests(trailer)
+	algos := make([]string, 0, len(digests))
+	for algo := range digests {
+		if t.hashes[algo] != nil {
+			algos = append(algos, algo)
+		}
+	}
+	sort.Strings(algos)
+	if len(algos) == 0 {
+		return nil
+	}
+	for _, algo := range algos {
+		if got := hex.EncodeToString(t.hashes[algo].Sum(nil)); got != digests[algo] {
+			err := &PermanentError{Err: fmt.Errorf(
+				"%s: %v mismatch with the trailer: expected %v, got %v", url, algo, digests[algo], got,
+			)}
+			d.emit(Event{Kind: Verified, URL: url, Algorithms: algos, Err: err})
+			return err
+		}
+	}
+	d.emit(Event{Kind: Verified, URL: url, Algorithms: algos})
+	d.log(slog.LevelDebug, fmt.Sprintf("%s matches its trailer %v", url, strings.Join(algos, ", ")), "url", url)
+	return nil
+}
+
+// ChecksumHeader goes with every ranged GET to offer gocat serve's range
+// checksums; ChecksumTrailer is the trailer where it answers with the
+// SHA-256, in hex, of the bytes it sent. Other servers ignore the header.
+const (
+	ChecksumHeader  = "Gocat-Checksum"
+	ChecksumTrailer = "Gocat-Checksum-Sha256"
+)
+
+// ChecksumError is a range whose bytes do not match the checksum its
+// server sent after them: damaged on the way, and worth fetching again.
+type ChecksumError struct {
+	Range     ByteRange
+	Got, Want string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("%v does not match the checksum the server sent: sha256 %v, want %v", e.Range, e.Got, e.Want)
+}
+
+// rangeCheck hashes a ranged response whose server announced
+// ChecksumTrailer. The checksum trailers of other servers are of the
+// whole object, so a range is only ever checked against gocat's.
+type rangeCheck struct {
+	resp *http.Response
+	hash hash.Hash
+}
+
+// newRangeCheck returns nil when resp announces no ChecksumTrailer.
+func newRangeCheck(resp *http.Response) *rangeCheck {
+	if _, ok := resp.Trailer[ChecksumTrailer]; !ok {
+		return nil
+	}
+	return &rangeCheck{resp: resp, hash: sha256.New()}
+}
+
+func (c *rangeCheck) wrap(r io.Reader) io.Reader {
+	if c == nil {
+		return r
+	}
+	return io.TeeReader(r, c.hash)
+}
+
+// check reads the response to its end, where the trailer is, and compares
+// the checksum in it with what was hashed of r.
+func (c *rangeCheck) check(r ByteRange) error {
+	if c == nil {
+		return nil
+	}
+	if _, err := io.Copy(io.Discard, io.LimitReader(c.resp.Body, 1)); err != nil {
+		return err
+	}
+	want := c.resp.Trailer.Get(ChecksumTrailer)
+	if got := hex.EncodeToString(c.hash.Sum(nil)); want != "" && got != want {
+		return &ChecksumError{Range: r, Got: got, Want: want}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+// fileSchemes are the URL schemes of the file sources.
+var fileSchemes = []string{"ftp", "sftp"}
+
+// fileSource serves files over a protocol other than HTTP that can read
+// from an offset, such as FTP's REST or an SFTP read.
+type fileSource interface {
+	// stat returns the size of the file at u and when it was modified,
+	// zero when the server does not say.
+	stat(ctx context.Context, u *url.URL) (int64, time.Time, error)
+	// open reads length bytes of the file at u from offset, or up to its
+	// end when length is -1. The reader stops reading when ctx is done.
+	open(ctx context.Context, u *url.URL, offset, length int64) (io.ReadCloser, error)
+}
+
+// fileTransport answers ftp:// and sftp:// requests itself, as a server
+// that serves ranges would, so those files are chunked, retried and
+// resumed like any other entry.
+type fileTransport struct {
+	base    http.RoundTripper
+	sources map[string]fileSource
+}
+
+func newFileTransport(base http.RoundTripper) (*fileTransport, error) {
+	ftpPassword, err := readSecret(FTPPassword)
+	if err != nil {
+		return nil, err
+	}
+	sftpPassword, err := readSecret(SFTPPassword)
+	if err != nil {
+		return nil, err
+	}
+	return &fileTransport{
+		base: base,
+		sources: map[string]fileSource{
+			"ftp":  newFTPSource(FTPUser, ftpPassword),
+			"sftp": newSFTPSource(SSHCommand, SFTPKey, sftpPassword),
+		},
+	}, nil
+}
+
+func (t *fileTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	src, ok := t.sources[req.URL.Scheme]
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return nil, &downloader.PermanentError{Err: fmt.Errorf("%s: %v is not supported", req.URL.Redacted(), req.Method)}
+	}
+
+	ctx := req.Context()
+	size, modified, err := src.stat(ctx, req.URL)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return fileResponse(req, http.StatusNotFound, http.Header{}, nil), nil
+	case errors.Is(err, fs.ErrPermission):
+		return fileResponse(req, http.StatusForbidden, http.Header{}, nil), nil
+	case err != nil:
+		return nil, err
+	}
+
+	header := http.Header{}
+	header.Set("Accept-Ranges", "bytes")
+	header.Set("Content-Type", "application/octet-stream")
+	if !modified.IsZero() {
+		header.Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	status, offset, length := http.StatusOK, int64(0), size
+	if first, last, ok := dataRange(req.Header.Get("Range"), size); ok {
+		status, offset, length = http.StatusPartialContent, first, last-first+1
+		header.Set("Content-Range", fmt.Sprintf("bytes %v-%v/%v", first, last, size))
+	}
+	header.Set("Content-Length", strconv.FormatInt(length, 10))
+	if req.Method == http.MethodHead || length == 0 {
+		resp := fileResponse(req, status, header, nil)
+		resp.ContentLength = length
+		return resp, nil
+	}
+
+	body, err := src.open(ctx, req.URL, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	resp := fileResponse(req, status, header, body)
+	resp.ContentLength = length
+	return resp, nil
+}
+
+func fileResponse(req *http.Request, status int, header http.Header, body io.ReadCloser) *http.Response {
+	if body == nil {
+		body = http.NoBody
+	}
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode: status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Body:       body,
+		Request:    req,
+	}
+}
+
+// fileCredentials returns the user and password for u: its own, or else
+// the flags'.
+func fileCredentials(u *url.URL, user, password string) (string, string) {
+	if u.User == nil {
+		return user, password
+	}
+	if p, ok := u.User.Password(); ok {
+		return u.User.Username(), p
+	}
+	return u.User.Username(), password
+}
+
+// readSecret returns s, or the file it names with a leading @, trimmed.
+func readSecret(s string) (string, error) {
+	if !strings.HasPrefix(s, "@") {
+		return s, nil
+	}
+	b, err := os.ReadFile(s[1:])
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
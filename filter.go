@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	Lines      string
+	Grep       string
+	MaxMatches int
+)
+
+// filterMaxLine is the longest line -grep holds to match.
+const filterMaxLine = 16 << 20
+
+// errFilterDone is what the filter's Write returns once -lines or
+// -max-matches has all it wants; the entries stop on it, without fetching
+// the rest, and the run ends as complete.
+var errFilterDone = errors.New("the -lines or -grep filter is satisfied")
+
+// filter passes only some lines of the output on, with -lines or -grep.
+var filter *lineFilter
+
+// lineFilter passes lines from to to, numbered from 1 across the whole
+// output as if it were piped to sed -n, or only those of them matching re.
+// A line is passed as it streams in unless it has to be matched whole.
+type lineFilter struct {
+	w          io.Writer
+	from, to   int64
+	re         *regexp.Regexp
+	maxMatches int
+
+	// line is how many lines have ended so far; partial holds the start
+	// of the next one while it has to be matched.
+	line    int64
+	partial []byte
+	matches int
+	done    bool
+}
+
+func newLineFilter(lines, grep string, maxMatches int) (*lineFilter, error) {
+	f := &lineFilter{from: 1, maxMatches: maxMatches}
+	if lines != "" {
+		var err error
+		if f.from, f.to, err = parseLines(lines); err != nil {
+			return nil, err
+		}
+	}
+	if grep != "" {
+		var err error
+		if f.re, err = regexp.Compile(grep); err != nil {
+			return nil, fmt.Errorf("invalid -grep: %w", err)
+		}
+	}
+	return f, nil
+}
+
+// parseLines parses -lines: N:M, N: for the rest from line N, :M for the
+// first M lines, or N for line N alone.
+func parseLines(s string) (from, to int64, err error) {
+	invalid := fmt.Errorf("invalid -lines %q: want N:M, N:, :M or N, lines numbered from 1", s)
+	a, b, ranged := strings.Cut(s, ":")
+	from, to = 1, 0
+	if a != "" {
+		if from, err = strconv.ParseInt(a, 10, 64); err != nil || from < 1 {
+			return 0, 0, invalid
+		}
+	}
+	switch {
+	case !ranged:
+		to = from
+	case b != "":
+		if to, err = strconv.ParseInt(b, 10, 64); err != nil || to < from {
+			return 0, 0, invalid
+		}
+	}
+	return from, to, nil
+}
+
+func (f *lineFilter) Write(p []byte) (int, error) {
+	if f.done {
+		return 0, errFilterDone
+	}
+	n := 0
+	for len(p) > 0 {
+		seg, end := p, false
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			seg, end = p[:i+1], true
+		}
+		if err := f.segment(seg, end); err != nil {
+			return n, err
+		}
+		n += len(seg)
+		p = p[len(seg):]
+		if f.done {
+			return n, errFilterDone
+		}
+	}
+	return n, nil
+}
+
+// segment handles seg, the next part of the current line, which it ends
+// if end.
+func (f *lineFilter) segment(seg []byte, end bool) error {
+	in := f.line+1 >= f.from
+	switch {
+	case !in:
+	case f.re == nil:
+		if _, err := f.w.Write(seg); err != nil {
+			return err
+		}
+	default:
+		if len(f.partial)+len(seg) > filterMaxLine {
+			return fmt.Errorf("-grep: line %v is longer than %v bytes", f.line+1, filterMaxLine)
+		}
+		f.partial = append(f.partial, seg...)
+		if end {
+			if err := f.match(); err != nil {
+				return err
+			}
+		}
+	}
+	if end {
+		f.line++
+		if f.to > 0 && f.line >= f.to {
+			f.done = true
+		}
+	}
+	return nil
+}
+
+// match passes the line in partial on if it matches.
+func (f *lineFilter) match() error {
+	line := f.partial
+	f.partial = f.partial[:0]
+	if !f.re.Match(bytes.TrimSuffix(line, []byte("\n"))) {
+		return nil
+	}
+	if _, err := f.w.Write(line); err != nil {
+		return err
+	}
+	f.matches++
+	if f.maxMatches > 0 && f.matches >= f.maxMatches {
+		f.done = true
+	}
+	return nil
+}
+
+// flush matches the last line when the output does not end with a newline.
+func (f *lineFilter) flush() error {
+	if f.done || len(f.partial) == 0 {
+		return nil
+	}
+	return f.match()
+}
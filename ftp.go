@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+var (
+	FTPUser     string
+	FTPPassword string
+)
+
+const (
+	// ftpIdleTimeout is how long a logged-in connection is kept for the
+	// next request to the same server.
+	ftpIdleTimeout = 30 * time.Second
+	// ftpReplyTimeout bounds the wait for the end of a transfer that was
+	// cut short on purpose.
+	ftpReplyTimeout = 5 * time.Second
+)
+
+// ftpError is a negative reply of an FTP server.
+type ftpError struct {
+	Code int
+	Msg  string
+}
+
+func (e *ftpError) Error() string {
+	return fmt.Sprintf("ftp: %d %s", e.Code, e.Msg)
+}
+
+// ftpSource reads ftp:// URLs in binary mode through passive data
+// connections, starting at an offset with REST. Logged-in control
+// connections are reused.
+type ftpSource struct {
+	user     string
+	password string
+
+	mu   sync.Mutex
+	idle map[string][]*ftpConn
+}
+
+func newFTPSource(user, password string) *ftpSource {
+	return &ftpSource{user: user, password: password, idle: map[string][]*ftpConn{}}
+}
+
+type ftpConn struct {
+	key  string
+	conn net.Conn
+	tp   *textproto.Conn
+	used time.Time
+}
+
+func ftpAddr(u *url.URL) string {
+	if u.Port() == "" {
+		return net.JoinHostPort(u.Hostname(), "21")
+	}
+	return u.Host
+}
+
+// ftpPath is the path of u as RFC 1738 has it: relative to where the login
+// lands, unless it starts with %2F.
+func ftpPath(u *url.URL) string {
+	return strings.TrimPrefix(u.Path, "/")
+}
+
+// conn returns an idle connection to the server of u, or a new one.
+func (s *ftpSource) conn(ctx context.Context, u *url.URL) (*ftpConn, bool, error) {
+	user, password := fileCredentials(u, s.user, s.password)
+	key := user + "@" + ftpAddr(u)
+	s.mu.Lock()
+	for len(s.idle[key]) > 0 {
+		conns := s.idle[key]
+		c := conns[len(conns)-1]
+		s.idle[key] = conns[:len(conns)-1]
+		if time.Since(c.used) < ftpIdleTimeout {
+			s.mu.Unlock()
+			return c, true, nil
+		}
+		c.close()
+	}
+	s.mu.Unlock()
+
+	c, err := dialFTP(ctx, key, ftpAddr(u), user, password)
+	return c, false, err
+}
+
+func (s *ftpSource) release(c *ftpConn) {
+	c.used = time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.idle[c.key] = append(s.idle[c.key], c)
+}
+
+// do runs op on a connection to the server of u. A reused connection the
+// server has dropped meanwhile is replaced once.
+func (s *ftpSource) do(ctx context.Context, u *url.URL, op func(c *ftpConn) error) error {
+	for {
+		c, reused, err := s.conn(ctx, u)
+		if err != nil {
+			return err
+		}
+		stop := c.watch(ctx)
+		err = op(c)
+		stop()
+		var ferr *ftpError
+		if err == nil || errors.As(err, &ferr) {
+			s.release(c)
+			return err
+		}
+		c.close()
+		if !reused || ctx.Err() != nil {
+			return err
+		}
+	}
+}
+
+func dialFTP(ctx context.Context, key, addr, user, password string) (*ftpConn, error) {
+	if Offline {
+		return nil, offlineError(addr)
+	}
+	d := net.Dialer{Timeout: ConnectTimeout}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &ftpConn{key: key, conn: conn, tp: textproto.NewConn(conn)}
+	stop := c.watch(ctx)
+	defer stop()
+
+	if _, _, err := c.tp.ReadResponse(220); err != nil {
+		c.close()
+		return nil, err
+	}
+	if user == "" {
+		user, password = "anonymous", "anonymous@"
+	}
+	code, msg, err := c.cmd("USER %s", user)
+	if err == nil && code == 331 {
+		code, msg, err = c.cmd("PASS %s", password)
+	}
+	if err == nil && code != 230 && code != 202 {
+		err = &ftpError{code, msg}
+		if code == 530 {
+			err = &downloader.PermanentError{Err: fmt.Errorf("ftp login to %s as %s: %w", addr, user, err)}
+		}
+	}
+	if err == nil {
+		err = c.expect(200, "TYPE I")
+	}
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// watch unblocks the connection once ctx is done, until the returned
+// function is called.
+func (c *ftpConn) watch(ctx context.Context) func() {
+	stop := context.AfterFunc(ctx, func() { c.conn.SetDeadline(time.Now()) })
+	return func() {
+		if !stop() {
+			// Too late: the connection is unusable, and do discards it.
+			return
+		}
+		c.conn.SetDeadline(time.Time{})
+	}
+}
+
+func (c *ftpConn) close() {
+	c.conn.Close()
+}
+
+// cmd sends a command and returns the reply, whatever its code.
+func (c *ftpConn) cmd(format string, args ...any) (int, string, error) {
+	id, err := c.tp.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	c.tp.StartResponse(id)
+	defer c.tp.EndResponse(id)
+	return c.tp.ReadResponse(0)
+}
+
+// expect sends a command and fails unless the reply has code want.
+func (c *ftpConn) expect(want int, format string, args ...any) error {
+	code, msg, err := c.cmd(format, args...)
+	if err == nil && code != want {
+		err = &ftpError{code, msg}
+	}
+	return err
+}
+
+// passive opens a data connection, with EPSV or else PASV. The address
+// PASV returns is ignored but for the port, as NAT often rewrites it.
+func (c *ftpConn) passive(ctx context.Context) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+	var port int
+	code, msg, err := c.cmd("EPSV")
+	switch {
+	case err != nil:
+		return nil, err
+	case code == 229:
+		// 229 Entering Extended Passive Mode (|||6446|)
+		fields := strings.Split(msg[strings.IndexByte(msg, '(')+1:], "|")
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("ftp: bad EPSV reply %q", msg)
+		}
+		if port, err = strconv.Atoi(fields[3]); err != nil {
+			return nil, fmt.Errorf("ftp: bad EPSV reply %q", msg)
+		}
+	default:
+		// 227 Entering Passive Mode (h1,h2,h3,h4,p1,p2)
+		code, msg, err = c.cmd("PASV")
+		if err != nil {
+			return nil, err
+		}
+		if code != 227 {
+			return nil, &ftpError{code, msg}
+		}
+		start := strings.IndexByte(msg, '(')
+		end := strings.LastIndexByte(msg, ')')
+		fields := []string{}
+		if start >= 0 && end > start {
+			fields = strings.Split(msg[start+1:end], ",")
+		}
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("ftp: bad PASV reply %q", msg)
+		}
+		hi, err1 := strconv.Atoi(fields[4])
+		lo, err2 := strconv.Atoi(fields[5])
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("ftp: bad PASV reply %q", msg)
+		}
+		port = hi<<8 | lo
+	}
+	d := net.Dialer{Timeout: ConnectTimeout}
+	return d.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+func (s *ftpSource) stat(ctx context.Context, u *url.URL) (int64, time.Time, error) {
+	var size int64
+	var modified time.Time
+	err := s.do(ctx, u, func(c *ftpConn) error {
+		code, msg, err := c.cmd("SIZE %s", ftpPath(u))
+		if err != nil {
+			return err
+		}
+		if code != 213 {
+			return &ftpError{code, msg}
+		}
+		if size, err = strconv.ParseInt(strings.TrimSpace(msg), 10, 64); err != nil {
+			return fmt.Errorf("ftp: bad SIZE reply %q", msg)
+		}
+		// MDTM is optional; without it there is no Last-Modified.
+		if code, msg, err = c.cmd("MDTM %s", ftpPath(u)); err == nil && code == 213 && len(msg) >= 14 {
+			modified, _ = time.Parse("20060102150405", msg[:14])
+		}
+		return err
+	})
+	var ferr *ftpError
+	if errors.As(err, &ferr) && ferr.Code == 550 {
+		return 0, time.Time{}, fs.ErrNotExist
+	}
+	return size, modified, err
+}
+
+func (s *ftpSource) open(ctx context.Context, u *url.URL, offset, length int64) (io.ReadCloser, error) {
+	for {
+		c, reused, err := s.conn(ctx, u)
+		if err != nil {
+			return nil, err
+		}
+		body, err := s.retrieve(ctx, c, u, offset, length)
+		// A reused connection the server has dropped is replaced once.
+		var ferr *ftpError
+		if err == nil || errors.As(err, &ferr) || !reused || ctx.Err() != nil {
+			return body, err
+		}
+	}
+}
+
+// retrieve starts a RETR from offset on c, which the returned body owns.
+func (s *ftpSource) retrieve(ctx context.Context, c *ftpConn, u *url.URL, offset, length int64) (io.ReadCloser, error) {
+	stop := c.watch(ctx)
+	data, err := c.passive(ctx)
+	if err == nil && offset > 0 {
+		err = c.expect(350, "REST %d", offset)
+	}
+	if err == nil {
+		var code int
+		var msg string
+		code, msg, err = c.cmd("RETR %s", ftpPath(u))
+		if err == nil && code != 150 && code != 125 {
+			err = &ftpError{code, msg}
+		}
+	}
+	if err != nil {
+		stop()
+		if data != nil {
+			data.Close()
+		}
+		var ferr *ftpError
+		if errors.As(err, &ferr) {
+			s.release(c)
+		} else {
+			c.close()
+		}
+		return nil, err
+	}
+	b := &ftpBody{s: s, c: c, data: data, stop: stop, left: length}
+	return b, nil
+}
+
+// ftpBody is the data connection of a RETR. Closing it before the end
+// aborts the transfer; the control connection is kept if the server
+// confirms that in time.
+type ftpBody struct {
+	s    *ftpSource
+	c    *ftpConn
+	data net.Conn
+	stop func()
+	left int64
+	done bool
+}
+
+func (b *ftpBody) Read(p []byte) (int, error) {
+	if b.left == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > b.left {
+		p = p[:b.left]
+	}
+	n, err := b.data.Read(p)
+	b.left -= int64(n)
+	if err == io.EOF && b.left > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (b *ftpBody) Close() error {
+	if b.done {
+		return nil
+	}
+	b.done = true
+	b.data.Close()
+	b.stop()
+	// 226 after a whole transfer; 426 or 451 after one cut short.
+	b.c.conn.SetReadDeadline(time.Now().Add(ftpReplyTimeout))
+	code, _, err := b.c.tp.ReadResponse(0)
+	b.c.conn.SetReadDeadline(time.Time{})
+	if err != nil || code/100 != 2 && code != 426 && code != 451 {
+		b.c.close()
+		return nil
+	}
+	b.s.release(b.c)
+	return nil
+}
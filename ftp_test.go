@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+// fakeFTP is an FTP server with files in memory, speaking as much of the
+// protocol as ftpSource does.
+type fakeFTP struct {
+	addr  string
+	files map[string][]byte
+	// epsv and pasv replace the replies to EPSV and PASV; an epsv of "-"
+	// refuses EPSV.
+	epsv, pasv string
+
+	mu    sync.Mutex
+	cmds  []string
+	conns int
+}
+
+func newFakeFTP(t *testing.T, files map[string][]byte) *fakeFTP {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	f := &fakeFTP{addr: l.Addr().String(), files: files}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns++
+			f.mu.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeFTP) url(path string) *url.URL {
+	u, _ := url.Parse("ftp://u:secret@" + f.addr + "/" + path)
+	return u
+}
+
+func (f *fakeFTP) commands() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.cmds...)
+}
+
+func (f *fakeFTP) connections() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.conns
+}
+
+func (f *fakeFTP) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	reply := func(code int, msg string) { tp.PrintfLine("%d %s", code, msg) }
+	reply(220, "fake")
+	var user string
+	var offset int64
+	var data net.Listener
+	passive := func() (int, bool) {
+		if data != nil {
+			data.Close()
+		}
+		var err error
+		if data, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			reply(425, "no data connection")
+			return 0, false
+		}
+		return data.Addr().(*net.TCPAddr).Port, true
+	}
+	defer func() {
+		if data != nil {
+			data.Close()
+		}
+	}()
+
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.cmds = append(f.cmds, line)
+		f.mu.Unlock()
+		cmd, arg, _ := strings.Cut(line, " ")
+		switch cmd {
+		case "USER":
+			user = arg
+			reply(331, "password please")
+		case "PASS":
+			if user == "u" && arg == "secret" || user == "anonymous" {
+				reply(230, "logged in")
+			} else {
+				reply(530, "login incorrect")
+			}
+		case "TYPE":
+			reply(200, "binary")
+		case "SIZE", "MDTM":
+			b, ok := f.files[arg]
+			switch {
+			case !ok:
+				reply(550, arg+": no such file")
+			case cmd == "SIZE":
+				reply(213, strconv.Itoa(len(b)))
+			default:
+				reply(213, "20240102030405")
+			}
+		case "EPSV":
+			if f.epsv == "-" {
+				reply(500, "EPSV not understood")
+				continue
+			}
+			if port, ok := passive(); ok {
+				msg := fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", port)
+				if f.epsv != "" {
+					msg = f.epsv
+				}
+				reply(229, msg)
+			}
+		case "PASV":
+			// The address is of no use: ftpSource only takes the port.
+			if port, ok := passive(); ok {
+				msg := fmt.Sprintf("Entering Passive Mode (10,9,8,7,%d,%d)", port>>8, port&0xff)
+				if f.pasv != "" {
+					msg = f.pasv
+				}
+				reply(227, msg)
+			}
+		case "REST":
+			offset, _ = strconv.ParseInt(arg, 10, 64)
+			reply(350, "restarting")
+		case "RETR":
+			b, ok := f.files[arg]
+			if !ok || data == nil {
+				reply(550, arg+": no such file")
+				continue
+			}
+			reply(150, "opening data connection")
+			dc, err := data.Accept()
+			if err != nil {
+				reply(425, "no data connection")
+				continue
+			}
+			_, err = dc.Write(b[min(offset, int64(len(b))):])
+			dc.Close()
+			offset = 0
+			if err != nil {
+				reply(426, "transfer aborted")
+			} else {
+				reply(226, "transfer complete")
+			}
+		case "QUIT":
+			reply(221, "bye")
+			return
+		default:
+			reply(502, "not implemented")
+		}
+	}
+}
+
+func TestFTPStat(t *testing.T) {
+	f := newFakeFTP(t, map[string][]byte{"dir/file.bin": []byte("0123456789")})
+	s := newFTPSource("", "")
+	ctx := context.Background()
+
+	size, modified, err := s.stat(ctx, f.url("dir/file.bin"))
+	if want := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC); err != nil || size != 10 || !modified.Equal(want) {
+		t.Errorf("stat = %v, %v, %v; want 10, %v", size, modified, err, want)
+	}
+	if _, _, err := s.stat(ctx, f.url("missing")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("stat of a missing file: %v, want fs.ErrNotExist", err)
+	}
+
+	u := f.url("dir/file.bin")
+	u.User = url.UserPassword("mallory", "wrong")
+	_, _, err = s.stat(ctx, u)
+	var perm *downloader.PermanentError
+	var ferr *ftpError
+	if !errors.As(err, &perm) || !errors.As(err, &ferr) || ferr.Code != 530 {
+		t.Errorf("stat with a bad password: %v, want a permanent 530", err)
+	}
+	if n := f.connections(); n != 2 {
+		t.Errorf("%v connections, want the login reused and one for the other user", n)
+	}
+}
+
+func TestFTPRetrieve(t *testing.T) {
+	content := bytes.Repeat([]byte("gocat ftp "), 1000)
+	tests := []struct {
+		name           string
+		epsv           string
+		offset, length int64
+		want           string
+	}{
+		{"epsv", "", 0, int64(len(content)), ""},
+		{"epsv resumed", "", 1234, 5000, "REST 1234"},
+		{"pasv", "-", 10, int64(len(content)) - 10, "PASV"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeFTP(t, map[string][]byte{"f": content})
+			f.epsv = tt.epsv
+			s := newFTPSource("", "")
+			body, err := s.open(context.Background(), f.url("f"), tt.offset, tt.length)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(body)
+			body.Close()
+			if err != nil || !bytes.Equal(got, content[tt.offset:tt.offset+tt.length]) {
+				t.Fatalf("read %v bytes, %v; want %v from %v", len(got), err, tt.length, tt.offset)
+			}
+			cmds := strings.Join(f.commands(), "\n")
+			if tt.want != "" && !strings.Contains(cmds, tt.want) {
+				t.Errorf("commands %q, want %q", cmds, tt.want)
+			}
+			if tt.offset == 0 && strings.Contains(cmds, "REST") {
+				t.Errorf("commands %q restart at 0", cmds)
+			}
+
+			// The control connection stays usable after the transfer.
+			if _, _, err := s.stat(context.Background(), f.url("f")); err != nil || f.connections() != 1 {
+				t.Errorf("stat after the transfer: %v on %v connections", err, f.connections())
+			}
+		})
+	}
+}
+
+func TestFTPAbortedRetrieve(t *testing.T) {
+	f := newFakeFTP(t, map[string][]byte{"big": bytes.Repeat([]byte("x"), 8<<20)})
+	s := newFTPSource("", "")
+	body, err := s.open(context.Background(), f.url("big"), 0, 8<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(body, make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	body.Close()
+	if _, _, err := s.stat(context.Background(), f.url("big")); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.connections(); n != 1 {
+		t.Errorf("%v connections, want the aborted one reused", n)
+	}
+}
+
+func TestFTPErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		epsv, pasv string
+		path       string
+		want       string
+	}{
+		{"bad epsv", "Entering Extended Passive Mode (|||x|)", "", "f", "bad EPSV reply"},
+		{"short epsv", "Entering Extended Passive Mode", "", "f", "bad EPSV reply"},
+		{"bad pasv", "-", "Entering Passive Mode (1,2,3)", "f", "bad PASV reply"},
+		{"missing", "", "", "missing", "ftp: 550 missing: no such file"},
+	}
+	for _, tt := range tests {
+		f := newFakeFTP(t, map[string][]byte{"f": []byte("data")})
+		f.epsv, f.pasv = tt.epsv, tt.pasv
+		_, err := newFTPSource("", "").open(context.Background(), f.url(tt.path), 0, 4)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%v: got %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
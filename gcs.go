@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+const (
+	gcsReadScope  = "https://www.googleapis.com/auth/devstorage.read_only"
+	gcsWriteScope = "https://www.googleapis.com/auth/devstorage.read_write"
+)
+
+// gcsScope is what service account tokens are asked for; -dest gs:// needs
+// the right to write.
+var gcsScope = gcsReadScope
+
+// gcsStore serves gs://bucket/object through the XML API, which takes
+// ranges like any HTTP server. Tokens come from GOOGLE_OAUTH_ACCESS_TOKEN,
+// Application Default Credentials (a service account key or gcloud's user
+// credentials) or the GCE metadata server; without any, requests go
+// unauthenticated for public buckets. STORAGE_EMULATOR_HOST points it at
+// an emulator.
+//
+// Reads of an object are pinned to the generation the first one answered
+// with, so that chunks never mix two versions of it, and ask for its
+// stored bytes: GCS would otherwise decompress an object stored gzipped on
+// the fly and ignore the ranges. The pins last as long as the process,
+// unless the request's context carries a scope of its own (see
+// withGenerationPins), as each job of gocat serve does.
+type gcsStore struct {
+	endpoint *url.URL
+
+	once  sync.Once
+	token *cachedToken
+	err   error
+
+	pins generationPins
+}
+
+// generationPins holds the generation each bucket/object was first read at.
+type generationPins struct {
+	mu          sync.Mutex
+	generations map[string]string
+}
+
+func (p *generationPins) get(object string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.generations[object]
+}
+
+// pin records generation for object unless it already has one.
+func (p *generationPins) pin(object, generation string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.generations == nil {
+		p.generations = map[string]string{}
+	}
+	if p.generations[object] == "" {
+		p.generations[object] = generation
+	}
+}
+
+type generationPinsKey struct{}
+
+// withGenerationPins returns a context whose object store reads pin
+// generations of their own, forgotten with it, so that a later download
+// of an object overwritten since reads its new generation.
+func withGenerationPins(ctx context.Context) context.Context {
+	return context.WithValue(ctx, generationPinsKey{}, &generationPins{})
+}
+
+// pinsOf returns the pins of req's context, or else the store's own.
+func (s *gcsStore) pinsOf(req *http.Request) *generationPins {
+	if p, ok := req.Context().Value(generationPinsKey{}).(*generationPins); ok {
+		return p
+	}
+	return &s.pins
+}
+
+func newGCSStore() *gcsStore {
+	s := &gcsStore{
+		endpoint: &url.URL{Scheme: "https", Host: "storage.googleapis.com"},
+	}
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		if u, err := url.Parse(host); err == nil && u.Host != "" {
+			s.endpoint = u
+		} else {
+			s.endpoint = &url.URL{Scheme: "http", Host: host}
+		}
+	}
+	return s
+}
+
+func (s *gcsStore) prepare(req *http.Request) error {
+	object := req.URL.Host + req.URL.Path
+	rawQuery := req.URL.RawQuery
+	if gcsRead(req) {
+		generation := s.pinsOf(req).get(object)
+		if query := req.URL.Query(); generation != "" && !query.Has("generation") {
+			query.Set("generation", generation)
+			rawQuery = query.Encode()
+		}
+		// Stored bytes, which the transport then leaves alone too.
+		if !strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+			req.Header.Set("Accept-Encoding", "gzip")
+		}
+	}
+	req.URL = &url.URL{
+		Scheme:   s.endpoint.Scheme,
+		Host:     s.endpoint.Host,
+		Path:     "/" + object,
+		RawQuery: rawQuery,
+	}
+	req.Host = ""
+	_, err := s.authorize(req)
+	return err
+}
+
+// check pins the object of req, a read, to the generation of its first
+// answer, and fails an answer GCS decompressed on the fly.
+func (s *gcsStore) check(req *http.Request, resp *http.Response) error {
+	if !gcsRead(req) || req.URL.Query().Has("generation") {
+		return nil
+	}
+	object := req.URL.Host + req.URL.Path
+	pins := s.pinsOf(req)
+	pinned := pins.get(object)
+	switch {
+	case resp.StatusCode == http.StatusNotFound && pinned != "":
+		return &downloader.PermanentError{
+			Err: fmt.Errorf("%s: generation %v is gone, the object changed while it was read", req.URL.Redacted(), pinned),
+		}
+	case resp.StatusCode/100 != 2:
+		return nil
+	}
+	if stored := resp.Header.Get("X-Goog-Stored-Content-Encoding"); stored != "" && stored != "identity" &&
+		resp.Header.Get("Content-Encoding") != stored {
+		return &downloader.PermanentError{
+			Err: fmt.Errorf("%s: GCS decompressed the %v object it stores, so its bytes and ranges do not line up", req.URL.Redacted(), stored),
+		}
+	}
+	if generation := resp.Header.Get("X-Goog-Generation"); generation != "" && pinned == "" {
+		pins.pin(object, generation)
+	}
+	return nil
+}
+
+// gcsRead reports whether req reads an object rather than writes one.
+func gcsRead(req *http.Request) bool {
+	return req.Method == "GET" || req.Method == "HEAD"
+}
+
+// authorize sets the bearer token of req, reporting false when there are
+// no credentials to take one from.
+func (s *gcsStore) authorize(req *http.Request) (bool, error) {
+	s.once.Do(func() { s.token, s.err = gcsTokenSource() })
+	if s.err != nil {
+		return false, s.err
+	}
+	if s.token == nil {
+		return false, nil
+	}
+	token, err := s.token.get(req.Context())
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return true, nil
+}
+
+// gcsTokenSource picks the first source of the credential chain, nil
+// meaning anonymous access.
+func gcsTokenSource() (*cachedToken, error) {
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		return &cachedToken{value: token}, nil
+	}
+
+	path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if path == "" {
+		if dir := os.Getenv("CLOUDSDK_CONFIG"); dir != "" {
+			path = dir + "/application_default_credentials.json"
+		} else {
+			path = homeFile(".config", "gcloud", "application_default_credentials.json")
+		}
+		if _, err := os.Stat(path); err != nil {
+			path = ""
+		}
+	}
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, &downloader.PermanentError{Err: err}
+		}
+		var adc googleCredentials
+		if err := json.Unmarshal(b, &adc); err != nil {
+			return nil, &downloader.PermanentError{Err: fmt.Errorf("%s: %w", path, err)}
+		}
+		switch adc.Type {
+		case "service_account":
+			key, err := adc.privateKey()
+			if err != nil {
+				return nil, &downloader.PermanentError{Err: fmt.Errorf("%s: %w", path, err)}
+			}
+			return &cachedToken{fetch: func(ctx context.Context) (string, time.Time, error) {
+				return adc.serviceAccountToken(ctx, key)
+			}}, nil
+		case "authorized_user":
+			return &cachedToken{fetch: adc.refreshToken}, nil
+		default:
+			return nil, &downloader.PermanentError{
+				Err: fmt.Errorf("%s: unsupported credential type %q", path, adc.Type),
+			}
+		}
+	}
+
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = "metadata.google.internal"
+	}
+	metadata := &cachedToken{fetch: func(ctx context.Context) (string, time.Time, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET",
+			"http://"+host+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		var tr tokenResponse
+		if err := fetchJSON(metadataClient, req, &tr); err != nil {
+			return "", time.Time{}, err
+		}
+		return tr.AccessToken, tr.expiry(), nil
+	}}
+	// Off GCE the metadata server does not answer; go anonymous then.
+	if _, err := metadata.get(context.Background()); err != nil {
+		return nil, nil
+	}
+	return metadata, nil
+}
+
+// googleCredentials is an Application Default Credentials file.
+type googleCredentials struct {
+	Type string `json:"type"`
+
+	// service_account
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	PrivateKeyID string `json:"private_key_id"`
+	TokenURI     string `json:"token_uri"`
+
+	// authorized_user
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+func (c *googleCredentials) tokenURI() string {
+	if c.TokenURI != "" {
+		return c.TokenURI
+	}
+	return "https://oauth2.googleapis.com/token"
+}
+
+func (c *googleCredentials) privateKey() (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(c.PrivateKey))
+	if block == nil {
+		return nil, errors.New("private_key is not PEM")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if rsaKey, rerr := x509.ParsePKCS1PrivateKey(block.Bytes); rerr == nil {
+			return rsaKey, nil
+		}
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private_key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// serviceAccountToken trades a JWT signed with the account's key for an
+// access token.
+func (c *googleCredentials) serviceAccountToken(ctx context.Context, key *rsa.PrivateKey) (string, time.Time, error) {
+	assertion, err := c.assertion(key, time.Now())
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return postToken(ctx, c.tokenURI(), url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	})
+}
+
+// assertion is the JWT, issued at now, that serviceAccountToken trades.
+func (c *googleCredentials) assertion(key *rsa.PrivateKey, now time.Time) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": c.PrivateKeyID})
+	claims, _ := json.Marshal(map[string]any{
+		"iss":   c.ClientEmail,
+		"scope": gcsScope,
+		"aud":   c.tokenURI(),
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(nil, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+func (c *googleCredentials) refreshToken(ctx context.Context) (string, time.Time, error) {
+	return postToken(ctx, c.tokenURI(), url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {c.ClientID},
+		"client_secret": {c.ClientSecret},
+		"refresh_token": {c.RefreshToken},
+	})
+}
+
+// postToken runs an OAuth 2.0 token request.
+func postToken(ctx context.Context, endpoint string, form url.Values) (string, time.Time, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var tr tokenResponse
+	if err := fetchJSON(credentialClient, req, &tr); err != nil {
+		return "", time.Time{}, err
+	}
+	if tr.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("%s returned no access token", endpoint)
+	}
+	return tr.AccessToken, tr.expiry(), nil
+}
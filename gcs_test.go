@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testServiceAccount(t *testing.T) (*googleCredentials, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &googleCredentials{
+		Type:         "service_account",
+		ClientEmail:  "gocat@project.iam.gserviceaccount.com",
+		PrivateKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		PrivateKeyID: "key1",
+	}, key
+}
+
+// checkAssertion verifies the JWT a service account signed and returns its
+// claims.
+func checkAssertion(t *testing.T, jwt string, key *rsa.PrivateKey) map[string]any {
+	t.Helper()
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		t.Fatalf("assertion %q is not a JWT", jwt)
+	}
+	enc := base64.RawURLEncoding
+	sig, err := enc.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, sum[:], sig); err != nil {
+		t.Errorf("signature: %v", err)
+	}
+	var header map[string]string
+	var claims map[string]any
+	for i, v := range []any{&header, &claims} {
+		b, err := enc.DecodeString(parts[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(b, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if header["alg"] != "RS256" || header["typ"] != "JWT" || header["kid"] != "key1" {
+		t.Errorf("header %v", header)
+	}
+	return claims
+}
+
+func TestGCSAssertion(t *testing.T) {
+	creds, _ := testServiceAccount(t)
+	key, err := creds.privateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	jwt, err := creds.assertion(key, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := checkAssertion(t, jwt, key)
+	want := map[string]any{
+		"iss":   "gocat@project.iam.gserviceaccount.com",
+		"scope": gcsReadScope,
+		"aud":   "https://oauth2.googleapis.com/token",
+		"iat":   1700000000.0,
+		"exp":   1700003600.0,
+	}
+	for k, v := range want {
+		if claims[k] != v {
+			t.Errorf("claim %v = %v, want %v", k, claims[k], v)
+		}
+	}
+	if again, _ := creds.assertion(key, now); again != jwt {
+		t.Error("the same key and time signed differently")
+	}
+}
+
+func TestGCSServiceAccountToken(t *testing.T) {
+	creds, key := testServiceAccount(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		if req.Form.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			http.Error(w, "bad grant", http.StatusBadRequest)
+			return
+		}
+		claims := checkAssertion(t, req.Form.Get("assertion"), key)
+		if claims["aud"] != "http://"+req.Host+"/token" {
+			t.Errorf("aud %v, want the token URI", claims["aud"])
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"ya29.token","expires_in":3599}`))
+	}))
+	t.Cleanup(srv.Close)
+	creds.TokenURI = srv.URL + "/token"
+
+	token, expiry, err := creds.serviceAccountToken(context.Background(), key)
+	if err != nil || token != "ya29.token" {
+		t.Fatalf("token = %q, %v", token, err)
+	}
+	if left := time.Until(expiry); left < 59*time.Minute || left > time.Hour {
+		t.Errorf("token expires in %v, want about an hour", left)
+	}
+}
+
+// testGCS is a GCS XML API serving gs://bucket/obj, which is overwritten
+// by a new generation once its first chunk is read, and gs://bucket/gz,
+// stored gzipped, which it decompresses for readers not taking gzip, or
+// for all of them when always is set.
+func testGCS(t *testing.T, always bool) (first, gz []byte) {
+	t.Helper()
+	first = bytes.Repeat([]byte("first "), 300<<10)
+	second := bytes.Repeat([]byte("other "), 300<<10)
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	zw.Write([]byte("unzipped\n"))
+	zw.Close()
+	gz = b.Bytes()
+
+	var mu sync.Mutex
+	generation := 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/bucket/obj":
+			mu.Lock()
+			current := generation
+			if req.Method == "GET" && req.Header.Get("Range") != "" && req.Header.Get("Range") != "bytes=0-0" {
+				generation = 2
+			}
+			mu.Unlock()
+			content := second
+			if g := req.URL.Query().Get("generation"); g == "1" || g == "" && current == 1 {
+				content = first
+			}
+			w.Header().Set("X-Goog-Generation", fmt.Sprint(current))
+			w.Header().Set("ETag", `"same"`)
+			http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(content))
+		case "/bucket/gz":
+			w.Header().Set("X-Goog-Stored-Content-Encoding", "gzip")
+			if !always && strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+				w.Header().Set("Content-Encoding", "gzip")
+				http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(gz))
+				return
+			}
+			io.WriteString(w, "unzipped\n")
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	t.Setenv("STORAGE_EMULATOR_HOST", srv.URL)
+	t.Setenv("GOOGLE_OAUTH_ACCESS_TOKEN", "token")
+	return first, gz
+}
+
+func TestGCSGenerationPinning(t *testing.T) {
+	first, _ := testGCS(t, false)
+	r, out, _ := testRun(t, func() { BatchSizeInMB = 1 })
+	t.Cleanup(func() { BatchSizeInMB = 16 })
+	runEntries(t, r, "gs://bucket/obj")
+	if !bytes.Equal(out.Bytes(), first) {
+		t.Errorf("got %v bytes, %q...; want all of the first generation", out.Len(), out.Bytes()[len(out.Bytes())-12:])
+	}
+}
+
+func TestGCSGenerationScope(t *testing.T) {
+	testGCS(t, false)
+	client := &http.Client{Transport: newObjectStoreTransport(http.DefaultTransport)}
+	read := func(ctx context.Context) string {
+		t.Helper()
+		head, err := http.NewRequestWithContext(ctx, "HEAD", "gs://bucket/obj", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(head)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		get, _ := http.NewRequestWithContext(ctx, "GET", "gs://bucket/obj", nil)
+		get.Header.Set("Range", "bytes=0-5")
+		if resp, err = client.Do(get); err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b)
+	}
+
+	// The first read overwrites the object.
+	first := withGenerationPins(context.Background())
+	if got := read(first); got != "first " {
+		t.Errorf("first download read %q, want the first generation", got)
+	}
+	if got := read(withGenerationPins(context.Background())); got != "other " {
+		t.Errorf("a later download read %q, want the generation that replaced it", got)
+	}
+	if got := read(first); got != "first " {
+		t.Errorf("the first download read %q on, want the generation it pinned", got)
+	}
+}
+
+func TestGCSTranscoding(t *testing.T) {
+	_, gz := testGCS(t, false)
+	r, out, _ := testRun(t, func() {})
+	runEntries(t, r, "gs://bucket/gz")
+	if !bytes.Equal(out.Bytes(), gz) {
+		t.Errorf("got %q, want the stored gzip bytes", out.Bytes())
+	}
+
+	testGCS(t, true)
+	r, out, _ = testRun(t, func() { SkipFailed = true })
+	runEntries(t, r, "gs://bucket/gz")
+	if out.Len() > 0 || len(r.failures) != 1 || !strings.Contains(r.failures[0], "GCS decompressed the gzip object") {
+		t.Errorf("wrote %q, failures %q; want the transcoded answer refused", out.Bytes(), r.failures)
+	}
+}
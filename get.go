@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+// getState is what the partial file of gocat get was begun on, kept next
+// to it so a later run only resumes it for the same object.
+type getState struct {
+	URL          string `json:"url"`
+	Size         int64  `json:"size"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// runGet is gocat get: it downloads one URL to a file, like aria2 or axel,
+// with -p chunks in flight at once spread across the URL and its -mirror
+// copies, -hedge and -speed-limit for the stalled ones, and a partial file
+// that the next run resumes from after an interruption.
+func runGet(args []string) {
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	registerFlags(fs)
+	out := fs.String("o", "", "file to write, replaced once it is complete")
+	fs.BoolVar(&Direct, "direct", false,
+		"connect to the servers directly, ignoring -proxy, -proxy-pac, -proxy-rules and the environment's proxies")
+	parseFlags(fs, args)
+
+	if *out == "" || fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: gocat get [options] [-direct] [-mirror <url>]... -o <output> <url>")
+		os.Exit(1)
+	}
+	if err := setup(); err != nil {
+		log.Fatal(err)
+	}
+	url := fs.Arg(0)
+	// Here -mirror names other URLs of the file itself rather than other
+	// locations of a list's directory.
+	dl.Mirrors = nil
+	dl.AddMirrors(url, Mirrors...)
+
+	ctx := interruptContext()
+	if err := getFile(ctx, url, *out); err != nil {
+		prog.stop()
+		printRetryReport()
+		fatal(ctx, err)
+	}
+	prog.stop()
+	printRetryReport()
+	fmt.Fprintln(os.Stderr, "COMPLETED!")
+}
+
+// getFile downloads url to out through a partial file beside it, which it
+// resumes when it was begun on the same object. The whole file is checked
+// against the size and digests known for url before it is put in place.
+func getFile(ctx context.Context, url, out string) error {
+	info, err := dl.Stat(ctx, url)
+	if err != nil {
+		return err
+	}
+	if err := checkListedSize(url, info.Size); err != nil {
+		return err
+	}
+
+	part := filepath.Join(filepath.Dir(out), partName(filepath.Base(out), "get"))
+	statePath := part + ".json"
+	want := getState{URL: url, Size: info.Size, ETag: info.ETag, LastModified: info.LastModified}
+	var saved getState
+	b, err := os.ReadFile(statePath)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(b, &saved); err != nil {
+			return fmt.Errorf("%s: %w", statePath, err)
+		}
+	}
+	same := saved == want
+	if !same {
+		if err := saveGetState(statePath, want); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// The partial file is only good for the object it was begun on, and
+	// DownloadRange leaves nothing but the first bytes of what it was
+	// asked for, however it ended.
+	start := int64(0)
+	if fi, err := f.Stat(); err == nil && same && info.Ranges && info.Size >= 0 {
+		start = min(fi.Size(), info.Size)
+	}
+	if err := f.Truncate(start); err != nil {
+		return err
+	}
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	if start > 0 {
+		infof("resuming %s at byte %v", url, start)
+	}
+
+	prog.setTotal(1, []int64{info.Size})
+	pe := prog.begin(0, url, info.Size, start)
+	w := pe.writer(f)
+	var written int64
+	if info.Ranges && info.Size >= 0 {
+		written, err = dl.DownloadFrom(ctx, url, info.Size, start, w)
+	} else {
+		written, err = dl.DownloadStream(ctx, url, info, 0, w)
+	}
+	written += start
+	if err == nil && info.Size >= 0 && written != info.Size {
+		err = fmt.Errorf("%s: expected %v bytes, wrote %v", url, info.Size, written)
+	}
+	pe.end(written, err)
+	if err != nil {
+		if info.Ranges && info.Size >= 0 {
+			infof("kept %v bytes of %s in %s; run again to resume", written, url, part)
+		}
+		return err
+	}
+	if err := checkFile(url, info, written, f); err != nil {
+		// Resuming would only keep what is wrong with it.
+		f.Close()
+		os.Remove(part)
+		os.Remove(statePath)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(part, out); err != nil {
+		return err
+	}
+	return os.Remove(statePath)
+}
+
+// checkFile checks the size bytes of f, which url was downloaded to,
+// against the size= of its list, when the server did not say, and against
+// every digest known for it.
+func checkFile(url string, info downloader.Info, size int64, f *os.File) error {
+	if info.Size < 0 {
+		if err := checkListedSize(url, size); err != nil {
+			return err
+		}
+	}
+	v := newVerifier(url, info)
+	if v == nil {
+		return nil
+	}
+	if _, err := io.Copy(v, io.NewSectionReader(f, 0, size)); err != nil {
+		return err
+	}
+	return v.verify()
+}
+
+// saveGetState replaces the state at path with s.
+func saveGetState(path string, s getState) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingWriter counts the bytes of the responses of a test server.
+type countingWriter struct {
+	http.ResponseWriter
+	n *atomic.Int64
+}
+
+func (w countingWriter) Write(b []byte) (int, error) {
+	w.n.Add(int64(len(b)))
+	return w.ResponseWriter.Write(b)
+}
+
+func TestGetResume(t *testing.T) {
+	testRun(t, func() {
+		Parallel = 4
+		BatchSizeInMB = 1
+		SmallSize = 0
+	})
+	// Registering the flags does not reset -small-size.
+	t.Cleanup(func() { SmallSize = 1 << 20 })
+	content := bytes.Repeat([]byte("0123456789abcdef"), 3<<16)
+	var etag atomic.Value
+	etag.Store(`"v1"`)
+	var served atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("ETag", etag.Load().(string))
+		http.ServeContent(countingWriter{w, &served}, req, "", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(srv.Close)
+	url := srv.URL + "/f"
+
+	// What an interrupted run left behind.
+	out := filepath.Join(t.TempDir(), "f")
+	part := filepath.Join(filepath.Dir(out), partName("f", "get"))
+	const kept = 1<<20 + 123
+	if err := os.WriteFile(part, content[:kept], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveGetState(part+".json", getState{URL: url, Size: int64(len(content)), ETag: `"v1"`}); err != nil {
+		t.Fatal(err)
+	}
+	if err := getFile(context.Background(), url, out); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(out); !bytes.Equal(got, content) {
+		t.Errorf("got %v bytes, not the content", len(got))
+	}
+	if n := served.Load(); n != int64(len(content))-kept {
+		t.Errorf("served %v bytes, want the %v after the partial file", n, int64(len(content))-kept)
+	}
+	for _, leftover := range []string{part, part + ".json"} {
+		if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+			t.Errorf("%s is left: %v", leftover, err)
+		}
+	}
+
+	// A partial file of an object since changed is begun again.
+	etag.Store(`"v2"`)
+	if err := os.WriteFile(part, bytes.Repeat([]byte("x"), kept), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveGetState(part+".json", getState{URL: url, Size: int64(len(content)), ETag: `"v1"`}); err != nil {
+		t.Fatal(err)
+	}
+	served.Store(0)
+	if err := getFile(context.Background(), url, out); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(out); !bytes.Equal(got, content) {
+		t.Errorf("got %v bytes, not the content", len(got))
+	}
+	if n := served.Load(); n != int64(len(content)) {
+		t.Errorf("served %v bytes, want all %v", n, len(content))
+	}
+}
@@ -1,3 +1,5 @@
 module github.com/msmania/gocat
 
 go 1.22.0
+
+require github.com/klauspost/compress v1.17.11
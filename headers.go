@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	Headers    stringList
+	BasicAuth  string
+	Bearer     string
+	CookieFile string
+)
+
+func headerSignerEnabled() bool {
+	return len(Headers) > 0 || BasicAuth != "" || Bearer != ""
+}
+
+type header struct {
+	name  string
+	value string
+}
+
+// headerSigner sets the -H headers and -u or -bearer credentials on every
+// request: the list, each HEAD and every range GET.
+type headerSigner struct {
+	headers []header
+	auth    string
+}
+
+func newHeaderSigner(headers []string, basic, bearer string) (*headerSigner, error) {
+	s := &headerSigner{}
+	for _, h := range headers {
+		name, value, ok := strings.Cut(h, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid -H %q, want \"Name: value\"", h)
+		}
+		s.headers = append(s.headers, header{name: http.CanonicalHeaderKey(name), value: strings.TrimSpace(value)})
+	}
+
+	if basic != "" && bearer != "" {
+		return nil, fmt.Errorf("-u and -bearer are mutually exclusive")
+	}
+	if basic != "" {
+		if !strings.Contains(basic, ":") {
+			return nil, fmt.Errorf("invalid -u %q, want user:password", basic)
+		}
+		s.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(basic))
+	}
+	if bearer != "" {
+		if strings.HasPrefix(bearer, "@") {
+			b, err := os.ReadFile(bearer[1:])
+			if err != nil {
+				return nil, err
+			}
+			bearer = strings.TrimSpace(string(b))
+		}
+		s.auth = "Bearer " + bearer
+	}
+	return s, nil
+}
+
+func (s *headerSigner) Sign(req *http.Request) error {
+	if s.auth != "" {
+		req.Header.Set("Authorization", s.auth)
+	}
+	for _, h := range s.headers {
+		switch {
+		case h.name == "Host":
+			req.Host = h.value
+		case h.value == "" && h.name == "User-Agent":
+			// An empty value, unlike none, stops Go sending its own.
+			req.Header.Set(h.name, "")
+		case h.value == "":
+			// As with curl, "Name:" removes a header.
+			req.Header.Del(h.name)
+		default:
+			req.Header.Set(h.name, h.value)
+		}
+	}
+	return nil
+}
+
+// entrySigner sets the header= fields of the list line of each request's
+// URL, over the -H ones.
+type entrySigner struct{}
+
+func (entrySigner) Sign(req *http.Request) error {
+	for name, values := range dl.EntryHeader(req.URL.String()) {
+		req.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	return nil
+}
+
+// loadCookieJar seeds a cookie jar from a Netscape cookies.txt file, as
+// written by curl, wget and browser extensions. Cookies servers set during
+// the run are kept in the jar too, but not written back.
+func loadCookieJar(path string) (*cookiejar.Jar, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		httpOnly := strings.HasPrefix(line, "#HttpOnly_")
+		line = strings.TrimPrefix(line, "#HttpOnly_")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("%s:%v: want 7 tab-separated fields", path, lineNo)
+		}
+		domain, subdomains, cpath, secure := fields[0], fields[1] == "TRUE", fields[2], fields[3] == "TRUE"
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%v: invalid expiry %q", path, lineNo, fields[4])
+		}
+
+		host := strings.TrimPrefix(domain, ".")
+		cookie := &http.Cookie{
+			Name:     fields[5],
+			Value:    fields[6],
+			Path:     cpath,
+			Secure:   secure,
+			HttpOnly: httpOnly,
+		}
+		if subdomains {
+			cookie.Domain = host
+		}
+		if expires > 0 {
+			cookie.Expires = time.Unix(expires, 0)
+		}
+		scheme := "http"
+		if secure {
+			scheme = "https"
+		}
+		jar.SetCookies(&url.URL{Scheme: scheme, Host: host, Path: cpath}, []*http.Cookie{cookie})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return jar, nil
+}
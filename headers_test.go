@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHeaderFlags(t *testing.T) {
+	var mu sync.Mutex
+	var seen []http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		seen = append(seen, req.Header.Clone())
+		mu.Unlock()
+		http.ServeContent(w, req, "", time.Time{}, strings.NewReader("private\n"))
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { Headers = nil })
+
+	dir := t.TempDir()
+	token := filepath.Join(dir, "token")
+	cookies := filepath.Join(dir, "cookies.txt")
+	os.WriteFile(token, []byte("from-file\n"), 0600)
+	os.WriteFile(cookies, []byte("# Netscape HTTP Cookie File\n127.0.0.1\tFALSE\t/\tFALSE\t0\tsession\tc1\n"), 0600)
+
+	for _, tc := range []struct {
+		name      string
+		configure func()
+		want      map[string]string
+	}{
+		{"-H and -bearer", func() {
+			Headers, Bearer = stringList{"x-token: abc", "User-Agent:"}, "@"+token
+		}, map[string]string{"X-Token": "abc", "User-Agent": "", "Authorization": "Bearer from-file"}},
+		{"-u", func() { BasicAuth = "user:pass" }, map[string]string{"Authorization": "Basic dXNlcjpwYXNz"}},
+		{"-cookie-file", func() { CookieFile = cookies }, map[string]string{"Cookie": "session=c1"}},
+	} {
+		mu.Lock()
+		seen = nil
+		mu.Unlock()
+		r, out, _ := testRun(t, func() {
+			Headers = nil
+			tc.configure()
+		})
+		runEntries(t, r, srv.URL+"/f")
+		if out.String() != "private\n" {
+			t.Errorf("%s: output %q", tc.name, out)
+		}
+		mu.Lock()
+		if len(seen) == 0 {
+			t.Errorf("%s: no requests", tc.name)
+		}
+		// Every request carries them, the HEAD as well as the GET.
+		for _, h := range seen {
+			for name, want := range tc.want {
+				if got, ok := h[name]; !ok && want != "" || ok && strings.Join(got, ",") != want {
+					t.Errorf("%s: %s is %q, want %q", tc.name, name, got, want)
+				}
+			}
+		}
+		mu.Unlock()
+	}
+
+	for _, tc := range []struct {
+		headers       []string
+		basic, bearer string
+		wantErr       string
+	}{
+		{[]string{"X-Token abc"}, "", "", "invalid -H"},
+		{nil, "user", "", "invalid -u"},
+		{nil, "user:pass", "token", "mutually exclusive"},
+	} {
+		if _, err := newHeaderSigner(tc.headers, tc.basic, tc.bearer); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("newHeaderSigner(%q, %q, %q): got %v, want %q", tc.headers, tc.basic, tc.bearer, err, tc.wantErr)
+		}
+	}
+}
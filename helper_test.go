@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"slices"
+	"testing"
+)
+
+// helperEnv makes the test binary, run as a child, stand in for a program
+// gocat drives instead of running the tests.
+const helperEnv = "GOCAT_TEST_HELPER"
+
+func TestMain(m *testing.M) {
+	switch os.Getenv(helperEnv) {
+	case "ssh":
+		os.Exit(fakeSSH(os.Args[1:]))
+	case "sftp":
+		os.Exit(fakeSFTP(os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
+// helperCommand is a command running the test binary as helper.
+func helperCommand(t *testing.T, helper string) string {
+	t.Helper()
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(helperEnv, helper)
+	return exe
+}
+
+// fakeSSH is ssh as far as -via uses it: "-O check" finds a master, and
+// "-W host:port" bridges stdio to host:port, dialled directly.
+func fakeSSH(args []string) int {
+	if i := slices.Index(args, "-O"); i >= 0 {
+		return 0
+	}
+	i := slices.Index(args, "-W")
+	if i < 0 || i+1 >= len(args) {
+		return 255
+	}
+	conn, err := net.Dial("tcp", args[i+1])
+	if err != nil {
+		return 255
+	}
+	go func() {
+		io.Copy(conn, os.Stdin)
+		conn.(*net.TCPConn).CloseWrite()
+	}()
+	io.Copy(os.Stdout, conn)
+	return 0
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+var (
+	History   bool
+	HistoryDB string
+)
+
+// historyRecord is one completed download. Records are appended as JSON
+// lines, so several machines sharing a home directory can write to the
+// same file without coordinating.
+type historyRecord struct {
+	Time         time.Time `json:"time"`
+	Machine      string    `json:"machine,omitempty"`
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Size         int64     `json:"size"`
+	SHA256       string    `json:"sha256"`
+}
+
+func historyPath() (string, error) {
+	if HistoryDB != "" {
+		return HistoryDB, nil
+	}
+	return dataPath("history.jsonl")
+}
+
+// dataPath returns where gocat keeps the state file name between runs:
+// $XDG_DATA_HOME/gocat, or ~/.local/share/gocat.
+func dataPath(name string) (string, error) {
+	dir := os.Getenv("XDG_DATA_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(dir, "gocat", name), nil
+}
+
+func historyEnabled() bool {
+	return History || HistoryDB != ""
+}
+
+func appendHistory(url string, info downloader.Info, sha256 string) error {
+	path, err := historyPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	machine, _ := os.Hostname()
+	line, err := json.Marshal(historyRecord{
+		Time:         time.Now().UTC(),
+		Machine:      machine,
+		URL:          url,
+		ETag:         info.ETag,
+		LastModified: info.LastModified,
+		Size:         info.Size,
+		SHA256:       sha256,
+	})
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	// A single write of a whole line keeps concurrent appenders from
+	// interleaving records.
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readHistory() ([]historyRecord, error) {
+	path, err := historyPath()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records := []historyRecord{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var r historyRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			// A torn last line from an interrupted writer is not fatal.
+			continue
+		}
+		records = append(records, r)
+	}
+	return records, scanner.Err()
+}
+
+// sameObject reports whether r was recorded for the object version info
+// describes. Without any validator there is no way to tell, so the answer
+// is no.
+func (r historyRecord) sameObject(url string, info downloader.Info) bool {
+	if r.URL != url || r.Size != info.Size {
+		return false
+	}
+	if info.ETag != "" {
+		return r.ETag == info.ETag
+	}
+	if info.LastModified != "" {
+		return r.LastModified == info.LastModified
+	}
+	return false
+}
+
+func runHistory(args []string) {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	registerFlags(fs)
+	check := fs.Bool("check", false,
+		"check whether the current version of each URL was already downloaded")
+	parseFlags(fs, args)
+
+	if err := setup(); err != nil {
+		log.Fatal(err)
+	}
+
+	records, err := readHistory()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if !*check {
+		filter := map[string]bool{}
+		for _, u := range fs.Args() {
+			filter[u] = true
+		}
+		for _, r := range records {
+			if len(filter) > 0 && !filter[r.URL] {
+				continue
+			}
+			fmt.Printf(
+				"%v\t%v\t%v\t%v\t%s\n",
+				r.Time.Format(time.RFC3339),
+				r.Machine,
+				r.Size,
+				r.SHA256,
+				r.URL,
+			)
+		}
+		return
+	}
+
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: gocat history -check <url>...")
+		os.Exit(1)
+	}
+
+	ctx := interruptContext()
+	unseen := 0
+	for _, u := range fs.Args() {
+		info, err := checkHeaders(ctx, u)
+		if err != nil {
+			fatal(ctx, err)
+		}
+
+		var match *historyRecord
+		for i := len(records) - 1; i >= 0; i-- {
+			if records[i].sameObject(u, info) {
+				match = &records[i]
+				break
+			}
+		}
+		if match == nil {
+			fmt.Printf("new\t%s\n", u)
+			unseen++
+			continue
+		}
+		fmt.Printf("seen\t%s\t%v\t%v\n", u, match.SHA256, match.Time.Format(time.RFC3339))
+	}
+	if unseen > 0 {
+		os.Exit(1)
+	}
+}
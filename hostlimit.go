@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hostLimiter keeps at most max requests in flight to each host, a request
+// holding its turn until its body is closed, and starts the requests to a
+// host at least interval apart. Requests to other hosts do not wait at all,
+// so chunks, mirrors and -j entries go on with the hosts that have room
+// while the busy ones are throttled.
+type hostLimiter struct {
+	base     http.RoundTripper
+	max      int
+	interval time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*hostTurns
+}
+
+type hostTurns struct {
+	// slots holds a token per request in flight; it is nil without a max.
+	slots chan struct{}
+	// next is the earliest the next request may start.
+	next time.Time
+}
+
+func newHostLimiter(base http.RoundTripper, max int, interval time.Duration) *hostLimiter {
+	return &hostLimiter{base: base, max: max, interval: interval, hosts: map[string]*hostTurns{}}
+}
+
+func (l *hostLimiter) turns(host string) *hostTurns {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h := l.hosts[host]
+	if h == nil {
+		h = &hostTurns{}
+		if l.max > 0 {
+			h.slots = make(chan struct{}, l.max)
+		}
+		l.hosts[host] = h
+	}
+	return h
+}
+
+func (l *hostLimiter) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	h := l.turns(strings.ToLower(req.URL.Hostname()))
+	release := func() {}
+	if h.slots != nil {
+		select {
+		case h.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		release = func() { <-h.slots }
+	}
+
+	if l.interval > 0 {
+		l.mu.Lock()
+		at := time.Now()
+		if h.next.After(at) {
+			at = h.next
+		}
+		h.next = at.Add(l.interval)
+		l.mu.Unlock()
+		if wait := time.Until(at); wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				release()
+				return nil, ctx.Err()
+			}
+		}
+	}
+
+	resp, err := l.base.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// releasingBody gives its request's turn back when closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+var (
+	HTTPSOnly    bool
+	HTTPSUpgrade bool
+	HSTS         bool
+	HSTSFile     string
+)
+
+func hstsEnabled() bool {
+	return HSTS || HSTSFile != ""
+}
+
+func schemeGuardEnabled() bool {
+	return HTTPSOnly || HTTPSUpgrade || hstsEnabled()
+}
+
+type hstsEntry struct {
+	Expires           time.Time `json:"expires"`
+	IncludeSubdomains bool      `json:"include_subdomains,omitempty"`
+}
+
+// hstsCache remembers Strict-Transport-Security policies across runs, as
+// browsers do. Like the quota file, it is re-read before every update and
+// replaced atomically.
+type hstsCache struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]hstsEntry
+}
+
+func openHSTS() (*hstsCache, error) {
+	path := HSTSFile
+	if path == "" {
+		var err error
+		if path, err = dataPath("hsts.json"); err != nil {
+			return nil, err
+		}
+	}
+	c := &hstsCache{path: path}
+	entries, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	c.entries = entries
+	return c, nil
+}
+
+func (c *hstsCache) load() (map[string]hstsEntry, error) {
+	entries := map[string]hstsEntry{}
+	b, err := os.ReadFile(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, fmt.Errorf("%v: %w", c.path, err)
+	}
+	return entries, nil
+}
+
+// known reports whether host, or a parent domain with includeSubDomains,
+// has an unexpired policy.
+func (c *hstsCache) known(host string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for d := host; ; {
+		if e, ok := c.entries[d]; ok && now.Before(e.Expires) && (d == host || e.IncludeSubdomains) {
+			return true
+		}
+		_, parent, ok := strings.Cut(d, ".")
+		if !ok {
+			return false
+		}
+		d = parent
+	}
+}
+
+// observe records the policy in a Strict-Transport-Security header
+// received over HTTPS from host.
+func (c *hstsCache) observe(host, header string) error {
+	maxAge := int64(-1)
+	sub := false
+	for _, directive := range strings.Split(header, ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "max-age":
+			n, err := strconv.ParseInt(strings.Trim(value, `"`), 10, 64)
+			if err != nil {
+				return nil
+			}
+			maxAge = n
+		case "includesubdomains":
+			sub = true
+		}
+	}
+	if maxAge < 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	old, had := c.entries[host]
+	e := hstsEntry{Expires: time.Now().Add(time.Duration(maxAge) * time.Second).UTC(), IncludeSubdomains: sub}
+	// Only write when the policy changes materially, not on every response.
+	if maxAge == 0 && !had ||
+		maxAge > 0 && had && old.IncludeSubdomains == sub && e.Expires.Sub(old.Expires).Abs() < time.Hour {
+		return nil
+	}
+
+	entries, err := c.load()
+	if err != nil {
+		return err
+	}
+	if maxAge == 0 {
+		delete(entries, host)
+	} else {
+		entries[host] = e
+	}
+	c.entries = entries
+
+	b, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// schemeGuard keeps requests off cleartext HTTP. It sits outermost, so it
+// also sees the requests of redirects and everything is signed for the
+// URL that is actually fetched.
+type schemeGuard struct {
+	base http.RoundTripper
+	hsts *hstsCache
+}
+
+func (t *schemeGuard) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Hostname()
+	if req.URL.Scheme == "http" {
+		switch {
+		case HTTPSUpgrade, t.hsts != nil && t.hsts.known(host):
+			upgraded := *req.URL
+			upgraded.Scheme = "https"
+			if port := upgraded.Port(); port == "80" {
+				upgraded.Host = host
+			}
+			req = req.Clone(req.Context())
+			req.URL = &upgraded
+		case HTTPSOnly:
+			return nil, &downloader.PermanentError{
+				Err: fmt.Errorf("refusing cleartext %s with -https-only", req.URL.Redacted()),
+			}
+		}
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || t.hsts == nil || req.URL.Scheme != "https" || net.ParseIP(host) != nil {
+		return resp, err
+	}
+	if sts := resp.Header.Get("Strict-Transport-Security"); sts != "" {
+		if err := t.hsts.observe(host, sts); err != nil {
+			warnf("recording HSTS policy of %v: %v", host, err.Error())
+		}
+	}
+	return resp, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+// roundTripFunc answers requests without a network.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestHSTSCache(t *testing.T) {
+	HSTSFile = filepath.Join(t.TempDir(), "hsts.json")
+	t.Cleanup(func() { HSTSFile = "" })
+
+	c, err := openHSTS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sts := range []string{"max-age=3600; includeSubDomains", "max-age=bad"} {
+		if err := c.observe("example.com", sts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.observe("plain.org", `max-age="600"`); err != nil {
+		t.Fatal(err)
+	}
+
+	// The policies outlive the run.
+	c, err = openHSTS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, want := range map[string]bool{
+		"example.com":     true,
+		"cdn.example.com": true,
+		"example.org":     false,
+		"plain.org":       true,
+		"www.plain.org":   false,
+	} {
+		if got := c.known(host); got != want {
+			t.Errorf("known(%v) = %v, want %v", host, got, want)
+		}
+	}
+
+	// max-age=0 takes a policy back.
+	if err := c.observe("plain.org", "max-age=0"); err != nil {
+		t.Fatal(err)
+	}
+	if c, err = openHSTS(); err != nil {
+		t.Fatal(err)
+	}
+	if c.known("plain.org") {
+		t.Error("plain.org is still known after max-age=0")
+	}
+}
+
+func TestSchemeGuard(t *testing.T) {
+	HSTSFile = filepath.Join(t.TempDir(), "hsts.json")
+	t.Cleanup(func() {
+		HSTSFile = ""
+		HTTPSOnly, HTTPSUpgrade = false, false
+	})
+	c, err := openHSTS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetched []string
+	g := &schemeGuard{hsts: c, base: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		fetched = append(fetched, req.URL.String())
+		resp := &http.Response{StatusCode: 200, Header: http.Header{}, Request: req}
+		resp.Header.Set("Strict-Transport-Security", "max-age=3600")
+		return resp, nil
+	})}
+	get := func(url string) error {
+		req, _ := http.NewRequest("GET", url, nil)
+		_, err := g.RoundTrip(req)
+		return err
+	}
+
+	// Cleartext goes through until the host sends a policy over HTTPS,
+	// which is not kept for an IP address.
+	for _, url := range []string{"http://example.com/a", "https://example.com/a", "http://example.com:80/b", "https://127.0.0.1/c", "http://127.0.0.1/c"} {
+		if err := get(url); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"http://example.com/a", "https://example.com/a", "https://example.com/b", "https://127.0.0.1/c", "http://127.0.0.1/c"}
+	if len(fetched) != len(want) {
+		t.Fatalf("fetched %v, want %v", fetched, want)
+	}
+	for i := range want {
+		if fetched[i] != want[i] {
+			t.Errorf("fetched %v, want %v", fetched[i], want[i])
+		}
+	}
+
+	// -https-only refuses the cleartext HSTS does not upgrade.
+	HTTPSOnly = true
+	err = get("http://example.org/")
+	var perm *downloader.PermanentError
+	if !errors.As(err, &perm) {
+		t.Errorf("got %v, want a PermanentError", err)
+	}
+	if err := get("http://example.com/"); err != nil {
+		t.Errorf("an HSTS host was refused: %v", err)
+	}
+
+	// -https-upgrade upgrades them all.
+	HTTPSOnly, HTTPSUpgrade = false, true
+	fetched = nil
+	if err := get("http://example.org:8080/"); err != nil || len(fetched) != 1 || fetched[0] != "https://example.org:8080/" {
+		t.Errorf("fetched %v: %v", fetched, err)
+	}
+}
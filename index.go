@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+// indexSuffix is what gocat verify appends to the output to find its
+// index when none is named.
+const indexSuffix = ".gocat"
+
+// indexPieceSize is how much of an entry each piece hash covers, so that
+// gocat verify can tell which part of a bad entry is bad.
+const indexPieceSize = 4 << 20
+
+var IndexFile string
+
+var outputIndex *indexWriter
+
+// An index records where each entry of a run landed in the concatenated
+// output, with hashes of its bytes, for gocat verify to check the output
+// against later.
+type index struct {
+	Version   int          `json:"version"`
+	Created   time.Time    `json:"created"`
+	Source    string       `json:"source"`
+	PieceSize int64        `json:"piece_size"`
+	Entries   []indexEntry `json:"entries"`
+	Length    int64        `json:"length"`
+	// Shard is set on the index of one shard of a -shard-count run, whose
+	// offsets are in that shard's output, for gocat merge-index to
+	// assemble with the others.
+	Shard *indexShard `json:"shard,omitempty"`
+}
+
+type indexShard struct {
+	Index int `json:"index"`
+	Count int `json:"count"`
+}
+
+type indexEntry struct {
+	URL    string   `json:"url"`
+	Offset int64    `json:"offset"`
+	Length int64    `json:"length"`
+	SHA256 string   `json:"sha256"`
+	Pieces []string `json:"pieces"`
+	// Missing marks an entry that failed and was zero-filled with
+	// -zero-fill-failed, without hashes, until gocat verify -repair
+	// fetches it.
+	Missing bool `json:"missing,omitempty"`
+}
+
+// indexWriter collects the entries of a run as they finish.
+type indexWriter struct {
+	path, source string
+	shard        *indexShard
+
+	mu      sync.Mutex
+	entries []indexEntry
+}
+
+func newIndexWriter(path, source string) *indexWriter {
+	return &indexWriter{path: path, source: source}
+}
+
+func (w *indexWriter) add(e indexEntry) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.entries = append(w.entries, e)
+}
+
+// save writes the index, entries in output order, over any earlier one.
+func (w *indexWriter) save() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	entries := slices.Clone(w.entries)
+	slices.SortFunc(entries, func(a, b indexEntry) int {
+		return int(min(max(a.Offset-b.Offset, -1), 1))
+	})
+	ix := index{
+		Version:   1,
+		Created:   time.Now().UTC(),
+		Source:    w.source,
+		PieceSize: indexPieceSize,
+		Entries:   entries,
+		Shard:     w.shard,
+	}
+	if n := len(entries); n > 0 {
+		ix.Length = entries[n-1].Offset + entries[n-1].Length
+	}
+	return ix.save(w.path)
+}
+
+// save writes ix to path, over any earlier index.
+func (ix *index) save(path string) error {
+	b, err := json.MarshalIndent(ix, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// pieceHasher hashes what is written to it whole and in pieces of size.
+type pieceHasher struct {
+	size   int64
+	whole  hash.Hash
+	piece  hash.Hash
+	n      int64
+	pieces []string
+}
+
+func newPieceHasher(size int64) *pieceHasher {
+	return &pieceHasher{size: size, whole: sha256.New(), piece: sha256.New()}
+}
+
+func (h *pieceHasher) Write(p []byte) (int, error) {
+	written := len(p)
+	h.whole.Write(p)
+	for len(p) > 0 {
+		k := min(int64(len(p)), h.size-h.n%h.size)
+		h.piece.Write(p[:k])
+		h.n += k
+		p = p[k:]
+		if h.n%h.size == 0 {
+			h.pieces = append(h.pieces, hex.EncodeToString(h.piece.Sum(nil)))
+			h.piece.Reset()
+		}
+	}
+	return written, nil
+}
+
+// entry returns the index entry for url at offset of the output.
+func (h *pieceHasher) entry(url string, offset int64) indexEntry {
+	pieces := h.pieces
+	if h.n%h.size != 0 || h.n == 0 {
+		pieces = append(pieces, hex.EncodeToString(h.piece.Sum(nil)))
+	}
+	return indexEntry{
+		URL:    url,
+		Offset: offset,
+		Length: h.n,
+		SHA256: hex.EncodeToString(h.whole.Sum(nil)),
+		Pieces: pieces,
+	}
+}
+
+func readIndex(path string) (*index, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ix index
+	if err := json.Unmarshal(b, &ix); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if ix.Version != 1 {
+		return nil, fmt.Errorf("%s: unsupported index version %v", path, ix.Version)
+	}
+	if ix.PieceSize <= 0 {
+		return nil, fmt.Errorf("%s: invalid piece_size %v", path, ix.PieceSize)
+	}
+	return &ix, nil
+}
+
+// mergeIndexes assembles the indexes of every shard of a -shard-count run
+// into the index of their outputs concatenated in shard order, which is
+// the output of the run unsharded.
+func mergeIndexes(ixs []*index) (*index, error) {
+	if len(ixs) == 0 {
+		return nil, errors.New("no indexes to merge")
+	}
+	shards := slices.Clone(ixs)
+	for _, ix := range shards {
+		if ix.Shard == nil {
+			return nil, fmt.Errorf("an index of %s is not of a shard", ix.Source)
+		}
+	}
+	slices.SortFunc(shards, func(a, b *index) int { return a.Shard.Index - b.Shard.Index })
+	count := shards[0].Shard.Count
+	if len(shards) != count {
+		return nil, fmt.Errorf("%v indexes for %v shards", len(shards), count)
+	}
+
+	merged := &index{
+		Version:   1,
+		Created:   time.Now().UTC(),
+		Source:    shards[0].Source,
+		PieceSize: shards[0].PieceSize,
+	}
+	for i, ix := range shards {
+		switch {
+		case ix.Shard.Count != count:
+			return nil, fmt.Errorf("shard %v is one of %v, not of %v", ix.Shard.Index, ix.Shard.Count, count)
+		case ix.Shard.Index != i:
+			return nil, fmt.Errorf("no index for shard %v", i)
+		case ix.PieceSize != merged.PieceSize:
+			return nil, fmt.Errorf("shard %v has pieces of %v bytes, not %v", i, ix.PieceSize, merged.PieceSize)
+		}
+		for _, e := range ix.Entries {
+			e.Offset += merged.Length
+			merged.Entries = append(merged.Entries, e)
+		}
+		merged.Length += ix.Length
+	}
+	return merged, nil
+}
+
+// runMergeIndex is gocat merge-index: it assembles the -index of each
+// shard of a run into one for gocat verify to check their outputs
+// concatenated in shard order against.
+func runMergeIndex(args []string) {
+	fs := flag.NewFlagSet("merge-index", flag.ExitOnError)
+	output := fs.String("o", "", "write the merged index to this file")
+	parseFlags(fs, args)
+	if *output == "" || fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: gocat merge-index -o <index> <shard index>...")
+		os.Exit(1)
+	}
+
+	var ixs []*index
+	for _, path := range fs.Args() {
+		ix, err := readIndex(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ixs = append(ixs, ix)
+	}
+	merged, err := mergeIndexes(ixs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := merged.save(*output); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "%v entries of %v shards, %v bytes\n", len(merged.Entries), len(ixs), merged.Length)
+}
+
+// runVerify checks an output against the -index written with it: that
+// every entry's bytes are where the index says, with the hashes it says,
+// and which pieces of a bad entry are bad. With -repair it re-fetches
+// just those pieces from the entry's URL, and the whole of each entry
+// -zero-fill-failed left missing, whose hashes it then adds to the index.
+func runVerify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	registerFlags(fs)
+	indexPath := fs.String("index", "", "index written with -index (default <output>"+indexSuffix+")")
+	repair := fs.Bool("repair", false,
+		"re-fetch the bad pieces of each bad entry, and each missing entry, from its URL and write them in place")
+	parseFlags(fs, args)
+
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: gocat verify [-index <index>] [-repair [options]] <output>")
+		os.Exit(1)
+	}
+	output := fs.Arg(0)
+	if *indexPath == "" {
+		*indexPath = output + indexSuffix
+	}
+
+	ix, err := readIndex(*indexPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FAILED: %v\n", err)
+		os.Exit(1)
+	}
+	mode := os.O_RDONLY
+	if *repair {
+		if err := setup(); err != nil {
+			log.Fatal(err)
+		}
+		mode = os.O_RDWR
+	}
+	ctx := interruptContext()
+	f, err := os.OpenFile(output, mode, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FAILED: %v\n", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	problems := 0
+	problem := func(format string, args ...any) {
+		fmt.Fprintf(os.Stderr, "FAILED: "+format+"\n", args...)
+		problems++
+	}
+	if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() && fi.Size() != ix.Length {
+		problem("%s is %v bytes, the index says %v", output, fi.Size(), ix.Length)
+	}
+
+	filled := 0
+	for i, e := range ix.Entries {
+		if e.Missing && !*repair {
+			problem("%s: missing, zero-filled at bytes [%v, %v) (-repair fetches it)", e.URL, e.Offset, e.Offset+e.Length)
+			continue
+		}
+		if e.Missing {
+			got, err := fillMissing(ctx, f, e, ix.PieceSize)
+			if err != nil {
+				problem("%s: fetching the missing bytes [%v, %v): %v", e.URL, e.Offset, e.Offset+e.Length, err)
+				continue
+			}
+			ix.Entries[i] = got
+			filled++
+			fmt.Fprintf(os.Stderr, "%s: fetched the %v missing bytes at %v\n", e.URL, e.Length, e.Offset)
+			continue
+		}
+		bad, err := verifyEntry(f, e, ix.PieceSize)
+		if *repair && err == nil && len(bad) > 0 {
+			n, rerr := repairEntry(ctx, f, e, ix.PieceSize, bad)
+			if rerr != nil {
+				problem("%s: repairing: %v", e.URL, rerr)
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "%s: repaired %v bytes in %v piece(s)\n", e.URL, n, len(bad))
+			bad, err = verifyEntry(f, e, ix.PieceSize)
+		}
+		switch {
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			problem("%s: %s ends before byte %v", e.URL, output, e.Offset+e.Length)
+		case err != nil:
+			problem("%s: %v", e.URL, err)
+		case len(bad) > 0:
+			problem("%s: the %v bytes at %v do not match the index", e.URL, e.Length, e.Offset)
+			for _, p := range bad {
+				from := e.Offset + p*ix.PieceSize
+				to := min(from+ix.PieceSize, e.Offset+e.Length)
+				fmt.Fprintf(os.Stderr, "  piece %v: bytes [%v, %v)\n", p, from, to)
+			}
+		}
+	}
+
+	if filled > 0 {
+		if err := ix.save(*indexPath); err != nil {
+			problem("recording the fetched entries in %s: %v", *indexPath, err)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "%v entries checked\n", len(ix.Entries))
+	if problems > 0 {
+		fmt.Fprintf(os.Stderr, "VERIFY FAILED: %v problem(s)\n", problems)
+		os.Exit(1)
+	}
+	fmt.Fprintln(os.Stderr, "COMPLETED!")
+}
+
+// verifyEntry returns the pieces of e that do not match their hashes, or
+// all of them when its whole hash does not match but the pieces do.
+func verifyEntry(f *os.File, e indexEntry, pieceSize int64) ([]int64, error) {
+	whole := sha256.New()
+	r := io.NewSectionReader(f, e.Offset, e.Length)
+	buf := make([]byte, 64<<10)
+	var bad []int64
+	for i := int64(0); i == 0 || i*pieceSize < e.Length; i++ {
+		piece := sha256.New()
+		n, err := io.CopyBuffer(io.MultiWriter(whole, piece), io.LimitReader(r, pieceSize), buf)
+		if err != nil {
+			return nil, err
+		}
+		if n < min(pieceSize, e.Length-i*pieceSize) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if i >= int64(len(e.Pieces)) || hex.EncodeToString(piece.Sum(nil)) != e.Pieces[i] {
+			bad = append(bad, i)
+		}
+	}
+	if len(bad) == 0 && hex.EncodeToString(whole.Sum(nil)) != e.SHA256 {
+		for i := range e.Pieces {
+			bad = append(bad, int64(i))
+		}
+	}
+	return bad, nil
+}
+
+// repairEntry re-fetches the bad pieces of e from its URL and writes them
+// over their place in f, once each matches its hash, rather than the whole
+// entry. It returns how many bytes it wrote.
+func repairEntry(ctx context.Context, f *os.File, e indexEntry, pieceSize int64, bad []int64) (int64, error) {
+	var written int64
+	for _, p := range bad {
+		from := p * pieceSize
+		to := min(from+pieceSize, e.Length)
+		if from >= to {
+			continue
+		}
+		data, err := dl.FetchRange(ctx, e.URL, downloader.ClosedRange(from, to-1))
+		if err != nil {
+			return written, err
+		}
+		sum := sha256.Sum256(data)
+		if p >= int64(len(e.Pieces)) || hex.EncodeToString(sum[:]) != e.Pieces[p] {
+			return written, fmt.Errorf("piece %v from the source does not match the index either", p)
+		}
+		if _, err := f.WriteAt(data, e.Offset+from); err != nil {
+			return written, err
+		}
+		written += int64(len(data))
+	}
+	return written, nil
+}
+
+// fillMissing fetches the whole of e, an entry -zero-fill-failed left
+// missing, into its place in f and returns it with the hashes of what
+// arrived. There is nothing to check those bytes against but their length,
+// so a source that is not the size of the gap is refused.
+func fillMissing(ctx context.Context, f *os.File, e indexEntry, pieceSize int64) (indexEntry, error) {
+	info, err := dl.Stat(ctx, e.URL)
+	if err != nil {
+		return e, err
+	}
+	if info.Size != e.Length {
+		return e, fmt.Errorf("the source has %v bytes, not the %v of the gap", info.Size, e.Length)
+	}
+	pieces := newPieceHasher(pieceSize)
+	w := fanOut(io.NewOffsetWriter(f, e.Offset), pieces)
+	var n int64
+	if info.Ranges {
+		n, err = dl.DownloadFrom(ctx, e.URL, info.Size, 0, w)
+	} else {
+		n, err = dl.DownloadStream(ctx, e.URL, info, 0, w)
+	}
+	if err != nil {
+		return e, err
+	}
+	if n != e.Length {
+		return e, fmt.Errorf("got %v bytes, not %v", n, e.Length)
+	}
+	return pieces.entry(e.URL, e.Offset), nil
+}
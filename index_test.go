@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRepairEntry(t *testing.T) {
+	content := []byte("0123456789abcdefghij")
+	const pieceSize = 8
+	var mu sync.Mutex
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, req.Header.Get("Range"))
+		mu.Unlock()
+		body := content
+		if req.URL.Path == "/changed" {
+			body = bytes.ToUpper(content)
+		}
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(body))
+	}))
+	t.Cleanup(srv.Close)
+	testRun(t, func() {})
+
+	entry := func(path string) indexEntry {
+		e := indexEntry{URL: srv.URL + path, Offset: 3, Length: int64(len(content))}
+		sum := sha256.Sum256(content)
+		e.SHA256 = hex.EncodeToString(sum[:])
+		for i := 0; i < len(content); i += pieceSize {
+			sum := sha256.Sum256(content[i:min(i+pieceSize, len(content))])
+			e.Pieces = append(e.Pieces, hex.EncodeToString(sum[:]))
+		}
+		return e
+	}
+	// The entry follows 3 bytes of another, and its second piece is bad.
+	output := func() *os.File {
+		path := filepath.Join(t.TempDir(), "out")
+		data := append([]byte("xyz"), content...)
+		data[3+10] = '!'
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Close() })
+		return f
+	}
+
+	f, e := output(), entry("/entry")
+	bad, err := verifyEntry(f, e, pieceSize)
+	if err != nil || !slices.Equal(bad, []int64{1}) {
+		t.Fatalf("verifyEntry: %v, %v; want piece 1 bad", bad, err)
+	}
+	n, err := repairEntry(context.Background(), f, e, pieceSize, bad)
+	if err != nil || n != pieceSize {
+		t.Fatalf("repairEntry: %v bytes, %v; want the %v of the piece", n, err, pieceSize)
+	}
+	if !slices.Equal(ranges, []string{"bytes=8-15"}) {
+		t.Errorf("requested %q, want only the bad piece", ranges)
+	}
+	if bad, err := verifyEntry(f, e, pieceSize); err != nil || len(bad) > 0 {
+		t.Errorf("after repair: %v, %v; want the entry good", bad, err)
+	}
+	if b, _ := os.ReadFile(f.Name()); string(b) != "xyz"+string(content) {
+		t.Errorf("output %q", b)
+	}
+
+	// A source that changed since leaves the output as it was.
+	f, e = output(), entry("/changed")
+	before, _ := os.ReadFile(f.Name())
+	if _, err := repairEntry(context.Background(), f, e, pieceSize, []int64{1}); err == nil ||
+		!strings.Contains(err.Error(), "does not match the index either") {
+		t.Errorf("repairing from a changed source: %v", err)
+	}
+	if b, _ := os.ReadFile(f.Name()); !bytes.Equal(b, before) {
+		t.Errorf("output %q, want it untouched", b)
+	}
+}
+
+func TestZeroFillFailed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.gocat")
+	r, out, base := testRun(t, func() {
+		SkipFailed, ZeroFillFailed = true, true
+		MaxRetry = 1
+		outputIndex = newIndexWriter(path, "list")
+	})
+	t.Cleanup(func() {
+		ZeroFillFailed = false
+		outputIndex = nil
+	})
+	runEntries(t, r, listEntries(t, base, "/a.txt\n/gone size=5\n/b.html\n")...)
+	if err := outputIndex.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := out.String(), "plain\n\x00\x00\x00\x00\x00<html>\n"; got != want {
+		t.Errorf("output %q, want %q", got, want)
+	}
+	if len(r.failures) != 1 {
+		t.Errorf("failures %q, want the missing entry", r.failures)
+	}
+	ix, err := readIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range ix.Entries {
+		got = append(got, fmt.Sprintf("%v %v+%v missing=%v", strings.TrimPrefix(e.URL, base), e.Offset, e.Length, e.Missing))
+	}
+	want := []string{"/a.txt 0+6 missing=false", "/gone 6+5 missing=true", "/b.html 11+7 missing=false"}
+	if !slices.Equal(got, want) {
+		t.Errorf("index entries %q, want %q", got, want)
+	}
+}
+
+func TestZeroFillCorrupt(t *testing.T) {
+	r, out, base := testRun(t, func() { SkipFailed, ZeroFillFailed = true, true })
+	t.Cleanup(func() { ZeroFillFailed = false })
+	file := listEntries(t, base, "/a.txt size=6\n")[0]
+
+	// Entry 1 failed verification while entry 0 still had the output, so
+	// its bytes can be taken back.
+	first, second := r.seq.slot(0), r.seq.slot(1)
+	second.Write([]byte("plain\n"))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.zeroFill(file, second, true)
+	}()
+	first.Write([]byte("first"))
+	first.close()
+	<-done
+	if got, want := out.String(), "first\x00\x00\x00\x00\x00\x00"; got != want {
+		t.Errorf("output %q, want %q", got, want)
+	}
+}
+
+func TestFillMissing(t *testing.T) {
+	_, _, base := testRun(t, func() {})
+	path := filepath.Join(t.TempDir(), "out")
+	if err := os.WriteFile(path, []byte("xyz\x00\x00\x00\x00\x00\x00end"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	e := indexEntry{URL: base + "/a.txt", Offset: 3, Length: 6, Missing: true}
+	got, err := fillMissing(context.Background(), f, e, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "xyzplain\nend" {
+		t.Errorf("output %q", b)
+	}
+	sum := sha256.Sum256([]byte("plain\n"))
+	if got.Missing || got.SHA256 != hex.EncodeToString(sum[:]) || len(got.Pieces) != 2 {
+		t.Errorf("entry %+v, want it hashed in 2 pieces", got)
+	}
+	if bad, err := verifyEntry(f, got, 4); err != nil || len(bad) > 0 {
+		t.Errorf("verifying the fetched entry: %v, %v", bad, err)
+	}
+
+	// A source of another size does not belong in the gap.
+	e.Length = 5
+	if _, err := fillMissing(context.Background(), f, e, 4); err == nil || !strings.Contains(err.Error(), "not the 5 of the gap") {
+		t.Errorf("filling a 5 byte gap with 6: %v", err)
+	}
+}
+
+func TestMergeIndexes(t *testing.T) {
+	dir := t.TempDir()
+	t.Cleanup(func() { outputIndex = nil })
+	var ixs []*index
+	var whole []byte
+	for i := range 2 {
+		path := filepath.Join(dir, fmt.Sprintf("out%v.gocat", i))
+		r, out, base := testRun(t, func() {
+			outputIndex = newIndexWriter(path, "list")
+			outputIndex.shard = &indexShard{Index: i, Count: 2}
+		})
+		list := []string{base + "/a.txt", base + "/b.html", base + "/a.txt"}
+		runEntries(t, r, shardEntries(list, i, 2)...)
+		if err := outputIndex.save(); err != nil {
+			t.Fatal(err)
+		}
+		ix, err := readIndex(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ixs = append(ixs, ix)
+		whole = append(whole, out.Bytes()...)
+	}
+
+	// Any order of the shards' indexes will do.
+	merged, err := mergeIndexes([]*index{ixs[1], ixs[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.Shard != nil || merged.Length != int64(len(whole)) || len(merged.Entries) != 3 {
+		t.Fatalf("merged %+v, want 3 entries in %v bytes", merged, len(whole))
+	}
+	output := filepath.Join(dir, "out")
+	if err := os.WriteFile(output, whole, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var offsets []int64
+	for _, e := range merged.Entries {
+		offsets = append(offsets, e.Offset)
+		if bad, err := verifyEntry(f, e, merged.PieceSize); err != nil || len(bad) > 0 {
+			t.Errorf("%s at %v: %v, %v", e.URL, e.Offset, bad, err)
+		}
+	}
+	if want := []int64{0, 6, 13}; !slices.Equal(offsets, want) {
+		t.Errorf("offsets %v, want %v", offsets, want)
+	}
+
+	for _, tc := range []struct {
+		ixs  []*index
+		want string
+	}{
+		{[]*index{ixs[0]}, "1 indexes for 2 shards"},
+		{[]*index{ixs[0], ixs[0]}, "no index for shard 1"},
+		{[]*index{ixs[0], merged}, "not of a shard"},
+	} {
+		if _, err := mergeIndexes(tc.ixs); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("got %v, want %q", err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	neturl "net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+var (
+	InputFile string
+	ListURL   string
+	// ListMirrors serve the same list as ListURL.
+	ListMirrors stringList
+)
+
+// wholeListNeeded reports whether an option has to see every entry before
+// the first download, which rules out taking a list as it arrives.
+func wholeListNeeded() bool {
+	return Preflight || DryRun || Confirm || ConfirmAbove > 0 || ResumeState != "" || ShardCount > 1 ||
+		OutputDevice != ""
+}
+
+// inputName labels where the entries came from, in messages and in the
+// -resume state.
+func inputName(args []string) string {
+	switch {
+	case ListURL != "":
+		return ListURL
+	case InputFile == "-":
+		return "stdin"
+	case InputFile != "":
+		return InputFile
+	default:
+		return strings.Join(args, " ")
+	}
+}
+
+// directEntries checks the URLs given as arguments, which unlike list
+// entries are refused rather than skipped when malformed. With -glob,
+// each is expanded first.
+func directEntries(args []string) ([]string, error) {
+	if Glob {
+		var expanded []string
+		for _, arg := range args {
+			urls, err := downloader.ExpandGlob(arg)
+			if err != nil {
+				return nil, fmt.Errorf("%q: %w", arg, err)
+			}
+			expanded = append(expanded, urls...)
+		}
+		args = expanded
+	}
+	for _, arg := range args {
+		u, err := neturl.Parse(arg)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme == "data" {
+			continue
+		}
+		if u.Scheme != "http" && u.Scheme != "https" && !slices.Contains(objectStoreSchemes, u.Scheme) && !slices.Contains(fileSchemes, u.Scheme) {
+			return nil, fmt.Errorf("%q is not an http, https, s3, gs, az, ftp, sftp or data URL", arg)
+		}
+		if u.Host == "" {
+			return nil, fmt.Errorf("%q has no host", arg)
+		}
+	}
+	return args, nil
+}
+
+// streamedInput reports whether the -i list is downloaded entry by entry
+// as it arrives: always for a pipe or socket named by path, and for stdin
+// unless it is a regular file or an option needs the whole list first.
+func streamedInput() bool {
+	if InputFile != "-" {
+		return isStream(InputFile)
+	}
+	fi, err := os.Stdin.Stat()
+	return err == nil && !fi.Mode().IsRegular() && fi.Mode()&fs.ModeCharDevice == 0 &&
+		!wholeListNeeded()
+}
+
+// openInput opens the -i list, "-" being stdin.
+func openInput() (io.ReadCloser, error) {
+	if InputFile == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	if isStream(InputFile) {
+		return openStream(InputFile)
+	}
+	return os.Open(InputFile)
+}
+
+// readInput reads the whole -i list. Its entries must be absolute URLs.
+func readInput(ctx context.Context) ([]string, error) {
+	f, err := openInput()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	files := []string{}
+	scan := dl.ScanList
+	if InputFile != "-" && !isStream(InputFile) {
+		scan = dl.ScanLocalList
+	}
+	err = scan(ctx, f, inputName(nil), nil, func(entry string) error {
+		files = append(files, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// runList is gocat list: it prints the entries of a list, one per line,
+// as a download would see them, after -expand-env, -recursive-list,
+// -manifest globs and sharding.
+func runList(args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	registerFlags(fs)
+	fs.StringVar(&InputFile, "i", "", "read the list from this local file, named pipe or unix:socket (- for stdin)")
+	fs.Var(&ListMirrors, "list-mirror", "another URL serving the same list (repeatable)")
+	parseFlags(fs, args)
+
+	if InputFile == "" && fs.NArg() != 1 || InputFile != "" && fs.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "Usage: gocat list [options] <list url> | -i <list>")
+		os.Exit(1)
+	}
+	if err := setup(); err != nil {
+		log.Fatal(err)
+	}
+
+	ctx := interruptContext()
+	var files []string
+	var err error
+	if InputFile != "" {
+		files, err = readInput(ctx)
+		files = shardList(files)
+	} else {
+		ListURL = fs.Arg(0)
+		files, err = loadList(ctx, ListURL)
+	}
+	if err != nil {
+		fatal(ctx, err)
+	}
+	w := bufio.NewWriter(os.Stdout)
+	for _, f := range files {
+		fmt.Fprintln(w, f)
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatal(err)
+	}
+}
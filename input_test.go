@@ -0,0 +1,33 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDirectEntriesGlob(t *testing.T) {
+	args := []string{"https://h/part-[1-2].bin", "https://h/{a,b}"}
+	t.Cleanup(func() { Glob = false })
+
+	// Without -glob the brackets are part of the URL.
+	Glob = false
+	if got, err := directEntries(args); err != nil || !slices.Equal(got, args) {
+		t.Errorf("got %q, %v; want the arguments as they are", got, err)
+	}
+
+	Glob = true
+	want := []string{"https://h/part-1.bin", "https://h/part-2.bin", "https://h/a", "https://h/b"}
+	if got, err := directEntries(args); err != nil || !slices.Equal(got, want) {
+		t.Errorf("got %q, %v; want %q", got, err, want)
+	}
+	// A glob is refused like any other malformed argument.
+	for arg, want := range map[string]string{
+		"https://h/[2-1]":  "invalid glob range",
+		"{https,file}://h": `"file://h" is not an http`,
+	} {
+		if _, err := directEntries([]string{arg}); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: got %v, want %q", arg, err, want)
+		}
+	}
+}
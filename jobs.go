@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+var (
+	Jobs int
+	// Fair is how the entries in flight share -limit-rate.
+	Fair string
+)
+
+// fairPolicies are the values of -fair.
+var fairPolicies = map[string]downloader.Fairness{
+	"":         downloader.FairNone,
+	"file":     downloader.FairFile,
+	"byte":     downloader.FairByte,
+	"priority": downloader.FairPriority,
+}
+
+// prefetchLimit caps what the entries ahead of the one on stdout may
+// buffer between them before they have to wait their turn.
+const prefetchLimit = 64 << 20
+
+// start runs entry i of the list, with up to Jobs entries in flight, unless
+// the q key was pressed or the filter is satisfied; wait waits for them.
+func (r *run) start(i int, file string) {
+	if r.quit.Load() {
+		r.stopped(file, "not started", -1, 0)
+		r.passTurn(i)
+		return
+	}
+	if r.filtered.Load() {
+		r.passTurn(i)
+		return
+	}
+	if Jobs <= 1 {
+		r.entry(i, file)
+		return
+	}
+	r.jobs <- struct{}{}
+	r.wg.Add(1)
+	go func() {
+		defer func() {
+			<-r.jobs
+			r.wg.Done()
+		}()
+		r.entry(i, file)
+	}()
+}
+
+// passTurn lets the entries after i have their output and their turn on
+// stdout or a device when i is never run.
+func (r *run) passTurn(i int) {
+	r.passClaim(i)
+	if r.seq != nil {
+		r.seq.slot(i).close()
+	}
+}
+
+func (r *run) wait() {
+	r.wg.Wait()
+}
+
+// sequencer keeps entries on a single output (stdout or a device) in list
+// order. The entry whose turn it is writes straight through; the others
+// buffer until prefetchLimit is reached between them, then wait.
+type sequencer struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	w    io.Writer
+	// turn is the entry that owns w, written how many bytes have gone to
+	// it so far.
+	turn     int
+	written  int64
+	buffered int
+	slots    map[int]*seqSlot
+}
+
+func newSequencer(w io.Writer) *sequencer {
+	s := &sequencer{w: w, slots: map[int]*seqSlot{}}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// seqSlot is what entry i writes to.
+type seqSlot struct {
+	s     *sequencer
+	i     int
+	buf   bytes.Buffer
+	total int64
+	done  bool
+	// offset is where the entry starts in the output, once done.
+	offset int64
+}
+
+func (s *sequencer) slot(i int) *seqSlot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sl := s.slots[i]
+	if sl == nil {
+		sl = &seqSlot{s: s, i: i}
+		s.slots[i] = sl
+	}
+	return sl
+}
+
+func (sl *seqSlot) Write(p []byte) (int, error) {
+	s := sl.s
+	s.mu.Lock()
+	for s.turn != sl.i && sl.buf.Len() > 0 && s.buffered+len(p) > prefetchLimit {
+		s.cond.Wait()
+	}
+	sl.total += int64(len(p))
+	if s.turn != sl.i {
+		sl.buf.Write(p)
+		s.buffered += len(p)
+		s.mu.Unlock()
+		return len(p), nil
+	}
+	s.mu.Unlock()
+
+	// Only the entry whose turn it is gets here, so w is not shared.
+	if err := sl.flush(); err != nil {
+		return 0, err
+	}
+	n, err := s.w.Write(p)
+	s.mu.Lock()
+	s.written += int64(n)
+	s.mu.Unlock()
+	return n, err
+}
+
+// flush writes out what the slot buffered before its turn came.
+func (sl *seqSlot) flush() error {
+	s := sl.s
+	if sl.buf.Len() == 0 {
+		return nil
+	}
+	n, err := s.w.Write(sl.buf.Bytes())
+	s.mu.Lock()
+	s.written += int64(n)
+	s.buffered -= sl.buf.Len()
+	sl.buf.Reset()
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	return err
+}
+
+// retract takes back what the entry wrote, when none of it has gone out
+// yet, and reports whether it could.
+func (sl *seqSlot) retract() bool {
+	s := sl.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sl.done || int64(sl.buf.Len()) != sl.total {
+		return false
+	}
+	s.buffered -= sl.buf.Len()
+	sl.buf.Reset()
+	sl.total = 0
+	s.cond.Broadcast()
+	return true
+}
+
+// close waits for the entry's turn, writes out the rest of it and passes
+// the output on to the next entry. It may be called more than once.
+func (sl *seqSlot) close() error {
+	s := sl.s
+	s.mu.Lock()
+	if sl.done {
+		s.mu.Unlock()
+		return nil
+	}
+	for s.turn != sl.i {
+		s.cond.Wait()
+	}
+	s.mu.Unlock()
+
+	err := sl.flush()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sl.done = true
+	sl.offset = s.written - sl.total
+	delete(s.slots, sl.i)
+	s.turn++
+	s.cond.Broadcast()
+	return err
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var JournalFile string
+
+var journal *journalWriter
+
+// journalRecord is one line of a -journal. A "request" record is every
+// HTTP exchange, with a hash of the body as received; an "entry" record
+// is a finished entry and where its bytes went: Bytes bytes from byte
+// First of the entry, at Offset of Output ("-" for stdout). Prev chains
+// each line to the SHA-256 of the one before, so an edited or truncated
+// journal is caught by gocat audit.
+type journalRecord struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	URL  string    `json:"url"`
+
+	Method       string `json:"method,omitempty"`
+	Range        string `json:"range,omitempty"`
+	Status       int    `json:"status,omitempty"`
+	ContentRange string `json:"content_range,omitempty"`
+	// Length is the Content-Length announced, -1 if none.
+	Length int64  `json:"length,omitempty"`
+	Error  string `json:"error,omitempty"`
+
+	Output   string   `json:"output,omitempty"`
+	Offset   int64    `json:"offset,omitempty"`
+	First    int64    `json:"first,omitempty"`
+	Pipeline []string `json:"pipeline,omitempty"`
+
+	Bytes  int64  `json:"bytes"`
+	SHA256 string `json:"sha256,omitempty"`
+	Prev   string `json:"prev"`
+}
+
+// journalWriter appends records to a journal. It is meant to have one
+// writer at a time; a second process appending forks the chain.
+type journalWriter struct {
+	mu   sync.Mutex
+	f    *os.File
+	prev string
+}
+
+func openJournal(path string) (*journalWriter, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// Carry on the chain of an existing journal from its last line.
+	j := &journalWriter{f: f}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		j.prev = lineHash(scanner.Bytes())
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+func lineHash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+func (j *journalWriter) add(rec journalRecord) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	rec.Time = time.Now().UTC()
+	rec.Prev = j.prev
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	// One write per line, so a crash leaves at most a torn last line.
+	if _, err := j.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	j.prev = lineHash(line)
+	return nil
+}
+
+func (j *journalWriter) log(rec journalRecord) {
+	if err := j.add(rec); err != nil {
+		warnf("writing the journal: %v", err.Error())
+	}
+}
+
+// journalTransport records every request that passes through it once its
+// body has been read or closed.
+type journalTransport struct {
+	base    http.RoundTripper
+	journal *journalWriter
+}
+
+func (t *journalTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rec := journalRecord{
+		Type:   "request",
+		URL:    req.URL.String(),
+		Method: req.Method,
+		Range:  req.Header.Get("Range"),
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		rec.Error = err.Error()
+		t.journal.log(rec)
+		return nil, err
+	}
+	rec.Status = resp.StatusCode
+	rec.ContentRange = resp.Header.Get("Content-Range")
+	rec.Length = resp.ContentLength
+	resp.Body = &journalBody{ReadCloser: resp.Body, journal: t.journal, rec: rec, h: sha256.New()}
+	return resp, nil
+}
+
+type journalBody struct {
+	io.ReadCloser
+	journal *journalWriter
+	rec     journalRecord
+	h       hash.Hash
+	once    sync.Once
+}
+
+func (b *journalBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.h.Write(p[:n])
+	b.rec.Bytes += int64(n)
+	if err != nil && !errors.Is(err, io.EOF) {
+		b.rec.Error = err.Error()
+	}
+	if err != nil {
+		b.done()
+	}
+	return n, err
+}
+
+func (b *journalBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.done()
+	return err
+}
+
+func (b *journalBody) done() {
+	b.once.Do(func() {
+		b.rec.SHA256 = hex.EncodeToString(b.h.Sum(nil))
+		b.journal.log(b.rec)
+	})
+}
+
+// complete reports whether a request record holds a whole successful
+// body, so its hash speaks for the bytes it covered.
+func (r *journalRecord) complete() bool {
+	return r.Type == "request" && r.Method == "GET" && r.Error == "" && r.Status/100 == 2 &&
+		r.Length >= 0 && r.Bytes == r.Length
+}
+
+// readJournal reads every record of a journal and checks its chain,
+// returning the records up to the first break along with the error.
+func readJournal(path string) ([]journalRecord, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var records []journalRecord
+	prev := ""
+	for n, line := range bytes.Split(bytes.TrimSuffix(b, []byte("\n")), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var rec journalRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return records, fmt.Errorf("%s:%v: %w", path, n+1, err)
+		}
+		if rec.Prev != prev {
+			return records, fmt.Errorf("%s:%v: does not follow the line before; the journal was altered", path, n+1)
+		}
+		prev = lineHash(line)
+		records = append(records, rec)
+	}
+	return records, nil
+}
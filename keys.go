@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// minKeyRate is as low as - takes the rate limit.
+const minKeyRate = 1 << 10
+
+const keysHelp = "keys: p pause/resume, s skip the entry, [ and ] one chunk fewer and more in flight per entry, - and + halve and double the rate limit, q quit after the chunks in flight"
+
+var errSkipped = errors.New("skipped")
+
+var (
+	restoreMu sync.Mutex
+	restoreFn func()
+)
+
+// restoreTerminal undoes cbreak, if keys were read; every exit path while
+// they are has to call it.
+func restoreTerminal() {
+	restoreMu.Lock()
+	defer restoreMu.Unlock()
+	if restoreFn != nil {
+		restoreFn()
+		restoreFn = nil
+	}
+}
+
+// listenKeys reads control keys from the terminal while the tty status
+// line or the dashboard is up. Stdin must be a terminal nobody else reads
+// from.
+func (r *run) listenKeys() {
+	if prog.mode != "tty" && prog.mode != "tui" || !isTerminal(os.Stdin) || InputFile == "-" {
+		return
+	}
+	restore, err := cbreak(os.Stdin)
+	if err != nil {
+		return
+	}
+	restoreMu.Lock()
+	restoreFn = restore
+	restoreMu.Unlock()
+	r.keyf("%s", keysHelp)
+
+	go func() {
+		b := make([]byte, 1)
+		for {
+			if _, err := os.Stdin.Read(b); err != nil {
+				return
+			}
+			r.key(b[0])
+		}
+	}()
+}
+
+func (r *run) key(k byte) {
+	switch k {
+	case 'p', ' ':
+		if dl.Paused() {
+			dl.Resume()
+			r.keyf("resumed")
+		} else {
+			dl.Pause()
+			r.keyf("paused every transfer, p to resume")
+		}
+	case 's':
+		r.skip()
+	case '[', ']':
+		n := dl.CurrentWorkers()
+		if k == '[' {
+			if n <= 1 {
+				r.keyf("already one chunk at a time")
+				return
+			}
+			n--
+		} else {
+			n++
+		}
+		dl.SetWorkers(n)
+		r.keyf("up to %v chunks of each entry in flight", dl.CurrentWorkers())
+	case '-':
+		rate := dl.CurrentRateLimit()
+		if rate == 0 {
+			// Start from what is coming in now.
+			rate = int64(prog.currentRate())
+		}
+		if rate == 0 {
+			r.keyf("nothing to slow down yet")
+			return
+		}
+		rate = max(rate/2, minKeyRate)
+		dl.SetRateLimit(rate)
+		r.keyf("rate limit %v/s", formatSize(rate))
+	case '+':
+		rate := dl.CurrentRateLimit()
+		if rate == 0 {
+			r.keyf("no rate limit to raise")
+			return
+		}
+		dl.SetRateLimit(rate * 2)
+		r.keyf("rate limit %v/s", formatSize(rate*2))
+	case 'q':
+		if r.quit.Swap(true) {
+			return
+		}
+		dl.Drain()
+		if dl.Paused() {
+			dl.Resume()
+		}
+		r.keyf("quitting after the chunks in flight")
+	case 'h', '?':
+		r.keyf("%s", keysHelp)
+	}
+}
+
+// skip abandons the first entry in flight. Only whole files can be
+// dropped; bytes already on stdout or a device cannot be taken back.
+func (r *run) skip() {
+	if !outputEnabled() {
+		r.keyf("entries can only be skipped with -o or -O")
+		return
+	}
+	r.mu.Lock()
+	first := -1
+	for i := range r.cancels {
+		if first < 0 || i < first {
+			first = i
+		}
+	}
+	var cancel context.CancelCauseFunc
+	if first >= 0 {
+		cancel = r.cancels[first]
+		delete(r.cancels, first)
+	}
+	r.mu.Unlock()
+	if cancel != nil {
+		cancel(errSkipped)
+	}
+}
+
+func (r *run) keyf(format string, args ...any) {
+	infof(format, args...)
+}
+
+// stopped records entry file as left unfinished on purpose, after written
+// of expected bytes (-1 when it never started), so the final report lists
+// it.
+func (r *run) stopped(file, why string, expected, written int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if expected < 0 {
+		r.mismatches = append(r.mismatches, fmt.Sprintf("%s: %s", file, why))
+		return
+	}
+	r.expected += expected
+	r.written += written
+	r.mismatches = append(r.mismatches, fmt.Sprintf("%s: %s after %v of %v bytes", file, why, written, expected))
+}
@@ -0,0 +1,22 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// listenPrivate listens on the unix socket path and leaves it to its owner
+// alone, as far as the platform has modes.
+func listenPrivate(path string) (net.Listener, error) {
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
@@ -0,0 +1,17 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenPrivate listens on the unix socket path, which only its owner can
+// connect to: the umask makes it so as it is created, where a chmod after
+// would leave a moment for others to connect.
+func listenPrivate(path string) (net.Listener, error) {
+	old := syscall.Umask(0077)
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
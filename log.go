@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	LogFormat string
+	Verbose   bool
+	Quiet     bool
+)
+
+// logger takes the messages of gocat and its downloader. The text form is
+// the one the command always printed, the message alone; -log-format json
+// adds the details as attributes.
+var logger = slog.New(&lineHandler{level: slog.LevelInfo})
+
+// setupLogging applies -v, -q and -log-format. From then on the standard
+// log package, which reports the errors that end the run, goes to logger
+// too in json form.
+func setupLogging() error {
+	level := slog.LevelInfo
+	switch {
+	case Verbose && Quiet:
+		return fmt.Errorf("-v and -q are mutually exclusive")
+	case Verbose:
+		level = slog.LevelDebug
+	case Quiet:
+		level = slog.LevelWarn
+	}
+	switch LogFormat {
+	case "", "text":
+		logger = slog.New(&lineHandler{level: level})
+	case "json":
+		logger = slog.New(slog.NewJSONHandler(logSink{}, &slog.HandlerOptions{Level: level}))
+		log.SetFlags(0)
+		log.SetOutput(errorLog{})
+	default:
+		return fmt.Errorf("invalid -log-format %q: want text or json", LogFormat)
+	}
+	return nil
+}
+
+func infof(format string, args ...any) {
+	logger.Info(fmt.Sprintf(format, args...))
+}
+
+func warnf(format string, args ...any) {
+	logger.Warn(fmt.Sprintf(format, args...))
+}
+
+// logSink writes past the status line once there is one.
+type logSink struct{}
+
+func (logSink) Write(b []byte) (int, error) {
+	if prog == nil {
+		return os.Stderr.Write(b)
+	}
+	return prog.logWriter().Write(b)
+}
+
+// errorLog turns lines of the log package into error records.
+type errorLog struct{}
+
+func (errorLog) Write(b []byte) (int, error) {
+	logger.Error(strings.TrimSuffix(string(b), "\n"), "event", "error")
+	return len(b), nil
+}
+
+// lineHandler prints records as "[time] message" lines. The attributes
+// only repeat what the message says.
+type lineHandler struct {
+	level slog.Level
+}
+
+func (h *lineHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *lineHandler) Handle(_ context.Context, r slog.Record) error {
+	_, err := fmt.Fprintf(logSink{}, "[%v] %s\n", r.Time.Format(time.RFC3339), r.Message)
+	return err
+}
+
+func (h *lineHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+
+func (h *lineHandler) WithGroup(string) slog.Handler { return h }
@@ -1,196 +1,969 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/msmania/gocat/downloader"
 )
 
 var (
-	MaxRetry      int
-	BatchSizeInMB int
+	MaxRetry        int
+	RetryInitial    time.Duration
+	RetryMax        time.Duration
+	RetryMultiplier float64
+	NetworkWait     time.Duration
+	BatchSizeInMB   int
+	AdaptiveChunks  bool
+	MinChunkSize    byteSize = 1 << 20
+	MaxChunkSize    byteSize = 64 << 20
+	SpeedLimit      byteSize
+	SpeedTimeSec    int
+	LimitRate       byteSize
+	LimitRateConn   byteSize
+	Parallel        int
+	Hedge           bool
+	SpoolDir        string
+	Window          int
+	WindowMemory    byteSize
+	Mirrors         stringList
+	ListTimeout     time.Duration
+	ConnectTimeout  time.Duration
+	MaxIdlePerHost  int
+	HTTP2           bool
+	KeepAlive       time.Duration
+	DNSCacheTTL     time.Duration
+	MaxPerHost      int
+	MinInterval     time.Duration
+	ChunkTimeout    time.Duration
+	MaxTime         time.Duration
+	MaxListSize     byteSize = 64 << 20
+	MaxLineLength   byteSize = 1 << 20
+	ExpandEnv       bool
+	StrictEnv       bool
+	EnvAllow        stringList
+	Manifest        bool
+	Glob            bool
+	RecursiveList   bool
+	ListSuffix      string
+	MaxListDepth    int
+	ShardIndex      int
+	ShardCount      int
 )
 
-func checkHeaders(url string) (int64, error) {
-	resp, err := http.Head(url)
-	if err != nil {
-		return 0, err
-	}
-
-	acceptRanges := resp.Header.Get("Accept-Ranges")
-	if acceptRanges != "bytes" {
-		return 0, errors.New("no supported Accept-Ranges found")
-	}
+// stringList is a flag.Value collecting every occurrence of a repeatable
+// flag.
+type stringList []string
 
-	contentLenStr := resp.Header.Get("Content-Length")
-	contentLen, err := strconv.ParseInt(contentLenStr, 10, 64)
-	if err != nil {
-		return 0, err
-	}
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
 
-	return contentLen, nil
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
 }
 
-func downloadChunk(
-	client http.Client,
-	url string,
-	offsetFrom, offsetTo int64,
-) ([]byte, error) {
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
+var (
+	ladder     = newProtocolLadder()
+	httpClient = &http.Client{Transport: ladder}
+	dl         *downloader.Downloader
+)
 
-	rangeStr := fmt.Sprintf("bytes=%v-%v", offsetFrom, offsetTo)
-	req.Header.Add("Range", rangeStr)
+// downloadAndWrite returns the size the server announced for url alongside
+// the number of bytes actually written to w, so callers can detect short
+// transfers.
+func downloadAndWrite(ctx context.Context, url string, w io.Writer) (expected, written int64, err error) {
+	return downloadFrom(ctx, url, 0, w)
+}
 
-	resp, err := client.Do(req)
+// downloadFrom is downloadAndWrite starting at byte start of url, or of the
+// part -range or -tail-bytes select; written counts only the bytes written
+// by this call.
+func downloadFrom(ctx context.Context, url string, start int64, w io.Writer) (expected, written int64, err error) {
+	info, err := checkHeaders(ctx, url)
 	if err != nil {
-		return nil, err
+		return 0, 0, err
 	}
-	defer resp.Body.Close()
-
-	respBytes, err := io.ReadAll(resp.Body)
+	from, to, err := window(url, info)
 	if err != nil {
-		return nil, err
+		return 0, 0, err
 	}
 
-	return respBytes, nil
-}
+	if quota != nil {
+		// An object of unknown size is only accounted once fetched.
+		if info.Size >= 0 {
+			if err := quota.check(url, to-from-start); err != nil {
+				return info.Size, 0, err
+			}
+		}
+		defer func() {
+			if qerr := quota.add(written); qerr != nil && err == nil {
+				err = qerr
+			}
+		}()
+	}
 
-func downloadChunkWithRetry(
-	client http.Client,
-	url string,
-	offsetFrom, offsetTo int64,
-) (resp []byte, err error) {
-	for i := 0; i < MaxRetry; i++ {
-		resp, err = downloadChunk(client, url, offsetFrom, offsetTo)
-		if err == nil {
-			break
+	var lead int64
+	if body, ok := takeSmall(url); ok {
+		if int64(len(body)) == info.Size {
+			n, err := w.Write(body[from+start : to])
+			return to - from, int64(n), err
+		}
+		// The first bytes came with the headers; the rest follows them.
+		if info.Ranges && !Parity && from+start < int64(len(body)) {
+			n, err := w.Write(body[from+start : min(to, int64(len(body)))])
+			if err != nil {
+				return to - from, int64(n), err
+			}
+			lead = int64(n)
+			start += lead
+			defer func() { written += lead }()
 		}
-		fmt.Fprintf(
-			os.Stderr,
-			"[%v] retrying %v/%v (%v)\n",
-			time.Now().Format(time.RFC3339),
-			i,
-			MaxRetry,
-			err.Error(),
-		)
-		time.Sleep(time.Second)
 	}
-	return
-}
 
-func downloadAndWrite(url string, w io.Writer) error {
-	contentLen, err := checkHeaders(url)
-	if err != nil {
-		return err
+	warmUp(ctx, url)
+
+	if Parity && start == 0 && info.Ranges && !partial() {
+		par, err := loadParity(ctx, url, info)
+		if err != nil {
+			warnf("ignoring the parity of %s: %v", url, err.Error())
+		}
+		if par != nil {
+			written, err = downloadParity(ctx, url, par, w)
+			return info.Size, written, err
+		}
 	}
 
-	batchSize := int64(BatchSizeInMB) << 20
-	numChunks := contentLen / batchSize
-	if contentLen%batchSize > 0 {
-		numChunks++
+	if partial() {
+		written, err = dl.DownloadRange(ctx, url, info.Size, from+start, to, w)
+		return to - from, written, err
 	}
+	if !info.Ranges {
+		written, err = dl.DownloadStream(ctx, url, info, start, w)
+		if info.Size < 0 {
+			// Whatever arrived is the whole object.
+			return start + written, written, err
+		}
+		return info.Size, written, err
+	}
+	written, err = dl.DownloadFrom(ctx, url, info.Size, start, w)
+	return info.Size, written, err
+}
 
-	client := http.Client{}
+func logChunk(level slog.Level, url string, chunk, numChunks, offset, offsetTo int64) {
+	logger.Log(
+		context.Background(),
+		level,
+		fmt.Sprintf("downloading %v/%v [%v, %v) from %s", chunk, numChunks, offset, offsetTo, url),
+		"event", "chunk",
+		"url", url,
+		"chunk", chunk,
+		"num_chunks", numChunks,
+		"from", offset,
+		"to", offsetTo,
+	)
+}
 
-	chunk := int64(1)
-	for offset := int64(0); offset < contentLen; {
-		offsetTo := offset + batchSize
-		if offsetTo > contentLen {
-			offsetTo = contentLen
-		}
+// shardEntries returns the contiguous block of list assigned to shard index
+// out of count, so concatenating every shard's output in index order yields
+// the same stream as an unsharded run.
+func shardEntries(list []string, index, count int) []string {
+	n := len(list)
+	return list[index*n/count : (index+1)*n/count]
+}
 
-		fmt.Fprintf(
-			os.Stderr,
-			"[%v] downloading %v/%v [%v, %v) from %s\n",
-			time.Now().Format(time.RFC3339),
-			chunk,
-			numChunks,
-			offset,
-			offsetTo,
-			url,
-		)
-		resp, err := downloadChunkWithRetry(client, url, offset, offsetTo-1)
+func resolveShard() error {
+	if ShardCount <= 0 {
+		return errors.New("shard count must be positive")
+	}
+	if ShardIndex < 0 {
+		env := os.Getenv("JOB_COMPLETION_INDEX")
+		if env == "" {
+			ShardIndex = 0
+			if ShardCount > 1 {
+				return errors.New("-shard-index or JOB_COMPLETION_INDEX is required")
+			}
+			return nil
+		}
+		index, err := strconv.Atoi(env)
 		if err != nil {
-			return err
+			return fmt.Errorf("invalid JOB_COMPLETION_INDEX: %w", err)
 		}
+		ShardIndex = index
+	}
+	if ShardIndex < 0 || ShardIndex >= ShardCount {
+		return fmt.Errorf("shard index %v out of range [0, %v)", ShardIndex, ShardCount)
+	}
+	return nil
+}
 
-		if _, err = w.Write(resp); err != nil {
-			return err
-		}
+// registerFlags defines the transfer options shared by the default
+// invocation and the subcommands that download.
+func registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&ConfigFile, "config", "",
+		"read options from this YAML file instead of ~/.config/gocat/config.yaml; GOCAT_* variables override it, and flags both")
+	fs.StringVar(&Profile, "profile", "",
+		"take options from this section of the config file's profiles first, over its top-level ones")
+	fs.IntVar(&MaxRetry, "m", 100, "max download retry attempts")
+	fs.DurationVar(&RetryInitial, "retry-initial", time.Second, "backoff after the first failed attempt")
+	fs.DurationVar(&RetryMax, "retry-max", 30*time.Second, "longest backoff between attempts")
+	fs.Float64Var(&RetryMultiplier, "retry-multiplier", 2,
+		"backoff growth per failed attempt; a server's Retry-After overrides it")
+	fs.DurationVar(&NetworkWait, "network-wait", 30*time.Minute,
+		"pause for up to this long when the network is unreachable (0 disables)")
+	fs.IntVar(&BatchSizeInMB, "b", 16, "chunk size")
+	fs.BoolVar(&AdaptiveChunks, "adaptive-chunks", false,
+		"size chunks by the throughput and failures seen, from -min-chunk up to -max-chunk, instead of -b")
+	fs.Var(&MinChunkSize, "min-chunk", "smallest, and first, chunk of -adaptive-chunks")
+	fs.Var(&MaxChunkSize, "max-chunk", "largest chunk of -adaptive-chunks")
+	fs.Var(&SpeedLimit, "speed-limit",
+		"abort and retry a chunk slower than this many bytes/s (0 disables)")
+	fs.IntVar(&SpeedTimeSec, "speed-time", 30,
+		"seconds a chunk may stay below -speed-limit before it is aborted")
+	fs.Var(&LimitRate, "limit-rate",
+		"cap the combined rate of all transfers at this many bytes/s, e.g. 10M (0 disables)")
+	fs.Var(&LimitRateConn, "limit-rate-conn",
+		"cap the rate of each connection at this many bytes/s (0 disables)")
+	fs.IntVar(&Parallel, "p", 1, "number of chunks to download concurrently")
+	fs.Var(&SmallSize, "small-size",
+		"fetch entries up to this size whole with one GET, without a HEAD first (0 disables)")
+	fs.Var(&HugeSize, "huge-size", "entries at least this large use -huge-parallel instead of -p (0 disables)")
+	fs.IntVar(&HugeWorkers, "huge-parallel", 8, "number of chunks of a -huge-size entry downloaded concurrently")
+	fs.BoolVar(&Hedge, "hedge", false,
+		"race a duplicate request for chunks slower than the recent p95")
+	fs.StringVar(&SpoolDir, "spool-dir", "",
+		"keep parallel chunks waiting for their turn in a temporary file in this directory instead of memory")
+	fs.IntVar(&Window, "window", 0,
+		"let the workers of a parallel entry run this many chunks ahead of the one being written, so one slow chunk does not stall them (0 is -p)")
+	fs.Var(&WindowMemory, "window-memory", "cap the memory held by the chunks in flight and waiting for their turn (0 leaves it to -window)")
+	fs.BoolVar(&Parity, "parity", false,
+		"fetch each entry's Reed-Solomon sidecar (<url>"+paritySuffix+", see gocat parity) with it to rebuild lost shards")
+	fs.StringVar(&PresignCmd, "presign-cmd", "",
+		"command run with an entry's URL to print a fresh pre-signed URL for it once the current one expires")
+	fs.BoolVar(&Resign, "resign", false,
+		"once an S3 or GCS pre-signed URL expires, sign its requests with your own AWS or Google credentials instead, before trying -presign-cmd")
+	fs.StringVar(&JournalFile, "journal", "",
+		"append a hash-chained record of every request and entry to this file (see gocat audit)")
+	fs.Var(&Mirrors, "mirror",
+		"another location of the list's directory to fetch entries from too (repeatable)")
+	fs.StringVar(&HMACKey, "hmac-key", "",
+		"sign every request with this HMAC key (@file reads it from a file)")
+	fs.StringVar(&HMACHeader, "hmac-header", "Authorization",
+		"header that carries the HMAC signature")
+	fs.StringVar(&HMACTemplate, "hmac-template", `{{.Method}}\n{{.Path}}\n{{.Date}}`,
+		"text/template of the string to sign")
+	fs.StringVar(&HMACFormat, "hmac-format", "{{.Signature}}",
+		"text/template of the signature header value")
+	fs.StringVar(&HMACHash, "hmac-hash", "sha256",
+		"HMAC hash function (sha1, sha256, sha512)")
+	fs.Var(&Headers, "H", "send this header, as \"Name: value\" (repeatable; \"Name:\" removes it)")
+	fs.StringVar(&BasicAuth, "u", "", "send basic auth, as user:password")
+	fs.StringVar(&Bearer, "bearer", "", "send this bearer token (@file reads it from a file)")
+	fs.StringVar(&CookieFile, "cookie-file", "", "send cookies from this Netscape cookies.txt file")
+	fs.StringVar(&FTPUser, "ftp-user", "", "log in to ftp:// servers as this user instead of anonymous; a user in the URL wins")
+	fs.StringVar(&FTPPassword, "ftp-password", "", "password of -ftp-user (@file reads it from a file)")
+	fs.StringVar(&S3Endpoint, "s3-endpoint", "",
+		"send s3:// requests to this S3-compatible service, e.g. MinIO, Ceph or R2, instead of AWS (default $AWS_ENDPOINT_URL_S3 or $AWS_ENDPOINT_URL)")
+	fs.StringVar(&S3Addressing, "s3-addressing", "auto",
+		"put the s3:// bucket in the path (path) or the host name (virtual); auto puts it in the path for -s3-endpoint and dotted names")
+	fs.StringVar(&S3Region, "s3-region", "", "sign s3:// requests for this region, e.g. auto for R2 (default $AWS_REGION or the AWS config's)")
+	fs.StringVar(&SFTPKey, "sftp-key", "", "private key for sftp://, besides those of ssh's own configuration and agent")
+	fs.StringVar(&SFTPPassword, "sftp-password", "", "log in to sftp:// with this password (@file reads it from a file)")
+	fs.StringVar(&SSHCommand, "ssh-command", "ssh", "ssh client that sftp:// runs the sftp subsystem with")
+	fs.Var(&VaultHeaders, "vault-header",
+		"set header Name from a Vault secret, as Name=path#field (repeatable)")
+	fs.StringVar(&VaultBearer, "vault-bearer", "",
+		"send a bearer token read from a Vault secret, as path#field")
+	fs.StringVar(&VaultBasic, "vault-basic", "",
+		"send basic auth from the username/password fields of a Vault path")
+	fs.IntVar(&MaxRedirects, "max-redirects", 10, "follow at most this many redirects per request (0 refuses them)")
+	fs.BoolVar(&PinRedirects, "pin-redirects", false,
+		"follow an entry's redirects once and send all later requests, chunks included, to where they led")
+	fs.BoolVar(&LocationTrusted, "location-trusted", false,
+		"send -u, -bearer, Authorization and Cookie headers and HMAC and Vault signatures to other hosts on redirects, like curl")
+	fs.DurationVar(&ConnectTimeout, "connect-timeout", 0,
+		"time limit for connecting, TLS handshake included (0 keeps the default of 30s)")
+	fs.IntVar(&MaxIdlePerHost, "max-idle-per-host", 0,
+		"idle connections kept open to each host for reuse (0 keeps enough for -p, -huge-parallel and -j)")
+	fs.BoolVar(&HTTP2, "http2", true, "use HTTP/2 with servers that offer it; -http2=false sticks to HTTP/1.1")
+	fs.DurationVar(&KeepAlive, "keepalive", 30*time.Second,
+		"interval between TCP keep-alive probes on idle connections (negative disables)")
+	fs.DurationVar(&DNSCacheTTL, "dns-cache-ttl", 0,
+		"resolve each host once and reuse its addresses for this long (0 resolves on every new connection)")
+	fs.IntVar(&MaxPerHost, "max-per-host", 0,
+		"requests in flight to any one host, chunks of every entry and mirror included; the rest wait their turn (0 disables)")
+	fs.DurationVar(&MinInterval, "min-request-interval", 0,
+		"least time between the starts of two requests to the same host (0 disables)")
+	fs.DurationVar(&ChunkTimeout, "chunk-timeout", 0,
+		"time limit for each ranged request, body included, after which it is retried (0 disables)")
+	fs.DurationVar(&ListTimeout, "list-timeout", time.Minute,
+		"time limit for each attempt at fetching the list (0 disables)")
+	fs.Var(&MaxListSize, "max-list-size", "largest list accepted, before and after decompression")
+	fs.Var(&MaxLineLength, "max-line-length", "longest list line accepted")
+	fs.BoolVar(&ExpandEnv, "expand-env", false,
+		"expand ${VAR} and ${VAR:-default} in the URLs of list entries; any variable in a -i file, only -expand-env-var ones in other lists")
+	fs.BoolVar(&StrictEnv, "strict-env", false,
+		"like -expand-env, but fail on undefined variables")
+	fs.Var(&EnvAllow, "expand-env-var",
+		"a variable -expand-env may expand in lists other than a -i file, such as -list or stdin; repeatable")
+	fs.BoolVar(&RecursiveList, "recursive-list", false,
+		"expand list lines that name another list, as list:URL or with -list-suffix, into its entries")
+	fs.StringVar(&ListSuffix, "list-suffix", "",
+		"with -recursive-list, also expand entries whose path ends in this, e.g. .list")
+	fs.IntVar(&MaxListDepth, "max-list-depth", 8, "with -recursive-list, how many lists deep to go")
+	fs.BoolVar(&Glob, "glob", false,
+		"expand curl-style {a,b} alternatives and [000-127] or [a-z:2] ranges in URL arguments and list entries")
+	fs.BoolVar(&Manifest, "manifest", false,
+		"read the list strictly: expand {a,b} and [1-9] globs, and fail on a malformed entry, mirror or field (out=, output=, size=, sha256=, header=, retries=, timeout=, chunk=) instead of skipping it")
+	fs.BoolVar(&WarnSizeMismatch, "warn-size-mismatch", false,
+		"only warn about an entry whose Content-Length or body is not the size= its list gives, instead of failing it")
+	fs.BoolVar(&Confirm, "confirm", false,
+		"show what would be downloaded and ask before transferring")
+	fs.Var(&ConfirmAbove, "confirm-above", "ask before transferring more than this size")
+	fs.BoolVar(&Meter, "meter", false,
+		"show a single throughput line instead of per-chunk logging")
+	fs.StringVar(&ProgressMode, "progress", "auto",
+		"progress display: tty (status line, with control keys when stdin is a terminal), tui (as -tui), log (line per chunk), json (events), none; auto picks tty on a terminal")
+	fs.BoolVar(&TUI, "tui", false,
+		"show a dashboard with a row per file in flight, and keys to pause, skip and change -p, instead of the status line")
+	fs.BoolVar(&Verbose, "v", false, "log more: each finished chunk, and the chunks a status line hides")
+	fs.BoolVar(&Quiet, "q", false, "log only warnings and errors")
+	fs.StringVar(&LogFormat, "log-format", "text",
+		"log as text lines, or as json records with the URL, offsets, bytes and durations of each event")
+	fs.StringVar(&NotifyCmd, "notify-cmd", "",
+		"command run with a message as its last argument, and GOCAT_EVENT in its environment, to notify of events")
+	fs.DurationVar(&NotifyETAWithin, "notify-eta-within", 0,
+		"notify (see -notify-cmd) once the run is expected to end within this long; needs one entry or -preflight")
+	fs.BoolVar(&Preflight, "preflight", false,
+		"check every entry concurrently before downloading anything")
+	fs.IntVar(&PreflightJobs, "preflight-jobs", 8, "concurrent requests during preflight")
+	fs.IntVar(&WarmConns, "warm-conns", 0,
+		"connections to open to each host before its first chunk")
+	fs.BoolVar(&History, "history", false,
+		"record URL, validators and SHA-256 of every completed download")
+	fs.StringVar(&HistoryDB, "history-db", "",
+		"history file (default $XDG_DATA_HOME/gocat/history.jsonl); implies -history")
+	fs.StringVar(&ResumeState, "resume", "",
+		"record progress in this file and continue from it; redirect stdout with >>")
+	fs.StringVar(&RecordDir, "record", "", "save every HTTP response under this directory")
+	fs.StringVar(&ReplayDir, "replay", "",
+		"answer HTTP requests from a -record directory instead of the network")
+	fs.BoolVar(&Offline, "offline", false,
+		"never touch the network: answer HTTP requests from -replay alone and fail the rest, ftp:// and sftp:// included")
+	fs.StringVar(&ProxyPAC, "proxy-pac", "",
+		"choose a proxy per host with this proxy auto-config file (URL or file)")
+	fs.StringVar(&Via, "via", "",
+		"tunnel every connection through SSH to this jump host, as [user@]host[:port]")
+	fs.StringVar(&ProxyURL, "proxy", "",
+		"send requests through this proxy (http, https, socks5 or socks5h URL)")
+	fs.StringVar(&ProxyRules, "proxy-rules", "",
+		"choose a proxy per host from a file of \"pattern target\" lines, target direct or a proxy URL")
+	fs.Var(&Plugins, "plugin",
+		"Go plugin exporting WrapTransport to wrap the HTTP transport; repeatable")
+	fs.StringVar(&QuotaSpec, "quota", "",
+		"refuse transfers beyond this budget, e.g. 500G/month (hour, day, week, month)")
+	fs.StringVar(&QuotaState, "quota-state", "",
+		"quota usage file (default $XDG_DATA_HOME/gocat/quota.json)")
+	fs.BoolVar(&HTTPSOnly, "https-only", false, "refuse to fetch anything over plain http")
+	fs.BoolVar(&HTTPSUpgrade, "https-upgrade", false, "fetch http:// URLs over https instead")
+	fs.BoolVar(&HSTS, "hsts", false,
+		"remember Strict-Transport-Security from servers and upgrade those hosts to https")
+	fs.StringVar(&HSTSFile, "hsts-file", "",
+		"HSTS cache file (default $XDG_DATA_HOME/gocat/hsts.json); implies -hsts")
+	fs.StringVar(&QuotaTag, "quota-tag", "default", "budget to account this run against")
+	fs.BoolVar(&QuotaWarn, "quota-warn", false, "only warn when the quota would be exceeded")
+	fs.Var(&SNIOverrides, "sni",
+		"TLS server name to send and verify, as name or host=name (repeatable)")
+	fs.StringVar(&CACert, "cacert", "", "trust only the CA certificates in this PEM file")
+	fs.StringVar(&ClientCert, "cert", "", "present this PEM client certificate, for mutual TLS")
+	fs.StringVar(&ClientKey, "key", "", "private key of -cert, if not in the same file")
+	fs.BoolVar(&Insecure, "insecure", false, "do not verify server certificates")
+	fs.StringVar(&TLSMin, "tls-min", "", "lowest TLS version to accept: 1.0, 1.1, 1.2 or 1.3")
+	fs.Var(&Pins, "pin-sha256",
+		"only accept host if its certificate chain has this key, as host=base64 SHA-256 of the SPKI (repeatable)")
+	fs.IntVar(&ShardIndex, "shard-index", -1,
+		"index of this shard (defaults to $JOB_COMPLETION_INDEX)")
+	fs.IntVar(&ShardCount, "shard-count", 1,
+		"number of shards the list is partitioned into")
+	registerChaosFlags(fs)
+	fs.VisitAll(func(f *flag.Flag) { sharedFlags[f.Name] = true })
+}
 
-		offset = offsetTo
-		chunk++
+// setup applies the parsed transfer options. It must run before the first
+// request is sent.
+func setup() error {
+	if err := setupLogging(); err != nil {
+		return err
+	}
+	if err := resolveShard(); err != nil {
+		return err
+	}
+	if err := setupQuota(); err != nil {
+		return err
+	}
+	for _, m := range Mirrors {
+		if u, err := url.Parse(m); err != nil || u.Host == "" {
+			return fmt.Errorf("invalid -mirror %q, want an absolute URL", m)
+		}
+	}
+	if AdaptiveChunks && (MinChunkSize <= 0 || MaxChunkSize < MinChunkSize) {
+		return fmt.Errorf("-adaptive-chunks needs 0 < -min-chunk <= -max-chunk")
+	}
+	if Window < 0 {
+		return fmt.Errorf("invalid -window %d: want 0 or more", Window)
+	}
+	if WindowMemory < 0 {
+		return fmt.Errorf("invalid -window-memory %v: want 0 or more", int64(WindowMemory))
+	}
+	if SpoolDir != "" {
+		if Window > 0 || WindowMemory > 0 {
+			return fmt.Errorf("-window and -window-memory cannot be combined with -spool-dir")
+		}
+		if Hedge {
+			return fmt.Errorf("-hedge cannot be combined with -spool-dir")
+		}
+		if fi, err := os.Stat(SpoolDir); err != nil || !fi.IsDir() {
+			return fmt.Errorf("invalid -spool-dir %q: want a directory", SpoolDir)
+		}
+	}
+	if MaxIdlePerHost < 0 {
+		return fmt.Errorf("invalid -max-idle-per-host %d: want 0 or more", MaxIdlePerHost)
+	}
+	if DNSCacheTTL < 0 {
+		return fmt.Errorf("invalid -dns-cache-ttl %v: want 0 or more", DNSCacheTTL)
+	}
+	if MaxPerHost < 0 {
+		return fmt.Errorf("invalid -max-per-host %d: want 0 or more", MaxPerHost)
+	}
+	if MinInterval < 0 {
+		return fmt.Errorf("invalid -min-request-interval %v: want 0 or more", MinInterval)
+	}
+	if S3Endpoint != "" {
+		if u, err := url.Parse(S3Endpoint); err != nil || u.Host == "" || u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("invalid -s3-endpoint %q: want an http:// or https:// URL", S3Endpoint)
+		}
+	}
+	switch S3Addressing {
+	case "auto", "path", "virtual":
+	default:
+		return fmt.Errorf("invalid -s3-addressing %q: want auto, path or virtual", S3Addressing)
+	}
+	if MaxRedirects < 0 {
+		return fmt.Errorf("invalid -max-redirects %d: want 0 or more", MaxRedirects)
+	}
+	if RecursiveList && MaxListDepth < 1 {
+		return fmt.Errorf("invalid -max-list-depth %d: want 1 or more", MaxListDepth)
+	}
+	if ListSuffix != "" && !RecursiveList {
+		return fmt.Errorf("-list-suffix needs -recursive-list")
+	}
+	if _, ok := fairPolicies[Fair]; !ok {
+		return fmt.Errorf("invalid -fair %q: want file, byte or priority", Fair)
+	}
+	if Fair != "" && LimitRate <= 0 {
+		return fmt.Errorf("-fair needs -limit-rate")
+	}
+	if err := configureTransport(); err != nil {
+		return err
+	}
+	if err := setupProgress(); err != nil {
+		return err
 	}
 
+	dl = downloader.New(httpClient)
+	dl.MaxRetry = MaxRetry
+	dl.RetryInitial = RetryInitial
+	dl.RetryMax = RetryMax
+	dl.RetryMultiplier = RetryMultiplier
+	dl.NetworkWait = NetworkWait
+	dl.ChunkSize = int64(BatchSizeInMB) << 20
+	dl.AdaptiveChunks = AdaptiveChunks
+	dl.MinChunkSize = int64(MinChunkSize)
+	dl.MaxChunkSize = int64(MaxChunkSize)
+	dl.Workers = Parallel
+	dl.SmallSize = int64(SmallSize)
+	dl.HugeSize = int64(HugeSize)
+	dl.HugeWorkers = HugeWorkers
+	dl.Hedge = Hedge
+	dl.SpoolDir = SpoolDir
+	dl.Window = Window
+	dl.WindowMemory = int64(WindowMemory)
+	dl.Mirrors = Mirrors
+	dl.SpeedLimit = int64(SpeedLimit)
+	dl.SpeedTime = time.Duration(SpeedTimeSec) * time.Second
+	dl.RateLimit = int64(LimitRate)
+	dl.ConnRateLimit = int64(LimitRateConn)
+	dl.Fair = fairPolicies[Fair]
+	dl.ListTimeout = ListTimeout
+	dl.ChunkTimeout = ChunkTimeout
+	dl.MaxListSize = int64(MaxListSize)
+	dl.MaxLineLength = int(MaxLineLength)
+	dl.ExpandEnv = ExpandEnv
+	dl.StrictEnv = StrictEnv
+	dl.EnvAllow = EnvAllow
+	dl.Manifest = Manifest
+	dl.Glob = Glob
+	dl.RecursiveLists = RecursiveList
+	dl.ListSuffix = ListSuffix
+	dl.MaxListDepth = MaxListDepth
+	dl.Schemes = append(append([]string{"data"}, fileSchemes...), objectStoreSchemes...)
+	dl.Log = logger
+	dl.OnRetry = prog.retry
+	dl.OnChunk = prog.chunk
 	return nil
 }
 
-func downloadList(url string) ([]string, error) {
-	resp, err := http.Get(url)
+// loadList fetches the list of files, from -list-mirror too, and narrows
+// it to this shard.
+func loadList(ctx context.Context, url string) ([]string, error) {
+	files, err := fetchList(ctx, url)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-
-	list := []string{}
-
-	scanner := bufio.NewScanner(resp.Body)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if !strings.HasPrefix(line, "http") {
-			continue
-		}
+	return shardList(files), nil
+}
 
-		list = append(list, line)
+// fetchList fetches the whole list of files, from -list-mirror too.
+func fetchList(ctx context.Context, url string) ([]string, error) {
+	dl.AddMirrors(url, ListMirrors...)
+	return dl.DownloadList(ctx, url)
+}
 
-		err := scanner.Err()
-		if err != nil {
-			return nil, err
-		}
+// shardList narrows files to this shard.
+func shardList(files []string) []string {
+	if ShardCount > 1 {
+		files = shardEntries(files, ShardIndex, ShardCount)
+		infof("shard %v/%v: %v entries", ShardIndex, ShardCount, len(files))
 	}
+	return files
+}
 
-	return list, nil
+var subcommands = map[string]func(args []string){
+	"download":    runDownload,
+	"list":        runList,
+	"resume":      runResume,
+	"get":         runGet,
+	"sync":        runSync,
+	"bundle":      runBundle,
+	"unbundle":    runUnbundle,
+	"repair":      runRepair,
+	"bisect":      runBisect,
+	"history":     runHistory,
+	"probe":       runProbe,
+	"bench":       runBench,
+	"parity":      runParity,
+	"audit":       runAudit,
+	"verify":      runVerify,
+	"merge-index": runMergeIndex,
+	"serve":       runServe,
+	"work":        runWork,
+	"testserve":   runTestserve,
 }
 
 func printUsage() {
 	fmt.Fprintln(
 		os.Stderr,
-		"Usage: gocat -m <max retry> -b <batch size in MB> <url>",
+		"Usage: gocat -m <max retry> -b <batch size in MB>"+
+			" [-speed-limit <bytes/s> -speed-time <sec>] [-hedge]"+
+			" [-shard-index <i> -shard-count <n>] <url>...",
 	)
+	fmt.Fprintln(os.Stderr, "       gocat [options] -i <list file, pipe, unix:socket or ->")
+	fmt.Fprintln(os.Stderr, "       gocat [options] -list <list url>")
+	fmt.Fprintln(os.Stderr, "       gocat download [options] <url>... | -i <list> | -list <list url>")
+	fmt.Fprintln(os.Stderr, "       gocat list [options] <list url> | -i <list>")
+	fmt.Fprintln(os.Stderr, "       gocat resume [options] <state>")
+	fmt.Fprintln(os.Stderr, "       gocat get [options] [-direct] [-mirror <url>]... -o <output> <url>")
+	fmt.Fprintln(os.Stderr, "       gocat sync [options] [-seed <file>] -o <output> <url>")
+	fmt.Fprintln(os.Stderr, "       gocat bundle [options] -o <bundle> <url>")
+	fmt.Fprintln(os.Stderr, "       gocat unbundle [-verify] <bundle>")
+	fmt.Fprintln(os.Stderr, "       gocat repair [options] -o <existing output> <url>")
+	fmt.Fprintln(os.Stderr, "       gocat bisect [options] -o <output> <url>")
+	fmt.Fprintln(os.Stderr, "       gocat history [-check] [url...]")
+	fmt.Fprintln(os.Stderr, "       gocat probe [options] <url>")
+	fmt.Fprintln(os.Stderr, "       gocat bench [options] [-write-config] <url>")
+	fmt.Fprintln(os.Stderr, "       gocat parity [-data <n>] [-parity <n>] [-shard <size>] <file>")
+	fmt.Fprintln(os.Stderr, "       gocat audit [-stdout <output>] <journal>")
+	fmt.Fprintln(os.Stderr, "       gocat verify [-index <index>] [-repair [options]] <output>")
+	fmt.Fprintln(os.Stderr, "       gocat merge-index -o <index> <shard index>...")
+	fmt.Fprintln(os.Stderr, "       gocat serve [options] -listen unix://<path>|tcp://<host:port> [-dir <dir>]")
+	fmt.Fprintln(os.Stderr, "       gocat work [options] -coordinator <url> [-dir <dir>] <manifest id>")
+	fmt.Fprintln(os.Stderr, "       gocat testserve [-addr <host:port>] [options]")
 }
 
 func main() {
+	if runAskpass() {
+		return
+	}
 	if len(os.Args) < 2 {
 		printUsage()
 		os.Exit(1)
 	}
 
-	flag.IntVar(&MaxRetry, "m", 100, "max download retry attempts")
-	flag.IntVar(&BatchSizeInMB, "b", 16, "chunk size")
-	flag.Parse()
+	if cmd, ok := subcommands[os.Args[1]]; ok {
+		cmd(os.Args[2:])
+		return
+	}
+	// gocat without a subcommand downloads, as it did before there were
+	// any.
+	runDownload(os.Args[1:])
+}
 
-	url := flag.Arg(flag.NArg() - 1)
-	files, err := downloadList(url)
-	if err != nil {
+// runDownload is gocat download: it writes the entries given as URLs, -i
+// or -list to stdout or to files.
+func runDownload(args []string) {
+	registerFlags(flag.CommandLine)
+	flag.StringVar(&OutputDir, "o", "",
+		"write each entry to its own file in this directory, or all of them to this disk (see -yes-i-mean-a-device)")
+	flag.BoolVar(&RemoteName, "O", false,
+		"write each entry to its own file named after the URL or Content-Disposition")
+	flag.BoolVar(&SkipExisting, "N", false, "shorthand for -skip-existing")
+	flag.BoolVar(&SkipExisting, "skip-existing", false,
+		"with -o or -O, skip entries whose file is still the version the server has, asked with If-None-Match or If-Modified-Since")
+	flag.StringVar(&SHA256Sums, "sha256sums", "",
+		"verify entries against this sha256sum manifest (URL or file)")
+	flag.StringVar(&NamePolicy, "name-policy", "replace",
+		"what to do with characters a file name cannot hold: replace (with _), encode (as %XX) or error")
+	flag.StringVar(&OnCollision, "on-collision", "error",
+		"what to do when two entries get the same output name: error, suffix (a-1.txt) or overwrite")
+	flag.BoolVar(&WindowsNames, "windows-names", false,
+		"apply Windows file name rules on every OS, e.g. for outputs on an SMB share")
+	flag.StringVar(&PipelineFile, "pipeline", "",
+		"post-process entries by Content-Type per the rules in this file (decompress, extract, pass, skip)")
+	flag.BoolVar(&Decompress, "decompress", false,
+		"undo gzip, zstd, bzip2 or xz compression of entries, found by their Content-Encoding, extension or magic bytes")
+	flag.BoolVar(&YesDevice, "yes-i-mean-a-device", false,
+		"allow -o to name a disk, which is overwritten with the entries back to back")
+	flag.IntVar(&Jobs, "j", 1,
+		"download this many entries at once; on stdout, later ones are fetched ahead into a bounded buffer")
+	flag.StringVar(&Fair, "fair", "",
+		"share -limit-rate between the -j entries in flight evenly (file), by size (byte), or by their priority= (priority)")
+	flag.StringVar(&InputFile, "i", "",
+		"read URLs from this local list, named pipe or unix:socket (- for stdin)")
+	flag.StringVar(&ListURL, "list", "", "download the URLs listed at this URL")
+	flag.StringVar(&RangeSpec, "range", "",
+		"fetch only bytes from-to of each entry, both included, or from- for the rest (sizes such as 4M accepted)")
+	flag.Var(&TailBytes, "tail-bytes", "fetch only the last this many bytes of each entry")
+	flag.StringVar(&Lines, "lines", "",
+		"output only lines N:M of the output, numbered from 1, and stop downloading after line M (N:, :M and N also accepted)")
+	flag.StringVar(&Grep, "grep", "", "output only the lines matching this regular expression")
+	flag.IntVar(&MaxMatches, "max-matches", 0, "with -grep, stop downloading after this many matching lines")
+	flag.DurationVar(&MaxTime, "max-time", 0, "give up on the whole run after this long (0 disables)")
+	flag.StringVar(&Dest, "dest", "",
+		"upload the entries, back to back, to s3://bucket/key or gs://bucket/object (multipart) or with a PUT to an http(s) URL, instead of stdout")
+	flag.Var(&Tees, "tee", "also write the output of stdout, -o device or -dest to this file (repeatable)")
+	flag.StringVar(&TeeOnError, "tee-on-error", "fail",
+		"what to do when a -tee file fails or falls behind: fail the run, or drop the file and go on")
+	flag.StringVar(&Format, "format", "cat",
+		"how entries go to stdout, -o device or -dest: cat (back to back) or tar (one member each, to split them again with tar -x)")
+	flag.Var(&SplitSize, "split-size", "instead of stdout, write the output in volumes of this many bytes, e.g. 100G, to files named by -split-prefix")
+	flag.StringVar(&SplitPrefix, "split-prefix", "",
+		"with -split-size, write <prefix>.000, <prefix>.001, ... and a map of them to <prefix>"+splitMapSuffix)
+	flag.Var(&DestPartSize, "dest-part-size", "part size of a multipart -dest upload, at least 5M")
+	flag.StringVar(&MetricsAddr, "metrics-addr", "",
+		"serve Prometheus metrics of the run at /metrics on this address, e.g. :9090")
+	flag.StringVar(&StatsJSON, "stats-json", "", "write a JSON summary of the run to this file at exit")
+	flag.StringVar(&IndexFile, "index", "",
+		"write where each entry starts and ends in the output, with its SHA-256 and piece hashes, to this file at exit (see gocat verify; with -shard-count, of this shard's output, see gocat merge-index)")
+	flag.BoolVar(&DryRun, "dry-run", false,
+		"only check every entry, and print its size, range support and ETag, the total, and the requests and egress of s3://, gs:// and az:// entries, without downloading")
+	flag.StringVar(&DryRunPricing, "dry-run-pricing", "",
+		"with -dry-run, price the requests and egress of s3://, gs:// and az:// entries from this file of lines <scheme> <$ per 1000 requests> <$ per GiB>")
+	flag.BoolVar(&SkipFailed, "skip-failed", false,
+		"go on with the next entry when one fails for good, and list the failed ones at the end")
+	flag.IntVar(&MaxFailures, "max-failures", 0, "with -skip-failed, give up on the run once this many entries failed (0 disables)")
+	flag.BoolVar(&ZeroFillFailed, "zero-fill-failed", false,
+		"with -skip-failed, write zeros in place of a failed entry, as long as it is, and mark it missing in -index for gocat verify -repair to fetch")
+	flag.Var(&ListMirrors, "list-mirror",
+		"another URL serving the same list as -list, tried when it fails and checked against it (repeatable)")
+	parseFlags(flag.CommandLine, args)
+
+	inputs := flag.NArg()
+	if InputFile != "" {
+		inputs++
+	}
+	if ListURL != "" {
+		inputs++
+	}
+	if inputs == 0 {
+		printUsage()
+		os.Exit(1)
+	}
+	if flag.NArg() > 0 && inputs > flag.NArg() || InputFile != "" && ListURL != "" {
+		log.Fatal("give URLs, -i or -list, not several of them")
+	}
+	if len(ListMirrors) > 0 && ListURL == "" {
+		log.Fatal("-list-mirror needs -list")
+	}
+	if Manifest && InputFile == "" && ListURL == "" {
+		log.Fatal("-manifest needs -i or -list")
+	}
+
+	if OutputDir != "" && isDevice(OutputDir) {
+		if !YesDevice {
+			log.Fatalf("%s is a device; pass -yes-i-mean-a-device to overwrite it", OutputDir)
+		}
+		if RemoteName || PipelineFile != "" || Decompress || ResumeState != "" {
+			log.Fatal("-O, -pipeline, -decompress and -resume cannot write to a device")
+		}
+		OutputDevice, OutputDir = OutputDir, ""
+	}
+
+	switch NamePolicy {
+	case "replace", "encode", "error":
+	default:
+		log.Fatalf("invalid -name-policy %q: want replace, encode or error", NamePolicy)
+	}
+	switch OnCollision {
+	case "error", "suffix", "overwrite":
+	default:
+		log.Fatalf("invalid -on-collision %q: want error, suffix or overwrite", OnCollision)
+	}
+	if err := parseRange(); err != nil {
+		log.Fatal(err)
+	}
+	if NotifyETAWithin > 0 && NotifyCmd == "" {
+		log.Fatal("-notify-eta-within needs -notify-cmd")
+	}
+	if SkipExisting && !outputEnabled() {
+		log.Fatal("-skip-existing needs -o or -O")
+	}
+	if Dest != "" && (outputEnabled() || ResumeState != "") {
+		log.Fatal("-dest cannot be combined with -o, -O or -resume")
+	}
+	if MaxFailures < 0 {
+		log.Fatalf("invalid -max-failures %d: want 0 or more", MaxFailures)
+	}
+	if DryRunPricing != "" && !DryRun {
+		log.Fatal("-dry-run-pricing needs -dry-run")
+	}
+	if MaxFailures > 0 && !SkipFailed {
+		log.Fatal("-max-failures needs -skip-failed")
+	}
+	if ZeroFillFailed && !SkipFailed {
+		log.Fatal("-zero-fill-failed needs -skip-failed")
+	}
+	if ZeroFillFailed && (outputEnabled() || PipelineFile != "" || Decompress || ResumeState != "" || Format == "tar" || Lines != "" || Grep != "") {
+		log.Fatal("-zero-fill-failed cannot be combined with -o, -O, -pipeline, -decompress, -resume, -format tar, -lines or -grep")
+	}
+	if outputEnabled() && ResumeState != "" {
+		log.Fatal("-resume only works on stdout, not with -o or -O")
+	}
+	if IndexFile != "" && (outputEnabled() || PipelineFile != "" || Decompress || ResumeState != "") {
+		log.Fatal("-index cannot be combined with -o, -O, -pipeline, -decompress or -resume")
+	}
+	if (SplitSize > 0) != (SplitPrefix != "") {
+		log.Fatal("-split-size and -split-prefix go together")
+	}
+	if SplitSize < 0 {
+		log.Fatalf("invalid -split-size %v: want more than 0", int64(SplitSize))
+	}
+	if SplitSize > 0 && (outputEnabled() || OutputDevice != "" || Dest != "" || ResumeState != "" || IndexFile != "") {
+		log.Fatal("-split-size cannot be combined with -o, -O, -dest, -resume or -index")
+	}
+	if len(Tees) > 0 && (outputEnabled() || ResumeState != "") {
+		log.Fatal("-tee cannot be combined with -o, -O or -resume")
+	}
+	switch TeeOnError {
+	case "fail", "drop":
+	default:
+		log.Fatalf("invalid -tee-on-error %q: want fail or drop", TeeOnError)
+	}
+	if (Lines != "" || Grep != "") && (outputEnabled() || Format == "tar" || ResumeState != "" || IndexFile != "") {
+		log.Fatal("-lines and -grep cannot be combined with -o, -O, -format tar, -resume or -index")
+	}
+	if MaxMatches < 0 {
+		log.Fatalf("invalid -max-matches %d: want 0 or more", MaxMatches)
+	}
+	if MaxMatches > 0 && Grep == "" {
+		log.Fatal("-max-matches needs -grep")
+	}
+	switch Format {
+	case "cat":
+	case "tar":
+		if outputEnabled() || PipelineFile != "" || Decompress || ResumeState != "" || IndexFile != "" {
+			log.Fatal("-format tar cannot be combined with -o, -O, -pipeline, -decompress, -resume or -index")
+		}
+	default:
+		log.Fatalf("invalid -format %q: want cat or tar", Format)
+	}
+	if Jobs > 1 && ResumeState != "" {
+		log.Fatal("-resume cannot continue a -j run")
+	}
+	if Decompress && ResumeState != "" {
+		log.Fatal("-resume cannot continue a -decompress run")
+	}
+	if PipelineFile != "" {
+		var err error
+		if pipe, err = loadPipeline(PipelineFile); err != nil {
+			log.Fatal(err)
+		}
+		if ResumeState != "" {
+			log.Fatal("-resume cannot continue a -pipeline run")
+		}
+		if !outputEnabled() && pipe.extracts() {
+			log.Fatal("the extract action needs -o or -O")
+		}
+	}
+
+	if err := setup(); err != nil {
+		log.Fatal(err)
+	}
+	if err := setupStats(); err != nil {
 		log.Fatal(err)
 	}
 
-	for _, file := range files {
-		if err := downloadAndWrite(file, os.Stdout); err != nil {
+	ctx := interruptContext()
+	if MaxTime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, MaxTime, fmt.Errorf("gave up after -max-time %v", MaxTime))
+		defer cancel()
+	}
+	src := inputName(flag.Args())
+	if resumeList != "" {
+		src = resumeList
+	}
+
+	if Dest != "" && !DryRun {
+		var err error
+		if dest, err = openDest(ctx, Dest); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if IndexFile != "" && !DryRun {
+		outputIndex = newIndexWriter(IndexFile, src)
+		if ShardCount > 1 {
+			outputIndex.shard = &indexShard{Index: ShardIndex, Count: ShardCount}
+		}
+	}
+
+	if SplitSize > 0 && !DryRun {
+		split = newSplitWriter(SplitPrefix, int64(SplitSize))
+	}
+
+	if len(Tees) > 0 && !DryRun {
+		var err error
+		if tee, err = openTee(Tees); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if Lines != "" || Grep != "" {
+		var err error
+		if filter, err = newLineFilter(Lines, Grep, MaxMatches); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if SHA256Sums != "" {
+		var err error
+		if sha256Sums, err = loadSHA256Sums(ctx, SHA256Sums); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if InputFile != "" && streamedInput() {
+		// Nothing can be known about entries that have not arrived yet.
+		if wholeListNeeded() {
+			log.Fatal("-preflight, -dry-run, -confirm, -resume, sharding and devices need the whole list up front")
+		}
+		stream, err := openInput()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer stream.Close()
+
+		r := newRun(ctx)
+		r.listenKeys()
+		i := 0
+		err = dl.ScanList(ctx, stream, src, nil, func(entry string) error {
+			r.start(i, entry)
+			i++
+			return nil
+		})
+		if err != nil {
+			r.fail(err)
+		}
+		r.finish()
+		return
+	}
+
+	var files []string
+	var err error
+	switch {
+	case ListURL != "":
+		files, err = loadList(ctx, ListURL)
+	case InputFile != "":
+		files, err = readInput(ctx)
+		files = shardList(files)
+	default:
+		files, err = directEntries(flag.Args())
+		files = shardList(files)
+	}
+	if err != nil {
+		fatal(ctx, err)
+	}
+
+	if DryRun {
+		if err := dryRun(ctx, os.Stdout, files); err != nil {
+			fatal(ctx, err)
+		}
+		return
+	}
+
+	var sizes []int64
+	// A device is only written to once the image is known to fit.
+	if Preflight || Confirm || ConfirmAbove > 0 || OutputDevice != "" {
+		sizes, err = preflight(ctx, files)
+		if err != nil {
+			fatal(ctx, err)
+		}
+		if quota != nil {
+			var total int64
+			for _, size := range sizes {
+				total += max(size, 0)
+			}
+			if err := quota.check(src, total); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if Confirm || ConfirmAbove > 0 {
+			if err := confirmDownload(files, sizes); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	if OutputDevice != "" {
+		if device, err = openDevice(OutputDevice, sizes); err != nil {
 			log.Fatal(err)
 		}
 	}
 
-	fmt.Fprintln(os.Stderr, "COMPLETED!")
+	r := newRun(ctx)
+	prog.setTotal(len(files), sizes)
+	if ResumeState != "" {
+		r.resume, err = openResume(ResumeState, src, files, os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	r.listenKeys()
+	for i, file := range files {
+		r.start(i, file)
+	}
+	r.finish()
 }
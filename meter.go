@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+var Meter bool
+
+const meterInterval = 500 * time.Millisecond
+
+// meter counts bytes passing through to the output and keeps a single
+// pv-style status line (bytes, current rate, elapsed) updated on stderr.
+type meter struct {
+	w     io.Writer
+	bytes atomic.Int64
+	start time.Time
+	done  chan struct{}
+	exit  chan struct{}
+}
+
+func newMeter(w io.Writer) *meter {
+	m := &meter{
+		w:     w,
+		start: time.Now(),
+		done:  make(chan struct{}),
+		exit:  make(chan struct{}),
+	}
+	go m.run()
+	return m
+}
+
+func (m *meter) Write(p []byte) (int, error) {
+	n, err := m.w.Write(p)
+	m.bytes.Add(int64(n))
+	return n, err
+}
+
+func (m *meter) run() {
+	defer close(m.exit)
+
+	ticker := time.NewTicker(meterInterval)
+	defer ticker.Stop()
+
+	last := int64(0)
+	lastAt := m.start
+	for {
+		select {
+		case <-m.done:
+			m.print(m.bytes.Load(), 0, time.Now(), true)
+			return
+		case now := <-ticker.C:
+			cur := m.bytes.Load()
+			rate := float64(cur-last) / now.Sub(lastAt).Seconds()
+			last, lastAt = cur, now
+			m.print(cur, rate, now, false)
+		}
+	}
+}
+
+func (m *meter) print(n int64, rate float64, now time.Time, final bool) {
+	elapsed := now.Sub(m.start)
+	if final {
+		rate = float64(n) / elapsed.Seconds()
+	}
+
+	end := ""
+	if final {
+		end = "\n"
+	}
+	fmt.Fprintf(
+		os.Stderr,
+		"\r%10v %10v/s %v\033[K%s",
+		formatSize(n),
+		formatSize(int64(rate)),
+		formatElapsed(elapsed),
+		end,
+	)
+}
+
+// stop prints the final average and leaves the line in place.
+func (m *meter) stop() {
+	close(m.done)
+	<-m.exit
+}
+
+func formatElapsed(d time.Duration) string {
+	s := int64(d.Seconds())
+	return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+}
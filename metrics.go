@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	tracker "github.com/msmania/gocat/progress"
+)
+
+var (
+	MetricsAddr string
+	StatsJSON   string
+)
+
+// runStats counts the run for -metrics-addr and -stats-json.
+type runStats struct {
+	start  time.Time
+	bytes  *tracker.Counter
+	chunks atomic.Int64
+	done   atomic.Int64
+	failed atomic.Int64
+
+	mu   sync.Mutex
+	rate float64
+}
+
+// stats is nil unless -metrics-addr or -stats-json is given.
+var stats *runStats
+
+func setupStats() error {
+	if MetricsAddr == "" && StatsJSON == "" {
+		return nil
+	}
+	stats = &runStats{
+		start: time.Now(),
+		bytes: tracker.NewCounter(-1, 0, progressWindow),
+	}
+	go stats.sample()
+	if MetricsAddr == "" {
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", MetricsAddr)
+	if err != nil {
+		return fmt.Errorf("-metrics-addr: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", stats.serveMetrics)
+	go http.Serve(ln, mux)
+	infof("serving metrics on http://%v/metrics", ln.Addr())
+	return nil
+}
+
+// sample keeps the current rate, averaged over progressWindow intervals
+// like the status line.
+func (s *runStats) sample() {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		_, rate := s.bytes.Sample(now)
+		s.mu.Lock()
+		s.rate = rate
+		s.mu.Unlock()
+	}
+}
+
+func (s *runStats) currentRate() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rate
+}
+
+func (s *runStats) chunk() {
+	if s != nil {
+		s.chunks.Add(1)
+	}
+}
+
+func (s *runStats) entryEnded(err error) {
+	switch {
+	case s == nil:
+	case err != nil:
+		s.failed.Add(1)
+	default:
+		s.done.Add(1)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelURL is rawURL as a label: scheme://host/path, without the user, the
+// query or the fragment, where credentials and signatures go, since anyone
+// who can scrape the metrics sees the labels.
+func labelURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "invalid"
+	}
+	u = &url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path, RawPath: u.RawPath}
+	return labelEscaper.Replace(u.String())
+}
+
+// serveMetrics writes the Prometheus text format.
+func (s *runStats) serveMetrics(w http.ResponseWriter, req *http.Request) {
+	retries.mu.Lock()
+	retried, backoff := retries.total, retries.backoff
+	retries.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(bw, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	metric("gocat_start_time_seconds", "gauge", "When the run started, in seconds since the epoch.")
+	fmt.Fprintf(bw, "gocat_start_time_seconds %.3f\n", float64(s.start.UnixMilli())/1000)
+	metric("gocat_bytes_total", "counter", "Bytes written to the outputs by this run.")
+	fmt.Fprintf(bw, "gocat_bytes_total %v\n", s.bytes.Bytes())
+	metric("gocat_throughput_bytes_per_second", "gauge", "Rate of the last few seconds.")
+	fmt.Fprintf(bw, "gocat_throughput_bytes_per_second %v\n", s.currentRate())
+	metric("gocat_chunks_total", "counter", "Chunks started.")
+	fmt.Fprintf(bw, "gocat_chunks_total %v\n", s.chunks.Load())
+	metric("gocat_retries_total", "counter", "Failed attempts that were retried.")
+	fmt.Fprintf(bw, "gocat_retries_total %v\n", retried)
+	metric("gocat_retry_backoff_seconds_total", "counter", "Time spent waiting before retries.")
+	fmt.Fprintf(bw, "gocat_retry_backoff_seconds_total %v\n", backoff.Seconds())
+	metric("gocat_entries_total", "counter", "Entries finished, by result.")
+	fmt.Fprintf(bw, "gocat_entries_total{result=\"done\"} %v\n", s.done.Load())
+	fmt.Fprintf(bw, "gocat_entries_total{result=\"failed\"} %v\n", s.failed.Load())
+
+	entries := prog.snapshot()
+	metric("gocat_entry_bytes", "gauge", "Bytes of each entry in flight, resumed ones included.")
+	for _, e := range entries {
+		fmt.Fprintf(bw, "gocat_entry_bytes{url=\"%v\"} %v\n", labelURL(e.url), e.bytes)
+	}
+	metric("gocat_entry_size_bytes", "gauge", "Size of each entry in flight whose size is known.")
+	for _, e := range entries {
+		if e.size >= 0 {
+			fmt.Fprintf(bw, "gocat_entry_size_bytes{url=\"%v\"} %v\n", labelURL(e.url), e.size)
+		}
+	}
+	bw.Flush()
+}
+
+// entryState is an entry in flight as the metrics show it.
+type entryState struct {
+	url   string
+	bytes int64
+	size  int64
+}
+
+func (p *progress) snapshot() []entryState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entries := make([]*progressEntry, 0, len(p.active))
+	for _, e := range p.active {
+		entries = append(entries, e)
+	}
+	slices.SortFunc(entries, func(a, b *progressEntry) int { return a.index - b.index })
+	states := make([]entryState, len(entries))
+	for i, e := range entries {
+		states[i] = entryState{e.url, e.counter.Bytes(), e.size}
+	}
+	return states
+}
+
+// runSummary is what -stats-json writes at exit.
+type runSummary struct {
+	Start          string   `json:"start"`
+	End            string   `json:"end"`
+	Seconds        float64  `json:"seconds"`
+	Bytes          int64    `json:"bytes"`
+	Rate           float64  `json:"rate"`
+	Chunks         int64    `json:"chunks"`
+	Retries        int      `json:"retries"`
+	BackoffSeconds float64  `json:"backoff_seconds"`
+	EntriesDone    int64    `json:"entries_done"`
+	EntriesFailed  int64    `json:"entries_failed"`
+	Failures       []string `json:"failures,omitempty"`
+}
+
+// writeStats writes the -stats-json summary of the run.
+func (r *run) writeStats() {
+	if stats == nil || StatsJSON == "" {
+		return
+	}
+	end := time.Now()
+	sum := runSummary{
+		Start:         stats.start.Format(time.RFC3339),
+		End:           end.Format(time.RFC3339),
+		Seconds:       end.Sub(stats.start).Seconds(),
+		Bytes:         stats.bytes.Bytes(),
+		Chunks:        stats.chunks.Load(),
+		EntriesDone:   stats.done.Load(),
+		EntriesFailed: stats.failed.Load(),
+	}
+	if sum.Seconds > 0 {
+		sum.Rate = float64(sum.Bytes) / sum.Seconds
+	}
+	retries.mu.Lock()
+	sum.Retries, sum.BackoffSeconds = retries.total, retries.backoff.Seconds()
+	retries.mu.Unlock()
+	r.mu.Lock()
+	sum.Failures = slices.Clone(r.failures)
+	r.mu.Unlock()
+
+	b, err := json.MarshalIndent(sum, "", "  ")
+	if err == nil {
+		err = os.WriteFile(StatsJSON, append(b, '\n'), 0644)
+	}
+	if err != nil {
+		warnf("writing -stats-json: %v", err)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	NamePolicy   string
+	WindowsNames bool
+)
+
+// maxNameBytes is the longest file name most file systems accept.
+const maxNameBytes = 255
+
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+func windowsRules() bool {
+	return WindowsNames || runtime.GOOS == "windows"
+}
+
+func invalidNameRune(r rune) bool {
+	if r == 0 || r == '/' {
+		return true
+	}
+	return windowsRules() && (r < 0x20 || strings.ContainsRune(`<>:"\|?*`, r))
+}
+
+// sanitizeName makes a name taken from a URL or Content-Disposition safe to
+// create. Per -name-policy, invalid characters are replaced with "_",
+// percent-encoded, or refused. Under Windows rules, reserved device names
+// such as CON or LPT1.txt get a "_" appended to their stem and trailing
+// dots and spaces are dropped. Over-long names are shortened, keeping the
+// extension.
+func sanitizeName(name string) (string, error) {
+	var b strings.Builder
+	for _, r := range name {
+		if !invalidNameRune(r) {
+			b.WriteRune(r)
+			continue
+		}
+		switch NamePolicy {
+		case "encode":
+			fmt.Fprintf(&b, "%%%02X", r)
+		case "error":
+			return "", fmt.Errorf("file name %q contains %q; see -name-policy", name, r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	name = b.String()
+
+	if windowsRules() {
+		name = strings.TrimRight(name, ". ")
+		stem, ext, _ := strings.Cut(name, ".")
+		if windowsReserved[strings.ToUpper(strings.TrimRight(stem, " "))] {
+			if NamePolicy == "error" {
+				return "", fmt.Errorf("file name %q is a reserved device name on Windows", name)
+			}
+			name = stem + "_"
+			if ext != "" {
+				name += "." + ext
+			}
+		}
+	}
+
+	return shortenName(name, maxNameBytes), nil
+}
+
+// shortenName cuts name to at most n bytes, keeping its extension unless
+// that takes more than half of them.
+func shortenName(name string, n int) string {
+	if len(name) <= n {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if len(ext) > n/2 {
+		ext = ""
+	}
+	stem := name[:n-len(ext)]
+	for !utf8.ValidString(stem) {
+		stem = stem[:len(stem)-1]
+	}
+	return stem + ext
+}
+
+// partName is the hidden temporary that becomes name on commit,
+// "."+name+"."+tag+".part", with name shortened so that the whole still
+// fits maxNameBytes. A tag of "*" is for os.CreateTemp, which replaces it
+// with up to 10 digits.
+func partName(name, tag string) string {
+	n := len(tag)
+	if tag == "*" {
+		n = 10
+	}
+	return "." + shortenName(name, maxNameBytes-len("."+"."+".part")-n) + "." + tag + ".part"
+}
+
+// longPath turns a Windows path beyond MAX_PATH into its \\?\ form, and a
+// UNC path into \\?\UNC\, so deep mirrored trees do not fail partway.
+// Elsewhere it returns p unchanged.
+func longPath(p string) string {
+	if runtime.GOOS != "windows" || strings.HasPrefix(p, `\\?\`) {
+		return p
+	}
+	abs, err := filepath.Abs(p)
+	// 248 leaves room below MAX_PATH for the names of the files inside.
+	if err != nil || len(abs) < 248 {
+		return p
+	}
+	if strings.HasPrefix(abs, `\\`) {
+		return `\\?\UNC\` + abs[2:]
+	}
+	return `\\?\` + abs
+}
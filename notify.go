@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	NotifyCmd       string
+	NotifyETAWithin time.Duration
+)
+
+const notifyTimeout = time.Minute
+
+// notifications are the -notify-cmd runs still going, which the progress
+// reporter waits for when it stops.
+var notifications sync.WaitGroup
+
+// notify runs -notify-cmd in the background with message as its last
+// argument, and with GOCAT_EVENT set to event and env added to its
+// environment.
+func notify(event, message string, env ...string) {
+	args := strings.Fields(NotifyCmd)
+	if len(args) == 0 {
+		return
+	}
+	notifications.Add(1)
+	go func() {
+		defer notifications.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, args[0], append(args[1:], message)...)
+		cmd.Env = append(append(os.Environ(), "GOCAT_EVENT="+event), env...)
+		cmd.Stdout = prog.logWriter()
+		cmd.Stderr = prog.logWriter()
+		if err := cmd.Run(); err != nil {
+			warnf("-notify-cmd: %v", err.Error())
+		}
+	}()
+}
+
+// checkETA fires the "eta" notification the first time the run is
+// expected to finish within -notify-eta-within. The ETA is only known with
+// the total size, so for a single entry or after -preflight. p.mu must be
+// held.
+func (p *progress) checkETA(now time.Time, eta float64) {
+	if p.etaNotified || eta < 0 || now.Sub(p.start) < progressWindow*progressInterval {
+		// The first estimates are too unsettled to act on.
+		return
+	}
+	left := time.Duration(eta) * time.Second
+	if left > NotifyETAWithin {
+		return
+	}
+	p.etaNotified = true
+	notify(
+		"eta",
+		fmt.Sprintf("gocat: about %v left", formatElapsed(left)),
+		fmt.Sprintf("GOCAT_ETA_SECONDS=%v", int64(eta)),
+	)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// objectStoreSchemes are the URL schemes served natively: s3://bucket/key,
+// gs://bucket/object and az://account/container/blob.
+var objectStoreSchemes = []string{"s3", "gs", "az"}
+
+// tokenRefreshMargin is how long before expiry a credential is renewed, so
+// it never runs out while a chunk is in flight.
+const tokenRefreshMargin = 5 * time.Minute
+
+// objectStore serves one URL scheme by pointing requests at the service's
+// HTTPS endpoint and authenticating them with whatever credentials the
+// service's usual environment and SDK chains provide, or none.
+type objectStore interface {
+	// prepare rewrites req, a private clone, in place and signs it.
+	prepare(req *http.Request) error
+}
+
+// objectStoreRetrier is an objectStore that can learn from the response to
+// req, as it was before prepare, and have it sent again; S3 uses this to
+// follow a bucket to its region.
+type objectStoreRetrier interface {
+	retry(req *http.Request, resp *http.Response) bool
+}
+
+// objectStoreChecker is an objectStore that vets the final response to req,
+// as it was before prepare; GCS uses this to pin the generation of an
+// object and to refuse bytes it transcoded.
+type objectStoreChecker interface {
+	check(req *http.Request, resp *http.Response) error
+}
+
+// objectStoreTransport turns s3://, gs:// and az:// requests into ordinary
+// HTTPS ones, so chunking, retries and parallelism work as for any URL.
+type objectStoreTransport struct {
+	base   http.RoundTripper
+	stores map[string]objectStore
+}
+
+func newObjectStoreTransport(base http.RoundTripper) *objectStoreTransport {
+	return &objectStoreTransport{
+		base: base,
+		stores: map[string]objectStore{
+			"s3": newS3Store(),
+			"gs": newGCSStore(),
+			"az": newAzureStore(),
+		},
+	}
+}
+
+func (t *objectStoreTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	store, ok := t.stores[req.URL.Scheme]
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+	if req.URL.Host == "" {
+		return nil, fmt.Errorf("%s: missing bucket", req.URL.Redacted())
+	}
+
+	out := req.Clone(req.Context())
+	if err := store.prepare(out); err != nil {
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(out)
+	if err != nil {
+		return nil, err
+	}
+	if r, ok := store.(objectStoreRetrier); ok && r.retry(req, resp) {
+		resp.Body.Close()
+		out = req.Clone(req.Context())
+		if req.GetBody != nil {
+			// The first attempt used up the body of an upload.
+			if out.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		if err := store.prepare(out); err != nil {
+			return nil, err
+		}
+		if resp, err = t.base.RoundTrip(out); err != nil {
+			return nil, err
+		}
+	}
+	if c, ok := store.(objectStoreChecker); ok {
+		if err := c.check(req, resp); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+	// Relative list entries resolve against the s3:// URL, not the endpoint.
+	resp.Request = req
+	return resp, nil
+}
+
+// cachedToken holds a bearer token and fetches a new one shortly before the
+// old one expires.
+type cachedToken struct {
+	fetch func(ctx context.Context) (string, time.Time, error)
+
+	mu      sync.Mutex
+	value   string
+	expires time.Time
+}
+
+func (c *cachedToken) get(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.value != "" && (c.expires.IsZero() || time.Until(c.expires) > tokenRefreshMargin) {
+		return c.value, nil
+	}
+	value, expires, err := c.fetch(ctx)
+	if err != nil {
+		return "", err
+	}
+	c.value, c.expires = value, expires
+	return value, nil
+}
+
+var (
+	// credentialClient talks to token services, through any proxy.
+	credentialClient = &http.Client{Timeout: 30 * time.Second}
+	// metadataClient talks to link-local instance metadata services, which
+	// are never behind a proxy and are given up on quickly off the cloud.
+	metadataClient = &http.Client{
+		Timeout:   2 * time.Second,
+		Transport: &http.Transport{Proxy: nil},
+	}
+)
+
+// fetchJSON sends req and decodes a 2xx JSON answer into v.
+func fetchJSON(client *http.Client, req *http.Request, v any) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s %s: %v: %s", req.Method, req.URL.Redacted(), resp.Status,
+			strings.TrimSpace(string(body)))
+	}
+	return json.Unmarshal(body, v)
+}
+
+// tokenResponse is the OAuth 2.0 access token answer shared by Google,
+// Microsoft and the metadata servers.
+type tokenResponse struct {
+	AccessToken string      `json:"access_token"`
+	ExpiresIn   json.Number `json:"expires_in"`
+}
+
+func (r *tokenResponse) expiry() time.Time {
+	secs, err := r.ExpiresIn.Int64()
+	if err != nil || secs <= 0 {
+		return time.Now().Add(time.Hour)
+	}
+	return time.Now().Add(time.Duration(secs) * time.Second)
+}
+
+// readINI parses the INI files the AWS CLI keeps its settings in into
+// section → key → value. A missing file is empty.
+func readINI(path string) (map[string]map[string]string, error) {
+	sections := map[string]map[string]string{}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return sections, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cur map[string]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || line[0] == '#' || line[0] == ';':
+		case line[0] == '[' && strings.HasSuffix(line, "]"):
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			if sections[name] == nil {
+				sections[name] = map[string]string{}
+			}
+			cur = sections[name]
+		case cur != nil:
+			if k, v, ok := strings.Cut(line, "="); ok {
+				cur[strings.TrimSpace(k)] = strings.TrimSpace(v)
+			}
+		}
+	}
+	return sections, scanner.Err()
+}
+
+func homeFile(parts ...string) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(append([]string{home}, parts...)...)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+var Offline bool
+
+// offlineError is what reaching addr gets with -offline. It is permanent,
+// so nothing retries it.
+func offlineError(addr string) error {
+	return &downloader.PermanentError{Err: fmt.Errorf("-offline: not connecting to %s", addr)}
+}
+
+// offlineDial is an http.Transport DialContext function that never dials.
+func offlineDial(_ context.Context, _, addr string) (net.Conn, error) {
+	return nil, offlineError(addr)
+}
+
+// goOffline cuts the HTTP clients off the network for -offline: the
+// ladder the entries and lists go through, and http.DefaultTransport,
+// which Vault, object store credentials, PAC files and the coordinator
+// use. ftp:// and sftp:// check Offline themselves. What -replay recorded
+// is then all a run has to answer from, and a request it did not record
+// fails at once rather than after every retry.
+func goOffline() error {
+	if RecordDir != "" || Via != "" {
+		return errors.New("-offline cannot be combined with -record or -via")
+	}
+	ladder.each(func(t *http.Transport) { t.DialContext = offlineDial })
+	if t, ok := http.DefaultTransport.(*http.Transport); ok {
+		t.DialContext = offlineDial
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOffline(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		hits.Add(1)
+		http.ServeContent(w, req, "", time.Time{}, strings.NewReader("online\n"))
+	}))
+	t.Cleanup(srv.Close)
+	def := http.DefaultTransport.(*http.Transport)
+	dial := def.DialContext
+	t.Cleanup(func() { def.DialContext = dial })
+
+	dir := t.TempDir()
+	r, out, _ := testRun(t, func() { RecordDir = dir })
+	runEntries(t, r, srv.URL+"/recorded")
+	if got := out.String(); got != "online\n" {
+		t.Fatalf("recording: output %q", got)
+	}
+
+	before := hits.Load()
+	r, out, _ = testRun(t, func() {
+		SkipFailed = true
+		Offline, ReplayDir = true, dir
+	})
+	runEntries(t, r, srv.URL+"/recorded", srv.URL+"/not-recorded", "ftp://"+strings.TrimPrefix(srv.URL, "http://")+"/f")
+	if got := out.String(); got != "online\n" {
+		t.Errorf("output %q, want only the recorded entry", got)
+	}
+	if len(r.failures) != 2 || !strings.Contains(r.failures[0], "no recorded response") || !strings.Contains(r.failures[1], "-offline") {
+		t.Errorf("failures %q, want the unrecorded and the ftp:// entry", r.failures)
+	}
+	if n := hits.Load() - before; n != 0 {
+		t.Errorf("%v requests reached the server", n)
+	}
+
+	// Without -replay, clients outside the ladder are cut off too.
+	testRun(t, func() { Offline = true })
+	if _, err := http.Get(srv.URL); err == nil || !strings.Contains(err.Error(), "-offline: not connecting to") {
+		t.Errorf("got %v, want the default transport refusing to dial", err)
+	}
+
+	Offline, Via = true, "jump.example"
+	defer func() { Offline, Via = false, "" }()
+	if err := configureTransport(); err == nil || !strings.Contains(err.Error(), "-offline cannot be combined") {
+		t.Errorf("got %v, want -via refused", err)
+	}
+}
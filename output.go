@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	neturl "net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+var (
+	OutputDir   string
+	RemoteName  bool
+	OnCollision string
+)
+
+func outputEnabled() bool {
+	return OutputDir != "" || RemoteName
+}
+
+// outputName picks the local name for url: the list's out= field, the
+// server's Content-Disposition filename when given, otherwise the last
+// segment of the URL path. Directory parts are dropped so a name cannot
+// escape the output directory.
+func outputName(url string, info downloader.Info) (string, error) {
+	name := info.Filename
+	if meta, ok := dl.Meta(url); ok && meta.Output != "" {
+		name = meta.Output
+	}
+	if name == "" {
+		u, err := neturl.Parse(url)
+		if err != nil {
+			return "", err
+		}
+		name = path.Base(u.Path)
+	}
+	return cleanName(url, name)
+}
+
+// cleanName makes name, given for url, a name in the output directory.
+func cleanName(url, name string) (string, error) {
+	name = filepath.Base(filepath.FromSlash(path.Base(name)))
+	if name == "." || name == ".." || name == "/" || name == string(filepath.Separator) {
+		return "", fmt.Errorf("%s: cannot derive a filename; list it with a file path", url)
+	}
+	name, err := sanitizeName(name)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", url, err)
+	}
+	if name == "" {
+		return "", fmt.Errorf("%s: cannot derive a filename; list it with a file path", url)
+	}
+	return name, nil
+}
+
+// outputFile is an entry being written to its own file. Data goes to a
+// hidden temporary next to the final path, which only appears on commit,
+// so an interrupted run never leaves a truncated file under the real name.
+type outputFile struct {
+	*os.File
+	path string
+}
+
+func createOutput(url string, info downloader.Info) (*outputFile, error) {
+	name, err := outputName(url, info)
+	if err != nil {
+		return nil, err
+	}
+	dir := OutputDir
+	if dir == "" {
+		dir = "."
+	}
+	return openOutput(dir, name)
+}
+
+// entryRoute returns the output= field of url's list line, if any.
+func entryRoute(url string) string {
+	meta, _ := dl.Meta(url)
+	return meta.Route
+}
+
+// routedFile reports whether an output= field is a path to write the
+// entry to.
+func routedFile(route string) bool {
+	return route != "" && route != "-" && !strings.HasPrefix(route, "s3://")
+}
+
+// createRouted starts the file of an entry whose output= is a path, which
+// is taken below -o's directory, or the current one. Each part of the path
+// goes through -name-policy, as names taken from URLs do.
+func createRouted(route string) (*outputFile, error) {
+	dir := OutputDir
+	if dir == "" {
+		dir = "."
+	}
+	parts := strings.Split(route, "/")
+	for i, part := range parts {
+		name, err := sanitizeName(part)
+		if err != nil {
+			return nil, fmt.Errorf("output=%v: %w", route, err)
+		}
+		parts[i] = name
+	}
+	p := filepath.Join(dir, filepath.Join(parts...))
+	return openOutput(filepath.Dir(p), filepath.Base(p))
+}
+
+func openOutput(dir, name string) (*outputFile, error) {
+	dir = longPath(dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(dir, partName(name, "*"))
+	if err != nil {
+		return nil, err
+	}
+	return &outputFile{File: f, path: filepath.Join(dir, name)}, nil
+}
+
+func (f *outputFile) commit() error {
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), f.path)
+}
+
+func (f *outputFile) abort() {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// claimOutput reserves f.path for entry i, file, or applies -on-collision
+// when an earlier entry of the run has it: error stops the run, suffix
+// numbers the name and overwrite lets the later entry replace the earlier
+// one. Entries claim in list order, so -j picks the names a run one entry
+// at a time would.
+func (r *run) claimOutput(i int, file string, f *outputFile) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for r.claimTurn < i {
+		r.claimCond.Wait()
+	}
+	defer r.passClaimLocked(i)
+
+	prev, taken := r.outputs[f.path]
+	if taken {
+		switch OnCollision {
+		case "suffix":
+			orig := f.path
+			for n := 1; taken; n++ {
+				f.path = suffixedName(orig, n)
+				_, taken = r.outputs[f.path]
+			}
+			warnf("%s and %s would both be written to %v, writing %v instead", prev, file, orig, f.path)
+		case "overwrite":
+			warnf("%s replaces %s at %v", file, prev, f.path)
+		default:
+			f.abort()
+			return fmt.Errorf("%s and %s would both be written to %v", prev, file, f.path)
+		}
+	}
+	r.outputs[f.path] = file
+	return nil
+}
+
+// passClaim lets the entries after i claim their outputs, once i has or
+// turned out not to need one.
+func (r *run) passClaim(i int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.passClaimLocked(i)
+}
+
+func (r *run) passClaimLocked(i int) {
+	if i < r.claimTurn {
+		return
+	}
+	r.passed[i] = true
+	for r.passed[r.claimTurn] {
+		delete(r.passed, r.claimTurn)
+		r.claimTurn++
+	}
+	r.claimCond.Broadcast()
+}
+
+// commitOutput moves entry i into place, unless a later entry of the list
+// that was downloaded at the same time already replaced it.
+func (r *run) commitOutput(i int, f *outputFile) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if last, ok := r.committed[f.path]; ok && last > i {
+		f.abort()
+		return nil
+	}
+	r.committed[f.path] = i
+	return f.commit()
+}
+
+// holds reports whether path was last committed by entry i.
+func (r *run) holds(i int, path string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	last, ok := r.committed[path]
+	return ok && last == i
+}
+
+// suffixedName numbers path before its extension: a.txt becomes a-1.txt
+// and a.tar.gz a-1.tar.gz.
+func suffixedName(path string, n int) string {
+	dir, name := filepath.Split(path)
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	if strings.HasSuffix(stem, ".tar") {
+		stem, ext = strings.TrimSuffix(stem, ".tar"), ".tar"+ext
+	}
+	if stem == "" {
+		stem, ext = name, ""
+	}
+	return filepath.Join(dir, fmt.Sprintf("%s-%d%s", stem, n, ext))
+}
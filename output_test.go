@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+func TestCreateOutputMaxLengthName(t *testing.T) {
+	dir := t.TempDir()
+	testRun(t, func() { OutputDir = dir })
+	t.Cleanup(func() { OutputDir = "" })
+
+	name := strings.Repeat("a", maxNameBytes-len(".bin")) + ".bin"
+	f, err := createOutput("http://example.com/"+name, downloader.Info{Size: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(filepath.Base(f.Name())); n > maxNameBytes {
+		t.Errorf("temporary name is %v bytes, want at most %v", n, maxNameBytes)
+	}
+	if _, err := f.WriteString("data"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.commit(); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(b) != "data" {
+		t.Errorf("read %q, %v; want the committed data under the full name", b, err)
+	}
+}
+
+func TestCreateRoutedNamePolicy(t *testing.T) {
+	dir := t.TempDir()
+	OutputDir, WindowsNames = dir, true
+	t.Cleanup(func() { OutputDir, WindowsNames, NamePolicy = "", false, "" })
+
+	f, err := createRouted("sub:1/a?b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.abort()
+	if want := filepath.Join(dir, "sub_1", "a_b.txt"); f.path != want {
+		t.Errorf("routed to %v, want %v", f.path, want)
+	}
+
+	NamePolicy = "error"
+	if _, err := createRouted("sub/a?b.txt"); err == nil || !strings.Contains(err.Error(), "see -name-policy") {
+		t.Errorf("with -name-policy error: %v", err)
+	}
+}
+
+// testS3 is an S3 endpoint taking multipart uploads, and the objects they
+// made, by path.
+func testS3(t *testing.T) map[string][]byte {
+	t.Helper()
+	var mu sync.Mutex
+	parts := map[string][]byte{}
+	objects := map[string][]byte{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		body, _ := io.ReadAll(req.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case req.Method == "POST" && q.Has("uploads"):
+			fmt.Fprint(w, "<InitiateMultipartUploadResult><UploadId>up-1</UploadId></InitiateMultipartUploadResult>")
+		case req.Method == "PUT" && q.Get("uploadId") == "up-1":
+			parts[req.URL.Path] = append(parts[req.URL.Path], body...)
+			w.Header().Set("ETag", `"part"`)
+		case req.Method == "POST" && q.Get("uploadId") == "up-1":
+			objects[req.URL.Path] = parts[req.URL.Path]
+			fmt.Fprint(w, "<CompleteMultipartUploadResult/>")
+		default:
+			http.Error(w, "unexpected", http.StatusBadRequest)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	t.Setenv("AWS_ENDPOINT_URL", srv.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	return objects
+}
+
+// listEntries reads list, relative to base, into dl and returns its
+// entries.
+func listEntries(t *testing.T, base, list string) []string {
+	t.Helper()
+	u, _ := url.Parse(base + "/")
+	var entries []string
+	err := dl.ScanList(context.Background(), strings.NewReader(list), "list", u, func(e string) error {
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestEntryRoutes(t *testing.T) {
+	objects := testS3(t)
+	// The routed path is taken in the current directory.
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	r, out, base := testRun(t, func() { Manifest = true })
+	t.Cleanup(func() { Manifest = false })
+	runEntries(t, r, listEntries(t, base, strings.Join([]string{
+		"/a.txt output=sub/a.txt",
+		"/b.html",
+		"/a.txt?copy output=s3://bucket/dir/a.txt",
+		"/a.txt?stream output=-",
+	}, "\n"))...)
+
+	if got := out.String(); got != "<html>\nplain\n" {
+		t.Errorf("output %q, want only the entries left on it", got)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "sub", "a.txt")); err != nil || string(b) != "plain\n" {
+		t.Errorf("sub/a.txt: %q, %v", b, err)
+	}
+	if b := objects["/bucket/dir/a.txt"]; string(b) != "plain\n" {
+		t.Errorf("uploaded %q, want the entry", b)
+	}
+}
+
+func TestEntryRoutesWithOutputDir(t *testing.T) {
+	dir := t.TempDir()
+	r, out, base := testRun(t, func() { OutputDir = dir })
+	t.Cleanup(func() { OutputDir = "" })
+	runEntries(t, r, listEntries(t, base, "/a.txt output=-\n/b.html\n/a.txt?x output=sub/x.txt\n")...)
+
+	if got := out.String(); got != "plain\n" {
+		t.Errorf("output %q, want the entry routed to it", got)
+	}
+	for name, want := range map[string]string{"b.html": "<html>\n", "sub/x.txt": "plain\n"} {
+		if b, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(b) != want {
+			t.Errorf("%v: %q, %v; want %q", name, b, err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.txt")); err == nil {
+		t.Error("a.txt was written though routed to the stream")
+	}
+}
+
+func TestListFields(t *testing.T) {
+	dir := t.TempDir()
+	r, _, base := testRun(t, func() {
+		OutputDir = dir
+		SkipFailed = true
+	})
+	t.Cleanup(func() { OutputDir = "" })
+	sum := sha256.Sum256([]byte("plain\n"))
+	runEntries(t, r, listEntries(t, base, strings.Join([]string{
+		"/a.txt out=renamed.txt size=6 sha256=" + hex.EncodeToString(sum[:]),
+		"/b.html?size out=size.html size=99",
+		"/b.html?sum out=sum.html sha256=" + strings.Repeat("0", 64),
+	}, "\n"))...)
+
+	if b, err := os.ReadFile(filepath.Join(dir, "renamed.txt")); err != nil || string(b) != "plain\n" {
+		t.Errorf("renamed.txt: %q, %v", b, err)
+	}
+	if len(r.failures) != 2 || !strings.Contains(r.failures[0], "the list says 99") || !strings.Contains(r.failures[1], "sha256") {
+		t.Errorf("failures %q, want the size= and sha256= mismatches", r.failures)
+	}
+	for _, name := range []string{"size.html", "sum.html"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			t.Errorf("%v was kept though it failed its check", name)
+		}
+	}
+}
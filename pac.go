@@ -0,0 +1,380 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+var ProxyPAC string
+
+// pacProxy picks a proxy per request by running FindProxyForURL from a
+// proxy auto-config file. Results are cached per URL as offered to the
+// script, so each entry is evaluated once rather than once per chunk. The
+// script runs outside mu, which guards only the cache, so one lookup
+// waiting on DNS holds up no other.
+type pacProxy struct {
+	script *pacScript
+	mu     sync.Mutex
+	cache  map[string]*url.URL
+}
+
+// loadPAC reads a PAC file from a URL or a local path. The file is fetched
+// without a proxy, since it is what decides the proxy.
+func loadPAC(src string) (*pacProxy, error) {
+	var body []byte
+	var err error
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		client := &http.Client{Timeout: time.Minute}
+		var resp *http.Response
+		if resp, err = client.Get(src); err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("fetching PAC %s: %v", src, resp.Status)
+		}
+		body, err = io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	} else {
+		body, err = os.ReadFile(src)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	script, err := parsePACScript(string(body), pacBuiltins)
+	if err != nil {
+		return nil, fmt.Errorf("PAC %s: %w", src, err)
+	}
+	if _, ok := script.funcs["FindProxyForURL"]; !ok {
+		return nil, fmt.Errorf("PAC %s does not define FindProxyForURL", src)
+	}
+	return &pacProxy{script: script, cache: map[string]*url.URL{}}, nil
+}
+
+// proxy is an http.Transport Proxy function.
+func (p *pacProxy) proxy(req *http.Request) (*url.URL, error) {
+	target := *req.URL
+	target.User = nil
+	if target.Scheme == "https" {
+		// Like browsers, only reveal the origin of HTTPS URLs to the script.
+		target.Path, target.RawPath, target.RawQuery = "/", "", ""
+	}
+	key := target.String()
+
+	p.mu.Lock()
+	u, ok := p.cache[key]
+	p.mu.Unlock()
+	if ok {
+		return u, nil
+	}
+
+	v, err := p.script.call("FindProxyForURL", key, target.Hostname())
+	if err != nil {
+		// A script that fails once fails every time.
+		return nil, &downloader.PermanentError{Err: fmt.Errorf("PAC FindProxyForURL(%q): %w", key, err)}
+	}
+	result, _ := v.(string)
+	u, err = parsePACResult(result)
+	if err != nil {
+		return nil, &downloader.PermanentError{Err: err}
+	}
+	via := "DIRECT"
+	if u != nil {
+		via = u.Host
+	}
+	infof("PAC: %s via %v", key, via)
+	p.mu.Lock()
+	p.cache[key] = u
+	p.mu.Unlock()
+	return u, nil
+}
+
+// parsePACResult turns "PROXY a:8080; SOCKS b:1080; DIRECT" into the first
+// proxy to use, nil meaning DIRECT. http.Transport cannot fail over within
+// a request, so later alternatives are ignored.
+func parsePACResult(result string) (*url.URL, error) {
+	first, _, _ := strings.Cut(result, ";")
+	fields := strings.Fields(first)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	kind := strings.ToUpper(fields[0])
+	if kind == "DIRECT" {
+		return nil, nil
+	}
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("malformed PAC result %q", result)
+	}
+	scheme := map[string]string{
+		"PROXY":  "http",
+		"HTTP":   "http",
+		"HTTPS":  "https",
+		"SOCKS":  "socks5",
+		"SOCKS5": "socks5",
+	}[kind]
+	if scheme == "" {
+		return nil, fmt.Errorf("unsupported PAC result %q", result)
+	}
+	return &url.URL{Scheme: scheme, Host: fields[1]}, nil
+}
+
+var pacBuiltins = map[string]pacBuiltin{
+	"isPlainHostName": func(args []any) (any, error) {
+		return !strings.Contains(pacArg(args, 0), "."), nil
+	},
+	"dnsDomainIs": func(args []any) (any, error) {
+		return strings.HasSuffix(strings.ToLower(pacArg(args, 0)), strings.ToLower(pacArg(args, 1))), nil
+	},
+	"localHostOrDomainIs": func(args []any) (any, error) {
+		host, hostdom := strings.ToLower(pacArg(args, 0)), strings.ToLower(pacArg(args, 1))
+		return host == hostdom || !strings.Contains(host, ".") && strings.HasPrefix(hostdom, host+"."), nil
+	},
+	"isResolvable": func(args []any) (any, error) {
+		return pacResolve(pacArg(args, 0)) != nil, nil
+	},
+	"dnsResolve": func(args []any) (any, error) {
+		if ip := pacResolve(pacArg(args, 0)); ip != nil {
+			return ip.String(), nil
+		}
+		return nil, nil
+	},
+	"isInNet": func(args []any) (any, error) {
+		ip := pacResolve(pacArg(args, 0))
+		pattern := net.ParseIP(pacArg(args, 1)).To4()
+		mask := net.ParseIP(pacArg(args, 2)).To4()
+		if ip == nil || pattern == nil || mask == nil {
+			return false, nil
+		}
+		m := net.IPMask(mask)
+		return ip.Mask(m).Equal(pattern.Mask(m)), nil
+	},
+	"myIpAddress": func(args []any) (any, error) {
+		// Connecting a UDP socket sends nothing but picks the outgoing
+		// interface.
+		conn, err := net.Dial("udp4", "192.0.2.1:9")
+		if err != nil {
+			return "127.0.0.1", nil
+		}
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+	},
+	"dnsDomainLevels": func(args []any) (any, error) {
+		return float64(strings.Count(pacArg(args, 0), ".")), nil
+	},
+	"shExpMatch": func(args []any) (any, error) {
+		return shExpMatch(pacArg(args, 0), pacArg(args, 1)), nil
+	},
+	"alert": func(args []any) (any, error) {
+		return nil, nil
+	},
+	"weekdayRange": pacWeekdayRange,
+	"dateRange":    pacDateRange,
+	"timeRange":    pacTimeRange,
+}
+
+func pacArg(args []any, i int) string {
+	if i >= len(args) {
+		return ""
+	}
+	return pacString(args[i])
+}
+
+// pacResolve returns the first IPv4 address of host, which PAC functions
+// deal in exclusively.
+func pacResolve(host string) net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.To4()
+	}
+	addrs, err := net.LookupIP(host)
+	if err != nil {
+		return nil
+	}
+	for _, a := range addrs {
+		if v4 := a.To4(); v4 != nil {
+			return v4
+		}
+	}
+	return nil
+}
+
+// shExpMatch matches s against a shell expression in which * matches any
+// run of characters, including "/", and ? any single character.
+func shExpMatch(s, pattern string) bool {
+	if pattern == "" {
+		return s == ""
+	}
+	switch pattern[0] {
+	case '*':
+		for i := 0; i <= len(s); i++ {
+			if shExpMatch(s[i:], pattern[1:]) {
+				return true
+			}
+		}
+		return false
+	case '?':
+		return s != "" && shExpMatch(s[1:], pattern[1:])
+	}
+	return s != "" && s[0] == pattern[0] && shExpMatch(s[1:], pattern[1:])
+}
+
+// pacNow is the clock of weekdayRange, dateRange and timeRange.
+var pacNow = time.Now
+
+var (
+	pacWeekdays = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+	pacMonths   = []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}
+)
+
+// pacClock strips the "GMT" that may end the arguments of a time function
+// and returns the time it asks about.
+func pacClock(args []any) ([]any, time.Time) {
+	now := pacNow()
+	if n := len(args); n > 0 && pacString(args[n-1]) == "GMT" {
+		return args[:n-1], now.UTC()
+	}
+	return args, now.Local()
+}
+
+// pacInRange reports whether v is within from and to, a range that wraps
+// around when from is after to, as in weekdayRange("FRI", "MON").
+func pacInRange(v, from, to int) bool {
+	if from <= to {
+		return from <= v && v <= to
+	}
+	return v >= from || v <= to
+}
+
+// pacWeekdayRange is weekdayRange(wd1[, wd2][, "GMT"]).
+func pacWeekdayRange(args []any) (any, error) {
+	args, now := pacClock(args)
+	if len(args) == 0 || len(args) > 2 {
+		return false, nil
+	}
+	from := slices.Index(pacWeekdays, pacString(args[0]))
+	to := from
+	if len(args) == 2 {
+		to = slices.Index(pacWeekdays, pacString(args[1]))
+	}
+	if from < 0 || to < 0 {
+		return false, nil
+	}
+	return pacInRange(int(now.Weekday()), from, to), nil
+}
+
+// pacTimeRange is timeRange(hour1[, hour2]), with minutes after each hour
+// or minutes and seconds, and an optional "GMT". Each end is inclusive, to
+// the last second of its hour or minute.
+func pacTimeRange(args []any) (any, error) {
+	args, now := pacClock(args)
+	n := make([]int, len(args))
+	for i, a := range args {
+		n[i] = int(pacNumber(a))
+	}
+	var from, to int
+	switch len(n) {
+	case 1:
+		from, to = n[0]*3600, n[0]*3600+3599
+	case 2:
+		from, to = n[0]*3600, n[1]*3600+3599
+	case 4:
+		from, to = n[0]*3600+n[1]*60, n[2]*3600+n[3]*60+59
+	case 6:
+		from, to = n[0]*3600+n[1]*60+n[2], n[3]*3600+n[4]*60+n[5]
+	default:
+		return false, nil
+	}
+	return pacInRange(now.Hour()*3600+now.Minute()*60+now.Second(), from, to), nil
+}
+
+// pacDateRange is dateRange with a day, a month name, a year, or one to
+// three of those for each end of a range, and an optional "GMT". What an
+// end leaves out is the current year, or the whole of its year or month.
+func pacDateRange(args []any) (any, error) {
+	args, now := pacClock(args)
+	type date struct{ day, month, year int }
+	parse := func(args []any) (d date, ok bool) {
+		for _, a := range args {
+			if m := slices.Index(pacMonths, pacString(a)); m >= 0 {
+				d.month = m + 1
+				continue
+			}
+			switch v := int(pacNumber(a)); {
+			case v >= 1 && v <= 31:
+				d.day = v
+			case v > 31:
+				d.year = v
+			default:
+				return d, false
+			}
+		}
+		return d, true
+	}
+	if len(args) == 1 {
+		d, ok := parse(args)
+		switch {
+		case !ok:
+			return false, nil
+		case d.day != 0:
+			return now.Day() == d.day, nil
+		case d.month != 0:
+			return int(now.Month()) == d.month, nil
+		}
+		return now.Year() == d.year, nil
+	}
+	if len(args) == 0 || len(args)%2 != 0 || len(args) > 6 {
+		return false, nil
+	}
+	from, ok1 := parse(args[:len(args)/2])
+	to, ok2 := parse(args[len(args)/2:])
+	if !ok1 || !ok2 {
+		return false, nil
+	}
+
+	// Days alone range within the current month, months alone within the
+	// current year.
+	years := from.year != 0 || to.year != 0
+	if from.year == 0 {
+		from.year = now.Year()
+	}
+	if to.year == 0 {
+		to.year = now.Year()
+	}
+	if from.month == 0 {
+		from.month = 1
+		if from.day != 0 {
+			from.month = int(now.Month())
+		}
+	}
+	if to.month == 0 {
+		to.month = 12
+		if to.day != 0 {
+			to.month = int(now.Month())
+		}
+	}
+	if from.day == 0 {
+		from.day = 1
+	}
+	start := time.Date(from.year, time.Month(from.month), from.day, 0, 0, 0, 0, now.Location())
+	end := time.Date(to.year, time.Month(to.month)+1, 0, 23, 59, 59, 0, now.Location())
+	if to.day != 0 {
+		end = time.Date(to.year, time.Month(to.month), to.day, 23, 59, 59, 0, now.Location())
+	}
+	if !start.After(end) {
+		return !now.Before(start) && !now.After(end), nil
+	}
+	// Without years, a range such as dateRange("DEC", "JAN") wraps around.
+	if !years {
+		return !now.Before(start) || !now.After(end), nil
+	}
+	return false, nil
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The scripts below follow PAC files as deployed: the Netscape example,
+// bypass lists walked by a loop, a switch on the scheme and a regular
+// expression picking a regional proxy.
+var pacSamples = []struct {
+	name   string
+	script string
+	tests  []struct{ url, want string }
+}{
+	{
+		name: "netscape",
+		script: `
+function FindProxyForURL(url, host) {
+    if (isPlainHostName(host) ||
+        dnsDomainIs(host, ".intranet.example.com"))
+        return "DIRECT";
+    else if (shExpMatch(host, "*.example.org"))
+        return "PROXY proxy1.example.com:8080; DIRECT";
+    else
+        return "PROXY proxy.example.com:3128; SOCKS socks.example.com:1080";
+}`,
+		tests: []struct{ url, want string }{
+			{"http://wiki/", "DIRECT"},
+			{"http://hr.intranet.example.com/", "DIRECT"},
+			{"http://www.example.org/", "http://proxy1.example.com:8080"},
+			{"https://example.net/", "http://proxy.example.com:3128"},
+		},
+	},
+	{
+		name: "bypass list",
+		script: `
+var bypass = [
+    "localhost",
+    "*.corp.example.com",
+    "10.*",
+];
+
+function FindProxyForURL(url, host) {
+    host = host.toLowerCase();
+    for (var i = 0; i < bypass.length; i++) {
+        if (shExpMatch(host, bypass[i]))
+            return "DIRECT";
+    }
+    if (isInNet(host, "192.168.0.0", "255.255.0.0"))
+        return "DIRECT";
+    if (url.substring(0, 5) == "http:")
+        return "PROXY web.example.com:80";
+    return "HTTPS secure.example.com:443";
+}`,
+		tests: []struct{ url, want string }{
+			{"http://LocalHost/", "DIRECT"},
+			{"http://build.corp.example.com/", "DIRECT"},
+			{"http://10.1.2.3/", "DIRECT"},
+			{"http://192.168.4.5/", "DIRECT"},
+			{"http://example.com/", "http://web.example.com:80"},
+			{"https://example.com/", "https://secure.example.com:443"},
+		},
+	},
+	{
+		name: "switch",
+		script: `
+function FindProxyForURL(url, host) {
+    var scheme = url.substring(0, url.indexOf(":"));
+    switch (scheme) {
+    case "ftp":
+        return "PROXY ftp.example.com:2121";
+    case "http":
+    case "https":
+        break;
+    default:
+        return "DIRECT";
+    }
+    return "PROXY web.example.com:8080";
+}`,
+		tests: []struct{ url, want string }{
+			{"ftp://files.example.com/", "http://ftp.example.com:2121"},
+			{"http://example.com/", "http://web.example.com:8080"},
+			{"https://example.com/", "http://web.example.com:8080"},
+			{"gopher://example.com/", "DIRECT"},
+		},
+	},
+	{
+		name: "regional",
+		script: `
+var proxies = {
+    "eu": "PROXY eu.example.com:8080",
+    us: "PROXY us.example.com:8080"
+};
+
+function FindProxyForURL(url, host) {
+    if (/^(\d+\.){3}\d+$/.test(host))
+        return "DIRECT";
+    var m = host.match(/\.(eu|us|ap)\.example\.com$/i);
+    if (m && m[1] in proxies)
+        return proxies[m[1]];
+    return "DIRECT";
+}`,
+		tests: []struct{ url, want string }{
+			{"http://8.8.8.8/", "DIRECT"},
+			{"http://shop.eu.example.com/", "http://eu.example.com:8080"},
+			{"http://shop.US.example.com/", "DIRECT"},
+			{"http://shop.us.example.com/", "http://us.example.com:8080"},
+			{"http://shop.ap.example.com/", "DIRECT"},
+		},
+	},
+	{
+		// Each call starts from the globals the script was loaded with.
+		name: "loops",
+		script: `
+var calls = 0;
+
+function depth(host) {
+    var labels = host.split("."), n = 0, i = labels.length;
+    while (i-- > 0) {
+        if (labels[i] == "")
+            continue;
+        n += 1;
+    }
+    do {
+        n *= 1;
+    } while (false);
+    return n;
+}
+
+function FindProxyForURL(url, host) {
+    calls++;
+    if (calls !== 1)
+        return "PROXY stale.example.com:1";
+    for (var k in arguments)
+        calls += 0;
+    return depth(host) < 3 ? "DIRECT" : "PROXY deep.example.com:3128";
+}`,
+		tests: []struct{ url, want string }{
+			{"http://example.com/", "DIRECT"},
+			{"http://example.com./", "DIRECT"},
+			{"http://a.example.com/", "http://deep.example.com:3128"},
+			{"http://example.com/", "DIRECT"},
+		},
+	},
+}
+
+func TestPACSamples(t *testing.T) {
+	for _, s := range pacSamples {
+		t.Run(s.name, func(t *testing.T) {
+			script, err := parsePACScript(s.script, pacBuiltins)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, tt := range s.tests {
+				u, _ := url.Parse(tt.url)
+				v, err := script.call("FindProxyForURL", tt.url, u.Hostname())
+				if err != nil {
+					t.Fatalf("%v: %v", tt.url, err)
+				}
+				result, _ := v.(string)
+				proxy, err := parsePACResult(result)
+				if err != nil {
+					t.Fatalf("%v: %v", tt.url, err)
+				}
+				got := "DIRECT"
+				if proxy != nil {
+					got = proxy.String()
+				}
+				if got != tt.want {
+					t.Errorf("%v: got %v (%q), want %v", tt.url, got, result, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPACUnsupported(t *testing.T) {
+	tests := []struct{ script, want string }{
+		{"function FindProxyForURL(u, h) {\n try { return \"DIRECT\"; } catch (e) {}\n}", "line 2: unsupported PAC construct: try"},
+		{"function FindProxyForURL(u, h) {\n var d = new Date();\n}", "line 2: unsupported PAC construct: new"},
+		{"function FindProxyForURL(u, h) {\n function inner() {}\n}", "line 2: unsupported PAC construct: function declared"},
+		{"var f = (h) => h;", "line 1: unsupported PAC construct: arrow function"},
+		{"function FindProxyForURL(u, h) {\n return h.padStart(9);\n}", "line 2: unsupported PAC construct: method padStart"},
+		{"function FindProxyForURL(u, h) {\n\n return sortIpAddressList(h);\n}", "line 3: unsupported PAC function sortIpAddressList"},
+		{"var re = /(?=www)/;", "line 1: unsupported PAC construct: regular expression"},
+		{"function FindProxyForURL(u, h) {\n for (;;) { break outer; }\n}", "line 2: unsupported PAC construct: labeled break"},
+		{"var s = `${x}`;", "line 1: unsupported PAC construct '`'"},
+		{"var m = 1 & 2;", "line 1: unsupported PAC construct '&'"},
+		{"function FindProxyForURL(u, h) {\n break;\n}", "line 2: break outside a loop or switch"},
+	}
+	for _, tt := range tests {
+		_, err := parsePACScript(tt.script, pacBuiltins)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: got %v, want %q", tt.script, err, tt.want)
+		}
+	}
+}
+
+func TestPACRunaway(t *testing.T) {
+	script, err := parsePACScript(`function FindProxyForURL(u, h) { while (true) {} }`, pacBuiltins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := script.call("FindProxyForURL", "http://a/", "a"); err == nil || !strings.Contains(err.Error(), "ran more than") {
+		t.Errorf("got %v, want the step limit", err)
+	}
+}
+
+func TestPACTimeFunctions(t *testing.T) {
+	// A Wednesday.
+	now := time.Date(2026, 10, 14, 13, 30, 15, 0, time.UTC)
+	pacNow = func() time.Time { return now }
+	t.Cleanup(func() { pacNow = time.Now })
+
+	tests := []struct {
+		fn   string
+		args []any
+		want bool
+	}{
+		{"weekdayRange", []any{"WED", "GMT"}, true},
+		{"weekdayRange", []any{"MON", "FRI", "GMT"}, true},
+		{"weekdayRange", []any{"SAT", "MON", "GMT"}, false},
+		{"weekdayRange", []any{"FRI", "WED", "GMT"}, true},
+		{"weekdayRange", []any{"wed", "GMT"}, false},
+		{"timeRange", []any{13.0, "GMT"}, true},
+		{"timeRange", []any{9.0, 12.0, "GMT"}, false},
+		{"timeRange", []any{12.0, 2.0, "GMT"}, true},
+		{"timeRange", []any{22.0, 6.0, "GMT"}, false},
+		{"timeRange", []any{13.0, 30.0, 13.0, 31.0, "GMT"}, true},
+		{"timeRange", []any{13.0, 0.0, 13.0, 29.0, "GMT"}, false},
+		{"timeRange", []any{13.0, 30.0, 0.0, 13.0, 30.0, 15.0, "GMT"}, true},
+		{"timeRange", []any{13.0, 30.0, 16.0, 13.0, 31.0, 0.0, "GMT"}, false},
+		{"dateRange", []any{14.0, "GMT"}, true},
+		{"dateRange", []any{"OCT", "GMT"}, true},
+		{"dateRange", []any{2026.0, "GMT"}, true},
+		{"dateRange", []any{2025.0, "GMT"}, false},
+		{"dateRange", []any{1.0, 15.0, "GMT"}, true},
+		{"dateRange", []any{15.0, 31.0, "GMT"}, false},
+		{"dateRange", []any{"SEP", "NOV", "GMT"}, true},
+		{"dateRange", []any{"NOV", "FEB", "GMT"}, false},
+		{"dateRange", []any{"SEP", "FEB", "GMT"}, true},
+		{"dateRange", []any{1.0, "JAN", 2026.0, 31.0, "DEC", 2026.0, "GMT"}, true},
+		{"dateRange", []any{"JAN", 2025.0, "DEC", 2025.0, "GMT"}, false},
+		{"dateRange", []any{14.0, "OCT", 14.0, "OCT", "GMT"}, true},
+	}
+	for _, tt := range tests {
+		got, err := pacBuiltins[tt.fn](tt.args)
+		if err != nil || got != tt.want {
+			t.Errorf("%v%v = %v, %v; want %v", tt.fn, tt.args, got, err, tt.want)
+		}
+	}
+}
+
+func TestShExpMatch(t *testing.T) {
+	tests := []struct {
+		s, pattern string
+		want       bool
+	}{
+		{"www.example.com", "*.example.com", true},
+		{"example.com", "*.example.com", false},
+		{"http://example.com/a/b", "*/a/*", true},
+		{"host1", "host?", true},
+		{"host12", "host?", false},
+		{"", "*", true},
+	}
+	for _, tt := range tests {
+		if got := shExpMatch(tt.s, tt.pattern); got != tt.want {
+			t.Errorf("shExpMatch(%q, %q) = %v, want %v", tt.s, tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestParsePACResult(t *testing.T) {
+	tests := []struct{ result, want, err string }{
+		{"DIRECT", "", ""},
+		{"", "", ""},
+		{"PROXY a.example.com:8080; DIRECT", "http://a.example.com:8080", ""},
+		{"socks5 b.example.com:1080", "socks5://b.example.com:1080", ""},
+		{"HTTPS c.example.com:443", "https://c.example.com:443", ""},
+		{"PROXY", "", "malformed PAC result"},
+		{"QUIC d.example.com:443", "", "unsupported PAC result"},
+	}
+	for _, tt := range tests {
+		u, err := parsePACResult(tt.result)
+		got := ""
+		if u != nil {
+			got = u.String()
+		}
+		if got != tt.want || (err == nil) != (tt.err == "") || err != nil && !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("parsePACResult(%q) = %v, %v; want %v, %v", tt.result, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+// TestPACProxyConcurrent checks that a lookup waiting in the script, as on
+// DNS, does not hold up another, and that results are cached.
+func TestPACProxyConcurrent(t *testing.T) {
+	started := make(chan string, 2)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	calls := map[string]int{}
+	builtins := maps.Clone(pacBuiltins)
+	builtins["dnsResolve"] = func(args []any) (any, error) {
+		mu.Lock()
+		calls[pacArg(args, 0)]++
+		mu.Unlock()
+		started <- pacArg(args, 0)
+		<-release
+		return "192.0.2.1", nil
+	}
+	script, err := parsePACScript(`
+function FindProxyForURL(url, host) {
+    if (dnsResolve(host) == "192.0.2.1")
+        return "PROXY p.example.com:3128";
+    return "DIRECT";
+}`, builtins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &pacProxy{script: script, cache: map[string]*url.URL{}}
+
+	var wg sync.WaitGroup
+	for _, host := range []string{"a.example.com", "b.example.com"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", "http://"+host+"/x", nil)
+			u, err := p.proxy(req)
+			if err != nil || u == nil || u.Host != "p.example.com:3128" {
+				t.Errorf("%v: got %v, %v", host, u, err)
+			}
+		}()
+	}
+	for range 2 {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the second lookup waited for the first")
+		}
+	}
+	close(release)
+	wg.Wait()
+
+	req, _ := http.NewRequest("GET", "http://a.example.com/x", nil)
+	if _, err := p.proxy(req); err != nil {
+		t.Fatal(err)
+	}
+	if calls["a.example.com"] != 1 {
+		t.Errorf("script ran %v times for a cached URL", calls["a.example.com"])
+	}
+}
@@ -0,0 +1,1932 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// pacscript is an interpreter for the subset of JavaScript that proxy
+// auto-config files are written in: functions, var, let and const, if,
+// for, for-in, while, do-while and switch, arrays, objects, regular
+// expressions, the usual operators and the string methods PAC files call.
+// Anything else is rejected when the file is loaded, as an unsupported PAC
+// construct with its line, rather than misread or failing the first
+// request.
+
+// pacMaxSteps bounds the statements one call runs, so a script looping
+// forever fails its request rather than hanging it.
+const pacMaxSteps = 1 << 20
+
+type pacToken struct {
+	kind byte // 'i'dent, 'n'umber, 's'tring, 'r'egexp, 'p'unctuation, 0 at the end
+	text string
+	line int
+}
+
+var pacPuncts = []string{
+	"===", "!==", "==", "!=", "<=", ">=", "=>", "&&", "||",
+	"++", "--", "+=", "-=", "*=", "/=", "%=",
+	"(", ")", "{", "}", "[", "]", ",", ";", ".", "=", "!", "<", ">",
+	"+", "-", "*", "/", "%", "?", ":",
+}
+
+func lexPAC(src string) ([]pacToken, error) {
+	var toks []pacToken
+	line := 1
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("line %v: unterminated comment", line)
+			}
+			line += strings.Count(src[i:i+2+end], "\n")
+			i += end + 4
+		case c == '"' || c == '\'':
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(src) && src[j] != c; j++ {
+				if src[j] == '\n' {
+					return nil, fmt.Errorf("line %v: unterminated string", line)
+				}
+				if src[j] == '\\' && j+1 < len(src) {
+					j++
+					switch src[j] {
+					case 'n':
+						b.WriteByte('\n')
+					case 't':
+						b.WriteByte('\t')
+					default:
+						b.WriteByte(src[j])
+					}
+					continue
+				}
+				b.WriteByte(src[j])
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("line %v: unterminated string", line)
+			}
+			toks = append(toks, pacToken{'s', b.String(), line})
+			i = j + 1
+		case c == '/' && pacRegexpAllowed(toks):
+			j, err := lexPACRegexp(src, i, line)
+			if err != nil {
+				return nil, err
+			}
+			toks = append(toks, pacToken{'r', src[i:j], line})
+			i = j
+		case c >= '0' && c <= '9':
+			j := i
+			if strings.HasPrefix(src[i:], "0x") || strings.HasPrefix(src[i:], "0X") {
+				j += 2
+			}
+			for j < len(src) && (src[j] >= '0' && src[j] <= '9' || src[j] == '.' ||
+				j > i+1 && src[i+1]|0x20 == 'x' && (src[j]|0x20 >= 'a' && src[j]|0x20 <= 'f')) {
+				j++
+			}
+			toks = append(toks, pacToken{'n', src[i:j], line})
+			i = j
+		case c == '_' || c == '$' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i
+			for j < len(src) && (src[j] == '_' || src[j] == '$' ||
+				src[j] >= 'a' && src[j] <= 'z' || src[j] >= 'A' && src[j] <= 'Z' ||
+				src[j] >= '0' && src[j] <= '9') {
+				j++
+			}
+			toks = append(toks, pacToken{'i', src[i:j], line})
+			i = j
+		default:
+			matched := false
+			for _, p := range pacPuncts {
+				if strings.HasPrefix(src[i:], p) {
+					toks = append(toks, pacToken{'p', p, line})
+					i += len(p)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("line %v: unsupported PAC construct %q", line, c)
+			}
+		}
+	}
+	return append(toks, pacToken{0, "", line}), nil
+}
+
+// pacRegexpAllowed reports whether a "/" after toks starts a regular
+// expression rather than dividing, as it does where an operand is due.
+func pacRegexpAllowed(toks []pacToken) bool {
+	if len(toks) == 0 {
+		return true
+	}
+	switch last := toks[len(toks)-1]; last.kind {
+	case 'p':
+		return last.text != ")" && last.text != "]"
+	case 'i':
+		switch last.text {
+		case "return", "typeof", "case", "in", "else", "do":
+			return true
+		}
+	}
+	return false
+}
+
+// lexPACRegexp returns the end of the regular expression literal, flags
+// included, starting at src[i].
+func lexPACRegexp(src string, i, line int) (int, error) {
+	class := false
+	for j := i + 1; j < len(src); j++ {
+		switch src[j] {
+		case '\n':
+			return 0, fmt.Errorf("line %v: unterminated regular expression", line)
+		case '\\':
+			j++
+		case '[':
+			class = true
+		case ']':
+			class = false
+		case '/':
+			if class {
+				continue
+			}
+			for j++; j < len(src) && src[j] >= 'a' && src[j] <= 'z'; j++ {
+			}
+			return j, nil
+		}
+	}
+	return 0, fmt.Errorf("line %v: unterminated regular expression", line)
+}
+
+type (
+	pacStmt any
+	pacExpr any
+
+	pacVar struct {
+		name string
+		init pacExpr
+	}
+	pacIf struct {
+		cond      pacExpr
+		then, alt pacStmt
+	}
+	pacBlock  []pacStmt
+	pacReturn struct{ x pacExpr }
+	pacDo     struct{ x pacExpr }
+	pacFor    struct {
+		init       pacStmt
+		cond, post pacExpr
+		body       pacStmt
+	}
+	pacForIn struct {
+		name string
+		x    pacExpr
+		body pacStmt
+	}
+	pacWhile struct {
+		cond pacExpr
+		body pacStmt
+		// do runs the body once before the first test.
+		do bool
+	}
+	pacSwitch struct {
+		x     pacExpr
+		cases []pacCase
+	}
+	pacCase struct {
+		// x is nil for default.
+		x    pacExpr
+		body pacBlock
+	}
+	pacJump pacFlow
+
+	pacLit    struct{ v any }
+	pacIdent  string
+	pacAssign struct {
+		// op is "=" or a compound assignment such as "+=".
+		op     string
+		target pacExpr
+		x      pacExpr
+	}
+	pacIncr struct {
+		target pacExpr
+		delta  float64
+		prefix bool
+	}
+	pacCall struct {
+		fn   pacExpr
+		args []pacExpr
+	}
+	pacMember struct {
+		x    pacExpr
+		name string
+	}
+	pacIndex struct{ x, i pacExpr }
+	pacUnary struct {
+		op string
+		x  pacExpr
+	}
+	pacBinary struct {
+		op   string
+		l, r pacExpr
+	}
+	pacCond      struct{ c, a, b pacExpr }
+	pacArrayLit  []pacExpr
+	pacObjectLit struct {
+		keys []string
+		vals []pacExpr
+	}
+)
+
+// pacFlow is how a statement ends: it falls through to the next one, or
+// returns, breaks or continues.
+type pacFlow int
+
+const (
+	pacNext pacFlow = iota
+	pacReturned
+	pacBroke
+	pacContinued
+)
+
+// The values of a script besides strings, float64 numbers, booleans and
+// nil for null and undefined.
+type (
+	pacArray  struct{ elems []any }
+	pacObject struct {
+		keys []string
+		vals map[string]any
+	}
+	pacRegexp struct {
+		re     *regexp.Regexp
+		src    string
+		global bool
+	}
+)
+
+// pacMethods are the methods a script may call, on strings, arrays and
+// regular expressions; a call of any other is rejected at load.
+var pacMethods = map[string]bool{
+	"toLowerCase": true, "toUpperCase": true, "indexOf": true, "lastIndexOf": true,
+	"substring": true, "substr": true, "slice": true, "charAt": true, "charCodeAt": true,
+	"split": true, "replace": true, "match": true, "search": true, "startsWith": true,
+	"endsWith": true, "includes": true, "trim": true, "concat": true, "toString": true,
+	"join": true, "push": true, "test": true, "exec": true,
+}
+
+type pacFunc struct {
+	params []string
+	body   pacBlock
+}
+
+type pacParser struct {
+	toks []pacToken
+	pos  int
+	// loops and switches count those the parser is in, for break and
+	// continue; calls are the functions called by name, checked once all
+	// are declared.
+	loops, switches int
+	calls           []pacToken
+}
+
+func (p *pacParser) peek() pacToken { return p.toks[p.pos] }
+
+func (p *pacParser) next() pacToken {
+	t := p.toks[p.pos]
+	if t.kind != 0 {
+		p.pos++
+	}
+	return t
+}
+
+func (p *pacParser) is(text string) bool {
+	t := p.peek()
+	return (t.kind == 'p' || t.kind == 'i') && t.text == text
+}
+
+func (p *pacParser) accept(text string) bool {
+	if p.is(text) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *pacParser) expect(text string) error {
+	if !p.accept(text) {
+		return p.errorf("expected %q", text)
+	}
+	return nil
+}
+
+func (p *pacParser) errorf(format string, args ...any) error {
+	t := p.peek()
+	found := t.text
+	if t.kind == 0 {
+		found = "end of file"
+	}
+	return fmt.Errorf("line %v: %v, found %q", t.line, fmt.Sprintf(format, args...), found)
+}
+
+// unsupported rejects what the next token starts.
+func (p *pacParser) unsupported(what string) error {
+	return fmt.Errorf("line %v: unsupported PAC construct: %v", p.peek().line, what)
+}
+
+func (p *pacParser) ident() (string, error) {
+	t := p.peek()
+	if t.kind != 'i' {
+		return "", p.errorf("expected a name")
+	}
+	p.pos++
+	return t.text, nil
+}
+
+// program parses the top level: function declarations and statements,
+// which run once when the script is loaded.
+func (p *pacParser) program() (map[string]*pacFunc, pacBlock, error) {
+	funcs := map[string]*pacFunc{}
+	var init pacBlock
+	for p.peek().kind != 0 {
+		if p.accept("function") {
+			name, err := p.ident()
+			if err != nil {
+				return nil, nil, err
+			}
+			fn, err := p.function()
+			if err != nil {
+				return nil, nil, err
+			}
+			funcs[name] = fn
+			continue
+		}
+		s, err := p.statement()
+		if err != nil {
+			return nil, nil, err
+		}
+		init = append(init, s)
+	}
+	return funcs, init, nil
+}
+
+func (p *pacParser) function() (*pacFunc, error) {
+	fn := &pacFunc{}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	for !p.accept(")") {
+		if len(fn.params) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		fn.params = append(fn.params, name)
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	body, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	fn.body = body
+	return fn, nil
+}
+
+// block parses statements up to and including the closing brace.
+func (p *pacParser) block() (pacBlock, error) {
+	var b pacBlock
+	for !p.accept("}") {
+		if p.peek().kind == 0 {
+			return nil, p.errorf("expected %q", "}")
+		}
+		s, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, s)
+	}
+	return b, nil
+}
+
+// body parses the statement a loop runs.
+func (p *pacParser) body() (pacStmt, error) {
+	p.loops++
+	defer func() { p.loops-- }()
+	return p.statement()
+}
+
+// declarations parses what follows var, let or const.
+func (p *pacParser) declarations() (pacBlock, error) {
+	var decls pacBlock
+	for {
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		v := &pacVar{name: name}
+		if p.accept("=") {
+			if v.init, err = p.expr(); err != nil {
+				return nil, err
+			}
+		}
+		decls = append(decls, v)
+		if !p.accept(",") {
+			return decls, nil
+		}
+	}
+}
+
+// condition parses a parenthesized expression.
+func (p *pacParser) condition() (pacExpr, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	x, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	return x, p.expect(")")
+}
+
+func (p *pacParser) statement() (pacStmt, error) {
+	switch {
+	case p.accept(";"):
+		return pacBlock(nil), nil
+	case p.accept("{"):
+		return p.block()
+	case p.accept("var"), p.accept("let"), p.accept("const"):
+		decls, err := p.declarations()
+		if err != nil {
+			return nil, err
+		}
+		p.accept(";")
+		return decls, nil
+	case p.accept("if"):
+		cond, err := p.condition()
+		if err != nil {
+			return nil, err
+		}
+		s := &pacIf{cond: cond}
+		if s.then, err = p.statement(); err != nil {
+			return nil, err
+		}
+		if p.accept("else") {
+			if s.alt, err = p.statement(); err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+	case p.accept("for"):
+		return p.forStatement()
+	case p.accept("while"):
+		cond, err := p.condition()
+		if err != nil {
+			return nil, err
+		}
+		body, err := p.body()
+		if err != nil {
+			return nil, err
+		}
+		return &pacWhile{cond: cond, body: body}, nil
+	case p.accept("do"):
+		body, err := p.body()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("while"); err != nil {
+			return nil, err
+		}
+		cond, err := p.condition()
+		if err != nil {
+			return nil, err
+		}
+		p.accept(";")
+		return &pacWhile{cond: cond, body: body, do: true}, nil
+	case p.accept("switch"):
+		return p.switchStatement()
+	case p.is("break"), p.is("continue"):
+		t := p.next()
+		if next := p.peek(); next.kind == 'i' && next.line == t.line {
+			return nil, p.unsupported("labeled " + t.text)
+		}
+		p.accept(";")
+		if t.text == "break" {
+			if p.loops == 0 && p.switches == 0 {
+				return nil, fmt.Errorf("line %v: break outside a loop or switch", t.line)
+			}
+			return pacJump(pacBroke), nil
+		}
+		if p.loops == 0 {
+			return nil, fmt.Errorf("line %v: continue outside a loop", t.line)
+		}
+		return pacJump(pacContinued), nil
+	case p.accept("return"):
+		s := &pacReturn{}
+		if !p.is(";") && !p.is("}") {
+			var err error
+			if s.x, err = p.expr(); err != nil {
+				return nil, err
+			}
+		}
+		p.accept(";")
+		return s, nil
+	case p.is("function"):
+		return nil, p.unsupported("function declared inside a block or function")
+	case p.is("try"), p.is("throw"), p.is("with"), p.is("class"), p.is("import"), p.is("export"), p.is("debugger"):
+		return nil, p.unsupported(p.peek().text)
+	}
+	x, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	p.accept(";")
+	return &pacDo{x}, nil
+}
+
+// forStatement parses the three-part for and for-in after "for".
+func (p *pacParser) forStatement() (pacStmt, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	declared := p.accept("var") || p.accept("let") || p.accept("const")
+	if t, n := p.peek(), p.toks[min(p.pos+1, len(p.toks)-1)]; t.kind == 'i' && n.kind == 'i' && n.text == "in" {
+		p.pos += 2
+		x, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		body, err := p.body()
+		if err != nil {
+			return nil, err
+		}
+		return &pacForIn{name: t.text, x: x, body: body}, nil
+	}
+
+	s := &pacFor{}
+	var err error
+	switch {
+	case declared:
+		s.init, err = p.declarations()
+	case !p.is(";"):
+		var x pacExpr
+		x, err = p.expr()
+		s.init = &pacDo{x}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(";"); err != nil {
+		return nil, err
+	}
+	if !p.is(";") {
+		if s.cond, err = p.expr(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect(";"); err != nil {
+		return nil, err
+	}
+	if !p.is(")") {
+		if s.post, err = p.expr(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	if s.body, err = p.body(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// switchStatement parses a switch after "switch".
+func (p *pacParser) switchStatement() (pacStmt, error) {
+	x, err := p.condition()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	p.switches++
+	defer func() { p.switches-- }()
+	s := &pacSwitch{x: x}
+	seenDefault := false
+	for !p.accept("}") {
+		var c pacCase
+		switch {
+		case p.accept("case"):
+			if c.x, err = p.expr(); err != nil {
+				return nil, err
+			}
+		case p.is("default") && !seenDefault:
+			p.pos++
+			seenDefault = true
+		default:
+			return nil, p.errorf("expected case or default")
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		for !p.is("case") && !p.is("default") && !p.is("}") {
+			if p.peek().kind == 0 {
+				return nil, p.errorf("expected %q", "}")
+			}
+			st, err := p.statement()
+			if err != nil {
+				return nil, err
+			}
+			c.body = append(c.body, st)
+		}
+		s.cases = append(s.cases, c)
+	}
+	return s, nil
+}
+
+// pacAssignOps are the assignment operators, and the binary operator each
+// compound one applies.
+var pacAssignOps = map[string]string{"=": "", "+=": "+", "-=": "-", "*=": "*", "/=": "/", "%=": "%"}
+
+func (p *pacParser) expr() (pacExpr, error) {
+	x, err := p.conditional()
+	if err != nil {
+		return nil, err
+	}
+	if p.is("=>") {
+		return nil, p.unsupported("arrow function")
+	}
+	if t := p.peek(); t.kind == 'p' {
+		if _, ok := pacAssignOps[t.text]; ok {
+			if !pacAssignable(x) {
+				return nil, p.errorf("can only assign to a variable, an element or a property")
+			}
+			p.pos++
+			r, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			return &pacAssign{t.text, x, r}, nil
+		}
+	}
+	return x, nil
+}
+
+func pacAssignable(x pacExpr) bool {
+	switch x.(type) {
+	case pacIdent, *pacIndex, *pacMember:
+		return true
+	}
+	return false
+}
+
+func (p *pacParser) conditional() (pacExpr, error) {
+	c, err := p.binary(0)
+	if err != nil || !p.accept("?") {
+		return c, err
+	}
+	a, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	b, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	return &pacCond{c, a, b}, nil
+}
+
+// pacLevels lists binary operators from the loosest binding to the
+// tightest.
+var pacLevels = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "===", "!=="},
+	{"<", ">", "<=", ">=", "in"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *pacParser) binary(level int) (pacExpr, error) {
+	if level == len(pacLevels) {
+		return p.unary()
+	}
+	l, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := ""
+		t := p.peek()
+		for _, o := range pacLevels[level] {
+			if t.text == o && (t.kind == 'p' || t.kind == 'i' && o == "in") {
+				op = o
+			}
+		}
+		if op == "" {
+			return l, nil
+		}
+		p.pos++
+		r, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		l = &pacBinary{op, l, r}
+	}
+}
+
+func (p *pacParser) unary() (pacExpr, error) {
+	switch {
+	case p.is("++"), p.is("--"):
+		delta := 1.0
+		if p.next().text == "--" {
+			delta = -1
+		}
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		if !pacAssignable(x) {
+			return nil, p.errorf("can only increment a variable, an element or a property")
+		}
+		return &pacIncr{x, delta, true}, nil
+	case p.is("!"), p.is("-"), p.is("+"), p.is("typeof"):
+		op := p.next().text
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &pacUnary{op, x}, nil
+	case p.is("new"), p.is("delete"), p.is("void"), p.is("this"), p.is("function"):
+		return nil, p.unsupported(p.peek().text)
+	}
+	return p.postfix()
+}
+
+func (p *pacParser) postfix() (pacExpr, error) {
+	x, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept("."):
+			t := p.peek()
+			name, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			if p.is("(") && !pacMethods[name] {
+				return nil, fmt.Errorf("line %v: unsupported PAC construct: method %v", t.line, name)
+			}
+			x = &pacMember{x, name}
+		case p.is("("):
+			t := p.toks[p.pos-1]
+			p.pos++
+			if id, ok := x.(pacIdent); ok {
+				p.calls = append(p.calls, pacToken{'i', string(id), t.line})
+			}
+			call := &pacCall{fn: x}
+			for !p.accept(")") {
+				if len(call.args) > 0 {
+					if err := p.expect(","); err != nil {
+						return nil, err
+					}
+				}
+				arg, err := p.expr()
+				if err != nil {
+					return nil, err
+				}
+				call.args = append(call.args, arg)
+			}
+			x = call
+		case p.accept("["):
+			i, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			x = &pacIndex{x, i}
+		case p.is("++"), p.is("--"):
+			if !pacAssignable(x) {
+				return x, nil
+			}
+			delta := 1.0
+			if p.next().text == "--" {
+				delta = -1
+			}
+			x = &pacIncr{x, delta, false}
+		default:
+			return x, nil
+		}
+	}
+}
+
+func (p *pacParser) primary() (pacExpr, error) {
+	t := p.peek()
+	switch {
+	case t.kind == 's':
+		p.pos++
+		return &pacLit{t.text}, nil
+	case t.kind == 'n':
+		p.pos++
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			var n int64
+			if n, err = strconv.ParseInt(t.text, 0, 64); err != nil {
+				return nil, fmt.Errorf("line %v: bad number %q", t.line, t.text)
+			}
+			f = float64(n)
+		}
+		return &pacLit{f}, nil
+	case t.kind == 'r':
+		p.pos++
+		re, err := compilePACRegexp(t.text)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: unsupported PAC construct: %w", t.line, err)
+		}
+		return &pacLit{re}, nil
+	case p.accept("("):
+		x, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return x, p.expect(")")
+	case p.accept("["):
+		var a pacArrayLit
+		for !p.accept("]") {
+			if len(a) > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+				// A trailing comma ends the list.
+				if p.accept("]") {
+					break
+				}
+			}
+			x, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, x)
+		}
+		return a, nil
+	case p.accept("{"):
+		o := &pacObjectLit{}
+		for !p.accept("}") {
+			if len(o.keys) > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+				if p.accept("}") {
+					break
+				}
+			}
+			k := p.next()
+			if k.kind != 'i' && k.kind != 's' && k.kind != 'n' {
+				return nil, fmt.Errorf("line %v: expected a property name, found %q", k.line, k.text)
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			x, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			o.keys, o.vals = append(o.keys, k.text), append(o.vals, x)
+		}
+		return o, nil
+	case t.kind == 'i':
+		p.pos++
+		switch t.text {
+		case "true":
+			return &pacLit{true}, nil
+		case "false":
+			return &pacLit{false}, nil
+		case "null", "undefined":
+			return &pacLit{nil}, nil
+		}
+		return pacIdent(t.text), nil
+	}
+	return nil, p.errorf("expected an expression")
+}
+
+// compilePACRegexp compiles the literal /pattern/flags. The syntax Go
+// shares with JavaScript covers what PAC files match hosts with;
+// lookarounds and backreferences do not compile.
+func compilePACRegexp(lit string) (*pacRegexp, error) {
+	end := strings.LastIndexByte(lit, '/')
+	pattern, flags := lit[1:end], lit[end+1:]
+	r := &pacRegexp{src: lit}
+	prefix := ""
+	for _, f := range flags {
+		switch f {
+		case 'g':
+			r.global = true
+		case 'i', 'm', 's':
+			prefix += string(f)
+		default:
+			return nil, fmt.Errorf("regular expression flag %q", f)
+		}
+	}
+	if prefix != "" {
+		pattern = "(?" + prefix + ")" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("regular expression %v: %w", lit, err)
+	}
+	r.re = re
+	return r, nil
+}
+
+// pacBuiltin is a predefined PAC function such as shExpMatch.
+type pacBuiltin func(args []any) (any, error)
+
+type pacScope struct {
+	vars   map[string]any
+	parent *pacScope
+}
+
+func (s *pacScope) lookup(name string) (*pacScope, bool) {
+	for ; s != nil; s = s.parent {
+		if _, ok := s.vars[name]; ok {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// pacScript is a parsed script and the globals its top level left. Both
+// stay as they are once loaded: every call runs on a copy of the globals,
+// so calls may run at once.
+type pacScript struct {
+	funcs    map[string]*pacFunc
+	builtins map[string]pacBuiltin
+	globals  *pacScope
+}
+
+func parsePACScript(src string, builtins map[string]pacBuiltin) (*pacScript, error) {
+	toks, err := lexPAC(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &pacParser{toks: toks}
+	funcs, init, err := p.program()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range p.calls {
+		if _, ok := funcs[c.text]; !ok && builtins[c.text] == nil {
+			return nil, fmt.Errorf("line %v: unsupported PAC function %v", c.line, c.text)
+		}
+	}
+	s := &pacScript{funcs: funcs, builtins: builtins, globals: &pacScope{vars: map[string]any{}}}
+	r := &pacRun{script: s, globals: s.globals}
+	if _, _, err := r.exec(init, s.globals); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// call runs the script function name with args.
+func (s *pacScript) call(name string, args ...any) (any, error) {
+	r := &pacRun{script: s, globals: &pacScope{vars: pacCloneVars(s.globals.vars)}}
+	return r.call(name, args)
+}
+
+// pacRun is one call of a script, with the globals it may change.
+type pacRun struct {
+	script  *pacScript
+	globals *pacScope
+	steps   int
+}
+
+func (r *pacRun) call(name string, args []any) (any, error) {
+	if fn, ok := r.script.funcs[name]; ok {
+		return r.invoke(fn, args)
+	}
+	if b, ok := r.script.builtins[name]; ok {
+		return b(args)
+	}
+	return nil, fmt.Errorf("%v is not defined", name)
+}
+
+func (r *pacRun) invoke(fn *pacFunc, args []any) (any, error) {
+	scope := &pacScope{vars: map[string]any{"arguments": &pacArray{slices.Clone(args)}}, parent: r.globals}
+	for i, name := range fn.params {
+		var v any
+		if i < len(args) {
+			v = args[i]
+		}
+		scope.vars[name] = v
+	}
+	v, _, err := r.exec(fn.body, scope)
+	return v, err
+}
+
+// exec runs a statement and reports how it ended.
+func (r *pacRun) exec(stmt pacStmt, scope *pacScope) (any, pacFlow, error) {
+	if r.steps++; r.steps > pacMaxSteps {
+		return nil, pacNext, fmt.Errorf("ran more than %v statements", pacMaxSteps)
+	}
+	switch st := stmt.(type) {
+	case pacBlock:
+		for _, sub := range st {
+			if v, flow, err := r.exec(sub, scope); flow != pacNext || err != nil {
+				return v, flow, err
+			}
+		}
+	case *pacVar:
+		var v any
+		if st.init != nil {
+			var err error
+			if v, err = r.eval(st.init, scope); err != nil {
+				return nil, pacNext, err
+			}
+		}
+		scope.vars[st.name] = v
+	case *pacIf:
+		c, err := r.eval(st.cond, scope)
+		if err != nil {
+			return nil, pacNext, err
+		}
+		if pacTruthy(c) {
+			return r.exec(st.then, scope)
+		}
+		if st.alt != nil {
+			return r.exec(st.alt, scope)
+		}
+	case *pacFor:
+		if st.init != nil {
+			if _, _, err := r.exec(st.init, scope); err != nil {
+				return nil, pacNext, err
+			}
+		}
+		for {
+			if st.cond != nil {
+				c, err := r.eval(st.cond, scope)
+				if err != nil {
+					return nil, pacNext, err
+				}
+				if !pacTruthy(c) {
+					break
+				}
+			}
+			v, flow, err := r.exec(st.body, scope)
+			if err != nil || flow == pacReturned {
+				return v, flow, err
+			}
+			if flow == pacBroke {
+				break
+			}
+			if st.post != nil {
+				if _, err := r.eval(st.post, scope); err != nil {
+					return nil, pacNext, err
+				}
+			}
+		}
+	case *pacForIn:
+		x, err := r.eval(st.x, scope)
+		if err != nil {
+			return nil, pacNext, err
+		}
+		for _, k := range pacKeys(x) {
+			r.set(st.name, k, scope)
+			v, flow, err := r.exec(st.body, scope)
+			if err != nil || flow == pacReturned {
+				return v, flow, err
+			}
+			if flow == pacBroke {
+				break
+			}
+		}
+	case *pacWhile:
+		for first := true; ; first = false {
+			if !first || !st.do {
+				c, err := r.eval(st.cond, scope)
+				if err != nil {
+					return nil, pacNext, err
+				}
+				if !pacTruthy(c) {
+					break
+				}
+			}
+			v, flow, err := r.exec(st.body, scope)
+			if err != nil || flow == pacReturned {
+				return v, flow, err
+			}
+			if flow == pacBroke {
+				break
+			}
+		}
+	case *pacSwitch:
+		x, err := r.eval(st.x, scope)
+		if err != nil {
+			return nil, pacNext, err
+		}
+		start := -1
+		for i, c := range st.cases {
+			if c.x == nil {
+				continue
+			}
+			v, err := r.eval(c.x, scope)
+			if err != nil {
+				return nil, pacNext, err
+			}
+			if pacStrictEqual(x, v) {
+				start = i
+				break
+			}
+		}
+		if start < 0 {
+			start = slices.IndexFunc(st.cases, func(c pacCase) bool { return c.x == nil })
+		}
+		if start < 0 {
+			break
+		}
+		// Cases fall through to the next until a break.
+		for _, c := range st.cases[start:] {
+			v, flow, err := r.exec(c.body, scope)
+			if err != nil || flow == pacReturned || flow == pacContinued {
+				return v, flow, err
+			}
+			if flow == pacBroke {
+				break
+			}
+		}
+	case pacJump:
+		return nil, pacFlow(st), nil
+	case *pacReturn:
+		if st.x == nil {
+			return nil, pacReturned, nil
+		}
+		v, err := r.eval(st.x, scope)
+		return v, pacReturned, err
+	case *pacDo:
+		_, err := r.eval(st.x, scope)
+		return nil, pacNext, err
+	}
+	return nil, pacNext, nil
+}
+
+// set assigns the variable name where it is declared, or as a global.
+func (r *pacRun) set(name string, v any, scope *pacScope) {
+	sc, ok := scope.lookup(name)
+	if !ok {
+		sc = r.globals
+	}
+	sc.vars[name] = v
+}
+
+func (r *pacRun) eval(x pacExpr, scope *pacScope) (any, error) {
+	switch e := x.(type) {
+	case *pacLit:
+		return e.v, nil
+	case pacIdent:
+		if sc, ok := scope.lookup(string(e)); ok {
+			return sc.vars[string(e)], nil
+		}
+		return nil, fmt.Errorf("%v is not defined", string(e))
+	case *pacAssign:
+		v, err := r.eval(e.x, scope)
+		if err != nil {
+			return nil, err
+		}
+		if op := pacAssignOps[e.op]; op != "" {
+			old, err := r.eval(e.target, scope)
+			if err != nil {
+				return nil, err
+			}
+			if v, err = pacArith(op, old, v); err != nil {
+				return nil, err
+			}
+		}
+		return v, r.store(e.target, v, scope)
+	case *pacIncr:
+		old, err := r.eval(e.target, scope)
+		if err != nil {
+			return nil, err
+		}
+		n := pacNumber(old)
+		if err := r.store(e.target, n+e.delta, scope); err != nil {
+			return nil, err
+		}
+		if e.prefix {
+			return n + e.delta, nil
+		}
+		return n, nil
+	case *pacCond:
+		c, err := r.eval(e.c, scope)
+		if err != nil {
+			return nil, err
+		}
+		if pacTruthy(c) {
+			return r.eval(e.a, scope)
+		}
+		return r.eval(e.b, scope)
+	case *pacUnary:
+		if id, ok := e.x.(pacIdent); ok && e.op == "typeof" {
+			if _, declared := scope.lookup(string(id)); !declared {
+				if _, ok := r.script.funcs[string(id)]; ok || r.script.builtins[string(id)] != nil {
+					return "function", nil
+				}
+				return "undefined", nil
+			}
+		}
+		v, err := r.eval(e.x, scope)
+		if err != nil {
+			return nil, err
+		}
+		switch e.op {
+		case "!":
+			return !pacTruthy(v), nil
+		case "typeof":
+			return pacTypeof(v), nil
+		case "+":
+			return pacNumber(v), nil
+		}
+		return -pacNumber(v), nil
+	case *pacBinary:
+		return r.evalBinary(e, scope)
+	case *pacMember:
+		v, err := r.eval(e.x, scope)
+		if err != nil {
+			return nil, err
+		}
+		return pacProperty(v, e.name)
+	case *pacIndex:
+		v, err := r.eval(e.x, scope)
+		if err != nil {
+			return nil, err
+		}
+		i, err := r.eval(e.i, scope)
+		if err != nil {
+			return nil, err
+		}
+		return pacElement(v, i)
+	case pacArrayLit:
+		a := &pacArray{make([]any, len(e))}
+		for i, x := range e {
+			v, err := r.eval(x, scope)
+			if err != nil {
+				return nil, err
+			}
+			a.elems[i] = v
+		}
+		return a, nil
+	case *pacObjectLit:
+		o := &pacObject{vals: map[string]any{}}
+		for i, k := range e.keys {
+			v, err := r.eval(e.vals[i], scope)
+			if err != nil {
+				return nil, err
+			}
+			o.set(k, v)
+		}
+		return o, nil
+	case *pacCall:
+		args := make([]any, len(e.args))
+		for i, a := range e.args {
+			v, err := r.eval(a, scope)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = v
+		}
+		switch fn := e.fn.(type) {
+		case pacIdent:
+			return r.call(string(fn), args)
+		case *pacMember:
+			recv, err := r.eval(fn.x, scope)
+			if err != nil {
+				return nil, err
+			}
+			return pacMethod(recv, fn.name, args)
+		}
+		return nil, errors.New("call of a non-function")
+	}
+	return nil, fmt.Errorf("unsupported expression %T", x)
+}
+
+// store assigns v to target, a variable, an element or a property.
+func (r *pacRun) store(target pacExpr, v any, scope *pacScope) error {
+	switch t := target.(type) {
+	case pacIdent:
+		r.set(string(t), v, scope)
+		return nil
+	case *pacIndex:
+		recv, err := r.eval(t.x, scope)
+		if err != nil {
+			return err
+		}
+		i, err := r.eval(t.i, scope)
+		if err != nil {
+			return err
+		}
+		switch recv := recv.(type) {
+		case *pacArray:
+			n := pacNumber(i)
+			if n < 0 || n != math.Trunc(n) || n > 1<<20 {
+				return fmt.Errorf("invalid array index %v", pacString(i))
+			}
+			for int(n) >= len(recv.elems) {
+				recv.elems = append(recv.elems, nil)
+			}
+			recv.elems[int(n)] = v
+			return nil
+		case *pacObject:
+			recv.set(pacString(i), v)
+			return nil
+		}
+		return fmt.Errorf("cannot set an element of %v", pacString(recv))
+	case *pacMember:
+		recv, err := r.eval(t.x, scope)
+		if err != nil {
+			return err
+		}
+		if o, ok := recv.(*pacObject); ok {
+			o.set(t.name, v)
+			return nil
+		}
+		return fmt.Errorf("cannot set property %v of %v", t.name, pacString(recv))
+	}
+	return errors.New("invalid assignment")
+}
+
+func (r *pacRun) evalBinary(e *pacBinary, scope *pacScope) (any, error) {
+	l, err := r.eval(e.l, scope)
+	if err != nil {
+		return nil, err
+	}
+	// && and || short-circuit and yield an operand, as in JavaScript.
+	switch e.op {
+	case "&&":
+		if !pacTruthy(l) {
+			return l, nil
+		}
+		return r.eval(e.r, scope)
+	case "||":
+		if pacTruthy(l) {
+			return l, nil
+		}
+		return r.eval(e.r, scope)
+	}
+	rv, err := r.eval(e.r, scope)
+	if err != nil {
+		return nil, err
+	}
+	switch e.op {
+	case "==":
+		return pacLooseEqual(l, rv), nil
+	case "!=":
+		return !pacLooseEqual(l, rv), nil
+	case "===":
+		return pacStrictEqual(l, rv), nil
+	case "!==":
+		return !pacStrictEqual(l, rv), nil
+	case "in":
+		return slices.Contains(pacKeys(rv), pacString(l)), nil
+	case "<", ">", "<=", ">=":
+		return pacCompare(e.op, l, rv), nil
+	}
+	return pacArith(e.op, l, rv)
+}
+
+func pacArith(op string, l, r any) (any, error) {
+	switch op {
+	case "+":
+		_, lnum := l.(float64)
+		_, rnum := r.(float64)
+		if (lnum || l == nil || pacIsBool(l)) && (rnum || r == nil || pacIsBool(r)) {
+			return pacNumber(l) + pacNumber(r), nil
+		}
+		return pacString(l) + pacString(r), nil
+	case "-":
+		return pacNumber(l) - pacNumber(r), nil
+	case "*":
+		return pacNumber(l) * pacNumber(r), nil
+	case "/":
+		return pacNumber(l) / pacNumber(r), nil
+	case "%":
+		return math.Mod(pacNumber(l), pacNumber(r)), nil
+	}
+	return nil, fmt.Errorf("unsupported operator %v", op)
+}
+
+func pacIsBool(v any) bool {
+	_, ok := v.(bool)
+	return ok
+}
+
+func pacCompare(op string, l, r any) bool {
+	ls, lok := l.(string)
+	rs, rok := r.(string)
+	if lok && rok {
+		switch op {
+		case "<":
+			return ls < rs
+		case ">":
+			return ls > rs
+		case "<=":
+			return ls <= rs
+		default:
+			return ls >= rs
+		}
+	}
+	ln, rn := pacNumber(l), pacNumber(r)
+	switch op {
+	case "<":
+		return ln < rn
+	case ">":
+		return ln > rn
+	case "<=":
+		return ln <= rn
+	default:
+		return ln >= rn
+	}
+}
+
+func pacStrictEqual(l, r any) bool {
+	switch l.(type) {
+	case nil, string, float64, bool, *pacArray, *pacObject, *pacRegexp:
+		return l == r
+	}
+	return false
+}
+
+// pacLooseEqual is ==: values of different types other than null are
+// compared as numbers.
+func pacLooseEqual(l, r any) bool {
+	if l == nil || r == nil {
+		return l == r
+	}
+	switch l.(type) {
+	case *pacArray, *pacObject, *pacRegexp:
+		if _, ok := r.(string); !ok {
+			return l == r
+		}
+		return pacString(l) == r
+	}
+	switch r.(type) {
+	case *pacArray, *pacObject, *pacRegexp:
+		if _, ok := l.(string); !ok {
+			return l == r
+		}
+		return pacString(r) == l
+	}
+	if ls, ok := l.(string); ok {
+		if rs, ok := r.(string); ok {
+			return ls == rs
+		}
+	}
+	return pacNumber(l) == pacNumber(r)
+}
+
+func pacTypeof(v any) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case nil:
+		return "undefined"
+	}
+	return "object"
+}
+
+// pacKeys are what for-in walks and the in operator tests: the indexes of
+// an array or a string, as strings, or the keys of an object.
+func pacKeys(v any) []string {
+	n := 0
+	switch v := v.(type) {
+	case *pacObject:
+		return v.keys
+	case *pacArray:
+		n = len(v.elems)
+	case string:
+		n = len(v)
+	}
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+	return keys
+}
+
+func (o *pacObject) set(k string, v any) {
+	if _, ok := o.vals[k]; !ok {
+		o.keys = append(o.keys, k)
+	}
+	o.vals[k] = v
+}
+
+func pacProperty(v any, name string) (any, error) {
+	switch v := v.(type) {
+	case *pacObject:
+		return v.vals[name], nil
+	case string:
+		if name == "length" {
+			return float64(len(v)), nil
+		}
+	case *pacArray:
+		if name == "length" {
+			return float64(len(v.elems)), nil
+		}
+	case *pacRegexp:
+		switch name {
+		case "source":
+			return v.re.String(), nil
+		case "global":
+			return v.global, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported property %v of %v", name, pacString(v))
+}
+
+func pacElement(v, i any) (any, error) {
+	switch v := v.(type) {
+	case *pacObject:
+		return v.vals[pacString(i)], nil
+	case *pacArray:
+		if n := pacNumber(i); n >= 0 && n < float64(len(v.elems)) && n == math.Trunc(n) {
+			return v.elems[int(n)], nil
+		}
+		if pacString(i) == "length" {
+			return float64(len(v.elems)), nil
+		}
+		return nil, nil
+	case string:
+		if n := pacNumber(i); n >= 0 && n < float64(len(v)) && n == math.Trunc(n) {
+			return v[int(n) : int(n)+1], nil
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("cannot index %v", pacString(v))
+}
+
+// pacCloneVars copies the globals of a script for one call; the arrays and
+// objects in them are copied too, so that the call can change them.
+func pacCloneVars(vars map[string]any) map[string]any {
+	seen := map[any]any{}
+	clone := make(map[string]any, len(vars))
+	for k, v := range vars {
+		clone[k] = pacClone(v, seen)
+	}
+	return clone
+}
+
+func pacClone(v any, seen map[any]any) any {
+	if c, ok := seen[v]; ok {
+		return c
+	}
+	switch v := v.(type) {
+	case *pacArray:
+		c := &pacArray{make([]any, len(v.elems))}
+		seen[v] = c
+		for i, e := range v.elems {
+			c.elems[i] = pacClone(e, seen)
+		}
+		return c
+	case *pacObject:
+		c := &pacObject{keys: slices.Clone(v.keys), vals: make(map[string]any, len(v.vals))}
+		seen[v] = c
+		for k, e := range v.vals {
+			c.vals[k] = pacClone(e, seen)
+		}
+		return c
+	}
+	return v
+}
+
+func pacMethod(recv any, name string, args []any) (any, error) {
+	arg := func(i int) any {
+		if i < len(args) {
+			return args[i]
+		}
+		return nil
+	}
+	if name == "toString" {
+		return pacString(recv), nil
+	}
+	switch recv := recv.(type) {
+	case string:
+		return pacStringMethod(recv, name, args, arg)
+	case *pacArray:
+		switch name {
+		case "indexOf", "lastIndexOf", "includes":
+			i := slices.IndexFunc(recv.elems, func(e any) bool { return pacStrictEqual(e, arg(0)) })
+			if name == "lastIndexOf" {
+				i = -1
+				for j, e := range recv.elems {
+					if pacStrictEqual(e, arg(0)) {
+						i = j
+					}
+				}
+			}
+			if name == "includes" {
+				return i >= 0, nil
+			}
+			return float64(i), nil
+		case "join":
+			sep := ","
+			if arg(0) != nil {
+				sep = pacString(arg(0))
+			}
+			parts := make([]string, len(recv.elems))
+			for i, e := range recv.elems {
+				if e != nil {
+					parts[i] = pacString(e)
+				}
+			}
+			return strings.Join(parts, sep), nil
+		case "push":
+			recv.elems = append(recv.elems, args...)
+			return float64(len(recv.elems)), nil
+		case "slice":
+			from, to := pacSliceBounds(arg(0), arg(1), len(recv.elems))
+			return &pacArray{slices.Clone(recv.elems[from:to])}, nil
+		case "concat":
+			c := &pacArray{slices.Clone(recv.elems)}
+			for _, a := range args {
+				if more, ok := a.(*pacArray); ok {
+					c.elems = append(c.elems, more.elems...)
+				} else {
+					c.elems = append(c.elems, a)
+				}
+			}
+			return c, nil
+		}
+	case *pacRegexp:
+		switch name {
+		case "test":
+			return recv.re.MatchString(pacString(arg(0))), nil
+		case "exec":
+			return pacMatch(recv.re, pacString(arg(0))), nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported method %v on %v", name, pacString(recv))
+}
+
+func pacStringMethod(str, name string, args []any, arg func(int) any) (any, error) {
+	switch name {
+	case "toLowerCase":
+		return strings.ToLower(str), nil
+	case "toUpperCase":
+		return strings.ToUpper(str), nil
+	case "indexOf":
+		from := pacClamp(arg(1), len(str))
+		i := strings.Index(str[from:], pacString(arg(0)))
+		if i >= 0 {
+			i += from
+		}
+		return float64(i), nil
+	case "lastIndexOf":
+		return float64(strings.LastIndex(str, pacString(arg(0)))), nil
+	case "includes":
+		return strings.Contains(str, pacString(arg(0))), nil
+	case "startsWith":
+		return strings.HasPrefix(str, pacString(arg(0))), nil
+	case "endsWith":
+		return strings.HasSuffix(str, pacString(arg(0))), nil
+	case "trim":
+		return strings.TrimSpace(str), nil
+	case "charAt":
+		i := pacNumber(arg(0))
+		if math.IsNaN(i) {
+			i = 0
+		}
+		if i < 0 || i >= float64(len(str)) {
+			return "", nil
+		}
+		return str[int(i) : int(i)+1], nil
+	case "charCodeAt":
+		i := pacNumber(arg(0))
+		if math.IsNaN(i) {
+			i = 0
+		}
+		if i < 0 || i >= float64(len(str)) {
+			return math.NaN(), nil
+		}
+		return float64(str[int(i)]), nil
+	case "substring":
+		from := pacClamp(arg(0), len(str))
+		to := len(str)
+		if arg(1) != nil {
+			to = pacClamp(arg(1), len(str))
+		}
+		if from > to {
+			from, to = to, from
+		}
+		return str[from:to], nil
+	case "substr":
+		from, _ := pacSliceBounds(arg(0), nil, len(str))
+		n := len(str) - from
+		if arg(1) != nil {
+			n = min(pacClamp(arg(1), len(str)), n)
+		}
+		return str[from : from+n], nil
+	case "slice":
+		from, to := pacSliceBounds(arg(0), arg(1), len(str))
+		return str[from:to], nil
+	case "concat":
+		for _, a := range args {
+			str += pacString(a)
+		}
+		return str, nil
+	case "split":
+		var parts []string
+		switch sep := arg(0).(type) {
+		case nil:
+			parts = []string{str}
+		case *pacRegexp:
+			parts = sep.re.Split(str, -1)
+		default:
+			parts = strings.Split(str, pacString(sep))
+		}
+		a := &pacArray{make([]any, len(parts))}
+		for i, s := range parts {
+			a.elems[i] = s
+		}
+		return a, nil
+	case "replace":
+		repl := pacString(arg(1))
+		re, ok := arg(0).(*pacRegexp)
+		if !ok {
+			return strings.Replace(str, pacString(arg(0)), repl, 1), nil
+		}
+		repl = pacReplacement.ReplaceAllString(strings.ReplaceAll(repl, "$&", "${0}"), "$${$1}")
+		if re.global {
+			return re.re.ReplaceAllString(str, repl), nil
+		}
+		loc := re.re.FindStringSubmatchIndex(str)
+		if loc == nil {
+			return str, nil
+		}
+		return str[:loc[0]] + string(re.re.ExpandString(nil, repl, str, loc)) + str[loc[1]:], nil
+	case "match", "search":
+		re, ok := arg(0).(*pacRegexp)
+		if !ok {
+			var err error
+			if re, err = compilePACRegexp("/" + pacString(arg(0)) + "/"); err != nil {
+				return nil, err
+			}
+		}
+		if name == "search" {
+			loc := re.re.FindStringIndex(str)
+			if loc == nil {
+				return -1.0, nil
+			}
+			return float64(loc[0]), nil
+		}
+		if !re.global {
+			return pacMatch(re.re, str), nil
+		}
+		all := re.re.FindAllString(str, -1)
+		if all == nil {
+			return nil, nil
+		}
+		a := &pacArray{make([]any, len(all))}
+		for i, m := range all {
+			a.elems[i] = m
+		}
+		return a, nil
+	}
+	return nil, fmt.Errorf("unsupported string method %v", name)
+}
+
+// pacReplacement finds the $1 group references of a JavaScript
+// replacement, which Go spells ${1}.
+var pacReplacement = regexp.MustCompile(`\$(\d+)`)
+
+// pacMatch is what exec and a non-global match return: the match and its
+// groups, or null.
+func pacMatch(re *regexp.Regexp, s string) any {
+	m := re.FindStringSubmatchIndex(s)
+	if m == nil {
+		return nil
+	}
+	a := &pacArray{make([]any, len(m)/2)}
+	for i := range a.elems {
+		if m[2*i] >= 0 {
+			a.elems[i] = s[m[2*i]:m[2*i+1]]
+		}
+	}
+	return a
+}
+
+// pacSliceBounds resolves the arguments of slice, which count from the end
+// when negative.
+func pacSliceBounds(from, to any, n int) (int, int) {
+	bound := func(v any, def int) int {
+		if v == nil {
+			return def
+		}
+		f := pacNumber(v)
+		switch {
+		case math.IsNaN(f):
+			return 0
+		case f < 0:
+			return max(n+int(f), 0)
+		}
+		return min(int(f), n)
+	}
+	lo, hi := bound(from, 0), bound(to, n)
+	return lo, max(lo, hi)
+}
+
+func pacClamp(v any, n int) int {
+	f := pacNumber(v)
+	if math.IsNaN(f) || f < 0 {
+		return 0
+	}
+	if f > float64(n) {
+		return n
+	}
+	return int(f)
+}
+
+func pacTruthy(v any) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case string:
+		return v != ""
+	case float64:
+		return v != 0 && !math.IsNaN(v)
+	case nil:
+		return false
+	}
+	return true
+}
+
+func pacNumber(v any) float64 {
+	switch v := v.(type) {
+	case float64:
+		return v
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	case string:
+		s := strings.TrimSpace(v)
+		if s == "" {
+			return 0
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	case nil:
+		return 0
+	}
+	return math.NaN()
+}
+
+func pacString(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case *pacArray:
+		s, _ := pacMethod(v, "join", nil)
+		return s.(string)
+	case *pacObject:
+		return "[object Object]"
+	case *pacRegexp:
+		return v.src
+	}
+	return "null"
+}
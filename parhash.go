@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// Hashing keeps up with fast links by spreading over cores: writes of at
+// least fanOutMin bytes go to the output and every hash at once, and CRCs
+// hash segments of crcSegment bytes side by side and combine the results.
+// SHA-256, SHA-1 and MD5 cannot be split that way, but the standard library
+// runs them on the CPU's hash instructions where there are any.
+const (
+	fanOutMin  = 64 << 10
+	crcSegment = 1 << 20
+)
+
+// fanOut is io.MultiWriter writing to all of ws concurrently. Each write
+// returns once every writer is done with it, with the error of the first
+// writer that failed.
+func fanOut(ws ...io.Writer) io.Writer {
+	return fanOutWriter(ws)
+}
+
+type fanOutWriter []io.Writer
+
+func (f fanOutWriter) Write(p []byte) (int, error) {
+	if len(p) < fanOutMin {
+		return io.MultiWriter(f...).Write(p)
+	}
+	errs := make([]error, len(f))
+	var wg sync.WaitGroup
+	for i, w := range f {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := w.Write(p)
+			if err == nil && n != len(p) {
+				err = io.ErrShortWrite
+			}
+			errs[i] = err
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// parallelCRC is a CRC-32 for poly, in the reversed form of the crc32
+// package, that hashes large writes in segments on several cores.
+type parallelCRC struct {
+	poly  uint32
+	table *crc32.Table
+	crc   uint32
+}
+
+func newParallelCRC(poly uint32) hash.Hash32 {
+	return &parallelCRC{poly: poly, table: crc32.MakeTable(poly)}
+}
+
+func (c *parallelCRC) Write(p []byte) (int, error) {
+	segments := min(len(p)/crcSegment, runtime.GOMAXPROCS(0))
+	if segments < 2 {
+		c.crc = crc32.Update(c.crc, c.table, p)
+		return len(p), nil
+	}
+	size := (len(p) + segments - 1) / segments
+	sums := make([]uint32, segments)
+	var wg sync.WaitGroup
+	for i := range sums {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sums[i] = crc32.Checksum(p[i*size:min((i+1)*size, len(p))], c.table)
+		}()
+	}
+	wg.Wait()
+	for i, sum := range sums {
+		c.crc = crc32Combine(c.poly, c.crc, sum, int64(min((i+1)*size, len(p))-i*size))
+	}
+	return len(p), nil
+}
+
+func (c *parallelCRC) Sum(b []byte) []byte {
+	return binary.BigEndian.AppendUint32(b, c.crc)
+}
+
+func (c *parallelCRC) Sum32() uint32  { return c.crc }
+func (c *parallelCRC) Reset()         { c.crc = 0 }
+func (c *parallelCRC) Size() int      { return crc32.Size }
+func (c *parallelCRC) BlockSize() int { return 1 }
+
+// crc32Combine returns the CRC of A followed by B from crc1, that of A,
+// and crc2, that of B, which is len2 bytes long. It applies len2 zero bytes
+// to crc1 by repeated squaring of the operator for one zero bit, as zlib's
+// crc32_combine does.
+func crc32Combine(poly, crc1, crc2 uint32, len2 int64) uint32 {
+	if len2 <= 0 {
+		return crc1
+	}
+	var even, odd [32]uint32
+	// The operator for one zero bit.
+	odd[0] = poly
+	row := uint32(1)
+	for n := 1; n < 32; n++ {
+		odd[n] = row
+		row <<= 1
+	}
+	gf2Square(&even, &odd) // two zero bits
+	gf2Square(&odd, &even) // four zero bits
+
+	// The first square gives the operator for one zero byte.
+	for {
+		gf2Square(&even, &odd)
+		if len2&1 != 0 {
+			crc1 = gf2Times(&even, crc1)
+		}
+		if len2 >>= 1; len2 == 0 {
+			break
+		}
+		gf2Square(&odd, &even)
+		if len2&1 != 0 {
+			crc1 = gf2Times(&odd, crc1)
+		}
+		if len2 >>= 1; len2 == 0 {
+			break
+		}
+	}
+	return crc1 ^ crc2
+}
+
+func gf2Times(mat *[32]uint32, vec uint32) uint32 {
+	var sum uint32
+	for i := 0; vec != 0; i, vec = i+1, vec>>1 {
+		if vec&1 != 0 {
+			sum ^= mat[i]
+		}
+	}
+	return sum
+}
+
+func gf2Square(square, mat *[32]uint32) {
+	for n := range square {
+		square[n] = gf2Times(mat, mat[n])
+	}
+}
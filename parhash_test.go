@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math/rand/v2"
+	"runtime"
+	"testing"
+)
+
+func TestCRC32Combine(t *testing.T) {
+	p := make([]byte, 5000)
+	rng := rand.New(rand.NewPCG(1, 2))
+	for i := range p {
+		p[i] = byte(rng.Uint32())
+	}
+	for _, poly := range []uint32{crc32.IEEE, crc32.Castagnoli, crc32.Koopman} {
+		table := crc32.MakeTable(poly)
+		want := crc32.Checksum(p, table)
+		for _, at := range []int{0, 1, 7, 8, 255, 256, 2049, 4999, 5000} {
+			got := crc32Combine(poly, crc32.Checksum(p[:at], table), crc32.Checksum(p[at:], table), int64(len(p)-at))
+			if got != want {
+				t.Errorf("poly %#x split at %v: got %#x, want %#x", poly, at, got, want)
+			}
+		}
+	}
+}
+
+func TestParallelCRC(t *testing.T) {
+	// Segments need cores to run on.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	p := make([]byte, 5*crcSegment+7)
+	rng := rand.New(rand.NewPCG(3, 4))
+	for i := range p {
+		p[i] = byte(rng.Uint32())
+	}
+	for _, poly := range []uint32{crc32.IEEE, crc32.Castagnoli} {
+		table := crc32.MakeTable(poly)
+		// Lengths below, at and across the segment boundaries, odd ones
+		// among them, which leave the last segment short.
+		for _, n := range []int{0, 1, crcSegment - 1, crcSegment, 2*crcSegment - 1, 2 * crcSegment, 2*crcSegment + 1, 3*crcSegment + 5, len(p)} {
+			h := newParallelCRC(poly)
+			h.Write(p[:n])
+			if got, want := h.Sum32(), crc32.Checksum(p[:n], table); got != want {
+				t.Errorf("poly %#x, %v bytes: got %#x, want %#x", poly, n, got, want)
+			}
+		}
+
+		// A run of writes, small and segmented, adds up to the whole.
+		h := newParallelCRC(poly)
+		for _, w := range [][]byte{p[:3], p[3 : 2*crcSegment+3], p[2*crcSegment+3 : 2*crcSegment+100], p[2*crcSegment+100:]} {
+			h.Write(w)
+		}
+		want := crc32.Checksum(p, table)
+		if got := h.Sum32(); got != want {
+			t.Errorf("poly %#x in writes: got %#x, want %#x", poly, got, want)
+		}
+		if got := h.Sum(nil); !bytes.Equal(got, []byte{byte(want >> 24), byte(want >> 16), byte(want >> 8), byte(want)}) {
+			t.Errorf("poly %#x Sum: got %x", poly, got)
+		}
+		h.Reset()
+		if h.Sum32() != 0 {
+			t.Errorf("poly %#x: %#x after Reset", poly, h.Sum32())
+		}
+	}
+}
+
+type failWriter struct{ err error }
+
+func (w failWriter) Write(p []byte) (int, error) { return 0, w.err }
+
+func TestFanOut(t *testing.T) {
+	p := make([]byte, 3*fanOutMin+1)
+	for i := range p {
+		p[i] = byte(i * 7)
+	}
+	var out bytes.Buffer
+	sha := sha256.New()
+	crc := newParallelCRC(crc32.IEEE)
+	w := fanOut(&out, sha, crc)
+	// Writes above and below fanOutMin.
+	for _, b := range [][]byte{p[:10], p[10 : 2*fanOutMin], p[2*fanOutMin:]} {
+		if n, err := w.Write(b); n != len(b) || err != nil {
+			t.Fatalf("wrote %v of %v: %v", n, len(b), err)
+		}
+	}
+	if !bytes.Equal(out.Bytes(), p) {
+		t.Error("the output differs")
+	}
+	if got, want := sha.Sum(nil), sha256.Sum256(p); !bytes.Equal(got, want[:]) {
+		t.Errorf("SHA-256 %x, want %x", got, want)
+	}
+	if got, want := crc.Sum32(), crc32.ChecksumIEEE(p); got != want {
+		t.Errorf("CRC %#x, want %#x", got, want)
+	}
+
+	// A failing writer fails the write, large or small.
+	broken := errors.New("broken")
+	w = fanOut(io.Discard, failWriter{broken})
+	for _, n := range []int{10, fanOutMin} {
+		if _, err := w.Write(p[:n]); err != broken {
+			t.Errorf("%v bytes: got %v, want %v", n, err, broken)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+// Parity fetches the Reed-Solomon sidecar of each entry, when published,
+// and rebuilds lost or corrupt shards from it.
+var Parity bool
+
+const (
+	parityMagic  = "GOCATPAR1"
+	paritySuffix = ".par"
+	// parityProbe is how much of a sidecar is asked for up front, enough
+	// for the header of files of several gigabytes in one round trip.
+	parityProbe = 256 << 10
+)
+
+// parityHeader describes a sidecar. The file is split into stripes of
+// Data shards of Shard bytes, the last one zero-padded; each stripe has
+// Parity parity shards, stored after the header stripe by stripe. Hashes
+// holds the SHA-256 of every data shard, then every parity shard.
+//
+// The header is the magic and its JSON length on the first line, then the
+// JSON.
+type parityHeader struct {
+	Size   int64    `json:"size"`
+	Shard  int64    `json:"shard"`
+	Data   int      `json:"data"`
+	Parity int      `json:"parity"`
+	Hashes []string `json:"hashes"`
+
+	code   *rsCode
+	offset int64
+}
+
+func (h *parityHeader) stripes() int64 {
+	perStripe := h.Shard * int64(h.Data)
+	return (h.Size + perStripe - 1) / perStripe
+}
+
+func (h *parityHeader) dataShards() int64 {
+	return (h.Size + h.Shard - 1) / h.Shard
+}
+
+func (h *parityHeader) check() error {
+	if h.Size < 0 || h.Shard <= 0 {
+		return errors.New("invalid sizes")
+	}
+	code, err := newRSCode(h.Data, h.Parity)
+	if err != nil {
+		return err
+	}
+	h.code = code
+	if want := h.dataShards() + h.stripes()*int64(h.Parity); int64(len(h.Hashes)) != want {
+		return fmt.Errorf("%v shard hashes, want %v", len(h.Hashes), want)
+	}
+	return nil
+}
+
+// parityURL is where the sidecar of url is published: next to it, with
+// paritySuffix appended to the path.
+func parityURL(url string) (string, error) {
+	u, err := neturl.Parse(url)
+	if err != nil {
+		return "", err
+	}
+	u.Path += paritySuffix
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+// loadParity fetches the header of the sidecar of url. A missing sidecar
+// is not an error; the entry is then fetched as usual.
+func loadParity(ctx context.Context, url string, info downloader.Info) (*parityHeader, error) {
+	purl, err := parityURL(url)
+	if err != nil {
+		return nil, err
+	}
+	pinfo, err := dl.Stat(ctx, purl)
+	if err != nil {
+		var perm *downloader.PermanentError
+		if errors.As(err, &perm) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if !pinfo.Ranges {
+		return nil, fmt.Errorf("%s does not serve ranges", purl)
+	}
+
+	head, err := dl.FetchRange(ctx, purl, downloader.ClosedRange(0, min(parityProbe, pinfo.Size)-1))
+	if err != nil {
+		return nil, err
+	}
+	first, rest, ok := bytes.Cut(head, []byte("\n"))
+	magic, length, _ := bytes.Cut(first, []byte(" "))
+	n, err := strconv.ParseInt(string(length), 10, 64)
+	if !ok || string(magic) != parityMagic || err != nil || n <= 0 {
+		return nil, fmt.Errorf("%s is not a gocat parity file", purl)
+	}
+	offset := int64(len(first)) + 1 + n
+	if int64(len(rest)) < n {
+		more, err := dl.FetchRange(ctx, purl, downloader.ClosedRange(int64(len(head)), offset-1))
+		if err != nil {
+			return nil, err
+		}
+		rest = append(rest, more...)
+	}
+
+	h := &parityHeader{offset: offset}
+	if err := json.Unmarshal(rest[:n], h); err != nil {
+		return nil, fmt.Errorf("%s: %w", purl, err)
+	}
+	if err := h.check(); err != nil {
+		return nil, fmt.Errorf("%s: %w", purl, err)
+	}
+	if h.Size != info.Size {
+		return nil, fmt.Errorf("%s is for %v bytes, not %v", purl, h.Size, info.Size)
+	}
+	return h, nil
+}
+
+// shardResult is one shard of a stripe as fetched, nil if lost.
+type shardResult struct {
+	index int
+	data  []byte
+}
+
+// downloadParity writes url to w stripe by stripe. The data and parity
+// shards of a stripe are all requested at once; as soon as any Data of
+// them have arrived intact the others are cancelled and the missing data
+// shards rebuilt, so a lost or corrupt shard costs no further round trip
+// as long as there is parity to spare.
+func downloadParity(ctx context.Context, url string, h *parityHeader, w io.Writer) (int64, error) {
+	purl, err := parityURL(url)
+	if err != nil {
+		return 0, err
+	}
+	var written int64
+	for s := int64(0); s < h.stripes(); s++ {
+		shards, err := fetchStripe(ctx, url, purl, h, s)
+		if err != nil {
+			return written, err
+		}
+		for d := 0; d < h.Data; d++ {
+			offset := (s*int64(h.Data) + int64(d)) * h.Shard
+			if offset >= h.Size {
+				break
+			}
+			n, err := w.Write(shards[d][:min(h.Shard, h.Size-offset)])
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func fetchStripe(parent context.Context, url, purl string, h *parityHeader, s int64) ([][]byte, error) {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	total := h.Data + h.Parity
+	shards := make([][]byte, total)
+	results := make(chan shardResult, total)
+	var wg sync.WaitGroup
+	inflight := 0
+	for i := 0; i < total; i++ {
+		src, r, hash, ok := h.locate(url, purl, s, i)
+		if !ok {
+			// Past the end of the file: known to be zeros.
+			shards[i] = make([]byte, h.Shard)
+			continue
+		}
+		inflight++
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results <- shardResult{i, fetchShard(ctx, src, r, hash, h.Shard)}
+		}(i)
+	}
+
+	have := 0
+	for _, shard := range shards {
+		if shard != nil {
+			have++
+		}
+	}
+	for ; inflight > 0 && have < h.Data; inflight-- {
+		res := <-results
+		if res.data != nil {
+			shards[res.index] = res.data
+			have++
+		}
+	}
+	cancel()
+	wg.Wait()
+
+	lost := 0
+	for d := 0; d < h.Data; d++ {
+		if shards[d] == nil {
+			lost++
+		}
+	}
+	if lost > 0 {
+		if err := h.code.reconstruct(shards); err != nil {
+			if parent.Err() != nil {
+				return nil, context.Cause(parent)
+			}
+			return nil, fmt.Errorf("%s: stripe %v: %w", url, s, err)
+		}
+		infof("rebuilt %v data shard(s) of stripe %v/%v from parity", lost, s+1, h.stripes())
+	}
+	return shards, nil
+}
+
+// locate returns where shard i of stripe s lives, ok being false for a
+// data shard wholly past the end of the file.
+func (h *parityHeader) locate(url, purl string, s int64, i int) (src string, r downloader.ByteRange, hash string, ok bool) {
+	if i < h.Data {
+		shard := s*int64(h.Data) + int64(i)
+		offset := shard * h.Shard
+		if offset >= h.Size {
+			return "", r, "", false
+		}
+		return url, downloader.ClosedRange(offset, min(offset+h.Shard, h.Size)-1), h.Hashes[shard], true
+	}
+	shard := s*int64(h.Parity) + int64(i-h.Data)
+	offset := h.offset + shard*h.Shard
+	return purl, downloader.ClosedRange(offset, offset+h.Shard-1), h.Hashes[h.dataShards()+shard], true
+}
+
+// fetchShard returns the shard at r of src padded to size, or nil when it
+// could not be had intact. A corrupt shard is asked for again, within the
+// retry budget, in case the stripe is still short of good ones.
+func fetchShard(ctx context.Context, src string, r downloader.ByteRange, hash string, size int64) []byte {
+	for attempt := 0; attempt < max(dl.MaxRetry, 1); attempt++ {
+		b, err := dl.FetchRange(ctx, src, r)
+		if err != nil {
+			return nil
+		}
+		sum := sha256.Sum256(b)
+		if int64(len(b)) == r.Last-r.First+1 && hex.EncodeToString(sum[:]) == hash {
+			padded := make([]byte, size)
+			copy(padded, b)
+			return padded
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		warnf("%s: shard %v is corrupt", src, r)
+	}
+	return nil
+}
+
+// writeParity writes the sidecar of the file at path to out.
+func writeParity(path string, out io.Writer, shard int64, data, parity int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	h := &parityHeader{Size: fi.Size(), Shard: shard, Data: data, Parity: parity}
+	code, err := newRSCode(data, parity)
+	if err != nil {
+		return err
+	}
+
+	// The header needs every hash, so the parity is buffered in a
+	// temporary file until it is complete.
+	tmp, err := os.CreateTemp("", "gocat-parity-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	parityOut := bufio.NewWriter(tmp)
+
+	var parityHashes []string
+	r := bufio.NewReader(f)
+	for s := int64(0); s < h.stripes(); s++ {
+		shards := make([][]byte, data)
+		for d := range shards {
+			shards[d] = make([]byte, shard)
+			n, err := io.ReadFull(r, shards[d])
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			if n > 0 {
+				sum := sha256.Sum256(shards[d][:n])
+				h.Hashes = append(h.Hashes, hex.EncodeToString(sum[:]))
+			}
+		}
+		for _, p := range code.encode(shards) {
+			sum := sha256.Sum256(p)
+			parityHashes = append(parityHashes, hex.EncodeToString(sum[:]))
+			if _, err := parityOut.Write(p); err != nil {
+				return err
+			}
+		}
+	}
+	h.Hashes = append(h.Hashes, parityHashes...)
+	if err := parityOut.Flush(); err != nil {
+		return err
+	}
+
+	header, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(out, "%s %v\n%s", parityMagic, len(header), header); err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.Copy(out, tmp)
+	return err
+}
+
+func runParity(args []string) {
+	fs := flag.NewFlagSet("parity", flag.ExitOnError)
+	out := fs.String("o", "", "sidecar to write (default <file>"+paritySuffix+")")
+	data := fs.Int("data", 16, "data shards per stripe")
+	parity := fs.Int("parity", 2, "parity shards per stripe; this many lost shards per stripe are rebuilt")
+	shard := byteSize(1 << 20)
+	fs.Var(&shard, "shard", "shard size")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 || shard <= 0 {
+		fmt.Fprintln(os.Stderr, "Usage: gocat parity [-data <n>] [-parity <n>] [-shard <size>] [-o <sidecar>] <file>")
+		os.Exit(1)
+	}
+	path := fs.Arg(0)
+	if *out == "" {
+		*out = path + paritySuffix
+	}
+
+	// Written aside and renamed, so a published sidecar is never partial.
+	f, err := os.CreateTemp(filepath.Dir(*out), partName(filepath.Base(*out), "*"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	w := bufio.NewWriter(f)
+	err = writeParity(path, w, int64(shard), *data, *parity)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Close()
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), *out)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		log.Fatal(err)
+	}
+	fmt.Fprintln(os.Stderr, "COMPLETED!")
+}
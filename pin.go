@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+var Pins stringList
+
+// parsePins reads -pin-sha256 values, host=base64 SHA-256 of a certificate's
+// SubjectPublicKeyInfo, into the pins of each host. A host may have
+// several, such as a backup key.
+func parsePins(values []string) (map[string][]string, error) {
+	pins := map[string][]string{}
+	for _, v := range values {
+		// The base64 keeps any padding after the first =.
+		host, pin, ok := strings.Cut(v, "=")
+		if raw, err := base64.StdEncoding.DecodeString(pin); !ok || host == "" || err != nil || len(raw) != sha256.Size {
+			return nil, fmt.Errorf("invalid -pin-sha256 %q: want host=base64 SHA-256 of the public key", v)
+		}
+		if net.ParseIP(host) != nil {
+			// No server name is sent for an address, so it cannot be told
+			// apart during the handshake.
+			return nil, fmt.Errorf("invalid -pin-sha256 %q: pin a host name, not an address", v)
+		}
+		host = strings.ToLower(host)
+		pins[host] = append(pins[host], pin)
+	}
+	return pins, nil
+}
+
+func spkiPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// usePins makes TLS connections to a pinned host fail unless a key of the
+// certificate chain matches one of its pins. The host is the server name
+// sent, so -sni's override when there is one. The check is part of the
+// handshake, so nothing is sent to a host that fails it, through a proxy
+// or not.
+func usePins(pins map[string][]string) {
+	verify := func(cs tls.ConnectionState) error {
+		want := pins[strings.ToLower(cs.ServerName)]
+		if len(want) == 0 {
+			return nil
+		}
+		chain := cs.PeerCertificates
+		if len(cs.VerifiedChains) > 0 {
+			chain = cs.VerifiedChains[0]
+		}
+		for _, cert := range chain {
+			if slices.Contains(want, spkiPin(cert)) {
+				return nil
+			}
+		}
+		got := ""
+		if len(cs.PeerCertificates) > 0 {
+			got = spkiPin(cs.PeerCertificates[0])
+		}
+		return &downloader.PermanentError{
+			Err: fmt.Errorf("certificate of %s matches no -pin-sha256 (its key is %s)", cs.ServerName, got),
+		}
+	}
+	ladder.each(func(t *http.Transport) { t.TLSClientConfig.VerifyConnection = verify })
+}
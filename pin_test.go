@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/pem"
+	"strings"
+	"testing"
+)
+
+func TestPinSHA256(t *testing.T) {
+	srv := newTLSServer(t, func(*tls.Config) {})
+	ca := writePEM(t, "ca.pem", &pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	pin := spkiPin(srv.Certificate())
+	other := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	t.Cleanup(func() { Pins, SNIOverrides = nil, nil })
+
+	for _, tc := range []struct {
+		name string
+		pins stringList
+		ok   bool
+	}{
+		{"match", stringList{"example.com=" + pin}, true},
+		{"backup key", stringList{"example.com=" + other, "EXAMPLE.com=" + pin}, true},
+		{"mismatch", stringList{"example.com=" + other}, false},
+		{"other host", stringList{"example.org=" + other}, true},
+	} {
+		out, failures := fetchTLS(t, srv.URL+"/f", func() {
+			// The test certificate is for example.com, and an address
+			// cannot be pinned.
+			CACert, SNIOverrides, Pins = ca, stringList{"example.com"}, tc.pins
+		})
+		if tc.ok && (out != "secure\n" || len(failures) > 0) {
+			t.Errorf("%s: output %q, failures %q", tc.name, out, failures)
+		}
+		if !tc.ok && (out != "" || len(failures) != 1 || !strings.Contains(failures[0], "matches no -pin-sha256")) {
+			t.Errorf("%s: output %q, failures %q, want the pin to refuse it", tc.name, out, failures)
+		}
+	}
+
+	for _, v := range []string{"127.0.0.1=" + pin, "example.com=" + pin[:8], "example.com"} {
+		if _, err := parsePins([]string{v}); err == nil {
+			t.Errorf("parsePins(%q) accepted it", v)
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/msmania/gocat/downloader"
+)
+
+var (
+	PipelineFile string
+	Decompress   bool
+)
+
+var pipe *pipeline
+
+// pipelineRule applies actions, in order, to entries whose Content-Type
+// matches pattern.
+type pipelineRule struct {
+	pattern string
+	actions []string
+}
+
+// pipeline post-processes each entry according to its Content-Type:
+// "decompress" undoes gzip, zstd, bzip2 or xz, "extract" unpacks a tar
+// archive into the output directory, "pass" leaves the bytes alone and
+// "skip" does not download the entry at all. Entries no rule matches pass through.
+type pipeline struct {
+	rules []pipelineRule
+}
+
+// loadPipeline reads lines of "pattern action[ | action...]", optionally
+// separated by "->" or "→", where pattern is a shExpMatch glob over the
+// media type such as "application/gzip" or "text/*". Blank lines and lines
+// starting with # are ignored.
+func loadPipeline(path string) (*pipeline, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &pipeline{}
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexAny(line, " \t")
+		if i < 0 {
+			return nil, fmt.Errorf("%s:%v: want \"content-type action\", got %q", path, lineNo, line)
+		}
+		pattern, rest := line[:i], strings.TrimSpace(line[i+1:])
+		rest = strings.TrimSpace(strings.TrimPrefix(strings.TrimPrefix(rest, "->"), "→"))
+
+		rule := pipelineRule{pattern: strings.ToLower(pattern)}
+		for _, action := range strings.Split(rest, "|") {
+			rule.actions = append(rule.actions, strings.ToLower(strings.TrimSpace(action)))
+		}
+		if err := checkActions(rule.actions); err != nil {
+			return nil, fmt.Errorf("%s:%v: %w", path, lineNo, err)
+		}
+		p.rules = append(p.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func checkActions(actions []string) error {
+	for i, action := range actions {
+		switch action {
+		case "pass", "decompress":
+		case "extract", "skip":
+			if i != len(actions)-1 {
+				return fmt.Errorf("%v must be the last action", action)
+			}
+		default:
+			return fmt.Errorf("unknown action %q, want pass, decompress, extract or skip", action)
+		}
+	}
+	return nil
+}
+
+// actions returns what to do with an entry of contentType.
+func (p *pipeline) actions(contentType string) []string {
+	for _, rule := range p.rules {
+		if shExpMatch(strings.ToLower(contentType), rule.pattern) {
+			return rule.actions
+		}
+	}
+	return nil
+}
+
+// extracts reports whether any rule unpacks archives.
+func (p *pipeline) extracts() bool {
+	for _, rule := range p.rules {
+		if hasAction(rule.actions, "extract") {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAction(actions []string, action string) bool {
+	for _, a := range actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// processor feeds an entry through the stages of its actions on the way to
+// the output. Each stage reads what the previous one writes in its own
+// goroutine.
+type processor struct {
+	w      io.Writer
+	stages []*pipeStage
+}
+
+type pipeStage struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+// newProcessor chains actions in front of w. extract writes into dir and
+// ignores w.
+func newProcessor(actions []string, w io.Writer, dir string) *processor {
+	p := &processor{w: w}
+	for i := len(actions) - 1; i >= 0; i-- {
+		switch actions[i] {
+		case "decompress":
+			p.push(func(r io.Reader, w io.Writer) error { return decompress(r, w) })
+		case "extract":
+			p.push(func(r io.Reader, _ io.Writer) error { return extractTar(r, dir) })
+		}
+	}
+	return p
+}
+
+func (p *processor) push(run func(r io.Reader, w io.Writer) error) {
+	pr, pw := io.Pipe()
+	s := &pipeStage{pw: pw, done: make(chan error, 1)}
+	next := p.w
+	go func() {
+		err := run(pr, next)
+		if err == nil {
+			// Trailing bytes after the end of the stream are ignored.
+			_, err = io.Copy(io.Discard, pr)
+		}
+		pr.CloseWithError(err)
+		s.done <- err
+	}()
+	p.w = pw
+	p.stages = append([]*pipeStage{s}, p.stages...)
+}
+
+func (p *processor) Write(b []byte) (int, error) {
+	return p.w.Write(b)
+}
+
+// Close ends the input and waits for every stage to finish, first to
+// last, returning the first failure.
+func (p *processor) Close() error {
+	var first error
+	for _, s := range p.stages {
+		s.pw.Close()
+		if err := <-s.done; err != nil && first == nil {
+			first = err
+		}
+	}
+	p.stages = nil
+	return first
+}
+
+// abort stops every stage, discarding what is in flight.
+func (p *processor) abort() {
+	for _, s := range p.stages {
+		s.pw.CloseWithError(errors.New("aborted"))
+		<-s.done
+	}
+	p.stages = nil
+}
+
+// decompress copies r to w undoing the compression its magic bytes name.
+func decompress(r io.Reader, w io.Writer) error {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(len(xzMagic))
+	var dec io.Reader
+	switch compressionOf(head) {
+	case "gzip":
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		dec = gz
+	case "zstd":
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		dec = zr
+	case "bzip2":
+		dec = bzip2.NewReader(br)
+	case "xz":
+		return xzDecode(br, w)
+	default:
+		return errors.New("decompress: not gzip, zstd, bzip2 or xz data")
+	}
+	_, err := io.Copy(w, dec)
+	return err
+}
+
+// autoDecompress is decompress for -decompress, which copies data in none
+// of its formats as is. claimed is the compression the entry's
+// Content-Encoding or name gave, worth a warning if the data disagrees:
+// some servers undo a Content-Encoding on the fly.
+func autoDecompress(r io.Reader, w io.Writer, file, claimed string) error {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(len(xzMagic))
+	if compressionOf(head) != "" {
+		return decompress(br, w)
+	}
+	if claimed != "" {
+		warnf("%s is not %v data, copying it as is", file, claimed)
+	}
+	_, err := io.Copy(w, br)
+	return err
+}
+
+// compressionOf names the compression that the magic bytes at the start
+// of a stream give away, if any.
+func compressionOf(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return "gzip"
+	case bytes.HasPrefix(head, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return "zstd"
+	case bytes.HasPrefix(head, []byte("BZh")):
+		return "bzip2"
+	case bytes.HasPrefix(head, xzMagic):
+		return "xz"
+	}
+	return ""
+}
+
+// compressionSuffixes maps the names of compressed files to their format
+// and the suffix of what they decompress to.
+var compressionSuffixes = []struct{ ext, format, to string }{
+	{".gz", "gzip", ""},
+	{".tgz", "gzip", ".tar"},
+	{".zst", "zstd", ""},
+	{".tzst", "zstd", ".tar"},
+	{".bz2", "bzip2", ""},
+	{".tbz2", "bzip2", ".tar"},
+	{".xz", "xz", ""},
+	{".txz", "xz", ".tar"},
+}
+
+// claimedCompression is the compression the Content-Encoding of an entry
+// or, failing that, the extension of its URL names.
+func claimedCompression(file string, info downloader.Info) string {
+	switch info.ContentEncoding {
+	case "gzip", "x-gzip":
+		return "gzip"
+	case "zstd":
+		return "zstd"
+	case "bzip2", "x-bzip2":
+		return "bzip2"
+	case "xz", "x-xz":
+		return "xz"
+	}
+	u, err := neturl.Parse(file)
+	if err != nil {
+		return ""
+	}
+	name := strings.ToLower(u.Path)
+	for _, s := range compressionSuffixes {
+		if strings.HasSuffix(name, s.ext) {
+			return s.format
+		}
+	}
+	return ""
+}
+
+// extractTar unpacks regular files and directories under dir. Names that
+// would land outside dir are refused, and links are skipped since a chain
+// of them can point anywhere.
+func extractTar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.FromSlash(hdr.Name)
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("extract: refusing %q outside the output directory", hdr.Name)
+		}
+		target := filepath.Join(dir, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, hdr.FileInfo().Mode().Perm())
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+		default:
+			infof("extract: skipping %v, not a regular file", hdr.Name)
+		}
+	}
+}
+
+// decompressedName drops the compression suffix from an output name.
+func decompressedName(name string) string {
+	for _, s := range compressionSuffixes {
+		if strings.HasSuffix(name, s.ext) && len(name) > len(s.ext) {
+			return strings.TrimSuffix(name, s.ext) + s.to
+		}
+	}
+	return name
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"plugin"
+)
+
+var Plugins stringList
+
+// loadPlugin opens a Go plugin built with -buildmode=plugin that exports
+//
+//	func WrapTransport(http.RoundTripper) http.RoundTripper
+//
+// The plugin must be built with the same Go toolchain and module versions
+// as gocat itself.
+func loadPlugin(path string) (func(http.RoundTripper) http.RoundTripper, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	sym, err := p.Lookup("WrapTransport")
+	if err != nil {
+		return nil, err
+	}
+	wrap, ok := sym.(func(http.RoundTripper) http.RoundTripper)
+	if !ok {
+		return nil, fmt.Errorf(
+			"%v: WrapTransport is %T, want func(http.RoundTripper) http.RoundTripper", path, sym)
+	}
+	return wrap, nil
+}
+
+// wrapPlugins applies every -plugin in order, so the first one sits
+// closest to the network.
+func wrapPlugins(transport http.RoundTripper) (http.RoundTripper, error) {
+	for _, path := range Plugins {
+		wrap, err := loadPlugin(path)
+		if err != nil {
+			return nil, err
+		}
+		transport = wrap(transport)
+	}
+	return transport, nil
+}
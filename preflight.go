@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	neturl "net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+var (
+	Preflight     bool
+	PreflightJobs int
+	DryRun        bool
+	DryRunPricing string
+)
+
+var (
+	SmallSize   byteSize = 1 << 20
+	HugeSize    byteSize = 1 << 30
+	HugeWorkers int
+)
+
+// smallBudget caps the bodies of small entries kept between checkHeaders
+// and downloadFrom, which a preflight of many entries would otherwise
+// hold all at once. Entries past it are fetched again.
+const smallBudget = 64 << 20
+
+var (
+	headMu    sync.Mutex
+	headCache = map[string]downloader.Info{}
+	// smallBodies holds whole entries of up to -small-size bytes, and the
+	// first -small-size bytes of larger ones, which came along with their
+	// headers.
+	smallBodies = map[string][]byte{}
+	smallHeld   int64
+)
+
+// checkHeaders returns the size and validators of url, from the preflight
+// cache when the entry was already checked.
+func checkHeaders(ctx context.Context, url string) (downloader.Info, error) {
+	headMu.Lock()
+	info, ok := headCache[url]
+	headMu.Unlock()
+	if ok {
+		return info, nil
+	}
+
+	info, body, err := dl.Peek(ctx, url)
+	if err != nil {
+		return downloader.Info{}, err
+	}
+
+	headMu.Lock()
+	headCache[url] = info
+	if body != nil && smallHeld+int64(len(body)) <= smallBudget {
+		smallBodies[url] = body
+		smallHeld += int64(len(body))
+	}
+	headMu.Unlock()
+	return info, nil
+}
+
+// statHeaders is checkHeaders for -preflight and -dry-run, which promise
+// the metadata and no more: it asks with Stat rather than Peek, so no
+// entry's bytes are taken out of its store before the download.
+func statHeaders(ctx context.Context, url string) (downloader.Info, error) {
+	if info, ok := cachedHeaders(url); ok {
+		return info, nil
+	}
+	info, err := dl.Stat(ctx, url)
+	if err != nil {
+		return downloader.Info{}, err
+	}
+	headMu.Lock()
+	headCache[url] = info
+	headMu.Unlock()
+	return info, nil
+}
+
+// takeSmall hands over the body checkHeaders kept for url, if any.
+func takeSmall(url string) ([]byte, bool) {
+	headMu.Lock()
+	defer headMu.Unlock()
+	body, ok := smallBodies[url]
+	if ok {
+		delete(smallBodies, url)
+		smallHeld -= int64(len(body))
+	}
+	return body, ok
+}
+
+// cachedHeaders returns what checkHeaders found for url, if it succeeded.
+func cachedHeaders(url string) (downloader.Info, bool) {
+	headMu.Lock()
+	defer headMu.Unlock()
+	info, ok := headCache[url]
+	return info, ok
+}
+
+// preflight checks every entry up front with at most PreflightJobs requests
+// in flight, so dead URLs are found before the first byte is written. All
+// failures are reported together.
+func preflight(ctx context.Context, files []string) ([]int64, error) {
+	start := time.Now()
+	sizes, errs := checkEntries(ctx, files)
+
+	total := int64(0)
+	unknown := 0
+	for i, err := range errs {
+		switch {
+		case err != nil:
+		case sizes[i] < 0:
+			unknown++
+		default:
+			total += sizes[i]
+		}
+	}
+
+	infof("preflight: %v entries, %v bytes in %v", len(files), total, time.Since(start).Round(time.Millisecond))
+	if unknown > 0 {
+		infof("preflight: %v entries of unknown size", unknown)
+	}
+	if err := preflightFailures(files, errs); err != nil {
+		return nil, err
+	}
+	return sizes, nil
+}
+
+// checkEntries returns how many bytes each entry would download, and why
+// it cannot be when it cannot.
+func checkEntries(ctx context.Context, files []string) ([]int64, []error) {
+	sizes := make([]int64, len(files))
+	errs := make([]error, len(files))
+
+	jobs := PreflightJobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	sem := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+	for i, file := range files {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, file string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			info, err := statHeaders(ctx, file)
+			from, to := int64(0), info.Size
+			if err == nil {
+				from, to, err = window(file, info)
+			}
+			sizes[i], errs[i] = to-from, err
+		}(i, file)
+	}
+	wg.Wait()
+	return sizes, errs
+}
+
+func preflightFailures(files []string, errs []error) error {
+	failed := []string{}
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("  %s: %v", files[i], err))
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf(
+		"preflight failed for %v of %v entries:\n%s",
+		len(failed),
+		len(files),
+		strings.Join(failed, "\n"),
+	)
+}
+
+// dryRun checks every entry like preflight and prints what it found to w
+// instead of downloading.
+func dryRun(ctx context.Context, w io.Writer, files []string) error {
+	sizes, errs := checkEntries(ctx, files)
+	printDryRun(w, files, sizes, errs)
+	var prices map[string]cloudPrice
+	if DryRunPricing != "" {
+		var err error
+		if prices, err = loadPricing(DryRunPricing); err != nil {
+			return err
+		}
+	}
+	printCloudCosts(w, files, errs, prices)
+	return preflightFailures(files, errs)
+}
+
+// printDryRun writes the size, range support and ETag of each entry, and
+// the total that would be downloaded.
+func printDryRun(w io.Writer, files []string, sizes []int64, errs []error) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "URL\tSIZE\tRANGES\tETAG\n")
+	total, unknown, failed := int64(0), 0, 0
+	for i, file := range files {
+		info, _ := cachedHeaders(file)
+		if errs[i] != nil {
+			failed++
+			fmt.Fprintf(tw, "%s\tFAILED\t-\t-\n", file)
+			continue
+		}
+		size := "unknown"
+		if sizes[i] >= 0 {
+			size = formatSize(sizes[i])
+			total += sizes[i]
+		} else {
+			unknown++
+		}
+		ranges := "no"
+		if info.Ranges {
+			ranges = "yes"
+		}
+		etag := info.ETag
+		if etag == "" {
+			etag = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%v\t%v\t%v\n", file, size, ranges, etag)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "%v entries, %v (%v bytes) to download", len(files), formatSize(total), total)
+	if unknown > 0 {
+		fmt.Fprintf(w, ", %v of unknown size", unknown)
+	}
+	if failed > 0 {
+		fmt.Fprintf(w, ", %v failed", failed)
+	}
+	fmt.Fprintln(w)
+}
+
+// cloudCost is what the entries of one object store would take.
+type cloudCost struct {
+	entries, unknown int
+	requests, bytes  int64
+}
+
+// cloudPrice is what an object store charges, in dollars, per 1000
+// requests and per GiB of egress.
+type cloudPrice struct {
+	perKRequests, perGiB float64
+}
+
+// loadPricing reads a -dry-run-pricing table: one line per URL scheme
+// with its prices per 1000 requests and per GiB of egress, such as
+// "s3 0.0004 0.09". Blank lines and lines starting with # are skipped.
+func loadPricing(path string) (map[string]cloudPrice, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	prices := map[string]cloudPrice{}
+	for n, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		var p cloudPrice
+		var err error
+		if len(fields) == 3 {
+			if p.perKRequests, err = strconv.ParseFloat(fields[1], 64); err == nil {
+				p.perGiB, err = strconv.ParseFloat(fields[2], 64)
+			}
+		}
+		if len(fields) != 3 || err != nil || p.perKRequests < 0 || p.perGiB < 0 {
+			return nil, fmt.Errorf("%s:%v: want <scheme> <dollars per 1000 requests> <dollars per GiB>", path, n+1)
+		}
+		prices[fields[0]] = p
+	}
+	return prices, nil
+}
+
+// printCloudCosts estimates, for the entries of each object store, the
+// requests the download would send, the metadata request of each entry
+// included, and the bytes it would take out of the store, priced with
+// prices where they have a line for the store.
+func printCloudCosts(w io.Writer, files []string, errs []error, prices map[string]cloudPrice) {
+	costs := map[string]*cloudCost{}
+	for i, file := range files {
+		u, err := neturl.Parse(file)
+		if err != nil || !slices.Contains(objectStoreSchemes, u.Scheme) {
+			continue
+		}
+		c := costs[u.Scheme]
+		if c == nil {
+			c = &cloudCost{}
+			costs[u.Scheme] = c
+		}
+		c.entries++
+		c.requests++
+		info, ok := cachedHeaders(file)
+		if errs[i] != nil || !ok {
+			continue
+		}
+		from, to, err := window(file, info)
+		if err != nil || to < 0 {
+			c.unknown++
+			c.requests++
+			continue
+		}
+		c.requests += dl.EstimateRequests(file, info, from, to)
+		c.bytes += to - from
+	}
+
+	for _, scheme := range objectStoreSchemes {
+		c := costs[scheme]
+		if c == nil {
+			continue
+		}
+		fmt.Fprintf(w, "%s: %v entries, about %v requests and %v (%v bytes) of egress",
+			scheme, c.entries, c.requests, formatSize(c.bytes), c.bytes)
+		if c.unknown > 0 {
+			fmt.Fprintf(w, " plus %v entries of unknown size", c.unknown)
+		}
+		if p, ok := prices[scheme]; ok {
+			dollars := float64(c.requests)/1000*p.perKRequests + float64(c.bytes)/(1<<30)*p.perGiB
+			fmt.Fprintf(w, ", $%.2f at the -dry-run-pricing rates", dollars)
+		}
+		fmt.Fprintln(w)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+func TestDryRunCloudCosts(t *testing.T) {
+	testRun(t, func() {
+		BatchSizeInMB = 4
+		SmallSize = 1 << 20
+	})
+	infos := map[string]downloader.Info{
+		// 10M, of which 1M came with the peek, in 3 chunks of 4M.
+		"s3://bucket/big": {Size: 10 << 20, Ranges: true},
+		// Fetched whole with the peek.
+		"s3://bucket/small": {Size: 1000, Ranges: true},
+		// One GET without ranges.
+		"gs://bucket/plain":      {Size: 2 << 20},
+		"az://account/c/unknown": {Size: -1},
+	}
+	headMu.Lock()
+	for url, info := range infos {
+		headCache[url] = info
+	}
+	headMu.Unlock()
+	t.Cleanup(func() {
+		headMu.Lock()
+		defer headMu.Unlock()
+		for url := range infos {
+			delete(headCache, url)
+		}
+	})
+
+	files := []string{
+		"s3://bucket/big", "s3://bucket/small", "gs://bucket/plain", "az://account/c/unknown",
+		"s3://bucket/gone", "https://example.com/not-a-store",
+	}
+	errs := make([]error, len(files))
+	errs[4] = errors.New("404 Not Found")
+
+	pricing := filepath.Join(t.TempDir(), "pricing")
+	if err := os.WriteFile(pricing, []byte("# scheme, per 1000 requests, per GiB\ns3 1000 1024\n\ngs 0 0.5\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	prices, err := loadPricing(pricing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	printCloudCosts(&out, files, errs, prices)
+	want := strings.Join([]string{
+		// A metadata request for each entry, the failed one too, and 3
+		// chunks, $6, and 10M and 1000 bytes, $10.
+		"s3: 3 entries, about 6 requests and 10.0MiB (10486760 bytes) of egress, $16.00 at the -dry-run-pricing rates",
+		"gs: 1 entries, about 2 requests and 2.0MiB (2097152 bytes) of egress, $0.00 at the -dry-run-pricing rates",
+		"az: 1 entries, about 2 requests and 0B (0 bytes) of egress plus 1 entries of unknown size",
+		"",
+	}, "\n")
+	if got := out.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	for _, bad := range []string{"s3 1\n", "s3 x 1\n", "s3 -1 1\n"} {
+		if err := os.WriteFile(pricing, []byte(bad), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadPricing(pricing); err == nil {
+			t.Errorf("%q was accepted", bad)
+		}
+	}
+}
+
+// TestDryRunMetadataOnly checks that -dry-run asks for the metadata of the
+// entries and none of their bytes.
+func TestDryRunMetadataOnly(t *testing.T) {
+	testRun(t, func() {})
+	var mu sync.Mutex
+	var gets []string
+	content := strings.Repeat("x", 3000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "GET" {
+			mu.Lock()
+			gets = append(gets, req.URL.Path+" "+req.Header.Get("Range"))
+			mu.Unlock()
+		}
+		http.ServeContent(w, req, "", time.Time{}, strings.NewReader(content[:len(req.URL.Path)*100]))
+	}))
+	t.Cleanup(srv.Close)
+
+	files := []string{srv.URL + "/a", srv.URL + "/bb"}
+	var out bytes.Buffer
+	if err := dryRun(context.Background(), &out, files); err != nil {
+		t.Fatal(err)
+	}
+	if len(gets) > 0 {
+		t.Errorf("-dry-run sent %q, want HEADs only", gets)
+	}
+	if !strings.Contains(out.String(), "300") {
+		t.Errorf("got\n%s\nwant the size of /bb", out.String())
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	PresignCmd string
+	Resign     bool
+)
+
+const presignTimeout = time.Minute
+
+// presignTransport keeps entries signed with short-lived pre-signed URLs
+// going: once the URL of an entry is refused as expired, -presign-cmd is
+// run for a fresh one, which that request and all later ones for the entry
+// go to instead. With -resign, an S3 or GCS URL is first stripped of its
+// signature and its requests signed with the user's own credentials.
+type presignTransport struct {
+	base http.RoundTripper
+	args []string
+	// s3 and gcs sign re-signed entries; they are nil without -resign.
+	s3  *s3Store
+	gcs *gcsStore
+
+	mu sync.Mutex
+	// current maps an entry URL to its latest pre-signed URL.
+	current map[string]string
+	// signers maps a re-signed entry to how its requests are signed.
+	signers map[string]func(*http.Request) error
+	// refresh lets one request at a time run the command.
+	refresh sync.Mutex
+}
+
+func newPresignTransport(base http.RoundTripper, cmd string, stores *objectStoreTransport) (*presignTransport, error) {
+	t := &presignTransport{
+		base:    base,
+		args:    strings.Fields(cmd),
+		current: map[string]string{},
+		signers: map[string]func(*http.Request) error{},
+	}
+	if Resign {
+		t.s3 = stores.stores["s3"].(*s3Store)
+		t.gcs = stores.stores["gs"].(*gcsStore)
+	} else if len(t.args) == 0 {
+		return nil, fmt.Errorf("empty -presign-cmd")
+	}
+	return t, nil
+}
+
+func (t *presignTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Redirects go wherever the server says.
+	if req.Response != nil {
+		return t.base.RoundTrip(req)
+	}
+
+	entry := req.URL.String()
+	t.mu.Lock()
+	used, sign := t.current[entry], t.signers[entry]
+	t.mu.Unlock()
+
+	resp, err := t.send(req, used, sign)
+	if err != nil || !expiredSignature(resp) {
+		return resp, err
+	}
+
+	fresh, sign, err := t.renew(req.Context(), entry, used)
+	if err != nil {
+		warnf("renewing the pre-signed URL of %s: %v", entry, err.Error())
+		return resp, nil
+	}
+	resp.Body.Close()
+	return t.send(req, fresh, sign)
+}
+
+// send makes req to the pre-signed URL in place of its own, if there is
+// one, signed by sign if that is set. The response still names req, so
+// relative URLs in it resolve against the entry.
+func (t *presignTransport) send(req *http.Request, presigned string, sign func(*http.Request) error) (*http.Response, error) {
+	if presigned == "" {
+		return t.base.RoundTrip(req)
+	}
+	u, err := neturl.Parse(presigned)
+	if err != nil {
+		return nil, err
+	}
+	out := req.Clone(req.Context())
+	out.URL = u
+	out.Host = ""
+	if sign != nil {
+		if err := sign(out); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := t.base.RoundTrip(out)
+	if err != nil {
+		return nil, err
+	}
+	resp.Request = req
+	return resp, nil
+}
+
+// renew returns a fresh pre-signed URL for entry, and how to sign it when
+// it was re-signed, unless another request already replaced used while
+// this one waited.
+func (t *presignTransport) renew(ctx context.Context, entry, used string) (string, func(*http.Request) error, error) {
+	t.refresh.Lock()
+	defer t.refresh.Unlock()
+
+	t.mu.Lock()
+	cur, sign := t.current[entry], t.signers[entry]
+	t.mu.Unlock()
+	if cur != used {
+		return cur, sign, nil
+	}
+
+	// Once re-signed, an entry refused again is left to -presign-cmd.
+	if t.s3 != nil && sign == nil {
+		expired := used
+		if expired == "" {
+			expired = entry
+		}
+		if unsigned, sign := t.unsign(expired); sign != nil {
+			t.mu.Lock()
+			t.current[entry], t.signers[entry] = unsigned, sign
+			t.mu.Unlock()
+			infof("signing the requests for %s with your own credentials, its pre-signed URL has expired", entry)
+			return unsigned, sign, nil
+		}
+	}
+	if len(t.args) == 0 {
+		return "", nil, fmt.Errorf("not an S3 or GCS pre-signed URL, and no -presign-cmd")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, presignTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, t.args[0], append(t.args[1:], entry)...)
+	cmd.Env = append(os.Environ(), "GOCAT_URL="+entry, "GOCAT_EXPIRED_URL="+used)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", nil, err
+	}
+	fresh := ""
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if fresh = strings.TrimSpace(scanner.Text()); fresh != "" {
+			break
+		}
+	}
+	u, err := neturl.Parse(fresh)
+	if err != nil || u.Host == "" {
+		return "", nil, fmt.Errorf("want a URL on stdout, got %q", fresh)
+	}
+
+	t.mu.Lock()
+	t.current[entry] = fresh
+	delete(t.signers, entry)
+	t.mu.Unlock()
+	infof("renewed the pre-signed URL of %s", entry)
+	return fresh, nil, nil
+}
+
+// unsign strips the signature from raw, an S3 or GCS pre-signed URL of
+// either signature version, and returns it with a signer for its requests;
+// the signer is nil for any other URL.
+func (t *presignTransport) unsign(raw string) (string, func(*http.Request) error) {
+	u, err := neturl.Parse(raw)
+	if err != nil {
+		return "", nil
+	}
+	q := u.Query()
+	var prefix string
+	var sign func(*http.Request) error
+	switch {
+	case q.Get("X-Amz-Algorithm") != "" || q.Get("AWSAccessKeyId") != "":
+		prefix = "x-amz-"
+		region := t.s3.region
+		// The scope is <key>/<date>/<region>/s3/aws4_request.
+		if scope := strings.Split(q.Get("X-Amz-Credential"), "/"); len(scope) == 5 {
+			region = scope[2]
+		}
+		sign = func(req *http.Request) error {
+			creds, err := t.s3.credentials(req.Context())
+			if err != nil {
+				return err
+			}
+			if creds == nil {
+				return fmt.Errorf("-resign: no AWS credentials to sign %s with", req.URL.Redacted())
+			}
+			signV4(req, creds, region, "s3", time.Now())
+			return nil
+		}
+	case q.Get("X-Goog-Algorithm") != "" || q.Get("GoogleAccessId") != "":
+		prefix = "x-goog-"
+		sign = func(req *http.Request) error {
+			ok, err := t.gcs.authorize(req)
+			if err == nil && !ok {
+				err = fmt.Errorf("-resign: no Google credentials to sign %s with", req.URL.Redacted())
+			}
+			return err
+		}
+	default:
+		return "", nil
+	}
+	for key := range q {
+		lower := strings.ToLower(key)
+		if strings.HasPrefix(lower, prefix) || lower == "awsaccesskeyid" || lower == "googleaccessid" ||
+			lower == "expires" || lower == "signature" {
+			q.Del(key)
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), sign
+}
+
+// expiredSignature reports whether resp refuses a pre-signed URL, which S3
+// and Azure answer with 403 and Google Cloud Storage with a 400 that says
+// so. Either way the body is left readable.
+func expiredSignature(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusForbidden:
+		return true
+	case http.StatusBadRequest:
+		head, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(head), resp.Body), resp.Body}
+		return bytes.Contains(bytes.ToLower(head), []byte("expired"))
+	}
+	return false
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+const probeBodyLimit = 1 << 20
+
+type probeResult struct {
+	name   string
+	status string // PASS, WARN or FAIL
+	detail string
+}
+
+type probeResponse struct {
+	resp *http.Response
+	body []byte
+}
+
+// probeGet sends a GET with the given extra headers and reads at most
+// probeBodyLimit bytes, so ignored ranges on a huge object stay cheap.
+func probeGet(ctx context.Context, url string, headers map[string]string) (*probeResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, probeBodyLimit))
+	if err != nil {
+		return nil, err
+	}
+	return &probeResponse{resp: resp, body: body}, nil
+}
+
+// probeRanges exercises the range features gocat relies on, or may rely
+// on, and explains how the server deviates from RFC 9110.
+func probeRanges(ctx context.Context, url string) []probeResult {
+	results := []probeResult{}
+	add := func(name, status, format string, args ...any) {
+		results = append(results, probeResult{name, status, fmt.Sprintf(format, args...)})
+	}
+
+	head, err := httpClient.Head(url)
+	if err != nil {
+		add("HEAD", "FAIL", "%v", err)
+	} else {
+		head.Body.Close()
+		status := "PASS"
+		if head.StatusCode/100 != 2 {
+			status = "WARN"
+		}
+		add("HEAD", status, "%v, Accept-Ranges=%q, Content-Length=%q",
+			head.Status, head.Header.Get("Accept-Ranges"), head.Header.Get("Content-Length"))
+	}
+
+	info, err := dl.Stat(ctx, url)
+	if err != nil {
+		add("metadata", "FAIL", "%v", err)
+		return results
+	}
+	if !info.Ranges {
+		add("ranges", "WARN", "server ignores ranges; gocat fetches it in one request")
+		return results
+	}
+	if head == nil || head.StatusCode/100 != 2 || head.Header.Get("Accept-Ranges") != "bytes" {
+		// Servers often serve ranges without advertising them.
+		add("metadata", "WARN", "ranges work but HEAD does not advertise them")
+	}
+	size := info.Size
+	validator := info.ETag
+	if validator == "" {
+		validator = info.LastModified
+	}
+	add("validators", "PASS", "size=%v ETag=%q Last-Modified=%q", size, info.ETag, info.LastModified)
+	if size < 2 {
+		add("ranges", "WARN", "object too small to probe ranges")
+		return results
+	}
+
+	checkRange := func(name string, r downloader.ByteRange, wantFirst, wantLast int64) {
+		p, err := probeGet(ctx, url, map[string]string{"Range": r.String()})
+		switch {
+		case err != nil:
+			add(name, "FAIL", "%v", err)
+		case p.resp.StatusCode == http.StatusOK:
+			add(name, "FAIL", "%v: range ignored, full object returned", r)
+		case p.resp.StatusCode != http.StatusPartialContent:
+			add(name, "FAIL", "%v: %v", r, p.resp.Status)
+		default:
+			first, last, _, err := r.CheckContentRange(p.resp.Header.Get("Content-Range"))
+			switch {
+			case err != nil:
+				add(name, "FAIL", "%v", err)
+			case first != wantFirst || last != wantLast:
+				add(name, "FAIL", "%v: got bytes %v-%v", r, first, last)
+			case int64(len(p.body)) != last-first+1:
+				add(name, "FAIL", "%v: body has %v bytes, Content-Range says %v",
+					r, len(p.body), last-first+1)
+			default:
+				add(name, "PASS", "%v -> %v", r, p.resp.Header.Get("Content-Range"))
+			}
+		}
+	}
+
+	n := min(size/2, 100)
+	checkRange("closed range", downloader.ClosedRange(0, n-1), 0, n-1)
+	checkRange("open-ended range", downloader.OpenRange(size-n), size-n, size-1)
+	checkRange("suffix range", downloader.SuffixRange(n), size-n, size-1)
+
+	// Multiple ranges may legitimately be coalesced or refused with a 200.
+	multi := fmt.Sprintf("bytes=0-0,%v-%v", size-1, size-1)
+	if p, err := probeGet(ctx, url, map[string]string{"Range": multi}); err != nil {
+		add("multi-range", "FAIL", "%v", err)
+	} else {
+		ct := p.resp.Header.Get("Content-Type")
+		switch {
+		case p.resp.StatusCode == http.StatusPartialContent &&
+			strings.HasPrefix(ct, "multipart/byteranges"):
+			add("multi-range", "PASS", "multipart/byteranges response")
+		case p.resp.StatusCode == http.StatusPartialContent:
+			add("multi-range", "WARN", "coalesced into %q", p.resp.Header.Get("Content-Range"))
+		case p.resp.StatusCode == http.StatusOK:
+			add("multi-range", "WARN", "not supported, full object returned")
+		default:
+			add("multi-range", "WARN", "%v", p.resp.Status)
+		}
+	}
+
+	if validator == "" {
+		add("If-Range", "WARN", "no ETag or Last-Modified to validate ranges with")
+	} else {
+		p, err := probeGet(ctx, url, map[string]string{"Range": "bytes=0-0", "If-Range": validator})
+		switch {
+		case err != nil:
+			add("If-Range match", "FAIL", "%v", err)
+		case p.resp.StatusCode == http.StatusPartialContent:
+			add("If-Range match", "PASS", "206 for the current validator")
+		default:
+			add("If-Range match", "FAIL", "%v for the current validator", p.resp.Status)
+		}
+
+		stale := `"gocat-probe-stale"`
+		if !strings.HasPrefix(validator, `"`) && !strings.HasPrefix(validator, `W/`) {
+			stale = "Thu, 01 Jan 1970 00:00:00 GMT"
+		}
+		p, err = probeGet(ctx, url, map[string]string{"Range": "bytes=0-0", "If-Range": stale})
+		switch {
+		case err != nil:
+			add("If-Range mismatch", "FAIL", "%v", err)
+		case p.resp.StatusCode == http.StatusOK:
+			add("If-Range mismatch", "PASS", "full object for a stale validator")
+		default:
+			add("If-Range mismatch", "FAIL",
+				"%v for a stale validator; a changed object would go unnoticed", p.resp.Status)
+		}
+	}
+
+	beyond := downloader.OpenRange(size + 100)
+	if p, err := probeGet(ctx, url, map[string]string{"Range": beyond.String()}); err != nil {
+		add("unsatisfiable range", "FAIL", "%v", err)
+	} else if p.resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		add("unsatisfiable range", "WARN", "%v: %v instead of 416", beyond, p.resp.Status)
+	} else if cr := p.resp.Header.Get("Content-Range"); cr != "bytes */"+strconv.FormatInt(size, 10) {
+		add("unsatisfiable range", "WARN", "416 with Content-Range %q", cr)
+	} else {
+		add("unsatisfiable range", "PASS", "416 with %q", cr)
+	}
+
+	return results
+}
+
+func runProbe(args []string) {
+	fs := flag.NewFlagSet("probe", flag.ExitOnError)
+	registerFlags(fs)
+	parseFlags(fs, args)
+
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: gocat probe [options] <url>")
+		os.Exit(1)
+	}
+
+	if err := setup(); err != nil {
+		log.Fatal(err)
+	}
+
+	results := probeRanges(interruptContext(), fs.Arg(0))
+
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+	failed := false
+	for _, r := range results {
+		fmt.Fprintf(tw, "%v\t%v\t%v\n", r.status, r.name, r.detail)
+		failed = failed || r.status == "FAIL"
+	}
+	tw.Flush()
+	os.Stdout.Write(buf.Bytes())
+
+	if failed {
+		os.Exit(1)
+	}
+}
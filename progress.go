@@ -0,0 +1,526 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"sync"
+	"time"
+
+	tracker "github.com/msmania/gocat/progress"
+)
+
+var (
+	ProgressMode string
+	TUI          bool
+)
+
+const (
+	progressInterval     = 500 * time.Millisecond
+	progressJSONInterval = time.Second
+	// progressWindow is how many intervals the current rate averages over.
+	progressWindow = 10
+)
+
+// progress reports the transfer on stderr in one of five forms: "tty"
+// redraws a status line in place, "tui" a dashboard with a row per entry
+// in flight, "log" prints a line per chunk, "json" emits one event object
+// per line for wrapping tools, and "none" is quiet. Bytes are counted as
+// they reach the output.
+type progress struct {
+	mode  string
+	start time.Time
+
+	mu sync.Mutex
+	// files is the number of entries, or -1 when they are streamed.
+	files int
+	// totalSize is the sum of all entry sizes, or -1 when any is unknown.
+	totalSize int64
+	// done counts the bytes of finished entries, finished the entries.
+	done     int64
+	finished int
+	// active holds the entries in flight, several with -j.
+	active map[int]*progressEntry
+	drawn  bool
+	// lines is the height of the dashboard on the screen.
+	lines int
+	// rate is the combined rate of the last report.
+	rate        float64
+	etaNotified bool
+
+	stopc chan struct{}
+	exit  chan struct{}
+}
+
+// progressEntry is an entry being downloaded.
+type progressEntry struct {
+	p       *progress
+	index   int
+	url     string
+	size    int64
+	resumed int64
+	began   time.Time
+	retries int
+
+	counter *tracker.Counter
+}
+
+// progressEvent is one line of -progress json. Sizes are -1 when unknown;
+// rates are bytes per second.
+type progressEvent struct {
+	Event      string   `json:"event"`
+	Time       string   `json:"time"`
+	Index      *int     `json:"index,omitempty"`
+	Files      int      `json:"files,omitempty"`
+	URL        string   `json:"url,omitempty"`
+	Bytes      *int64   `json:"bytes,omitempty"`
+	Size       *int64   `json:"size,omitempty"`
+	Rate       *float64 `json:"rate,omitempty"`
+	ETA        *float64 `json:"eta_seconds,omitempty"`
+	TotalBytes *int64   `json:"total_bytes,omitempty"`
+	TotalSize  *int64   `json:"total_size,omitempty"`
+	Chunk      int64    `json:"chunk,omitempty"`
+	NumChunks  int64    `json:"num_chunks,omitempty"`
+	From       *int64   `json:"from,omitempty"`
+	To         *int64   `json:"to,omitempty"`
+	Backoff    *float64 `json:"backoff_seconds,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+var prog *progress
+
+// setupProgress resolves "auto" and starts the reporter.
+func setupProgress() error {
+	mode := ProgressMode
+	if TUI {
+		if mode != "" && mode != "auto" && mode != "tui" {
+			return fmt.Errorf("-tui and -progress %v are mutually exclusive", mode)
+		}
+		mode = "tui"
+	}
+	switch mode {
+	case "", "auto":
+		switch {
+		case Meter:
+			// The meter owns the status line.
+			mode = "none"
+		case isTerminal(os.Stderr):
+			mode = "tty"
+		default:
+			mode = "log"
+		}
+	case "tty", "tui", "json":
+		if Meter {
+			return fmt.Errorf("-meter and -progress %v are mutually exclusive", mode)
+		}
+		if mode == "tui" && !isTerminal(os.Stderr) {
+			return fmt.Errorf("-tui needs stderr to be a terminal")
+		}
+	case "log", "none":
+	default:
+		return fmt.Errorf("invalid -progress %q: want auto, tty, tui, log, json or none", mode)
+	}
+
+	prog = &progress{
+		mode:      mode,
+		start:     time.Now(),
+		files:     -1,
+		totalSize: -1,
+		active:    map[int]*progressEntry{},
+		stopc:     make(chan struct{}),
+		exit:      make(chan struct{}),
+	}
+	go prog.run()
+	return nil
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// currentRate is the combined rate of the entries in flight, as last
+// reported.
+func (p *progress) currentRate() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.rate
+}
+
+// setTotal records how many entries the run has and, when every size is
+// known, how many bytes.
+func (p *progress) setTotal(files int, sizes []int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.files = files
+	if len(sizes) != files {
+		return
+	}
+	p.totalSize = 0
+	for _, size := range sizes {
+		if size < 0 {
+			p.totalSize = -1
+			return
+		}
+		p.totalSize += size
+	}
+}
+
+// begin starts entry i, of which the first start bytes were written by an
+// earlier run.
+func (p *progress) begin(i int, url string, size, start int64) *progressEntry {
+	e := &progressEntry{
+		p:       p,
+		index:   i,
+		url:     url,
+		size:    size,
+		resumed: start,
+		began:   time.Now(),
+		counter: tracker.NewCounter(size, start, progressWindow),
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active[i] = e
+	p.done += start
+
+	if p.mode == "json" {
+		p.emit(progressEvent{
+			Event: "start",
+			Index: &i,
+			Files: p.files,
+			URL:   url,
+			Size:  &size,
+			Bytes: &start,
+		})
+	}
+	return e
+}
+
+// end finishes the entry after written bytes in total.
+func (e *progressEntry) end(written int64, err error) {
+	p := e.p
+	p.mu.Lock()
+	if p.active[e.index] != e {
+		p.mu.Unlock()
+		return
+	}
+	delete(p.active, e.index)
+	p.finished++
+	stats.entryEnded(err)
+	// begin already counted the resumed part.
+	p.done += written - e.resumed
+
+	elapsed := time.Since(e.began)
+	if p.mode == "json" {
+		ev := progressEvent{
+			Event: "done",
+			Index: &e.index,
+			URL:   e.url,
+			Bytes: &written,
+			Size:  &e.size,
+		}
+		if elapsed > 0 {
+			rate := float64(written-e.resumed) / elapsed.Seconds()
+			ev.Rate = &rate
+		}
+		if err != nil {
+			ev.Error = err.Error()
+		}
+		p.emit(ev)
+	}
+	p.mu.Unlock()
+	e.log(written, elapsed, err)
+}
+
+// log records the end of the entry. A failure is reported by the run, so
+// it only makes a debug record.
+func (e *progressEntry) log(written int64, elapsed time.Duration, err error) {
+	attrs := []any{
+		"event", "done",
+		"index", e.index,
+		"url", e.url,
+		"bytes", written,
+		"size", e.size,
+		"seconds", elapsed.Seconds(),
+	}
+	if err != nil {
+		logger.Debug(
+			fmt.Sprintf("%s failed after %v bytes: %v", e.url, written, err.Error()),
+			append(attrs, "error", err.Error())...,
+		)
+		return
+	}
+	logger.Info(
+		fmt.Sprintf("finished %s: %v bytes in %v", e.url, written, elapsed.Round(time.Millisecond)),
+		attrs...,
+	)
+}
+
+// Write counts bytes of the entry as they reach the output.
+func (e *progressEntry) Write(b []byte) (int, error) {
+	return e.counter.Write(b)
+}
+
+// writer returns w counting into the reporter and the run's stats.
+func (e *progressEntry) writer(w io.Writer) io.Writer {
+	if stats != nil {
+		return io.MultiWriter(w, e, stats.bytes)
+	}
+	if !e.p.ticking() {
+		return w
+	}
+	return io.MultiWriter(w, e)
+}
+
+// chunk is a downloader.Downloader OnChunk callback. Where a chunk is not
+// shown, it is still logged at debug level.
+func (p *progress) chunk(url string, chunk, numChunks, from, to int64) {
+	stats.chunk()
+	level := slog.LevelDebug
+	switch p.mode {
+	case "log":
+		level = slog.LevelInfo
+	case "json":
+		p.mu.Lock()
+		p.emit(progressEvent{
+			Event:     "chunk",
+			URL:       url,
+			Chunk:     chunk,
+			NumChunks: numChunks,
+			From:      &from,
+			To:        &to,
+		})
+		p.mu.Unlock()
+	case "tty", "tui":
+		// Subcommands that never begin an entry keep the chunk log.
+		p.mu.Lock()
+		if len(p.active) == 0 {
+			level = slog.LevelInfo
+		}
+		p.mu.Unlock()
+	}
+	logChunk(level, url, chunk, numChunks, from, to)
+}
+
+// retry is a downloader.Downloader OnRetry callback.
+func (p *progress) retry(url string, err error, backoff time.Duration) {
+	retries.record(url, err, backoff)
+	if p.mode == "tui" {
+		p.mu.Lock()
+		for _, e := range p.active {
+			if e.url == url {
+				e.retries++
+			}
+		}
+		p.mu.Unlock()
+		return
+	}
+	if p.mode != "json" {
+		return
+	}
+	secs := backoff.Seconds()
+	p.mu.Lock()
+	p.emit(progressEvent{Event: "retry", URL: url, Error: err.Error(), Backoff: &secs})
+	p.mu.Unlock()
+}
+
+// logWriter is where log lines go so that they do not run into the status
+// line: in tty mode the line is cleared first and redrawn on the next tick,
+// and so is the dashboard in tui mode.
+func (p *progress) logWriter() io.Writer {
+	if p.mode != "tty" && p.mode != "tui" {
+		return os.Stderr
+	}
+	return progressLog{p}
+}
+
+type progressLog struct{ p *progress }
+
+func (l progressLog) Write(b []byte) (int, error) {
+	l.p.logf("%s", b)
+	return len(b), nil
+}
+
+func (p *progress) logf(format string, args ...any) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+	fmt.Fprintf(os.Stderr, format, args...)
+}
+
+// ticking reports whether the entries are sampled: for the status line,
+// the json events or -notify-eta-within.
+func (p *progress) ticking() bool {
+	return p.mode == "tty" || p.mode == "tui" || p.mode == "json" || NotifyETAWithin > 0
+}
+
+func (p *progress) run() {
+	defer close(p.exit)
+	if !p.ticking() {
+		<-p.stopc
+		return
+	}
+
+	interval := progressInterval
+	if p.mode == "json" {
+		interval = progressJSONInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stopc:
+			return
+		case now := <-ticker.C:
+			p.mu.Lock()
+			if len(p.active) > 0 {
+				p.report(now)
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+// report prints the state of the entries in flight. p.mu must be held.
+func (p *progress) report(now time.Time) {
+	entries := make([]*progressEntry, 0, len(p.active))
+	for _, e := range p.active {
+		entries = append(entries, e)
+	}
+	slices.SortFunc(entries, func(a, b *progressEntry) int { return a.index - b.index })
+
+	ns := make([]int64, len(entries))
+	rates := make([]float64, len(entries))
+	totalBytes, totalRate := p.done, 0.0
+	for i, e := range entries {
+		ns[i], rates[i] = e.counter.Sample(now)
+		totalBytes += ns[i] - e.resumed
+		totalRate += rates[i]
+	}
+	p.rate = totalRate
+	totalETA := -1.0
+	if totalRate > 0 && p.totalSize >= 0 {
+		totalETA = float64(p.totalSize-totalBytes) / totalRate
+	}
+	if NotifyETAWithin > 0 {
+		eta := totalETA
+		if e := entries[0]; eta < 0 && p.files == 1 && totalRate > 0 && e.size >= 0 {
+			eta = float64(e.size-ns[0]) / totalRate
+		}
+		p.checkETA(now, eta)
+	}
+
+	if p.mode == "json" {
+		for i, e := range entries {
+			ev := progressEvent{
+				Event:      "progress",
+				Index:      &e.index,
+				URL:        e.url,
+				Bytes:      &ns[i],
+				Size:       &e.size,
+				Rate:       &rates[i],
+				TotalBytes: &totalBytes,
+				TotalSize:  &p.totalSize,
+			}
+			if rates[i] > 0 && e.size >= 0 {
+				eta := float64(e.size-ns[i]) / rates[i]
+				ev.ETA = &eta
+			}
+			p.emit(ev)
+		}
+		return
+	}
+	if p.mode == "tui" {
+		p.dashboard(entries, ns, rates, totalBytes, totalRate, totalETA)
+		return
+	}
+	if p.mode != "tty" {
+		return
+	}
+
+	files := "?"
+	if p.files >= 0 {
+		files = fmt.Sprint(p.files)
+	}
+	e, n := entries[0], ns[0]
+	line := fmt.Sprintf("%v/%v %s %v", e.index+1, files, path.Base(e.url), progressAmount(n, e.size))
+	if len(entries) > 1 {
+		line += fmt.Sprintf(" and %v more", len(entries)-1)
+	}
+	line += " " + formatSize(int64(totalRate)) + "/s"
+	if dl.Paused() {
+		line += " PAUSED"
+	}
+	if eta, ok := tracker.ETA(e.size-n, totalRate); ok && len(entries) == 1 && e.size >= 0 {
+		line += " ETA " + formatElapsed(eta)
+	}
+	if p.files != 1 {
+		line += " | total " + progressAmount(totalBytes, p.totalSize)
+		if totalETA >= 0 {
+			line += " ETA " + formatElapsed(time.Duration(totalETA*float64(time.Second)))
+		}
+	}
+	fmt.Fprintf(os.Stderr, "\r%s\033[K", line)
+	p.drawn = true
+}
+
+// clear takes the status line or the dashboard off the screen. p.mu must
+// be held.
+func (p *progress) clear() {
+	switch {
+	case p.lines > 1:
+		fmt.Fprintf(os.Stderr, "\r\033[%dA\033[J", p.lines-1)
+	case p.drawn || p.lines == 1:
+		fmt.Fprint(os.Stderr, "\r\033[K")
+	}
+	p.drawn, p.lines = false, 0
+}
+
+func progressAmount(n, size int64) string {
+	if size <= 0 {
+		return formatSize(n)
+	}
+	return fmt.Sprintf("%3d%% %v/%v", n*100/size, formatSize(n), formatSize(size))
+}
+
+// emit writes ev as a line of JSON. p.mu must be held.
+func (p *progress) emit(ev progressEvent) {
+	ev.Time = time.Now().Format(time.RFC3339Nano)
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	os.Stderr.Write(append(b, '\n'))
+}
+
+// stop ends the reporter, leaving stderr at the start of a line. In json
+// mode it emits a summary of the run.
+func (p *progress) stop() {
+	select {
+	case <-p.stopc:
+		return
+	default:
+	}
+	close(p.stopc)
+	<-p.exit
+	notifications.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+	if p.mode == "json" {
+		total := p.done
+		elapsed := time.Since(p.start).Seconds()
+		ev := progressEvent{Event: "summary", Files: p.files, TotalBytes: &total}
+		if elapsed > 0 {
+			rate := float64(total) / elapsed
+			ev.Rate = &rate
+		}
+		p.emit(ev)
+	}
+}
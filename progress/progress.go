@@ -0,0 +1,78 @@
+// Package progress tracks a transfer the way gocat's progress display
+// does: bytes as they are written, the rate over a recent window, and the
+// time left at that rate.
+package progress
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counter counts the bytes of one transfer. Write may be called from one
+// goroutine while another samples.
+type Counter struct {
+	size   int64
+	window int
+	bytes  atomic.Int64
+
+	mu      sync.Mutex
+	samples []sample
+}
+
+type sample struct {
+	at    time.Time
+	bytes int64
+}
+
+// NewCounter returns a Counter of a transfer of size bytes, -1 when
+// unknown, that resumes after start bytes. Its rate averages over the
+// last window samples.
+func NewCounter(size, start int64, window int) *Counter {
+	c := &Counter{size: size, window: max(window, 1)}
+	c.bytes.Store(start)
+	c.samples = []sample{{time.Now(), start}}
+	return c
+}
+
+// Write counts p.
+func (c *Counter) Write(p []byte) (int, error) {
+	c.bytes.Add(int64(len(p)))
+	return len(p), nil
+}
+
+// Bytes is how far the transfer is, the resumed bytes included.
+func (c *Counter) Bytes() int64 {
+	return c.bytes.Load()
+}
+
+// Size is the size the Counter was created with.
+func (c *Counter) Size() int64 {
+	return c.size
+}
+
+// Sample records how far the transfer is at now and returns that with the
+// rate, in bytes per second, since the oldest sample of the window.
+func (c *Counter) Sample(now time.Time) (int64, float64) {
+	n := c.bytes.Load()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.samples = append(c.samples, sample{now, n})
+	if len(c.samples) > c.window+1 {
+		c.samples = c.samples[1:]
+	}
+	rate := 0.0
+	if first := c.samples[0]; now.After(first.at) {
+		rate = float64(n-first.bytes) / now.Sub(first.at).Seconds()
+	}
+	return n, rate
+}
+
+// ETA is the time left for remaining bytes at rate. ok is false when it
+// cannot be told: the rate is zero or the size unknown.
+func ETA(remaining int64, rate float64) (eta time.Duration, ok bool) {
+	if rate <= 0 || remaining < 0 {
+		return 0, false
+	}
+	return time.Duration(float64(remaining) / rate * float64(time.Second)), true
+}
@@ -0,0 +1,57 @@
+package progress
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCounter(t *testing.T) {
+	c := NewCounter(1000, 100, 2)
+	if c.Bytes() != 100 || c.Size() != 1000 {
+		t.Errorf("got %v of %v, want 100 of 1000", c.Bytes(), c.Size())
+	}
+	c.Write(make([]byte, 50))
+	c.Write(make([]byte, 50))
+	if c.Bytes() != 200 {
+		t.Errorf("got %v bytes, want 200", c.Bytes())
+	}
+
+	// The rate averages over the last window samples only.
+	start := c.samples[0].at
+	if n, rate := c.Sample(start.Add(time.Second)); n != 200 || rate != 100 {
+		t.Errorf("got %v at %v/s, want 200 at 100/s", n, rate)
+	}
+	c.Write(make([]byte, 300))
+	if n, rate := c.Sample(start.Add(2 * time.Second)); n != 500 || rate != 200 {
+		t.Errorf("got %v at %v/s, want 500 at 200/s", n, rate)
+	}
+	c.Write(make([]byte, 100))
+	if n, rate := c.Sample(start.Add(3 * time.Second)); n != 600 || rate != 200 {
+		t.Errorf("got %v at %v/s, want 600 at 200/s", n, rate)
+	}
+
+	// No time passed, no rate.
+	c = NewCounter(-1, 0, 0)
+	if _, rate := c.Sample(c.samples[0].at); rate != 0 {
+		t.Errorf("got %v/s at the start", rate)
+	}
+}
+
+func TestETA(t *testing.T) {
+	for _, tc := range []struct {
+		remaining int64
+		rate      float64
+		want      time.Duration
+		ok        bool
+	}{
+		{1000, 100, 10 * time.Second, true},
+		{0, 100, 0, true},
+		{1000, 0, 0, false},
+		{-1, 100, 0, false},
+	} {
+		got, ok := ETA(tc.remaining, tc.rate)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("ETA(%v, %v) = %v, %v, want %v, %v", tc.remaining, tc.rate, got, ok, tc.want, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var (
+	ProxyURL   string
+	ProxyRules string
+	// Direct, gocat get's -direct, sends every request without a proxy.
+	Direct bool
+)
+
+// proxyRule sends requests to hosts matching pattern through proxy, or
+// directly when proxy is nil.
+type proxyRule struct {
+	pattern string
+	proxy   *url.URL
+}
+
+// proxyRules picks a proxy by the first rule whose pattern matches the
+// request's host, falling back to fallback when none does.
+type proxyRules struct {
+	rules    []proxyRule
+	fallback func(*http.Request) (*url.URL, error)
+}
+
+// parseProxyURL accepts http, https, socks5 and socks5h proxies. Both SOCKS
+// schemes let the proxy resolve names, so hosts only the bastion can
+// resolve work either way.
+func parseProxyURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy %q, want http, https, socks5 or socks5h", s)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy %q has no host", s)
+	}
+	return u, nil
+}
+
+// loadProxyRules reads lines of "pattern target", optionally separated by
+// "->" or "→", where pattern is a shExpMatch glob over the host name and
+// target is "direct" or a proxy URL. Blank lines and lines starting with
+// # are ignored.
+func loadProxyRules(path string, fallback func(*http.Request) (*url.URL, error)) (*proxyRules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &proxyRules{fallback: fallback}
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var fields []string
+		for _, field := range strings.Fields(line) {
+			if field != "->" && field != "→" {
+				fields = append(fields, field)
+			}
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%v: want \"pattern target\", got %q", path, lineNo, line)
+		}
+
+		rule := proxyRule{pattern: strings.ToLower(fields[0])}
+		if !strings.EqualFold(fields[1], "direct") {
+			if rule.proxy, err = parseProxyURL(fields[1]); err != nil {
+				return nil, fmt.Errorf("%s:%v: %w", path, lineNo, err)
+			}
+		}
+		p.rules = append(p.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(p.rules) == 0 {
+		return nil, errors.New(path + " has no proxy rules")
+	}
+	return p, nil
+}
+
+// proxy is an http.Transport Proxy function.
+func (p *proxyRules) proxy(req *http.Request) (*url.URL, error) {
+	host := strings.ToLower(req.URL.Hostname())
+	for _, rule := range p.rules {
+		if shExpMatch(host, rule.pattern) {
+			return rule.proxy, nil
+		}
+	}
+	return p.fallback(req)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+var (
+	QuotaSpec  string
+	QuotaState string
+	QuotaTag   string
+	QuotaWarn  bool
+)
+
+var quota *quotaTracker
+
+type quotaUsage struct {
+	PeriodStart time.Time `json:"period_start"`
+	Bytes       int64     `json:"bytes"`
+}
+
+// quotaTracker enforces a byte budget per tag and period, persisted in a
+// small JSON file so the budget spans runs.
+type quotaTracker struct {
+	limit  int64
+	period string
+	tag    string
+	path   string
+
+	// mu serializes add between entries downloaded at once with -j.
+	mu sync.Mutex
+}
+
+// parseQuota reads "500G", "500G/month" and the like. Periods are hour,
+// day, week and month; without one the budget never resets.
+func parseQuota(spec string) (int64, string, error) {
+	sizeStr, period, _ := strings.Cut(spec, "/")
+	limit, err := parseSize(sizeStr)
+	if err != nil {
+		return 0, "", err
+	}
+	switch period {
+	case "", "hour", "day", "week", "month":
+	default:
+		return 0, "", fmt.Errorf("unknown quota period %q", period)
+	}
+	return limit, period, nil
+}
+
+func periodStart(period string, now time.Time) time.Time {
+	now = now.UTC()
+	y, m, d := now.Date()
+	switch period {
+	case "hour":
+		return now.Truncate(time.Hour)
+	case "day":
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	case "week":
+		offset := (int(now.Weekday()) + 6) % 7 // weeks start on Monday
+		return time.Date(y, m, d-offset, 0, 0, 0, 0, time.UTC)
+	case "month":
+		return time.Date(y, m, 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return time.Time{}
+	}
+}
+
+func setupQuota() error {
+	if QuotaSpec == "" {
+		return nil
+	}
+	limit, period, err := parseQuota(QuotaSpec)
+	if err != nil {
+		return err
+	}
+
+	path := QuotaState
+	if path == "" {
+		if path, err = dataPath("quota.json"); err != nil {
+			return err
+		}
+	}
+
+	quota = &quotaTracker{limit: limit, period: period, tag: QuotaTag, path: path}
+	return nil
+}
+
+func (q *quotaTracker) load() (map[string]quotaUsage, error) {
+	state := map[string]quotaUsage{}
+	b, err := os.ReadFile(q.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("%v: %w", q.path, err)
+	}
+	return state, nil
+}
+
+// used returns this tag's usage for the current period.
+func (q *quotaTracker) used() (int64, error) {
+	state, err := q.load()
+	if err != nil {
+		return 0, err
+	}
+	u := state[q.tag]
+	if !u.PeriodStart.Equal(periodStart(q.period, time.Now())) {
+		return 0, nil
+	}
+	return u.Bytes, nil
+}
+
+// check refuses a transfer of size bytes that would exceed the budget, or
+// only warns about it with -quota-warn.
+func (q *quotaTracker) check(url string, size int64) error {
+	used, err := q.used()
+	if err != nil {
+		return err
+	}
+	if used+size <= q.limit {
+		return nil
+	}
+
+	msg := fmt.Sprintf(
+		"%s: %v bytes would exceed quota %q for tag %q (%v of %v used)",
+		url, size, QuotaSpec, q.tag, used, q.limit,
+	)
+	if QuotaWarn {
+		warnf("warning: %v", msg)
+		return nil
+	}
+	return &downloader.PermanentError{Err: errors.New(msg)}
+}
+
+// add records n transferred bytes. The file is re-read first and replaced
+// atomically, so concurrent runs lose at most a race, never the file.
+func (q *quotaTracker) add(n int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	state, err := q.load()
+	if err != nil {
+		return err
+	}
+
+	start := periodStart(q.period, time.Now())
+	u := state[q.tag]
+	if !u.PeriodStart.Equal(start) {
+		u = quotaUsage{PeriodStart: start}
+	}
+	u.Bytes += n
+	state[q.tag] = u
+
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(q.path), 0755); err != nil {
+		return err
+	}
+	tmp := q.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path)
+}
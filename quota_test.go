@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+func TestParseQuota(t *testing.T) {
+	if limit, period, err := parseQuota("500G/month"); err != nil || limit != 500<<30 || period != "month" {
+		t.Errorf("got %v, %q, %v", limit, period, err)
+	}
+	if limit, period, err := parseQuota("1M"); err != nil || limit != 1<<20 || period != "" {
+		t.Errorf("got %v, %q, %v", limit, period, err)
+	}
+	if _, _, err := parseQuota("1M/year"); err == nil {
+		t.Error("a year was accepted")
+	}
+
+	// A Wednesday afternoon.
+	now := time.Date(2024, 5, 15, 13, 45, 0, 0, time.UTC)
+	for period, want := range map[string]time.Time{
+		"hour":  time.Date(2024, 5, 15, 13, 0, 0, 0, time.UTC),
+		"day":   time.Date(2024, 5, 15, 0, 0, 0, 0, time.UTC),
+		"week":  time.Date(2024, 5, 13, 0, 0, 0, 0, time.UTC),
+		"month": time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC),
+		"":      {},
+	} {
+		if got := periodStart(period, now); !got.Equal(want) {
+			t.Errorf("periodStart(%q) = %v, want %v", period, got, want)
+		}
+	}
+}
+
+func TestQuotaPersisted(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "quota.json")
+	_, _, base := testRun(t, func() {
+		QuotaSpec, QuotaState, QuotaTag = "10/day", state, "nightly"
+	})
+	t.Cleanup(func() { quota = nil })
+
+	// 6 bytes fit in the budget, 6 more do not.
+	ctx := context.Background()
+	if _, n, err := downloadFrom(ctx, base+"/a.txt", 0, io.Discard); err != nil || n != 6 {
+		t.Fatalf("wrote %v: %v", n, err)
+	}
+	_, _, err := downloadFrom(ctx, base+"/a.txt", 0, io.Discard)
+	var perm *downloader.PermanentError
+	if !errors.As(err, &perm) {
+		t.Errorf("got %v, want the quota refusing it", err)
+	}
+
+	// What was used outlives the run, for this tag only.
+	q := &quotaTracker{limit: 10, period: "day", tag: "nightly", path: state}
+	if used, err := q.used(); err != nil || used != 6 {
+		t.Errorf("used %v: %v", used, err)
+	}
+	other := &quotaTracker{limit: 10, period: "day", tag: "other", path: state}
+	if used, err := other.used(); err != nil || used != 0 {
+		t.Errorf("another tag used %v: %v", used, err)
+	}
+
+	// A new period starts from nothing.
+	yesterday := periodStart("day", time.Now()).AddDate(0, 0, -1).Format(time.RFC3339)
+	if err := os.WriteFile(state, []byte(`{"nightly":{"period_start":"`+yesterday+`","bytes":9}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if used, err := q.used(); err != nil || used != 0 {
+		t.Errorf("used %v of yesterday's budget: %v", used, err)
+	}
+	if err := q.add(3); err != nil {
+		t.Fatal(err)
+	}
+	if used, err := q.used(); err != nil || used != 3 {
+		t.Errorf("used %v after adding 3 in a new period: %v", used, err)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+var (
+	RangeSpec string
+	TailBytes byteSize
+)
+
+// rangeFirst and rangeLast are the bytes -range asks for, both included;
+// rangeLast is -1 for the rest of the object.
+var rangeFirst, rangeLast int64 = 0, -1
+
+// partial reports whether only part of each entry is fetched.
+func partial() bool {
+	return RangeSpec != "" || TailBytes > 0
+}
+
+// parseRange checks -range and -tail-bytes.
+func parseRange() error {
+	if RangeSpec == "" {
+		return nil
+	}
+	if TailBytes > 0 {
+		return fmt.Errorf("-range and -tail-bytes are mutually exclusive")
+	}
+	from, to, ok := strings.Cut(RangeSpec, "-")
+	first, err := parseSize(from)
+	if !ok || err != nil {
+		return fmt.Errorf("invalid -range %q: want from-to, or from- for the rest", RangeSpec)
+	}
+	rangeFirst = first
+	if to != "" {
+		last, err := parseSize(to)
+		if err != nil || last < first {
+			return fmt.Errorf("invalid -range %q: want from-to, or from- for the rest", RangeSpec)
+		}
+		rangeLast = last
+	}
+	return nil
+}
+
+// window returns the part [from, to) of url, of info, that is fetched.
+func window(url string, info downloader.Info) (from, to int64, err error) {
+	if !partial() {
+		return 0, info.Size, nil
+	}
+	if !info.Ranges {
+		return 0, 0, &downloader.PermanentError{
+			Err: fmt.Errorf("%s does not serve ranges, so no part of it can be fetched", url),
+		}
+	}
+	if info.Size < 0 {
+		return 0, 0, &downloader.PermanentError{Err: fmt.Errorf("size of %s is unknown", url)}
+	}
+	if TailBytes > 0 {
+		return max(info.Size-int64(TailBytes), 0), info.Size, nil
+	}
+	if rangeFirst >= info.Size {
+		return 0, 0, &downloader.PermanentError{
+			Err: fmt.Errorf("-range %v starts past the end of %s (%v bytes)", RangeSpec, url, info.Size),
+		}
+	}
+	to = info.Size
+	if rangeLast >= 0 {
+		to = min(rangeLast+1, info.Size)
+	}
+	return rangeFirst, to, nil
+}
@@ -0,0 +1,110 @@
+// Package ratelimit paces byte streams with token buckets, the way gocat
+// holds its transfers to -limit-rate and -limit-rate-conn.
+package ratelimit
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// ReadSize bounds a single read of a limited Reader so one reader cannot
+// take a burst far larger than its share.
+const ReadSize = 16 << 10
+
+// Bucket paces bytes to a rate per second, allowing bursts of up to a
+// second's worth once it has been idle. It starts empty, so a transfer
+// shorter than a second is paced too. Readers take what they read and then
+// wait off any debt, so concurrent readers together stay within the rate.
+// A Bucket is safe for concurrent use.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// New returns a Bucket of rate bytes per second; 0 or less lets everything
+// through.
+func New(rate int64) *Bucket {
+	return &Bucket{rate: float64(rate), last: time.Now()}
+}
+
+// SetRate changes the rate from now on; 0 or less lets everything through.
+func (b *Bucket) SetRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate = float64(rate)
+	b.tokens = min(b.tokens, max(b.rate, 0))
+	b.last = time.Now()
+}
+
+// Rate is the rate in force, 0 when unlimited.
+func (b *Bucket) Rate() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return int64(max(b.rate, 0))
+}
+
+// Take accounts n bytes and blocks until the bucket is no longer in debt,
+// or returns the cause of ctx once it is done.
+func (b *Bucket) Take(ctx context.Context, n int) error {
+	b.mu.Lock()
+	if b.rate <= 0 {
+		b.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	wait := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// Reader paces r to every one of buckets. Reads are cut to ReadSize while
+// any of them limits.
+func Reader(ctx context.Context, r io.Reader, buckets ...*Bucket) io.Reader {
+	return &reader{ctx: ctx, r: r, buckets: buckets}
+}
+
+type reader struct {
+	ctx     context.Context
+	r       io.Reader
+	buckets []*Bucket
+}
+
+func (lr *reader) Read(p []byte) (int, error) {
+	if len(p) > ReadSize && lr.limited() {
+		p = p[:ReadSize]
+	}
+	n, err := lr.r.Read(p)
+	for _, b := range lr.buckets {
+		if werr := b.Take(lr.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (lr *reader) limited() bool {
+	for _, b := range lr.buckets {
+		if b.Rate() > 0 {
+			return true
+		}
+	}
+	return false
+}
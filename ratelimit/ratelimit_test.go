@@ -0,0 +1,82 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestBucketRate(t *testing.T) {
+	// The bucket starts empty, so even the first second is paced.
+	b := New(100 << 10)
+	start := time.Now()
+	n, err := io.Copy(io.Discard, Reader(context.Background(), bytes.NewReader(make([]byte, 50<<10)), b))
+	if err != nil || n != 50<<10 {
+		t.Fatalf("copied %v: %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("50K at 100K/s took %v", elapsed)
+	}
+}
+
+func TestBucketBurst(t *testing.T) {
+	b := New(1 << 20)
+	ctx := context.Background()
+
+	// An idle bucket fills up to a second's worth, and no more.
+	b.mu.Lock()
+	b.last = time.Now().Add(-10 * time.Second)
+	b.mu.Unlock()
+	start := time.Now()
+	if err := b.Take(ctx, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("a second's burst waited %v", elapsed)
+	}
+	start = time.Now()
+	if err := b.Take(ctx, 256<<10); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("the bytes past the burst waited only %v", elapsed)
+	}
+}
+
+func TestBucketUnlimited(t *testing.T) {
+	b := New(0)
+	start := time.Now()
+	if err := b.Take(context.Background(), 1<<30); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("an unlimited bucket waited %v", elapsed)
+	}
+
+	// A Reader of unlimited buckets does not cut reads.
+	r := Reader(context.Background(), bytes.NewReader(make([]byte, 4*ReadSize)), b)
+	if n, _ := r.Read(make([]byte, 4*ReadSize)); n != 4*ReadSize {
+		t.Errorf("read %v, want %v", n, 4*ReadSize)
+	}
+	b.SetRate(1)
+	if b.Rate() != 1 {
+		t.Errorf("rate %v after SetRate(1)", b.Rate())
+	}
+	r = Reader(context.Background(), bytes.NewReader(make([]byte, 4*ReadSize)), New(0), New(1<<30))
+	if n, _ := r.Read(make([]byte, 4*ReadSize)); n != ReadSize {
+		t.Errorf("read %v, want %v", n, ReadSize)
+	}
+}
+
+func TestBucketCancel(t *testing.T) {
+	b := New(1)
+	cause := errors.New("stopped")
+	ctx, cancel := context.WithCancelCause(context.Background())
+	time.AfterFunc(20*time.Millisecond, func() { cancel(cause) })
+	if err := b.Take(ctx, 1<<20); err != cause {
+		t.Errorf("got %v, want %v", err, cause)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"sync"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+var (
+	MaxRedirects    int
+	PinRedirects    bool
+	LocationTrusted bool
+)
+
+// checkRedirect stops following redirects past -max-redirects. Retrying
+// would only follow them again.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > MaxRedirects {
+		return &downloader.PermanentError{Err: fmt.Errorf("stopped after %d redirects (-max-redirects)", MaxRedirects)}
+	}
+	return nil
+}
+
+type pinnedOriginKey struct{}
+
+// redirectOrigin returns the URL req was made for: that of the first
+// request of its redirect chain, or the entry a pinned URL stands for.
+func redirectOrigin(req *http.Request) *neturl.URL {
+	if origin, ok := req.Context().Value(pinnedOriginKey{}).(*neturl.URL); ok {
+		return origin
+	}
+	for req.Response != nil && req.Response.Request != nil {
+		req = req.Response.Request
+	}
+	return req.URL
+}
+
+// otherHost reports whether req went, by redirects or a pinned URL, to
+// another host than the one it was made for. Credentials for the first
+// are not sent there unless -location-trusted, as with curl.
+func otherHost(req *http.Request) bool {
+	return !LocationTrusted && !strings.EqualFold(redirectOrigin(req).Hostname(), req.URL.Hostname())
+}
+
+// pinTransport follows the redirects of each entry once, with
+// -pin-redirects, and sends every later request for it, chunks included,
+// straight to where they led. A pre-signed backend URL then serves the
+// whole entry rather than each chunk landing on whichever backend the
+// redirect picks. A pinned URL that stops working is dropped and the
+// redirects followed again.
+type pinTransport struct {
+	base http.RoundTripper
+
+	mu     sync.Mutex
+	pinned map[string]string
+}
+
+func newPinTransport(base http.RoundTripper) *pinTransport {
+	return &pinTransport{base: base, pinned: map[string]string{}}
+}
+
+func (t *pinTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return t.base.RoundTrip(req)
+	}
+	if req.Response != nil {
+		// A redirect being followed; where it ends is pinned.
+		resp, err := t.base.RoundTrip(req)
+		if err == nil && resp.StatusCode/100 == 2 {
+			origin := redirectOrigin(req).String()
+			t.mu.Lock()
+			if t.pinned[origin] != req.URL.String() {
+				logger.Debug(fmt.Sprintf("pinned %s to %s", origin, req.URL.Redacted()), "url", origin)
+			}
+			t.pinned[origin] = req.URL.String()
+			t.mu.Unlock()
+		}
+		return resp, err
+	}
+
+	entry := req.URL.String()
+	t.mu.Lock()
+	pinned := t.pinned[entry]
+	t.mu.Unlock()
+	if pinned == "" {
+		return t.base.RoundTrip(req)
+	}
+	u, err := neturl.Parse(pinned)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.WithValue(req.Context(), pinnedOriginKey{}, req.URL)
+	out := req.Clone(ctx)
+	out.URL, out.Host = u, ""
+	resp, err := t.base.RoundTrip(out)
+	if err == nil && (resp.StatusCode/100 == 2 || resp.StatusCode == http.StatusNotModified ||
+		resp.StatusCode == http.StatusRequestedRangeNotSatisfiable) {
+		// Relative URLs in the answer still resolve against the entry.
+		resp.Request = req
+		return resp, nil
+	}
+
+	// Expired, moved away or down: forget it, and have the client follow
+	// the entry's redirects again.
+	if err == nil {
+		resp.Body.Close()
+	}
+	t.mu.Lock()
+	if t.pinned[entry] == pinned {
+		delete(t.pinned, entry)
+	}
+	t.mu.Unlock()
+	infof("%s no longer works for %s, following its redirects again", u.Redacted(), entry)
+	return t.base.RoundTrip(req)
+}
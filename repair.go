@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+func runRepair(args []string) {
+	fs := flag.NewFlagSet("repair", flag.ExitOnError)
+	registerFlags(fs)
+	out := fs.String("o", "", "existing concatenated output to repair in place")
+	parseFlags(fs, args)
+
+	if *out == "" || fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: gocat repair [options] -o <existing output> <url>")
+		os.Exit(1)
+	}
+
+	if err := setup(); err != nil {
+		log.Fatal(err)
+	}
+
+	ctx := interruptContext()
+	files, err := loadList(ctx, fs.Arg(0))
+	if err != nil {
+		fatal(ctx, err)
+	}
+
+	f, err := os.OpenFile(*out, os.O_RDWR, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	repaired, err := compareOutput(ctx, f, files, true)
+	if err != nil {
+		printRetryReport()
+		fatal(ctx, err)
+	}
+
+	printRetryReport()
+	total := int64(0)
+	for _, d := range repaired {
+		fmt.Fprintln(os.Stderr, "repaired "+d.String())
+		total += d.Length
+	}
+	fmt.Fprintf(os.Stderr, "%v bytes in %v regions repaired\n", total, len(repaired))
+	fmt.Fprintln(os.Stderr, "COMPLETED!")
+}
+
+func runBisect(args []string) {
+	fs := flag.NewFlagSet("bisect", flag.ExitOnError)
+	registerFlags(fs)
+	out := fs.String("o", "", "concatenated output to diagnose")
+	parseFlags(fs, args)
+
+	if *out == "" || fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: gocat bisect [options] -o <output> <url>")
+		os.Exit(1)
+	}
+
+	if err := setup(); err != nil {
+		log.Fatal(err)
+	}
+
+	ctx := interruptContext()
+	files, err := loadList(ctx, fs.Arg(0))
+	if err != nil {
+		fatal(ctx, err)
+	}
+
+	f, err := os.Open(*out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	diverged, err := compareOutput(ctx, f, files, false)
+	if err != nil {
+		printRetryReport()
+		fatal(ctx, err)
+	}
+
+	printRetryReport()
+	if len(diverged) == 0 {
+		fmt.Fprintln(os.Stderr, "output matches every source")
+		return
+	}
+	for _, d := range diverged {
+		fmt.Println(d.String())
+	}
+	os.Exit(1)
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+var ResumeState string
+
+type resumeEntry struct {
+	URL          string      `json:"url"`
+	Meta         *resumeMeta `json:"meta,omitempty"`
+	Size         int64       `json:"size"`
+	ETag         string      `json:"etag,omitempty"`
+	LastModified string      `json:"last_modified,omitempty"`
+	Written      int64       `json:"written"`
+}
+
+// resumeMeta is what the list said about an entry, its mirrors included,
+// so a run resumed elsewhere, without the list, fetches it the same way.
+type resumeMeta struct {
+	Output       string              `json:"out,omitempty"`
+	Route        string              `json:"output,omitempty"`
+	Size         int64               `json:"size"`
+	SHA256       string              `json:"sha256,omitempty"`
+	Header       map[string][]string `json:"header,omitempty"`
+	Retries      int                 `json:"retries,omitempty"`
+	ChunkTimeout time.Duration       `json:"timeout,omitempty"`
+	ChunkSize    int64               `json:"chunk,omitempty"`
+	Mirrors      []string            `json:"mirrors,omitempty"`
+}
+
+// resumeState records how far a run has written each entry, so an
+// interrupted run can pick up at the last written chunk, on this machine
+// or, with a copy of the output, on another one.
+type resumeState struct {
+	path    string
+	List    string        `json:"list"`
+	Entries []resumeEntry `json:"entries"`
+	// OutputSHA256 is the digest of the output up to where the entries
+	// were written, which a copy of it must match.
+	OutputSHA256 string `json:"output_sha256,omitempty"`
+
+	// mu guards Entries and h between the entry being written and a save
+	// on interrupt.
+	mu sync.Mutex
+	h  hash.Hash
+}
+
+// openResume loads or creates the state at path for this list and
+// positions out at the end of what the state says has been written. out
+// must be a regular file holding the interrupted run's output, so open it
+// with >> or 1<> rather than >.
+func openResume(path, list string, files []string, out *os.File) (*resumeState, error) {
+	s := &resumeState{path: path}
+	b, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		s.List = list
+		for _, f := range files {
+			s.Entries = append(s.Entries, resumeEntry{URL: f, Meta: snapshotMeta(f)})
+		}
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(b, s); err != nil {
+			return nil, fmt.Errorf("%v: %w", path, err)
+		}
+		if !s.matches(list, files) {
+			return nil, fmt.Errorf("%v belongs to a different list; remove it to start over", path)
+		}
+		for _, e := range s.Entries {
+			restoreMeta(e.URL, e.Meta)
+		}
+	}
+
+	fi, err := out.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, errors.New("-resume needs the output redirected to a regular file")
+	}
+
+	var offset int64
+	for _, e := range s.Entries {
+		offset += e.Written
+	}
+	if fi.Size() < offset {
+		return nil, fmt.Errorf(
+			"output has %v bytes but %v records %v; redirect with >> to keep it",
+			fi.Size(), path, offset,
+		)
+	}
+	// Drop whatever was written after the state was last saved.
+	if err := out.Truncate(offset); err != nil {
+		return nil, err
+	}
+	// What is kept must be what the state was saved with, which a copy
+	// made on another machine may not be.
+	in, err := readBack(out)
+	if err != nil {
+		return nil, err
+	}
+	s.h = sha256.New()
+	_, err = io.Copy(s.h, io.NewSectionReader(in, 0, offset))
+	if in != out {
+		in.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if sum := hex.EncodeToString(s.h.Sum(nil)); s.OutputSHA256 != "" && sum != s.OutputSHA256 {
+		return nil, fmt.Errorf(
+			"the first %v bytes of the output are not those %v was saved with; is it the output of that run?",
+			offset, path,
+		)
+	}
+	if _, err := out.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return s, s.save()
+}
+
+// readBack returns out open for reading. With >> the shell opens it for
+// writing only, so it is opened again, read-only, through its descriptor
+// or its name, whichever names the same file.
+func readBack(out *os.File) (*os.File, error) {
+	fi, err := out.Stat()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range []string{
+		fmt.Sprintf("/proc/self/fd/%d", out.Fd()),
+		fmt.Sprintf("/dev/fd/%d", out.Fd()),
+		out.Name(),
+	} {
+		in, err := os.Open(name)
+		if err != nil {
+			continue
+		}
+		if ifi, err := in.Stat(); err == nil && os.SameFile(fi, ifi) {
+			return in, nil
+		}
+		in.Close()
+	}
+	// Nothing else names it; out is readable itself with 1<>.
+	return out, nil
+}
+
+// snapshotMeta returns what the list said about url, if anything.
+func snapshotMeta(url string) *resumeMeta {
+	meta, ok := dl.Meta(url)
+	mirrors := dl.MirrorsOf(url)
+	if !ok && len(mirrors) == 0 {
+		return nil
+	}
+	if !ok {
+		meta.Size = -1
+	}
+	return &resumeMeta{
+		Output:       meta.Output,
+		Route:        meta.Route,
+		Size:         meta.Size,
+		SHA256:       meta.SHA256,
+		Header:       meta.Header,
+		Retries:      meta.Retries,
+		ChunkTimeout: meta.ChunkTimeout,
+		ChunkSize:    meta.ChunkSize,
+		Mirrors:      mirrors,
+	}
+}
+
+// restoreMeta gives url back the meta a state recorded for it, unless the
+// list it was read from again already did.
+func restoreMeta(url string, m *resumeMeta) {
+	if m == nil {
+		return
+	}
+	if _, ok := dl.Meta(url); !ok {
+		dl.SetMeta(url, downloader.EntryMeta{
+			Output:       m.Output,
+			Route:        m.Route,
+			Size:         m.Size,
+			SHA256:       m.SHA256,
+			Header:       m.Header,
+			Retries:      m.Retries,
+			ChunkTimeout: m.ChunkTimeout,
+			ChunkSize:    m.ChunkSize,
+		}, m.Mirrors...)
+		return
+	}
+	dl.AddMirrors(url, m.Mirrors...)
+}
+
+func (s *resumeState) matches(list string, files []string) bool {
+	if s.List != list || len(s.Entries) != len(files) {
+		return false
+	}
+	for i, e := range s.Entries {
+		if e.URL != files[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *resumeState) save() error {
+	s.mu.Lock()
+	if s.h != nil {
+		s.OutputSHA256 = hex.EncodeToString(s.h.Sum(nil))
+	}
+	b, err := json.MarshalIndent(s, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// start returns where entry i resumes, after checking the object has not
+// changed since its first bytes were written.
+func (s *resumeState) start(i int, info downloader.Info) (int64, error) {
+	s.mu.Lock()
+	e := &s.Entries[i]
+	if e.Written == 0 {
+		e.Size, e.ETag, e.LastModified = info.Size, info.ETag, info.LastModified
+		s.mu.Unlock()
+		return 0, s.save()
+	}
+	s.mu.Unlock()
+	if e.Size != info.Size || e.ETag != info.ETag || e.LastModified != info.LastModified {
+		return 0, &downloader.PermanentError{Err: fmt.Errorf(
+			"%s changed since the interrupted run; remove %v to start over", e.URL, s.path,
+		)}
+	}
+	return e.Written, nil
+}
+
+// resumeSaveInterval bounds how often the state is rewritten as the bytes
+// of an entry stream in. Bytes written after the last save are dropped and
+// fetched again on resume, so saving less often only costs a little
+// repeated work.
+const resumeSaveInterval = time.Second
+
+// writer records the progress of entry i as it is written.
+func (s *resumeState) writer(i int, w io.Writer) io.Writer {
+	return &resumeWriter{w: w, s: s, i: i, saved: time.Now()}
+}
+
+func (s *resumeState) finish() error {
+	return os.Remove(s.path)
+}
+
+type resumeWriter struct {
+	w     io.Writer
+	s     *resumeState
+	i     int
+	saved time.Time
+}
+
+func (r *resumeWriter) Write(p []byte) (int, error) {
+	n, err := r.w.Write(p)
+	r.s.mu.Lock()
+	r.s.Entries[r.i].Written += int64(n)
+	r.s.h.Write(p[:n])
+	r.s.mu.Unlock()
+	if time.Since(r.saved) >= resumeSaveInterval {
+		r.saved = time.Now()
+		if serr := r.s.save(); err == nil {
+			err = serr
+		}
+	}
+	return n, err
+}
+
+// resumeList names the list of the run gocat resume continues, which its
+// state was saved for.
+var resumeList string
+
+// runResume is gocat resume: it continues the -resume run whose state is
+// the last argument, with the entries recorded there, taking the other
+// arguments as download options. Redirect stdout with >> as for -resume.
+// The state and the output can be copied to another machine and resumed
+// there: the state carries what the list said about each entry, and the
+// digest the output must start with.
+func runResume(args []string) {
+	if len(args) == 0 || strings.HasPrefix(args[len(args)-1], "-") {
+		fmt.Fprintln(os.Stderr, "Usage: gocat resume [options] <state> >> <output>")
+		os.Exit(1)
+	}
+	path := args[len(args)-1]
+	b, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var s resumeState
+	if err := json.Unmarshal(b, &s); err != nil {
+		log.Fatalf("%v: %v", path, err)
+	}
+	if len(s.Entries) == 0 {
+		log.Fatalf("%v records no entries", path)
+	}
+
+	resumeList = s.List
+	download := append(slices.Clone(args[:len(args)-1]), "-resume", path)
+	for _, e := range s.Entries {
+		download = append(download, e.URL)
+	}
+	runDownload(download)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResumeElsewhere(t *testing.T) {
+	_, _, base := testRun(t, func() {})
+	files := listEntries(t, base, `/a.txt retries=7 header="X-Token: abc"`+"\n/b.html\n")
+	dir := t.TempDir()
+	state := filepath.Join(dir, "state.json")
+	out, err := os.Create(filepath.Join(dir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	s, err := openResume(state, "list", files, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := checkHeaders(context.Background(), files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.start(0, info); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.writer(0, out).Write([]byte("pla")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.save(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved resumeState
+	if err := json.Unmarshal(b, &saved); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("pla"))
+	if saved.OutputSHA256 != hex.EncodeToString(sum[:]) || saved.Entries[0].Meta == nil || saved.Entries[1].Meta != nil {
+		t.Fatalf("saved %s", b)
+	}
+
+	// Another machine, with copies of the state and the output but not
+	// the list, picks up where it was.
+	testRun(t, func() {})
+	elsewhere := t.TempDir()
+	copied := filepath.Join(elsewhere, "out")
+	if err := os.WriteFile(copied, []byte("pla and what came after the save"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(elsewhere, "state.json"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(copied, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	s, err = openResume(filepath.Join(elsewhere, "state.json"), "list", files, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, ok := dl.Meta(files[0])
+	if !ok || meta.Retries != 7 || meta.Header.Get("X-Token") != "abc" {
+		t.Errorf("meta %+v, %v, want the list's back", meta, ok)
+	}
+	if start, err := s.start(0, info); err != nil || start != 3 {
+		t.Errorf("resumes at %v: %v", start, err)
+	}
+	s.writer(0, f).Write([]byte("in\n"))
+	if got, _ := os.ReadFile(copied); string(got) != "plain\n" {
+		t.Errorf("output %q", got)
+	}
+
+	// A copy that is not the output of the run is refused.
+	if err := os.WriteFile(copied, []byte("xyz"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(elsewhere, "state.json"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = openResume(filepath.Join(elsewhere, "state.json"), "list", files, f)
+	if err == nil || !strings.Contains(err.Error(), "not those") {
+		t.Errorf("got %v for another output", err)
+	}
+}
+
+// TestResumeAppend resumes into an output opened as >> opens it, for
+// writing only.
+func TestResumeAppend(t *testing.T) {
+	_, _, base := testRun(t, func() {})
+	files := listEntries(t, base, "/a.txt\n")
+	dir := t.TempDir()
+	state := filepath.Join(dir, "state.json")
+	path := filepath.Join(dir, "out")
+	open := func() *os.File {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Close() })
+		return f
+	}
+
+	out := open()
+	s, err := openResume(state, "list", files, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := checkHeaders(context.Background(), files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.start(0, info); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.writer(0, out).Write([]byte("pla")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.save(); err != nil {
+		t.Fatal(err)
+	}
+	out.Write([]byte("ne, written after the save"))
+	out.Close()
+
+	out = open()
+	s, err = openResume(state, "list", files, out)
+	if err != nil {
+		t.Fatalf("resuming through >>: %v", err)
+	}
+	if start, err := s.start(0, info); err != nil || start != 3 {
+		t.Errorf("resumes at %v: %v", start, err)
+	}
+	s.writer(0, out).Write([]byte("in\n"))
+	if got, _ := os.ReadFile(path); string(got) != "plain\n" {
+		t.Errorf("output %q, want %q", got, "plain\n")
+	}
+}
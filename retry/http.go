@@ -0,0 +1,53 @@
+package retry
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// StatusError is an HTTP response that is not the one asked for.
+type StatusError struct {
+	Status     string
+	StatusCode int
+	// RetryAfter is the wait the server asked for, or zero.
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return e.Status
+}
+
+// ResponseError returns the StatusError of resp. 4xx answers other than
+// 408 and 429 come wrapped in a PermanentError.
+func ResponseError(resp *http.Response) error {
+	err := &StatusError{
+		Status:     resp.Status,
+		StatusCode: resp.StatusCode,
+		RetryAfter: ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+	if resp.StatusCode/100 == 4 &&
+		resp.StatusCode != http.StatusRequestTimeout &&
+		resp.StatusCode != http.StatusTooManyRequests {
+		return &PermanentError{Err: err}
+	}
+	return err
+}
+
+// ParseRetryAfter accepts both forms of Retry-After, delay-seconds and an
+// HTTP-date, and returns the wait from now; zero when there is none.
+func ParseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
@@ -0,0 +1,101 @@
+// Package retry is the retry and backoff engine of gocat: exponential
+// backoff with jitter, Retry-After, and errors that end the retries early.
+package retry
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+)
+
+// Policy is how often and how patiently a failing operation is retried.
+type Policy struct {
+	// MaxAttempts counts the first attempt too; less than 1 means 1.
+	MaxAttempts int
+	// Initial is the first backoff, grown by Multiplier after each failed
+	// attempt up to Max.
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+
+	// OnRetry, when set, is called for every failed attempt before the
+	// backoff, with the index of the attempt from 0.
+	OnRetry func(i int, err error, wait time.Duration)
+	// Hold, when set, can take a failure out of the count: it returns true
+	// once it has waited out a condition that is nobody's fault, such as a
+	// lost network, and the attempt is then repeated for free. A non-nil
+	// error ends the retries with it.
+	Hold func(ctx context.Context, err error) (bool, error)
+}
+
+// Backoff returns the wait before attempt i+1: Initial grown by Multiplier
+// per attempt up to Max, with jitter spreading it over its upper half so
+// clients that failed together do not retry together. A longer Retry-After
+// carried by err wins.
+func (p Policy) Backoff(i int, err error) time.Duration {
+	wait := float64(p.Initial)
+	for n := 0; n < i && wait < float64(p.Max); n++ {
+		wait *= p.Multiplier
+	}
+	wait = min(wait, float64(p.Max))
+	wait = wait/2 + rand.Float64()*wait/2
+
+	var se *StatusError
+	if errors.As(err, &se) && float64(se.RetryAfter) > wait {
+		return se.RetryAfter
+	}
+	return time.Duration(wait)
+}
+
+// Do runs attempt until it succeeds, making up to MaxAttempts attempts. A
+// PermanentError ends it at once. Once ctx is done, Do returns its cause
+// instead, and a cancelled attempt is neither reported nor counted.
+func (p Policy) Do(ctx context.Context, attempt func() error) error {
+	for i := 0; ; i++ {
+		err := attempt()
+		if err == nil {
+			return nil
+		}
+		if p.Hold != nil {
+			held, herr := p.Hold(ctx, err)
+			if herr != nil {
+				return herr
+			}
+			if held {
+				i--
+				continue
+			}
+		}
+		// The last attempt too may have failed only because ctx is done.
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+		var perm *PermanentError
+		if errors.As(err, &perm) || i+1 >= p.MaxAttempts {
+			return err
+		}
+		wait := p.Backoff(i, err)
+		if p.OnRetry != nil {
+			p.OnRetry(i, err, wait)
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+	}
+}
+
+// PermanentError marks a failure that retrying cannot fix, such as a 404.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
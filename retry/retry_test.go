@@ -0,0 +1,155 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestResponseError(t *testing.T) {
+	for _, tc := range []struct {
+		code      int
+		permanent bool
+	}{
+		{http.StatusNotFound, true},
+		{http.StatusForbidden, true},
+		{http.StatusRequestTimeout, false},
+		{http.StatusTooManyRequests, false},
+		{http.StatusInternalServerError, false},
+		{http.StatusServiceUnavailable, false},
+	} {
+		resp := &http.Response{
+			Status:     http.StatusText(tc.code),
+			StatusCode: tc.code,
+			Header:     http.Header{"Retry-After": {"3"}},
+		}
+		err := ResponseError(resp)
+		var perm *PermanentError
+		if got := errors.As(err, &perm); got != tc.permanent {
+			t.Errorf("%v: permanent %v, want %v", tc.code, got, tc.permanent)
+		}
+		var se *StatusError
+		if !errors.As(err, &se) {
+			t.Errorf("%v: %T is no StatusError", tc.code, err)
+			continue
+		}
+		if se.StatusCode != tc.code || se.RetryAfter != 3*time.Second {
+			t.Errorf("%v: got %v after %v", tc.code, se.StatusCode, se.RetryAfter)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		v    string
+		want time.Duration
+	}{
+		{"", 0},
+		{"0", 0},
+		{"-5", 0},
+		{"120", 2 * time.Minute},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+		{"soon", 0},
+	} {
+		if got := ParseRetryAfter(tc.v, now); got != tc.want {
+			t.Errorf("ParseRetryAfter(%q) = %v, want %v", tc.v, got, tc.want)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := Policy{Initial: 100 * time.Millisecond, Max: time.Second, Multiplier: 2}
+	for i, full := range []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	} {
+		// The jitter spreads each wait over the upper half of its full
+		// length.
+		for n := 0; n < 20; n++ {
+			if got := p.Backoff(i, errors.New("x")); got < full/2 || got > full {
+				t.Errorf("Backoff(%v) = %v, want within [%v, %v]", i, got, full/2, full)
+			}
+		}
+	}
+
+	// A longer Retry-After wins over the backoff, a shorter one does not.
+	long := &StatusError{StatusCode: 503, RetryAfter: 5 * time.Second}
+	if got := p.Backoff(0, long); got != 5*time.Second {
+		t.Errorf("Backoff with Retry-After 5s = %v", got)
+	}
+	short := &PermanentError{Err: &StatusError{StatusCode: 503, RetryAfter: time.Millisecond}}
+	if got := p.Backoff(3, short); got < 400*time.Millisecond {
+		t.Errorf("Backoff with Retry-After 1ms = %v", got)
+	}
+}
+
+func TestDo(t *testing.T) {
+	p := Policy{MaxAttempts: 3, Initial: time.Millisecond, Max: time.Millisecond, Multiplier: 2}
+	ctx := context.Background()
+
+	var retries []int
+	p.OnRetry = func(i int, err error, wait time.Duration) { retries = append(retries, i) }
+	attempts := 0
+	err := p.Do(ctx, func() error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("transient")
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 || len(retries) != 2 {
+		t.Errorf("got %v after %v attempts and retries %v", err, attempts, retries)
+	}
+
+	// The attempts run out.
+	attempts = 0
+	err = p.Do(ctx, func() error { attempts++; return errors.New("transient") })
+	if err == nil || attempts != 3 {
+		t.Errorf("got %v after %v attempts, want an error after 3", err, attempts)
+	}
+
+	// A PermanentError ends it at once.
+	attempts = 0
+	perm := &PermanentError{Err: errors.New("gone")}
+	err = p.Do(ctx, func() error { attempts++; return perm })
+	if err != perm || attempts != 1 {
+		t.Errorf("got %v after %v attempts, want %v after 1", err, attempts, perm)
+	}
+
+	// A held failure is repeated without counting.
+	attempts = 0
+	held := 0
+	p.Hold = func(ctx context.Context, err error) (bool, error) {
+		if held < 5 {
+			held++
+			return true, nil
+		}
+		return false, nil
+	}
+	err = p.Do(ctx, func() error { attempts++; return errors.New("offline") })
+	if err == nil || attempts != 8 {
+		t.Errorf("got %v after %v attempts, want an error after 5 held and 3 counted", err, attempts)
+	}
+	p.Hold = nil
+
+	// Once ctx is done, its cause is the answer.
+	cause := errors.New("stopped")
+	cctx, cancel := context.WithCancelCause(ctx)
+	attempts = 0
+	err = p.Do(cctx, func() error {
+		attempts++
+		cancel(cause)
+		return errors.New("transient")
+	})
+	if err != cause || attempts != 1 {
+		t.Errorf("got %v after %v attempts, want %v after 1", err, attempts, cause)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+const retryReportTop = 5
+
+// retryStats accumulates every failed attempt of the run so the final
+// report can point at the mirrors that cost the most.
+type retryStats struct {
+	mu         sync.Mutex
+	total      int
+	backoff    time.Duration
+	byURL      map[string]int
+	byHost     map[string]int
+	byCategory map[string]int
+}
+
+var retries = retryStats{
+	byURL:      map[string]int{},
+	byHost:     map[string]int{},
+	byCategory: map[string]int{},
+}
+
+func (s *retryStats) record(rawURL string, err error, backoff time.Duration) {
+	host := rawURL
+	if u, perr := url.Parse(rawURL); perr == nil {
+		host = u.Host
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.total++
+	s.backoff += backoff
+	s.byURL[rawURL]++
+	s.byHost[host]++
+	s.byCategory[errorCategory(err)]++
+}
+
+func errorCategory(err error) string {
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	var stall *downloader.StallError
+	var chunkTimeout *downloader.ChunkTimeoutError
+	var tlsErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var status *downloader.StatusError
+	switch {
+	case errors.As(err, &stall):
+		return "stall"
+	case errors.As(err, &status):
+		return fmt.Sprintf("http %v", status.StatusCode)
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.As(err, &tlsErr), errors.As(err, &recordErr):
+		return "tls"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return "connection reset"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &chunkTimeout),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		return "truncated"
+	default:
+		return "other"
+	}
+}
+
+type countEntry struct {
+	key   string
+	count int
+}
+
+func topCounts(m map[string]int, n int) []countEntry {
+	entries := make([]countEntry, 0, len(m))
+	for k, v := range m {
+		entries = append(entries, countEntry{k, v})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].count != entries[j].count {
+			return entries[i].count > entries[j].count
+		}
+		return entries[i].key < entries[j].key
+	})
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+// printReport writes nothing when the run needed no retries.
+func (s *retryStats) printReport(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.total == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "retries: %v in total, %v spent in backoff\n", s.total, s.backoff)
+	sections := []struct {
+		title  string
+		counts map[string]int
+	}{
+		{"by error", s.byCategory},
+		{"by host", s.byHost},
+		{"by url", s.byURL},
+	}
+	for _, sec := range sections {
+		fmt.Fprintf(w, "  %v:\n", sec.title)
+		for _, e := range topCounts(sec.counts, retryReportTop) {
+			fmt.Fprintf(w, "    %6v  %v\n", e.count, e.key)
+		}
+	}
+}
+
+func printRetryReport() {
+	retries.printReport(os.Stderr)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// GF(2^8) arithmetic with the polynomial x^8+x^4+x^3+x^2+1 (0x11d), as
+// used by most Reed-Solomon implementations.
+var gfExp, gfLog = gfTables()
+
+func gfTables() (exp [510]byte, log [256]byte) {
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		exp[i+255] = byte(x)
+		log[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	return exp, log
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// gfMulAdd adds c*src to dst.
+func gfMulAdd(dst, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	lc := int(gfLog[c])
+	for i, v := range src {
+		if v != 0 {
+			dst[i] ^= gfExp[lc+int(gfLog[v])]
+		}
+	}
+}
+
+type gfMatrix [][]byte
+
+func newGFMatrix(rows, cols int) gfMatrix {
+	m := make(gfMatrix, rows)
+	for i := range m {
+		m[i] = make([]byte, cols)
+	}
+	return m
+}
+
+func (m gfMatrix) mul(o gfMatrix) gfMatrix {
+	out := newGFMatrix(len(m), len(o[0]))
+	for i := range m {
+		for j := range o[0] {
+			var v byte
+			for k := range o {
+				v ^= gfMul(m[i][k], o[k][j])
+			}
+			out[i][j] = v
+		}
+	}
+	return out
+}
+
+// invert returns the inverse of the square matrix m by Gauss-Jordan
+// elimination.
+func (m gfMatrix) invert() (gfMatrix, error) {
+	n := len(m)
+	work := newGFMatrix(n, 2*n)
+	for i := range m {
+		copy(work[i], m[i])
+		work[i][n+i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && work[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("singular matrix")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+		if inv := gfInv(work[col][col]); inv != 1 {
+			for j := range work[col] {
+				work[col][j] = gfMul(work[col][j], inv)
+			}
+		}
+		for row := 0; row < n; row++ {
+			if row != col && work[row][col] != 0 {
+				c := work[row][col]
+				for j := range work[row] {
+					work[row][j] ^= gfMul(c, work[col][j])
+				}
+			}
+		}
+	}
+	out := newGFMatrix(n, n)
+	for i := range out {
+		copy(out[i], work[i][n:])
+	}
+	return out, nil
+}
+
+// rsCode is a systematic Reed-Solomon code of data+parity shards: any data
+// of them rebuild the rest.
+type rsCode struct {
+	data, parity int
+	// matrix maps the data shards to all shards; its first data rows are
+	// the identity.
+	matrix gfMatrix
+}
+
+func newRSCode(data, parity int) (*rsCode, error) {
+	if data < 1 || parity < 1 || data+parity > 256 {
+		return nil, fmt.Errorf("invalid Reed-Solomon code of %v data and %v parity shards", data, parity)
+	}
+	// A Vandermonde matrix, any data rows of which are independent, turned
+	// systematic by multiplying with the inverse of its top square.
+	n := data + parity
+	vm := newGFMatrix(n, data)
+	for r := 0; r < n; r++ {
+		for c := 0; c < data; c++ {
+			v := byte(1)
+			for e := 0; e < c; e++ {
+				v = gfMul(v, byte(r))
+			}
+			vm[r][c] = v
+		}
+	}
+	top, err := vm[:data].invert()
+	if err != nil {
+		return nil, err
+	}
+	return &rsCode{data: data, parity: parity, matrix: vm.mul(top)}, nil
+}
+
+// encode returns the parity shards of data shards of equal length.
+func (c *rsCode) encode(shards [][]byte) [][]byte {
+	parity := make([][]byte, c.parity)
+	for p := range parity {
+		parity[p] = make([]byte, len(shards[0]))
+		for d, shard := range shards {
+			gfMulAdd(parity[p], shard, c.matrix[c.data+p][d])
+		}
+	}
+	return parity
+}
+
+// reconstruct fills in the nil data shards of shards, data then parity,
+// from any c.data of those present.
+func (c *rsCode) reconstruct(shards [][]byte) error {
+	var rows []int
+	for i, s := range shards {
+		if s != nil && len(rows) < c.data {
+			rows = append(rows, i)
+		}
+	}
+	if len(rows) < c.data {
+		return fmt.Errorf("%v of %v shards are needed, have %v", c.data, len(shards), len(rows))
+	}
+
+	sub := newGFMatrix(c.data, c.data)
+	for i, r := range rows {
+		copy(sub[i], c.matrix[r])
+	}
+	dec, err := sub.invert()
+	if err != nil {
+		return err
+	}
+	size := len(shards[rows[0]])
+	for d := 0; d < c.data; d++ {
+		if shards[d] != nil {
+			continue
+		}
+		out := make([]byte, size)
+		for i, r := range rows {
+			gfMulAdd(out, shards[r], dec[d][i])
+		}
+		shards[d] = out
+	}
+	return nil
+}
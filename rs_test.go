@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"testing"
+)
+
+func TestGFMul(t *testing.T) {
+	// Carry-less multiplication reduced by 0x11d, bit by bit.
+	slow := func(a, b byte) byte {
+		var p int
+		x := int(a)
+		for ; b != 0; b >>= 1 {
+			if b&1 != 0 {
+				p ^= x
+			}
+			x <<= 1
+			if x&0x100 != 0 {
+				x ^= 0x11d
+			}
+		}
+		return byte(p)
+	}
+	for a := range 256 {
+		for b := range 256 {
+			if got, want := gfMul(byte(a), byte(b)), slow(byte(a), byte(b)); got != want {
+				t.Fatalf("gfMul(%#x, %#x) = %#x, want %#x", a, b, got, want)
+			}
+		}
+		if a != 0 && gfMul(byte(a), gfInv(byte(a))) != 1 {
+			t.Fatalf("gfInv(%#x) = %#x is no inverse", a, gfInv(byte(a)))
+		}
+	}
+}
+
+// forEachErasure calls f with every set of k of n shards.
+func forEachErasure(n, k int, f func(erased []int)) {
+	var rec func(start int, erased []int)
+	rec = func(start int, erased []int) {
+		if len(erased) == k {
+			f(erased)
+			return
+		}
+		for i := start; i < n; i++ {
+			rec(i+1, append(erased, i))
+		}
+	}
+	rec(0, nil)
+}
+
+func TestRSRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	for _, shape := range []struct{ data, parity int }{{1, 1}, {2, 1}, {4, 2}, {10, 4}, {17, 3}} {
+		code, err := newRSCode(shape.data, shape.parity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := make([][]byte, shape.data)
+		for i := range data {
+			data[i] = make([]byte, 64)
+			for j := range data[i] {
+				data[i][j] = byte(rng.UintN(256))
+			}
+		}
+		parity := code.encode(data)
+		all := append(append([][]byte{}, data...), parity...)
+
+		for k := 1; k <= shape.parity; k++ {
+			forEachErasure(len(all), k, func(erased []int) {
+				shards := append([][]byte{}, all...)
+				for _, i := range erased {
+					shards[i] = nil
+				}
+				if err := code.reconstruct(shards); err != nil {
+					t.Fatalf("%v+%v without %v: %v", shape.data, shape.parity, erased, err)
+				}
+				for i := range data {
+					if !bytes.Equal(shards[i], data[i]) {
+						t.Fatalf("%v+%v without %v: data shard %v differs", shape.data, shape.parity, erased, i)
+					}
+				}
+				for i, p := range code.encode(shards[:shape.data]) {
+					if !bytes.Equal(p, parity[i]) {
+						t.Fatalf("%v+%v without %v: parity shard %v differs once rebuilt", shape.data, shape.parity, erased, i)
+					}
+				}
+			})
+		}
+
+		shards := append([][]byte{}, all...)
+		for i := 0; i <= shape.parity; i++ {
+			shards[i] = nil
+		}
+		if err := code.reconstruct(shards); err == nil {
+			t.Errorf("%v+%v rebuilt from %v shards", shape.data, shape.parity, shape.data-1)
+		}
+	}
+}
+
+func TestNewRSCodeLimits(t *testing.T) {
+	for _, shape := range []struct{ data, parity int }{{0, 1}, {1, 0}, {200, 57}} {
+		if _, err := newRSCode(shape.data, shape.parity); err == nil {
+			t.Errorf("newRSCode(%v, %v) succeeded", shape.data, shape.parity)
+		}
+	}
+	if _, err := newRSCode(200, 56); err != nil {
+		t.Errorf("newRSCode(200, 56): %v", err)
+	}
+}
@@ -0,0 +1,666 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+var (
+	SkipFailed     bool
+	MaxFailures    int
+	ZeroFillFailed bool
+)
+
+// run carries the state of the default invocation from one entry to the
+// next: where output goes, and the totals for the final report.
+type run struct {
+	// ctx is cancelled by SIGINT or SIGTERM.
+	ctx    context.Context
+	out    io.Writer
+	meter  *meter
+	resume *resumeState
+	// seq orders the entries on stdout or a device.
+	seq *sequencer
+
+	// jobs holds a token for each entry in flight with -j.
+	jobs    chan struct{}
+	wg      sync.WaitGroup
+	failing sync.Mutex
+	// quit is set by the q key: no more entries are started.
+	quit atomic.Bool
+	// filtered is set once the -lines or -grep filter is satisfied, which
+	// ends the run as complete.
+	filtered atomic.Bool
+
+	// mu guards the rest, which entries in flight share.
+	mu sync.Mutex
+	// outputs maps each -o/-O path written so far to its entry, committed
+	// to the index of the last entry that was renamed into place there.
+	outputs   map[string]string
+	committed map[string]int
+	// cancels skips each entry in flight.
+	cancels map[int]context.CancelCauseFunc
+	// claimTurn is the next entry to claim its output; entries that
+	// reached the point out of order wait on claimCond in passed.
+	claimTurn int
+	passed    map[int]bool
+	claimCond *sync.Cond
+
+	expected   int64
+	written    int64
+	mismatches []string
+	// failures are the entries given up on under -skip-failed.
+	failures []string
+}
+
+func newRun(ctx context.Context) *run {
+	r := &run{
+		ctx:       ctx,
+		out:       os.Stdout,
+		jobs:      make(chan struct{}, max(Jobs, 1)),
+		outputs:   map[string]string{},
+		committed: map[string]int{},
+		cancels:   map[int]context.CancelCauseFunc{},
+		passed:    map[int]bool{},
+	}
+	r.claimCond = sync.NewCond(&r.mu)
+	if device != nil {
+		r.out = device
+	}
+	if dest != nil {
+		r.out = dest
+	}
+	if split != nil {
+		r.out = split
+	}
+	if tee != nil {
+		tee.primary = r.out
+		r.out = tee
+	}
+	if outputEnabled() {
+		// Entries go to their own files; out only feeds the meter.
+		r.out = io.Discard
+	}
+	if filter != nil {
+		filter.w = r.out
+		r.out = filter
+	}
+	if Meter {
+		r.meter = newMeter(r.out)
+		r.out = r.meter
+	}
+	if !outputEnabled() {
+		r.seq = newSequencer(r.out)
+	} else {
+		// For the entries whose output= is "-".
+		r.seq = newSequencer(os.Stdout)
+	}
+	return r
+}
+
+func (r *run) fail(err error) {
+	// The first failure exits; any others wait for it.
+	r.failing.Lock()
+	if r.meter != nil {
+		r.meter.stop()
+	}
+	prog.stop()
+	r.saveResume()
+	printRetryReport()
+	r.printFailures()
+	r.writeStats()
+	if dest != nil {
+		dest.abort()
+	}
+	if split != nil {
+		split.abort()
+	}
+	if tee != nil {
+		tee.abort()
+	}
+	fatal(r.ctx, err)
+}
+
+// giveUp ends the run with the failure of entry file or, with -skip-failed,
+// records it for the final report and lets the run go on, until
+// -max-failures entries have failed.
+func (r *run) giveUp(file string, err error) {
+	if !SkipFailed || r.ctx.Err() != nil {
+		r.fail(err)
+	}
+	msg := err.Error()
+	if !strings.Contains(msg, file) {
+		msg = file + ": " + msg
+	}
+	r.mu.Lock()
+	r.failures = append(r.failures, msg)
+	n := len(r.failures)
+	r.mu.Unlock()
+	warnf("giving up on %s", msg)
+	if MaxFailures > 0 && n >= MaxFailures {
+		r.fail(fmt.Errorf("%d entries failed, stopping (-max-failures %d)", n, MaxFailures))
+	}
+}
+
+// satisfied reports whether an entry stopped on err because the filter
+// has all it wants, and if so stops the entries still in flight and keeps
+// any more from starting.
+func (r *run) satisfied(ctx context.Context, err error) bool {
+	if err == nil || !errors.Is(err, errFilterDone) && !errors.Is(context.Cause(ctx), errFilterDone) {
+		return false
+	}
+	if !r.filtered.Swap(true) {
+		r.mu.Lock()
+		for _, cancel := range r.cancels {
+			cancel(errFilterDone)
+		}
+		r.mu.Unlock()
+	}
+	return true
+}
+
+// zeroFill pads what entry file, given up on, wrote to slot with zeros
+// up to its size, so that the entries after it are where they would have
+// been, and records its region in the index as missing. The bytes of an
+// entry that failed verification are wrong, so they are replaced with
+// zeros too if they have not gone out yet. A region that cannot be filled
+// would shift every later entry, and fails the run.
+func (r *run) zeroFill(file string, slot *seqSlot, corrupt bool) {
+	if route := entryRoute(file); route != "" && route != "-" {
+		return
+	}
+	// The source just failed; what it said before is all there is to go by.
+	size := int64(-1)
+	if info, ok := cachedHeaders(file); ok {
+		if from, to, err := window(file, info); err == nil {
+			size = to - from
+		}
+	}
+	// What the list says it should be wins over what the server said.
+	if meta, ok := dl.Meta(file); ok && meta.Size >= 0 && !partial() {
+		size = meta.Size
+	}
+	switch {
+	case corrupt && !slot.retract():
+		r.fail(fmt.Errorf("cannot zero-fill %s: its %v bytes failed verification and are already written", file, slot.total))
+	case size < 0:
+		r.fail(fmt.Errorf("cannot zero-fill %s: its size is unknown", file))
+	case slot.total > size:
+		r.fail(fmt.Errorf("cannot zero-fill %s: it wrote %v bytes, more than its %v", file, slot.total, size))
+	}
+	kept := slot.total
+	if _, err := io.CopyN(slot, zeros{}, size-kept); err != nil {
+		r.fail(err)
+	}
+	if err := slot.close(); err != nil {
+		r.fail(err)
+	}
+	if kept > 0 {
+		warnf("zero-filled %s after the %v bytes that arrived, to its %v bytes at %v", file, kept, size, slot.offset)
+	} else {
+		warnf("zero-filled %s, all of its %v bytes, at %v", file, size, slot.offset)
+	}
+	if outputIndex != nil {
+		outputIndex.add(indexEntry{URL: file, Offset: slot.offset, Length: size, Missing: true})
+	}
+}
+
+// printFailures lists the entries given up on, if any.
+func (r *run) printFailures() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.failures) == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "FAILED! %v entries:\n", len(r.failures))
+	for _, f := range r.failures {
+		fmt.Fprintln(os.Stderr, "  "+f)
+	}
+}
+
+// entry downloads entry i of the list, file, and exits on any error other
+// than a short transfer, which is reported at the end. With -skip-failed,
+// so is a failed one.
+func (r *run) entry(i int, file string) {
+	defer r.passClaim(i)
+	// Every way out has to pass the turn on the output to the next entry.
+	var slot *seqSlot
+	if r.seq != nil {
+		slot = r.seq.slot(i)
+		defer slot.close()
+	}
+	giveUp := func(err error) { r.giveUp(file, err) }
+	// giveUpCorrupt is giveUp for an entry written whole but wrong.
+	giveUpCorrupt := giveUp
+	if ZeroFillFailed && slot != nil {
+		giveUp = func(err error) {
+			r.giveUp(file, err)
+			r.zeroFill(file, slot, false)
+		}
+		giveUpCorrupt = func(err error) {
+			r.giveUp(file, err)
+			r.zeroFill(file, slot, true)
+		}
+	}
+	if SkipExisting && upToDate(r.ctx, file) {
+		infof("skipping %s, the local copy is up to date", file)
+		return
+	}
+	var err error
+	var actions []string
+	if pipe != nil {
+		var info downloader.Info
+		if info, err = checkHeaders(r.ctx, file); err != nil {
+			giveUp(err)
+			return
+		}
+		actions = pipe.actions(info.ContentType)
+		if hasAction(actions, "skip") {
+			infof("skipping %s (%v)", file, info.ContentType)
+			return
+		}
+	}
+
+	// -decompress goes first, unless the pipeline already decompresses.
+	var claimed string
+	auto := Decompress && !hasAction(actions, "decompress")
+	if auto {
+		var info downloader.Info
+		if info, err = checkHeaders(r.ctx, file); err != nil {
+			giveUp(err)
+			return
+		}
+		claimed = claimedCompression(file, info)
+	}
+
+	// route sends the entry elsewhere than the others go.
+	route := entryRoute(file)
+	if route != "" && route != "-" && r.resume != nil {
+		giveUp(&downloader.PermanentError{Err: errors.New("output= cannot be combined with -resume")})
+		return
+	}
+	w := r.out
+	if slot != nil {
+		w = slot
+	}
+	var te *tarEntry
+	if slot != nil && tarOutput() && (route == "" || route == "-") {
+		te = newTarEntry(slot)
+		w = te
+	}
+	var f *outputFile
+	var upload destWriter
+	switch {
+	case route == "-" && outputEnabled():
+		if r.meter != nil {
+			w = io.MultiWriter(slot, r.meter)
+		}
+	case strings.HasPrefix(route, "s3://"):
+		u, _ := neturl.Parse(route)
+		if upload, err = newMultipartUpload(r.ctx, u); err == nil {
+			w = upload
+			if r.meter != nil {
+				w = io.MultiWriter(upload, r.meter)
+			}
+		}
+	case routedFile(route):
+		if f, err = createRouted(route); err == nil {
+			err = r.claimOutput(i, file, f)
+		}
+		if err == nil {
+			w = f
+			if r.meter != nil {
+				w = io.MultiWriter(f, r.meter)
+			}
+		}
+	case outputEnabled() && hasAction(actions, "extract"):
+		// The archive's members are the output.
+		w = io.Discard
+	case outputEnabled():
+		var info downloader.Info
+		info, err = checkHeaders(r.ctx, file)
+		if err == nil {
+			f, err = createOutput(file, info)
+		}
+		if err == nil && (hasAction(actions, "decompress") || claimed != "") {
+			f.path = filepath.Join(filepath.Dir(f.path), decompressedName(filepath.Base(f.path)))
+		}
+		if err == nil {
+			err = r.claimOutput(i, file, f)
+		}
+		if err == nil {
+			w = f
+			if r.meter != nil {
+				w = io.MultiWriter(f, r.meter)
+			}
+		}
+	}
+
+	// Whatever is verified or recorded is what the server sent, not what
+	// the pipeline made of it.
+	var proc *processor
+	if len(actions) > 0 || auto {
+		dir := OutputDir
+		if dir == "" {
+			dir = "."
+		}
+		proc = newProcessor(actions, w, dir)
+		if auto {
+			proc.push(func(r io.Reader, w io.Writer) error { return autoDecompress(r, w, file, claimed) })
+		}
+		w = proc
+	}
+	discard := func() {
+		if proc != nil {
+			proc.abort()
+		}
+		if f != nil {
+			f.abort()
+		}
+		if upload != nil {
+			upload.abort()
+		}
+	}
+
+	h := sha256.New()
+	if historyEnabled() || journal != nil {
+		w = fanOut(w, h)
+	}
+	var pieces *pieceHasher
+	if outputIndex != nil {
+		pieces = newPieceHasher(indexPieceSize)
+		w = fanOut(w, pieces)
+	}
+
+	var start int64
+	if r.resume != nil {
+		var info downloader.Info
+		info, err = checkHeaders(r.ctx, file)
+		if err == nil {
+			start, err = r.resume.start(i, info)
+		}
+		w = r.resume.writer(i, w)
+	}
+
+	// A resumed entry cannot be verified from its tail alone, nor can a
+	// part of one.
+	var v *verifier
+	if start == 0 && !partial() {
+		if info, ierr := checkHeaders(r.ctx, file); ierr == nil {
+			v = newVerifier(file, info)
+		}
+		if v != nil {
+			w = fanOut(w, v)
+		}
+	}
+
+	ctx, cancel := context.WithCancelCause(r.ctx)
+	defer cancel(nil)
+	r.mu.Lock()
+	r.cancels[i] = cancel
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.cancels, i)
+		r.mu.Unlock()
+	}()
+
+	var expected, written int64
+	if err == nil {
+		info, herr := checkHeaders(r.ctx, file)
+		size := info.Size
+		if from, to, werr := window(file, info); werr == nil {
+			size = to - from
+		}
+		// Without headers, the download reports why.
+		if herr == nil {
+			err = checkListedSize(file, info.Size)
+		}
+		if err == nil && te != nil {
+			err = te.begin(file, info, size)
+		}
+		if err == nil {
+			pe := prog.begin(i, file, size, start)
+			lw := pe.writer(w)
+			if !partial() {
+				lw = limitListedSize(file, start, lw)
+			}
+			expected, written, err = downloadFrom(ctx, file, start, lw)
+			written += start
+			if r.satisfied(ctx, err) {
+				pe.end(written, nil)
+				return
+			}
+			pe.end(written, err)
+		}
+		// The server may not have said how big the entry is.
+		if err == nil && !partial() && info.Size < 0 {
+			err = checkListedSize(file, written)
+		}
+	}
+	// A member may not end short of its header's size, whatever happened.
+	if te != nil {
+		if terr := te.end(err != nil); terr != nil {
+			r.fail(terr)
+		}
+	}
+	if err != nil {
+		discard()
+		switch {
+		case errors.Is(context.Cause(ctx), errSkipped):
+			r.keyf("skipped %s", file)
+			r.stopped(file, "skipped", expected, written)
+			return
+		case errors.Is(err, downloader.ErrDrained):
+			r.stopped(file, "stopped", expected, written)
+			return
+		}
+		giveUp(err)
+		return
+	}
+
+	r.mu.Lock()
+	r.expected += expected
+	r.written += written
+	if expected != written {
+		r.mismatches = append(
+			r.mismatches,
+			fmt.Sprintf("%s: expected %v bytes, wrote %v", file, expected, written),
+		)
+		r.mu.Unlock()
+		discard()
+		return
+	}
+	r.mu.Unlock()
+
+	if v != nil {
+		if err := v.verify(); err != nil {
+			discard()
+			giveUpCorrupt(err)
+			return
+		}
+	}
+
+	if proc != nil {
+		if err := proc.Close(); err != nil {
+			discard()
+			giveUp(fmt.Errorf("%s: %w", file, err))
+			return
+		}
+	}
+
+	if upload != nil {
+		if err := upload.Close(); err != nil {
+			giveUp(fmt.Errorf("uploading to %v: %w", route, err))
+			return
+		}
+	}
+	if f != nil {
+		if err := r.commitOutput(i, f); err != nil {
+			r.fail(err)
+		}
+		if SkipExisting && r.holds(i, f.path) {
+			info, _ := checkHeaders(r.ctx, file)
+			if err := recordExisting(file, f.path, info); err != nil {
+				warnf("recording %s for -skip-existing: %v", f.path, err.Error())
+			}
+		}
+	}
+	if slot != nil {
+		if err := slot.close(); err != nil && !r.satisfied(ctx, err) {
+			r.fail(err)
+		}
+	}
+
+	if journal != nil {
+		applied := actions
+		if auto {
+			applied = append([]string{"decompress"}, actions...)
+		}
+		rec := journalRecord{
+			Type:     "entry",
+			URL:      file,
+			Output:   "-",
+			First:    start,
+			Pipeline: applied,
+			Bytes:    written - start,
+			SHA256:   hex.EncodeToString(h.Sum(nil)),
+		}
+		switch {
+		case f != nil:
+			rec.Output, rec.Offset = f.path, start
+		case upload != nil:
+			rec.Output, rec.Offset = route, start
+		case device != nil:
+			rec.Output, rec.Offset = OutputDevice, slot.offset
+		case dest != nil:
+			rec.Output, rec.Offset = Dest, slot.offset
+		case split != nil:
+			rec.Output, rec.Offset = SplitPrefix+splitMapSuffix, slot.offset
+		default:
+			rec.Offset = slot.offset
+		}
+		if te != nil {
+			rec.Offset += te.header
+		}
+		journal.log(rec)
+	}
+
+	// An entry routed elsewhere is not in the indexed stream.
+	if outputIndex != nil && f == nil && upload == nil {
+		outputIndex.add(pieces.entry(file, slot.offset))
+	}
+
+	// A resumed entry was only partly hashed by this run.
+	if historyEnabled() && start == 0 && !partial() {
+		info, _ := checkHeaders(r.ctx, file)
+		if err := appendHistory(file, info, hex.EncodeToString(h.Sum(nil))); err != nil {
+			log.Printf("recording history: %v", err)
+		}
+	}
+}
+
+// saveResume keeps the progress made since the last periodic save for a
+// run that is about to exit unfinished.
+func (r *run) saveResume() {
+	if r.resume == nil {
+		return
+	}
+	if err := r.resume.save(); err != nil {
+		log.Printf("saving resume state: %v", err)
+	}
+}
+
+// finish waits for the entries in flight, prints the final report and
+// exits non-zero if any entry came up short.
+func (r *run) finish() {
+	r.wait()
+	if filter != nil {
+		if err := filter.flush(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if tarOutput() && r.seq != nil {
+		if err := endTar(r.out); err != nil {
+			log.Fatal(err)
+		}
+	}
+	restoreTerminal()
+	if tee != nil {
+		if err := tee.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if r.meter != nil {
+		r.meter.stop()
+	}
+	prog.stop()
+	printRetryReport()
+	r.printFailures()
+	r.writeStats()
+	if outputIndex != nil {
+		if err := outputIndex.save(); err != nil {
+			log.Printf("writing the index: %v", err)
+		}
+	}
+
+	if device != nil && len(r.mismatches) == 0 && len(r.failures) == 0 {
+		if err := device.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// The split map is only written for a whole stream.
+	if split != nil {
+		if len(r.mismatches) > 0 || len(r.failures) > 0 {
+			split.abort()
+		} else if err := split.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// An upload is only published whole.
+	if dest != nil {
+		if len(r.mismatches) > 0 || len(r.failures) > 0 {
+			dest.abort()
+		} else if err := dest.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if len(r.mismatches) > 0 {
+		fmt.Fprintf(
+			os.Stderr,
+			"INCOMPLETE! expected %v bytes in total, wrote %v\n",
+			r.expected,
+			r.written,
+		)
+		for _, m := range r.mismatches {
+			fmt.Fprintln(os.Stderr, "  "+m)
+		}
+		r.saveResume()
+		os.Exit(1)
+	}
+	if len(r.failures) > 0 {
+		r.saveResume()
+		os.Exit(1)
+	}
+
+	if r.resume != nil {
+		if err := r.resume.finish(); err != nil {
+			log.Printf("removing resume state: %v", err)
+		}
+	}
+	fmt.Fprintln(os.Stderr, "COMPLETED!")
+}
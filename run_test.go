@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"flag"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+// testRun sets up the flags at their defaults, then what configure
+// changes, and a run writing what would go to stdout to the buffer.
+func testRun(t *testing.T, configure func()) (*run, *bytes.Buffer, string) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/a.txt":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("plain\n"))
+		case "/b.html":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html>\n"))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	// Each run gets transports of its own, so setup does not retune the
+	// connections an earlier run left idle or stack its wrappers on theirs.
+	ladder = newProtocolLadder()
+	httpClient = &http.Client{Transport: ladder}
+	// Nor does it start with the headers of an earlier run's entries, which
+	// a server on a reused port would otherwise get for its own.
+	headMu.Lock()
+	headCache, smallBodies, smallHeld = map[string]downloader.Info{}, map[string][]byte{}, 0
+	headMu.Unlock()
+	// A run's progress reads the flags, which registering sets again.
+	if prog != nil {
+		prog.stop()
+	}
+	registerFlags(flag.NewFlagSet("test", flag.ContinueOnError))
+	ProgressMode = "none"
+	Quiet = true
+	configure()
+	t.Cleanup(func() {
+		pipe = nil
+		SkipFailed, Decompress = false, false
+	})
+	if err := setup(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(prog.stop)
+	r := newRun(context.Background())
+	var out bytes.Buffer
+	r.seq = newSequencer(&out)
+	return r, &out, srv.URL
+}
+
+// runEntries runs the entries in order, failing the test if they do not
+// finish in time.
+func runEntries(t *testing.T, r *run, files ...string) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i, file := range files {
+			r.start(i, file)
+		}
+		r.wait()
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the entries did not finish: an entry left without passing its turn")
+	}
+}
+
+func TestSkippedEntryPassesTurn(t *testing.T) {
+	rules := filepath.Join(t.TempDir(), "pipeline")
+	if err := os.WriteFile(rules, []byte("text/plain skip\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, out, base := testRun(t, func() {
+		var err error
+		if pipe, err = loadPipeline(rules); err != nil {
+			t.Fatal(err)
+		}
+	})
+	runEntries(t, r, base+"/a.txt", base+"/b.html")
+	if got := out.String(); got != "<html>\n" {
+		t.Errorf("output %q, want only the kept entry", got)
+	}
+}
+
+func TestFailedEntryPassesTurn(t *testing.T) {
+	r, out, base := testRun(t, func() {
+		SkipFailed = true
+		Decompress = true
+		MaxRetry = 2
+	})
+	runEntries(t, r, base+"/missing", base+"/a.txt")
+	if got := out.String(); got != "plain\n" {
+		t.Errorf("output %q, want only the good entry", got)
+	}
+	if len(r.failures) != 1 {
+		t.Errorf("failures %q, want the missing entry", r.failures)
+	}
+}
+
+func TestDecompressChecksGzipTrailer(t *testing.T) {
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	zw.Write([]byte("unzipped\n"))
+	zw.Close()
+	good := b.Bytes()
+	// The trailer is the CRC-32 and then the length of the data.
+	crc := bytes.Clone(good)
+	crc[len(crc)-8] ^= 0xff
+	size := bytes.Clone(good)
+	size[len(size)-4]++
+	short := good[:len(good)-8]
+	objects := map[string][]byte{"/good.gz": good, "/crc.gz": crc, "/size.gz": size, "/short.gz": short}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(objects[req.URL.Path]))
+	}))
+	t.Cleanup(srv.Close)
+
+	r, out, _ := testRun(t, func() {
+		SkipFailed = true
+		Decompress = true
+	})
+	runEntries(t, r, srv.URL+"/good.gz", srv.URL+"/crc.gz", srv.URL+"/size.gz", srv.URL+"/short.gz")
+	if !strings.HasPrefix(out.String(), "unzipped\n") {
+		t.Errorf("output %q, want the good entry first", out.String())
+	}
+	want := []string{
+		"/crc.gz: gzip: invalid checksum",
+		"/size.gz: gzip: invalid checksum",
+		"/short.gz: unexpected EOF",
+	}
+	if len(r.failures) != len(want) {
+		t.Fatalf("failures %q, want %v", r.failures, len(want))
+	}
+	for i, f := range r.failures {
+		if !strings.HasSuffix(f, want[i]) {
+			t.Errorf("failure %q, want it to end in %q", f, want[i])
+		}
+	}
+}
+
+func TestLargeEntryPeekedOnce(t *testing.T) {
+	data := make([]byte, 3<<20)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	var mu sync.Mutex
+	var requests []string
+	conns := 0
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		requests = append(requests, req.Method+" "+req.Header.Get("Range"))
+		mu.Unlock()
+		http.ServeContent(w, req, "big.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	r, out, _ := testRun(t, func() { BatchSizeInMB = 1 })
+	runEntries(t, r, srv.URL+"/big.bin")
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Fatalf("wrote %v bytes, not the object", out.Len())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	// The peek is the first chunk, so no HEAD and no byte fetched twice.
+	want := []string{"GET bytes=0-1048575", "GET bytes=1048576-2097151", "GET bytes=2097152-3145727"}
+	if !slices.Equal(requests, want) {
+		t.Errorf("requests %q, want %q", requests, want)
+	}
+	if conns != 1 {
+		t.Errorf("%v connections, want the one kept alive", conns)
+	}
+}
+
+func TestResolveShard(t *testing.T) {
+	t.Cleanup(func() { ShardIndex, ShardCount = -1, 1 })
+	for _, tc := range []struct {
+		index, count int
+		env          string
+		want         int
+		wantErr      bool
+	}{
+		{index: -1, count: 1, want: 0},
+		{index: -1, count: 3, env: "2", want: 2},
+		{index: 1, count: 3, env: "2", want: 1},
+		{index: -1, count: 3, wantErr: true},
+		{index: -1, count: 3, env: "3", wantErr: true},
+		{index: -1, count: 3, env: "-3", wantErr: true},
+		{index: -1, count: 3, env: "x", wantErr: true},
+		{index: 0, count: 0, wantErr: true},
+	} {
+		t.Setenv("JOB_COMPLETION_INDEX", tc.env)
+		ShardIndex, ShardCount = tc.index, tc.count
+		err := resolveShard()
+		switch {
+		case tc.wantErr && err == nil:
+			t.Errorf("index %v of %v with JOB_COMPLETION_INDEX=%q: got %v, want an error", tc.index, tc.count, tc.env, ShardIndex)
+		case !tc.wantErr && err != nil:
+			t.Errorf("index %v of %v with JOB_COMPLETION_INDEX=%q: %v", tc.index, tc.count, tc.env, err)
+		case !tc.wantErr && ShardIndex != tc.want:
+			t.Errorf("index %v of %v with JOB_COMPLETION_INDEX=%q: got %v, want %v", tc.index, tc.count, tc.env, ShardIndex, tc.want)
+		}
+	}
+}
+
+func TestShardEntries(t *testing.T) {
+	list := []string{"a", "b", "c", "d", "e"}
+	var joined []string
+	for i := range 3 {
+		joined = append(joined, shardEntries(list, i, 3)...)
+	}
+	if !slices.Equal(joined, list) {
+		t.Errorf("the shards make %q, want %q", joined, list)
+	}
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// S3Endpoint, S3Addressing and S3Region override what the environment
+// and the AWS configuration say, for S3-compatible stores such as MinIO,
+// Ceph and Cloudflare R2.
+var (
+	S3Endpoint   string
+	S3Addressing string
+	S3Region     string
+)
+
+// emptySHA256 is the payload hash of the bodiless requests gocat sends;
+// uploads set X-Amz-Content-Sha256 to that of their body beforehand.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+type awsCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+// s3Store serves s3://bucket/key with ranged GetObject. Credentials come,
+// like the AWS SDKs', from AWS_ACCESS_KEY_ID and friends, the shared
+// credentials file, web identity (EKS), the ECS container endpoint or EC2
+// instance metadata; without any, requests go unsigned for public buckets.
+// -s3-endpoint, AWS_ENDPOINT_URL_S3 or AWS_ENDPOINT_URL select an
+// S3-compatible service, addressed path-style unless -s3-addressing says
+// otherwise.
+type s3Store struct {
+	profile  string
+	region   string
+	endpoint *url.URL
+	// addressing is auto, path or virtual.
+	addressing string
+
+	mu        sync.Mutex
+	creds     *awsCredentials
+	anonymous bool
+	// regions holds the region of each bucket found by a redirect.
+	regions map[string]string
+}
+
+func newS3Store() *s3Store {
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	s := &s3Store{profile: profile, addressing: S3Addressing, regions: map[string]string{}}
+
+	s.region = S3Region
+	if s.region == "" {
+		s.region = os.Getenv("AWS_REGION")
+	}
+	if s.region == "" {
+		s.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if s.region == "" {
+		section := "profile " + profile
+		if profile == "default" {
+			section = "default"
+		}
+		if config, err := readINI(awsConfigFile()); err == nil {
+			s.region = config[section]["region"]
+		}
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+
+	for _, v := range []string{S3Endpoint, os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL")} {
+		if v != "" {
+			if u, err := url.Parse(v); err == nil && u.Host != "" {
+				s.endpoint = u
+				break
+			}
+		}
+	}
+	return s
+}
+
+func awsConfigFile() string {
+	if v := os.Getenv("AWS_CONFIG_FILE"); v != "" {
+		return v
+	}
+	return homeFile(".aws", "config")
+}
+
+func (s *s3Store) prepare(req *http.Request) error {
+	bucket, key := req.URL.Host, req.URL.Path
+	s.mu.Lock()
+	region := s.regions[bucket]
+	s.mu.Unlock()
+	if region == "" {
+		region = s.region
+	}
+
+	u := &url.URL{Scheme: "https", Host: "s3." + region + ".amazonaws.com", RawQuery: req.URL.RawQuery}
+	var base string
+	if s.endpoint != nil {
+		u.Scheme, u.Host = s.endpoint.Scheme, s.endpoint.Host
+		base = strings.TrimSuffix(s.endpoint.Path, "/")
+	}
+	// Dotted names do not match AWS's wildcard certificate.
+	pathStyle := s.addressing == "path" ||
+		s.addressing != "virtual" && (s.endpoint != nil || strings.Contains(bucket, "."))
+	if pathStyle {
+		u.Path = base + "/" + bucket + key
+	} else {
+		u.Host = bucket + "." + u.Host
+		u.Path = base + key
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	u.RawPath = awsEscapePath(u.Path)
+	req.URL, req.Host = u, ""
+
+	creds, err := s.credentials(req.Context())
+	if err != nil {
+		return err
+	}
+	if creds != nil {
+		signV4(req, creds, region, "s3", time.Now())
+	}
+	return nil
+}
+
+// retry follows S3's answer that a bucket lives in another region.
+func (s *s3Store) retry(req *http.Request, resp *http.Response) bool {
+	if resp.StatusCode != http.StatusMovedPermanently && resp.StatusCode != http.StatusBadRequest {
+		return false
+	}
+	region := resp.Header.Get("X-Amz-Bucket-Region")
+	if region == "" || s.endpoint != nil {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.regions[req.URL.Host] == region {
+		return false
+	}
+	s.regions[req.URL.Host] = region
+	return true
+}
+
+// credentials returns the first credentials the chain yields, nil meaning
+// anonymous access, and renews expiring ones.
+func (s *s3Store) credentials(ctx context.Context) (*awsCredentials, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.anonymous {
+		return nil, nil
+	}
+	if s.creds != nil && (s.creds.Expiration.IsZero() || time.Until(s.creds.Expiration) > tokenRefreshMargin) {
+		return s.creds, nil
+	}
+
+	creds, err := s.lookup(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if creds == nil {
+		s.anonymous = true
+		return nil, nil
+	}
+	s.creds = creds
+	return creds, nil
+}
+
+func (s *s3Store) lookup(ctx context.Context) (*awsCredentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return &awsCredentials{
+			AccessKeyID:     id,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			Token:           os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		path = homeFile(".aws", "credentials")
+	}
+	shared, err := readINI(path)
+	if err != nil {
+		return nil, err
+	}
+	if p := shared[s.profile]; p["aws_access_key_id"] != "" {
+		return &awsCredentials{
+			AccessKeyID:     p["aws_access_key_id"],
+			SecretAccessKey: p["aws_secret_access_key"],
+			Token:           p["aws_session_token"],
+		}, nil
+	}
+
+	if tokenFile := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"); tokenFile != "" {
+		return assumeRoleWithWebIdentity(ctx, tokenFile, os.Getenv("AWS_ROLE_ARN"), s.region)
+	}
+
+	if full, rel := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"),
+		os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); full != "" || rel != "" {
+		if full == "" {
+			full = "http://169.254.170.2" + rel
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", full, nil)
+		if err != nil {
+			return nil, err
+		}
+		if token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		creds := &awsCredentials{}
+		if err := fetchJSON(metadataClient, req, creds); err != nil {
+			return nil, err
+		}
+		return creds, nil
+	}
+
+	if !strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true") {
+		if creds, err := ec2RoleCredentials(ctx); err == nil {
+			return creds, nil
+		}
+	}
+	return nil, nil
+}
+
+// ec2RoleCredentials asks the EC2 instance metadata service, IMDSv2
+// style, for the credentials of the instance's role.
+func ec2RoleCredentials(ctx context.Context) (*awsCredentials, error) {
+	const imds = "http://169.254.169.254/latest"
+	req, err := http.NewRequestWithContext(ctx, "PUT", imds+"/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "21600")
+	token, err := readSmall(metadataClient, req)
+	if err != nil {
+		return nil, err
+	}
+
+	get := func(path string) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", imds+path, nil)
+		if err == nil {
+			req.Header.Set("X-Aws-Ec2-Metadata-Token", token)
+		}
+		return req, err
+	}
+	req, err = get("/meta-data/iam/security-credentials/")
+	if err != nil {
+		return nil, err
+	}
+	role, err := readSmall(metadataClient, req)
+	if err != nil {
+		return nil, err
+	}
+	name, _, _ := strings.Cut(strings.TrimSpace(role), "\n")
+	if name == "" {
+		return nil, fmt.Errorf("instance has no IAM role")
+	}
+
+	req, err = get("/meta-data/iam/security-credentials/" + name)
+	if err != nil {
+		return nil, err
+	}
+	creds := &awsCredentials{}
+	if err := fetchJSON(metadataClient, req, creds); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+// readSmall sends req and returns its short 200 answer.
+func readSmall(client *http.Client, req *http.Request) (string, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s %s: %v", req.Method, req.URL.Redacted(), resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	return string(b), err
+}
+
+func assumeRoleWithWebIdentity(ctx context.Context, tokenFile, role, region string) (*awsCredentials, error) {
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {role},
+		"RoleSessionName":  {"gocat"},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	endpoint := "https://sts." + region + ".amazonaws.com/"
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := credentialClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("AssumeRoleWithWebIdentity %v: %v", role, resp.Status)
+	}
+
+	var out struct {
+		Credentials struct {
+			AccessKeyID     string `xml:"AccessKeyId"`
+			SecretAccessKey string
+			SessionToken    string
+			Expiration      time.Time
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	c := out.Credentials
+	return &awsCredentials{
+		AccessKeyID:     c.AccessKeyID,
+		SecretAccessKey: c.SecretAccessKey,
+		Token:           c.SessionToken,
+		Expiration:      c.Expiration,
+	}, nil
+}
+
+// signV4 signs a bodiless request with AWS Signature Version 4, covering
+// the host, any Range and the x-amz-* headers. S3 alone wants the payload
+// hash as X-Amz-Content-Sha256 as well.
+func signV4(req *http.Request, creds *awsCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	payload := req.Header.Get("X-Amz-Content-Sha256")
+	if payload == "" {
+		payload = emptySHA256
+		if service == "s3" {
+			req.Header.Set("X-Amz-Content-Sha256", payload)
+		}
+	}
+	if creds.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.Token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "range" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, name := range names {
+		canonHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		awsEscapePath(req.URL.Path),
+		awsCanonicalQuery(req.URL.Query()),
+		canonHeaders.String(),
+		signed,
+		payload,
+	}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	for _, part := range []string{region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signed, sig,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+// awsEscape percent-encodes everything but the unreserved characters, as
+// SigV4 requires; slashes are kept for paths.
+func awsEscape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || keepSlash && c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func awsEscapePath(p string) string {
+	return awsEscape(p, true)
+}
+
+func awsCanonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := append([]string{}, q[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, awsEscape(k, false)+"="+awsEscape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
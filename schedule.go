@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// scheduleHistory is how many of its latest runs a schedule keeps.
+const scheduleHistory = 20
+
+// serveSchedule queues a job for its URL each time its cron spec comes
+// around, plus up to Jitter so that schedules set for the same minute do
+// not all start at once. A run whose last job has not ended yet is
+// skipped rather than queued beside it.
+type serveSchedule struct {
+	ID       string `json:"id"`
+	URL      string `json:"url"`
+	Output   string `json:"output,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+	Cron     string `json:"cron"`
+	Jitter   string `json:"jitter,omitempty"`
+	// Next is when the next run is due; one missed while the daemon was
+	// down runs once it is back.
+	Next time.Time `json:"next"`
+	// Job is the job of the last run.
+	Job     string        `json:"job,omitempty"`
+	History []scheduleRun `json:"history,omitempty"`
+
+	cron   *cronSchedule
+	jitter time.Duration
+}
+
+// scheduleRun is one run of a schedule: the job it queued and how that
+// ended, or skipped.
+type scheduleRun struct {
+	Due   time.Time `json:"due"`
+	Job   string    `json:"job,omitempty"`
+	State string    `json:"state"`
+	Error string    `json:"error,omitempty"`
+}
+
+// parse parses the Cron and Jitter of sc.
+func (sc *serveSchedule) parse() error {
+	c, err := parseCron(sc.Cron)
+	if err != nil {
+		return err
+	}
+	if c.next(time.Now()).IsZero() {
+		return fmt.Errorf("cron %q never comes around", sc.Cron)
+	}
+	sc.cron = c
+	sc.jitter = 0
+	if sc.Jitter != "" {
+		if sc.jitter, err = time.ParseDuration(sc.Jitter); err != nil || sc.jitter < 0 {
+			return fmt.Errorf("invalid jitter %q: want a duration such as 10m", sc.Jitter)
+		}
+	}
+	return nil
+}
+
+// plan sets Next to the first time after t the schedule comes around.
+func (sc *serveSchedule) plan(t time.Time) {
+	sc.Next = sc.cron.next(t)
+	if sc.jitter > 0 {
+		sc.Next = sc.Next.Add(rand.N(sc.jitter))
+	}
+}
+
+// record adds run to the history, dropping the oldest beyond
+// scheduleHistory.
+func (sc *serveSchedule) record(run scheduleRun) {
+	sc.History = append(sc.History, run)
+	if len(sc.History) > scheduleHistory {
+		sc.History = slices.Delete(sc.History, 0, len(sc.History)-scheduleHistory)
+	}
+}
+
+func (s *server) schedule(id string) *serveSchedule {
+	for _, sc := range s.state.Schedules {
+		if sc.ID == id {
+			return sc
+		}
+	}
+	return nil
+}
+
+// tick runs the schedules as they come due.
+func (s *server) tick(ctx context.Context) {
+	ticker := time.NewTicker(serveSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			s.runDue(now)
+			s.mu.Unlock()
+		}
+	}
+}
+
+// runDue queues a job for each schedule due by now. s.mu must be held.
+func (s *server) runDue(now time.Time) {
+	changed := false
+	for _, sc := range s.state.Schedules {
+		if sc.Next.After(now) {
+			continue
+		}
+		changed = true
+		run := scheduleRun{Due: sc.Next}
+		sc.plan(now)
+		if last := s.job(sc.Job); last != nil && (last.State == "queued" || last.State == "running") {
+			run.State, run.Error = "skipped", fmt.Sprintf("job %s has not ended", last.ID)
+			infof("skipped schedule %s: job %s has not ended", sc.ID, last.ID)
+			s.record(sc, run)
+			continue
+		}
+		j := &serveJob{URL: sc.URL, Output: sc.Output, Priority: sc.Priority, Schedule: sc.ID}
+		if err := s.queue(j); err != nil {
+			run.State, run.Error = "failed", err.Error()
+			warnf("schedule %s: %v", sc.ID, err)
+			s.record(sc, run)
+			continue
+		}
+		sc.Job, run.Job, run.State = j.ID, j.ID, j.State
+		s.record(sc, run)
+	}
+	if changed {
+		s.saveOrWarn()
+	}
+}
+
+// record adds run to the history of sc, and forgets the jobs of sc that
+// have ended and fallen out of it, so that a schedule does not grow the
+// state file run after run. s.mu must be held.
+func (s *server) record(sc *serveSchedule, run scheduleRun) {
+	sc.record(run)
+	kept := map[string]bool{sc.Job: true}
+	for _, r := range sc.History {
+		kept[r.Job] = true
+	}
+	s.state.Jobs = slices.DeleteFunc(s.state.Jobs, func(j *serveJob) bool {
+		return j.Schedule == sc.ID && !kept[j.ID] && j.State != "queued" && j.State != "running"
+	})
+}
+
+// ended records how j, which has ended, did in the history of the
+// schedule that queued it, if any. s.mu must be held.
+func (s *server) ended(j *serveJob) {
+	sc := s.schedule(j.Schedule)
+	if sc == nil {
+		return
+	}
+	for i := range sc.History {
+		if run := &sc.History[i]; run.Job == j.ID {
+			run.State, run.Error = j.State, j.Error
+		}
+	}
+}
+
+func (s *server) addSchedule(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		URL      string `json:"url"`
+		Output   string `json:"output"`
+		Priority int    `json:"priority"`
+		Cron     string `json:"cron"`
+		Jitter   string `json:"jitter"`
+	}
+	if err := json.NewDecoder(io.LimitReader(req.Body, 1<<20)).Decode(&body); err != nil {
+		serveError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return
+	}
+	if err := s.checkJob(body.URL, body.Output); err != nil {
+		serveError(w, http.StatusBadRequest, err)
+		return
+	}
+	sc := &serveSchedule{
+		URL:      body.URL,
+		Output:   body.Output,
+		Priority: body.Priority,
+		Cron:     body.Cron,
+		Jitter:   body.Jitter,
+	}
+	if err := sc.parse(); err != nil {
+		serveError(w, http.StatusBadRequest, err)
+		return
+	}
+	sc.plan(time.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sc.ID = "s" + strconv.Itoa(s.state.NextSchedule)
+	s.state.NextSchedule++
+	s.state.Schedules = append(s.state.Schedules, sc)
+	if err := s.save(); err != nil {
+		s.state.NextSchedule--
+		s.state.Schedules = s.state.Schedules[:len(s.state.Schedules)-1]
+		serveError(w, http.StatusInternalServerError, err)
+		return
+	}
+	infof("scheduled %s as %s at %q, next at %v", sc.URL, sc.ID, sc.Cron, sc.Next.Format(time.RFC3339))
+	serveJSON(w, http.StatusCreated, sc)
+}
+
+func (s *server) listSchedules(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	serveJSON(w, http.StatusOK, map[string]any{"schedules": s.state.Schedules})
+}
+
+func (s *server) getSchedule(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sc := s.schedule(req.PathValue("id"))
+	if sc == nil {
+		serveError(w, http.StatusNotFound, fmt.Errorf("no schedule %s", req.PathValue("id")))
+		return
+	}
+	serveJSON(w, http.StatusOK, sc)
+}
+
+// deleteSchedule stops a schedule; the job of its last run goes on.
+func (s *server) deleteSchedule(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sc := s.schedule(req.PathValue("id"))
+	if sc == nil {
+		serveError(w, http.StatusNotFound, fmt.Errorf("no schedule %s", req.PathValue("id")))
+		return
+	}
+	s.state.Schedules = slices.DeleteFunc(s.state.Schedules, func(o *serveSchedule) bool { return o == sc })
+	s.saveOrWarn()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// loadSchedules parses the schedules of a state file.
+func (s *server) loadSchedules() error {
+	// State files from before schedules have none.
+	s.state.NextSchedule = max(s.state.NextSchedule, 1)
+	for _, sc := range s.state.Schedules {
+		if err := sc.parse(); err != nil {
+			return fmt.Errorf("schedule %s: %w", sc.ID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,748 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/msmania/gocat/downloader"
+	tracker "github.com/msmania/gocat/progress"
+)
+
+// serveSampleInterval is how often the rates of the running jobs are
+// sampled; serveWindow is how many samples they average over.
+const (
+	serveSampleInterval = time.Second
+	serveWindow         = 10
+)
+
+var (
+	errJobCancelled = errors.New("cancelled")
+)
+
+// serveJob is a download queued with gocat serve. Its state is queued,
+// running, done, failed or cancelled.
+type serveJob struct {
+	ID     string `json:"id"`
+	URL    string `json:"url"`
+	Output string `json:"output,omitempty"`
+	State  string `json:"state"`
+	// Priority orders the queue, highest first; a job preempts a running
+	// one of lower priority when every worker is busy.
+	Priority int `json:"priority,omitempty"`
+	// Schedule is the schedule that queued the job, if any.
+	Schedule string `json:"schedule,omitempty"`
+	// Size is -1 until known; ETag and LastModified are what a restarted
+	// daemon checks before resuming the partial file.
+	Size         int64      `json:"size"`
+	Written      int64      `json:"written"`
+	Rate         float64    `json:"rate,omitempty"`
+	ETag         string     `json:"etag,omitempty"`
+	LastModified string     `json:"last_modified,omitempty"`
+	Error        string     `json:"error,omitempty"`
+	Created      time.Time  `json:"created"`
+	Finished     *time.Time `json:"finished,omitempty"`
+
+	counter   *tracker.Counter
+	cancel    context.CancelCauseFunc
+	drain     func()
+	preempted bool
+}
+
+type serveState struct {
+	Version      int              `json:"version"`
+	NextID       int              `json:"next_id"`
+	Jobs         []*serveJob      `json:"jobs"`
+	NextSchedule int              `json:"next_schedule,omitempty"`
+	Schedules    []*serveSchedule `json:"schedules,omitempty"`
+	NextManifest int              `json:"next_manifest,omitempty"`
+	Manifests    []*serveManifest `json:"manifests,omitempty"`
+}
+
+// server runs the jobs of gocat serve, workers at a time, by priority and
+// then in the order they were queued, and keeps them in its state file so
+// that a restarted daemon picks up where the last one stopped: a job
+// interrupted mid-transfer, or preempted by one of higher priority,
+// resumes from its partial file if the object has not changed.
+type server struct {
+	dir     string
+	path    string
+	workers int
+	// token, when set, is the bearer token every request must carry;
+	// schemes are those a job's URL may have.
+	token   string
+	schemes []string
+
+	mu    sync.Mutex
+	cond  *sync.Cond
+	state serveState
+}
+
+// runServe is gocat serve: it takes downloads to queue, queries and
+// cancellations as JSON over HTTP on -listen, a unix socket or a TCP
+// address, and writes the downloads to -dir.
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	registerFlags(fs)
+	listen := fs.String("listen", "", "where to take requests: unix:///path/to/socket or tcp://host:port")
+	dir := fs.String("dir", ".", "directory the downloads are written to")
+	statePath := fs.String("state", "", "file that keeps the queue across restarts (default serve.json in the data directory)")
+	fs.IntVar(&Jobs, "j", 2, "number of downloads run at a time")
+	fs.StringVar(&Fair, "fair", "",
+		"share -limit-rate between the running jobs evenly (file), by size (byte) or by job priority, counting those below 1 as 1 (priority)")
+	token := fs.String("token", "",
+		"require \"Authorization: Bearer <token>\" on every request; needed to listen on TCP")
+	schemes := fs.String("schemes", "http,https", "URL schemes a job may use, separated by commas")
+	parseFlags(fs, args)
+
+	if fs.NArg() != 0 || *listen == "" {
+		fmt.Fprintln(os.Stderr, "Usage: gocat serve -listen unix://<path>|tcp://<host:port> [-dir <dir>] [-state <file>] [-j <n>] [options]")
+		fmt.Fprintln(os.Stderr, "  POST /jobs {\"url\": ..., \"output\": ..., \"priority\": n}  queue a download")
+		fmt.Fprintln(os.Stderr, "  GET /jobs, GET /jobs/<id>              show the jobs and their progress")
+		fmt.Fprintln(os.Stderr, "  GET /jobs/<id>/output                  fetch the file of a done job, with a checksum of each range for gocat")
+		fmt.Fprintln(os.Stderr, "  DELETE /jobs/<id>                      cancel a job, or forget a finished one")
+		fmt.Fprintln(os.Stderr, "  POST /schedules {\"url\": ..., \"cron\": \"0 2 * * *\", \"jitter\": \"10m\", ...}  queue a job on a schedule")
+		fmt.Fprintln(os.Stderr, "  GET /schedules, GET /schedules/<id>    show the schedules and their latest runs")
+		fmt.Fprintln(os.Stderr, "  DELETE /schedules/<id>                 stop a schedule")
+		fmt.Fprintln(os.Stderr, "  POST /manifests {\"list\": ..., \"lease\": \"10m\"}  share a list's entries between gocat work processes")
+		fmt.Fprintln(os.Stderr, "  GET /manifests, GET /manifests/<id>    show the manifests and who has each entry")
+		fmt.Fprintln(os.Stderr, "  DELETE /manifests/<id>                 forget a manifest")
+		os.Exit(1)
+	}
+	if Jobs < 1 {
+		log.Fatalf("invalid -j %v: want at least 1", Jobs)
+	}
+	if *statePath == "" {
+		p, err := dataPath("serve.json")
+		if err != nil {
+			log.Fatal(err)
+		}
+		*statePath = p
+	}
+	if err := setup(); err != nil {
+		log.Fatal(err)
+	}
+
+	s, err := openServer(longPath(*dir), *statePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.token, s.workers = *token, Jobs
+	for _, scheme := range strings.Split(*schemes, ",") {
+		s.schemes = append(s.schemes, strings.ToLower(strings.TrimSpace(scheme)))
+	}
+	ln, err := serveListen(*listen, *token != "")
+	if err != nil {
+		log.Fatal(err)
+	}
+	infof("serving %s, downloading to %s", *listen, *dir)
+
+	ctx := interruptContext()
+	srv := &http.Server{Handler: s.handler()}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+		s.mu.Lock()
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}()
+
+	var wg sync.WaitGroup
+	for range Jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.work(ctx)
+		}()
+	}
+	go s.sample(ctx)
+	go s.tick(ctx)
+	if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.save(); err != nil {
+		log.Fatal(err)
+	}
+	queued := 0
+	for _, j := range s.state.Jobs {
+		if j.State == "queued" {
+			queued++
+		}
+	}
+	infof("stopped; %v jobs left queued in %s", queued, s.path)
+}
+
+// serveListen listens on addr, removing a socket a dead daemon left behind.
+// Anyone who can reach the API can have files fetched and written, so the
+// socket is the owner's alone from the start, and a TCP address, which any
+// local user can reach even on loopback, needs a token.
+func serveListen(addr string, token bool) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(addr, "unix://"):
+		path := strings.TrimPrefix(addr, "unix://")
+		if _, err := os.Stat(path); err == nil {
+			if c, err := net.Dial("unix", path); err == nil {
+				c.Close()
+				return nil, fmt.Errorf("%s: another daemon is listening", path)
+			}
+			os.Remove(path)
+		}
+		return listenPrivate(path)
+	case strings.HasPrefix(addr, "tcp://"):
+		if !token {
+			return nil, fmt.Errorf("-listen %s takes requests from any user: pass -token to serve it", addr)
+		}
+		return net.Listen("tcp", strings.TrimPrefix(addr, "tcp://"))
+	}
+	return nil, fmt.Errorf("invalid -listen %q: want unix://<path> or tcp://<host:port>", addr)
+}
+
+func openServer(dir, path string) (*server, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &server{dir: dir, path: path, state: serveState{Version: 1, NextID: 1, NextSchedule: 1, NextManifest: 1}}
+	s.cond = sync.NewCond(&s.mu)
+	b, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return s, nil
+	case err != nil:
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.state); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := s.loadSchedules(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := s.loadManifests(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	resumed := 0
+	for _, j := range s.state.Jobs {
+		// The daemon that ran it stopped, or died, before it ended.
+		if j.State == "running" {
+			j.State = "queued"
+		}
+		if j.State == "queued" {
+			resumed++
+		}
+	}
+	if resumed > 0 {
+		infof("%v jobs queued by an earlier daemon", resumed)
+	}
+	return s, nil
+}
+
+// save writes the state file. s.mu must be held.
+func (s *server) save() error {
+	b, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// saveOrWarn is save for the changes that cannot be taken back: the job
+// goes on, but a restart may not know of it.
+func (s *server) saveOrWarn() {
+	if err := s.save(); err != nil {
+		warnf("saving %s: %v", s.path, err)
+	}
+}
+
+func (s *server) job(id string) *serveJob {
+	for _, j := range s.state.Jobs {
+		if j.ID == id {
+			return j
+		}
+	}
+	return nil
+}
+
+// view is j as the API shows it. s.mu must be held.
+func (s *server) view(j *serveJob) serveJob {
+	v := *j
+	if j.counter != nil {
+		v.Written = j.counter.Bytes()
+	}
+	return v
+}
+
+func (s *server) work(ctx context.Context) {
+	for {
+		s.mu.Lock()
+		var j *serveJob
+		for ctx.Err() == nil {
+			if j = s.next(); j != nil {
+				break
+			}
+			s.cond.Wait()
+		}
+		if j == nil {
+			s.mu.Unlock()
+			return
+		}
+		jctx, cancel := context.WithCancelCause(ctx)
+		jctx, drain := downloader.WithDrain(jctx)
+		j.State, j.cancel, j.drain = "running", cancel, drain
+		s.saveOrWarn()
+		s.mu.Unlock()
+
+		part, err := s.download(jctx, j)
+		cause := context.Cause(jctx)
+		cancel(nil)
+
+		s.mu.Lock()
+		j.cancel, j.drain = nil, nil
+		if j.counter != nil {
+			j.Written, j.Rate = j.counter.Bytes(), 0
+			j.counter = nil
+		}
+		switch {
+		case err == nil:
+			now := time.Now().UTC()
+			j.State, j.Finished, j.preempted = "done", &now, false
+			infof("finished %s: %v bytes to %s", j.URL, j.Written, j.Output)
+		case j.preempted && errors.Is(err, downloader.ErrDrained):
+			// The partial file holds every chunk written, and is kept
+			// for when its turn comes again.
+			j.State, j.preempted = "queued", false
+			infof("preempted %s", j.URL)
+		case errors.Is(cause, errJobCancelled):
+			now := time.Now().UTC()
+			j.State, j.Finished, j.Error = "cancelled", &now, ""
+			if part != "" {
+				os.Remove(part)
+			}
+			infof("cancelled %s", j.URL)
+		case ctx.Err() != nil:
+			// The daemon is stopping: the next one resumes it.
+			j.State = "queued"
+		default:
+			now := time.Now().UTC()
+			j.State, j.Finished, j.Error = "failed", &now, err.Error()
+			warnf("%s failed: %v", j.URL, err)
+		}
+		if j.State != "queued" {
+			s.ended(j)
+		}
+		s.saveOrWarn()
+		s.mu.Unlock()
+	}
+}
+
+// next is the queued job to run next: the first of the highest priority.
+// s.mu must be held.
+func (s *server) next() *serveJob {
+	var next *serveJob
+	for _, j := range s.state.Jobs {
+		if j.State == "queued" && (next == nil || j.Priority > next.Priority) {
+			next = j
+		}
+	}
+	return next
+}
+
+// preempt makes room for j, just queued, when every worker is busy, by
+// pausing the running job of the lowest priority, the latest queued of
+// them, if it is lower than j's: it starts no more chunks, and once the
+// chunks in flight are written it goes back to the queue. A job not
+// fetched in ranges runs to its end. s.mu must be held.
+func (s *server) preempt(j *serveJob) {
+	var victim *serveJob
+	running := 0
+	for _, o := range s.state.Jobs {
+		if o.State != "running" {
+			continue
+		}
+		running++
+		if o.drain != nil && !o.preempted && (victim == nil || o.Priority <= victim.Priority) {
+			victim = o
+		}
+	}
+	if running < s.workers || victim == nil || victim.Priority >= j.Priority {
+		return
+	}
+	victim.preempted = true
+	victim.drain()
+	infof("preempting job %s for job %s of priority %v", victim.ID, j.ID, j.Priority)
+}
+
+// download fetches j to its file in s.dir, through a partial file kept
+// under a name of its own so that a restart finds it, and returns that
+// name for a cancelled job to remove.
+func (s *server) download(ctx context.Context, j *serveJob) (part string, err error) {
+	// A job queued after an object changed must see the change.
+	ctx = withGenerationPins(ctx)
+	// The job may have been queued under wider -schemes.
+	if err := s.allowed(j.URL); err != nil {
+		return "", &downloader.PermanentError{Err: err}
+	}
+	info, err := dl.Stat(ctx, j.URL)
+	if err != nil {
+		return "", err
+	}
+	if dl.Fair == downloader.FairPriority {
+		dl.SetMeta(j.URL, downloader.EntryMeta{Priority: max(j.Priority, 1)})
+	}
+
+	s.mu.Lock()
+	// The partial file is only good for the object it was begun on.
+	same := j.Size == info.Size && j.ETag == info.ETag && j.LastModified == info.LastModified
+	j.Size, j.ETag, j.LastModified = info.Size, info.ETag, info.LastModified
+	if j.Output == "" {
+		j.Output, err = outputName(j.URL, info)
+	}
+	name := j.Output
+	if err == nil {
+		for _, o := range s.state.Jobs {
+			if o != j && o.State == "running" && o.Output == name {
+				err = fmt.Errorf("job %s is already downloading to %s", o.ID, name)
+				break
+			}
+		}
+	}
+	if err == nil {
+		s.saveOrWarn()
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return "", &downloader.PermanentError{Err: err}
+	}
+
+	part = filepath.Join(s.dir, partName(name, j.ID))
+	f, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return part, err
+	}
+	defer f.Close()
+	start := int64(0)
+	if fi, err := f.Stat(); err == nil && same && info.Ranges && info.Size >= 0 {
+		start = min(fi.Size(), info.Size)
+	}
+	if err := f.Truncate(start); err != nil {
+		return part, err
+	}
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return part, err
+	}
+	if start > 0 {
+		infof("resuming %s at byte %v", j.URL, start)
+	}
+
+	counter := tracker.NewCounter(info.Size, start, serveWindow)
+	s.mu.Lock()
+	j.counter = counter
+	s.mu.Unlock()
+	w := io.MultiWriter(f, counter)
+
+	var written int64
+	if info.Ranges && info.Size >= 0 {
+		written, err = dl.DownloadFrom(ctx, j.URL, info.Size, start, w)
+	} else {
+		written, err = dl.DownloadStream(ctx, j.URL, info, 0, w)
+	}
+	if err != nil {
+		return part, err
+	}
+	if info.Size >= 0 && start+written != info.Size {
+		return part, fmt.Errorf("%s: expected %v bytes, wrote %v", j.URL, info.Size, start+written)
+	}
+	if err := f.Close(); err != nil {
+		return part, err
+	}
+	return part, os.Rename(part, filepath.Join(s.dir, name))
+}
+
+// sample updates the rates of the running jobs.
+func (s *server) sample(ctx context.Context) {
+	ticker := time.NewTicker(serveSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			for _, j := range s.state.Jobs {
+				if j.counter != nil {
+					_, j.Rate = j.counter.Sample(now)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /jobs", s.enqueue)
+	mux.HandleFunc("GET /jobs", s.list)
+	mux.HandleFunc("GET /jobs/{id}", s.get)
+	mux.HandleFunc("GET /jobs/{id}/output", s.output)
+	mux.HandleFunc("DELETE /jobs/{id}", s.delete)
+	mux.HandleFunc("POST /schedules", s.addSchedule)
+	mux.HandleFunc("GET /schedules", s.listSchedules)
+	mux.HandleFunc("GET /schedules/{id}", s.getSchedule)
+	mux.HandleFunc("DELETE /schedules/{id}", s.deleteSchedule)
+	mux.HandleFunc("POST /manifests", s.addManifest)
+	mux.HandleFunc("GET /manifests", s.listManifests)
+	mux.HandleFunc("GET /manifests/{id}", s.getManifest)
+	mux.HandleFunc("DELETE /manifests/{id}", s.deleteManifest)
+	mux.HandleFunc("POST /manifests/{id}/claim", s.claim)
+	mux.HandleFunc("POST /manifests/{id}/entries/{index}", s.report)
+	if s.token == "" {
+		return mux
+	}
+	want := []byte("Bearer " + s.token)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), want) != 1 {
+			serveError(w, http.StatusUnauthorized, errors.New("missing or wrong token"))
+			return
+		}
+		mux.ServeHTTP(w, req)
+	})
+}
+
+// allowed checks that rawURL has one of the -schemes.
+func (s *server) allowed(rawURL string) error {
+	u, err := neturl.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	if !slices.Contains(s.schemes, strings.ToLower(u.Scheme)) {
+		return fmt.Errorf("%s: scheme %q is not one of -schemes %s", rawURL, u.Scheme, strings.Join(s.schemes, ","))
+	}
+	return nil
+}
+
+func (s *server) enqueue(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		URL      string `json:"url"`
+		Output   string `json:"output"`
+		Priority int    `json:"priority"`
+	}
+	if err := json.NewDecoder(io.LimitReader(req.Body, 1<<20)).Decode(&body); err != nil {
+		serveError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return
+	}
+	if err := s.checkJob(body.URL, body.Output); err != nil {
+		serveError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if body.Output != "" {
+		for _, j := range s.state.Jobs {
+			if j.Output == body.Output && (j.State == "queued" || j.State == "running") {
+				serveError(w, http.StatusConflict, fmt.Errorf("job %s is already downloading to %s", j.ID, j.Output))
+				return
+			}
+		}
+	}
+	j := &serveJob{URL: body.URL, Output: body.Output, Priority: body.Priority}
+	if err := s.queue(j); err != nil {
+		serveError(w, http.StatusInternalServerError, err)
+		return
+	}
+	serveJSON(w, http.StatusCreated, s.view(j))
+}
+
+// checkJob checks the url and output of a job to queue.
+func (s *server) checkJob(url, output string) error {
+	if url == "" {
+		return errors.New("invalid request: no url")
+	}
+	if err := s.allowed(url); err != nil {
+		return err
+	}
+	if output != "" {
+		name, err := sanitizeName(output)
+		if err != nil || name != output || filepath.Base(name) != name || name == "." || name == ".." {
+			return fmt.Errorf("invalid output %q: want a file name in the download directory", output)
+		}
+	}
+	return nil
+}
+
+// queue gives j an ID and queues it, unless the state cannot be saved.
+// s.mu must be held.
+func (s *server) queue(j *serveJob) error {
+	j.ID = strconv.Itoa(s.state.NextID)
+	j.State, j.Size, j.Created = "queued", -1, time.Now().UTC()
+	s.state.NextID++
+	s.state.Jobs = append(s.state.Jobs, j)
+	if err := s.save(); err != nil {
+		s.state.NextID--
+		s.state.Jobs = s.state.Jobs[:len(s.state.Jobs)-1]
+		return err
+	}
+	s.cond.Signal()
+	s.preempt(j)
+	infof("queued %s as job %s", j.URL, j.ID)
+	return nil
+}
+
+func (s *server) list(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := make([]serveJob, 0, len(s.state.Jobs))
+	for _, j := range s.state.Jobs {
+		jobs = append(jobs, s.view(j))
+	}
+	serveJSON(w, http.StatusOK, map[string]any{"jobs": jobs})
+}
+
+func (s *server) get(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j := s.job(req.PathValue("id"))
+	if j == nil {
+		serveError(w, http.StatusNotFound, fmt.Errorf("no job %s", req.PathValue("id")))
+		return
+	}
+	serveJSON(w, http.StatusOK, s.view(j))
+}
+
+// output serves the file of a done job, in ranges, for another gocat to
+// fetch. Asked with downloader.ChecksumHeader, as gocat asks, it follows
+// each response with the SHA-256 of the bytes it sent, so they are checked
+// from end to end without a checksum file.
+func (s *server) output(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	j := s.job(req.PathValue("id"))
+	var state, name string
+	if j != nil {
+		state, name = j.State, j.Output
+	}
+	s.mu.Unlock()
+	switch {
+	case j == nil:
+		serveError(w, http.StatusNotFound, fmt.Errorf("no job %s", req.PathValue("id")))
+		return
+	case state != "done":
+		serveError(w, http.StatusConflict, fmt.Errorf("job %s is %s", j.ID, state))
+		return
+	}
+	f, err := os.Open(filepath.Join(s.dir, name))
+	if err != nil {
+		serveError(w, http.StatusNotFound, fmt.Errorf("job %s: %w", j.ID, err))
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		serveError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if req.Method != "GET" || !strings.EqualFold(req.Header.Get(downloader.ChecksumHeader), "sha256") {
+		http.ServeContent(w, req, name, fi.ModTime(), f)
+		return
+	}
+	w.Header().Set("Trailer", downloader.ChecksumTrailer)
+	cw := &checksumWriter{ResponseWriter: w, hash: sha256.New()}
+	http.ServeContent(cw, req, name, fi.ModTime(), f)
+	if cw.status/100 == 2 {
+		w.Header().Set(downloader.ChecksumTrailer, hex.EncodeToString(cw.hash.Sum(nil)))
+	}
+}
+
+// checksumWriter hashes the body it sends, chunked, so that a trailer with
+// the hash can follow it.
+type checksumWriter struct {
+	http.ResponseWriter
+	hash   hash.Hash
+	status int
+}
+
+func (w *checksumWriter) WriteHeader(status int) {
+	w.status = status
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *checksumWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.hash.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+// delete cancels a queued or running job, and forgets one that has ended.
+func (s *server) delete(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j := s.job(req.PathValue("id"))
+	if j == nil {
+		serveError(w, http.StatusNotFound, fmt.Errorf("no job %s", req.PathValue("id")))
+		return
+	}
+	switch j.State {
+	case "queued":
+		now := time.Now().UTC()
+		j.State, j.Finished = "cancelled", &now
+		// An earlier daemon may have begun it.
+		if j.Output != "" {
+			os.Remove(filepath.Join(s.dir, partName(j.Output, j.ID)))
+		}
+		s.ended(j)
+		s.saveOrWarn()
+	case "running":
+		// The worker records the end once the transfer has stopped,
+		// even if it was being preempted.
+		j.preempted = false
+		j.cancel(errJobCancelled)
+	default:
+		s.state.Jobs = slices.DeleteFunc(s.state.Jobs, func(o *serveJob) bool { return o == j })
+		s.saveOrWarn()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	serveJSON(w, http.StatusAccepted, s.view(j))
+}
+
+func serveJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func serveError(w http.ResponseWriter, status int, err error) {
+	serveJSON(w, status, map[string]string{"error": err.Error()})
+}
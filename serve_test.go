@@ -0,0 +1,691 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+// testDaemon is a daemon with two workers, downloading to the directory it
+// returns, behind an httptest server taking its API.
+func testDaemon(t *testing.T, token string) (*server, *httptest.Server, string) {
+	t.Helper()
+	testRun(t, func() {})
+	dir := t.TempDir()
+	s, err := openServer(dir, filepath.Join(t.TempDir(), "serve.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.token, s.schemes, s.workers = token, []string{"http", "https"}, 2
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{}, 2)
+	for range 2 {
+		go func() {
+			s.work(ctx)
+			done <- struct{}{}
+		}()
+	}
+	api := httptest.NewServer(s.handler())
+	t.Cleanup(func() {
+		api.Close()
+		cancel()
+		s.mu.Lock()
+		s.cond.Broadcast()
+		s.mu.Unlock()
+		<-done
+		<-done
+	})
+	return s, api, dir
+}
+
+// call sends a request to the API and decodes its JSON answer into v.
+func call(t *testing.T, api *httptest.Server, token, method, path, body string, v any) int {
+	t.Helper()
+	req, err := http.NewRequest(method, api.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		json.NewDecoder(resp.Body).Decode(v)
+	}
+	return resp.StatusCode
+}
+
+// waitJob polls job id until it has ended.
+func waitJob(t *testing.T, api *httptest.Server, token, id string) serveJob {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		var j serveJob
+		call(t, api, token, "GET", "/jobs/"+id, "", &j)
+		switch j.State {
+		case "done", "failed", "cancelled":
+			return j
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not end", id)
+	return serveJob{}
+}
+
+func TestServeListen(t *testing.T) {
+	if _, err := serveListen("tcp://127.0.0.1:0", false); err == nil {
+		t.Error("a TCP listener without -token was accepted")
+	}
+	ln, err := serveListen("tcp://127.0.0.1:0", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+
+	path := filepath.Join(t.TempDir(), "gocat.sock")
+	ln, err = serveListen("unix://"+path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode().Perm(); mode&0077 != 0 {
+		t.Errorf("socket mode %v, want it the owner's alone", mode)
+	}
+	if _, err := serveListen("unix://"+path, false); err == nil {
+		t.Error("a second daemon on the same socket was accepted")
+	}
+}
+
+func TestServeJobs(t *testing.T) {
+	_, api, dir := testDaemon(t, "sekret")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.ServeContent(w, req, "", time.Time{}, strings.NewReader("served\n"))
+	}))
+	t.Cleanup(origin.Close)
+
+	if code := call(t, api, "", "GET", "/jobs", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("no token: status %v, want 401", code)
+	}
+	if code := call(t, api, "wrong", "GET", "/jobs", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("wrong token: status %v, want 401", code)
+	}
+	if code := call(t, api, "sekret", "POST", "/jobs", `{"url": "file:///etc/passwd"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("file:// job: status %v, want 400", code)
+	}
+	if code := call(t, api, "sekret", "POST", "/jobs", `{"url": "`+origin.URL+`/x", "output": "../x"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("output outside the directory: status %v, want 400", code)
+	}
+
+	var j serveJob
+	if code := call(t, api, "sekret", "POST", "/jobs", `{"url": "`+origin.URL+`/a.txt"}`, &j); code != http.StatusCreated {
+		t.Fatalf("queueing: status %v", code)
+	}
+	if j = waitJob(t, api, "sekret", j.ID); j.State != "done" {
+		t.Fatalf("job %+v, want done", j)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "a.txt")); err != nil || string(b) != "served\n" {
+		t.Errorf("read %q, %v; want what the origin served", b, err)
+	}
+}
+
+func TestServeOutputCollision(t *testing.T) {
+	_, api, dir := testDaemon(t, "")
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("slow") != "" && req.Method == "GET" && req.Header.Get("Range") != "bytes=0-0" {
+			<-release
+		}
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader([]byte(req.URL.RawQuery)))
+	}))
+	t.Cleanup(origin.Close)
+	t.Cleanup(func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	})
+
+	var first, second serveJob
+	call(t, api, "", "POST", "/jobs", `{"url": "`+origin.URL+`/same.bin?slow=1"}`, &first)
+	deadline := time.Now().Add(5 * time.Second)
+	for first.State != "running" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		call(t, api, "", "GET", "/jobs/"+first.ID, "", &first)
+	}
+	// Both derive same.bin from their URL.
+	call(t, api, "", "POST", "/jobs", `{"url": "`+origin.URL+`/same.bin?fast=1"}`, &second)
+	if second = waitJob(t, api, "", second.ID); second.State != "failed" || !strings.Contains(second.Error, "already downloading") {
+		t.Errorf("second job %+v, want it failed on the collision", second)
+	}
+	close(release)
+	if first = waitJob(t, api, "", first.ID); first.State != "done" {
+		t.Errorf("first job %+v, want done", first)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "same.bin")); string(b) != "slow=1" {
+		t.Errorf("same.bin is %q, want the first job's", b)
+	}
+}
+
+func TestServePriority(t *testing.T) {
+	_, api, dir := testDaemon(t, "")
+	// The later low job is fetched 4 bytes at a time, a chunk each time
+	// the test lets one through.
+	dl.ChunkSize, dl.Workers = 4, 1
+	const body = "0123456789abcdefghijklmnopqrstuvwxyzABCD"
+	release, next := make(chan struct{}), make(chan struct{})
+	var mu sync.Mutex
+	var ranges []string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if gate := map[string]chan struct{}{"/low0": release, "/low1": next}[req.URL.Path]; gate != nil && req.Method == "GET" {
+			if req.URL.Path == "/low1" {
+				mu.Lock()
+				ranges = append(ranges, req.Header.Get("Range"))
+				mu.Unlock()
+			}
+			select {
+			case <-gate:
+			case <-req.Context().Done():
+				return
+			}
+		}
+		content := req.URL.Path
+		if req.URL.Path == "/low1" {
+			content = body
+		}
+		http.ServeContent(w, req, "", time.Time{}, strings.NewReader(content))
+	}))
+	t.Cleanup(origin.Close)
+	var closeOnce sync.Once
+	unblock := func() {
+		closeOnce.Do(func() {
+			close(release)
+			close(next)
+		})
+	}
+	t.Cleanup(unblock)
+
+	// Two low jobs keep both workers busy, the later one two chunks in.
+	var low [2]serveJob
+	for i := range low {
+		call(t, api, "", "POST", "/jobs", `{"url": "`+origin.URL+`/low`+strconv.Itoa(i)+`"}`, &low[i])
+	}
+	next <- struct{}{}
+	next <- struct{}{}
+	deadline := time.Now().Add(5 * time.Second)
+	for (low[0].State != "running" || low[1].Written != 8) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		for i := range low {
+			call(t, api, "", "GET", "/jobs/"+low[i].ID, "", &low[i])
+		}
+	}
+
+	// The urgent one takes the place of the later low one once its chunk
+	// in flight is written.
+	var urgent serveJob
+	call(t, api, "", "POST", "/jobs", `{"url": "`+origin.URL+`/urgent", "priority": 5}`, &urgent)
+	next <- struct{}{}
+	if urgent = waitJob(t, api, "", urgent.ID); urgent.State != "done" || urgent.Priority != 5 {
+		t.Fatalf("urgent job %+v, want done while the low ones wait", urgent)
+	}
+	call(t, api, "", "GET", "/jobs/"+low[0].ID, "", &low[0])
+	if low[0].State != "running" {
+		t.Errorf("first low job %+v, want it still running", low[0])
+	}
+	call(t, api, "", "GET", "/jobs/"+low[1].ID, "", &low[1])
+	if low[1].Written != 12 {
+		t.Errorf("second low job %+v, want it paused 12 bytes in", low[1])
+	}
+
+	unblock()
+	for i, want := range []string{"/low0", body} {
+		if low[i] = waitJob(t, api, "", low[i].ID); low[i].State != "done" {
+			t.Errorf("low job %+v, want done after the urgent one", low[i])
+		}
+		if b, _ := os.ReadFile(filepath.Join(dir, "low"+strconv.Itoa(i))); string(b) != want {
+			t.Errorf("low%v is %q, want %q", i, b, want)
+		}
+	}
+	// The preempted job resumed where it stopped: no chunk was fetched
+	// twice.
+	mu.Lock()
+	defer mu.Unlock()
+	var want []string
+	for off := 0; off < len(body); off += 4 {
+		want = append(want, fmt.Sprintf("bytes=%v-%v", off, off+3))
+	}
+	if !slices.Equal(ranges, want) {
+		t.Errorf("ranges fetched %q, want %q", ranges, want)
+	}
+}
+
+func TestServeNext(t *testing.T) {
+	s := &server{state: serveState{Jobs: []*serveJob{
+		{ID: "1", State: "done", Priority: 9},
+		{ID: "2", State: "queued"},
+		{ID: "3", State: "queued", Priority: 2},
+		{ID: "4", State: "queued", Priority: 2},
+	}}}
+	if j := s.next(); j == nil || j.ID != "3" {
+		t.Errorf("next is %+v, want job 3, the first of the highest priority", j)
+	}
+}
+
+func TestServeSchedule(t *testing.T) {
+	s, api, dir := testDaemon(t, "")
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "GET" && req.Header.Get("Range") != "bytes=0-0" {
+			select {
+			case <-release:
+			case <-req.Context().Done():
+				return
+			}
+		}
+		http.ServeContent(w, req, "", time.Time{}, strings.NewReader("nightly\n"))
+	}))
+	t.Cleanup(origin.Close)
+	t.Cleanup(func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	})
+
+	if code := call(t, api, "", "POST", "/schedules", `{"url": "`+origin.URL+`/n", "cron": "0 2 31 2 *"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("a schedule that never comes around: status %v, want 400", code)
+	}
+	var sc serveSchedule
+	if code := call(t, api, "", "POST", "/schedules", `{"url": "`+origin.URL+`/n", "output": "n.txt", "cron": "0 2 * * *", "jitter": "10m"}`, &sc); code != http.StatusCreated {
+		t.Fatalf("scheduling: status %v", code)
+	}
+	if next := sc.Next.Local(); next.Hour() != 2 || next.Minute() >= 10 || !next.After(time.Now()) {
+		t.Errorf("next run at %v, want within 10 minutes after the next 02:00", next)
+	}
+
+	// Due: a job is queued. Due again while it is still running: the run
+	// is skipped.
+	due := func() serveSchedule {
+		s.mu.Lock()
+		s.runDue(s.schedule(sc.ID).Next)
+		s.mu.Unlock()
+		var got serveSchedule
+		call(t, api, "", "GET", "/schedules/"+sc.ID, "", &got)
+		return got
+	}
+	first := due()
+	if len(first.History) != 1 || first.History[0].Job == "" || first.Job != first.History[0].Job {
+		t.Fatalf("after the first run: %+v", first)
+	}
+	var j serveJob
+	deadline := time.Now().Add(5 * time.Second)
+	for j.State != "running" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		call(t, api, "", "GET", "/jobs/"+first.Job, "", &j)
+	}
+	if j.Schedule != sc.ID {
+		t.Errorf("job %+v, want it from schedule %s", j, sc.ID)
+	}
+	second := due()
+	if len(second.History) != 2 || second.History[1].State != "skipped" || second.Job != first.Job {
+		t.Errorf("after a run while the last was running: %+v", second)
+	}
+
+	close(release)
+	if j = waitJob(t, api, "", first.Job); j.State != "done" {
+		t.Fatalf("job %+v, want done", j)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "n.txt")); string(b) != "nightly\n" {
+		t.Errorf("n.txt is %q", b)
+	}
+	var got serveSchedule
+	call(t, api, "", "GET", "/schedules/"+sc.ID, "", &got)
+	if got.History[0].State != "done" {
+		t.Errorf("history %+v, want the first run done", got.History)
+	}
+
+	// The schedules survive a restart.
+	s.mu.Lock()
+	restarted, err := openServer(dir, s.path)
+	s.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := restarted.schedule(sc.ID); r == nil || r.cron == nil || len(r.History) != 2 || restarted.state.NextSchedule != 2 {
+		t.Errorf("after a restart: %+v", restarted.state)
+	}
+
+	if code := call(t, api, "", "DELETE", "/schedules/"+sc.ID, "", nil); code != http.StatusNoContent {
+		t.Errorf("deleting: status %v, want 204", code)
+	}
+	if code := call(t, api, "", "GET", "/schedules/"+sc.ID, "", nil); code != http.StatusNotFound {
+		t.Errorf("after deleting: status %v, want 404", code)
+	}
+}
+
+func TestServeManifest(t *testing.T) {
+	s, api, _ := testDaemon(t, "sekret")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/list" {
+			w.Write([]byte("a.bin out=x.bin\nb.bin\nc.bin\nd.bin\n"))
+			return
+		}
+		http.ServeContent(w, req, "", time.Time{}, strings.NewReader(req.URL.Path))
+	}))
+	t.Cleanup(origin.Close)
+
+	var m serveManifest
+	if code := call(t, api, "sekret", "POST", "/manifests", `{"list": "`+origin.URL+`/list"}`, &m); code != http.StatusCreated {
+		t.Fatalf("adding the manifest: status %v", code)
+	}
+	if len(m.Entries) != 4 || m.Entries[0].Meta == nil || m.Entries[0].Meta.Output != "x.bin" {
+		t.Fatalf("manifest %+v", m)
+	}
+	coordinator := func(worker string) *coordinator {
+		return &coordinator{base: api.URL, token: "sekret", manifest: m.ID, worker: worker, client: http.DefaultClient}
+	}
+
+	// A worker that claims an entry and dies loses it once its lease runs
+	// out.
+	ghost := coordinator("ghost")
+	claim, err := ghost.claim(context.Background())
+	if err != nil || claim.Index != 0 {
+		t.Fatalf("claimed %+v: %v", claim, err)
+	}
+	s.mu.Lock()
+	expired := time.Now().Add(-time.Second)
+	s.manifest(m.ID).Entries[0].Until = &expired
+	s.mu.Unlock()
+
+	// Two workers share the rest, and the ghost's entry, between them.
+	workPoll = 10 * time.Millisecond
+	t.Cleanup(func() { workPoll = 5 * time.Second })
+	dirs := []string{t.TempDir(), t.TempDir()}
+	errs := make(chan error, 2)
+	for i, dir := range dirs {
+		go func() {
+			_, _, err := work(context.Background(), coordinator("w"+strconv.Itoa(i)), dir)
+			errs <- err
+		}()
+	}
+	for range dirs {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := map[string]string{}
+	for _, dir := range dirs {
+		names, _ := os.ReadDir(dir)
+		for _, n := range names {
+			if _, twice := got[n.Name()]; twice {
+				t.Errorf("%s was written by both workers", n.Name())
+			}
+			b, _ := os.ReadFile(filepath.Join(dir, n.Name()))
+			got[n.Name()] = string(b)
+		}
+	}
+	want := map[string]string{"x.bin": "/a.bin", "b.bin": "/b.bin", "c.bin": "/c.bin", "d.bin": "/d.bin"}
+	if len(got) != len(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for name, content := range want {
+		if got[name] != content {
+			t.Errorf("%s is %q, want %q", name, got[name], content)
+		}
+	}
+
+	if err := ghost.report(context.Background(), 0, "done", ""); !errors.Is(err, errLeaseLost) {
+		t.Errorf("the ghost's report: got %v, want %v", err, errLeaseLost)
+	}
+	call(t, api, "sekret", "GET", "/manifests/"+m.ID, "", &m)
+	for i, e := range m.Entries {
+		if e.State != "done" || e.Worker == "ghost" {
+			t.Errorf("entry %v: %+v", i, e)
+		}
+	}
+	if m.Entries[0].Claims != 2 {
+		t.Errorf("entry 0 claimed %v times, want 2", m.Entries[0].Claims)
+	}
+}
+
+func TestServeManifestChecks(t *testing.T) {
+	_, api, _ := testDaemon(t, "")
+	bad := strings.Repeat("0", 64)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/list" {
+			w.Write([]byte("a/data.bin\nb/data.bin\nc.bin size=3\nd.bin sha256=" + bad + "\n"))
+			return
+		}
+		http.ServeContent(w, req, "", time.Time{}, strings.NewReader(req.URL.Path))
+	}))
+	t.Cleanup(origin.Close)
+
+	// The daemon's own shard takes nothing from the workers.
+	ShardIndex, ShardCount = 1, 2
+	t.Cleanup(func() { ShardIndex, ShardCount = -1, 1 })
+
+	var m serveManifest
+	list := `{"list": "` + origin.URL + `/list"`
+	if code := call(t, api, "", "POST", "/manifests", list+`}`, nil); code != http.StatusBadRequest {
+		t.Errorf("two entries named data.bin: status %v, want %v", code, http.StatusBadRequest)
+	}
+	if code := call(t, api, "", "POST", "/manifests", list+`, "on_collision": "suffix"}`, &m); code != http.StatusCreated {
+		t.Fatalf("adding the manifest: status %v", code)
+	}
+	var names []string
+	for _, e := range m.Entries {
+		names = append(names, e.Name)
+	}
+	if want := []string{"data.bin", "data-1.bin", "c.bin", "d.bin"}; !slices.Equal(names, want) {
+		t.Fatalf("names %q, want %q", names, want)
+	}
+
+	// Two workers sharing a directory.
+	workPoll = 10 * time.Millisecond
+	t.Cleanup(func() { workPoll = 5 * time.Second })
+	dir := t.TempDir()
+	type result struct {
+		done, failed int
+		err          error
+	}
+	results := make(chan result, 2)
+	for i := range 2 {
+		go func() {
+			c := &coordinator{base: api.URL, manifest: m.ID, worker: "w" + strconv.Itoa(i), client: http.DefaultClient}
+			done, failed, err := work(context.Background(), c, dir)
+			results <- result{done, failed, err}
+		}()
+	}
+	var done, failed int
+	for range 2 {
+		r := <-results
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		done, failed = done+r.done, failed+r.failed
+	}
+	if done != 2 || failed != 2 {
+		t.Errorf("%v done and %v failed, want 2 and 2", done, failed)
+	}
+	for name, want := range map[string]string{"data.bin": "/a/data.bin", "data-1.bin": "/b/data.bin"} {
+		if b, _ := os.ReadFile(filepath.Join(dir, name)); string(b) != want {
+			t.Errorf("%s is %q, want %q", name, b, want)
+		}
+	}
+	for _, name := range []string{"c.bin", "d.bin"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			t.Errorf("%s was written despite its list line", name)
+		}
+	}
+	call(t, api, "", "GET", "/manifests/"+m.ID, "", &m)
+	for i, state := range []string{"done", "done", "failed", "failed"} {
+		if m.Entries[i].State != state {
+			t.Errorf("entry %v: %+v, want %s", i, m.Entries[i], state)
+		}
+	}
+}
+
+func TestServeSchedulePrune(t *testing.T) {
+	s, api, _ := testDaemon(t, "")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.ServeContent(w, req, "", time.Time{}, strings.NewReader("minutely\n"))
+	}))
+	t.Cleanup(origin.Close)
+
+	var own serveJob
+	call(t, api, "", "POST", "/jobs", `{"url": "`+origin.URL+`/own", "output": "own.txt"}`, &own)
+	waitJob(t, api, "", own.ID)
+	var sc serveSchedule
+	if code := call(t, api, "", "POST", "/schedules", `{"url": "`+origin.URL+`/m", "output": "m.txt", "cron": "* * * * *"}`, &sc); code != http.StatusCreated {
+		t.Fatalf("scheduling: status %v", code)
+	}
+	for range scheduleHistory + 5 {
+		s.mu.Lock()
+		s.runDue(s.schedule(sc.ID).Next)
+		id := s.schedule(sc.ID).Job
+		s.mu.Unlock()
+		if j := waitJob(t, api, "", id); j.State != "done" {
+			t.Fatalf("job %+v, want done", j)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inHistory := map[string]bool{}
+	for _, run := range s.schedule(sc.ID).History {
+		inHistory[run.Job] = true
+	}
+	scheduled := 0
+	for _, j := range s.state.Jobs {
+		if j.Schedule == sc.ID {
+			scheduled++
+			if !inHistory[j.ID] {
+				t.Errorf("job %s is kept but out of the history", j.ID)
+			}
+		}
+	}
+	if scheduled != scheduleHistory {
+		t.Errorf("%v jobs of the schedule kept, want %v", scheduled, scheduleHistory)
+	}
+	if s.job(own.ID) == nil {
+		t.Errorf("job %s, queued by hand, was dropped", own.ID)
+	}
+}
+
+// corruptWriter flips the first byte of the body it is given.
+type corruptWriter struct {
+	http.ResponseWriter
+	done bool
+}
+
+func (w *corruptWriter) Write(p []byte) (int, error) {
+	if !w.done && len(p) > 0 {
+		w.done = true
+		p = bytes.Clone(p)
+		p[0] ^= 0xff
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func TestServeOutput(t *testing.T) {
+	data := make([]byte, 3<<20)
+	for i := range data {
+		data[i] = byte(i * 13)
+	}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(origin.Close)
+	s, api, _ := testDaemon(t, "sekret")
+
+	var j serveJob
+	if code := call(t, api, "sekret", "POST", "/jobs", `{"url": "`+origin.URL+`/obj", "output": "obj"}`, &j); code != http.StatusCreated {
+		t.Fatalf("queueing: %v", code)
+	}
+	if got := waitJob(t, api, "sekret", j.ID); got.State != "done" {
+		t.Fatalf("job %+v", got)
+	}
+
+	// Asked for it, the daemon follows a range with its checksum.
+	req, _ := http.NewRequest("GET", api.URL+"/jobs/"+j.ID+"/output", nil)
+	req.Header.Set("Authorization", "Bearer sekret")
+	req.Header.Set("Range", "bytes=10-19")
+	req.Header.Set(downloader.ChecksumHeader, "sha256")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	sum := sha256.Sum256(data[10:20])
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, data[10:20]) ||
+		resp.Trailer.Get(downloader.ChecksumTrailer) != hex.EncodeToString(sum[:]) {
+		t.Errorf("got %v, %q, trailer %q", resp.Status, body, resp.Trailer)
+	}
+
+	// Another gocat fetching it finds the range damaged on the way, and
+	// fetches that range again.
+	var mu sync.Mutex
+	ranges := map[string]int{}
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		rng := req.Header.Get("Range")
+		ranges[rng]++
+		first := ranges[rng] == 1
+		mu.Unlock()
+		if first && rng == "bytes=1048576-2097151" {
+			w = &corruptWriter{ResponseWriter: w}
+		}
+		s.handler().ServeHTTP(w, req)
+	}))
+	t.Cleanup(proxy.Close)
+	r, out, _ := testRun(t, func() {
+		Bearer = "sekret"
+		BatchSizeInMB = 1
+		SkipFailed = true
+		RetryInitial = time.Millisecond
+	})
+	runEntries(t, r, proxy.URL+"/jobs/"+j.ID+"/output")
+	if !bytes.Equal(out.Bytes(), data) || len(r.failures) > 0 {
+		t.Errorf("wrote %v bytes, failures %q", out.Len(), r.failures)
+	}
+	mu.Lock()
+	if n := ranges["bytes=1048576-2097151"]; n != 2 {
+		t.Errorf("damaged range fetched %v times, want 2", n)
+	}
+	mu.Unlock()
+
+	// A job still running has no file to serve.
+	s.mu.Lock()
+	s.job(j.ID).State = "running"
+	s.mu.Unlock()
+	if code := call(t, api, "sekret", "GET", "/jobs/"+j.ID+"/output", "", nil); code != http.StatusConflict {
+		t.Errorf("output of a running job: %v", code)
+	}
+}
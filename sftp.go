@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	SSHCommand   string
+	SFTPKey      string
+	SFTPPassword string
+)
+
+// The packet types, status codes and flags of SFTP version 3 that gocat
+// uses.
+const (
+	sftpInit    = 1
+	sftpVersion = 2
+	sftpOpen    = 3
+	sftpClose   = 4
+	sftpRead    = 5
+	sftpStat    = 17
+	sftpStatus  = 101
+	sftpHandle  = 102
+	sftpData    = 103
+	sftpAttrs   = 105
+
+	sftpOK         = 0
+	sftpEOF        = 1
+	sftpNoSuchFile = 2
+	sftpPermDenied = 3
+
+	sftpAttrSize   = 0x1
+	sftpAttrUIDGID = 0x2
+	sftpAttrPerms  = 0x4
+	sftpAttrTimes  = 0x8
+	sftpOpenRead   = 0x1
+)
+
+const (
+	sftpMaxPacket = 256 << 10
+	// sftpReadSize is what servers answer a read with at most, sftpInflight
+	// reads at a time.
+	sftpReadSize    = 32 << 10
+	sftpInflight    = 16
+	sftpIdleTimeout = 30 * time.Second
+	// askpassEnv marks gocat run as the SSH_ASKPASS of its own ssh, and
+	// askpassPasswdEnv hands it the password.
+	askpassEnv       = "GOCAT_ASKPASS"
+	askpassPasswdEnv = "GOCAT_ASKPASS_PASSWORD"
+)
+
+// askpassPassword returns the password to answer with when args are those
+// of gocat run as the SSH_ASKPASS of its own ssh: the marker set on that
+// ssh alone, and a single prompt for a password or passphrase. Anything
+// else, such as a host key to confirm, gets no answer, and a gocat run
+// with the password merely in its environment goes on as usual.
+func askpassPassword(args []string) (string, bool) {
+	if os.Getenv(askpassEnv) != "1" || len(args) != 2 || !strings.HasSuffix(args[1], ": ") {
+		return "", false
+	}
+	return os.LookupEnv(askpassPasswdEnv)
+}
+
+// runAskpass answers for ssh when gocat runs as its SSH_ASKPASS, which only
+// has to print the password.
+func runAskpass() bool {
+	password, ok := askpassPassword(os.Args)
+	if ok {
+		fmt.Println(password)
+	}
+	return ok
+}
+
+// sftpSource reads sftp:// URLs over the sftp subsystem of the system's
+// ssh, which brings its configuration, agent, known hosts and keys along.
+// Sessions are reused, and reads are pipelined sftpInflight deep.
+type sftpSource struct {
+	command  string
+	key      string
+	password string
+
+	mu   sync.Mutex
+	idle map[string][]*sftpSession
+}
+
+func newSFTPSource(command, key, password string) *sftpSource {
+	return &sftpSource{command: command, key: key, password: password, idle: map[string][]*sftpSession{}}
+}
+
+// sftpPath is the path of u: absolute, or relative to the home directory
+// when it starts with /~/.
+func sftpPath(u *url.URL) string {
+	if rest, ok := strings.CutPrefix(u.Path, "/~/"); ok {
+		return rest
+	}
+	return u.Path
+}
+
+type sftpSession struct {
+	key    string
+	cmd    *exec.Cmd
+	w      io.WriteCloser
+	r      *bufio.Reader
+	stderr bytes.Buffer
+	next   uint32
+	used   time.Time
+	broken atomic.Bool
+	once   sync.Once
+}
+
+func (s *sftpSource) session(u *url.URL) (*sftpSession, error) {
+	if Offline {
+		return nil, offlineError(u.Host)
+	}
+	user, password := fileCredentials(u, "", s.password)
+	key := user + "@" + u.Host
+	s.mu.Lock()
+	for len(s.idle[key]) > 0 {
+		idle := s.idle[key]
+		ss := idle[len(idle)-1]
+		s.idle[key] = idle[:len(idle)-1]
+		if time.Since(ss.used) < sftpIdleTimeout {
+			s.mu.Unlock()
+			return ss, nil
+		}
+		ss.kill()
+	}
+	s.mu.Unlock()
+
+	args := []string{"-s", "-x"}
+	if password == "" {
+		args = append(args, "-o", "BatchMode=yes")
+	} else {
+		args = append(args, "-o", "NumberOfPasswordPrompts=1")
+	}
+	if u.Port() != "" {
+		args = append(args, "-p", u.Port())
+	}
+	if user != "" {
+		args = append(args, "-l", user)
+	}
+	if s.key != "" {
+		args = append(args, "-i", s.key)
+	}
+	args = append(args, "--", u.Hostname(), "sftp")
+
+	ss := &sftpSession{key: key, cmd: exec.Command(s.command, args...)}
+	ss.cmd.Stderr = &ss.stderr
+	if password != "" {
+		exe, err := os.Executable()
+		if err != nil {
+			return nil, err
+		}
+		ss.cmd.Env = append(os.Environ(),
+			"SSH_ASKPASS="+exe,
+			"SSH_ASKPASS_REQUIRE=force",
+			askpassEnv+"=1",
+			askpassPasswdEnv+"="+password,
+		)
+	}
+	w, err := ss.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	r, err := ss.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	ss.w, ss.r = w, bufio.NewReaderSize(r, sftpMaxPacket)
+	if err := ss.cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	_, err = ss.request(sftpInit, uint32(3))
+	var typ byte
+	if err == nil {
+		typ, _, _, err = ss.recv()
+	}
+	if err == nil && typ != sftpVersion {
+		err = fmt.Errorf("sftp: unexpected packet %d instead of a version", typ)
+	}
+	if err != nil {
+		ss.w.Close()
+		ss.cmd.Process.Kill()
+		ss.cmd.Wait()
+		if msg := strings.TrimSpace(ss.stderr.String()); msg != "" {
+			err = errors.New(msg)
+		}
+		return nil, fmt.Errorf("sftp to %s: %w", u.Host, err)
+	}
+	return ss, nil
+}
+
+func (s *sftpSource) release(ss *sftpSession) {
+	if ss.broken.Load() {
+		ss.kill()
+		return
+	}
+	ss.used = time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.idle[ss.key] = append(s.idle[ss.key], ss)
+}
+
+func (ss *sftpSession) kill() {
+	ss.broken.Store(true)
+	ss.once.Do(func() {
+		ss.w.Close()
+		ss.cmd.Process.Kill()
+		go ss.cmd.Wait()
+	})
+}
+
+// watch kills the session once ctx is done, until the returned function
+// is called.
+func (ss *sftpSession) watch(ctx context.Context) func() bool {
+	return context.AfterFunc(ctx, ss.kill)
+}
+
+// request writes a packet of typ. Every type but INIT has a request id
+// first, which is returned; fields are uint32, uint64 or string.
+func (ss *sftpSession) request(typ byte, fields ...any) (uint32, error) {
+	b := []byte{0, 0, 0, 0, typ}
+	var id uint32
+	if typ != sftpInit {
+		ss.next++
+		id = ss.next
+		b = binary.BigEndian.AppendUint32(b, id)
+	}
+	for _, f := range fields {
+		switch v := f.(type) {
+		case uint32:
+			b = binary.BigEndian.AppendUint32(b, v)
+		case uint64:
+			b = binary.BigEndian.AppendUint64(b, v)
+		case string:
+			b = binary.BigEndian.AppendUint32(b, uint32(len(v)))
+			b = append(b, v...)
+		}
+	}
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	if _, err := ss.w.Write(b); err != nil {
+		ss.broken.Store(true)
+		return 0, err
+	}
+	return id, nil
+}
+
+// recv reads a packet and returns its type, its request id and the rest.
+func (ss *sftpSession) recv() (byte, uint32, sftpBuf, error) {
+	var head [5]byte
+	if _, err := io.ReadFull(ss.r, head[:]); err != nil {
+		ss.broken.Store(true)
+		return 0, 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(head[:4])
+	if n < 1 || n > sftpMaxPacket {
+		ss.broken.Store(true)
+		return 0, 0, nil, fmt.Errorf("sftp: bad packet length %d", n)
+	}
+	body := make(sftpBuf, n-1)
+	if _, err := io.ReadFull(ss.r, body); err != nil {
+		ss.broken.Store(true)
+		return 0, 0, nil, err
+	}
+	typ := head[4]
+	if typ == sftpVersion {
+		return typ, 0, body, nil
+	}
+	id, err := body.uint32()
+	if err != nil {
+		ss.broken.Store(true)
+	}
+	return typ, id, body, err
+}
+
+// reply waits for the answer to request id, which must be the next.
+func (ss *sftpSession) reply(id uint32) (byte, sftpBuf, error) {
+	typ, got, body, err := ss.recv()
+	if err == nil && got != id {
+		ss.broken.Store(true)
+		err = fmt.Errorf("sftp: answer to request %d instead of %d", got, id)
+	}
+	if err == nil && typ == sftpStatus {
+		err = body.status()
+	}
+	return typ, body, err
+}
+
+// sftpBuf is the rest of a packet being decoded.
+type sftpBuf []byte
+
+var errSFTPShort = errors.New("sftp: short packet")
+
+func (b *sftpBuf) uint32() (uint32, error) {
+	if len(*b) < 4 {
+		return 0, errSFTPShort
+	}
+	v := binary.BigEndian.Uint32(*b)
+	*b = (*b)[4:]
+	return v, nil
+}
+
+func (b *sftpBuf) uint64() (uint64, error) {
+	if len(*b) < 8 {
+		return 0, errSFTPShort
+	}
+	v := binary.BigEndian.Uint64(*b)
+	*b = (*b)[8:]
+	return v, nil
+}
+
+func (b *sftpBuf) string() ([]byte, error) {
+	n, err := b.uint32()
+	if err != nil || uint32(len(*b)) < n {
+		return nil, errSFTPShort
+	}
+	v := (*b)[:n]
+	*b = (*b)[n:]
+	return v, nil
+}
+
+// status turns a STATUS packet into an error, nil for OK and io.EOF for
+// the end of a file.
+func (b sftpBuf) status() error {
+	code, err := b.uint32()
+	if err != nil {
+		return err
+	}
+	msg, _ := b.string()
+	switch code {
+	case sftpOK:
+		return nil
+	case sftpEOF:
+		return io.EOF
+	case sftpNoSuchFile:
+		return fs.ErrNotExist
+	case sftpPermDenied:
+		return fs.ErrPermission
+	}
+	return fmt.Errorf("sftp: error %d: %s", code, msg)
+}
+
+func (s *sftpSource) stat(ctx context.Context, u *url.URL) (int64, time.Time, error) {
+	ss, err := s.session(u)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	defer s.release(ss)
+	defer ss.watch(ctx)()
+
+	id, err := ss.request(sftpStat, sftpPath(u))
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	typ, body, err := ss.reply(id)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	if typ != sftpAttrs {
+		ss.broken.Store(true)
+		return 0, time.Time{}, fmt.Errorf("sftp: unexpected packet %d instead of attributes", typ)
+	}
+
+	flags, err := body.uint32()
+	size, modified := int64(-1), time.Time{}
+	if err == nil && flags&sftpAttrSize != 0 {
+		var n uint64
+		n, err = body.uint64()
+		size = int64(n)
+	}
+	if err == nil && flags&sftpAttrUIDGID != 0 {
+		_, err = body.uint64()
+	}
+	if err == nil && flags&sftpAttrPerms != 0 {
+		_, err = body.uint32()
+	}
+	if err == nil && flags&sftpAttrTimes != 0 {
+		var mtime uint32
+		if _, err = body.uint32(); err == nil {
+			mtime, err = body.uint32()
+			modified = time.Unix(int64(mtime), 0)
+		}
+	}
+	if err == nil && size < 0 {
+		err = fmt.Errorf("sftp: %s: no size", u.Path)
+	}
+	return size, modified, err
+}
+
+func (s *sftpSource) open(ctx context.Context, u *url.URL, offset, length int64) (io.ReadCloser, error) {
+	ss, err := s.session(u)
+	if err != nil {
+		return nil, err
+	}
+	stop := ss.watch(ctx)
+	id, err := ss.request(sftpOpen, sftpPath(u), uint32(sftpOpenRead), uint32(0))
+	var handle []byte
+	if err == nil {
+		var typ byte
+		var body sftpBuf
+		typ, body, err = ss.reply(id)
+		if err == nil && typ != sftpHandle {
+			ss.broken.Store(true)
+			err = fmt.Errorf("sftp: unexpected packet %d instead of a handle", typ)
+		}
+		if err == nil {
+			handle, err = body.string()
+		}
+	}
+	if err != nil {
+		stop()
+		s.release(ss)
+		return nil, err
+	}
+	return &sftpReader{src: s, ss: ss, stop: stop, handle: string(handle), off: offset, end: offset + length}, nil
+}
+
+// sftpReader reads [off, end) of an open file, keeping up to sftpInflight
+// reads in flight. Servers answer them in order; a short answer starts
+// the pipeline over after it.
+type sftpReader struct {
+	src    *sftpSource
+	ss     *sftpSession
+	stop   func() bool
+	handle string
+
+	off     int64
+	end     int64
+	pending []sftpPending
+	buf     []byte
+	err     error
+}
+
+type sftpPending struct {
+	id  uint32
+	off int64
+	n   int
+}
+
+func (r *sftpReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		for len(r.pending) < sftpInflight && r.off < r.end {
+			n := int(min(sftpReadSize, r.end-r.off))
+			id, err := r.ss.request(sftpRead, r.handle, uint64(r.off), uint32(n))
+			if err != nil {
+				r.err = err
+				break
+			}
+			r.pending = append(r.pending, sftpPending{id, r.off, n})
+			r.off += int64(n)
+		}
+		if len(r.pending) == 0 {
+			if r.err == nil {
+				r.err = io.EOF
+			}
+			continue
+		}
+
+		head := r.pending[0]
+		r.pending = r.pending[1:]
+		typ, body, err := r.ss.reply(head.id)
+		switch {
+		case err == io.EOF:
+			r.err = io.ErrUnexpectedEOF
+		case err != nil:
+			r.err = err
+		case typ != sftpData:
+			r.ss.broken.Store(true)
+			r.err = fmt.Errorf("sftp: unexpected packet %d instead of data", typ)
+		default:
+			data, err := body.string()
+			if err != nil {
+				r.err = err
+				break
+			}
+			r.buf = data
+			if len(data) < head.n {
+				r.restart(head.off + int64(len(data)))
+			}
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// restart drops the answers in flight and reads again from off.
+func (r *sftpReader) restart(off int64) {
+	r.drain()
+	r.off = off
+}
+
+func (r *sftpReader) drain() {
+	for _, pend := range r.pending {
+		if _, _, err := r.ss.reply(pend.id); err != nil && err != io.EOF && r.ss.broken.Load() {
+			break
+		}
+	}
+	r.pending = nil
+}
+
+func (r *sftpReader) Close() error {
+	if r.ss == nil {
+		return nil
+	}
+	if !r.ss.broken.Load() {
+		r.drain()
+		if id, err := r.ss.request(sftpClose, r.handle); err == nil {
+			r.ss.reply(id)
+		}
+	}
+	r.stop()
+	r.src.release(r.ss)
+	r.ss = nil
+	return nil
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSFTPEnv configures fakeSFTP: "args" makes it fail with its
+// arguments, "maxread=N" answers reads with at most N bytes.
+const fakeSFTPEnv = "GOCAT_TEST_SFTP"
+
+// fakeSFTP is ssh running the sftp subsystem: an SFTP version 3 server of
+// the local files on stdio.
+func fakeSFTP(args []string) int {
+	maxRead := 1 << 30
+	switch mode := os.Getenv(fakeSFTPEnv); {
+	case mode == "args":
+		fmt.Fprintln(os.Stderr, strings.Join(args, " "))
+		return 255
+	case strings.HasPrefix(mode, "maxread="):
+		maxRead, _ = strconv.Atoi(strings.TrimPrefix(mode, "maxread="))
+	}
+
+	r := bufio.NewReader(os.Stdin)
+	w := bufio.NewWriter(os.Stdout)
+	send := func(typ byte, fields ...any) {
+		b := []byte{0, 0, 0, 0, typ}
+		for _, f := range fields {
+			switch v := f.(type) {
+			case uint32:
+				b = binary.BigEndian.AppendUint32(b, v)
+			case uint64:
+				b = binary.BigEndian.AppendUint64(b, v)
+			case string:
+				b = binary.BigEndian.AppendUint32(b, uint32(len(v)))
+				b = append(b, v...)
+			}
+		}
+		binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+		w.Write(b)
+		w.Flush()
+	}
+	status := func(id uint32, err error) {
+		code := uint32(sftpOK)
+		switch {
+		case errors.Is(err, io.EOF):
+			code = sftpEOF
+		case errors.Is(err, fs.ErrNotExist):
+			code = sftpNoSuchFile
+		case errors.Is(err, fs.ErrPermission):
+			code = sftpPermDenied
+		case err != nil:
+			code = 4
+		}
+		msg := ""
+		if err != nil {
+			msg = err.Error()
+		}
+		send(sftpStatus, id, code, msg, "")
+	}
+
+	files := map[string]*os.File{}
+	for {
+		var head [5]byte
+		if _, err := io.ReadFull(r, head[:]); err != nil {
+			return 0
+		}
+		body := make(sftpBuf, binary.BigEndian.Uint32(head[:4])-1)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return 1
+		}
+		if head[4] == sftpInit {
+			send(sftpVersion, uint32(3))
+			continue
+		}
+		id, _ := body.uint32()
+		switch head[4] {
+		case sftpStat:
+			path, _ := body.string()
+			fi, err := os.Stat(string(path))
+			if err == nil && strings.HasSuffix(string(path), "denied") {
+				err = fs.ErrPermission
+			}
+			if err != nil {
+				status(id, err)
+				continue
+			}
+			mtime := uint32(fi.ModTime().Unix())
+			send(sftpAttrs, id, uint32(sftpAttrSize|sftpAttrUIDGID|sftpAttrPerms|sftpAttrTimes),
+				uint64(fi.Size()), uint32(1000), uint32(1000), uint32(0o644), mtime, mtime)
+		case sftpOpen:
+			path, _ := body.string()
+			f, err := os.Open(string(path))
+			if err != nil {
+				status(id, err)
+				continue
+			}
+			handle := strconv.Itoa(len(files))
+			files[handle] = f
+			send(sftpHandle, id, handle)
+		case sftpRead:
+			handle, _ := body.string()
+			off, _ := body.uint64()
+			n, _ := body.uint32()
+			buf := make([]byte, min(int(n), maxRead))
+			n2, err := files[string(handle)].ReadAt(buf, int64(off))
+			if n2 == 0 {
+				status(id, err)
+				continue
+			}
+			send(sftpData, id, string(buf[:n2]))
+		case sftpClose:
+			handle, _ := body.string()
+			files[string(handle)].Close()
+			delete(files, string(handle))
+			status(id, nil)
+		default:
+			status(id, errors.New("unsupported"))
+		}
+	}
+}
+
+// testSFTP is an sftpSource whose ssh is fakeSFTP configured with mode.
+func testSFTP(t *testing.T, mode string) *sftpSource {
+	t.Helper()
+	t.Setenv(fakeSFTPEnv, mode)
+	s := newSFTPSource(helperCommand(t, "sftp"), "", "")
+	t.Cleanup(func() {
+		for _, idle := range s.idle {
+			for _, ss := range idle {
+				ss.kill()
+			}
+		}
+	})
+	return s
+}
+
+func sftpURL(path string) *url.URL {
+	return &url.URL{Scheme: "sftp", Host: "files.example", Path: filepath.ToSlash(path)}
+}
+
+func TestSFTPStat(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file.bin")
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.WriteFile(name, []byte("0123456789"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(name, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "denied"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s := testSFTP(t, "")
+	ctx := context.Background()
+
+	size, mtime, err := s.stat(ctx, sftpURL(name))
+	if err != nil || size != 10 || !mtime.Equal(modified) {
+		t.Errorf("stat = %v, %v, %v; want 10, %v", size, mtime, err, modified)
+	}
+	if _, _, err := s.stat(ctx, sftpURL(filepath.Join(dir, "missing"))); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("stat of a missing file: %v, want fs.ErrNotExist", err)
+	}
+	if _, _, err := s.stat(ctx, sftpURL(filepath.Join(dir, "denied"))); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("stat of a denied file: %v, want fs.ErrPermission", err)
+	}
+	if n := len(s.idle["@files.example"]); n != 1 {
+		t.Errorf("%v idle sessions, want the one reused", n)
+	}
+}
+
+func TestSFTPOpen(t *testing.T) {
+	content := make([]byte, 700<<10)
+	for i := range content {
+		content[i] = byte(i * 7 / 3)
+	}
+	name := filepath.Join(t.TempDir(), "big.bin")
+	if err := os.WriteFile(name, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		mode           string
+		offset, length int64
+	}{
+		{"whole", "", 0, int64(len(content))},
+		{"range", "", 12345, 100000},
+		// Answers shorter than asked start the pipeline over after them.
+		{"short reads", "maxread=1000", 999, 300000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testSFTP(t, tt.mode)
+			body, err := s.open(context.Background(), sftpURL(name), tt.offset, tt.length)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(body)
+			body.Close()
+			if err != nil || !bytes.Equal(got, content[tt.offset:tt.offset+tt.length]) {
+				t.Fatalf("read %v bytes, %v; want %v from %v", len(got), err, tt.length, tt.offset)
+			}
+			// The session is kept for the next request.
+			if _, _, err := s.stat(context.Background(), sftpURL(name)); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	s := testSFTP(t, "")
+	body, err := s.open(context.Background(), sftpURL(name), int64(len(content))-10, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	if got, err := io.ReadAll(body); !errors.Is(err, io.ErrUnexpectedEOF) || len(got) != 10 {
+		t.Errorf("read past the end: %v bytes, %v; want 10 and a truncation", len(got), err)
+	}
+}
+
+func TestSFTPSessionArgs(t *testing.T) {
+	s := testSFTP(t, "args")
+	s.key = "/keys/id"
+	u := &url.URL{Scheme: "sftp", User: url.User("alice"), Host: "files.example:2222", Path: "/x"}
+	_, _, err := s.stat(context.Background(), u)
+	want := "-s -x -o BatchMode=yes -p 2222 -l alice -i /keys/id -- files.example sftp"
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("got %v, want the ssh arguments %q", err, want)
+	}
+}
+
+func TestAskpass(t *testing.T) {
+	t.Setenv(askpassPasswdEnv, "pw")
+	prompt := []string{"gocat", "alice@files.example's password: "}
+	if _, ok := askpassPassword(prompt); ok {
+		t.Error("answered without the marker its ssh gets")
+	}
+
+	t.Setenv(askpassEnv, "1")
+	if got, ok := askpassPassword(prompt); !ok || got != "pw" {
+		t.Errorf("got %q, %v, want the password", got, ok)
+	}
+	for _, args := range [][]string{
+		{"gocat", "-o", "out", "https://example.com/x"},
+		{"gocat"},
+		{"gocat", "Are you sure you want to continue connecting (yes/no/[fingerprint])? "},
+	} {
+		if got, ok := askpassPassword(args); ok {
+			t.Errorf("%q answered with %q", args, got)
+		}
+	}
+}
+
+func TestSFTPFraming(t *testing.T) {
+	var w bytes.Buffer
+	ss := &sftpSession{w: nopWriteCloser{&w}}
+	id, err := ss.request(sftpRead, "h", uint64(1<<32+5), uint32(4096))
+	if err != nil || id != 1 {
+		t.Fatalf("request = %v, %v", id, err)
+	}
+	want := []byte{
+		0, 0, 0, 22, sftpRead,
+		0, 0, 0, 1,
+		0, 0, 0, 1, 'h',
+		0, 0, 0, 1, 0, 0, 0, 5,
+		0, 0, 16, 0,
+	}
+	if !bytes.Equal(w.Bytes(), want) {
+		t.Errorf("request wrote % x, want % x", w.Bytes(), want)
+	}
+
+	tests := []struct {
+		name   string
+		packet []byte
+		want   string
+	}{
+		{"empty", []byte{0, 0, 0, 0, sftpStatus}, "bad packet length 0"},
+		{"too long", []byte{0, 0x10, 0, 0, sftpData}, "bad packet length"},
+		{"no id", []byte{0, 0, 0, 3, sftpStatus, 0, 0}, errSFTPShort.Error()},
+		{"truncated", []byte{0, 0, 0, 9, sftpStatus, 0, 0, 0, 1}, "unexpected EOF"},
+	}
+	for _, tt := range tests {
+		ss := &sftpSession{r: bufio.NewReader(bytes.NewReader(tt.packet))}
+		if _, _, _, err := ss.recv(); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%v: got %v, want %q", tt.name, err, tt.want)
+		}
+		if !ss.broken.Load() {
+			t.Errorf("%v: the session is not marked broken", tt.name)
+		}
+	}
+}
+
+func TestSFTPStatus(t *testing.T) {
+	packet := func(code uint32, msg string) sftpBuf {
+		b := binary.BigEndian.AppendUint32(nil, code)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(msg)))
+		return append(b, msg...)
+	}
+	tests := []struct {
+		b    sftpBuf
+		want error
+		msg  string
+	}{
+		{packet(sftpOK, ""), nil, ""},
+		{packet(sftpEOF, "end"), io.EOF, ""},
+		{packet(sftpNoSuchFile, "gone"), fs.ErrNotExist, ""},
+		{packet(sftpPermDenied, "no"), fs.ErrPermission, ""},
+		{packet(4, "failure"), nil, "sftp: error 4: failure"},
+		{sftpBuf{0, 0}, errSFTPShort, ""},
+	}
+	for _, tt := range tests {
+		err := tt.b.status()
+		switch {
+		case tt.msg != "":
+			if err == nil || err.Error() != tt.msg {
+				t.Errorf("status % x = %v, want %q", []byte(tt.b), err, tt.msg)
+			}
+		case !errors.Is(err, tt.want) || (err == nil) != (tt.want == nil):
+			t.Errorf("status % x = %v, want %v", []byte(tt.b), err, tt.want)
+		}
+	}
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// interruptError is the cancellation cause of a command stopped by a
+// signal.
+type interruptError struct {
+	sig syscall.Signal
+}
+
+func (e *interruptError) Error() string {
+	return "interrupted by " + e.sig.String()
+}
+
+// interruptContext returns a context cancelled by the first SIGINT or
+// SIGTERM, which stops every in-flight request so the command can report
+// what it wrote and exit. A second signal exits immediately.
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := (<-ch).(syscall.Signal)
+		warnf("%v: stopping, send again to exit at once", sig)
+		cancel(&interruptError{sig})
+		<-ch
+		restoreTerminal()
+		os.Exit(128 + int(sig))
+	}()
+	return ctx
+}
+
+// fatal exits with err, or with 128 plus the signal number when ctx was
+// interrupted, so scripts can tell an interrupted run from a failed one.
+func fatal(ctx context.Context, err error) {
+	restoreTerminal()
+	var ie *interruptError
+	if errors.As(context.Cause(ctx), &ie) {
+		fmt.Fprintf(os.Stderr, "INTERRUPTED! %v\n", ie)
+		os.Exit(128 + int(ie.sig))
+	}
+	log.Fatal(err)
+}
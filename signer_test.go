@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHMACSigner(t *testing.T) {
+	// RFC 2202 and RFC 4231, test case 2.
+	for _, tc := range []struct{ hash, want string }{
+		{"sha1", "effcdf6ae5eb2fa2d27416d5f184df9c259a7c79"},
+		{"sha256", "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"},
+		{"sha512", "164b7a7bfcf819e2e395fbe73b56e0a387bd64222e831fd610270cd7ea2505549758bf75c05a994a6d034f65f8f0e6fdcaeab1a34d4a6b4b636e070a38bce737"},
+	} {
+		s, err := newHMACSigner("Jefe", "X-Sig", "what do ya want for nothing?", "{{.Signature}}", tc.hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest("GET", "https://example.com/", nil)
+		if err := s.Sign(req); err != nil {
+			t.Fatal(err)
+		}
+		if got := req.Header.Get("X-Sig"); got != tc.want {
+			t.Errorf("%v: got %v, want %v", tc.hash, got, tc.want)
+		}
+	}
+}
+
+func TestHMACSignerFields(t *testing.T) {
+	key := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(key, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newHMACSigner("@"+key, "Authorization", `{{.Method}}\n{{.Path}}\n{{.Range}}\n{{.Date}}`,
+		"HMAC {{.SignatureBase64}}", "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", "https://example.com/bucket/key", nil)
+	req.Header.Set("Range", "bytes=0-99")
+	req.Header.Set("Date", "Mon, 06 May 2024 10:00:00 GMT")
+	if err := s.Sign(req); err != nil {
+		t.Fatal(err)
+	}
+	// openssl dgst -sha256 -hmac secret -binary | base64 of
+	// "GET\n/bucket/key\nbytes=0-99\nMon, 06 May 2024 10:00:00 GMT".
+	if got, want := req.Header.Get("Authorization"), "HMAC dVra7fZftY9wTFcpApA2xAsTRRxCLbE9ub127+9WsRM="; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// A request without a Date gets one, which is what is signed.
+	req, _ = http.NewRequest("GET", "https://example.com/bucket/key", nil)
+	if err := s.Sign(req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Header.Get("Date") == "" {
+		t.Error("no Date was set")
+	}
+
+	if _, err := newHMACSigner("k", "X-Sig", "", "", "md5"); err == nil {
+		t.Error("an unsupported hash was accepted")
+	}
+}
+
+func TestRedirectCredentials(t *testing.T) {
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, `{"data":{"data":{"token":"vt"},"metadata":{"version":1}}}`)
+	}))
+	t.Cleanup(vault.Close)
+	t.Setenv("VAULT_ADDR", vault.URL)
+	t.Setenv("VAULT_TOKEN", "root")
+
+	// The same server under another name, so redirects to it change host.
+	var mu sync.Mutex
+	var seen []http.Header
+	away := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		seen = append(seen, req.Header.Clone())
+		mu.Unlock()
+		http.ServeContent(w, req, "", time.Time{}, strings.NewReader("data\n"))
+	}))
+	t.Cleanup(away.Close)
+	awayURL := strings.Replace(away.URL, "127.0.0.1", "localhost", 1)
+	var redirects int
+	home := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		redirects++
+		mu.Unlock()
+		http.Redirect(w, req, awayURL+req.URL.Path, http.StatusFound)
+	}))
+	t.Cleanup(home.Close)
+	t.Cleanup(func() { VaultHeaders = nil })
+
+	for _, tc := range []struct {
+		name      string
+		configure func()
+		header    string
+	}{
+		{"u", func() { BasicAuth = "alice:pw" }, "Authorization"},
+		{"bearer", func() { Bearer = "tok" }, "Authorization"},
+		{"hmac", func() { HMACKey, HMACHeader = "key", "X-Sig" }, "X-Sig"},
+		{"vault-header", func() { VaultHeaders = stringList{"X-Api-Token=secret/data/api#token"} }, "X-Api-Token"},
+		{"vault-bearer", func() { VaultBearer = "secret/data/api#token" }, "Authorization"},
+	} {
+		for _, trusted := range []bool{false, true} {
+			for _, pin := range []bool{false, true} {
+				name := fmt.Sprintf("%s/trusted=%v/pin=%v", tc.name, trusted, pin)
+				mu.Lock()
+				seen, redirects = nil, 0
+				mu.Unlock()
+				r, out, _ := testRun(t, func() {
+					// Registering the flags leaves repeatable ones as they were.
+					VaultHeaders = nil
+					tc.configure()
+					LocationTrusted, PinRedirects = trusted, pin
+				})
+				runEntries(t, r, home.URL+"/f", home.URL+"/f")
+				if got := out.String(); got != "data\ndata\n" {
+					t.Errorf("%s: output %q", name, got)
+				}
+
+				mu.Lock()
+				if len(seen) == 0 {
+					t.Errorf("%s: never redirected", name)
+				}
+				if pin && redirects >= len(seen) {
+					t.Errorf("%s: %v redirects for %v requests, want later ones pinned", name, redirects, len(seen))
+				}
+				for _, h := range seen {
+					if got := h.Get(tc.header) != ""; got != trusted {
+						t.Errorf("%s: other host got %s %q", name, tc.header, h.Get(tc.header))
+					}
+				}
+				mu.Unlock()
+			}
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+var SkipExisting bool
+
+// sidecarName is the file in the output directory that remembers, for
+// -skip-existing, which version of each URL the files there hold.
+const sidecarName = ".gocat-validators.json"
+
+// sidecarRecord is what was downloaded from a URL. MTime tells whether the
+// file was touched since.
+type sidecarRecord struct {
+	Path         string `json:"path"`
+	Size         int64  `json:"size"`
+	MTime        int64  `json:"mtime"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+var sidecar struct {
+	mu      sync.Mutex
+	loaded  bool
+	records map[string]sidecarRecord
+}
+
+func sidecarPath() string {
+	dir := OutputDir
+	if dir == "" {
+		dir = "."
+	}
+	return filepath.Join(longPath(dir), sidecarName)
+}
+
+// sidecarLookup returns the record of url. sidecar.mu must be held.
+func sidecarLookup(url string) (sidecarRecord, bool) {
+	if !sidecar.loaded {
+		sidecar.loaded = true
+		sidecar.records = map[string]sidecarRecord{}
+		data, err := os.ReadFile(sidecarPath())
+		if err == nil {
+			err = json.Unmarshal(data, &sidecar.records)
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			warnf("ignoring %v: %v", sidecarPath(), err.Error())
+		}
+	}
+	rec, ok := sidecar.records[url]
+	return rec, ok
+}
+
+// upToDate reports whether the local copy of url needs no download: the
+// file it was written to last time is untouched and the server says it
+// has not changed since. Without a record, a file under the name the URL
+// would get is only taken for the current version if it has its size and
+// is dated exactly as the server dates it, as gocat, curl -R and wget
+// leave it: when the file was written says nothing of the version.
+func upToDate(ctx context.Context, url string) bool {
+	sidecar.mu.Lock()
+	rec, ok := sidecarLookup(url)
+	sidecar.mu.Unlock()
+
+	var since time.Time
+	if ok {
+		fi, err := os.Stat(rec.Path)
+		if err != nil || fi.Size() != rec.Size || fi.ModTime().Unix() != rec.MTime {
+			return false
+		}
+		since, _ = http.ParseTime(rec.LastModified)
+	} else {
+		name, err := outputName(url, downloader.Info{})
+		if err != nil {
+			return false
+		}
+		dir := OutputDir
+		if dir == "" {
+			dir = "."
+		}
+		fi, err := os.Stat(filepath.Join(longPath(dir), name))
+		if err != nil || !fi.Mode().IsRegular() {
+			return false
+		}
+		info, err := dl.Stat(ctx, url)
+		if err != nil {
+			return false
+		}
+		modified, err := http.ParseTime(info.LastModified)
+		return err == nil && info.Size == fi.Size() && modified.Equal(fi.ModTime().Truncate(time.Second))
+	}
+	if rec.ETag == "" && since.IsZero() {
+		return false
+	}
+	unchanged, err := dl.Unchanged(ctx, url, rec.ETag, since, rec.Size)
+	return err == nil && unchanged
+}
+
+// recordExisting remembers that path now holds url as described by info,
+// dated like the server dates it so later runs can ask If-Modified-Since.
+func recordExisting(url, path string, info downloader.Info) error {
+	if modified, err := http.ParseTime(info.LastModified); err == nil {
+		if err := os.Chtimes(path, modified, modified); err != nil {
+			return err
+		}
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	sidecar.mu.Lock()
+	defer sidecar.mu.Unlock()
+	sidecarLookup(url)
+	sidecar.records[url] = sidecarRecord{
+		Path:         path,
+		Size:         fi.Size(),
+		MTime:        fi.ModTime().Unix(),
+		ETag:         info.ETag,
+		LastModified: info.LastModified,
+	}
+	data, err := json.MarshalIndent(sidecar.records, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := sidecarPath() + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, sidecarPath())
+}
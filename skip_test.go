@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+// testOrigin serves content at every path, last modified at modified and
+// with etag, answering conditional requests as a server does.
+func testOrigin(t *testing.T, content, etag string, modified time.Time) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+		http.ServeContent(w, req, "", modified, strings.NewReader(content))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// testOutputDir points -O at a fresh directory with a fresh sidecar.
+func testOutputDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	OutputDir = dir
+	sidecar.loaded, sidecar.records = false, nil
+	t.Cleanup(func() {
+		OutputDir = ""
+		sidecar.loaded, sidecar.records = false, nil
+	})
+	return dir
+}
+
+func TestUpToDateWithoutRecord(t *testing.T) {
+	modified := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	srv := testOrigin(t, "version 2\n", "", modified)
+	testRun(t, func() {})
+
+	for _, tc := range []struct {
+		name    string
+		content string
+		mtime   time.Time
+		want    bool
+	}{
+		// Fetched after the server's version dates it, but not by what
+		// the server says: it may hold the version before.
+		{"written later", "version 1\n", modified.Add(time.Hour), false},
+		{"dated by the server", "version 2\n", modified, true},
+		{"dated by the server, another size", "version 22\n", modified, false},
+		{"older", "version 2\n", modified.Add(-time.Hour), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := testOutputDir(t)
+			path := filepath.Join(dir, "f.txt")
+			if err := os.WriteFile(path, []byte(tc.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(path, tc.mtime, tc.mtime); err != nil {
+				t.Fatal(err)
+			}
+			if got := upToDate(context.Background(), srv.URL+"/f.txt"); got != tc.want {
+				t.Errorf("upToDate %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestUpToDateWithRecord(t *testing.T) {
+	modified := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	srv := testOrigin(t, "content\n", `"v1"`, modified)
+	testRun(t, func() {})
+	dir := testOutputDir(t)
+	url := srv.URL + "/f.txt"
+	path := filepath.Join(dir, "f.txt")
+	if err := os.WriteFile(path, []byte("content\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordExisting(url, path, downloader.Info{Size: 8, ETag: `"v1"`, LastModified: modified.Format(http.TimeFormat)}); err != nil {
+		t.Fatal(err)
+	}
+	if !upToDate(context.Background(), url) {
+		t.Error("a recorded, untouched file is not up to date")
+	}
+
+	// A later run reads the record from the sidecar.
+	sidecar.loaded, sidecar.records = false, nil
+	if !upToDate(context.Background(), url) {
+		t.Error("the record did not survive in the sidecar")
+	}
+
+	later := time.Now()
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if upToDate(context.Background(), url) {
+		t.Error("a file touched since it was recorded is up to date")
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var SNIOverrides stringList
+
+// sniMap maps a connection host to the TLS server name to present and to
+// verify the certificate against. The empty key applies to every host.
+type sniMap map[string]string
+
+func parseSNI(values []string) (sniMap, error) {
+	m := sniMap{}
+	for _, v := range values {
+		host, name, ok := strings.Cut(v, "=")
+		if !ok {
+			host, name = "", v
+		}
+		if name == "" {
+			return nil, fmt.Errorf("invalid -sni %q", v)
+		}
+		m[strings.ToLower(host)] = name
+	}
+	return m, nil
+}
+
+func (m sniMap) serverName(host string) string {
+	if name, ok := m[strings.ToLower(host)]; ok {
+		return name
+	}
+	return m[""]
+}
+
+// useSNI makes t dial TLS itself so each connection can present the
+// overridden server name. Hosts without an override keep the usual
+// behaviour of using the URL host.
+func useSNI(t *http.Transport, m sniMap, protos []string) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	t.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg := t.TLSClientConfig.Clone()
+		cfg.ServerName = host
+		if name := m.serverName(host); name != "" {
+			cfg.ServerName = name
+		}
+		cfg.NextProtos = protos
+
+		dial := dialer.DialContext
+		if t.DialContext != nil {
+			// Keep -via and other dialers in the path.
+			dial = t.DialContext
+		}
+		raw, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		conn := tls.Client(raw, cfg)
+		if err := conn.HandshakeContext(ctx); err != nil {
+			raw.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	SplitSize   byteSize
+	SplitPrefix string
+)
+
+// splitMapSuffix is what the split map is named after the prefix.
+const splitMapSuffix = ".split.json"
+
+// split is where the output goes instead of stdout with -split-size.
+var split *splitWriter
+
+// splitMap records the volumes of a split output in order, so that the
+// stream can be put back together, with cat, and checked.
+type splitMap struct {
+	Version    int           `json:"version"`
+	Created    time.Time     `json:"created"`
+	VolumeSize int64         `json:"volume_size"`
+	Length     int64         `json:"length"`
+	Volumes    []splitVolume `json:"volumes"`
+}
+
+type splitVolume struct {
+	Name   string `json:"name"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	SHA256 string `json:"sha256"`
+}
+
+// splitWriter writes a stream to <prefix>.000, <prefix>.001 and so on,
+// each volume but the last exactly size bytes. A volume is created with
+// its first byte, so the stream never leaves an empty one behind.
+type splitWriter struct {
+	prefix string
+	size   int64
+
+	f       *os.File
+	h       hash.Hash
+	volumes []splitVolume
+	written int64
+}
+
+func newSplitWriter(prefix string, size int64) *splitWriter {
+	return &splitWriter{prefix: prefix, size: size}
+}
+
+func (w *splitWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if w.f == nil {
+			if err := w.next(); err != nil {
+				return written, err
+			}
+		}
+		v := &w.volumes[len(w.volumes)-1]
+		k := min(int64(len(p)), w.size-v.Length)
+		n, err := w.f.Write(p[:k])
+		w.h.Write(p[:n])
+		v.Length += int64(n)
+		w.written += int64(n)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+		if v.Length == w.size {
+			if err := w.finishVolume(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *splitWriter) next() error {
+	name := fmt.Sprintf("%s.%03d", w.prefix, len(w.volumes))
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w.f, w.h = f, sha256.New()
+	// Named relative to the map, which may move with them.
+	w.volumes = append(w.volumes, splitVolume{Name: filepath.Base(name), Offset: w.written})
+	return nil
+}
+
+func (w *splitWriter) finishVolume() error {
+	v := &w.volumes[len(w.volumes)-1]
+	v.SHA256 = hex.EncodeToString(w.h.Sum(nil))
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
+
+// Close finishes the last volume and writes the split map.
+func (w *splitWriter) Close() error {
+	if w.f == nil && len(w.volumes) == 0 {
+		// An empty stream still gets its one volume.
+		if err := w.next(); err != nil {
+			return err
+		}
+	}
+	if w.f != nil {
+		if err := w.finishVolume(); err != nil {
+			return err
+		}
+	}
+	b, err := json.MarshalIndent(splitMap{
+		Version:    1,
+		Created:    time.Now().UTC(),
+		VolumeSize: w.size,
+		Length:     w.written,
+		Volumes:    w.volumes,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := w.prefix + splitMapSuffix
+	if err := os.WriteFile(path+".tmp", append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// abort closes the volume being written, leaving no split map.
+func (w *splitWriter) abort() {
+	if w.f != nil {
+		w.f.Close()
+		w.f = nil
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readSplit returns the split map of prefix and the stream its volumes
+// put back together, checking each volume against the map.
+func readSplit(t *testing.T, prefix string) (splitMap, []byte) {
+	t.Helper()
+	b, err := os.ReadFile(prefix + splitMapSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m splitMap
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	var stream []byte
+	for _, v := range m.Volumes {
+		vol, err := os.ReadFile(filepath.Join(filepath.Dir(prefix), v.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(vol)
+		if int64(len(vol)) != v.Length || v.Offset != int64(len(stream)) || v.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("volume %+v does not match its %v bytes at %v", v, len(vol), len(stream))
+		}
+		stream = append(stream, vol...)
+	}
+	return m, stream
+}
+
+func TestSplitWriter(t *testing.T) {
+	data := []byte("0123456789abcdefghijKLMNO")
+	for _, tc := range []struct {
+		name    string
+		length  int
+		volumes []string
+	}{
+		{"short last", 25, []string{"out.000", "out.001", "out.002"}},
+		{"exact", 20, []string{"out.000", "out.001"}},
+		{"empty", 0, []string{"out.000"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			prefix := filepath.Join(t.TempDir(), "out")
+			w := newSplitWriter(prefix, 10)
+			// Writes across and up to the volume boundaries.
+			for p := data[:tc.length]; len(p) > 0; {
+				k := min(len(p), 7)
+				if n, err := w.Write(p[:k]); n != k || err != nil {
+					t.Fatalf("wrote %v of %v: %v", n, k, err)
+				}
+				p = p[k:]
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			m, stream := readSplit(t, prefix)
+			if !bytes.Equal(stream, data[:tc.length]) {
+				t.Errorf("the volumes hold %q", stream)
+			}
+			if m.VolumeSize != 10 || m.Length != int64(tc.length) || len(m.Volumes) != len(tc.volumes) {
+				t.Fatalf("map %+v", m)
+			}
+			for i, v := range m.Volumes {
+				if v.Name != tc.volumes[i] {
+					t.Errorf("volume %v is %v, want %v", i, v.Name, tc.volumes[i])
+				}
+			}
+			if _, err := os.Stat(fmt.Sprintf("%s.%03d", prefix, len(tc.volumes))); !os.IsNotExist(err) {
+				t.Errorf("a volume past the last: %v", err)
+			}
+		})
+	}
+}
+
+func TestSplitWriterAbort(t *testing.T) {
+	prefix := filepath.Join(t.TempDir(), "out")
+	w := newSplitWriter(prefix, 10)
+	w.Write([]byte("0123456789abc"))
+	w.abort()
+	if _, err := os.Stat(prefix + splitMapSuffix); !os.IsNotExist(err) {
+		t.Errorf("an aborted stream left a split map: %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// isStream reports whether src is a pushed list: a named pipe or a
+// "unix:<path>" socket.
+func isStream(src string) bool {
+	if strings.HasPrefix(src, "unix:") {
+		return true
+	}
+	fi, err := os.Stat(src)
+	return err == nil && fi.Mode()&fs.ModeNamedPipe != 0
+}
+
+// openStream opens a pushed list. A pipe list ends when its last writer
+// closes it. A socket list accepts any number of producers, one URL per
+// line, and never ends.
+func openStream(src string) (io.ReadCloser, error) {
+	if path, ok := strings.CutPrefix(src, "unix:"); ok {
+		return listenList(path)
+	}
+	// Blocks until a producer opens the pipe for writing.
+	return os.Open(src)
+}
+
+// listenList serves a list socket at path. Lines from concurrent producers
+// are kept whole but otherwise interleave in arrival order.
+func listenList(path string) (io.ReadCloser, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&fs.ModeSocket != 0 {
+		// Left behind by an earlier run that did not shut down cleanly.
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	var mu sync.Mutex
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				warnf("accepting list producer: %v", err.Error())
+				continue
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				scanner.Buffer(make([]byte, 0, 64<<10), int(MaxLineLength))
+				for scanner.Scan() {
+					mu.Lock()
+					_, err := fmt.Fprintln(pw, scanner.Text())
+					mu.Unlock()
+					if err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return &socketList{PipeReader: pr, ln: ln}, nil
+}
+
+type socketList struct {
+	*io.PipeReader
+	ln net.Listener
+}
+
+func (s *socketList) Close() error {
+	s.ln.Close()
+	return s.PipeReader.Close()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+var Format string
+
+// tarOutput reports whether entries go out as members of a tar stream
+// rather than back to back.
+func tarOutput() bool {
+	return Format == "tar"
+}
+
+// tarEntry writes an entry to w as a tar member, so that the boundaries
+// between entries survive a single pipe. The header, which needs the size
+// up front, goes out with the first byte, so an entry that fails before
+// leaves no member; one that comes up short after it is padded with zeros
+// to its size, so the members after it can still be extracted.
+type tarEntry struct {
+	out *countWriter
+	tw  *tar.Writer
+	hdr *tar.Header
+	// header is the length of the header once written, n the bytes of
+	// the entry written so far.
+	header, n int64
+}
+
+func newTarEntry(w io.Writer) *tarEntry {
+	return &tarEntry{out: &countWriter{w: w}}
+}
+
+// begin sets up the header of file, size bytes of it, named as -O would
+// name it.
+func (t *tarEntry) begin(file string, info downloader.Info, size int64) error {
+	if size < 0 {
+		return &downloader.PermanentError{
+			Err: fmt.Errorf("%s: size unknown, which a -format tar member needs", file),
+		}
+	}
+	name, err := outputName(file, info)
+	if err != nil {
+		return err
+	}
+	mtime, err := http.ParseTime(info.LastModified)
+	if err != nil {
+		mtime = time.Now()
+	}
+	t.hdr = &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  mtime.UTC().Truncate(time.Second),
+	}
+	return nil
+}
+
+func (t *tarEntry) writeHeader() error {
+	if t.tw != nil {
+		return nil
+	}
+	if t.hdr == nil {
+		return fmt.Errorf("tar member written before its header")
+	}
+	t.tw = tar.NewWriter(t.out)
+	err := t.tw.WriteHeader(t.hdr)
+	// WriteHeader leaves nothing buffered.
+	t.header = t.out.n
+	return err
+}
+
+func (t *tarEntry) Write(p []byte) (int, error) {
+	if err := t.writeHeader(); err != nil {
+		return 0, err
+	}
+	n, err := t.tw.Write(p)
+	t.n += int64(n)
+	return n, err
+}
+
+// end closes the member: it pads one begun to its size and to the tar
+// block size, and writes out an empty one that succeeded.
+func (t *tarEntry) end(failed bool) error {
+	if t.hdr == nil || t.tw == nil && failed {
+		return nil
+	}
+	if err := t.writeHeader(); err != nil {
+		return err
+	}
+	if short := t.hdr.Size - t.n; short > 0 {
+		if _, err := io.CopyN(t.tw, zeros{}, short); err != nil {
+			return err
+		}
+	}
+	t.hdr = nil
+	return t.tw.Flush()
+}
+
+// endTar writes the two zero blocks that end a tar stream.
+func endTar(w io.Writer) error {
+	_, err := w.Write(make([]byte, 2*512))
+	return err
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
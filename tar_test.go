@@ -0,0 +1,99 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+// readTar returns the members of a tar stream by name, in order.
+func readTar(t *testing.T, b []byte) (names []string, contents []string) {
+	t.Helper()
+	tr := tar.NewReader(bytes.NewReader(b))
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return names, contents
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		contents = append(contents, string(body))
+	}
+}
+
+func TestTarOutput(t *testing.T) {
+	r, out, base := testRun(t, func() { Format = "tar" })
+	t.Cleanup(func() { Format = "" })
+	runEntries(t, r, base+"/a.txt", base+"/b.html")
+	if err := endTar(out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len()%512 != 0 {
+		t.Errorf("the stream is %v bytes, not whole tar blocks", out.Len())
+	}
+	names, contents := readTar(t, out.Bytes())
+	if len(names) != 2 || names[0] != "a.txt" || contents[0] != "plain\n" || names[1] != "b.html" || contents[1] != "<html>\n" {
+		t.Errorf("got %q with %q", names, contents)
+	}
+}
+
+func TestTarEntryFraming(t *testing.T) {
+	// Naming a member looks up the entry's out= field.
+	testRun(t, func() {})
+	var out bytes.Buffer
+	info := downloader.Info{LastModified: "Wed, 15 May 2024 10:00:00 GMT"}
+
+	// An entry cut short after its header is padded to its size.
+	te := newTarEntry(&out)
+	if err := te.begin("https://example.com/short.bin", info, 10); err != nil {
+		t.Fatal(err)
+	}
+	te.Write([]byte("abcd"))
+	if err := te.end(true); err != nil {
+		t.Fatal(err)
+	}
+	// One that fails before its first byte leaves no member.
+	te = newTarEntry(&out)
+	if err := te.begin("https://example.com/gone.bin", info, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := te.end(true); err != nil {
+		t.Fatal(err)
+	}
+	// An empty one that succeeds is a member all the same.
+	te = newTarEntry(&out)
+	if err := te.begin("https://example.com/empty", info, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := te.end(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := endTar(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	names, contents := readTar(t, out.Bytes())
+	if len(names) != 2 || names[0] != "short.bin" || contents[0] != "abcd\x00\x00\x00\x00\x00\x00" || names[1] != "empty" || contents[1] != "" {
+		t.Errorf("got %q with %q", names, contents)
+	}
+	tr := tar.NewReader(bytes.NewReader(out.Bytes()))
+	if hdr, err := tr.Next(); err != nil || hdr.ModTime.Unix() != 1715767200 {
+		t.Errorf("got %+v, %v, want the Last-Modified as its time", hdr, err)
+	}
+
+	// The size goes in the header, so it has to be known.
+	var perm *downloader.PermanentError
+	if err := newTarEntry(&out).begin("https://example.com/x", info, -1); !errors.As(err, &perm) {
+		t.Errorf("got %v for an unknown size", err)
+	}
+}
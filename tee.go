@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+var (
+	Tees       stringList
+	TeeOnError string
+)
+
+// teeBacklog is how far a -tee file may fall behind the primary output
+// before it holds the run up, or is dropped with -tee-on-error drop.
+const teeBacklog = 64 << 20
+
+var tee *teeWriter
+
+// teeWriter copies what goes to the primary output, stdout, a device or
+// -dest, to every -tee file. Each file is written by its own goroutine, so
+// a slow disk only holds the run up once its queue is full; with
+// -tee-on-error drop a file that fails or falls that far behind is given
+// up on, and the primary output goes on without it.
+type teeWriter struct {
+	primary io.Writer
+	sinks   []*teeSink
+}
+
+type teeSink struct {
+	path string
+	f    *os.File
+	done chan struct{}
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// queue holds the writes not on disk yet, backlog bytes of them.
+	queue   [][]byte
+	backlog int
+	closed  bool
+	err     error
+	dropped bool
+}
+
+func openTee(paths []string) (*teeWriter, error) {
+	t := &teeWriter{}
+	for _, path := range paths {
+		f, err := os.Create(path)
+		if err != nil {
+			t.abort()
+			return nil, err
+		}
+		s := &teeSink{path: path, f: f, done: make(chan struct{})}
+		s.cond = sync.NewCond(&s.mu)
+		go s.run()
+		t.sinks = append(t.sinks, s)
+	}
+	return t, nil
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	n, err := t.primary.Write(p)
+	if err != nil {
+		return n, err
+	}
+	for _, s := range t.sinks {
+		if err := s.write(p); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Close waits for every file to catch up and closes it.
+func (t *teeWriter) Close() error {
+	var first error
+	for _, s := range t.sinks {
+		if err := s.close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// abort closes the files as they are, after a failed run.
+func (t *teeWriter) abort() {
+	for _, s := range t.sinks {
+		s.close()
+	}
+}
+
+func (s *teeSink) run() {
+	defer close(s.done)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		for len(s.queue) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if len(s.queue) == 0 {
+			return
+		}
+		b := s.queue[0]
+		s.queue = s.queue[1:]
+		failed := s.err != nil || s.dropped
+		s.mu.Unlock()
+		var err error
+		if !failed {
+			_, err = s.f.Write(b)
+		}
+		s.mu.Lock()
+		s.backlog -= len(b)
+		s.cond.Broadcast()
+		if err != nil {
+			s.failLocked(err)
+		}
+	}
+}
+
+// failLocked records err, or drops the file for it with -tee-on-error drop.
+func (s *teeSink) failLocked(err error) {
+	if TeeOnError == "drop" {
+		s.dropLocked(err.Error())
+		return
+	}
+	if s.err == nil {
+		s.err = fmt.Errorf("-tee %s: %w", s.path, err)
+	}
+}
+
+func (s *teeSink) dropLocked(reason string) {
+	if s.dropped {
+		return
+	}
+	s.dropped = true
+	for _, b := range s.queue {
+		s.backlog -= len(b)
+	}
+	s.queue = nil
+	s.cond.Broadcast()
+	warnf("dropping -tee %s (%s), the rest of the run goes to the other outputs", s.path, reason)
+}
+
+func (s *teeSink) write(p []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if TeeOnError != "drop" {
+		for s.backlog > teeBacklog && s.err == nil {
+			s.cond.Wait()
+		}
+	} else if s.backlog > teeBacklog {
+		s.dropLocked(fmt.Sprintf("more than %v bytes behind", teeBacklog))
+	}
+	if s.err != nil || s.dropped {
+		return s.err
+	}
+	// p may be reused once Write returns.
+	s.queue = append(s.queue, bytes.Clone(p))
+	s.backlog += len(p)
+	s.cond.Broadcast()
+	return nil
+}
+
+func (s *teeSink) close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	<-s.done
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.f.Close(); err != nil {
+		s.failLocked(err)
+	}
+	return s.err
+}
@@ -0,0 +1,16 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func cbreak(f *os.File) (func(), error) {
+	return nil, errors.New("keys are not supported on this platform")
+}
+
+func terminalSize(f *os.File) (cols, rows int) {
+	return 0, 0
+}
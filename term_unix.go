@@ -0,0 +1,43 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// cbreak hands keys on the terminal f to the program as they are typed,
+// without echoing them, and returns a function restoring the terminal.
+// Ctrl-C still raises SIGINT.
+func cbreak(f *os.File) (func(), error) {
+	var saved syscall.Termios
+	if err := termios(f, ioctlGetTermios, &saved); err != nil {
+		return nil, err
+	}
+	t := saved
+	t.Lflag &^= syscall.ICANON | syscall.ECHO
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+	if err := termios(f, ioctlSetTermios, &t); err != nil {
+		return nil, err
+	}
+	return func() { termios(f, ioctlSetTermios, &saved) }, nil
+}
+
+func termios(f *os.File, req uintptr, t *syscall.Termios) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req, uintptr(unsafe.Pointer(t))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// terminalSize is the columns and rows of the terminal f, 0 when unknown.
+func terminalSize(f *os.File) (cols, rows int) {
+	var ws struct{ Row, Col, X, Y uint16 }
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws))); errno != 0 {
+		return 0, 0
+	}
+	return int(ws.Col), int(ws.Row)
+}
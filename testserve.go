@@ -0,0 +1,325 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/msmania/gocat/ratelimit"
+)
+
+// testServer is the origin of gocat testserve. Every path names an object
+// of its own, made up from the seed and the path, so two runs with the same
+// flags serve the same bytes and misbehave the same way.
+type testServer struct {
+	size       int64
+	ranges     string
+	flaky      float64
+	slowRate   int64
+	slowShare  float64
+	etagEvery  int64
+	stormEvery time.Duration
+	stormFor   time.Duration
+	retryAfter int
+
+	seed     uint64
+	started  time.Time
+	requests atomic.Int64
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+// testEpoch is the Last-Modified of the first generation of every object.
+var testEpoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func (ts *testServer) chance(share float64) bool {
+	if share <= 0 {
+		return false
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.rnd.Float64() < share
+}
+
+func (ts *testServer) int64N(n int64) int64 {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.rnd.Int64N(n)
+}
+
+func (ts *testServer) storming(now time.Time) bool {
+	return ts.stormEvery > 0 && now.Sub(ts.started)%ts.stormEvery < ts.stormFor
+}
+
+func (ts *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := ts.requests.Add(1) - 1
+	what := []string{}
+	defer func() {
+		infof("%v %v range=%q: %v", r.Method, r.URL, r.Header.Get("Range"), strings.Join(what, ", "))
+	}()
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		what = append(what, "405")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if ts.storming(time.Now()) {
+		what = append(what, "429 storm")
+		w.Header().Set("Retry-After", strconv.Itoa(ts.retryAfter))
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	size := ts.size
+	if v := r.URL.Query().Get("size"); v != "" {
+		s, err := parseSize(v)
+		if err != nil || s < 0 {
+			what = append(what, "400")
+			http.Error(w, fmt.Sprintf("invalid size %q", v), http.StatusBadRequest)
+			return
+		}
+		size = s
+	}
+
+	var generation int64
+	if ts.etagEvery > 0 {
+		generation = n / ts.etagEvery
+	}
+	h := fnv.New64a()
+	io.WriteString(h, r.URL.Path)
+	obj := &testObject{seed: ts.seed ^ h.Sum64() + uint64(generation), size: size}
+	modified := testEpoch.Add(time.Duration(generation) * time.Minute)
+	w.Header().Set("ETag", fmt.Sprintf(`"%016x-%d"`, obj.seed, generation))
+	what = append(what, fmt.Sprintf("generation %d", generation))
+
+	var body io.Writer = w
+	if ts.slowRate > 0 && ts.chance(ts.slowShare) {
+		what = append(what, fmt.Sprintf("slow at %v/s", formatSize(ts.slowRate)))
+		body = &pacedWriter{w: body, r: r, bucket: ratelimit.New(ts.slowRate)}
+	}
+	first, last, ranged := dataRange(r.Header.Get("Range"), size)
+	length := size
+	if ranged && (ts.ranges == "ok" || ts.ranges == "wrong") {
+		length = last - first + 1
+	}
+	if length > 0 && ts.chance(ts.flaky) {
+		cut := ts.int64N(length)
+		what = append(what, fmt.Sprintf("cut after %d bytes", cut))
+		body = &cutWriter{w: body, left: cut}
+	}
+	rw := &bodyWriter{ResponseWriter: w, body: body}
+
+	switch ts.ranges {
+	case "ok":
+		http.ServeContent(rw, r, "", modified, obj)
+		return
+	case "ignore":
+		w.Header().Set("Accept-Ranges", "bytes")
+	}
+
+	w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+	if ts.ranges == "wrong" && ranged {
+		// The body starts over at 0 whatever range was asked for, and
+		// Content-Range says so, as a broken cache or proxy answers.
+		what = append(what, "misplaced range")
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", 0, length-1, size))
+		w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		if r.Method == http.MethodGet {
+			io.CopyN(rw, obj, length)
+		}
+		return
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		io.Copy(rw, obj)
+	}
+}
+
+// testObject is the content of one object: a splitmix64 stream of seed,
+// cheap to make at any offset.
+type testObject struct {
+	seed uint64
+	size int64
+	off  int64
+}
+
+func (o *testObject) Read(p []byte) (int, error) {
+	if o.off >= o.size {
+		return 0, io.EOF
+	}
+	p = p[:min(int64(len(p)), o.size-o.off)]
+	for i := range p {
+		pos := o.off + int64(i)
+		p[i] = byte(splitmix64(o.seed+uint64(pos/8)) >> (pos % 8 * 8))
+	}
+	o.off += int64(len(p))
+	return len(p), nil
+}
+
+func (o *testObject) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.off
+	case io.SeekEnd:
+		offset += o.size
+	}
+	if offset < 0 {
+		return 0, errors.New("testObject: negative position")
+	}
+	o.off = offset
+	return offset, nil
+}
+
+func splitmix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+// bodyWriter sends the body of a response through body, which ends at the
+// ResponseWriter it wraps.
+type bodyWriter struct {
+	http.ResponseWriter
+	body io.Writer
+}
+
+func (bw *bodyWriter) Write(p []byte) (int, error) {
+	return bw.body.Write(p)
+}
+
+// cutWriter drops the connection once left bytes have gone through, the
+// way a flaky origin or middlebox does.
+type cutWriter struct {
+	w    io.Writer
+	left int64
+}
+
+func (cw *cutWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > cw.left {
+		cw.w.Write(p[:cw.left])
+		if f, ok := cw.w.(http.Flusher); ok {
+			f.Flush()
+		}
+		panic(http.ErrAbortHandler)
+	}
+	cw.left -= int64(len(p))
+	return cw.w.Write(p)
+}
+
+type pacedWriter struct {
+	w      io.Writer
+	r      *http.Request
+	bucket *ratelimit.Bucket
+}
+
+func (pw *pacedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), ratelimit.ReadSize)
+		if err := pw.bucket.Take(pw.r.Context(), n); err != nil {
+			return written, err
+		}
+		n, err := pw.w.Write(p[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (pw *pacedWriter) Flush() {
+	if f, ok := pw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func runTestserve(args []string) {
+	fs := flag.NewFlagSet("testserve", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:8080", "address to listen on; port 0 picks a free one")
+	size := byteSize(64 << 20)
+	fs.Var(&size, "size", "size of every object; ?size= in a URL overrides it")
+	seed := fs.Uint64("seed", 1, "seed of the content and of every random choice")
+	ranges := fs.String("ranges", "ok",
+		"range support: ok, none (200 without Accept-Ranges), ignore (Accept-Ranges but always 200)"+
+			" or wrong (206 from byte 0 whatever the range, with a Content-Range saying so)")
+	flaky := fs.Float64("flaky", 0, "share of responses whose connection drops mid-body")
+	slowRate := byteSize(0)
+	fs.Var(&slowRate, "slow-rate", "bytes/s of a slow response")
+	slowShare := fs.Float64("slow", 0, "share of responses sent at -slow-rate")
+	etagEvery := fs.Int64("etag-every", 0, "change every object, and its ETag, after this many requests (0 never)")
+	stormEvery := fs.Duration("storm-every", 0, "start a storm of 429 answers this often (0 never)")
+	stormFor := fs.Duration("storm-for", 5*time.Second, "length of a 429 storm")
+	retryAfter := fs.Int("retry-after", 1, "Retry-After, in seconds, of a 429 answer")
+	fs.BoolVar(&Verbose, "v", false, "log debug messages too")
+	fs.BoolVar(&Quiet, "q", false, "log only warnings and errors, not each request")
+	fs.StringVar(&LogFormat, "log-format", "text", "log as text lines or as json records")
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "Usage: gocat testserve [-addr <host:port>] [-size <size>] [-seed <n>]"+
+			" [-ranges ok|none|ignore|wrong] [-flaky <share>] [-slow <share> -slow-rate <bytes/s>]"+
+			" [-etag-every <n>] [-storm-every <duration> -storm-for <duration>]")
+		os.Exit(1)
+	}
+	switch *ranges {
+	case "ok", "none", "ignore", "wrong":
+	default:
+		log.Fatalf("invalid -ranges %q: want ok, none, ignore or wrong", *ranges)
+	}
+	if *slowShare > 0 && slowRate <= 0 {
+		log.Fatal("-slow needs -slow-rate")
+	}
+	if err := setupLogging(); err != nil {
+		log.Fatal(err)
+	}
+
+	ts := &testServer{
+		size:       int64(size),
+		ranges:     *ranges,
+		flaky:      *flaky,
+		slowRate:   int64(slowRate),
+		slowShare:  *slowShare,
+		etagEvery:  *etagEvery,
+		stormEvery: *stormEvery,
+		stormFor:   *stormFor,
+		retryAfter: *retryAfter,
+		seed:       *seed,
+		started:    time.Now(),
+		rnd:        rand.New(rand.NewPCG(*seed, *seed)),
+	}
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	infof("serving %v objects on http://%v/", formatSize(int64(size)), ln.Addr())
+
+	ctx := interruptContext()
+	srv := &http.Server{Handler: ts}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"hash/fnv"
+	"io"
+	"math/rand/v2"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestTestserve runs gocat against each way gocat testserve misbehaves, and
+// checks that it either writes the object exactly or fails.
+func TestTestserve(t *testing.T) {
+	const size = 3 << 20
+	for _, tc := range []struct {
+		name string
+		ts   *testServer
+		// fails is what the failure says, or "" when the download must
+		// succeed.
+		fails string
+	}{
+		{name: "ok", ts: &testServer{ranges: "ok"}},
+		{name: "none", ts: &testServer{ranges: "none"}},
+		{name: "ignore", ts: &testServer{ranges: "ignore"}},
+		{name: "wrong", ts: &testServer{ranges: "wrong"}, fails: "but server sent"},
+		{name: "flaky", ts: &testServer{ranges: "ok", flaky: 0.5}},
+		{name: "slow", ts: &testServer{ranges: "ok", slowRate: 4 << 20, slowShare: 0.5}},
+		{name: "etag", ts: &testServer{ranges: "ok", etagEvery: 2}, fails: "changed"},
+		// The metadata is asked for just after a storm, and the slow
+		// chunks run into the next.
+		{name: "storm", ts: &testServer{
+			ranges: "ok", slowRate: 8 << 20, slowShare: 1,
+			stormEvery: 100 * time.Millisecond, stormFor: 50 * time.Millisecond,
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := tc.ts
+			ts.size, ts.seed, ts.started = size, 1, time.Now().Add(-ts.stormFor)
+			ts.rnd = rand.New(rand.NewPCG(1, 1))
+			srv := httptest.NewServer(ts)
+			t.Cleanup(srv.Close)
+
+			r, out, _ := testRun(t, func() {
+				SkipFailed = true
+				BatchSizeInMB = 1
+				MaxRetry = 20
+				RetryInitial, RetryMax = time.Millisecond, 10*time.Millisecond
+			})
+			runEntries(t, r, srv.URL+"/object")
+			if tc.fails != "" {
+				if len(r.failures) != 1 || !strings.Contains(r.failures[0], tc.fails) {
+					t.Errorf("failures %q, want one saying %q", r.failures, tc.fails)
+				}
+				return
+			}
+			if len(r.failures) != 0 {
+				t.Fatalf("failures %q", r.failures)
+			}
+			h := fnv.New64a()
+			io.WriteString(h, "/object")
+			want, _ := io.ReadAll(&testObject{seed: ts.seed ^ h.Sum64(), size: size})
+			if !bytes.Equal(out.Bytes(), want) {
+				t.Errorf("wrote %v bytes, not the object", out.Len())
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+var (
+	CACert     string
+	ClientCert string
+	ClientKey  string
+	Insecure   bool
+	TLSMin     string
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// configureTLS applies -cacert, -cert, -key, -insecure, -tls-min and
+// -pin-sha256 to every transport of the ladder, so HEAD, list and chunk requests all
+// present the same certificate and trust the same roots.
+func configureTLS() error {
+	var roots *x509.CertPool
+	if CACert != "" {
+		pem, err := os.ReadFile(CACert)
+		if err != nil {
+			return err
+		}
+		// Like curl, the file replaces the system roots.
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("-cacert %s holds no PEM certificate", CACert)
+		}
+	}
+
+	var certs []tls.Certificate
+	if ClientKey != "" && ClientCert == "" {
+		return fmt.Errorf("-key needs -cert")
+	}
+	if ClientCert != "" {
+		// The key may be in the same file as the certificate.
+		key := ClientKey
+		if key == "" {
+			key = ClientCert
+		}
+		cert, err := tls.LoadX509KeyPair(ClientCert, key)
+		if err != nil {
+			return fmt.Errorf("-cert %s: %w", ClientCert, err)
+		}
+		certs = []tls.Certificate{cert}
+	}
+
+	var minVersion uint16
+	if TLSMin != "" {
+		var ok bool
+		if minVersion, ok = tlsVersions[TLSMin]; !ok {
+			return fmt.Errorf("invalid -tls-min %q: want 1.0, 1.1, 1.2 or 1.3", TLSMin)
+		}
+	}
+
+	var pins map[string][]string
+	if len(Pins) > 0 {
+		var err error
+		if pins, err = parsePins(Pins); err != nil {
+			return err
+		}
+	}
+
+	if Insecure {
+		warnf("warning: -insecure: server certificates are not verified")
+	}
+	ladder.each(func(t *http.Transport) {
+		cfg := t.TLSClientConfig
+		if roots != nil {
+			cfg.RootCAs = roots
+		}
+		if certs != nil {
+			cfg.Certificates = certs
+		}
+		if minVersion != 0 {
+			cfg.MinVersion = minVersion
+		}
+		cfg.InsecureSkipVerify = Insecure
+	})
+	if pins != nil {
+		usePins(pins)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTLSServer starts an https server of "secure\n", tuned by configure
+// before it starts.
+func newTLSServer(t *testing.T, configure func(*tls.Config)) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.ServeContent(w, req, "", time.Time{}, strings.NewReader("secure\n"))
+	}))
+	// Refused handshakes are what the tests are after.
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.TLS = &tls.Config{}
+	configure(srv.TLS)
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// writePEM writes blocks to a file in a temporary directory.
+func writePEM(t *testing.T, name string, blocks ...*pem.Block) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	var b []byte
+	for _, block := range blocks {
+		b = append(b, pem.EncodeToMemory(block)...)
+	}
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// fetchTLS downloads url under the flags configure sets, returning what
+// was written and the failures.
+func fetchTLS(t *testing.T, url string, configure func()) (string, []string) {
+	t.Helper()
+	r, out, _ := testRun(t, func() {
+		SkipFailed = true
+		MaxRetry = 1
+		configure()
+	})
+	t.Cleanup(func() {
+		CACert, ClientCert, ClientKey, Insecure, TLSMin = "", "", "", false, ""
+	})
+	runEntries(t, r, url)
+	return out.String(), r.failures
+}
+
+func TestCACert(t *testing.T) {
+	srv := newTLSServer(t, func(*tls.Config) {})
+	ca := writePEM(t, "ca.pem", &pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+
+	for _, tc := range []struct {
+		name      string
+		configure func()
+		ok        bool
+	}{
+		{"system roots", func() {}, false},
+		{"cacert", func() { CACert = ca }, true},
+		{"insecure", func() { Insecure = true }, true},
+	} {
+		out, failures := fetchTLS(t, srv.URL+"/f", tc.configure)
+		if tc.ok && (out != "secure\n" || len(failures) > 0) {
+			t.Errorf("%s: output %q, failures %q", tc.name, out, failures)
+		}
+		if !tc.ok && (out != "" || len(failures) != 1 || !strings.Contains(failures[0], "certificate")) {
+			t.Errorf("%s: output %q, failures %q, want a certificate error", tc.name, out, failures)
+		}
+	}
+}
+
+func TestClientCert(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "gocat"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certBlock := &pem.Block{Type: "CERTIFICATE", Bytes: der}
+	keyBlock := &pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}
+	certFile := writePEM(t, "cert.pem", certBlock)
+	keyFile := writePEM(t, "key.pem", keyBlock)
+	both := writePEM(t, "both.pem", certBlock, keyBlock)
+
+	srv := newTLSServer(t, func(cfg *tls.Config) {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		cfg.ClientCAs = x509.NewCertPool()
+		cfg.ClientCAs.AddCert(cert)
+	})
+
+	for _, tc := range []struct {
+		name      string
+		configure func()
+		ok        bool
+	}{
+		{"no cert", func() {}, false},
+		{"cert and key", func() { ClientCert, ClientKey = certFile, keyFile }, true},
+		{"one file", func() { ClientCert = both }, true},
+	} {
+		out, failures := fetchTLS(t, srv.URL+"/f", func() {
+			Insecure = true
+			tc.configure()
+		})
+		if tc.ok && (out != "secure\n" || len(failures) > 0) {
+			t.Errorf("%s: output %q, failures %q", tc.name, out, failures)
+		}
+		if !tc.ok && (out != "" || len(failures) != 1) {
+			t.Errorf("%s: output %q, failures %q, want the handshake refused", tc.name, out, failures)
+		}
+	}
+
+	// A key alone is a mistake, not a request without a certificate.
+	ClientCert, ClientKey = "", keyFile
+	defer func() { ClientKey = "" }()
+	if err := configureTLS(); err == nil || !strings.Contains(err.Error(), "-key needs -cert") {
+		t.Errorf("got %v, want -key needs -cert", err)
+	}
+}
+
+func TestTLSMin(t *testing.T) {
+	srv := newTLSServer(t, func(cfg *tls.Config) { cfg.MaxVersion = tls.VersionTLS12 })
+
+	out, failures := fetchTLS(t, srv.URL+"/f", func() { Insecure, TLSMin = true, "1.2" })
+	if out != "secure\n" || len(failures) > 0 {
+		t.Errorf("-tls-min 1.2: output %q, failures %q", out, failures)
+	}
+	out, failures = fetchTLS(t, srv.URL+"/f", func() { Insecure, TLSMin = true, "1.3" })
+	if out != "" || len(failures) != 1 || !strings.Contains(failures[0], "version") {
+		t.Errorf("-tls-min 1.3: output %q, failures %q, want a protocol version error", out, failures)
+	}
+
+	TLSMin = "1.4"
+	defer func() { TLSMin = "" }()
+	if err := configureTLS(); err == nil || !strings.Contains(err.Error(), "invalid -tls-min") {
+		t.Errorf("got %v, want invalid -tls-min", err)
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// protocolLadder sends requests over HTTP/2 when an origin negotiates it and
+// demotes that origin to HTTP/1.1 for the rest of the run as soon as an
+// HTTP/2 exchange with it fails, either while negotiating or mid-transfer.
+type protocolLadder struct {
+	h2 *http.Transport
+	h1 *http.Transport
+	// h1Only sends everything over HTTP/1.1, with -http2=false.
+	h1Only bool
+
+	mu      sync.Mutex
+	demoted map[string]bool
+}
+
+func newProtocolLadder() *protocolLadder {
+	h2 := http.DefaultTransport.(*http.Transport).Clone()
+	h2.ForceAttemptHTTP2 = true
+
+	h1 := http.DefaultTransport.(*http.Transport).Clone()
+	h1.ForceAttemptHTTP2 = false
+	h1.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+
+	// Resuming TLS sessions saves a full handshake on every new connection
+	// to an origin already seen in this run.
+	sessions := tls.NewLRUClientSessionCache(0)
+	for _, t := range []*http.Transport{h1, h2} {
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		}
+		t.TLSClientConfig.ClientSessionCache = sessions
+	}
+	// Cloning http.DefaultTransport sets it up for HTTP/2, and the clone
+	// then offers "h2" too, which would take HTTP/1.1 back to HTTP/2.
+	h1.TLSClientConfig.NextProtos = []string{"http/1.1"}
+
+	return &protocolLadder{
+		h2:      h2,
+		h1:      h1,
+		demoted: map[string]bool{},
+	}
+}
+
+// each applies fn to every transport on the ladder.
+func (l *protocolLadder) each(fn func(t *http.Transport)) {
+	fn(l.h2)
+	fn(l.h1)
+}
+
+func (l *protocolLadder) isDemoted(host string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.demoted[host]
+}
+
+func (l *protocolLadder) demote(host string, cause error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.demoted[host] {
+		return
+	}
+	l.demoted[host] = true
+	infof("falling back to HTTP/1.1 for %v (%v)", host, cause.Error())
+}
+
+func (l *protocolLadder) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	if l.h1Only || l.isDemoted(host) {
+		return l.h1.RoundTrip(req)
+	}
+
+	resp, err := l.h2.RoundTrip(req)
+	if err != nil {
+		if !isHTTP2Error(err) {
+			return nil, err
+		}
+		l.demote(host, err)
+		if req.Body != nil && req.Body != http.NoBody {
+			return nil, err
+		}
+		return l.h1.RoundTrip(req)
+	}
+
+	if resp.ProtoMajor == 2 {
+		resp.Body = &demotingBody{ReadCloser: resp.Body, ctx: req.Context(), ladder: l, host: host}
+	}
+	return resp, nil
+}
+
+// demotingBody demotes its origin when an HTTP/2 response body fails before
+// reaching EOF, so the retry of that chunk goes out over HTTP/1.1. A body
+// gocat gave up on itself, a hedge that lost, a timeout, a filter that has
+// all it wants or an interrupt, says nothing about the origin.
+type demotingBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	ladder *protocolLadder
+	host   string
+}
+
+func (b *demotingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) && b.ctx.Err() == nil &&
+		!errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+		b.ladder.demote(b.host, err)
+	}
+	return n, err
+}
+
+// http2StreamError has the shape errors.As converts net/http's HTTP/2
+// stream errors to.
+type http2StreamError struct {
+	StreamID uint32
+	Code     uint32
+	Cause    error
+}
+
+func (e http2StreamError) Error() string {
+	return fmt.Sprintf("stream error: stream ID %d; code %d", e.StreamID, e.Code)
+}
+
+// isHTTP2Error reports whether err is a failure of the HTTP/2 exchange
+// itself: a reset stream, a GOAWAY or a connection error. net/http keeps
+// the types of the last two to itself, so they are told by name.
+func isHTTP2Error(err error) bool {
+	var se http2StreamError
+	if errors.As(err, &se) {
+		return true
+	}
+	for err != nil {
+		t := reflect.TypeOf(err)
+		if t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		if strings.HasPrefix(t.PkgPath(), "net/http") {
+			switch t.Name() {
+			case "GoAwayError", "ConnectionError", "http2GoAwayError", "http2ConnectionError":
+				return true
+			}
+		}
+		switch u := err.(type) {
+		case interface{ Unwrap() error }:
+			err = u.Unwrap()
+		case interface{ Unwrap() []error }:
+			return slices.ContainsFunc(u.Unwrap(), isHTTP2Error)
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// configureTransport wraps the shared client's transport according to the
+// parsed flags. It must run before the first request is sent.
+func configureTransport() error {
+	if err := configureTLS(); err != nil {
+		return err
+	}
+
+	ladder.h1Only = !HTTP2
+
+	// Go keeps only 2 idle connections per host by default, so with more
+	// chunks in flight than that most finished connections would be closed
+	// and the next chunks would pay for a new handshake.
+	idle := MaxIdlePerHost
+	if idle == 0 {
+		idle = max(Parallel, HugeWorkers, 2) * max(Jobs, 1)
+	}
+	idle = max(idle, WarmConns)
+	ladder.each(func(t *http.Transport) {
+		t.MaxIdleConnsPerHost = idle
+		t.MaxIdleConns = max(t.MaxIdleConns, idle)
+	})
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: KeepAlive}
+	if ConnectTimeout > 0 {
+		dialer.Timeout = ConnectTimeout
+		ladder.each(func(t *http.Transport) { t.TLSHandshakeTimeout = ConnectTimeout })
+	}
+	dial := dialer.DialContext
+	if DNSCacheTTL > 0 {
+		dial = newDNSCache(dialer, DNSCacheTTL).dial
+	}
+	ladder.each(func(t *http.Transport) { t.DialContext = dial })
+
+	if Offline {
+		if err := goOffline(); err != nil {
+			return err
+		}
+	}
+	if Via != "" {
+		tunnel, err := newSSHTunnel(Via)
+		if err != nil {
+			return err
+		}
+		ladder.each(func(t *http.Transport) { t.DialContext = tunnel.dial })
+	}
+
+	if len(SNIOverrides) > 0 {
+		m, err := parseSNI(SNIOverrides)
+		if err != nil {
+			return err
+		}
+		useSNI(ladder.h2, m, []string{"h2", "http/1.1"})
+		useSNI(ladder.h1, m, []string{"http/1.1"})
+	}
+
+	if Direct && (ProxyPAC != "" || ProxyURL != "" || ProxyRules != "") {
+		return errors.New("-direct cannot be combined with -proxy, -proxy-pac or -proxy-rules")
+	}
+	if ProxyPAC != "" && (ProxyURL != "" || ProxyRules != "") {
+		return errors.New("-proxy-pac cannot be combined with -proxy or -proxy-rules")
+	}
+	if ProxyPAC != "" {
+		pac, err := loadPAC(ProxyPAC)
+		if err != nil {
+			return err
+		}
+		ladder.each(func(t *http.Transport) { t.Proxy = pac.proxy })
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if ProxyURL != "" {
+		u, err := parseProxyURL(ProxyURL)
+		if err != nil {
+			return err
+		}
+		proxy = http.ProxyURL(u)
+		ladder.each(func(t *http.Transport) { t.Proxy = proxy })
+	}
+	if ProxyRules != "" {
+		// Hosts no rule matches use -proxy, or the environment.
+		rules, err := loadProxyRules(ProxyRules, proxy)
+		if err != nil {
+			return err
+		}
+		ladder.each(func(t *http.Transport) { t.Proxy = rules.proxy })
+	}
+	if Direct {
+		// Not even those of the environment.
+		ladder.each(func(t *http.Transport) { t.Proxy = nil })
+	}
+
+	transport := httpClient.Transport
+	// Next to the wire, so redirects and rewritten object store URLs are
+	// limited by the host they actually go to. A request waiting for its
+	// turn is already on the clock of -chunk-timeout and -speed-limit.
+	if MaxPerHost > 0 || MinInterval > 0 {
+		transport = newHostLimiter(transport, MaxPerHost, MinInterval)
+	}
+	switch {
+	case RecordDir != "" && ReplayDir != "":
+		return errors.New("-record and -replay are mutually exclusive")
+	case RecordDir != "":
+		if err := os.MkdirAll(RecordDir, 0755); err != nil {
+			return err
+		}
+		transport = &recordTransport{base: transport, dir: RecordDir}
+	case ReplayDir != "":
+		transport = &replayTransport{dir: ReplayDir}
+	}
+
+	if chaosEnabled() {
+		transport = &chaosTransport{base: transport}
+	}
+
+	// Plugins see requests after signing, as they go on the wire.
+	transport, err := wrapPlugins(transport)
+	if err != nil {
+		return err
+	}
+
+	stores := newObjectStoreTransport(transport)
+	if transport, err = newFileTransport(stores); err != nil {
+		return err
+	}
+	transport = &dataTransport{base: transport}
+
+	if PresignCmd != "" || Resign {
+		if transport, err = newPresignTransport(transport, PresignCmd, stores); err != nil {
+			return err
+		}
+	}
+
+	// Outside the object stores and -presign-cmd, so requests are journaled
+	// by the URL given.
+	if JournalFile != "" {
+		if journal, err = openJournal(JournalFile); err != nil {
+			return err
+		}
+		transport = &journalTransport{base: transport, journal: journal}
+	}
+
+	if HMACKey != "" {
+		signer, err := newHMACSigner(HMACKey, HMACHeader, HMACTemplate, HMACFormat, HMACHash)
+		if err != nil {
+			return err
+		}
+		transport = &signingTransport{base: transport, signer: signer, credentials: true}
+	}
+
+	if len(VaultHeaders) > 0 || VaultBearer != "" || VaultBasic != "" {
+		signer, err := newVaultSigner(VaultHeaders, VaultBearer, VaultBasic)
+		if err != nil {
+			return err
+		}
+		transport = &signingTransport{base: transport, signer: signer, credentials: true}
+	}
+
+	// Between -H and Vault, so the list's header= fields override -H.
+	transport = &signingTransport{base: transport, signer: entrySigner{}}
+
+	// Before HMAC and Vault signing, so those can override -H.
+	if headerSignerEnabled() {
+		signer, err := newHeaderSigner(Headers, BasicAuth, Bearer)
+		if err != nil {
+			return err
+		}
+		transport = &signingTransport{base: transport, signer: signer}
+	}
+
+	if CookieFile != "" {
+		jar, err := loadCookieJar(CookieFile)
+		if err != nil {
+			return err
+		}
+		httpClient.Jar = jar
+	}
+
+	// Outside the signers, which then know a pinned URL for what it is.
+	if PinRedirects {
+		transport = newPinTransport(transport)
+	}
+	httpClient.CheckRedirect = checkRedirect
+
+	// Outermost, so redirects are checked too and signers see the upgraded URL.
+	if schemeGuardEnabled() {
+		guard := &schemeGuard{base: transport}
+		if hstsEnabled() {
+			if guard.hsts, err = openHSTS(); err != nil {
+				return err
+			}
+		}
+		transport = guard
+	}
+
+	httpClient.Transport = transport
+	return nil
+}
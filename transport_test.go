@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestProtocolLadder(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor != 2 {
+			io.WriteString(w, "whole body\n")
+			return
+		}
+		io.WriteString(w, "half")
+		w.(http.Flusher).Flush()
+		if req.URL.Path == "/wait" {
+			<-req.Context().Done()
+			return
+		}
+		// The stream is reset mid-body.
+		panic(http.ErrAbortHandler)
+	}))
+	srv.EnableHTTP2 = true
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	host := strings.TrimPrefix(srv.URL, "https://")
+
+	newLadder := func() (*protocolLadder, *http.Client) {
+		l := newProtocolLadder()
+		l.each(func(t *http.Transport) { t.TLSClientConfig.InsecureSkipVerify = true })
+		return l, &http.Client{Transport: l}
+	}
+	get := func(ctx context.Context, c *http.Client, path string) (*http.Response, string, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := c.Do(req)
+		if err != nil {
+			return nil, "", err
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		return resp, string(b), err
+	}
+
+	l, c := newLadder()
+	if resp, _, err := get(context.Background(), c, "/f"); resp == nil || resp.ProtoMajor != 2 || err == nil {
+		t.Fatalf("got %v, want the HTTP/2 body to fail", err)
+	}
+	if !l.isDemoted(host) {
+		t.Fatal("the origin is not demoted after a reset stream")
+	}
+	// The retry, and every request after it, goes over HTTP/1.1.
+	if resp, body, err := get(context.Background(), c, "/f"); err != nil || resp.ProtoMajor != 1 || body != "whole body\n" {
+		t.Errorf("after demotion: %v, body %q", err, body)
+	}
+
+	// A body given up on by gocat itself says nothing about the origin.
+	l, c = newLadder()
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, "GET", srv.URL+"/wait", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(resp.Body, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if _, err := io.ReadAll(resp.Body); err == nil {
+		t.Error("the cancelled body ended cleanly")
+	}
+	resp.Body.Close()
+	if l.isDemoted(host) {
+		t.Error("the origin is demoted after a cancelled body")
+	}
+
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{fmt.Errorf("read: %w", http2StreamError{StreamID: 1, Code: 2}), true},
+		{&url.Error{Op: "Get", URL: srv.URL, Err: errors.New("connection refused")}, false},
+		{context.Canceled, false},
+	} {
+		if got := isHTTP2Error(tc.err); got != tc.want {
+			t.Errorf("isHTTP2Error(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	tracker "github.com/msmania/gocat/progress"
+)
+
+const (
+	tuiDefaultWidth = 80
+	tuiNameWidth    = 24
+	tuiMinBar       = 10
+)
+
+const tuiKeys = "p pause/resume  s skip  [ ] fewer/more chunks  - + rate  q quit"
+
+// dashboard redraws the -tui block: a line for the run, a row per entry in
+// flight, as many as the terminal has room for, and the keys. Lines are cut
+// to the width of the terminal so that none wraps and the block can be
+// redrawn in place. p.mu must be held.
+func (p *progress) dashboard(entries []*progressEntry, ns []int64, rates []float64, totalBytes int64, totalRate, totalETA float64) {
+	width, height := terminalSize(os.Stderr)
+	if width <= 0 {
+		width = tuiDefaultWidth
+	}
+
+	files := "?"
+	if p.files >= 0 {
+		files = fmt.Sprint(p.files)
+	}
+	head := fmt.Sprintf("%v/%v files done, %v in flight | %v | %v/s",
+		p.finished, files, len(entries), progressAmount(totalBytes, p.totalSize), formatSize(int64(totalRate)))
+	if totalETA >= 0 {
+		head += " ETA " + formatElapsed(time.Duration(totalETA*float64(time.Second)))
+	}
+	head += fmt.Sprintf(" | -p %v", dl.CurrentWorkers())
+	if limit := dl.CurrentRateLimit(); limit > 0 {
+		head += fmt.Sprintf(" limit %v/s", formatSize(limit))
+	}
+	if dl.Paused() {
+		head += " | PAUSED"
+	}
+	lines := []string{head}
+
+	rows := len(entries)
+	if height > 0 {
+		// Room for the head, the keys and an "and n more" line.
+		rows = min(rows, max(height-3, 1))
+	}
+	for i, e := range entries[:rows] {
+		lines = append(lines, p.row(e, ns[i], rates[i], width))
+	}
+	if more := len(entries) - rows; more > 0 {
+		lines = append(lines, fmt.Sprintf("  and %v more", more))
+	}
+	lines = append(lines, tuiKeys)
+
+	var b strings.Builder
+	for i, line := range lines {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(truncate(line, width-1))
+	}
+	p.clear()
+	fmt.Fprint(os.Stderr, b.String())
+	p.lines = len(lines)
+}
+
+// row is the line of entry e, n bytes of it done at rate, with a bar
+// taking the width the rest leaves.
+func (p *progress) row(e *progressEntry, n int64, rate float64, width int) string {
+	name := truncate(path.Base(e.url), tuiNameWidth)
+	name += strings.Repeat(" ", tuiNameWidth-utf8.RuneCountInString(name))
+	stats := fmt.Sprintf("%9v/s", formatSize(int64(rate)))
+	if e.size >= 0 {
+		stats = fmt.Sprintf(" %3d%% %v/%v %s", n*100/max(e.size, 1), formatSize(n), formatSize(e.size), stats)
+		if eta, ok := tracker.ETA(e.size-n, rate); ok {
+			stats += " ETA " + formatElapsed(eta)
+		}
+	} else {
+		stats = fmt.Sprintf(" %v %s", formatSize(n), stats)
+	}
+	switch e.retries {
+	case 0:
+	case 1:
+		stats += " 1 retry"
+	default:
+		stats += fmt.Sprintf(" %v retries", e.retries)
+	}
+
+	line := fmt.Sprintf("%4d %s ", e.index+1, name)
+	bar := width - 1 - utf8.RuneCountInString(line) - len(stats) - 2
+	if bar < tuiMinBar {
+		return line + stats
+	}
+	filled := 0
+	if e.size > 0 {
+		filled = int(min(n, e.size) * int64(bar) / e.size)
+	}
+	return line + "[" + strings.Repeat("#", filled) + strings.Repeat("-", bar-filled) + "]" + stats
+}
+
+// truncate cuts s to at most n runes.
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	r := []rune(s)
+	return string(r[:max(n, 0)])
+}
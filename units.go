@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+// byteSize is a flag.Value accepting sizes such as "512", "64K", "10M" or
+// "1.5G". Suffixes are binary multiples.
+type byteSize int64
+
+var sizeSuffixes = []struct {
+	suffix string
+	shift  uint
+}{
+	{"T", 40},
+	{"G", 30},
+	{"M", 20},
+	{"K", 10},
+}
+
+func parseSize(s string) (int64, error) {
+	return downloader.ParseSize(s)
+}
+
+func formatSize(n int64) string {
+	for _, suf := range sizeSuffixes {
+		if n >= int64(1)<<suf.shift {
+			return fmt.Sprintf("%.1f%siB", float64(n)/float64(int64(1)<<suf.shift), suf.suffix)
+		}
+	}
+	return fmt.Sprintf("%vB", n)
+}
+
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(s string) error {
+	n, err := parseSize(s)
+	if err != nil {
+		return err
+	}
+	*b = byteSize(n)
+	return nil
+}
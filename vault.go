@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	VaultHeaders stringList
+	VaultBearer  string
+	VaultBasic   string
+)
+
+// vaultRef names one field of a Vault secret, written as "path#field".
+type vaultRef struct {
+	path  string
+	field string
+}
+
+func parseVaultRef(s string) (vaultRef, error) {
+	path, field, ok := strings.Cut(s, "#")
+	if !ok || path == "" || field == "" {
+		return vaultRef{}, fmt.Errorf("invalid Vault reference %q, want path#field", s)
+	}
+	return vaultRef{path: strings.Trim(path, "/"), field: field}, nil
+}
+
+type vaultSecret struct {
+	data    map[string]any
+	expires time.Time
+}
+
+// vaultClient reads secrets over Vault's HTTP API using VAULT_ADDR and
+// VAULT_TOKEN (or ~/.vault-token), caching each path until its lease
+// expires.
+type vaultClient struct {
+	addr   string
+	token  string
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]vaultSecret
+}
+
+func newVaultClient() (*vaultClient, error) {
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return nil, errors.New("VAULT_ADDR is not set")
+	}
+
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		home, err := os.UserHomeDir()
+		if err == nil {
+			b, err := os.ReadFile(filepath.Join(home, ".vault-token"))
+			if err == nil {
+				token = strings.TrimSpace(string(b))
+			}
+		}
+	}
+	if token == "" {
+		return nil, errors.New("neither VAULT_TOKEN nor ~/.vault-token is available")
+	}
+
+	return &vaultClient{
+		addr:   strings.TrimRight(addr, "/"),
+		token:  token,
+		client: &http.Client{Timeout: 30 * time.Second},
+		cache:  map[string]vaultSecret{},
+	}, nil
+}
+
+func (c *vaultClient) read(path string) (map[string]any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if s, ok := c.cache[path]; ok && (s.expires.IsZero() || time.Now().Before(s.expires)) {
+		return s.data, nil
+	}
+
+	req, err := http.NewRequest("GET", c.addr+"/v1/"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", c.token)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault: reading %v: %v", path, resp.Status)
+	}
+
+	var body struct {
+		LeaseDuration int            `json:"lease_duration"`
+		Data          map[string]any `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("vault: reading %v: %w", path, err)
+	}
+
+	data := body.Data
+	// KV version 2 nests the secret under data.data next to data.metadata.
+	if inner, ok := data["data"].(map[string]any); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+
+	s := vaultSecret{data: data}
+	if body.LeaseDuration > 0 {
+		// Refresh a little early so no request goes out with a dying secret.
+		lease := time.Duration(body.LeaseDuration) * time.Second
+		s.expires = time.Now().Add(lease - lease/10)
+	}
+	c.cache[path] = s
+	return data, nil
+}
+
+func (c *vaultClient) field(ref vaultRef) (string, error) {
+	data, err := c.read(ref.path)
+	if err != nil {
+		return "", err
+	}
+	v, ok := data[ref.field]
+	if !ok {
+		return "", fmt.Errorf("vault: %v has no field %q", ref.path, ref.field)
+	}
+	return fmt.Sprint(v), nil
+}
+
+type vaultHeader struct {
+	name string
+	ref  vaultRef
+}
+
+// vaultSigner sets headers from Vault secrets on every request. Secrets are
+// read at startup and re-read whenever their lease runs out, so long runs
+// never hold a static credential.
+type vaultSigner struct {
+	client  *vaultClient
+	headers []vaultHeader
+	bearer  *vaultRef
+	basic   string
+}
+
+func newVaultSigner(headers []string, bearer, basic string) (*vaultSigner, error) {
+	client, err := newVaultClient()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &vaultSigner{client: client, basic: strings.Trim(basic, "/")}
+	for _, h := range headers {
+		name, refStr, ok := strings.Cut(h, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid -vault-header %q, want Name=path#field", h)
+		}
+		ref, err := parseVaultRef(refStr)
+		if err != nil {
+			return nil, err
+		}
+		s.headers = append(s.headers, vaultHeader{name: strings.TrimSpace(name), ref: ref})
+	}
+	if bearer != "" {
+		ref, err := parseVaultRef(bearer)
+		if err != nil {
+			return nil, err
+		}
+		s.bearer = &ref
+	}
+
+	// Fail at startup rather than on the first chunk.
+	probe, err := http.NewRequest("GET", "http://localhost/", nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Sign(probe); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *vaultSigner) Sign(req *http.Request) error {
+	for _, h := range s.headers {
+		v, err := s.client.field(h.ref)
+		if err != nil {
+			return err
+		}
+		req.Header.Set(h.name, v)
+	}
+
+	if s.bearer != nil {
+		token, err := s.client.field(*s.bearer)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	if s.basic != "" {
+		user, err := s.client.field(vaultRef{path: s.basic, field: "username"})
+		if err != nil {
+			return err
+		}
+		pass, err := s.client.field(vaultRef{path: s.basic, field: "password"})
+		if err != nil {
+			return err
+		}
+		cred := base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))
+		req.Header.Set("Authorization", "Basic "+cred)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestVaultSigner(t *testing.T) {
+	var mu sync.Mutex
+	token, reads := "t1", 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Vault-Token") != "root" {
+			http.Error(w, "permission denied", http.StatusForbidden)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		reads++
+		switch req.URL.Path {
+		case "/v1/secret/data/api":
+			// KV version 2, with a lease.
+			fmt.Fprintf(w, `{"lease_duration":3600,"data":{"data":{"token":%q},"metadata":{"version":1}}}`, token)
+		case "/v1/kv/login":
+			// KV version 1, without one.
+			fmt.Fprint(w, `{"data":{"username":"alice","password":"pw"}}`)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	t.Setenv("VAULT_ADDR", srv.URL+"/")
+	t.Setenv("VAULT_TOKEN", "root")
+
+	s, err := newVaultSigner([]string{"X-Api-Token=secret/data/api#token"}, "/secret/data/api#token", "kv/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func() *http.Request {
+		t.Helper()
+		req, _ := http.NewRequest("GET", "https://example.com/", nil)
+		if err := s.Sign(req); err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+	req := sign()
+	if got := req.Header.Get("X-Api-Token"); got != "t1" {
+		t.Errorf("X-Api-Token %q", got)
+	}
+	// Basic comes last and wins over the bearer token.
+	if got, want := req.Header.Get("Authorization"), "Basic YWxpY2U6cHc="; got != want {
+		t.Errorf("Authorization %q, want %q", got, want)
+	}
+
+	// The secrets are read once, however many requests they sign.
+	sign()
+	mu.Lock()
+	if reads != 2 {
+		t.Errorf("%v reads, want one for each path", reads)
+	}
+	token = "t2"
+	mu.Unlock()
+	if got := sign().Header.Get("X-Api-Token"); got != "t1" {
+		t.Errorf("X-Api-Token %q before the lease ran out", got)
+	}
+
+	// Once its lease runs out, the secret is read again; the one without a
+	// lease is kept.
+	s.client.mu.Lock()
+	secret := s.client.cache["secret/data/api"]
+	if lease := time.Until(secret.expires); lease < 50*time.Minute || lease > time.Hour {
+		t.Errorf("cached for %v of a lease of an hour", lease)
+	}
+	secret.expires = time.Now().Add(-time.Second)
+	s.client.cache["secret/data/api"] = secret
+	s.client.mu.Unlock()
+	if got := sign().Header.Get("X-Api-Token"); got != "t2" {
+		t.Errorf("X-Api-Token %q after the lease ran out", got)
+	}
+	mu.Lock()
+	if reads != 3 {
+		t.Errorf("%v reads, want 3", reads)
+	}
+	mu.Unlock()
+}
+
+func TestVaultSignerErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, `{"data":{"token":"x"}}`)
+	}))
+	t.Cleanup(srv.Close)
+	t.Setenv("VAULT_ADDR", srv.URL)
+	t.Setenv("VAULT_TOKEN", "root")
+
+	// A missing field fails at startup, not on the first request.
+	if _, err := newVaultSigner(nil, "secret/api#password", ""); err == nil {
+		t.Error("a missing field was accepted")
+	}
+	if _, err := newVaultSigner([]string{"X-Api-Token"}, "", ""); err == nil {
+		t.Error("a header without a reference was accepted")
+	}
+	if _, err := newVaultSigner(nil, "secret/api", ""); err == nil {
+		t.Error("a reference without a field was accepted")
+	}
+}
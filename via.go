@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var Via string
+
+// sshControlPersist is how long the shared SSH connection outlives its last
+// channel, so a run ending leaves nothing behind for long while back to
+// back runs reuse it.
+const sshControlPersist = "60s"
+
+// sshTunnel dials every connection as a direct-tcpip channel ("ssh -W") of
+// one SSH connection to a jump host. It drives the system ssh, so
+// ~/.ssh/config, agents and known_hosts apply as for an interactive login,
+// and a control master multiplexes the channels over a single
+// authenticated connection.
+type sshTunnel struct {
+	ssh  string
+	args []string
+
+	mu    sync.Mutex
+	ready bool
+}
+
+func newSSHTunnel(via string) (*sshTunnel, error) {
+	dest, port := via, ""
+	if host, p, err := net.SplitHostPort(via); err == nil {
+		dest, port = host, p
+	}
+	dir, err := sshControlDir()
+	if err != nil {
+		return nil, fmt.Errorf("-via: %w", err)
+	}
+	args := []string{
+		"-o", "ControlMaster=auto",
+		"-o", "ControlPath=" + filepath.Join(dir, "%C"),
+		"-o", "ControlPersist=" + sshControlPersist,
+	}
+	if port != "" {
+		args = append(args, "-p", port)
+	}
+	return &sshTunnel{ssh: "ssh", args: append(args, dest)}, nil
+}
+
+// sshControlDir is where the control sockets go: a directory of the user's
+// alone, since whoever can reach a socket can use the connection behind it
+// and a shared one such as /tmp lets another user plant a socket first.
+func sshControlDir() (string, error) {
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(cache, "gocat", "ssh")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	// MkdirAll leaves the mode of a directory that was already there.
+	if err := os.Chmod(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+func (t *sshTunnel) command(extra ...string) *exec.Cmd {
+	args := append(append([]string{}, t.args[:len(t.args)-1]...), extra...)
+	return exec.Command(t.ssh, append(args, t.args[len(t.args)-1])...)
+}
+
+// dial is an http.Transport DialContext function. Deadlines work as on any
+// connection; ssh's own complaints, such as a refused channel, go to the
+// log.
+func (t *sshTunnel) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	t.mu.Lock()
+	if t.ready {
+		t.mu.Unlock()
+		conn, err := t.start(addr)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+	// The first channel sets up the master, perhaps prompting on the
+	// terminal; others wait rather than each logging in on its own.
+	defer t.mu.Unlock()
+	conn, err := t.start(addr)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if t.command("-O", "check").Run() == nil {
+			t.ready = true
+			return conn, nil
+		}
+		select {
+		case <-conn.exited:
+			return nil, fmt.Errorf("ssh to %v failed: %v", t.args[len(t.args)-1], conn.cmd.ProcessState)
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+			conn.Close()
+			return nil, context.Cause(ctx)
+		}
+	}
+}
+
+// start runs "ssh -W addr" and bridges its stdio to one end of a pipe.
+func (t *sshTunnel) start(addr string) (*sshConn, error) {
+	cmd := t.command("-W", addr)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = prog.logWriter()
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	local, remote := net.Pipe()
+	c := &sshConn{Conn: local, cmd: cmd, exited: make(chan struct{})}
+	go func() {
+		io.Copy(stdin, remote)
+		stdin.Close()
+	}()
+	go func() {
+		io.Copy(remote, stdout)
+		cmd.Wait()
+		remote.Close()
+		close(c.exited)
+	}()
+	return c, nil
+}
+
+type sshConn struct {
+	net.Conn
+	cmd    *exec.Cmd
+	exited chan struct{}
+}
+
+func (c *sshConn) Close() error {
+	err := c.Conn.Close()
+	c.cmd.Process.Kill()
+	return err
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSSHControlDirIsPrivate(t *testing.T) {
+	cache := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", cache)
+	t.Setenv("HOME", cache)
+	dir := filepath.Join(cache, "gocat", "ssh")
+	// Left open by someone else, it is closed again.
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(dir, 0777)
+
+	tunnel, err := newSSHTunnel("jump.example:2222")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0700 {
+		t.Errorf("control directory mode %v, want 0700", mode)
+	}
+	args := strings.Join(tunnel.args, " ")
+	if !strings.Contains(args, "ControlPath="+filepath.Join(dir, "%C")) {
+		t.Errorf("ssh args %q do not put the control socket in %v", args, dir)
+	}
+	if !strings.HasSuffix(args, "-p 2222 jump.example") {
+		t.Errorf("ssh args %q, want the port and host of -via", args)
+	}
+}
+
+func TestSSHTunnelDials(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("through the tunnel"))
+	}))
+	t.Cleanup(srv.Close)
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	testRun(t, func() {})
+
+	tunnel, err := newSSHTunnel("jump.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel.ssh = helperCommand(t, "ssh")
+	client := &http.Client{Transport: &http.Transport{DialContext: tunnel.dial}}
+	for range 2 {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || string(b) != "through the tunnel" {
+			t.Fatalf("read %q, %v", b, err)
+		}
+	}
+	if !tunnel.ready {
+		t.Error("the tunnel did not find its master")
+	}
+}
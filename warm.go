@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var WarmConns int
+
+var (
+	warmMu    sync.Mutex
+	warmHosts = map[string]bool{}
+)
+
+// warmUp opens WarmConns connections to rawURL's host the first time the
+// host is seen, by sending that many concurrent one-byte GET requests and
+// reading none of the bodies until every one has its response, so that no
+// request can take the connection of another. The connections return to
+// the idle pool, so the chunk requests that follow skip the TCP and TLS
+// handshakes. Over HTTP/2 they share the one connection, as the chunks do.
+func warmUp(ctx context.Context, rawURL string) {
+	if WarmConns <= 0 || ReplayDir != "" || Offline {
+		return
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return
+	}
+
+	warmMu.Lock()
+	seen := warmHosts[u.Host]
+	warmHosts[u.Host] = true
+	warmMu.Unlock()
+	if seen {
+		return
+	}
+
+	n := WarmConns
+	if MaxPerHost > 0 {
+		// The rest would wait for a slot the first ones hold.
+		n = min(n, MaxPerHost)
+	}
+	start := time.Now()
+	var arrived, wg sync.WaitGroup
+	arrived.Add(n)
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := warmRequest(ctx, rawURL)
+			arrived.Done()
+			if err != nil {
+				return
+			}
+			arrived.Wait()
+			// Drained, a one-byte body leaves the connection reusable.
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<10))
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+
+	infof("warmed %v connections to %v in %v", n, u.Host, time.Since(start).Round(time.Millisecond))
+}
+
+func warmRequest(ctx context.Context, rawURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	req.Header.Set("Accept-Encoding", "identity")
+	return httpClient.Do(req)
+}
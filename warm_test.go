@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestWarmUpOpensConnections(t *testing.T) {
+	var mu sync.Mutex
+	conns := 0
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("x"))
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	testRun(t, func() { WarmConns = 4 })
+	t.Cleanup(func() { WarmConns = 0 })
+	warmUp(context.Background(), srv.URL+"/a")
+	warmUp(context.Background(), srv.URL+"/b")
+
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return conns
+	}
+	if n := count(); n != 4 {
+		t.Errorf("%v connections, want 4", n)
+	}
+	// The chunks that follow find them idle.
+	for range 4 {
+		resp, err := httpClient.Get(srv.URL + "/c")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if n := count(); n != 4 {
+		t.Errorf("%v connections after reusing them, want 4", n)
+	}
+}
@@ -0,0 +1,786 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+)
+
+// An xz decoder for what xz and liblzma write: concatenated, padded
+// streams of LZMA2 blocks with any of the standard checks. Blocks with
+// other filters, such as BCJ or delta, are refused.
+
+var xzMagic = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+
+var errXZ = errors.New("xz: corrupt data")
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+// xzCheckSizes is the size of the check of each check ID.
+var xzCheckSizes = [16]int{0, 4, 4, 4, 8, 8, 8, 16, 16, 16, 32, 32, 32, 64, 64, 64}
+
+// xzDecode copies the decompressed content of the xz streams in br to w.
+func xzDecode(br *bufio.Reader, w io.Writer) error {
+	d := &lzma2Decoder{}
+	for first := true; ; first = false {
+		if !first {
+			// Streams may be separated by a multiple of four null bytes.
+			padding := 0
+			for {
+				b, err := br.ReadByte()
+				if err == io.EOF && padding%4 == 0 {
+					return nil
+				}
+				if err != nil {
+					return xzError(err)
+				}
+				if b != 0 {
+					br.UnreadByte()
+					break
+				}
+				padding++
+			}
+			if padding%4 != 0 {
+				return errXZ
+			}
+		}
+		if err := xzStream(br, w, d); err != nil {
+			return err
+		}
+	}
+}
+
+// xzError turns the end of the input into a truncation error.
+func xzError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("xz: %w", io.ErrUnexpectedEOF)
+	}
+	return err
+}
+
+func xzStream(br *bufio.Reader, w io.Writer, d *lzma2Decoder) error {
+	var header [12]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return xzError(err)
+	}
+	if !bytes.Equal(header[:6], xzMagic) {
+		return errors.New("xz: not an xz stream")
+	}
+	flags := header[6:8]
+	if crc32.ChecksumIEEE(flags) != binary.LittleEndian.Uint32(header[8:]) {
+		return errXZ
+	}
+	if flags[0] != 0 || flags[1] > 0x0f {
+		return errors.New("xz: unsupported stream flags")
+	}
+
+	// Each block's unpadded and uncompressed size, to match the index.
+	var records [][2]uint64
+	for {
+		size, err := br.ReadByte()
+		if err != nil {
+			return xzError(err)
+		}
+		if size == 0 {
+			break
+		}
+		unpadded, uncompressed, err := xzBlock(br, size, flags[1], w, d)
+		if err != nil {
+			return err
+		}
+		records = append(records, [2]uint64{unpadded, uncompressed})
+	}
+
+	// The index, whose indicator byte was just read.
+	ir := &xzHashReader{r: br, h: crc32.NewIEEE(), n: 1}
+	ir.h.Write([]byte{0})
+	count, err := xzVarint(ir)
+	if err != nil {
+		return err
+	}
+	if count != uint64(len(records)) {
+		return errXZ
+	}
+	for _, rec := range records {
+		for _, want := range rec {
+			v, err := xzVarint(ir)
+			if err != nil {
+				return err
+			}
+			if v != want {
+				return errXZ
+			}
+		}
+	}
+	for ir.n%4 != 0 {
+		if b, err := ir.ReadByte(); err != nil || b != 0 {
+			return xzError(orCorrupt(err))
+		}
+	}
+	indexSize := ir.n
+	var sum [4]byte
+	if _, err := io.ReadFull(br, sum[:]); err != nil {
+		return xzError(err)
+	}
+	if binary.LittleEndian.Uint32(sum[:]) != ir.h.(hash.Hash32).Sum32() {
+		return errXZ
+	}
+
+	var footer [12]byte
+	if _, err := io.ReadFull(br, footer[:]); err != nil {
+		return xzError(err)
+	}
+	if crc32.ChecksumIEEE(footer[4:10]) != binary.LittleEndian.Uint32(footer[:4]) ||
+		(int64(binary.LittleEndian.Uint32(footer[4:8]))+1)*4 != indexSize+4 ||
+		!bytes.Equal(footer[8:10], flags) || string(footer[10:]) != "YZ" {
+		return errXZ
+	}
+	return nil
+}
+
+func orCorrupt(err error) error {
+	if err == nil {
+		return errXZ
+	}
+	return err
+}
+
+// xzBlock decodes the block whose header starts with size, returning its
+// unpadded and uncompressed sizes.
+func xzBlock(br *bufio.Reader, size, check byte, w io.Writer, d *lzma2Decoder) (uint64, uint64, error) {
+	header := make([]byte, (int(size)+1)*4)
+	header[0] = size
+	if _, err := io.ReadFull(br, header[1:]); err != nil {
+		return 0, 0, xzError(err)
+	}
+	n := len(header)
+	if crc32.ChecksumIEEE(header[:n-4]) != binary.LittleEndian.Uint32(header[n-4:]) {
+		return 0, 0, errXZ
+	}
+	flags := header[1]
+	if flags&0x3c != 0 {
+		return 0, 0, errors.New("xz: unsupported block flags")
+	}
+	hr := bytes.NewReader(header[2 : n-4])
+	compressedSize, uncompressedSize := int64(-1), int64(-1)
+	if flags&0x40 != 0 {
+		v, err := xzVarint(hr)
+		if err != nil {
+			return 0, 0, err
+		}
+		compressedSize = int64(v)
+	}
+	if flags&0x80 != 0 {
+		v, err := xzVarint(hr)
+		if err != nil {
+			return 0, 0, err
+		}
+		uncompressedSize = int64(v)
+	}
+	var dictSize int
+	for i, filters := 0, int(flags&3)+1; i < filters; i++ {
+		id, err := xzVarint(hr)
+		if err != nil {
+			return 0, 0, err
+		}
+		propsSize, err := xzVarint(hr)
+		if err != nil {
+			return 0, 0, err
+		}
+		if id != 0x21 || i != filters-1 {
+			return 0, 0, fmt.Errorf("xz: unsupported filter %#x, only LZMA2 is", id)
+		}
+		props, err := hr.ReadByte()
+		if err != nil || propsSize != 1 {
+			return 0, 0, errXZ
+		}
+		if dictSize, err = lzma2DictSize(props); err != nil {
+			return 0, 0, err
+		}
+	}
+	for hr.Len() > 0 {
+		if b, _ := hr.ReadByte(); b != 0 {
+			return 0, 0, errXZ
+		}
+	}
+
+	var h hash.Hash
+	switch check {
+	case 0x01:
+		h = crc32.NewIEEE()
+	case 0x04:
+		h = crc64.New(crc64Table)
+	case 0x0a:
+		h = sha256.New()
+	}
+	out := &countWriter{w: w}
+	if h != nil {
+		out.w = io.MultiWriter(w, h)
+	}
+	in := &xzHashReader{r: br}
+	if err := d.decode(in, out, dictSize); err != nil {
+		return 0, 0, err
+	}
+	if compressedSize >= 0 && in.n != compressedSize ||
+		uncompressedSize >= 0 && out.n != uncompressedSize {
+		return 0, 0, errXZ
+	}
+
+	for i := in.n; i%4 != 0; i++ {
+		if b, err := br.ReadByte(); err != nil || b != 0 {
+			return 0, 0, xzError(orCorrupt(err))
+		}
+	}
+	sum := make([]byte, xzCheckSizes[check])
+	if _, err := io.ReadFull(br, sum); err != nil {
+		return 0, 0, xzError(err)
+	}
+	// CRCs are stored little-endian, hash.Hash sums big-endian.
+	var want []byte
+	switch h := h.(type) {
+	case hash.Hash32:
+		want = binary.LittleEndian.AppendUint32(nil, h.Sum32())
+	case hash.Hash64:
+		want = binary.LittleEndian.AppendUint64(nil, h.Sum64())
+	case hash.Hash:
+		want = h.Sum(nil)
+	}
+	if want != nil && !bytes.Equal(sum, want) {
+		return 0, 0, errors.New("xz: check failed")
+	}
+	return uint64(int64(n) + in.n + int64(len(sum))), uint64(out.n), nil
+}
+
+// countWriter counts what is written through it.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// xzHashReader counts, and hashes if h is set, what is read through it.
+type xzHashReader struct {
+	r   *bufio.Reader
+	h   hash.Hash
+	n   int64
+	one [1]byte
+}
+
+func (x *xzHashReader) Read(p []byte) (int, error) {
+	n, err := x.r.Read(p)
+	x.n += int64(n)
+	if x.h != nil {
+		x.h.Write(p[:n])
+	}
+	return n, err
+}
+
+func (x *xzHashReader) ReadByte() (byte, error) {
+	b, err := x.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	x.n++
+	if x.h != nil {
+		x.one[0] = b
+		x.h.Write(x.one[:])
+	}
+	return b, nil
+}
+
+// xzVarint reads a multibyte integer of up to 63 bits.
+func xzVarint(r io.ByteReader) (uint64, error) {
+	var v uint64
+	for i := 0; i < 9; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, xzError(orCorrupt(err))
+		}
+		if i > 0 && b == 0 {
+			return 0, errXZ
+		}
+		v |= uint64(b&0x7f) << (7 * i)
+		if b&0x80 == 0 {
+			return v, nil
+		}
+	}
+	return 0, errXZ
+}
+
+func lzma2DictSize(props byte) (int, error) {
+	if props > 40 {
+		return 0, errXZ
+	}
+	if props == 40 {
+		return 1<<32 - 1, nil
+	}
+	return (2 | int(props&1)) << (props/2 + 11), nil
+}
+
+// lzma2Decoder decodes LZMA2 chunks: runs of stored bytes, or of LZMA
+// data that may reset the dictionary, the coder state or its properties.
+type lzma2Decoder struct {
+	dict  lzDict
+	lzma  lzmaDecoder
+	rc    rangeDecoder
+	chunk []byte
+}
+
+func (d *lzma2Decoder) decode(r io.Reader, w io.Writer, dictSize int) error {
+	d.dict.w = w
+	d.dict.size = dictSize
+	if len(d.dict.buf) > dictSize {
+		d.dict.buf = d.dict.buf[:dictSize]
+	}
+	d.dict.reset()
+	if d.chunk == nil {
+		d.chunk = make([]byte, 1<<16)
+	}
+
+	needDict, needProps := true, true
+	var header [5]byte
+	for {
+		if _, err := io.ReadFull(r, header[:1]); err != nil {
+			return xzError(err)
+		}
+		control := header[0]
+		switch {
+		case control == 0x00:
+			return d.dict.flush()
+
+		case control == 0x01 || control == 0x02:
+			if control == 0x01 {
+				if err := d.dict.flush(); err != nil {
+					return err
+				}
+				d.dict.reset()
+				needDict = false
+			} else if needDict {
+				return errXZ
+			}
+			if _, err := io.ReadFull(r, header[:2]); err != nil {
+				return xzError(err)
+			}
+			n := int(binary.BigEndian.Uint16(header[:2])) + 1
+			if _, err := io.ReadFull(r, d.chunk[:n]); err != nil {
+				return xzError(err)
+			}
+			for _, b := range d.chunk[:n] {
+				if err := d.dict.put(b); err != nil {
+					return err
+				}
+			}
+
+		case control >= 0x80:
+			if _, err := io.ReadFull(r, header[:4]); err != nil {
+				return xzError(err)
+			}
+			unpacked := int(control&0x1f)<<16 + int(binary.BigEndian.Uint16(header[:2])) + 1
+			packed := int(binary.BigEndian.Uint16(header[2:4])) + 1
+			reset := control >> 5 & 3
+			if reset == 3 {
+				if err := d.dict.flush(); err != nil {
+					return err
+				}
+				d.dict.reset()
+				needDict = false
+			} else if needDict {
+				return errXZ
+			}
+			if reset >= 2 {
+				if _, err := io.ReadFull(r, header[:1]); err != nil {
+					return xzError(err)
+				}
+				if err := d.lzma.setProps(header[0]); err != nil {
+					return err
+				}
+				needProps = false
+			} else if needProps {
+				return errXZ
+			}
+			if reset >= 1 {
+				d.lzma.reset()
+			}
+			if _, err := io.ReadFull(r, d.chunk[:packed]); err != nil {
+				return xzError(err)
+			}
+			if err := d.rc.init(d.chunk[:packed]); err != nil {
+				return err
+			}
+			if err := d.lzma.decode(&d.rc, &d.dict, unpacked); err != nil {
+				return err
+			}
+			if !d.rc.finished() {
+				return errXZ
+			}
+
+		default:
+			return errXZ
+		}
+		if err := d.dict.flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// lzDict is the sliding window of the last size bytes decoded. buf grows
+// as needed up to size, then wraps.
+type lzDict struct {
+	buf  []byte
+	size int
+	pos  int
+	// full is how many bytes back matches may reach, total how many were
+	// decoded since the last reset.
+	full    int
+	total   int
+	flushed int
+	w       io.Writer
+}
+
+func (d *lzDict) reset() {
+	d.pos, d.full, d.total, d.flushed = 0, 0, 0, 0
+}
+
+func (d *lzDict) flush() error {
+	if d.pos == d.flushed {
+		return nil
+	}
+	_, err := d.w.Write(d.buf[d.flushed:d.pos])
+	d.flushed = d.pos
+	return err
+}
+
+func (d *lzDict) put(b byte) error {
+	if d.pos == len(d.buf) {
+		if err := d.flush(); err != nil {
+			return err
+		}
+		if len(d.buf) < d.size {
+			n := min(max(2*len(d.buf), 1<<16), d.size)
+			if n <= cap(d.buf) {
+				d.buf = d.buf[:n]
+			} else {
+				buf := make([]byte, n)
+				copy(buf, d.buf)
+				d.buf = buf
+			}
+		} else {
+			d.pos, d.flushed = 0, 0
+		}
+	}
+	d.buf[d.pos] = b
+	d.pos++
+	d.total++
+	if d.full < d.size {
+		d.full++
+	}
+	return nil
+}
+
+// get returns the byte dist+1 back.
+func (d *lzDict) get(dist int) byte {
+	i := d.pos - dist - 1
+	if i < 0 {
+		i += len(d.buf)
+	}
+	return d.buf[i]
+}
+
+// rangeDecoder is the LZMA range decoder over one chunk.
+type rangeDecoder struct {
+	buf       []byte
+	pos       int
+	rng, code uint32
+}
+
+func (rc *rangeDecoder) init(buf []byte) error {
+	if len(buf) < 5 || buf[0] != 0 {
+		return errXZ
+	}
+	rc.buf, rc.pos = buf, 5
+	rc.rng = 0xffffffff
+	rc.code = binary.BigEndian.Uint32(buf[1:5])
+	if rc.code == rc.rng {
+		return errXZ
+	}
+	return nil
+}
+
+// finished reports whether the chunk ended where the coder did.
+func (rc *rangeDecoder) finished() bool {
+	return rc.pos == len(rc.buf) && rc.code == 0
+}
+
+func (rc *rangeDecoder) normalize() {
+	if rc.rng < 1<<24 {
+		rc.rng <<= 8
+		var b byte
+		if rc.pos < len(rc.buf) {
+			b = rc.buf[rc.pos]
+		}
+		// Reading past the end is caught by finished.
+		rc.pos++
+		rc.code = rc.code<<8 | uint32(b)
+	}
+}
+
+func (rc *rangeDecoder) bit(p *uint16) uint32 {
+	bound := (rc.rng >> 11) * uint32(*p)
+	var b uint32
+	if rc.code < bound {
+		rc.rng = bound
+		*p += (2048 - *p) >> 5
+	} else {
+		rc.rng -= bound
+		rc.code -= bound
+		*p -= *p >> 5
+		b = 1
+	}
+	rc.normalize()
+	return b
+}
+
+func (rc *rangeDecoder) direct(bits int) uint32 {
+	var v uint32
+	for ; bits > 0; bits-- {
+		rc.rng >>= 1
+		rc.code -= rc.rng
+		t := 0 - rc.code>>31
+		rc.code += rc.rng & t
+		rc.normalize()
+		v = v<<1 + t + 1
+	}
+	return v
+}
+
+func (rc *rangeDecoder) tree(probs []uint16, bits int) uint32 {
+	m := uint32(1)
+	for i := 0; i < bits; i++ {
+		m = m<<1 | rc.bit(&probs[m])
+	}
+	return m - 1<<bits
+}
+
+func (rc *rangeDecoder) reverseTree(probs []uint16, bits int) uint32 {
+	m, v := uint32(1), uint32(0)
+	for i := 0; i < bits; i++ {
+		b := rc.bit(&probs[m])
+		m = m<<1 | b
+		v |= b << i
+	}
+	return v
+}
+
+type lzmaLenDecoder struct {
+	choice, choice2 uint16
+	low, mid        [16][8]uint16
+	high            [256]uint16
+}
+
+func (l *lzmaLenDecoder) decode(rc *rangeDecoder, posState uint32) int {
+	if rc.bit(&l.choice) == 0 {
+		return 2 + int(rc.tree(l.low[posState][:], 3))
+	}
+	if rc.bit(&l.choice2) == 0 {
+		return 2 + 8 + int(rc.tree(l.mid[posState][:], 3))
+	}
+	return 2 + 16 + int(rc.tree(l.high[:], 8))
+}
+
+// lzmaDecoder is the LZMA model: the probabilities, state and recent
+// distances carried from one chunk to the next.
+type lzmaDecoder struct {
+	lc, lp, pb uint
+	state      uint32
+	rep        [4]uint32
+
+	literal     []uint16
+	isMatch     [12 << 4]uint16
+	isRep       [12]uint16
+	isRepG0     [12]uint16
+	isRepG1     [12]uint16
+	isRepG2     [12]uint16
+	isRep0Long  [12 << 4]uint16
+	distSlot    [4][64]uint16
+	distSpecial [115]uint16
+	distAlign   [16]uint16
+	matchLen    lzmaLenDecoder
+	repLen      lzmaLenDecoder
+}
+
+func (s *lzmaDecoder) setProps(props byte) error {
+	if props >= 9*5*5 {
+		return errXZ
+	}
+	s.lc, s.lp, s.pb = uint(props%9), uint(props/9%5), uint(props/45)
+	if s.lc+s.lp > 4 {
+		return errXZ
+	}
+	if n := 0x300 << (s.lc + s.lp); len(s.literal) != n {
+		s.literal = make([]uint16, n)
+	}
+	return nil
+}
+
+func (s *lzmaDecoder) reset() {
+	s.state = 0
+	s.rep = [4]uint32{}
+	for _, probs := range [][]uint16{
+		s.literal, s.isMatch[:], s.isRep[:], s.isRepG0[:], s.isRepG1[:], s.isRepG2[:],
+		s.isRep0Long[:], s.distSpecial[:], s.distAlign[:],
+	} {
+		for i := range probs {
+			probs[i] = 1024
+		}
+	}
+	for i := range s.distSlot {
+		for j := range s.distSlot[i] {
+			s.distSlot[i][j] = 1024
+		}
+	}
+	for _, l := range []*lzmaLenDecoder{&s.matchLen, &s.repLen} {
+		l.choice, l.choice2 = 1024, 1024
+		for i := range l.low {
+			for j := range l.low[i] {
+				l.low[i][j], l.mid[i][j] = 1024, 1024
+			}
+		}
+		for i := range l.high {
+			l.high[i] = 1024
+		}
+	}
+}
+
+// decode decodes n bytes into dict. Matches do not cross chunks.
+func (s *lzmaDecoder) decode(rc *rangeDecoder, dict *lzDict, n int) error {
+	pbMask := uint32(1)<<s.pb - 1
+	lpMask := uint32(1)<<s.lp - 1
+	for n > 0 {
+		posState := uint32(dict.total) & pbMask
+		if rc.bit(&s.isMatch[s.state<<4|posState]) == 0 {
+			var prev uint32
+			if dict.full > 0 {
+				prev = uint32(dict.get(0))
+			}
+			lit := (uint32(dict.total)&lpMask)<<s.lc + prev>>(8-s.lc)
+			probs := s.literal[0x300*lit : 0x300*lit+0x300]
+			symbol := uint32(1)
+			if s.state < 7 {
+				for symbol < 0x100 {
+					symbol = symbol<<1 | rc.bit(&probs[symbol])
+				}
+			} else {
+				match := uint32(dict.get(int(s.rep[0]))) << 1
+				offset := uint32(0x100)
+				for symbol < 0x100 {
+					matchBit := match & offset
+					match <<= 1
+					if rc.bit(&probs[offset+matchBit+symbol]) == 1 {
+						symbol = symbol<<1 | 1
+						offset = matchBit
+					} else {
+						symbol <<= 1
+						offset &^= matchBit
+					}
+				}
+			}
+			if err := dict.put(byte(symbol)); err != nil {
+				return err
+			}
+			switch {
+			case s.state < 4:
+				s.state = 0
+			case s.state < 10:
+				s.state -= 3
+			default:
+				s.state -= 6
+			}
+			n--
+			continue
+		}
+
+		length := 0
+		if rc.bit(&s.isRep[s.state]) == 0 {
+			s.rep[3], s.rep[2], s.rep[1] = s.rep[2], s.rep[1], s.rep[0]
+			length = s.matchLen.decode(rc, posState)
+			s.state = lzmaNextState(s.state, 7, 10)
+			s.rep[0] = s.distance(rc, length)
+			if s.rep[0] == 0xffffffff {
+				// An end marker, which LZMA2 has no use for.
+				return errXZ
+			}
+		} else {
+			if rc.bit(&s.isRepG0[s.state]) == 0 {
+				if rc.bit(&s.isRep0Long[s.state<<4|posState]) == 0 {
+					s.state = lzmaNextState(s.state, 9, 11)
+					length = 1
+				}
+			} else {
+				var dist uint32
+				if rc.bit(&s.isRepG1[s.state]) == 0 {
+					dist = s.rep[1]
+				} else {
+					if rc.bit(&s.isRepG2[s.state]) == 0 {
+						dist = s.rep[2]
+					} else {
+						dist = s.rep[3]
+						s.rep[3] = s.rep[2]
+					}
+					s.rep[2] = s.rep[1]
+				}
+				s.rep[1] = s.rep[0]
+				s.rep[0] = dist
+			}
+			if length == 0 {
+				length = s.repLen.decode(rc, posState)
+				s.state = lzmaNextState(s.state, 8, 11)
+			}
+		}
+
+		if int64(s.rep[0]) >= int64(dict.full) || length > n {
+			return errXZ
+		}
+		for i := 0; i < length; i++ {
+			if err := dict.put(dict.get(int(s.rep[0]))); err != nil {
+				return err
+			}
+		}
+		n -= length
+	}
+	return nil
+}
+
+// lzmaNextState is the state after a match: lit if it followed literals,
+// rep otherwise.
+func lzmaNextState(state, lit, rep uint32) uint32 {
+	if state < 7 {
+		return lit
+	}
+	return rep
+}
+
+func (s *lzmaDecoder) distance(rc *rangeDecoder, length int) uint32 {
+	slot := rc.tree(s.distSlot[min(length-2, 3)][:], 6)
+	if slot < 4 {
+		return slot
+	}
+	bits := int(slot>>1) - 1
+	dist := (2 | slot&1) << bits
+	if slot < 14 {
+		return dist + rc.reverseTree(s.distSpecial[dist-slot:], bits)
+	}
+	dist += rc.direct(bits-4) << 4
+	return dist + rc.reverseTree(s.distAlign[:], 4)
+}
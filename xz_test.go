@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The fixtures in testdata/xz were written by xz 5 from xzPlain, with
+// -C none, crc32, crc64 and sha256, with --block-size=16KiB for
+// multiblock.xz and with --x86 for bcj.xz. incompressible.xz holds 16 KiB
+// of random bytes, hence stored chunks, whose SHA-256 is xzRandomSum.
+
+const xzRandomSum = "e12ff013bf1e8efa7ce81dba0670da6fd2b5b89033902dcaaaf0dc742ba5b549"
+
+func xzPlain() []byte {
+	var b bytes.Buffer
+	for i := range 4000 {
+		fmt.Fprintf(&b, "%v %v gocat xz fixture\n", i, i*i%9973)
+	}
+	return b.Bytes()
+}
+
+func xzFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join("testdata", "xz", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func xzTestDecode(b []byte) ([]byte, error) {
+	var out bytes.Buffer
+	err := xzDecode(bufio.NewReader(bytes.NewReader(b)), &out)
+	return out.Bytes(), err
+}
+
+func TestXZDecode(t *testing.T) {
+	plain := xzPlain()
+	for _, name := range []string{"check-none.xz", "check-crc32.xz", "check-crc64.xz", "check-sha256.xz", "multiblock.xz"} {
+		got, err := xzTestDecode(xzFixture(t, name))
+		if err != nil {
+			t.Errorf("%v: %v", name, err)
+		} else if !bytes.Equal(got, plain) {
+			t.Errorf("%v: decoded %v bytes, want the %v of the input", name, len(got), len(plain))
+		}
+	}
+
+	got, err := xzTestDecode(xzFixture(t, "incompressible.xz"))
+	if sum := fmt.Sprintf("%x", sha256.Sum256(got)); err != nil || sum != xzRandomSum {
+		t.Errorf("incompressible.xz: %v, sha256 %v; want %v", err, sum, xzRandomSum)
+	}
+	if got, err := xzTestDecode(xzFixture(t, "empty.xz")); err != nil || len(got) != 0 {
+		t.Errorf("empty.xz: got %q, %v", got, err)
+	}
+}
+
+func TestXZConcatenated(t *testing.T) {
+	plain := xzPlain()
+	a, b := xzFixture(t, "check-crc32.xz"), xzFixture(t, "check-sha256.xz")
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	zeros := func(n int) []byte { return make([]byte, n) }
+
+	tests := []struct {
+		name  string
+		input []byte
+		err   error
+	}{
+		{"two streams", join(a, b), nil},
+		{"padded between", join(a, zeros(4), b), nil},
+		{"padded after", join(a, b, zeros(8)), nil},
+		{"misaligned padding", join(a, zeros(3), b), errXZ},
+	}
+	for _, tt := range tests {
+		got, err := xzTestDecode(tt.input)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%v: got %v, want %v", tt.name, err, tt.err)
+		}
+		if tt.err == nil && !bytes.Equal(got, join(plain, plain)) {
+			t.Errorf("%v: decoded %v bytes, want both inputs", tt.name, len(got))
+		}
+	}
+}
+
+func TestXZTruncated(t *testing.T) {
+	b := xzFixture(t, "multiblock.xz")
+	for _, n := range []int{0, 5, 11, 12, 13, 100, len(b) / 2, len(b) - 40, len(b) - 12, len(b) - 1} {
+		if _, err := xzTestDecode(b[:n]); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("first %v of %v bytes: got %v, want a truncation", n, len(b), err)
+		}
+	}
+}
+
+func TestXZCorrupt(t *testing.T) {
+	b := xzFixture(t, "check-crc32.xz")
+	// The footer holds the index size, and the one block's check comes
+	// right before the index.
+	index := len(b) - 12 - int(binary.LittleEndian.Uint32(b[len(b)-8:])+1)*4
+	flip := func(i int) []byte {
+		c := bytes.Clone(b)
+		c[i] ^= 0x55
+		return c
+	}
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  string
+	}{
+		{"not xz", []byte("plain text, not xz"), "not an xz stream"},
+		{"header crc", flip(8), errXZ.Error()},
+		{"stream flags", flip(7), errXZ.Error()},
+		{"block check", flip(index - 2), "xz: check failed"},
+		{"index count", flip(index + 1), errXZ.Error()},
+		{"footer magic", flip(len(b) - 1), errXZ.Error()},
+		{"payload", flip(len(b) / 2), "xz: "},
+		{"filter", xzFixture(t, "bcj.xz"), "unsupported filter"},
+	}
+	for _, tt := range tests {
+		if _, err := xzTestDecode(tt.input); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%v: got %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	neturl "net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/msmania/gocat/downloader"
+)
+
+const zsyncSuffix = ".zsync"
+
+// zsyncControl is a zsync control file: the block size of a file and, for
+// each block, a weak rolling checksum and a strong one, by which blocks
+// can be found at any offset of a local file.
+type zsyncControl struct {
+	url       string
+	length    int64
+	blockSize int
+	mtime     time.Time
+	sha1      string
+	// seqMatches is how many consecutive blocks must match, for checksums
+	// that were cut short for being checked in pairs.
+	seqMatches int
+	rsumBytes  int
+	sumBytes   int
+	rsums      []uint32
+	sums       [][]byte
+	// byRsum maps a weak checksum to the blocks that have it.
+	byRsum map[uint32][]int
+}
+
+// parseZsync parses a control file whose data is to be fetched from the
+// URL it names, resolved against base.
+func parseZsync(b []byte, base *neturl.URL) (*zsyncControl, error) {
+	header, body, ok := bytes.Cut(b, []byte("\n\n"))
+	if !ok || !bytes.HasPrefix(header, []byte("zsync: ")) {
+		return nil, errors.New("not a zsync control file")
+	}
+	c := &zsyncControl{length: -1, seqMatches: 1, rsumBytes: 4, sumBytes: 16}
+	var rawURL string
+	compressed := false
+	for _, line := range strings.Split(string(header), "\n") {
+		key, value, _ := strings.Cut(line, ": ")
+		var err error
+		switch key {
+		case "Length":
+			c.length, err = strconv.ParseInt(value, 10, 64)
+		case "Blocksize":
+			c.blockSize, err = strconv.Atoi(value)
+		case "Hash-Lengths":
+			_, err = fmt.Sscanf(value, "%d,%d,%d", &c.seqMatches, &c.rsumBytes, &c.sumBytes)
+		case "URL":
+			if rawURL == "" {
+				rawURL = value
+			}
+		case "Z-URL":
+			compressed = true
+		case "SHA-1":
+			c.sha1 = strings.ToLower(value)
+		case "MTime":
+			c.mtime, _ = time.Parse(time.RFC1123Z, value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %q", key, value)
+		}
+	}
+	switch {
+	case rawURL == "" && compressed:
+		return nil, errors.New("only a compressed version is offered (Z-URL), which is not supported")
+	case rawURL == "":
+		return nil, errors.New("no URL")
+	case c.length < 0 || c.blockSize <= 0 || c.blockSize&(c.blockSize-1) != 0:
+		return nil, errors.New("invalid Length or Blocksize")
+	case c.seqMatches < 1 || c.seqMatches > 2 || c.rsumBytes < 1 || c.rsumBytes > 4 || c.sumBytes < 3 || c.sumBytes > 16:
+		return nil, errors.New("invalid Hash-Lengths")
+	}
+	u, err := base.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	c.url = u.String()
+
+	blocks := int((c.length + int64(c.blockSize) - 1) / int64(c.blockSize))
+	entry := c.rsumBytes + c.sumBytes
+	if len(body) < blocks*entry {
+		return nil, fmt.Errorf("has checksums for %v blocks, not %v", len(body)/entry, blocks)
+	}
+	c.byRsum = map[uint32][]int{}
+	for i := range blocks {
+		e := body[i*entry : (i+1)*entry]
+		var r [4]byte
+		copy(r[4-c.rsumBytes:], e[:c.rsumBytes])
+		rsum := binary.BigEndian.Uint32(r[:])
+		c.rsums = append(c.rsums, rsum)
+		c.sums = append(c.sums, e[c.rsumBytes:])
+		c.byRsum[rsum] = append(c.byRsum[rsum], i)
+	}
+	return c, nil
+}
+
+// rsumMask keeps the bits of a rolling checksum the control file has.
+func (c *zsyncControl) rsumMask() uint32 {
+	return uint32(1<<(8*c.rsumBytes) - 1)
+}
+
+// rsum is the weak checksum of zsync, after rsync's: two 16-bit sums
+// that can be rolled along a byte at a time.
+func rsum(p []byte) (a, b uint16) {
+	for i, c := range p {
+		a += uint16(c)
+		b += uint16(len(p)-i) * uint16(c)
+	}
+	return a, b
+}
+
+// matchesAt reports whether block i of c is window.
+func (c *zsyncControl) matchesAt(i int, window []byte) bool {
+	a, b := rsum(window)
+	if (uint32(a)<<16|uint32(b))&c.rsumMask() != c.rsums[i] {
+		return false
+	}
+	sum := md4Sum(window)
+	return bytes.Equal(sum[:c.sumBytes], c.sums[i])
+}
+
+// scan slides a window of a block over seed, a byte at a time, and
+// records in have where each block of c not found yet turns up. The seed
+// reads as zeros past its end, as the last block is padded.
+func (c *zsyncControl) scan(ctx context.Context, seed *os.File, have []int64) error {
+	fi, err := seed.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	bs := c.blockSize
+	mask := c.rsumMask()
+	// Past the bytes read, buf holds two blocks of zeros for the windows
+	// at the end of the seed.
+	read := max(4<<20, 4*bs)
+	buf := make([]byte, read+2*bs)
+	base, valid := int64(0), 0
+	rolled := false
+	var a, b uint16
+	for p := int64(0); p < size; {
+		if p+int64(2*bs) > base+int64(valid) && base+int64(valid) < size || p == 0 && valid == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			base = p
+			n, err := seed.ReadAt(buf[:read], base)
+			if err != nil && !errors.Is(err, io.EOF) {
+				return err
+			}
+			clear(buf[n:])
+			valid, rolled = n, false
+		}
+		off := int(p - base)
+		window := buf[off : off+bs]
+		if rolled {
+			out, in := uint16(buf[off-1]), uint16(window[bs-1])
+			a += in - out
+			b += a - uint16(bs)*out
+		} else {
+			a, b = rsum(window)
+			rolled = true
+		}
+
+		matched := false
+		for _, i := range c.byRsum[(uint32(a)<<16|uint32(b))&mask] {
+			if have[i] >= 0 {
+				continue
+			}
+			sum := md4Sum(window)
+			if !bytes.Equal(sum[:c.sumBytes], c.sums[i]) {
+				continue
+			}
+			// Weak checksums are only trusted two blocks at a time.
+			if c.seqMatches > 1 && i+1 < len(have) && !c.matchesAt(i+1, buf[off+bs:off+2*bs]) {
+				continue
+			}
+			have[i] = p
+			matched = true
+		}
+		if matched {
+			p += int64(bs)
+			rolled = false
+		} else {
+			p++
+		}
+	}
+	return nil
+}
+
+// runSync is gocat sync: it brings a local file up to date with a remote
+// one, like zsync, by reusing whatever blocks of the old copy the remote
+// still has, wherever they moved to, and fetching only the rest with
+// ranged requests. The blocks' checksums come from the remote file's
+// zsync control file, <url>.zsync, as zsyncmake writes it.
+func runSync(args []string) {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	registerFlags(fs)
+	out := fs.String("o", "", "file to bring up to date, replaced once the new version is complete")
+	seed := fs.String("seed", "", "take blocks from this file instead of the -o one, e.g. yesterday's copy")
+	parseFlags(fs, args)
+
+	if *out == "" || fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: gocat sync [options] [-seed <file>] -o <output> <url or .zsync url>")
+		os.Exit(1)
+	}
+	if *seed == "" {
+		*seed = *out
+	}
+	if err := setup(); err != nil {
+		log.Fatal(err)
+	}
+
+	ctx := interruptContext()
+	if err := syncFile(ctx, fs.Arg(0), *seed, *out); err != nil {
+		printRetryReport()
+		fatal(ctx, err)
+	}
+	printRetryReport()
+	fmt.Fprintln(os.Stderr, "COMPLETED!")
+}
+
+func syncFile(ctx context.Context, rawURL, seedPath, out string) error {
+	curl, err := neturl.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if !strings.HasSuffix(curl.Path, zsyncSuffix) {
+		curl.Path += zsyncSuffix
+		curl.RawPath = ""
+	}
+	b, err := dl.FetchList(ctx, curl.String())
+	if err != nil {
+		return err
+	}
+	c, err := parseZsync(b, curl)
+	if err != nil {
+		return &downloader.PermanentError{Err: fmt.Errorf("%s: %w", curl.Redacted(), err)}
+	}
+	url := c.url
+	if !strings.HasSuffix(rawURL, zsyncSuffix) {
+		url = rawURL
+	}
+
+	info, err := dl.Stat(ctx, url)
+	if err != nil {
+		return err
+	}
+	if info.Size != c.length {
+		return &downloader.PermanentError{Err: fmt.Errorf(
+			"%s is %v bytes, but %s is for %v; is the control file stale?", url, info.Size, curl.Redacted(), c.length,
+		)}
+	}
+	if !info.Ranges {
+		return &downloader.PermanentError{Err: fmt.Errorf("%s does not serve ranges", url)}
+	}
+
+	have := make([]int64, len(c.rsums))
+	for i := range have {
+		have[i] = -1
+	}
+	seed, err := os.Open(seedPath)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		infof("%s does not exist; fetching all of %s", seedPath, url)
+	case err != nil:
+		return err
+	default:
+		defer seed.Close()
+		start := time.Now()
+		if err := c.scan(ctx, seed, have); err != nil {
+			return fmt.Errorf("%s: %w", seedPath, err)
+		}
+		found := 0
+		for _, at := range have {
+			if at >= 0 {
+				found++
+			}
+		}
+		infof("found %v of %v blocks of %s in %s in %v", found, len(have), url, seedPath,
+			time.Since(start).Round(time.Millisecond))
+	}
+
+	tmp := out + ".part"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if f != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+	h := sha1.New()
+	w := bufio.NewWriterSize(io.MultiWriter(f, h), 1<<20)
+
+	bs := int64(c.blockSize)
+	var reused, fetched int64
+	ranges := 0
+	block := make([]byte, bs)
+	for i := 0; i < len(have); {
+		from := int64(i) * bs
+		if have[i] >= 0 {
+			n := min(bs, c.length-from)
+			k, err := seed.ReadAt(block[:n], have[i])
+			if err != nil && !errors.Is(err, io.EOF) {
+				return err
+			}
+			clear(block[k:n])
+			if _, err := w.Write(block[:n]); err != nil {
+				return err
+			}
+			reused += n
+			i++
+			continue
+		}
+		j := i
+		for j < len(have) && have[j] < 0 {
+			j++
+		}
+		to := min(int64(j)*bs, c.length)
+		n, err := dl.DownloadRange(ctx, url, info.Size, from, to, w)
+		fetched += n
+		if err != nil {
+			return err
+		}
+		ranges++
+		i = j
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if c.sha1 != "" {
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != c.sha1 {
+			return &downloader.PermanentError{Err: fmt.Errorf(
+				"%s: SHA-1 of the assembled file is %v, the control file says %v", url, sum, c.sha1,
+			)}
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	f = nil
+	if !c.mtime.IsZero() {
+		os.Chtimes(tmp, c.mtime, c.mtime)
+	}
+	if err := os.Rename(tmp, out); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	infof("%s: reused %v bytes, fetched %v bytes in %v ranges", out, reused, fetched, ranges)
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMD4(t *testing.T) {
+	// The test suite of RFC 1320, appendix A.5.
+	for _, tc := range []struct{ in, want string }{
+		{"", "31d6cfe0d16ae931b73c59d7e0c089c0"},
+		{"a", "bde52cb31de33e46245e05fbdbd6fb24"},
+		{"abc", "a448017aaf21d8525fc10ae87aa6729d"},
+		{"message digest", "d9130a8164549fe818874806e1c7014b"},
+		{"abcdefghijklmnopqrstuvwxyz", "d79e1c308aa5bbcdeea8ed63df412da9"},
+		{"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789", "043f8582f241db351ce627e153e7f0e4"},
+		{strings.Repeat("1234567890", 8), "e33b4ddc9c38f2199c3e7b164fcc0536"},
+	} {
+		sum := md4Sum([]byte(tc.in))
+		if got := hex.EncodeToString(sum[:]); got != tc.want {
+			t.Errorf("md4Sum(%q) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+// zsyncFixture writes the control file of content the way zsyncmake does:
+// a header, then for each block, the last one padded with zeros, the low
+// bytes of its rolling checksum and the head of its MD4.
+func zsyncFixture(content []byte, blockSize, seqMatches, rsumBytes, sumBytes int, url string) []byte {
+	var b bytes.Buffer
+	sum := sha1.Sum(content)
+	fmt.Fprintf(&b, "zsync: 0.6.2\nFilename: f\nMTime: %s\nBlocksize: %v\nLength: %v\n",
+		time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC).Format(time.RFC1123Z), blockSize, len(content))
+	fmt.Fprintf(&b, "Hash-Lengths: %v,%v,%v\nURL: %s\nSHA-1: %x\n\n", seqMatches, rsumBytes, sumBytes, url, sum)
+	for from := 0; from < len(content); from += blockSize {
+		block := make([]byte, blockSize)
+		copy(block, content[from:])
+		a, s := rsum(block)
+		var r [4]byte
+		binary.BigEndian.PutUint32(r[:], uint32(a)<<16|uint32(s))
+		b.Write(r[4-rsumBytes:])
+		md4 := md4Sum(block)
+		b.Write(md4[:sumBytes])
+	}
+	return b.Bytes()
+}
+
+func TestSync(t *testing.T) {
+	// 40 blocks of 16 bytes, each of them unlike the others, the last one
+	// short.
+	var content bytes.Buffer
+	for i := range 40 {
+		fmt.Fprintf(&content, "block %09d\n", i)
+	}
+	content.WriteString("tail")
+	newer := content.Bytes()
+
+	for _, tc := range []struct {
+		name                            string
+		seqMatches, rsumBytes, sumBytes int
+	}{
+		{"single", 1, 4, 16},
+		{"paired", 2, 2, 5},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			fetched := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				switch req.URL.Path {
+				case "/f":
+					if req.Method == "GET" {
+						var from, to int
+						if _, err := fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-%d", &from, &to); err == nil {
+							mu.Lock()
+							fetched += to - from + 1
+							mu.Unlock()
+						}
+					}
+					http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(newer))
+				case "/f.zsync":
+					w.Write(zsyncFixture(newer, 16, tc.seqMatches, tc.rsumBytes, tc.sumBytes, "f"))
+				default:
+					http.NotFound(w, req)
+				}
+			}))
+			t.Cleanup(srv.Close)
+			testRun(t, func() {})
+
+			// The old copy lacks blocks 10 and 11, has block 25 changed,
+			// and starts with bytes the new one does not have.
+			dir := t.TempDir()
+			out := filepath.Join(dir, "out")
+			old := append([]byte("gocat stale header"), newer[:10*16]...)
+			old = append(old, newer[12*16:25*16]...)
+			old = append(old, []byte("block 99999999x\n")...)
+			old = append(old, newer[26*16:]...)
+			if err := os.WriteFile(out, old, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := syncFile(context.Background(), srv.URL+"/f", out, out); err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := os.ReadFile(out); !bytes.Equal(got, newer) {
+				t.Errorf("got %q", got)
+			}
+			if fi, err := os.Stat(out); err != nil || !fi.ModTime().Equal(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)) {
+				t.Errorf("mtime %v, %v", fi.ModTime(), err)
+			}
+			// Blocks 10, 11 and 25, and in pairs the ones before the gaps
+			// as well, are all that had to come over the network.
+			mu.Lock()
+			defer mu.Unlock()
+			if fetched == 0 || fetched > 5*16 {
+				t.Errorf("fetched %v bytes", fetched)
+			}
+		})
+	}
+}
+
+func TestSyncNoSeed(t *testing.T) {
+	newer := []byte("a file without an older copy\n")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/f":
+			http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(newer))
+		case "/f.zsync":
+			w.Write(zsyncFixture(newer, 16, 1, 4, 16, "f"))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	testRun(t, func() {})
+
+	out := filepath.Join(t.TempDir(), "out")
+	if err := syncFile(context.Background(), srv.URL+"/f.zsync", out, out); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(out); !bytes.Equal(got, newer) {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestSyncSHA1Mismatch(t *testing.T) {
+	newer := []byte("the file the control file was made for\n")
+	served := []byte("the file the server has now, not it...\n")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/f":
+			http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(served))
+		case "/f.zsync":
+			w.Write(zsyncFixture(newer, 16, 1, 4, 16, "f"))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	testRun(t, func() {})
+
+	out := filepath.Join(t.TempDir(), "out")
+	err := syncFile(context.Background(), srv.URL+"/f", out, out)
+	if err == nil || !strings.Contains(err.Error(), "SHA-1 of the assembled file") {
+		t.Errorf("got %v, want a SHA-1 mismatch", err)
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("the output was left behind: %v", err)
+	}
+	if _, err := os.Stat(out + ".part"); !os.IsNotExist(err) {
+		t.Errorf("the partial file was left behind: %v", err)
+	}
+}